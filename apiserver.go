@@ -3,63 +3,203 @@ package raft
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
+// apiServiceServer implements pb.APIService, which is served by the apiServer
+// alongside the HTTP API on the same listener, so that external clients can
+// apply logs with gRPC. Errors are carried in the responses.
 type apiServiceServer struct {
 	server *Server
+	// stopCh is closed when the apiServer shuts down to end the streams.
+	stopCh <-chan struct{}
 	pb.UnimplementedAPIServiceServer
 }
 
 func (s *apiServiceServer) Apply(ctx context.Context, body *pb.LogBody) (*pb.ApplyLogResponse, error) {
-	result, err := s.server.Apply(ctx, body.Copy()).Result()
-	if err != nil {
-		return &pb.ApplyLogResponse{
-			Response: &pb.ApplyLogResponse_Error{Error: err.Error()},
-		}, nil
+	return s.server.applyLogResponse(s.server.Apply(ctx, body)), nil
+}
+
+// ApplyBatch applies the logs received from the stream and sends the results
+// in the same order. Logs are enqueued without waiting for the results of the
+// previous ones, so the logs are appended in the order they are received when
+// the server is the leader.
+func (s *apiServiceServer) ApplyBatch(stream pb.APIService_ApplyBatchServer) error {
+	futures := make(chan ApplyFuture, apiApplyBatchWindow)
+	sendErrCh := make(chan error, 1)
+	go func() {
+		var sendErr error
+		for future := range futures {
+			if sendErr != nil {
+				// Drain the futures after the stream is broken.
+				continue
+			}
+			sendErr = stream.Send(s.server.applyLogResponse(future))
+		}
+		sendErrCh <- sendErr
+	}()
+
+	var recvErr error
+	for {
+		body, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				recvErr = err
+			}
+			break
+		}
+		futures <- s.server.Apply(stream.Context(), body)
+	}
+	close(futures)
+	if sendErr := <-sendErrCh; sendErr != nil {
+		return sendErr
 	}
-	return &pb.ApplyLogResponse{
-		Response: &pb.ApplyLogResponse_Meta{
-			Meta: &pb.LogMeta{Index: result.Index, Term: result.Term},
-		},
-	}, nil
+	return recvErr
 }
 
 func (s *apiServiceServer) ApplyCommand(ctx context.Context, cmd *pb.Command) (*pb.ApplyLogResponse, error) {
-	result, err := s.server.ApplyCommand(ctx, cmd.Data).Result()
+	return s.server.applyLogResponse(s.server.ApplyCommand(ctx, cmd.Data)), nil
+}
+
+func (s *apiServiceServer) ChangeMembership(
+	ctx context.Context, request *pb.MembershipChangeRequest,
+) (*pb.MembershipChangeResponse, error) {
+	if err := s.server.changeMembership(ctx, request); err != nil {
+		return &pb.MembershipChangeResponse{Error: err.Error()}, nil
+	}
+	return &pb.MembershipChangeResponse{}, nil
+}
+
+func (s *apiServiceServer) ReadIndex(ctx context.Context, _ *pb.ReadIndexRequest) (*pb.ReadIndexResponse, error) {
+	index, err := s.server.ReadIndex(ctx)
 	if err != nil {
-		return &pb.ApplyLogResponse{
-			Response: &pb.ApplyLogResponse_Error{
-				Error: err.Error(),
-			},
-		}, nil
+		return &pb.ReadIndexResponse{Error: err.Error()}, nil
 	}
-	return &pb.ApplyLogResponse{
-		Response: &pb.ApplyLogResponse_Meta{
-			Meta: &pb.LogMeta{Index: result.Index, Term: result.Term},
-		},
-	}, nil
+	return &pb.ReadIndexResponse{Index: index}, nil
+}
+
+// WatchLogs streams the applied logs. ErrLogsCompacted is reported with
+// codes.OutOfRange so that the clients know to restart from a snapshot.
+func (s *apiServiceServer) WatchLogs(request *pb.WatchLogsRequest, stream pb.APIService_WatchLogsServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := s.server.WatchLogs(ctx, request.FromIndex, request.Types, stream.Send)
+	if errors.Is(err, ErrLogsCompacted) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	return err
 }
 
 type apiMembersAddRequest struct {
-	Id       string `json:"id"`
-	Endpoint string `json:"endpoint"`
+	Id       string            `json:"id"`
+	Endpoint string            `json:"endpoint"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	NonVoter bool              `json:"non_voter,omitempty"`
+}
+
+type apiMembersUpdateRequest struct {
+	Endpoint string            `json:"endpoint"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type apiLeadershipTransferRequest struct {
+	Id string `json:"id"`
+}
+
+type apiLeaderResponse struct {
+	Leader *pb.Peer `json:"leader"`
+	Known  bool     `json:"known"`
+	Term   uint64   `json:"term"`
+}
+
+type apiConfiguration struct {
+	LogIndex  uint64     `json:"log_index"`
+	Joint     bool       `json:"joint"`
+	Current   []*pb.Peer `json:"current"`
+	Next      []*pb.Peer `json:"next,omitempty"`
+	Staging   []*pb.Peer `json:"staging,omitempty"`
+	Initiator string     `json:"initiator,omitempty"`
+}
+
+func newAPIConfiguration(c *configuration) apiConfiguration {
+	ac := apiConfiguration{LogIndex: c.LogIndex(), Joint: c.Joint(), Current: []*pb.Peer{}, Initiator: c.Initiator}
+	if c.Current != nil {
+		ac.Current = append(ac.Current, c.Current.Peers...)
+	}
+	if c.Next != nil {
+		ac.Next = append([]*pb.Peer{}, c.Next.Peers...)
+	}
+	if len(c.Staging) > 0 {
+		ac.Staging = append([]*pb.Peer{}, c.Staging...)
+	}
+	return ac
+}
+
+// apiConfigurationRecord is a committed configuration in the history, whose
+// term is omitted if it's unknown.
+type apiConfigurationRecord struct {
+	apiConfiguration
+	Term uint64 `json:"term,omitempty"`
+}
+
+type apiMembersResponse struct {
+	Committed apiConfiguration `json:"committed"`
+	Latest    apiConfiguration `json:"latest"`
+}
+
+type apiSnapshotResponse struct {
+	Id    string `json:"id"`
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+}
+
+type apiSnapshotVerifyResponse struct {
+	Id    string `json:"id"`
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Size  uint64 `json:"size"`
+	CRC64 uint64 `json:"crc64"`
 }
 
 type apiErrorResponse struct {
-	Error error `json:"error"`
+	Error string `json:"error"`
 }
 
+const (
+	// apiApplyBatchWindow is the number of logs in ApplyBatch that are
+	// enqueued ahead of the results being sent.
+	apiApplyBatchWindow = 256
+
+	apiEventsBufferSize        = 64
+	apiEventsKeepaliveInterval = 15 * time.Second
+)
+
 type apiServerRouters struct {
 	root   *mux.Router
 	api    *mux.Router
@@ -67,10 +207,27 @@ type apiServerRouters struct {
 	apiV1  *mux.Router
 }
 
+// APIExtension adds the routes of an application to the API server. The
+// router serves the routes under /api/extension.
 type APIExtension interface {
 	Setup(s *Server, r *mux.Router) error
 }
 
+// APIGRPCExtension is an optional interface for those APIExtensions that
+// register their own gRPC services, which are served on the same listener as
+// the API server.
+type APIGRPCExtension interface {
+	RegisterGRPC(s *Server, registrar grpc.ServiceRegistrar) error
+}
+
+// APIReadOnlyGRPCExtension is an optional interface for those
+// APIGRPCExtensions whose gRPC methods, given in the form of
+// "/package.Service/Method", are accessible with APIAccessReadOnly. Other
+// methods require APIAccessAdmin.
+type APIReadOnlyGRPCExtension interface {
+	ReadOnlyGRPCMethods() []string
+}
+
 type apiServer struct {
 	server *Server
 
@@ -81,41 +238,146 @@ type apiServer struct {
 
 	routers    apiServerRouters
 	extensions []APIExtension
+
+	// readOnlyGRPCMethods are the gRPC methods accessible with
+	// APIAccessReadOnly.
+	readOnlyGRPCMethods map[string]struct{}
+
+	// stopCh is closed on shutdown to end the long-lived streams, which would
+	// otherwise keep the connections from being drained.
+	stopCh   chan struct{}
+	stopOnce sync.Once
 }
 
 func newAPIServer(server *Server, extensions ...APIExtension) *apiServer {
 	s := &apiServer{
-		server:     server,
-		grpcServer: grpc.NewServer(),
+		server: server,
+		grpcServer: grpc.NewServer(
+			grpc.ChainUnaryInterceptor(traceUnaryServerInterceptor),
+			grpc.ChainStreamInterceptor(traceStreamServerInterceptor)),
 		routers:    apiServerRouters{},
 		extensions: extensions,
+		stopCh:     make(chan struct{}),
+	}
+	s.apiSvcSvr = &apiServiceServer{server: server, stopCh: s.stopCh}
+	Must1(s.registerServices(s.grpcServer))
+
+	s.readOnlyGRPCMethods = map[string]struct{}{}
+	for method := range apiReadOnlyGRPCMethods {
+		s.readOnlyGRPCMethods[method] = struct{}{}
+	}
+	for _, extension := range extensions {
+		if e, ok := extension.(APIReadOnlyGRPCExtension); ok {
+			for _, method := range e.ReadOnlyGRPCMethods() {
+				s.readOnlyGRPCMethods[method] = struct{}{}
+			}
+		}
 	}
-	s.apiSvcSvr = &apiServiceServer{server: server}
-	pb.RegisterAPIServiceServer(s.grpcServer, s.apiSvcSvr)
 
 	// Bind HTTP handler with GRPC handler
 	httpHandler, grpcHandler := s.setupRouters(), s.grpcServer
-	httpGRPCHandler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+	var httpGRPCHandler http.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(withAuditActor(r.Context(), apiRequestActor(r)))
+		if isGRPCRequest(r) {
 			grpcHandler.ServeHTTP(rw, r)
 			return
 		}
-		httpHandler.ServeHTTP(rw, r)
+		httpHandler.ServeHTTP(rw, r.WithContext(incomingHTTPTraceContext(r)))
 	})
+	if authenticate := server.opts().apiAuthenticator; authenticate != nil {
+		httpGRPCHandler = s.authHandler(authenticate, httpGRPCHandler)
+	}
 
 	// Configure HTTP server with HTTP/2
 	http2Server := &http2.Server{}
 
-	// With TLS ...
-	// s.httpServer = &http.Server{Handler: httpGRPCHandler}
-	// Must1(http2.ConfigureServer(httpServer, http2Server))
-
-	// Without TLS ...
+	// HTTP/2 is negotiated with ALPN when serving with TLS, see Serve(), and
+	// h2c is used otherwise.
 	s.httpServer = &http.Server{Handler: h2c.NewHandler(httpGRPCHandler, http2Server)}
 
 	return s
 }
 
+// registerServices registers the gRPC services of the apiServer.
+func (s *apiServer) registerServices(registrar grpc.ServiceRegistrar) error {
+	pb.RegisterAPIServiceServer(registrar, s.apiSvcSvr)
+	healthpb.RegisterHealthServer(registrar, newHealthService(s.server.healthy, pb.APIService_ServiceDesc.ServiceName))
+	for _, extension := range s.extensions {
+		if e, ok := extension.(APIGRPCExtension); ok {
+			if err := e.RegisterGRPC(s.server, registrar); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// membershipErrorResponse maps the errors of membership changes to the
+// responses.
+func membershipErrorResponse(rw http.ResponseWriter, err error) (interface{}, int, error) {
+	var noLeaderErr *NoLeaderError
+	switch {
+	case errors.As(err, &noLeaderErr):
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(noLeaderErr.RetryAfter.Seconds()))))
+		return apiErrorResponse{Error: err.Error()}, http.StatusServiceUnavailable, nil
+	case errors.Is(err, ErrPeerExists), errors.Is(err, ErrInJointConsensus),
+		errors.Is(err, ErrNotInJointConsensus), errors.Is(err, ErrTransitionCommitted):
+		return apiErrorResponse{Error: err.Error()}, http.StatusConflict, nil
+	case errors.Is(err, ErrUnknownPeer):
+		return apiErrorResponse{Error: err.Error()}, http.StatusNotFound, nil
+	case errors.Is(err, ErrCatchUpTimeout):
+		return apiErrorResponse{Error: err.Error()}, http.StatusGatewayTimeout, nil
+	}
+	return apiErrorResponse{Error: err.Error()}, http.StatusBadRequest, nil
+}
+
+// serveEvents streams the events of the server as server-sent events until the
+// client goes away. Each event is named after its type and carries the Event
+// encoded in JSON.
+func (s *apiServer) serveEvents(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, _ error) {
+			return apiErrorResponse{Error: "streaming is not supported"}, http.StatusInternalServerError, nil
+		})
+		return
+	}
+	events, cancel := s.server.Subscribe(apiEventsBufferSize)
+	defer cancel()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(apiEventsKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopCh:
+			return
+		case <-keepalive.C:
+			// Comments keep idle connections from being closed by proxies.
+			if _, err := io.WriteString(rw, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				s.server.logger.Warnw("error occurred encoding the event", logFields(s.server, zap.Error(err))...)
+				continue
+			}
+			if _, err := fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
 // setupRouters sets up the routers and returns the root router
 func (s *apiServer) setupRouters() *mux.Router {
 	s.routers.root = mux.NewRouter()
@@ -137,20 +399,175 @@ func (s *apiServer) setupRouters() *mux.Router {
 			}
 			result, err := s.server.Apply(r.Context(), &pb.LogBody{Type: pb.LogType_COMMAND, Data: bodyData}).Result()
 			if err != nil {
+				var noLeaderErr *NoLeaderError
+				if errors.As(err, &noLeaderErr) {
+					rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(noLeaderErr.RetryAfter.Seconds()))))
+					return apiErrorResponse{Error: err.Error()}, http.StatusServiceUnavailable, nil
+				}
 				return nil, 0, err
 			}
 			return result, 0, nil
 		})
 	}).Methods("POST")
 
+	s.routers.apiV1.HandleFunc("/logs/export", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		var from, to uint64
+		for key, v := range map[string]*uint64{"from": &from, "to": &to} {
+			if value := r.URL.Query().Get(key); value != "" {
+				n, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					h.JSONFunc(func() (v interface{}, statusCode int, _ error) {
+						return apiErrorResponse{Error: err.Error()}, http.StatusBadRequest, nil
+					})
+					return
+				}
+				*v = n
+			}
+		}
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		if _, err := s.server.ExportLogs(rw, from, to); err != nil {
+			s.server.logger.Warnw("error occurred exporting logs", logFields(s.server, zap.Error(err))...)
+		}
+	}).Methods("GET")
+
+	s.routers.apiV1.HandleFunc("/query", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		errorFn := func(err error, statusCode int) {
+			h.JSONFunc(func() (v interface{}, _ int, _ error) {
+				return apiErrorResponse{Error: err.Error()}, statusCode, nil
+			})
+		}
+		consistency := ReadLinearizable
+		if value := r.URL.Query().Get("consistency"); value != "" {
+			c, err := ParseReadConsistency(value)
+			if err != nil {
+				errorFn(err, http.StatusBadRequest)
+				return
+			}
+			consistency = c
+		}
+		var minIndex uint64
+		if value := r.URL.Query().Get("min_index"); value != "" {
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				errorFn(err, http.StatusBadRequest)
+				return
+			}
+			minIndex = n
+		}
+		query, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			errorFn(err, http.StatusBadRequest)
+			return
+		}
+		result, err := s.server.Query(r.Context(), consistency, minIndex, query)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrNonLeader):
+				errorFn(err, http.StatusMisdirectedRequest)
+			case errors.Is(err, ErrNoQueryHandler):
+				errorFn(err, http.StatusNotImplemented)
+			case errors.Is(err, ErrDeadlineExceeded):
+				errorFn(err, http.StatusGatewayTimeout)
+			default:
+				errorFn(err, http.StatusInternalServerError)
+			}
+			return
+		}
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		rw.Write(result)
+	}).Methods("POST")
+
 	s.routers.apiV1.HandleFunc("/states", func(rw http.ResponseWriter, r *http.Request) {
 		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
 		h.JSON(s.server.States())
 	}).Methods("GET")
 
+	s.routers.apiV1.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSON(s.server.States())
+	}).Methods("GET")
+
+	s.routers.apiV1.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, _ error) {
+			health := s.server.Health()
+			if !health.Healthy {
+				statusCode = http.StatusServiceUnavailable
+			}
+			return health, statusCode, nil
+		})
+	}).Methods("GET")
+
+	s.routers.apiV1.HandleFunc("/audit", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, err error) {
+			var since time.Time
+			if value := r.URL.Query().Get("since"); value != "" {
+				if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+					return apiErrorResponse{Error: err.Error()}, http.StatusBadRequest, nil
+				}
+			}
+			var limit int
+			if value := r.URL.Query().Get("limit"); value != "" {
+				if limit, err = strconv.Atoi(value); err != nil {
+					return apiErrorResponse{Error: err.Error()}, http.StatusBadRequest, nil
+				}
+			}
+			records, err := s.server.AuditRecords(since, limit)
+			if errors.Is(err, ErrAuditLogDisabled) {
+				return apiErrorResponse{Error: err.Error()}, http.StatusNotImplemented, nil
+			}
+			return records, 0, err
+		})
+	}).Methods("GET")
+
+	s.routers.apiV1.HandleFunc("/leader", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		leader := s.server.Leader()
+		h.JSON(apiLeaderResponse{Leader: leader, Known: leader.Id != "", Term: s.server.currentTerm()})
+	}).Methods("GET")
+
+	s.routers.apiV1.HandleFunc("/leadership/transfer", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, err error) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return nil, 0, err
+			}
+			// The target is optional.
+			var apiRequest apiLeadershipTransferRequest
+			if len(body) > 0 {
+				if err := json.Unmarshal(body, &apiRequest); err != nil {
+					return apiErrorResponse{Error: err.Error()}, http.StatusBadRequest, nil
+				}
+			}
+			if err := s.server.TransferLeadership(r.Context(), apiRequest.Id); err != nil {
+				switch {
+				case errors.Is(err, ErrNonLeader):
+					return apiErrorResponse{Error: err.Error()}, http.StatusMisdirectedRequest, nil
+				case errors.Is(err, ErrUnknownPeer):
+					return apiErrorResponse{Error: err.Error()}, http.StatusNotFound, nil
+				case errors.Is(err, ErrNoTransferTarget), errors.Is(err, ErrLeadershipTransfer):
+					return apiErrorResponse{Error: err.Error()}, http.StatusConflict, nil
+				case errors.Is(err, ErrDeadlineExceeded):
+					return apiErrorResponse{Error: err.Error()}, http.StatusGatewayTimeout, nil
+				}
+				return nil, 0, err
+			}
+			return nil, http.StatusNoContent, nil
+		})
+	}).Methods("POST")
+
+	s.routers.apiV1.HandleFunc("/events", s.serveEvents).Methods("GET")
+
 	s.routers.apiV1.HandleFunc("/members", func(rw http.ResponseWriter, r *http.Request) {
 		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
-		h.JSON(s.server.confStore.Latest().Peers())
+		h.JSON(apiMembersResponse{
+			Committed: newAPIConfiguration(s.server.confStore.Committed()),
+			Latest:    newAPIConfiguration(s.server.confStore.Latest()),
+		})
 	}).Methods("GET")
 
 	s.routers.apiV1.HandleFunc("/members", func(rw http.ResponseWriter, r *http.Request) {
@@ -164,16 +581,160 @@ func (s *apiServer) setupRouters() *mux.Router {
 			if err := json.Unmarshal(body, &apiRequest); err != nil {
 				return nil, 0, err
 			}
-			if err := s.server.Register(&pb.Peer{
-				Id:       apiRequest.Id,
+			peer := &pb.Peer{Id: apiRequest.Id, Endpoint: apiRequest.Endpoint, Metadata: apiRequest.Metadata}
+			if apiRequest.NonVoter {
+				peer.Suffrage = pb.Suffrage_SUFFRAGE_NON_VOTER
+			}
+			if err := s.server.AddPeer(r.Context(), peer); err != nil {
+				return membershipErrorResponse(rw, err)
+			}
+			return nil, http.StatusNoContent, nil
+		})
+	}).Methods("POST")
+
+	s.routers.apiV1.HandleFunc("/members/history", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		records := []apiConfigurationRecord{}
+		for _, record := range s.server.confStore.History() {
+			records = append(records, apiConfigurationRecord{
+				apiConfiguration: newAPIConfiguration(newConfiguration(record.Configuration, record.Index)),
+				Term:             record.Term,
+			})
+		}
+		h.JSON(records)
+	}).Methods("GET")
+
+	s.routers.apiV1.HandleFunc("/members/abort", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, err error) {
+			if err := s.server.AbortTransition(r.Context()); err != nil {
+				return membershipErrorResponse(rw, err)
+			}
+			return nil, http.StatusNoContent, nil
+		})
+	}).Methods("POST")
+
+	s.routers.apiV1.HandleFunc("/members/{id}/promote", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, err error) {
+			if err := s.server.PromotePeer(r.Context(), mux.Vars(r)["id"]); err != nil {
+				return membershipErrorResponse(rw, err)
+			}
+			return nil, http.StatusNoContent, nil
+		})
+	}).Methods("POST")
+
+	s.routers.apiV1.HandleFunc("/members/{id}", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, err error) {
+			if err := s.server.RemovePeer(r.Context(), mux.Vars(r)["id"]); err != nil {
+				return membershipErrorResponse(rw, err)
+			}
+			return nil, http.StatusNoContent, nil
+		})
+	}).Methods("DELETE")
+
+	s.routers.apiV1.HandleFunc("/members/{id}", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, err error) {
+			var apiRequest apiMembersUpdateRequest
+			if err := json.NewDecoder(r.Body).Decode(&apiRequest); err != nil {
+				return apiErrorResponse{Error: err.Error()}, http.StatusBadRequest, nil
+			}
+			if err := s.server.UpdatePeer(r.Context(), &pb.Peer{
+				Id:       mux.Vars(r)["id"],
 				Endpoint: apiRequest.Endpoint,
+				Metadata: apiRequest.Metadata,
 			}); err != nil {
-				return apiErrorResponse{Error: err}, http.StatusBadRequest, nil
+				return membershipErrorResponse(rw, err)
 			}
 			return nil, http.StatusNoContent, nil
 		})
+	}).Methods("PUT")
+
+	storageHandler := func(fn func() (StorageStats, error)) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+			h.JSONFunc(func() (v interface{}, statusCode int, err error) {
+				stats, err := fn()
+				if err != nil {
+					if errors.Is(err, ErrCompactionUnsupported) {
+						return apiErrorResponse{Error: err.Error()}, http.StatusNotImplemented, nil
+					}
+					return nil, 0, err
+				}
+				return stats, 0, nil
+			})
+		}
+	}
+
+	if handler, ok := s.server.opts().metricsExporter.(http.Handler); ok {
+		s.routers.root.Handle("/metrics", handler).Methods("GET")
+	}
+
+	s.routers.apiV1.HandleFunc("/storage", storageHandler(s.server.StorageStats)).Methods("GET")
+
+	s.routers.apiV1.HandleFunc("/storage/compact", storageHandler(s.server.CompactStorage)).Methods("POST")
+
+	s.routers.apiV1.HandleFunc("/snapshots", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, err error) {
+			meta, err := s.server.Snapshot().Result()
+			if err != nil {
+				if errors.Is(err, ErrNothingToSnapshot) {
+					return apiErrorResponse{Error: err.Error()}, http.StatusConflict, nil
+				}
+				return nil, 0, err
+			}
+			return apiSnapshotResponse{Id: meta.Id(), Index: meta.Index(), Term: meta.Term()}, 0, nil
+		})
 	}).Methods("POST")
 
+	s.routers.apiV1.HandleFunc("/snapshots/restore", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, err error) {
+			meta, err := s.server.Restore(r.Context(), r.Body)
+			if err != nil {
+				switch {
+				case errors.Is(err, ErrNonLeader):
+					return apiErrorResponse{Error: err.Error()}, http.StatusMisdirectedRequest, nil
+				case errors.Is(err, ErrInJointConsensus):
+					return apiErrorResponse{Error: err.Error()}, http.StatusConflict, nil
+				}
+				return nil, 0, err
+			}
+			return apiSnapshotResponse{Id: meta.Id(), Index: meta.Index(), Term: meta.Term()}, 0, nil
+		})
+	}).Methods("POST")
+
+	s.routers.apiV1.HandleFunc("/snapshots/{id}/verify", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSONFunc(func() (v interface{}, statusCode int, err error) {
+			meta, err := s.server.VerifySnapshot(mux.Vars(r)["id"])
+			if err != nil {
+				switch {
+				case errors.Is(err, ErrSnapshotChecksumUnsupported):
+					return apiErrorResponse{Error: err.Error()}, http.StatusNotImplemented, nil
+				case errors.Is(err, ErrCorruptedSnapshot):
+					return apiErrorResponse{Error: err.Error()}, http.StatusUnprocessableEntity, nil
+				}
+				return nil, 0, err
+			}
+			checksumMeta := meta.(SnapshotChecksumMeta)
+			return apiSnapshotVerifyResponse{
+				Id:    meta.Id(),
+				Index: meta.Index(),
+				Term:  meta.Term(),
+				Size:  checksumMeta.Size(),
+				CRC64: checksumMeta.CRC64(),
+			}, 0, nil
+		})
+	}).Methods("POST")
+
+	if s.server.opts().debugToken != "" {
+		s.setupDebugRouter(s.server.opts().debugToken)
+	}
+
 	for _, extension := range s.extensions {
 		Must1(extension.Setup(s.server, s.routers.apiExt))
 	}
@@ -182,13 +743,37 @@ func (s *apiServer) setupRouters() *mux.Router {
 }
 
 func (s *apiServer) Serve(listener net.Listener) error {
+	tlsConfig := s.server.opts().apiServerTLSConfig
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
 	s.server.logger.Infow("API server started",
 		logFields(s.server,
 			"address", listener.Addr(),
-			"endpoint", fmt.Sprintf("http://%s", listener.Addr()))...)
+			"endpoint", fmt.Sprintf("%s://%s", scheme, listener.Addr()))...)
+	if tlsConfig != nil {
+		s.httpServer.TLSConfig = tlsConfig.Clone()
+		if err := http2.ConfigureServer(s.httpServer, &http2.Server{}); err != nil {
+			return err
+		}
+		return s.httpServer.ServeTLS(listener, "", "")
+	}
 	return s.httpServer.Serve(listener)
 }
 
+// Shutdown stops accepting connections, ends the streams, and waits for the
+// requests in flight to complete until ctx is done, after which the remaining
+// connections are closed.
+func (s *apiServer) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.httpServer.Close()
+		return err
+	}
+	return nil
+}
+
 func (s *apiServer) Stop() error {
-	return s.httpServer.Shutdown(context.Background())
+	return s.Shutdown(context.Background())
 }
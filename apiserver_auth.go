@@ -0,0 +1,145 @@
+package raft
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sumimakito/raft/pb"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// APIAccessLevel is the level of access to the API server granted to a
+// request. Higher levels include the lower ones.
+type APIAccessLevel uint8
+
+const (
+	// APIAccessNone grants no access.
+	APIAccessNone APIAccessLevel = iota
+	// APIAccessReadOnly grants access to the endpoints that do not change the
+	// cluster, e.g., the status, the members, and the queries.
+	APIAccessReadOnly
+	// APIAccessAdmin grants access to all endpoints, including applying logs,
+	// membership changes, snapshots, and the debug endpoints.
+	APIAccessAdmin
+)
+
+func (l APIAccessLevel) String() string {
+	switch l {
+	case APIAccessNone:
+		return "None"
+	case APIAccessReadOnly:
+		return "ReadOnly"
+	case APIAccessAdmin:
+		return "Admin"
+	}
+	return "Unknown"
+}
+
+// APIAuthenticator authenticates the requests to the API server, including
+// the gRPC ones, and returns the access level granted to the request. Errors
+// are reported as unauthenticated.
+type APIAuthenticator func(r *http.Request) (APIAccessLevel, error)
+
+// TokenAuthenticator grants the access levels of the bearer tokens in the
+// "Authorization: Bearer <token>" header.
+func TokenAuthenticator(tokens map[string]APIAccessLevel) APIAuthenticator {
+	return func(r *http.Request) (APIAccessLevel, error) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return APIAccessNone, ErrUnauthenticated
+		}
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for t, level := range tokens {
+			if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+				return level, nil
+			}
+		}
+		return APIAccessNone, ErrUnauthenticated
+	}
+}
+
+// MTLSAuthenticator grants the access levels of the common names in the
+// verified client certificates. The API server must be configured to verify
+// the client certificates with APIServerTLSOption.
+func MTLSAuthenticator(commonNames map[string]APIAccessLevel) APIAuthenticator {
+	return func(r *http.Request) (APIAccessLevel, error) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return APIAccessNone, ErrUnauthenticated
+		}
+		level, ok := commonNames[r.TLS.VerifiedChains[0][0].Subject.CommonName]
+		if !ok {
+			return APIAccessNone, ErrUnauthenticated
+		}
+		return level, nil
+	}
+}
+
+// apiReadOnlyGRPCMethods are the built-in gRPC methods accessible with
+// APIAccessReadOnly.
+var apiReadOnlyGRPCMethods = map[string]struct{}{
+	"/" + pb.APIService_ServiceDesc.ServiceName + "/ReadIndex": {},
+	"/" + pb.APIService_ServiceDesc.ServiceName + "/WatchLogs": {},
+	"/" + healthpb.Health_ServiceDesc.ServiceName + "/Check":   {},
+	"/" + healthpb.Health_ServiceDesc.ServiceName + "/Watch":   {},
+}
+
+func isGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// requiredAccessLevel returns the access level required by the request.
+func (s *apiServer) requiredAccessLevel(r *http.Request) APIAccessLevel {
+	if isGRPCRequest(r) {
+		if _, ok := s.readOnlyGRPCMethods[r.URL.Path]; ok {
+			return APIAccessReadOnly
+		}
+		return APIAccessAdmin
+	}
+	if strings.HasPrefix(r.URL.Path, "/debug/") {
+		return APIAccessAdmin
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.URL.Path == "/api/v1/query" {
+		return APIAccessReadOnly
+	}
+	return APIAccessAdmin
+}
+
+// authHandler rejects the requests that are not granted the access level
+// they require by the APIAuthenticator.
+func (s *apiServer) authHandler(authenticate APIAuthenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		level, err := authenticate(r)
+		if err != nil {
+			s.authError(rw, r, http.StatusUnauthorized, codes.Unauthenticated, ErrUnauthenticated.Error())
+			return
+		}
+		if required := s.requiredAccessLevel(r); level < required {
+			s.authError(rw, r, http.StatusForbidden, codes.PermissionDenied,
+				"access level "+required.String()+" is required")
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// authError responds with the error in the form the client expects, i.e.,
+// a gRPC status for gRPC requests and a JSON error otherwise.
+func (s *apiServer) authError(rw http.ResponseWriter, r *http.Request, statusCode int, code codes.Code, message string) {
+	if isGRPCRequest(r) {
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+		rw.Header().Set("Grpc-Message", message)
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+	if statusCode == http.StatusUnauthorized {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+	h.JSONFunc(func() (v interface{}, _ int, _ error) {
+		return apiErrorResponse{Error: message}, statusCode, nil
+	})
+}
@@ -0,0 +1,92 @@
+package raft
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type apiRuntimeStats struct {
+	GoVersion    string `json:"go_version"`
+	NumCPU       int    `json:"num_cpu"`
+	GOMAXPROCS   int    `json:"gomaxprocs"`
+	NumGoroutine int    `json:"num_goroutine"`
+	NumCgoCall   int64  `json:"num_cgo_call"`
+
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	Sys          uint64 `json:"sys"`
+	TotalAlloc   uint64 `json:"total_alloc"`
+	Mallocs      uint64 `json:"mallocs"`
+	Frees        uint64 `json:"frees"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+	LastGC       uint64 `json:"last_gc"`
+}
+
+func newAPIRuntimeStats() apiRuntimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return apiRuntimeStats{
+		GoVersion:    runtime.Version(),
+		NumCPU:       runtime.NumCPU(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumGoroutine: runtime.NumGoroutine(),
+		NumCgoCall:   runtime.NumCgoCall(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapObjects:  m.HeapObjects,
+		Sys:          m.Sys,
+		TotalAlloc:   m.TotalAlloc,
+		Mallocs:      m.Mallocs,
+		Frees:        m.Frees,
+		NumGC:        m.NumGC,
+		PauseTotalNs: m.PauseTotalNs,
+		LastGC:       m.LastGC,
+	}
+}
+
+// debugAuthMiddleware rejects the requests without the bearer token.
+func debugAuthMiddleware(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// setupDebugRouter mounts the profiling, runtime, and queue endpoints under
+// /debug, which are only accessible with the token.
+func (s *apiServer) setupDebugRouter(token string) {
+	debug := s.routers.root.PathPrefix("/debug").Subrouter()
+	debug.Use(debugAuthMiddleware(token))
+
+	debug.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+	debug.HandleFunc("/pprof/profile", pprof.Profile)
+	debug.HandleFunc("/pprof/symbol", pprof.Symbol)
+	debug.HandleFunc("/pprof/trace", pprof.Trace)
+	// Index also serves the named profiles, e.g., /debug/pprof/heap.
+	debug.PathPrefix("/pprof/").HandlerFunc(pprof.Index)
+
+	debug.HandleFunc("/runtime", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSON(newAPIRuntimeStats())
+	}).Methods("GET")
+
+	debug.HandleFunc("/queues", func(rw http.ResponseWriter, r *http.Request) {
+		h := NewHandyRespWriter(rw, s.server.logger.Desugar())
+		h.JSON(s.server.QueueDepths())
+	}).Methods("GET")
+}
@@ -0,0 +1,469 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPIServiceServer(t *testing.T) {
+	server := testingServer(t, RetryPolicyOption(ConstantRetryPolicy{MaxAttempts: 1}))
+	apiServer := newAPIServer(server)
+	listener := ƒAssertNoError2(net.Listen("tcp", "127.0.0.1:0"))(t)
+	go apiServer.Serve(listener)
+	defer apiServer.Stop()
+
+	conn := ƒAssertNoError2(grpc.Dial(listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials())))(t)
+	defer conn.Close()
+	client := pb.NewAPIServiceClient(conn)
+
+	// The request reaches the server and fails since there's no leader.
+	response := ƒAssertNoError2(client.ApplyCommand(context.Background(), &pb.Command{Data: []byte("command")}))(t)
+	assert.Contains(t, response.GetError(), ErrNoLeader.Error())
+}
+
+func TestAPIServerClusterEndpoints(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	peer1, peer2 := &pb.Peer{Id: "1", Endpoint: "1"}, &pb.Peer{Id: "2", Endpoint: "2"}
+	committed := newConfiguration(&pb.Configuration{Current: &pb.Config{Peers: []*pb.Peer{peer1}}}, 1)
+	server.confStore.SetCommitted(committed)
+	server.confStore.SetLatest(newConfiguration(committed.CopyInitiateTransition(&pb.Config{Peers: []*pb.Peer{peer1, peer2}}), 2))
+	server.setLeader(peer1)
+	apiServer := newAPIServer(server)
+
+	getFn := func(path string, v interface{}) {
+		recorder := httptest.NewRecorder()
+		apiServer.routers.root.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), v))
+	}
+
+	var status ServerStates
+	getFn("/api/v1/status", &status)
+	assert.Equal(t, server.id, status.ID)
+	assert.Equal(t, Follower.String(), status.Role)
+
+	var leader apiLeaderResponse
+	getFn("/api/v1/leader", &leader)
+	assert.True(t, leader.Known)
+	assert.Equal(t, "1", leader.Leader.Id)
+
+	var members apiMembersResponse
+	getFn("/api/v1/members", &members)
+	assert.Equal(t, uint64(1), members.Committed.LogIndex)
+	assert.False(t, members.Committed.Joint)
+	assert.Len(t, members.Committed.Current, 1)
+	assert.Equal(t, uint64(2), members.Latest.LogIndex)
+	assert.True(t, members.Latest.Joint)
+	assert.Len(t, members.Latest.Next, 2)
+
+	var history []apiConfigurationRecord
+	getFn("/api/v1/members/history", &history)
+	assert.Empty(t, history)
+	committed.Initiator = "admin"
+	server.confStore.record(ConfigurationRecord{Index: 1, Term: 2, Configuration: committed.Configuration})
+	getFn("/api/v1/members/history", &history)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, uint64(1), history[0].LogIndex)
+		assert.Equal(t, uint64(2), history[0].Term)
+		assert.Equal(t, "admin", history[0].Initiator)
+		assert.Len(t, history[0].Current, 1)
+	}
+}
+
+func TestAPIServerLeadershipTransfer(t *testing.T) {
+	server := testingServer(t)
+	apiServer := newAPIServer(server)
+
+	transferFn := func(body string) (int, apiErrorResponse) {
+		recorder := httptest.NewRecorder()
+		apiServer.routers.root.ServeHTTP(recorder,
+			httptest.NewRequest(http.MethodPost, "/api/v1/leadership/transfer", strings.NewReader(body)))
+		var response apiErrorResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response
+	}
+
+	code, response := transferFn("")
+	assert.Equal(t, http.StatusMisdirectedRequest, code)
+	assert.Equal(t, ErrNonLeader.Error(), response.Error)
+
+	code, _ = transferFn(`{"id":`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, response = transferFn(`{"id":"2"}`)
+	assert.Equal(t, http.StatusMisdirectedRequest, code)
+	assert.Equal(t, ErrNonLeader.Error(), response.Error)
+}
+
+func TestAPIServerEvents(t *testing.T) {
+	server := testingServer(t)
+	apiServer := newAPIServer(server)
+	listener := ƒAssertNoError2(net.Listen("tcp", "127.0.0.1:0"))(t)
+	go apiServer.Serve(listener)
+	defer apiServer.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request := ƒAssertNoError2(http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://"+listener.Addr().String()+"/api/v1/events", nil))(t)
+	response := ƒAssertNoError2(http.DefaultClient.Do(request))(t)
+	defer response.Body.Close()
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	// The subscription is in place once the headers are received.
+	server.setRole(Candidate)
+	server.setLeader(&pb.Peer{Id: "1", Endpoint: "1"})
+
+	reader := bufio.NewReader(response.Body)
+	readEvent := func() (string, Event) {
+		var name string
+		var event Event
+		for {
+			line := strings.TrimSpace(ƒAssertNoError2(reader.ReadString('\n'))(t))
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			case line == "":
+				return name, event
+			}
+		}
+	}
+
+	name, event := readEvent()
+	assert.Equal(t, string(EventRoleChanged), name)
+	assert.Equal(t, EventRoleChanged, event.Type)
+	assert.Equal(t, Candidate.String(), event.Data)
+
+	name, event = readEvent()
+	assert.Equal(t, string(EventLeaderChanged), name)
+	assert.Equal(t, "1", event.Data.(map[string]interface{})["id"])
+}
+
+func TestAPIServerDebugEndpoints(t *testing.T) {
+	serveFn := func(apiServer *apiServer, path, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		apiServer.routers.root.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// The endpoints are not mounted by default.
+	apiServer := newAPIServer(testingServer(t))
+	assert.Equal(t, http.StatusNotFound, serveFn(apiServer, "/debug/runtime", "").Code)
+
+	apiServer = newAPIServer(testingServer(t, DebugEndpointsOption("secret")))
+	assert.Equal(t, http.StatusUnauthorized, serveFn(apiServer, "/debug/runtime", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serveFn(apiServer, "/debug/pprof/heap", "wrong").Code)
+
+	recorder := serveFn(apiServer, "/debug/runtime", "secret")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var stats apiRuntimeStats
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &stats))
+	assert.Greater(t, stats.NumGoroutine, 0)
+
+	recorder = serveFn(apiServer, "/debug/queues", "secret")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var queues QueueDepths
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &queues))
+	assert.Equal(t, cap(apiServer.server.trans.RPC()), queues.TransportRPC.Capacity)
+
+	assert.Equal(t, http.StatusOK, serveFn(apiServer, "/debug/pprof/", "secret").Code)
+	assert.Equal(t, http.StatusOK, serveFn(apiServer, "/debug/pprof/heap", "secret").Code)
+}
+
+func TestAPIServiceServerApplyBatch(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.logOpsCh = make(chan logStoreOp)
+	defer close(server.logOpsCh)
+	go func() {
+		var lastApplied uint64
+		for op := range server.logOpsCh {
+			server.handleLogOp(op)
+			// Apply the logs at once as if they were committed, with the
+			// results echoing the commands.
+			for ; lastApplied < server.lastLogIndex(); lastApplied++ {
+				log := Must2(server.logStore.Entry(lastApplied + 1))
+				server.applyResponses.resolve(log.Meta, log.Body.Data, nil)
+			}
+		}
+	}()
+	server.setRole(Leader)
+	apiServer := newAPIServer(server)
+	listener := ƒAssertNoError2(net.Listen("tcp", "127.0.0.1:0"))(t)
+	go apiServer.Serve(listener)
+	defer apiServer.Stop()
+
+	conn := ƒAssertNoError2(grpc.Dial(listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials())))(t)
+	defer conn.Close()
+	stream := ƒAssertNoError2(pb.NewAPIServiceClient(conn).ApplyBatch(context.Background()))(t)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		assert.NoError(t, stream.Send(&pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte{byte(i)}}))
+	}
+	assert.NoError(t, stream.CloseSend())
+	for i := 0; i < n; i++ {
+		response := ƒAssertNoError2(stream.Recv())(t)
+		// The logs are appended in the order they are sent.
+		assert.Equal(t, uint64(i+1), response.GetMeta().GetIndex())
+		assert.Equal(t, []byte{byte(i)}, response.Result)
+	}
+	_, err := stream.Recv()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestAPIServerQuery(t *testing.T) {
+	server := testingServer(t, QueryHandlerOption(func(ctx context.Context, query []byte) ([]byte, error) {
+		return append([]byte("result of "), query...), nil
+	}))
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{
+		Peers: []*pb.Peer{{Id: server.id, Endpoint: "1"}, {Id: "2", Endpoint: "2"}, {Id: "3", Endpoint: "3"}},
+	}}, 1))
+	server.serverState.stateCurrentTerm = 1
+	server.setCommitIndex(2)
+	server.setLastApplied(2, 1)
+	apiServer := newAPIServer(server)
+
+	queryFn := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		apiServer.routers.root.ServeHTTP(recorder,
+			httptest.NewRequest(http.MethodPost, path, strings.NewReader("query")))
+		return recorder
+	}
+
+	recorder := queryFn("/api/v1/query?consistency=stale&min_index=2")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "result of query", recorder.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, queryFn("/api/v1/query?consistency=eventual").Code)
+	// Linearizable reads are only served by the leader.
+	assert.Equal(t, http.StatusMisdirectedRequest, queryFn("/api/v1/query").Code)
+
+	// The lease holds with the acknowledgement from one of the followers.
+	server.setRole(Leader)
+	assert.False(t, server.leaseHolds())
+	server.replScheduler.setLastContact("2", time.Now())
+	assert.True(t, server.leaseHolds())
+	recorder = queryFn("/api/v1/query?consistency=lease")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "result of query", recorder.Body.String())
+
+	apiServer = newAPIServer(testingServer(t))
+	assert.Equal(t, http.StatusNotImplemented, queryFn("/api/v1/query?consistency=stale").Code)
+}
+
+// testingWriteCert writes a self-signed key pair for 127.0.0.1 with the
+// serial number to the files.
+func testingWriteCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key := ƒAssertNoError2(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER := ƒAssertNoError2(x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key))(t)
+	keyDER := ƒAssertNoError2(x509.MarshalECPrivateKey(key))(t)
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func TestAPIServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	testingWriteCert(t, certFile, keyFile, 1)
+
+	server := testingServer(t, APIServerTLSCertFilesOption(certFile, keyFile))
+	apiServer := newAPIServer(server)
+	listener := ƒAssertNoError2(net.Listen("tcp", "127.0.0.1:0"))(t)
+	go apiServer.Serve(listener)
+	defer apiServer.Stop()
+
+	serialFn := func() int64 {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		defer client.CloseIdleConnections()
+		response := ƒAssertNoError2(client.Get("https://" + listener.Addr().String() + "/api/v1/status"))(t)
+		defer response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, 2, response.ProtoMajor)
+		return response.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(1), serialFn())
+
+	// The renewed key pair is served without restarting.
+	testingWriteCert(t, certFile, keyFile, 2)
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, future, future))
+	time.Sleep(certReloadInterval)
+	assert.Equal(t, int64(2), serialFn())
+}
+
+type testingTokenCredentials string
+
+func (c testingTokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(c)}, nil
+}
+
+func (c testingTokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+func TestAPIServerAuth(t *testing.T) {
+	server := testingServer(t,
+		RetryPolicyOption(ConstantRetryPolicy{MaxAttempts: 1}),
+		APIAuthenticatorOption(TokenAuthenticator(map[string]APIAccessLevel{
+			"reader": APIAccessReadOnly,
+			"admin":  APIAccessAdmin,
+		})))
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	apiServer := newAPIServer(server)
+	listener := ƒAssertNoError2(net.Listen("tcp", "127.0.0.1:0"))(t)
+	go apiServer.Serve(listener)
+	defer apiServer.Stop()
+
+	requestFn := func(method, path, token string) int {
+		request := ƒAssertNoError2(http.NewRequest(method, "http://"+listener.Addr().String()+path, nil))(t)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := ƒAssertNoError2(http.DefaultClient.Do(request))(t)
+		response.Body.Close()
+		return response.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, requestFn(http.MethodGet, "/api/v1/status", ""))
+	assert.Equal(t, http.StatusUnauthorized, requestFn(http.MethodGet, "/api/v1/status", "unknown"))
+	assert.Equal(t, http.StatusOK, requestFn(http.MethodGet, "/api/v1/status", "reader"))
+	assert.Equal(t, http.StatusForbidden, requestFn(http.MethodDelete, "/api/v1/members/1", "reader"))
+	assert.NotEqual(t, http.StatusForbidden, requestFn(http.MethodDelete, "/api/v1/members/1", "admin"))
+
+	grpcClientFn := func(token string) *grpc.ClientConn {
+		conn := ƒAssertNoError2(grpc.Dial(listener.Addr().String(),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithPerRPCCredentials(testingTokenCredentials(token))))(t)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	reader, admin := grpcClientFn("reader"), grpcClientFn("admin")
+	_, err := pb.NewAPIServiceClient(reader).ApplyCommand(context.Background(), &pb.Command{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = healthpb.NewHealthClient(reader).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	_, err = pb.NewAPIServiceClient(admin).ApplyCommand(context.Background(), &pb.Command{})
+	assert.NoError(t, err)
+	_, err = pb.NewAPIServiceClient(grpcClientFn("unknown")).ApplyCommand(context.Background(), &pb.Command{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+type testingAPIExtension struct{}
+
+func (testingAPIExtension) Setup(s *Server, r *mux.Router) error {
+	r.HandleFunc("/hello", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("hello"))
+	}).Methods("GET")
+	return nil
+}
+
+func (testingAPIExtension) RegisterGRPC(s *Server, registrar grpc.ServiceRegistrar) error {
+	pb.RegisterTransportServer(registrar, &pb.UnimplementedTransportServer{})
+	return nil
+}
+
+func (testingAPIExtension) ReadOnlyGRPCMethods() []string {
+	return []string{"/" + pb.Transport_ServiceDesc.ServiceName + "/AppendEntries"}
+}
+
+func TestAPIServerExtension(t *testing.T) {
+	server := testingServer(t, APIAuthenticatorOption(TokenAuthenticator(map[string]APIAccessLevel{
+		"reader": APIAccessReadOnly,
+	})))
+	apiServer := newAPIServer(server, testingAPIExtension{})
+	listener := ƒAssertNoError2(net.Listen("tcp", "127.0.0.1:0"))(t)
+	go apiServer.Serve(listener)
+	defer apiServer.Stop()
+
+	request := ƒAssertNoError2(http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/api/extension/hello", nil))(t)
+	request.Header.Set("Authorization", "Bearer reader")
+	response := ƒAssertNoError2(http.DefaultClient.Do(request))(t)
+	defer response.Body.Close()
+	assert.Equal(t, "hello", string(ƒAssertNoError2(io.ReadAll(response.Body))(t)))
+
+	conn := ƒAssertNoError2(grpc.Dial(listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(testingTokenCredentials("reader"))))(t)
+	defer conn.Close()
+	client := pb.NewTransportClient(conn)
+	// The service of the extension is reached.
+	_, err := client.AppendEntries(context.Background(), &pb.AppendEntriesRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.RequestVote(context.Background(), &pb.RequestVoteRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestServerAPIHandler(t *testing.T) {
+	server := testingServer(t, APIServerEnabledOption(false))
+	server.apiServer = newAPIServer(server, testingAPIExtension{})
+	defer server.apiServer.Stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/", server.APIHandler())
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+	response := ƒAssertNoError2(http.Get(httpServer.URL + "/api/extension/hello"))(t)
+	defer response.Body.Close()
+	assert.Equal(t, "hello", string(ƒAssertNoError2(io.ReadAll(response.Body))(t)))
+
+	grpcServer := grpc.NewServer()
+	assert.NoError(t, server.RegisterAPIServices(grpcServer))
+	listener := ƒAssertNoError2(net.Listen("tcp", "127.0.0.1:0"))(t)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn := ƒAssertNoError2(grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials())))(t)
+	defer conn.Close()
+	// The service of the extension is registered on the host gRPC server.
+	_, err := pb.NewTransportClient(conn).AppendEntries(context.Background(), &pb.AppendEntriesRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = pb.NewAPIServiceClient(conn).ReadIndex(context.Background(), &pb.ReadIndexRequest{})
+	assert.NotEqual(t, codes.Unimplemented, status.Code(err))
+}
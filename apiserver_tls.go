@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is the minimum interval between checks on the
+// certificate files for changes.
+const certReloadInterval = 1 * time.Second
+
+// certFileReloader loads the key pair from the files and reloads it once the
+// files are modified, so that renewed certificates are served without
+// restarting the server.
+type certFileReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex // protects the fields below
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertFileReloader(certFile, keyFile string) *certFileReloader {
+	return &certFileReloader{certFile: certFile, keyFile: keyFile}
+}
+
+// latestModTime returns the latest modification time of the files.
+func (r *certFileReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. The last loaded key
+// pair is kept if the files fail to reload.
+func (r *certFileReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil && time.Since(r.checkedAt) < certReloadInterval {
+		return r.cert, nil
+	}
+	r.checkedAt = time.Now()
+	modTime, err := r.latestModTime()
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	r.cert, r.modTime = &cert, modTime
+	return r.cert, nil
+}
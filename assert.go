@@ -18,3 +18,10 @@ func ƒAssertNoError2[T any](v T, err error) func(t *testing.T) T {
 		return v
 	}
 }
+
+func ƒAssertNoError3[T1 any, T2 any](v1 T1, v2 T2, err error) func(t *testing.T) (T1, T2) {
+	return func(t *testing.T) (T1, T2) {
+		assert.NoError(t, err)
+		return v1, v2
+	}
+}
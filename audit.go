@@ -0,0 +1,231 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap"
+)
+
+// AuditAction is the action recorded in an AuditRecord.
+type AuditAction string
+
+const (
+	// AuditConfigurationChanged is recorded when the latest configuration
+	// changes. Detail is the new configuration.
+	AuditConfigurationChanged AuditAction = "configuration_changed"
+	// AuditMembershipChangeRequested is recorded when a peer is requested to
+	// be added or removed on the server. Detail is the change.
+	AuditMembershipChangeRequested AuditAction = "membership_change_requested"
+	// AuditDeadServerRemoved is recorded when the leader initiates the
+	// removal of a voter unreachable beyond the threshold of the
+	// DeadServerPolicy. Detail is the voter.
+	AuditDeadServerRemoved AuditAction = "dead_server_removed"
+	// AuditLeadershipAcquired is recorded when the server becomes the leader.
+	AuditLeadershipAcquired AuditAction = "leadership_acquired"
+	// AuditLeadershipLost is recorded when the server is no longer the leader.
+	AuditLeadershipLost AuditAction = "leadership_lost"
+	// AuditLeaderChanged is recorded when the server discovers a new leader.
+	// Detail is the new leader.
+	AuditLeaderChanged AuditAction = "leader_changed"
+	// AuditLeadershipTransferRequested is recorded when the leadership is
+	// requested to be transferred. Detail is the ID of the target, if any.
+	AuditLeadershipTransferRequested AuditAction = "leadership_transfer_requested"
+	// AuditSnapshotRestored is recorded when a snapshot provided by the user
+	// has been restored with Server.Restore. Detail is the snapshot.
+	AuditSnapshotRestored AuditAction = "snapshot_restored"
+	// AuditLogsTruncated is recorded when the inconsistent logs are truncated
+	// on startup by LogCheckTruncate. Detail is the inconsistency.
+	AuditLogsTruncated AuditAction = "logs_truncated"
+	// AuditConfigurationRecovered is recorded when the configuration is
+	// replaced on startup with the recovery file set by RecoveryFileOption.
+	// Detail is the recovered configuration.
+	AuditConfigurationRecovered AuditAction = "configuration_recovered"
+)
+
+// AuditRecord is a record in the audit trail of the membership and leadership
+// changes and the forced recoveries.
+type AuditRecord struct {
+	Time     time.Time   `json:"time"`
+	Action   AuditAction `json:"action"`
+	ServerID string      `json:"server_id"`
+	Term     uint64      `json:"term"`
+	// Actor is the client that requested the action through the API, or
+	// empty if the action is taken by the cluster itself or requested by the
+	// code embedding the server.
+	Actor     string          `json:"actor,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Detail    json.RawMessage `json:"detail,omitempty"`
+}
+
+// AuditLog persists the audit records in an append-only manner.
+type AuditLog interface {
+	Append(record AuditRecord) error
+	// Records returns the records at or after since in the order they were
+	// appended, up to limit records if limit is positive.
+	Records(since time.Time, limit int) ([]AuditRecord, error)
+}
+
+// FileAuditLog is an AuditLog that appends the records to a file as JSON
+// lines. Each record is synced before Append returns.
+type FileAuditLog struct {
+	mu   sync.Mutex // protects file
+	path string
+	file *os.File
+}
+
+// NewFileAuditLog opens the file at the path as a FileAuditLog. The file is
+// created if it does not exist.
+func NewFileAuditLog(path string) (*FileAuditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// Terminate the torn record, if any, so that it's not joined with the
+	// next one.
+	if info, err := file.Stat(); err != nil {
+		file.Close()
+		return nil, err
+	} else if size := info.Size(); size > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, size-1); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if last[0] != '\n' {
+			if _, err := file.Write([]byte{'\n'}); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+	}
+	return &FileAuditLog{path: path, file: file}, nil
+}
+
+func (l *FileAuditLog) Append(record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Records reads the records from the file. The torn records, i.e., those
+// left incomplete by a crash, are skipped.
+func (l *FileAuditLog) Records(since time.Time, limit int) ([]AuditRecord, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records := []AuditRecord{}
+	reader := bufio.NewReader(file)
+	for limit <= 0 || len(records) < limit {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// The record without a line break is torn or being appended.
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			continue
+		}
+		if !record.Time.Before(since) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (l *FileAuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// auditMembershipChange is the detail of AuditMembershipChangeRequested.
+type auditMembershipChange struct {
+	Type string   `json:"type"`
+	Peer *pb.Peer `json:"peer,omitempty"`
+}
+
+// auditActorKey is the context key of the actor of the audit records.
+type auditActorKey struct{}
+
+func withAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// initiator returns who initiates the request with ctx, which is recorded in
+// the configurations: the actor of the API request, or the server itself.
+func (s *Server) initiator(ctx context.Context) string {
+	if actor, _ := ctx.Value(auditActorKey{}).(string); actor != "" {
+		return actor
+	}
+	return s.id
+}
+
+// apiRequestActor identifies the client of an API request by the common name
+// in its verified certificate, or by its address otherwise.
+func apiRequestActor(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return r.RemoteAddr
+}
+
+// audit appends a record of the action to the AuditLog, if any. The actor and
+// the request ID are read from ctx. Errors are logged since the actions have
+// been taken.
+func (s *Server) audit(ctx context.Context, action AuditAction, detail interface{}) {
+	auditLog := s.opts().auditLog
+	if auditLog == nil {
+		return
+	}
+	actor, _ := ctx.Value(auditActorKey{}).(string)
+	record := AuditRecord{
+		Time:      s.opts().clock.Now(),
+		Action:    action,
+		ServerID:  s.id,
+		Term:      s.currentTerm(),
+		Actor:     actor,
+		RequestID: RequestID(ctx),
+	}
+	if detail != nil {
+		data, err := json.Marshal(detail)
+		if err != nil {
+			s.logger.Warnw("error encoding the audit record",
+				logFields(s, zap.Error(err), zap.String("action", string(action)))...)
+		}
+		record.Detail = data
+	}
+	if err := auditLog.Append(record); err != nil {
+		s.logger.Warnw("error appending the audit record",
+			logFields(s, zap.Error(err), zap.String("action", string(action)))...)
+	}
+}
+
+// AuditRecords returns the audit records at or after since, up to limit
+// records if limit is positive. ErrAuditLogDisabled is returned if no AuditLog
+// is set with AuditLogOption.
+func (s *Server) AuditRecords(since time.Time, limit int) ([]AuditRecord, error) {
+	auditLog := s.opts().auditLog
+	if auditLog == nil {
+		return nil, ErrAuditLogDisabled
+	}
+	return auditLog.Records(since, limit)
+}
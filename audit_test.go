@@ -0,0 +1,78 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog := ƒAssertNoError2(NewFileAuditLog(path))(t)
+	start := time.Unix(1000, 0).UTC()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, auditLog.Append(AuditRecord{
+			Time:   start.Add(time.Duration(i) * time.Second),
+			Action: AuditLeadershipAcquired,
+			Term:   uint64(i + 1),
+		}))
+	}
+	assert.NoError(t, auditLog.Close())
+
+	// A torn record left by a crash is skipped after reopening.
+	file := ƒAssertNoError2(os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0))(t)
+	ƒAssertNoError2(file.Write([]byte(`{"time":"`)))(t)
+	assert.NoError(t, file.Close())
+	auditLog = ƒAssertNoError2(NewFileAuditLog(path))(t)
+	defer auditLog.Close()
+	assert.NoError(t, auditLog.Append(AuditRecord{Time: start.Add(3 * time.Second), Action: AuditLeadershipLost, Term: 4}))
+
+	terms := func(records []AuditRecord) (terms []uint64) {
+		for _, record := range records {
+			terms = append(terms, record.Term)
+		}
+		return
+	}
+	assert.Equal(t, []uint64{1, 2, 3, 4}, terms(ƒAssertNoError2(auditLog.Records(time.Time{}, 0))(t)))
+	assert.Equal(t, []uint64{2, 3}, terms(ƒAssertNoError2(auditLog.Records(start.Add(time.Second), 2))(t)))
+}
+
+func TestServerAudit(t *testing.T) {
+	auditLog := ƒAssertNoError2(NewFileAuditLog(filepath.Join(t.TempDir(), "audit.log")))(t)
+	defer auditLog.Close()
+	server := testingServer(t, AuditLogOption(auditLog))
+	server.serverState.stateCurrentTerm = 2
+
+	server.alterLeader(&pb.Peer{Id: "2", Endpoint: "2"})
+	ctx := withAuditActor(WithRequestID(context.Background(), "request"), "client")
+	server.audit(ctx, AuditLeadershipTransferRequested, "3")
+
+	recorder := httptest.NewRecorder()
+	newAPIServer(server).routers.root.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var records []AuditRecord
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &records))
+	assert.Len(t, records, 2)
+	assert.Equal(t, AuditLeaderChanged, records[0].Action)
+	assert.Equal(t, server.id, records[0].ServerID)
+	assert.Equal(t, uint64(2), records[0].Term)
+	assert.Empty(t, records[0].Actor)
+	assert.JSONEq(t, `{"id":"2","endpoint":"2"}`, string(records[0].Detail))
+	assert.Equal(t, AuditLeadershipTransferRequested, records[1].Action)
+	assert.Equal(t, "client", records[1].Actor)
+	assert.Equal(t, "request", records[1].RequestID)
+	assert.JSONEq(t, `"3"`, string(records[1].Detail))
+
+	recorder = httptest.NewRecorder()
+	newAPIServer(testingServer(t)).routers.root.ServeHTTP(recorder,
+		httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil))
+	assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+}
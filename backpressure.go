@@ -0,0 +1,137 @@
+package raft
+
+import (
+	"context"
+	"sync"
+)
+
+// BackpressurePolicy bounds the logs the leader has appended but not yet
+// committed, so that the log and the memory don't grow without bound while a
+// quorum of the followers is unreachable. Apply is rejected with
+// ErrProposalDropped, or blocked if Block is set, once a limit is reached. The
+// limits are checked when Apply is called, so the logs applied concurrently
+// may exceed them slightly.
+type BackpressurePolicy struct {
+	// MaxUncommittedEntries is the number of the uncommitted logs. Zero means
+	// no limit.
+	MaxUncommittedEntries uint64
+	// MaxUncommittedBytes is the total size of the data of the uncommitted
+	// logs appended in the term. Zero means no limit.
+	MaxUncommittedBytes uint64
+	// Block makes Apply wait until the uncommitted logs are within the limits
+	// or its context is done, instead of failing right away.
+	Block bool
+}
+
+// uncommittedLog is the size of the data of an uncommitted log.
+type uncommittedLog struct {
+	index uint64
+	size  uint64
+}
+
+// uncommittedLogs tracks the sizes of the logs the leader has appended in the
+// term that are yet to be committed.
+type uncommittedLogs struct {
+	mu    sync.Mutex // protects logs, bytes, and shrinkCh
+	logs  []uncommittedLog
+	bytes uint64
+	// shrinkCh is closed when the logs are committed or reset. It's only
+	// created when there are waiters.
+	shrinkCh chan struct{}
+}
+
+func (u *uncommittedLogs) add(index, size uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.logs = append(u.logs, uncommittedLog{index: index, size: size})
+	u.bytes += size
+}
+
+// commit drops the logs up to commitIndex.
+func (u *uncommittedLogs) commit(commitIndex uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n := 0
+	for n < len(u.logs) && u.logs[n].index <= commitIndex {
+		u.bytes -= u.logs[n].size
+		n++
+	}
+	u.logs = u.logs[n:]
+	u.notifyLocked()
+}
+
+func (u *uncommittedLogs) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.logs, u.bytes = nil, 0
+	u.notifyLocked()
+}
+
+// shrunk returns a channel that is closed the next time the logs are committed
+// or reset.
+func (u *uncommittedLogs) shrunk() <-chan struct{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.shrinkCh == nil {
+		u.shrinkCh = make(chan struct{})
+	}
+	return u.shrinkCh
+}
+
+// notifyLocked wakes the waiters of shrunk. u.mu must be held.
+func (u *uncommittedLogs) notifyLocked() {
+	if u.shrinkCh != nil {
+		close(u.shrinkCh)
+		u.shrinkCh = nil
+	}
+}
+
+func (u *uncommittedLogs) Bytes() uint64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.bytes
+}
+
+// uncommittedExceeded reports whether the uncommitted logs have reached a
+// limit of the policy.
+func (s *Server) uncommittedExceeded(policy BackpressurePolicy) bool {
+	if n := policy.MaxUncommittedEntries; n > 0 {
+		if lastLogIndex, commitIndex := s.lastLogIndex(), s.commitIndex(); lastLogIndex > commitIndex && lastLogIndex-commitIndex >= n {
+			return true
+		}
+	}
+	return policy.MaxUncommittedBytes > 0 && s.uncommitted.Bytes() >= policy.MaxUncommittedBytes
+}
+
+// waitBackpressure returns ErrProposalDropped if the uncommitted logs have
+// reached a limit of the BackpressurePolicy, or waits until they are within
+// the limits if the policy blocks. The waiters are woken by the commits, and by
+// the leader loop when the leadership is lost. Should only be called on the
+// leader.
+func (s *Server) waitBackpressure(ctx context.Context) error {
+	policy := s.opts().backpressurePolicy
+	if !s.uncommittedExceeded(policy) {
+		return nil
+	}
+	if !policy.Block {
+		return ErrProposalDropped
+	}
+	for {
+		// The channel is taken before the checks so that no commit is missed.
+		shrunk := s.uncommitted.shrunk()
+		if !s.uncommittedExceeded(policy) {
+			return nil
+		}
+		if s.shutdownState() {
+			return ErrServerShutdown
+		}
+		if s.role() != Leader {
+			return ErrNonLeader
+		}
+		select {
+		case <-ctx.Done():
+			return ErrDeadlineExceeded
+		case <-shrunk:
+		}
+	}
+}
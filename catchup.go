@@ -0,0 +1,138 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap"
+)
+
+// CatchUpPolicy decides when a staging server has caught up with the leader,
+// so that the configuration transition promoting it to a voter can be
+// initiated. The logs are replicated to the server before the transition, as
+// the commits of the joint configuration wait for the server otherwise, which
+// makes the cluster unavailable if it trails far behind.
+type CatchUpPolicy struct {
+	// MaxTrailingLogs is the number of logs the server may trail the last log
+	// of the leader by.
+	MaxTrailingLogs uint64
+	// MaxLag is how long ago the server may have last matched the last log of
+	// the leader, which is met under a steady load even if MaxTrailingLogs is
+	// not. Zero disables the check.
+	MaxLag time.Duration
+	// Timeout is how long AddPeer waits for the server to catch up before the
+	// server is unstaged and ErrCatchUpTimeout is returned. Zero means no
+	// limit other than the context of the request.
+	Timeout time.Duration
+}
+
+func (p CatchUpPolicy) validate() error {
+	if p.MaxLag < 0 {
+		return fmt.Errorf("catch-up max lag %v is negative", p.MaxLag)
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("catch-up timeout %v is negative", p.Timeout)
+	}
+	return nil
+}
+
+// caughtUp reports whether the peer has caught up with the leader by the
+// policy. The peer must have responded to the leader in the term.
+func (r *replScheduler) caughtUp(serverID string, policy CatchUpPolicy) bool {
+	if r.lastContact(serverID).IsZero() {
+		return false
+	}
+	lastLogIndex, matchIndex := r.server.lastLogIndex(), r.matchIndex(serverID)
+	if matchIndex >= lastLogIndex || lastLogIndex-matchIndex <= policy.MaxTrailingLogs {
+		return true
+	}
+	if policy.MaxLag > 0 {
+		matchedAt := r.matchedAt(serverID)
+		return !matchedAt.IsZero() && r.server.opts().clock.Now().Sub(matchedAt) <= policy.MaxLag
+	}
+	return false
+}
+
+// notifyStaging signals the leader loop to promote the staging peers if the
+// peer is staging and has caught up with the leader.
+func (r *replScheduler) notifyStaging(serverID string) {
+	if _, ok := r.server.confStore.Latest().StagingPeer(serverID); !ok {
+		return
+	}
+	if !r.caughtUp(serverID, r.server.opts().catchUpPolicy) {
+		return
+	}
+	select {
+	case r.server.stagingCh <- struct{}{}:
+	default:
+	}
+}
+
+// promoteStaging initiates the configuration transition adding a staging peer
+// that has caught up with the leader. The other staging peers are promoted
+// after the transition completes. Should only be called in the leader loop.
+func (s *Server) promoteStaging() {
+	latest := s.confStore.Latest()
+	if latest.Joint() {
+		return
+	}
+	for _, peer := range latest.Staging {
+		if !s.replScheduler.caughtUp(peer.Id, s.opts().catchUpPolicy) {
+			continue
+		}
+		s.logger.Infow("the staging peer has caught up",
+			logFields(s, zap.Object("peer", peer), "match_index", s.replScheduler.matchIndex(peer.Id))...)
+		if err := s.confStore.promote(peer); err != nil {
+			s.logger.Warnw("error occurred promoting the staging peer",
+				logFields(s, zap.Object("peer", peer), zap.Error(err))...)
+		}
+		return
+	}
+}
+
+// catchUp stages the peer, and waits until it's promoted to the voting
+// configuration by the leader. The peer is unstaged if it does not catch up
+// with the leader within the timeout of the CatchUpPolicy or before ctx is
+// done. The initiator of the request is recorded in the configurations.
+// Should only be called on the leader.
+func (s *Server) catchUp(ctx context.Context, peer *pb.Peer, initiator string) error {
+	if policy := s.opts().catchUpPolicy; policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+	if err := s.confStore.stage(peer, initiator); err != nil {
+		return err
+	}
+	ticker := s.opts().clock.NewTicker(s.opts().heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		latest := s.confStore.Latest()
+		if _, ok := latest.Peer(peer.Id); ok {
+			return nil
+		}
+		if _, ok := latest.StagingPeer(peer.Id); !ok {
+			// The peer is removed while staging.
+			return fmt.Errorf("%w: %s", ErrUnknownPeer, peer.Id)
+		}
+		if s.role() != Leader {
+			return ErrNonLeader
+		}
+		select {
+		case <-ctx.Done():
+			matchIndex := s.replScheduler.matchIndex(peer.Id)
+			if err := s.confStore.unstage(peer.Id, initiator); err != nil {
+				return err
+			}
+			if _, ok := s.confStore.Latest().Peer(peer.Id); ok {
+				// Promoted in the meantime.
+				return nil
+			}
+			return fmt.Errorf("%w: %s is at log %d of %d", ErrCatchUpTimeout,
+				peer.Id, matchIndex, s.lastLogIndex())
+		case <-ticker.C():
+		}
+	}
+}
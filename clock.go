@@ -0,0 +1,228 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the time and the timers used by the server, e.g., the
+// election timers, the heartbeats, and the snapshot scheduler. A ManualClock
+// makes them deterministic in tests.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a timer created by a Clock. See time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a ticker created by a Clock. See time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock backed by the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// ManualClock is a Clock whose time only moves forward with Advance. The
+// timers and the tickers fire in the order of their deadlines during Advance,
+// and those with the same deadline in the order they were set. Like
+// time.Ticker, a ticker drops the ticks its receiver is not ready for.
+type ManualClock struct {
+	mu     sync.Mutex // protects now, timers, and seq
+	now    time.Time
+	timers map[*manualTimer]struct{}
+	// seq orders the timers set with the same deadline.
+	seq uint64
+}
+
+// NewManualClock returns a ManualClock starting at now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now, timers: map[*manualTimer]struct{}{}}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, 0)
+}
+
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for ManualClock.NewTicker")
+	}
+	return manualTicker{c.newTimer(d, d)}
+}
+
+func (c *ManualClock) newTimer(d, period time.Duration) *manualTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{clock: c, ch: make(chan time.Time, 1), deadline: c.now.Add(d), period: period}
+	c.seq++
+	t.seq = c.seq
+	c.timers[t] = struct{}{}
+	c.fire()
+	return t
+}
+
+// Advance moves the time forward by d and fires the timers due by then.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	target := c.now.Add(d)
+	for c.fireNextLocked(target) {
+	}
+	c.now = target
+}
+
+// nextDeadline returns the earliest deadline of the active timers, if any.
+func (c *ManualClock) nextDeadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if next := c.next(); next != nil {
+		return next.deadline, true
+	}
+	return time.Time{}, false
+}
+
+// fireNext moves the time to the earliest deadline not after limit, and fires
+// the first timer due then, leaving the others with the same deadline to the
+// following calls. It reports whether a timer has fired.
+func (c *ManualClock) fireNext(limit time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fireNextLocked(limit)
+}
+
+func (c *ManualClock) fireNextLocked(limit time.Time) bool {
+	next := c.next()
+	if next == nil || next.deadline.After(limit) {
+		return false
+	}
+	c.now = next.deadline
+	c.fireTimer(next)
+	return true
+}
+
+// Timers returns the number of the active timers and tickers, which helps
+// tests wait for the timers to be set before advancing the time.
+func (c *ManualClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// next returns the timer with the earliest deadline, or the first set among
+// those with the same deadline.
+func (c *ManualClock) next() *manualTimer {
+	var next *manualTimer
+	for t := range c.timers {
+		if next == nil || t.deadline.Before(next.deadline) || t.deadline.Equal(next.deadline) && t.seq < next.seq {
+			next = t
+		}
+	}
+	return next
+}
+
+// fire fires the timers due by now.
+func (c *ManualClock) fire() {
+	for c.fireNextLocked(c.now) {
+	}
+}
+
+// fireTimer sends the time to the timer, and reschedules it if it's a ticker.
+func (c *ManualClock) fireTimer(t *manualTimer) {
+	select {
+	case t.ch <- c.now:
+	default:
+	}
+	if t.period > 0 {
+		for !t.deadline.After(c.now) {
+			t.deadline = t.deadline.Add(t.period)
+		}
+		c.seq++
+		t.seq = c.seq
+	} else {
+		delete(c.timers, t)
+	}
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	ch       chan time.Time
+	deadline time.Time     // protected by clock.mu
+	seq      uint64        // protected by clock.mu
+	period   time.Duration // zero for the timers
+}
+
+type manualTicker struct {
+	*manualTimer
+}
+
+func (t manualTicker) Stop() {
+	t.manualTimer.Stop()
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return active
+}
+
+func (t *manualTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, active := t.clock.timers[t]
+	t.deadline = t.clock.now.Add(d)
+	t.clock.seq++
+	t.seq = t.clock.seq
+	t.clock.timers[t] = struct{}{}
+	t.clock.fire()
+	return active
+}
@@ -0,0 +1,72 @@
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewManualClock(start)
+
+	timer := clock.NewTimer(3 * time.Second)
+	ticker := clock.NewTicker(2 * time.Second)
+	assert.Equal(t, 2, clock.Timers())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), clock.Now())
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	case <-ticker.C():
+		t.Fatal("ticker fired early")
+	default:
+	}
+
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, start.Add(2*time.Second), <-ticker.C())
+	assert.Equal(t, start.Add(3*time.Second), <-timer.C())
+	assert.False(t, timer.Stop())
+	assert.Equal(t, 1, clock.Timers())
+
+	assert.False(t, timer.Reset(time.Second))
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(4*time.Second), <-timer.C())
+	assert.Equal(t, start.Add(4*time.Second), <-ticker.C())
+
+	ticker.Stop()
+	clock.Advance(10 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("stopped ticker fired")
+	default:
+	}
+	assert.Equal(t, 0, clock.Timers())
+}
+
+func TestServerRandomTimer(t *testing.T) {
+	offsets := func() (offsets []time.Duration) {
+		clock := NewManualClock(time.Unix(0, 0))
+		server := testingServer(t, ClockOption(clock), RandSeedOption(1))
+		for i := 0; i < 8; i++ {
+			timer := server.randomTimer(time.Second)
+			var elapsed time.Duration
+			for fired := false; !fired; {
+				select {
+				case <-timer.C():
+					fired = true
+				default:
+					clock.Advance(time.Millisecond)
+					elapsed += time.Millisecond
+				}
+			}
+			assert.GreaterOrEqual(t, elapsed, time.Second)
+			assert.LessOrEqual(t, elapsed, time.Second+time.Duration(0.3*float64(time.Second)))
+			offsets = append(offsets, elapsed)
+		}
+		return
+	}
+	assert.Equal(t, offsets(), offsets())
+}
@@ -0,0 +1,377 @@
+package raft_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+	"github.com/sumimakito/raft/rafttest"
+	"google.golang.org/protobuf/proto"
+)
+
+func assertCommandsApplied(t *testing.T, c *rafttest.Cluster, commands []raft.Command) {
+	t.Helper()
+	for _, server := range c.Servers() {
+		assert.Equal(t, commands, c.StateMachine(server.Id()).(*rafttest.StateMachine).Commands(), server.Id())
+	}
+}
+
+func TestClusterReplication(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{})
+
+	var commands []raft.Command
+	var index uint64
+	for i := 0; i < 10; i++ {
+		command := raft.Command(fmt.Sprint(i))
+		commands = append(commands, command)
+		index = c.Apply(command)
+	}
+	c.WaitForApplied(index)
+	assertCommandsApplied(t, c, commands)
+}
+
+func TestClusterLeaderIsolation(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{Servers: 5})
+
+	commands := []raft.Command{raft.Command("before")}
+	c.Apply(commands[0])
+
+	leader := c.WaitForLeader()
+	c.Isolate(leader.Id())
+	// The isolated leader cannot commit the logs, which are replaced once the
+	// leader rejoins.
+	isolated := leader.ApplyCommand(context.Background(), raft.Command("isolated"))
+
+	newLeader := c.WaitForLeader()
+	assert.NotEqual(t, leader.Id(), newLeader.Id())
+	commands = append(commands, raft.Command("after"))
+	index := c.Apply(commands[1])
+
+	c.Heal()
+	c.WaitForApplied(index)
+	assertCommandsApplied(t, c, commands)
+	_, err := isolated.Response()
+	assert.ErrorIs(t, err, raft.ErrLeadershipLost)
+}
+
+func TestClusterPartition(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{Servers: 5})
+
+	c.Partition([]string{"1", "2"}, []string{"3", "4", "5"})
+	leader := c.WaitForLeader()
+	assert.Contains(t, []string{"3", "4", "5"}, leader.Id())
+	index := c.Apply(raft.Command("majority"))
+	c.WaitForApplied(index, "3", "4", "5")
+
+	c.Heal()
+	c.WaitForApplied(index)
+	assertCommandsApplied(t, c, []raft.Command{raft.Command("majority")})
+}
+
+func TestClusterTransferLeadership(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{})
+
+	index := c.Apply(raft.Command("0"))
+	c.WaitForApplied(index)
+	leader := c.WaitForLeader()
+	var target string
+	for _, server := range c.Servers() {
+		if server.Id() != leader.Id() {
+			target = server.Id()
+			break
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, leader.TransferLeadership(ctx, target))
+	assert.Equal(t, target, c.WaitForLeader().Id())
+}
+
+func TestClusterAddPeer(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{})
+	commands := []raft.Command{raft.Command("0"), raft.Command("1")}
+	for _, command := range commands {
+		c.Apply(command)
+	}
+
+	// The new server is kept from catching up, and is unstaged once AddPeer
+	// times out.
+	added := c.AddServer()
+	c.Intercept(func(from, to string, request interface{}) error {
+		if to == added.Id() {
+			return rafttest.ErrPartitioned
+		}
+		return nil
+	})
+	leader := c.WaitForLeader()
+	peer := &pb.Peer{Id: added.Id(), Endpoint: added.Endpoint()}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, leader.AddPeer(ctx, peer), raft.ErrCatchUpTimeout)
+	configuration := leader.Configuration()
+	assert.Nil(t, configuration.Next)
+	assert.Empty(t, configuration.Staging)
+	assert.Len(t, configuration.Current.Peers, 3)
+
+	// The server is promoted once it catches up.
+	c.Intercept(nil)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, c.WaitForLeader().AddPeer(ctx, peer))
+	commands = append(commands, raft.Command("2"))
+	index := c.Apply(commands[2])
+	c.WaitForApplied(index)
+	assertCommandsApplied(t, c, commands)
+
+	// The registered server is staged, and promoted by the leader on its own.
+	registered := c.AddServer()
+	leader = c.WaitForLeader()
+	metadata := map[string]string{"zone": "b"}
+	assert.NoError(t, leader.Register(&pb.Peer{Id: registered.Id(), Endpoint: registered.Endpoint(), Metadata: metadata}))
+	assert.Len(t, leader.Configuration().Staging, 1)
+	assert.Eventually(t, func() bool {
+		configuration := c.WaitForLeader().Configuration()
+		return configuration.Next == nil && len(configuration.Staging) == 0 && len(configuration.Current.Peers) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	// The metadata are carried with the peer through the transitions.
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(metadata, registered.States().Metadata)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, leader.States().Metadata)
+}
+
+func TestClusterNonVoters(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{Servers: 1})
+	leader := c.WaitForLeader()
+
+	// The non-voters are added without catching up, and receive the logs.
+	var nonVoters []*raft.Server
+	for i := 0; i < 2; i++ {
+		added := c.AddServer()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, leader.AddPeer(ctx, &pb.Peer{
+			Id: added.Id(), Endpoint: added.Endpoint(), Suffrage: pb.Suffrage_SUFFRAGE_NON_VOTER,
+		}))
+		nonVoters = append(nonVoters, added)
+		assert.Eventually(t, func() bool { return leader.Configuration().Next == nil },
+			5*time.Second, 10*time.Millisecond)
+	}
+	configuration := leader.Configuration()
+	assert.Len(t, configuration.Current.Peers, 3)
+	for _, p := range configuration.Current.Peers {
+		assert.Equal(t, p.Id != leader.Id(), p.Suffrage == pb.Suffrage_SUFFRAGE_NON_VOTER, p.Id)
+	}
+	c.WaitForApplied(c.Apply(raft.Command("0")))
+
+	// The non-voters never campaign without the voter.
+	terms := map[string]uint64{}
+	for _, s := range nonVoters {
+		terms[s.Id()] = s.States().CurrentTerm
+	}
+	c.Stop(leader.Id())
+	time.Sleep(time.Second)
+	for _, s := range nonVoters {
+		states := s.States()
+		assert.Equal(t, raft.Follower.String(), states.Role)
+		assert.Equal(t, terms[s.Id()], states.CurrentTerm)
+	}
+
+	// The commits don't wait for the non-voters.
+	leader = c.Restart(leader.Id())
+	for _, s := range nonVoters {
+		c.Stop(s.Id())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := leader.ApplyCommand(ctx, raft.Command("1")).Response()
+	assert.NoError(t, err)
+
+	// The non-voter is promoted to a voter.
+	promoted := c.Restart(nonVoters[0].Id())
+	c.WaitForApplied(leader.States().LastAppliedIndex, promoted.Id())
+	assert.NoError(t, leader.PromotePeer(ctx, promoted.Id()))
+	assert.Eventually(t, func() bool {
+		configuration := leader.Configuration()
+		if configuration.Next != nil {
+			return false
+		}
+		for _, p := range configuration.Current.Peers {
+			if p.Id == promoted.Id() {
+				return p.Suffrage == pb.Suffrage_SUFFRAGE_VOTER
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, leader.PromotePeer(ctx, promoted.Id()), raft.ErrPeerExists)
+	assert.ErrorIs(t, leader.PromotePeer(ctx, "unknown"), raft.ErrUnknownPeer)
+}
+
+func TestClusterAbortTransition(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{Servers: 1})
+	leader := c.WaitForLeader()
+	c.Apply(raft.Command("0"))
+
+	// The joint configuration is never replicated to the server added, with
+	// which it cannot be committed.
+	added := c.AddServer()
+	c.Intercept(func(from, to string, request interface{}) error {
+		if r, ok := request.(*pb.AppendEntriesRequest); ok && to == added.Id() {
+			for _, log := range r.Entries {
+				var configuration pb.Configuration
+				if log.Body.Type == pb.LogType_CONFIGURATION &&
+					proto.Unmarshal(log.Body.Data, &configuration) == nil && configuration.Next != nil {
+					return rafttest.ErrPartitioned
+				}
+			}
+		}
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, leader.AddPeer(ctx, &pb.Peer{Id: added.Id(), Endpoint: added.Endpoint()}))
+	assert.NotNil(t, leader.Configuration().Next)
+	stuck := leader.ApplyCommand(ctx, raft.Command("1"))
+
+	assert.NoError(t, leader.AbortTransition(ctx))
+	configuration := leader.Configuration()
+	assert.Nil(t, configuration.Next)
+	assert.Len(t, configuration.Current.Peers, 1)
+	assert.ErrorIs(t, leader.AbortTransition(ctx), raft.ErrNotInJointConsensus)
+	// The logs are committed by the configuration reverted to.
+	_, err := stuck.Response()
+	assert.NoError(t, err)
+}
+
+func TestClusterDeadServerCleanup(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{
+		Servers: 4,
+		ServerOptions: []raft.ServerOption{
+			raft.DeadServerPolicyOption(raft.DeadServerPolicy{Threshold: 300 * time.Millisecond, MinVoters: 3}),
+		},
+	})
+	votersFn := func() []*pb.Peer {
+		configuration := c.WaitForLeader().Configuration()
+		if configuration.Next != nil {
+			return nil
+		}
+		return configuration.Current.Peers
+	}
+	followersFn := func() []string {
+		var ids []string
+		for _, p := range votersFn() {
+			if p.Id != c.WaitForLeader().Id() {
+				ids = append(ids, p.Id)
+			}
+		}
+		return ids
+	}
+
+	// The dead follower is removed by the leader.
+	dead := followersFn()[0]
+	c.Stop(dead)
+	assert.Eventually(t, func() bool { return len(votersFn()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	for _, p := range votersFn() {
+		assert.NotEqual(t, dead, p.Id)
+	}
+	history := c.WaitForLeader().ConfigurationHistory()
+	assert.Equal(t, c.WaitForLeader().Id(), history[len(history)-1].Initiator)
+
+	// No more voters are removed below MinVoters, and the voters left still
+	// make a quorum.
+	leader := c.WaitForLeader()
+	c.Stop(followersFn()[0])
+	time.Sleep(time.Second)
+	configuration := leader.Configuration()
+	assert.Nil(t, configuration.Next)
+	assert.Len(t, configuration.Current.Peers, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := leader.ApplyCommand(ctx, raft.Command("1")).Response()
+	assert.NoError(t, err)
+}
+
+func TestClusterRedeploy(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{
+		ServerOptions: []raft.ServerOption{raft.AnnounceEndpointOption(true)},
+	})
+	leader := c.WaitForLeader()
+	var follower string
+	for _, server := range c.Servers() {
+		if server.Id() != leader.Id() {
+			follower = server.Id()
+		}
+	}
+
+	// The server announces its new endpoint, though the leader cannot reach it
+	// at the old one.
+	c.Stop(follower)
+	redeployed := c.Redeploy(follower)
+	assert.Eventually(t, func() bool {
+		peer, ok := peerByID(c.WaitForLeader().Configuration().Current.Peers, follower)
+		return ok && peer.Endpoint == redeployed.Endpoint()
+	}, 5*time.Second, 10*time.Millisecond)
+	index := c.Apply(raft.Command("1"))
+	c.WaitForApplied(index)
+	assertCommandsApplied(t, c, []raft.Command{raft.Command("1")})
+}
+
+func peerByID(peers []*pb.Peer, id string) (*pb.Peer, bool) {
+	for _, peer := range peers {
+		if peer.Id == id {
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
+func TestClusterConfigurationHistory(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{Servers: 1})
+	leader := c.WaitForLeader()
+	added := c.AddServer()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, leader.AddPeer(ctx, &pb.Peer{Id: added.Id(), Endpoint: added.Endpoint()}))
+
+	// The bootstrap, staging, joint, and committed configurations.
+	assert.Eventually(t, func() bool { return len(leader.ConfigurationHistory()) == 4 },
+		5*time.Second, 10*time.Millisecond)
+	history := leader.ConfigurationHistory()
+	assert.Len(t, history[0].Current.Peers, 1)
+	assert.Len(t, history[1].Staging, 1)
+	assert.NotNil(t, history[2].Next)
+	assert.Len(t, history[3].Current.Peers, 2)
+	for i, record := range history {
+		if i > 0 {
+			// The bootstrap configuration is appended by each server before
+			// any terms.
+			assert.Equal(t, leader.Id(), record.Initiator)
+			assert.NotZero(t, record.Term)
+			assert.Greater(t, record.Index, history[i-1].Index)
+		}
+	}
+	// The history is the same on the followers.
+	assert.Eventually(t, func() bool { return len(added.ConfigurationHistory()) == len(history) },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestClusterScenarios(t *testing.T) {
+	rafttest.RunScenarios(t, rafttest.Options{
+		StableStore: func(id string) raft.StableStore {
+			store, err := raft.NewBoltStore(filepath.Join(t.TempDir(), "store.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+		SnapshotStore: func(id string) raft.SnapshatStore {
+			return raft.NewObjectSnapshotStore(raft.NewFileObjectStore(t.TempDir()), "")
+		},
+	})
+}
@@ -2,109 +2,350 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sumimakito/raft"
 	"go.uber.org/zap"
 )
 
+// maxValueSize is the maximum size of the values written through the API.
+const maxValueSize = 1 << 20
+
+// APIExtension serves the keys of the StateMachine under /api/extension:
+//
+//	GET    /keys          lists the keys in order.
+//	GET    /keys/{key}    reads the value of the key.
+//	PUT    /keys/{key}    sets the key to the request body, which expires
+//	                      after the ttl parameter if given, e.g., ttl=30s.
+//	                      With the prev_exist or prev_value parameters, the
+//	                      key is only set if it exists as prev_exist reports,
+//	                      or has the value in base64 of prev_value, and 412
+//	                      Precondition Failed is responded otherwise.
+//	DELETE /keys/{key}    deletes the key.
+//	GET    /keyvalues     reads all keys and their values.
+//	GET    /range         reads the keys in [start, end) and their values.
+//	GET    /prefix        reads the keys with the prefix and their values.
+//	GET    /watch         streams the changes of the keys with the prefix.
+//	POST   /txn           applies the transaction in the request body.
+//	POST   /mset          sets the keys in the request body at once.
+//	POST   /mdel          deletes the keys in the request body at once.
+//
+// The range queries take the bounds as the query parameters start, end, and
+// prefix, and return at most limit keys if the limit is given. The keys may
+// contain slashes, e.g., /keys/a/b for the key a/b.
+//
+// The reads are served from the local StateMachine at the consistency
+// parameter, which is one of:
+//
+//	stale         the default, served by any server as is, which costs
+//	              nothing but may miss the latest writes.
+//	lease         served by the leader without a round trip while the
+//	              followers have acknowledged it within the follower timeout,
+//	              which relies on bounded clock drift.
+//	linearizable  served by the leader after a round of heartbeats to a
+//	              quorum, which costs a round trip on each read.
+//
+// The reads but stale ones on a follower and the writes on a follower are
+// redirected to the leader with 307 Temporary Redirect if the API address of
+// the leader is known. The reads are rejected with 421 Misdirected Request
+// and the writes are forwarded to the leader by the server otherwise.
 type APIExtension struct {
 	logger *zap.Logger
+	// peerAPIs maps the IDs of the servers to the addresses of their API
+	// servers, either host:port or a URL.
+	peerAPIs map[string]string
+}
+
+func NewAPIExtension(logger *zap.Logger, peerAPIs map[string]string) *APIExtension {
+	return &APIExtension{logger: logger, peerAPIs: peerAPIs}
+}
+
+// rangeResponse is the body of the responses of the range queries.
+type rangeResponse struct {
+	KeyValues []KeyValue `json:"kvs"`
+	// More reports whether the keys are cut off by the limit.
+	More bool `json:"more"`
+}
+
+// errorResponse is the body of the responses of the failed requests.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (e *APIExtension) writeError(rw http.ResponseWriter, err error, statusCode int) {
+	h := raft.NewHandyRespWriter(rw, e.logger)
+	h.JSONStatus(errorResponse{Error: err.Error()}, statusCode)
+}
+
+// writeApplyError maps the errors of applying the commands to the responses.
+func (e *APIExtension) writeApplyError(rw http.ResponseWriter, err error) {
+	var noLeaderErr *raft.NoLeaderError
+	switch {
+	case errors.As(err, &noLeaderErr):
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(noLeaderErr.RetryAfter.Seconds()))))
+		e.writeError(rw, err, http.StatusServiceUnavailable)
+	case errors.Is(err, raft.ErrLeadershipLost), errors.Is(err, raft.ErrLeadershipTransfer),
+		errors.Is(err, raft.ErrServerShutdown), errors.Is(err, raft.ErrProposalDropped):
+		e.writeError(rw, err, http.StatusServiceUnavailable)
+	case errors.Is(err, raft.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		e.writeError(rw, err, http.StatusGatewayTimeout)
+	default:
+		e.logger.Warn("error occurred applying the command", zap.Error(err))
+		e.writeError(rw, err, http.StatusInternalServerError)
+	}
+}
+
+// redirect redirects the request to the leader if the server is a follower
+// and the API address of the leader is known, and reports whether it has.
+func (e *APIExtension) redirect(s *raft.Server, rw http.ResponseWriter, r *http.Request) bool {
+	leader := s.Leader()
+	if leader.Id == "" || leader.Id == s.Id() {
+		return false
+	}
+	address, ok := e.peerAPIs[leader.Id]
+	if !ok {
+		return false
+	}
+	if !strings.Contains(address, "://") {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		address = scheme + "://" + address
+	}
+	rw.Header().Set("X-Raft-Leader", leader.Id)
+	http.Redirect(rw, r, strings.TrimSuffix(address, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
 }
 
-func NewAPIExtension(logger *zap.Logger) *APIExtension {
-	return &APIExtension{logger: logger}
+// apply applies the command on the leader and writes the ApplyResult, with
+// 201 Created if a key is set for the first time, or 412 Precondition Failed
+// if the compares of a CommandCompareAndSwap don't hold.
+func (e *APIExtension) apply(s *raft.Server, rw http.ResponseWriter, r *http.Request, command *Command) {
+	if e.redirect(s, rw, r) {
+		return
+	}
+	data, err := raft.EncodeCommand(raft.MsgpackCodec, command)
+	if err != nil {
+		e.writeError(rw, err, http.StatusInternalServerError)
+		return
+	}
+	response, err := s.ApplyCommand(r.Context(), data).Response()
+	if err != nil {
+		e.writeApplyError(rw, err)
+		return
+	}
+	result, err := decodeApplyResult(response)
+	if err != nil {
+		e.writeError(rw, err, http.StatusInternalServerError)
+		return
+	}
+	statusCode := http.StatusOK
+	switch {
+	case command.Type == CommandCompareAndSwap && !result.Succeeded:
+		statusCode = http.StatusPreconditionFailed
+	case (command.Type == CommandSet || command.Type == CommandCompareAndSwap) && !result.Found:
+		statusCode = http.StatusCreated
+	case command.Type == CommandUnset && !result.Found:
+		statusCode = http.StatusNotFound
+	}
+	h := raft.NewHandyRespWriter(rw, e.logger)
+	h.JSONStatus(result, statusCode)
+}
+
+// read waits until the reads are allowed at the consistency parameter and
+// reports whether they are, or writes the response otherwise.
+func (e *APIExtension) read(s *raft.Server, rw http.ResponseWriter, r *http.Request) bool {
+	consistency := raft.ReadStale
+	if value := r.URL.Query().Get("consistency"); value != "" {
+		var err error
+		if consistency, err = raft.ParseReadConsistency(value); err != nil {
+			e.writeError(rw, err, http.StatusBadRequest)
+			return false
+		}
+	}
+	if consistency != raft.ReadStale && e.redirect(s, rw, r) {
+		return false
+	}
+	err := s.WaitReadable(r.Context(), consistency, 0)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, raft.ErrNonLeader):
+		e.writeError(rw, err, http.StatusMisdirectedRequest)
+	default:
+		e.writeApplyError(rw, err)
+	}
+	return false
+}
+
+// parseCompare returns the Compare on the key of the prev_exist and prev_value
+// parameters, or nil if neither is given.
+func parseCompare(key string, query url.Values) (*Compare, error) {
+	prevExist, prevValue := query.Get("prev_exist"), query.Get("prev_value")
+	if prevExist == "" && prevValue == "" {
+		return nil, nil
+	}
+	compare := &Compare{Key: key, Exists: true}
+	if prevExist != "" {
+		var err error
+		if compare.Exists, err = strconv.ParseBool(prevExist); err != nil {
+			return nil, errors.New("invalid prev_exist: " + prevExist)
+		}
+	}
+	if prevValue != "" {
+		if !compare.Exists {
+			return nil, errors.New("prev_value is given with prev_exist=false")
+		}
+		value, err := base64.StdEncoding.DecodeString(prevValue)
+		if err != nil {
+			return nil, errors.New("invalid prev_value: " + prevValue)
+		}
+		compare.Value = value
+	}
+	return compare, nil
 }
 
 func (e *APIExtension) Setup(s *raft.Server, r *mux.Router) error {
 	r.HandleFunc("/keys", func(rw http.ResponseWriter, r *http.Request) {
+		if !e.read(s, rw, r) {
+			return
+		}
 		h := raft.NewHandyRespWriter(rw, e.logger)
-		h.Encoded(s.StateMachine().(*StateMachine).Keys(), raft.HandyEncodingJSON, 0)
+		h.JSON(s.StateMachine().(*StateMachine).Keys())
 	}).Methods("GET")
 
-	r.HandleFunc("/keys/{key}", func(rw http.ResponseWriter, r *http.Request) {
-		h := raft.NewHandyRespWriter(rw, e.logger)
+	r.HandleFunc("/keys/{key:.+}", func(rw http.ResponseWriter, r *http.Request) {
 		var encoding raft.HandyEncoding
-		switch r.URL.Query().Get("encoding") {
+		switch value := r.URL.Query().Get("encoding"); value {
 		case string(raft.HandyEncodingBase64), "":
 			encoding = raft.HandyEncodingBase64
 		case string(raft.HandyEncodingRaw):
 			encoding = raft.HandyEncodingRaw
 		default:
-			h.WriteHeader(http.StatusBadRequest)
+			e.writeError(rw, errors.New("unknown encoding: "+value), http.StatusBadRequest)
+			return
+		}
+		if !e.read(s, rw, r) {
 			return
 		}
-		vars := mux.Vars(r)
-		v, ok := s.StateMachine().(*StateMachine).Value(vars["key"])
+		key := mux.Vars(r)["key"]
+		stateMachine := s.StateMachine().(*StateMachine)
+		v, ok := stateMachine.Value(key)
 		if !ok {
-			h.WriteHeader(http.StatusNotFound)
+			e.writeError(rw, errors.New("key not found: "+key), http.StatusNotFound)
 			return
 		}
+		if expiresAt, ok := stateMachine.ExpiresAt(key); ok {
+			rw.Header().Set("X-Expires-At", expiresAt.UTC().Format(time.RFC3339Nano))
+		}
+		h := raft.NewHandyRespWriter(rw, e.logger)
 		h.Encoded(v, encoding, 0)
 	}).Methods("GET")
 
-	r.HandleFunc("/keys/{key}", func(rw http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		key := vars["key"]
-		value, err := ioutil.ReadAll(r.Body)
+	r.HandleFunc("/keys/{key:.+}", func(rw http.ResponseWriter, r *http.Request) {
+		value, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValueSize+1))
 		if err != nil {
-			log.Println(err)
-			rw.WriteHeader(http.StatusInternalServerError)
+			e.writeError(rw, err, http.StatusBadRequest)
 			return
 		}
-		c := Command{Type: CommandSet, Key: key, Value: value}
-		f := s.ApplyCommand(context.Background(), c.Encode())
-		result, err := f.Result()
-		if err != nil {
-			log.Println(err)
-			rw.WriteHeader(http.StatusInternalServerError)
+		if len(value) > maxValueSize {
+			e.writeError(rw, fmt.Errorf("value exceeds %d bytes", maxValueSize), http.StatusRequestEntityTooLarge)
 			return
 		}
-		respBody, err := json.Marshal(result)
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
+		command := &Command{Type: CommandSet, Key: mux.Vars(r)["key"], Value: value}
+		if value := r.URL.Query().Get("ttl"); value != "" {
+			ttl, err := time.ParseDuration(value)
+			if err != nil || ttl <= 0 {
+				e.writeError(rw, errors.New("invalid ttl: "+value), http.StatusBadRequest)
+				return
+			}
+			command.ExpiresAt = time.Now().Add(ttl).UnixNano()
 		}
-		if _, err := rw.Write(respBody); err != nil {
-			log.Println(err)
+		if compare, err := parseCompare(command.Key, r.URL.Query()); err != nil {
+			e.writeError(rw, err, http.StatusBadRequest)
+			return
+		} else if compare != nil {
+			command.Type = CommandCompareAndSwap
+			command.Compares = []*Compare{compare}
 		}
+		e.apply(s, rw, r, command)
 	}).Methods("PUT")
 
-	r.HandleFunc("/keys/{key}", func(rw http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		key := vars["key"]
-		c := Command{Type: CommandUnset, Key: key}
-		f := s.ApplyCommand(context.Background(), c.Encode())
-		result, err := f.Result()
-		if err != nil {
-			log.Println(err)
-			rw.WriteHeader(http.StatusInternalServerError)
+	r.HandleFunc("/keys/{key:.+}", func(rw http.ResponseWriter, r *http.Request) {
+		e.apply(s, rw, r, &Command{Type: CommandUnset, Key: mux.Vars(r)["key"]})
+	}).Methods("DELETE")
+
+	r.HandleFunc("/keyvalues", func(rw http.ResponseWriter, r *http.Request) {
+		if !e.read(s, rw, r) {
 			return
 		}
-		respBody, err := json.Marshal(result)
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
+		h := raft.NewHandyRespWriter(rw, e.logger)
+		h.JSON(s.StateMachine().(*StateMachine).KeyValues())
+	}).Methods("GET")
+
+	rangeHandler := func(query func(r *http.Request, limit int) ([]KeyValue, bool)) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			var limit int
+			if value := r.URL.Query().Get("limit"); value != "" {
+				var err error
+				if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+					e.writeError(rw, errors.New("invalid limit: "+value), http.StatusBadRequest)
+					return
+				}
+			}
+			if !e.read(s, rw, r) {
+				return
+			}
+			keyValues, more := query(r, limit)
+			h := raft.NewHandyRespWriter(rw, e.logger)
+			h.JSON(rangeResponse{KeyValues: keyValues, More: more})
 		}
-		if _, err := rw.Write(respBody); err != nil {
-			log.Println(err)
+	}
+
+	r.HandleFunc("/range", rangeHandler(func(r *http.Request, limit int) ([]KeyValue, bool) {
+		query := r.URL.Query()
+		return s.StateMachine().(*StateMachine).Range(query.Get("start"), query.Get("end"), limit)
+	})).Methods("GET")
+
+	r.HandleFunc("/prefix", rangeHandler(func(r *http.Request, limit int) ([]KeyValue, bool) {
+		return s.StateMachine().(*StateMachine).Prefix(r.URL.Query().Get("prefix"), limit)
+	})).Methods("GET")
+
+	r.HandleFunc("/txn", func(rw http.ResponseWriter, r *http.Request) {
+		if e.redirect(s, rw, r) {
+			return
 		}
-	}).Methods("DELETE")
+		e.serveTxn(s, rw, r)
+	}).Methods("POST")
 
-	r.HandleFunc("/keyvalues", func(rw http.ResponseWriter, r *http.Request) {
-		rw.Header().Set("Content-Type", "application/json")
-		snapshot := s.StateMachine().(*StateMachine).KeyValues()
-		out, err := json.Marshal(snapshot)
-		if err != nil {
-			log.Println(err)
+	r.HandleFunc("/mset", func(rw http.ResponseWriter, r *http.Request) {
+		if e.redirect(s, rw, r) {
+			return
 		}
-		if _, err := rw.Write(out); err != nil {
-			log.Println(err)
+		e.serveMultiSet(s, rw, r)
+	}).Methods("POST")
+
+	r.HandleFunc("/mdel", func(rw http.ResponseWriter, r *http.Request) {
+		if e.redirect(s, rw, r) {
+			return
 		}
+		e.serveMultiDelete(s, rw, r)
+	}).Methods("POST")
+
+	r.HandleFunc("/watch", func(rw http.ResponseWriter, r *http.Request) {
+		e.serveWatch(s, rw, r)
 	}).Methods("GET")
 
 	return nil
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/rafttest"
+	"go.uber.org/zap"
+)
+
+func TestAPIExtension(t *testing.T) {
+	ext := NewAPIExtension(zap.NewNop(), map[string]string{})
+	c := rafttest.NewCluster(t, rafttest.Options{
+		Servers:       3,
+		StateMachine:  func(id string) raft.StateMachine { return NewStateMachine() },
+		ServerOptions: []raft.ServerOption{raft.APIExtensionOption(ext)},
+	})
+	leader := c.WaitForLeader()
+	urls := map[string]string{}
+	for _, server := range c.Servers() {
+		httpServer := httptest.NewServer(server.APIHandler())
+		t.Cleanup(httpServer.Close)
+		urls[server.Id()] = httpServer.URL
+		// The redirections use the addresses without the scheme.
+		ext.peerAPIs[server.Id()] = strings.TrimPrefix(httpServer.URL, "http://")
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	do := func(method, url, body string) (*http.Response, string) {
+		t.Helper()
+		request, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		data, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, string(data)
+	}
+	decode := func(body string) *ApplyResult {
+		t.Helper()
+		var result ApplyResult
+		if err := json.Unmarshal([]byte(body), &result); err != nil {
+			t.Fatal(err)
+		}
+		return &result
+	}
+	keyURL := urls[leader.Id()] + "/api/extension/keys/k"
+
+	response, body := do("PUT", keyURL, "v1")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	assert.Equal(t, &ApplyResult{}, decode(body))
+	response, body = do("PUT", keyURL, "v2")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, &ApplyResult{Previous: []byte("v1"), Found: true}, decode(body))
+
+	response, body = do("GET", keyURL+"?encoding=raw", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "v2", body)
+	response, _ = do("GET", keyURL+"?encoding=hex", "")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response, body = do("GET", urls[leader.Id()]+"/api/extension/keys", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.JSONEq(t, `["k"]`, body)
+
+	response, _ = do("PUT", urls[leader.Id()]+"/api/extension/keys/l", "v")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	response, body = do("GET", urls[leader.Id()]+"/api/extension/range?start=k&end=l", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.JSONEq(t, `{"kvs":[{"key":"k","value":"djI="}],"more":false}`, body)
+	response, body = do("GET", urls[leader.Id()]+"/api/extension/prefix?limit=1", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.JSONEq(t, `{"kvs":[{"key":"k","value":"djI="}],"more":true}`, body)
+	response, _ = do("GET", urls[leader.Id()]+"/api/extension/prefix?limit=-1", "")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	// The writes on the followers are redirected to the leader.
+	for _, server := range c.Servers() {
+		if server.Id() == leader.Id() {
+			continue
+		}
+		c.WaitForApplied(leader.States().LastAppliedIndex, server.Id())
+		response, _ = do("PUT", urls[server.Id()]+"/api/extension/keys/k?encoding=raw", "v3")
+		assert.Equal(t, http.StatusTemporaryRedirect, response.StatusCode)
+		assert.Equal(t, keyURL+"?encoding=raw", response.Header.Get("Location"))
+		assert.Equal(t, leader.Id(), response.Header.Get("X-Raft-Leader"))
+		// The stale reads are served locally, and the others are redirected.
+		response, body = do("GET", urls[server.Id()]+"/api/extension/keys/k?encoding=raw", "")
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "v2", body)
+		response, _ = do("GET", urls[server.Id()]+"/api/extension/keys?consistency=lease", "")
+		assert.Equal(t, http.StatusTemporaryRedirect, response.StatusCode)
+		assert.Equal(t, urls[leader.Id()]+"/api/extension/keys?consistency=lease", response.Header.Get("Location"))
+	}
+	for _, consistency := range []string{"stale", "lease", "linearizable"} {
+		response, body = do("GET", keyURL+"?encoding=raw&consistency="+consistency, "")
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "v2", body)
+	}
+	response, _ = do("GET", keyURL+"?consistency=strong", "")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response, body = do("DELETE", keyURL, "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, &ApplyResult{Previous: []byte("v2"), Found: true}, decode(body))
+	response, _ = do("DELETE", keyURL, "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	response, body = do("GET", keyURL, "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	assert.JSONEq(t, `{"error":"key not found: k"}`, body)
+
+	// The key is only set if it exists as prev_exist reports, or has the
+	// value of prev_value.
+	response, body = do("PUT", keyURL+"?prev_exist=true", "v1")
+	assert.Equal(t, http.StatusPreconditionFailed, response.StatusCode)
+	assert.Equal(t, &ApplyResult{}, decode(body))
+	response, _ = do("PUT", keyURL+"?prev_exist=false", "v1")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	response, _ = do("PUT", keyURL+"?prev_value=djA%3D", "v2")
+	assert.Equal(t, http.StatusPreconditionFailed, response.StatusCode)
+	response, body = do("PUT", keyURL+"?prev_value=djE%3D", "v2")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, &ApplyResult{Previous: []byte("v1"), Found: true, Succeeded: true}, decode(body))
+	response, _ = do("PUT", keyURL+"?prev_exist=false&prev_value=djE%3D", "v2")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	txnURL := urls[leader.Id()] + "/api/extension/txn"
+	response, body = do("POST", txnURL, `{
+		"compares": [{"key": "k", "exists": true, "value": "djI="}],
+		"success": [{"type": "unset", "key": "k"}, {"type": "set", "key": "m", "value": "djM=", "ttl": "1h"}],
+		"failure": [{"type": "set", "key": "n", "value": "djM="}]
+	}`)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, &ApplyResult{Succeeded: true, Results: []*ApplyResult{
+		{Previous: []byte("v2"), Found: true},
+		{},
+	}}, decode(body))
+	response, _ = do("POST", txnURL, `{"success": [{"type": "expire", "key": "k"}]}`)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response, _ = do("POST", txnURL, `{"compares": [{"key": "k", "value": "djI="}]}`)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	msetURL := urls[leader.Id()] + "/api/extension/mset"
+	response, body = do("POST", msetURL, `{"kvs": [{"key": "m", "value": "djQ="}, {"key": "o", "value": "djU="}]}`)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, &ApplyResult{Results: []*ApplyResult{
+		{Previous: []byte("v3"), Found: true},
+		{},
+	}}, decode(body))
+	response, _ = do("POST", msetURL, `{"kvs": []}`)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response, body = do("POST", urls[leader.Id()]+"/api/extension/mdel", `{"keys": ["m", "p"]}`)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, &ApplyResult{Results: []*ApplyResult{
+		{Previous: []byte("v4"), Found: true},
+		{},
+	}}, decode(body))
+	_, body = do("GET", urls[leader.Id()]+"/api/extension/keys", "")
+	assert.JSONEq(t, `["l","o"]`, body)
+
+	response, _ = do("PUT", keyURL, strings.Repeat("v", maxValueSize+1))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+}
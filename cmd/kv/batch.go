@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sumimakito/raft"
+)
+
+// msetRequest is the body of the requests to /mset, e.g.,
+//
+//	{"kvs": [{"key": "a", "value": "MQ=="}, {"key": "b", "value": "Mg=="}], "ttl": "10s"}
+//
+// where the values are encoded in base64, and the ttl is optional.
+type msetRequest struct {
+	KeyValues []KeyValue `json:"kvs"`
+	TTL       string     `json:"ttl"`
+}
+
+// mdelRequest is the body of the requests to /mdel, e.g.,
+//
+//	{"keys": ["a", "b"]}
+type mdelRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// decodeBatchRequest decodes the body of the request to /mset or /mdel into v.
+func decodeBatchRequest(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxValueSize+1))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// command returns the CommandMultiSet of the request.
+func (r *msetRequest) command() (*Command, error) {
+	if len(r.KeyValues) == 0 {
+		return nil, errors.New("no keys to set")
+	}
+	command := &Command{Type: CommandMultiSet}
+	for _, kv := range r.KeyValues {
+		command.Keys = append(command.Keys, kv.Key)
+		command.Values = append(command.Values, kv.Value)
+	}
+	if r.TTL != "" {
+		ttl, err := time.ParseDuration(r.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, errors.New("invalid ttl: " + r.TTL)
+		}
+		command.ExpiresAt = time.Now().Add(ttl).UnixNano()
+	}
+	return command, nil
+}
+
+// serveMultiSet sets the keys in the request body in one log. The response
+// is 200 OK with the ApplyResult of each key in Results in order.
+func (e *APIExtension) serveMultiSet(s *raft.Server, rw http.ResponseWriter, r *http.Request) {
+	var request msetRequest
+	if err := decodeBatchRequest(r, &request); err != nil {
+		e.writeError(rw, err, http.StatusBadRequest)
+		return
+	}
+	command, err := request.command()
+	if err != nil {
+		e.writeError(rw, err, http.StatusBadRequest)
+		return
+	}
+	e.apply(s, rw, r, command)
+}
+
+// serveMultiDelete deletes the keys in the request body in one log. The
+// response is 200 OK with the ApplyResult of each key in Results in order.
+func (e *APIExtension) serveMultiDelete(s *raft.Server, rw http.ResponseWriter, r *http.Request) {
+	var request mdelRequest
+	if err := decodeBatchRequest(r, &request); err != nil {
+		e.writeError(rw, err, http.StatusBadRequest)
+		return
+	}
+	if len(request.Keys) == 0 {
+		e.writeError(rw, errors.New("no keys to delete"), http.StatusBadRequest)
+		return
+	}
+	e.apply(s, rw, r, &Command{Type: CommandMultiDelete, Keys: request.Keys})
+}
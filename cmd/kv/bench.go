@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/raftclient"
+)
+
+// benchOptions configures the load driven by bench.
+type benchOptions struct {
+	Duration time.Duration
+	Clients  int
+	// Keys is the number of the keys written by each client.
+	Keys int
+	// ReadRatio is the fraction of the operations that are reads.
+	ReadRatio   float64
+	ValueSize   int
+	Consistency string
+	// Verify checks that the reads of each client return the values it has
+	// written last, which holds for the linearizable and lease reads.
+	Verify bool
+	// Timeout bounds each operation.
+	Timeout time.Duration
+}
+
+// benchOp is the stats of a type of the operations.
+type benchOp struct {
+	Name      string
+	Latencies []time.Duration
+	Errors    int
+}
+
+// Percentile returns the latency at the percentile in [0, 100].
+func (o *benchOp) Percentile(p float64) time.Duration {
+	if len(o.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(o.Latencies)-1) * p / 100)
+	return o.Latencies[i]
+}
+
+// benchReport is the result of a run of bench.
+type benchReport struct {
+	Elapsed time.Duration
+	Reads   benchOp
+	Writes  benchOp
+	// Violations are the reads that didn't return the values written last.
+	Violations []string
+}
+
+func (r *benchReport) print(w io.Writer) error {
+	ops := len(r.Reads.Latencies) + len(r.Writes.Latencies)
+	fmt.Fprintf(w, "%d operations in %v, %.1f ops/s\n\n", ops, r.Elapsed.Round(time.Millisecond),
+		float64(ops)/r.Elapsed.Seconds())
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "OP\tCOUNT\tERRORS\tP50\tP90\tP99\tMAX")
+	for _, op := range []*benchOp{&r.Reads, &r.Writes} {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%v\t%v\t%v\n", op.Name, len(op.Latencies), op.Errors,
+			op.Percentile(50), op.Percentile(90), op.Percentile(99), op.Percentile(100))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, violation := range r.Violations {
+		fmt.Fprintln(w, "violation:", violation)
+	}
+	return nil
+}
+
+// benchClient is a client driving the load, which keeps the values it has
+// written last to verify the reads.
+type benchClient struct {
+	id      int
+	opts    *benchOptions
+	client  *raftclient.Client
+	rand    *rand.Rand
+	seq     int
+	written map[string][]byte
+	reads   benchOp
+	writes  benchOp
+	// violations are the reads that didn't return the values written last.
+	violations []string
+}
+
+func (c *benchClient) key(n int) string {
+	return fmt.Sprintf("bench/%d/%d", c.id, n)
+}
+
+func (c *benchClient) value() []byte {
+	c.seq++
+	value := []byte(fmt.Sprintf("%d/%d/", c.id, c.seq))
+	for len(value) < c.opts.ValueSize {
+		value = append(value, 'x')
+	}
+	return value
+}
+
+// request sends the request and returns the body of the response.
+func (c *benchClient) request(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	response, err := c.client.ExtensionRequest(ctx, method, path, reader)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return ioutil.ReadAll(response.Body)
+}
+
+// step runs an operation, and reports whether it's done before ctx.
+func (c *benchClient) step(ctx context.Context) bool {
+	n := c.rand.Intn(c.opts.Keys)
+	key := c.key(n)
+	expected, written := c.written[key]
+	op := &c.writes
+	start := time.Now()
+	var err error
+	if written && c.rand.Float64() < c.opts.ReadRatio {
+		op = &c.reads
+		query := url.Values{"encoding": {"raw"}, "consistency": {c.opts.Consistency}}
+		var value []byte
+		value, err = c.request(ctx, http.MethodGet, "/keys/"+url.PathEscape(key)+"?"+query.Encode(), nil)
+		if err == nil && c.opts.Verify && !bytes.Equal(expected, value) {
+			c.violations = append(c.violations, fmt.Sprintf("read %q of %s, want %q", value, key, expected))
+		}
+	} else {
+		value := c.value()
+		if _, err = c.request(ctx, http.MethodPut, "/keys/"+url.PathEscape(key), value); err == nil {
+			c.written[key] = value
+		} else {
+			// The write may or may not have been applied.
+			delete(c.written, key)
+		}
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		op.Errors++
+		return true
+	}
+	op.Latencies = append(op.Latencies, time.Since(start))
+	return true
+}
+
+// bench drives the load against the cluster until the duration elapses or ctx
+// is done.
+func bench(ctx context.Context, client *raftclient.Client, opts *benchOptions) *benchReport {
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+	seed := time.Now().UnixNano()
+	clients := make([]*benchClient, opts.Clients)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range clients {
+		clients[i] = &benchClient{
+			id:      i,
+			opts:    opts,
+			client:  client,
+			rand:    rand.New(rand.NewSource(seed + int64(i))),
+			written: map[string][]byte{},
+			reads:   benchOp{Name: "read"},
+			writes:  benchOp{Name: "write"},
+		}
+		wg.Add(1)
+		go func(c *benchClient) {
+			defer wg.Done()
+			for c.step(ctx) {
+			}
+		}(clients[i])
+	}
+	wg.Wait()
+
+	report := &benchReport{
+		Elapsed: time.Since(start),
+		Reads:   benchOp{Name: "read"},
+		Writes:  benchOp{Name: "write"},
+	}
+	for _, c := range clients {
+		report.Reads.Latencies = append(report.Reads.Latencies, c.reads.Latencies...)
+		report.Reads.Errors += c.reads.Errors
+		report.Writes.Latencies = append(report.Writes.Latencies, c.writes.Latencies...)
+		report.Writes.Errors += c.writes.Errors
+		report.Violations = append(report.Violations, c.violations...)
+	}
+	for _, op := range []*benchOp{&report.Reads, &report.Writes} {
+		sort.Slice(op.Latencies, func(i, j int) bool { return op.Latencies[i] < op.Latencies[j] })
+	}
+	return report
+}
+
+// runBench runs the bench subcommand with the arguments, and returns the exit
+// code.
+func runBench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	opts := &benchOptions{}
+	endpoints := flags.String("endpoints", "", "Comma-separated addresses of the API servers.")
+	flags.DurationVar(&opts.Duration, "duration", 10*time.Second, "Duration of the load.")
+	flags.IntVar(&opts.Clients, "clients", 10, "Number of the concurrent clients.")
+	flags.IntVar(&opts.Keys, "keys", 100, "Number of the keys written by each client.")
+	flags.Float64Var(&opts.ReadRatio, "reads", 0.8, "Fraction of the operations that are reads.")
+	flags.IntVar(&opts.ValueSize, "value-size", 128, "Size of the values in bytes.")
+	flags.StringVar(&opts.Consistency, "consistency", "linearizable",
+		"Consistency of the reads (available: linearizable, lease, stale).")
+	flags.BoolVar(&opts.Verify, "verify", false,
+		"Verify that the reads of each client return the values it has written last.")
+	flags.DurationVar(&opts.Timeout, "timeout", 5*time.Second, "Timeout of each operation.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s bench [OPTIONS]\n\nOptions:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if _, err := raft.ParseReadConsistency(opts.Consistency); err != nil ||
+		opts.Clients <= 0 || opts.Keys <= 0 || opts.ReadRatio < 0 || opts.ReadRatio > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var list []string
+	for _, endpoint := range strings.Split(*endpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			list = append(list, endpoint)
+		}
+	}
+	client, err := raftclient.New(list)
+	if errors.Is(err, raftclient.ErrNoEndpoints) {
+		fmt.Fprintln(os.Stderr, "error: no endpoints given with -endpoints")
+		return 2
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer client.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report := bench(ctx, client, opts)
+	if err := report.print(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if len(report.Violations) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/raftclient"
+	"github.com/sumimakito/raft/rafttest"
+	"go.uber.org/zap"
+)
+
+func TestBench(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{
+		Servers:       3,
+		StateMachine:  func(id string) raft.StateMachine { return NewStateMachine() },
+		ServerOptions: []raft.ServerOption{raft.APIExtensionOption(NewAPIExtension(zap.NewNop(), nil))},
+	})
+	c.WaitForLeader()
+	var endpoints []string
+	for _, server := range c.Servers() {
+		httpServer := httptest.NewServer(server.APIHandler())
+		t.Cleanup(httpServer.Close)
+		endpoints = append(endpoints, strings.TrimPrefix(httpServer.URL, "http://"))
+	}
+	client, err := raftclient.New(endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	report := bench(context.Background(), client, &benchOptions{
+		Duration:    500 * time.Millisecond,
+		Clients:     4,
+		Keys:        5,
+		ReadRatio:   0.5,
+		ValueSize:   16,
+		Consistency: raft.ReadLinearizable.String(),
+		Verify:      true,
+		Timeout:     time.Second,
+	})
+	assert.NotEmpty(t, report.Reads.Latencies)
+	assert.NotEmpty(t, report.Writes.Latencies)
+	assert.Zero(t, report.Reads.Errors+report.Writes.Errors)
+	assert.Empty(t, report.Violations)
+	assert.LessOrEqual(t, report.Writes.Percentile(50), report.Writes.Percentile(99))
+
+	var out bytes.Buffer
+	assert.NoError(t, report.print(&out))
+	assert.Contains(t, out.String(), "ops/s")
+}
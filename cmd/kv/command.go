@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/sumimakito/raft"
-	"github.com/ugorji/go/codec"
 )
 
 type CommandType uint8
@@ -10,22 +12,151 @@ type CommandType uint8
 const (
 	CommandSet CommandType = 1 + iota
 	CommandUnset
+	// CommandExpire deletes the key if it still expires at ExpiresAt, i.e., it
+	// hasn't been set again since the leader found it expired.
+	CommandExpire
+	// CommandCompareAndSwap sets the key like CommandSet if all Compares hold.
+	CommandCompareAndSwap
+	// CommandTxn applies the commands of Success if all Compares hold, or those
+	// of Failure otherwise, which are either CommandSet or CommandUnset.
+	CommandTxn
+	// CommandMultiSet sets the Keys to the Values at the same indexes, which
+	// expire at ExpiresAt if it's not 0.
+	CommandMultiSet
+	// CommandMultiDelete deletes the Keys.
+	CommandMultiDelete
 )
 
+func (t CommandType) String() string {
+	switch t {
+	case CommandSet:
+		return "set"
+	case CommandUnset:
+		return "unset"
+	case CommandExpire:
+		return "expire"
+	case CommandCompareAndSwap:
+		return "cas"
+	case CommandTxn:
+		return "txn"
+	case CommandMultiSet:
+		return "mset"
+	case CommandMultiDelete:
+		return "mdel"
+	}
+	return "unknown"
+}
+
 type Command struct {
 	Type  CommandType
 	Key   string
 	Value []byte
+	// ExpiresAt is the time in Unix nanoseconds the key set by the command
+	// expires at, or 0 if it never expires. The time is taken by the server
+	// the command is submitted to, so that the command is applied the same on
+	// all servers.
+	ExpiresAt int64 `codec:",omitempty"`
+	// Compares are the conditions of CommandCompareAndSwap and CommandTxn,
+	// checked against the keys before the command.
+	Compares []*Compare `codec:",omitempty"`
+	Success  []*Command `codec:",omitempty"`
+	Failure  []*Command `codec:",omitempty"`
+	// Keys and Values are the keys and values of CommandMultiSet and
+	// CommandMultiDelete, which are applied in order in one log.
+	Keys   []string `codec:",omitempty"`
+	Values [][]byte `codec:",omitempty"`
+}
+
+// commands returns the commands applied one key at a time for
+// CommandMultiSet and CommandMultiDelete.
+func (c *Command) commands() []*Command {
+	commands := make([]*Command, 0, len(c.Keys))
+	for i, key := range c.Keys {
+		if c.Type == CommandMultiSet {
+			commands = append(commands, &Command{Type: CommandSet, Key: key, Value: c.Values[i], ExpiresAt: c.ExpiresAt})
+		} else {
+			commands = append(commands, &Command{Type: CommandUnset, Key: key})
+		}
+	}
+	return commands
+}
+
+// Compare is a condition on a key. It holds if the key exists as Exists
+// reports, and has the Value if it exists and Value is not nil.
+type Compare struct {
+	Key    string `json:"key"`
+	Exists bool   `json:"exists"`
+	Value  []byte `json:"value,omitempty"`
+}
+
+// validateTxn checks that the commands of a CommandTxn are applicable in a
+// transaction.
+func validateTxn(command *Command) error {
+	for _, commands := range [][]*Command{command.Success, command.Failure} {
+		for _, c := range commands {
+			if c.Type != CommandSet && c.Type != CommandUnset {
+				return fmt.Errorf("invalid command in the transaction: %s", c.Type)
+			}
+		}
+	}
+	return nil
 }
 
-func (c *Command) Encode() []byte {
-	var out []byte
-	codec.NewEncoderBytes(&out, &codec.MsgpackHandle{}).MustEncode(c)
-	return out
+// validateMulti checks that a CommandMultiSet has a value for each key.
+func validateMulti(command *Command) error {
+	if command.Type == CommandMultiSet && len(command.Keys) != len(command.Values) {
+		return fmt.Errorf("%d keys given with %d values", len(command.Keys), len(command.Values))
+	}
+	if command.Type == CommandMultiDelete && command.Values != nil {
+		return errors.New("unexpected values to delete")
+	}
+	return nil
 }
 
 func DecodeCommand(command raft.Command) *Command {
-	var cmd Command
-	codec.NewDecoderBytes(command, &codec.MsgpackHandle{}).MustDecode(&cmd)
-	return &cmd
+	return raft.Must2(raft.DecodeCommand[*Command](raft.MsgpackCodec, command))
+}
+
+// ApplyResult is the result of applying a Command.
+type ApplyResult struct {
+	// Previous is the value of the key before the command.
+	Previous []byte `json:"previous,omitempty"`
+	// Found reports whether the key existed before the command.
+	Found bool `json:"found"`
+	// Succeeded reports whether the Compares of CommandCompareAndSwap or
+	// CommandTxn held.
+	Succeeded bool `json:"succeeded,omitempty"`
+	// Results are the results of the commands applied by CommandTxn, or
+	// those on the keys of CommandMultiSet and CommandMultiDelete in order.
+	Results []*ApplyResult `json:"results,omitempty"`
+}
+
+// applyResult has the fields of ApplyResult without its methods, so that the
+// codec encodes the fields instead of calling MarshalBinary.
+type applyResult ApplyResult
+
+// MarshalBinary encodes the ApplyResult, so that it's carried back to the
+// servers that redirected the command to the leader.
+func (r *ApplyResult) MarshalBinary() ([]byte, error) {
+	return raft.MsgpackCodec.Marshal((*applyResult)(r))
+}
+
+func (r *ApplyResult) UnmarshalBinary(data []byte) error {
+	return raft.MsgpackCodec.Unmarshal(data, (*applyResult)(r))
+}
+
+// decodeApplyResult returns the ApplyResult in the response of an
+// ApplyFuture, which is encoded if the command was redirected to the leader.
+func decodeApplyResult(response interface{}) (*ApplyResult, error) {
+	switch r := response.(type) {
+	case *ApplyResult:
+		return r, nil
+	case []byte:
+		result := &ApplyResult{}
+		if err := result.UnmarshalBinary(r); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unexpected result of type %T", response)
 }
@@ -0,0 +1,179 @@
+package porcupine
+
+import (
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// CheckOperations reports whether the history is linearizable.
+func CheckOperations(model Model, history []Operation) bool {
+	return CheckOperationsTimeout(model, history, 0) == Ok
+}
+
+// CheckOperationsTimeout checks whether the history is linearizable. It gives
+// up with Unknown after the timeout, or never if the timeout is zero.
+func CheckOperationsTimeout(model Model, history []Operation, timeout time.Duration) CheckResult {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	result := Ok
+	for _, partition := range model.partition(history) {
+		switch checkPartition(model, partition, deadline) {
+		case Illegal:
+			return Illegal
+		case Unknown:
+			result = Unknown
+		}
+	}
+	return result
+}
+
+// entry is the call or the return of an operation in the doubly linked list
+// searched by checkPartition.
+type entry struct {
+	id         int
+	op         *Operation
+	time       int64
+	match      *entry // the return of a call, or nil for a return
+	prev, next *entry
+}
+
+// lift removes the call and its return from the list.
+func (e *entry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	match := e.match
+	match.prev.next = match.next
+	if match.next != nil {
+		match.next.prev = match.prev
+	}
+}
+
+// unlift puts back the call and its return removed by lift.
+func (e *entry) unlift() {
+	match := e.match
+	match.prev.next = match
+	if match.next != nil {
+		match.next.prev = match
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+// makeEntries links the calls and the returns of the operations in the order
+// of their time behind a sentinel head. The calls precede the returns at the
+// same time.
+func makeEntries(history []Operation) *entry {
+	var entries []*entry
+	for i := range history {
+		op := &history[i]
+		ret := &entry{id: i, op: op, time: op.Return}
+		entries = append(entries, &entry{id: i, op: op, time: op.Call, match: ret}, ret)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		return entries[i].match != nil && entries[j].match == nil
+	})
+	head := &entry{id: -1}
+	last := head
+	for _, e := range entries {
+		last.next = e
+		e.prev = last
+		last = e
+	}
+	return head
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << (i % 64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << (i % 64) }
+
+func (b bitset) equals(other bitset) bool {
+	for i := range b {
+		if b[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, word := range b {
+		for i := range buf {
+			buf[i] = byte(word >> (8 * i))
+		}
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+// cacheEntry is a visited configuration: the operations linearized and the
+// state they lead to.
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+func checkPartition(model Model, history []Operation, deadline time.Time) CheckResult {
+	type frame struct {
+		entry *entry
+		state interface{}
+	}
+	head := makeEntries(history)
+	linearized := make(bitset, (len(history)+63)/64)
+	cache := map[uint64][]cacheEntry{}
+	// visit adds the configuration to the cache, and reports whether it's
+	// new.
+	visit := func(state interface{}) bool {
+		h := linearized.hash()
+		for _, e := range cache[h] {
+			if e.linearized.equals(linearized) && model.equal(e.state, state) {
+				return false
+			}
+		}
+		cache[h] = append(cache[h], cacheEntry{linearized: append(bitset(nil), linearized...), state: state})
+		return true
+	}
+	var stack []frame
+	state := model.Init()
+	e := head.next
+	for steps := 0; head.next != nil; steps++ {
+		if steps%1024 == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			return Unknown
+		}
+		if e.match != nil {
+			// Try linearizing the call here.
+			if ok, newState := model.Step(state, e.op.Input, e.op.Output); ok {
+				linearized.set(e.id)
+				if visit(newState) {
+					stack = append(stack, frame{entry: e, state: state})
+					state = newState
+					e.lift()
+					e = head.next
+					continue
+				}
+				linearized.clear(e.id)
+			}
+			e = e.next
+			continue
+		}
+		// A return is reached before its call is linearized, so backtrack.
+		if len(stack) == 0 {
+			return Illegal
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.entry.id)
+		top.entry.unlift()
+		e = top.entry.next
+	}
+	return Ok
+}
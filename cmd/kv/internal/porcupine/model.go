@@ -0,0 +1,65 @@
+// Package porcupine checks histories for linearizability with the API of
+// github.com/anishathalye/porcupine, which cannot be added to the module yet.
+// Only the API used by the tests is provided, so that switching to porcupine
+// takes nothing but replacing the import path.
+//
+// As in porcupine, the history is partitioned with Model.Partition, and each
+// partition is searched for a linearization with the algorithm of Wing and
+// Gong, improved by Lowe with a cache of the visited configurations.
+package porcupine
+
+// Operation is an operation in the history. Call and Return are the times of
+// the call and the return of the operation, which must be totally ordered.
+// The operations with an unknown outcome, which may or may not have taken
+// effect, never return and have a Return of math.MaxInt64.
+type Operation struct {
+	ClientId int
+	Input    interface{}
+	Call     int64
+	Output   interface{}
+	Return   int64
+}
+
+// Model is a sequential specification of the system.
+type Model struct {
+	// Partition splits the history into the partitions checked
+	// independently, e.g., by key. The history is checked as a whole if
+	// it's nil.
+	Partition func(history []Operation) [][]Operation
+	// Init returns the initial state.
+	Init func() interface{}
+	// Step applies the operation on the state, and reports whether the
+	// output of the operation is legal in the state.
+	Step func(state interface{}, input interface{}, output interface{}) (bool, interface{})
+	// Equal reports whether the states are equal. The states are compared
+	// with == if it's nil.
+	Equal func(state1, state2 interface{}) bool
+	// DescribeOperation describes the operation for the humans.
+	DescribeOperation func(input interface{}, output interface{}) string
+	// DescribeState describes the state for the humans.
+	DescribeState func(state interface{}) string
+}
+
+// CheckResult is the result of a check.
+type CheckResult string
+
+const (
+	// Unknown is the result of a check that timed out.
+	Unknown CheckResult = "Unknown"
+	Ok      CheckResult = "Ok"
+	Illegal CheckResult = "Illegal"
+)
+
+func (m Model) partition(history []Operation) [][]Operation {
+	if m.Partition == nil {
+		return [][]Operation{history}
+	}
+	return m.Partition(history)
+}
+
+func (m Model) equal(state1, state2 interface{}) bool {
+	if m.Equal == nil {
+		return state1 == state2
+	}
+	return m.Equal(state1, state2)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/cmd/kv/internal/porcupine"
+	"github.com/sumimakito/raft/rafttest"
+)
+
+var (
+	flagLinearizabilityDuration = flag.Duration("linearizability.duration", 5*time.Second,
+		"how long the clients run against the cluster under faults")
+	flagLinearizabilityClients = flag.Int("linearizability.clients", 5, "number of the concurrent clients")
+	flagLinearizabilitySeed    = flag.Int64("linearizability.seed", 0,
+		"seed of the clients and the faults, or 0 for one from the current time")
+)
+
+const (
+	linearizabilityKeys         = 3
+	linearizabilityOpTimeout    = time.Second
+	linearizabilityCheckTimeout = time.Minute
+)
+
+// kvHistory records the operations of the clients. The times of the calls and
+// the returns are taken from a counter shared by the clients, so that they're
+// totally ordered.
+type kvHistory struct {
+	clock int64
+	mu    sync.Mutex // protects ops
+	ops   []porcupine.Operation
+}
+
+func (h *kvHistory) now() int64 {
+	return atomic.AddInt64(&h.clock, 1)
+}
+
+func (h *kvHistory) record(op porcupine.Operation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops = append(h.ops, op)
+}
+
+// kvClient issues the operations to the server it believes is the leader, and
+// moves to another server on errors.
+type kvClient struct {
+	id      int
+	c       *rafttest.Cluster
+	history *kvHistory
+	rand    *rand.Rand
+	server  *raft.Server
+	seq     int
+}
+
+func (c *kvClient) nextServer() {
+	servers := c.c.Servers()
+	c.server = servers[c.rand.Intn(len(servers))]
+}
+
+func (c *kvClient) run(stopCh <-chan struct{}) {
+	c.nextServer()
+	for {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		key := fmt.Sprint("key-", c.rand.Intn(linearizabilityKeys))
+		var ok bool
+		switch n := c.rand.Intn(10); {
+		case n < 5:
+			ok = c.get(key)
+		case n < 9:
+			c.seq++
+			ok = c.write(&Command{Type: CommandSet, Key: key, Value: []byte(fmt.Sprintf("%d-%d", c.id, c.seq))})
+		default:
+			ok = c.write(&Command{Type: CommandUnset, Key: key})
+		}
+		if !ok {
+			c.nextServer()
+		}
+	}
+}
+
+// get reads the key from the state machine of the server after the read index
+// is applied. The failed reads are left out of the history since they have no
+// effect.
+func (c *kvClient) get(key string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), linearizabilityOpTimeout)
+	defer cancel()
+	op := porcupine.Operation{ClientId: c.id, Input: kvInput{Type: kvOpGet, Key: key}, Call: c.history.now()}
+	if _, err := c.server.ReadIndex(ctx); err != nil {
+		return false
+	}
+	value, found := c.server.StateMachine().(*StateMachine).Value(key)
+	op.Output = kvOutput{kvValue: kvValue{Value: string(value), Found: found}}
+	op.Return = c.history.now()
+	c.history.record(op)
+	return true
+}
+
+// write applies the command, which may have been applied if it fails, so the
+// failed writes are recorded with an unknown outcome.
+func (c *kvClient) write(command *Command) bool {
+	input := kvInput{Type: kvOpSet, Key: command.Key, Value: string(command.Value)}
+	if command.Type == CommandUnset {
+		input.Type = kvOpUnset
+	}
+	op := porcupine.Operation{ClientId: c.id, Input: input, Output: kvOutput{Unknown: true}, Return: math.MaxInt64}
+	defer func() { c.history.record(op) }()
+	op.Call = c.history.now()
+	future := c.server.ApplyCommand(context.Background(), raft.Must2(raft.EncodeCommand(raft.MsgpackCodec, command)))
+	type result struct {
+		previous interface{}
+		err      error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		previous, err := future.Response()
+		resultCh <- result{previous: previous, err: err}
+	}()
+	select {
+	case r := <-resultCh:
+		if r.err != nil {
+			return false
+		}
+		result, err := decodeApplyResult(r.previous)
+		if err != nil {
+			return false
+		}
+		op.Output = kvOutput{kvValue: kvValue{Value: string(result.Previous), Found: result.Found}}
+		op.Return = c.history.now()
+		return true
+	case <-time.After(linearizabilityOpTimeout):
+		return false
+	}
+}
+
+// injectFaults partitions the cluster at random until stopCh is closed.
+func injectFaults(c *rafttest.Cluster, r *rand.Rand, stopCh <-chan struct{}, logf func(string, ...interface{})) {
+	var ids []string
+	for _, server := range c.Servers() {
+		ids = append(ids, server.Id())
+	}
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(time.Duration(200+r.Intn(500)) * time.Millisecond):
+		}
+		switch r.Intn(4) {
+		case 0:
+			logf("healing the partitions")
+			c.Heal()
+		case 1:
+			if leader := c.Leader(); leader != nil {
+				logf("isolating the leader %s", leader.Id())
+				c.Isolate(leader.Id())
+			}
+		case 2:
+			id := ids[r.Intn(len(ids))]
+			logf("isolating %s", id)
+			c.Isolate(id)
+		case 3:
+			shuffled := append([]string(nil), ids...)
+			r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+			minority := shuffled[:len(shuffled)/2]
+			logf("partitioning %v from %v", minority, shuffled[len(shuffled)/2:])
+			c.Partition(minority, shuffled[len(shuffled)/2:])
+		}
+	}
+}
+
+// TestLinearizability runs the clients against the KV example under network
+// partitions, and checks that the history of their operations is
+// linearizable. Run longer with -linearizability.duration.
+func TestLinearizability(t *testing.T) {
+	seed := *flagLinearizabilitySeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	duration := *flagLinearizabilityDuration
+	if testing.Short() {
+		duration = time.Second
+	}
+	t.Logf("seed %d", seed)
+	r := rand.New(rand.NewSource(seed))
+
+	c := rafttest.NewCluster(t, rafttest.Options{
+		Servers:      5,
+		StateMachine: func(id string) raft.StateMachine { return NewStateMachine() },
+	})
+	c.WaitForLeader()
+
+	history := &kvHistory{}
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *flagLinearizabilityClients; i++ {
+		client := &kvClient{id: i, c: c, history: history, rand: rand.New(rand.NewSource(r.Int63()))}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.run(stopCh)
+		}()
+	}
+	faultsDone := make(chan struct{})
+	go func() {
+		defer close(faultsDone)
+		injectFaults(c, rand.New(rand.NewSource(r.Int63())), stopCh, t.Logf)
+	}()
+	time.Sleep(duration)
+	close(stopCh)
+	<-faultsDone
+	c.Heal()
+	wg.Wait()
+
+	unknown := 0
+	for _, op := range history.ops {
+		if op.Output.(kvOutput).Unknown {
+			unknown++
+		}
+	}
+	t.Logf("checking %d operations, %d with unknown outcomes", len(history.ops), unknown)
+	switch porcupine.CheckOperationsTimeout(kvModel, history.ops, linearizabilityCheckTimeout) {
+	case porcupine.Illegal:
+		for _, partition := range kvModel.Partition(history.ops) {
+			if porcupine.CheckOperations(kvModel, partition) {
+				continue
+			}
+			for _, op := range partition {
+				t.Logf("client %d [%d, %d] %s", op.ClientId, op.Call, op.Return, kvModel.DescribeOperation(op.Input, op.Output))
+			}
+			t.Fatalf("history of %s is not linearizable", partition[0].Input.(kvInput).Key)
+		}
+	case porcupine.Unknown:
+		t.Logf("gave up checking the history after %s", linearizabilityCheckTimeout)
+	}
+}
+
+func TestCheckOperations(t *testing.T) {
+	set := func(value, previous string, call, ret int64) porcupine.Operation {
+		return porcupine.Operation{Input: kvInput{Type: kvOpSet, Key: "k", Value: value},
+			Output: kvOutput{kvValue: kvValue{Value: previous, Found: previous != ""}}, Call: call, Return: ret}
+	}
+	get := func(value string, call, ret int64) porcupine.Operation {
+		return porcupine.Operation{Input: kvInput{Type: kvOpGet, Key: "k"},
+			Output: kvOutput{kvValue: kvValue{Value: value, Found: value != ""}}, Call: call, Return: ret}
+	}
+	cases := []struct {
+		name    string
+		history []porcupine.Operation
+		result  porcupine.CheckResult
+	}{
+		{"sequential", []porcupine.Operation{set("a", "", 1, 2), get("a", 3, 4), set("b", "a", 5, 6), get("b", 7, 8)}, porcupine.Ok},
+		{"concurrent", []porcupine.Operation{set("a", "", 1, 4), get("a", 2, 3), get("", 2, 5)}, porcupine.Ok},
+		{"stale read", []porcupine.Operation{set("a", "", 1, 2), set("b", "a", 3, 4), get("a", 5, 6)}, porcupine.Illegal},
+		{"lost write", []porcupine.Operation{set("a", "", 1, 2), set("b", "", 3, 4)}, porcupine.Illegal},
+		{"unknown write", []porcupine.Operation{
+			{Input: kvInput{Type: kvOpSet, Key: "k", Value: "a"}, Output: kvOutput{Unknown: true}, Call: 1, Return: math.MaxInt64},
+			get("", 2, 3), get("a", 4, 5),
+		}, porcupine.Ok},
+		{"unobserved unknown write", []porcupine.Operation{
+			{Input: kvInput{Type: kvOpSet, Key: "k", Value: "a"}, Output: kvOutput{Unknown: true}, Call: 1, Return: math.MaxInt64},
+			get("", 2, 3), set("b", "", 4, 5), get("b", 6, 7),
+		}, porcupine.Ok},
+		{"read reverted", []porcupine.Operation{set("a", "", 1, 2), get("a", 3, 6), get("", 4, 5)}, porcupine.Illegal},
+	}
+	for _, tc := range cases {
+		if result := porcupine.CheckOperationsTimeout(kvModel, tc.history, time.Minute); result != tc.result {
+			t.Errorf("%s: got %s, want %s", tc.name, result, tc.result)
+		}
+	}
+}
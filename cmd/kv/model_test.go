@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sumimakito/raft/cmd/kv/internal/porcupine"
+)
+
+type kvOpType uint8
+
+const (
+	kvOpGet kvOpType = iota
+	kvOpSet
+	kvOpUnset
+)
+
+func (t kvOpType) String() string {
+	switch t {
+	case kvOpGet:
+		return "get"
+	case kvOpSet:
+		return "set"
+	case kvOpUnset:
+		return "unset"
+	}
+	return "unknown"
+}
+
+// kvValue is the value of a key, and the state of the model of a partition.
+type kvValue struct {
+	Value string
+	Found bool
+}
+
+func (v kvValue) String() string {
+	if !v.Found {
+		return "<unset>"
+	}
+	return fmt.Sprintf("%q", v.Value)
+}
+
+// kvInput is the input of an operation in the history.
+type kvInput struct {
+	Type  kvOpType
+	Key   string
+	Value string // for kvOpSet
+}
+
+// kvOutput is the output of an operation in the history: the value read, or
+// the value before the write. The writes with an unknown outcome never return.
+type kvOutput struct {
+	kvValue
+	Unknown bool
+}
+
+// kvModel is the model of the KV example, partitioned by key.
+var kvModel = porcupine.Model{
+	Partition: partitionByKey,
+	Init:      func() interface{} { return kvValue{} },
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		value, in, out := state.(kvValue), input.(kvInput), output.(kvOutput)
+		switch in.Type {
+		case kvOpGet:
+			return out.kvValue == value, value
+		case kvOpSet:
+			return out.Unknown || out.kvValue == value, kvValue{Value: in.Value, Found: true}
+		case kvOpUnset:
+			return out.Unknown || out.kvValue == value, kvValue{}
+		}
+		return false, value
+	},
+	DescribeOperation: func(input, output interface{}) string {
+		in, out := input.(kvInput), output.(kvOutput)
+		result := out.kvValue.String()
+		if out.Unknown {
+			result = "unknown"
+		}
+		if in.Type == kvOpSet {
+			return fmt.Sprintf("set(%s, %q) -> %s", in.Key, in.Value, result)
+		}
+		return fmt.Sprintf("%s(%s) -> %s", in.Type, in.Key, result)
+	},
+	DescribeState: func(state interface{}) string { return state.(kvValue).String() },
+}
+
+// partitionByKey partitions the history by key in the order of the keys first
+// seen.
+func partitionByKey(history []porcupine.Operation) [][]porcupine.Operation {
+	// observed holds the key-value pairs read or overwritten.
+	observed := map[[2]string]bool{}
+	for _, op := range history {
+		if out := op.Output.(kvOutput); !out.Unknown && out.Found {
+			observed[[2]string{op.Input.(kvInput).Key, out.Value}] = true
+		}
+	}
+	partitions := map[string]int{}
+	var result [][]porcupine.Operation
+	for _, op := range history {
+		in := op.Input.(kvInput)
+		// The sets with an unknown outcome are left out if their values,
+		// which are unique, are never observed: had they been applied, they
+		// would have been overwritten by other writes with unknown outcomes.
+		if op.Output.(kvOutput).Unknown && in.Type == kvOpSet && !observed[[2]string{in.Key, in.Value}] {
+			continue
+		}
+		i, ok := partitions[in.Key]
+		if !ok {
+			i = len(result)
+			partitions[in.Key] = i
+			result = append(result, nil)
+		}
+		result[i] = append(result[i], op)
+	}
+	return result
+}
@@ -31,6 +31,9 @@ var logLevels = map[string]zapcore.Level{
 
 type parsedClusterConfig struct {
 	Peers map[string]string `yaml:"peers"`
+	// APIs are the addresses of the API servers of the peers, to which the
+	// writes are redirected.
+	APIs map[string]string `yaml:"apis"`
 }
 
 func ensureDir(dir string) error {
@@ -48,6 +51,10 @@ func ensureDir(dir string) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		log.Panic(err)
@@ -75,6 +82,7 @@ func main() {
 
 	if flag.NArg() < 3 {
 		fmt.Printf("Usage: %s [OPTIONS] <SERVER_ID> <RPC_ADDRESS> <DATA_DIR>\n", os.Args[0])
+		fmt.Printf("       %s bench [OPTIONS]\n", os.Args[0])
 		fmt.Println()
 		fmt.Println("Options:")
 		flag.PrintDefaults()
@@ -82,6 +90,7 @@ func main() {
 	}
 
 	var cluster []*pb.Peer
+	peerAPIs := map[string]string{}
 	if clusterConfig != "" {
 		func() {
 			file, err := os.Open(raft.PathJoin(workDir, clusterConfig))
@@ -98,6 +107,9 @@ func main() {
 			for id, endpoint := range c.Peers {
 				cluster = append(cluster, &pb.Peer{Id: id, Endpoint: endpoint})
 			}
+			for id, address := range c.APIs {
+				peerAPIs[id] = address
+			}
 		}()
 	}
 
@@ -133,8 +145,8 @@ func main() {
 	if err != nil {
 		log.Panic(err)
 	}
-	apiExtension := NewAPIExtension(logger)
-	stableStore, err := raft.NewBoltStore(filepath.Join(dataDir, "store.db"))
+	apiExtension := NewAPIExtension(logger, peerAPIs)
+	stableStore, err := raft.NewWALStore(filepath.Join(dataDir, "wal"))
 	if err != nil {
 		log.Panic(err)
 	}
@@ -144,8 +156,10 @@ func main() {
 	serverOpts := []raft.ServerOption{
 		raft.ElectionTimeoutOption(1 * time.Second),
 		raft.FollowerTimeoutOption(1 * time.Second),
+		raft.HeartbeatIntervalOption(100 * time.Millisecond),
 		raft.APIExtensionOption(apiExtension),
 		raft.LogLevelOption(logLevel),
+		raft.RecoveryFileOption(filepath.Join(dataDir, "peers.json")),
 	}
 
 	if apiAddress != "" {
@@ -166,6 +180,7 @@ func main() {
 	if err != nil {
 		log.Panic(err)
 	}
+	stateMachine.SetServer(server)
 
 	if err := server.Serve(); err != nil {
 		log.Panic(err)
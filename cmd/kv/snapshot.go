@@ -3,13 +3,13 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"hash/crc64"
 	"io"
-	"io/fs"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/sumimakito/raft"
 	kvpb "github.com/sumimakito/raft/cmd/kv/pb"
@@ -18,32 +18,40 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
 type Snapshot struct {
 	metadata *SnapshotMeta
 	reader   io.ReadCloser
 }
 
 func newSnapshot(snapshotDir string) (*Snapshot, error) {
-	metadataFile, err := os.OpenFile(filepath.Join(snapshotDir, "metadata"), os.O_RDONLY, 0600)
+	metadata, err := readMeta(snapshotDir)
 	if err != nil {
 		return nil, err
 	}
-	metadataBytes, err := ioutil.ReadAll(metadataFile)
-	if err := metadataFile.Close(); err != nil {
-		return nil, err
-	}
-	var pbMetadata kvpb.SnapshotMeta
-	proto.Unmarshal(metadataBytes, &pbMetadata)
-	snapshotFile, err := os.OpenFile(filepath.Join(snapshotDir, "snapshot"), os.O_RDONLY, 0600)
+	snapshotFile, err := os.Open(filepath.Join(snapshotDir, "snapshot"))
 	if err != nil {
 		return nil, err
 	}
 	return &Snapshot{
-		metadata: &SnapshotMeta{pbMetadata: &pbMetadata},
+		metadata: metadata,
 		reader:   raft.NewBufferedReadCloser(snapshotFile),
 	}, nil
 }
 
+func readMeta(snapshotDir string) (*SnapshotMeta, error) {
+	metadataBytes, err := os.ReadFile(filepath.Join(snapshotDir, "metadata"))
+	if err != nil {
+		return nil, err
+	}
+	var pbMetadata kvpb.SnapshotMeta
+	if err := proto.Unmarshal(metadataBytes, &pbMetadata); err != nil {
+		return nil, err
+	}
+	return &SnapshotMeta{pbMetadata: &pbMetadata}, nil
+}
+
 func (s *Snapshot) Meta() (raft.SnapshotMeta, error) {
 	return s.metadata, nil
 }
@@ -112,6 +120,14 @@ func (m *SnapshotMeta) SetCRC64(crc64 uint64) {
 	m.pbMetadata.Crc64 = crc64
 }
 
+func (m *SnapshotMeta) CreatedAt() time.Time {
+	id, err := raft.ObjectIDFromHex(m.pbMetadata.Id)
+	if err != nil {
+		return time.Time{}
+	}
+	return id.Timestamp()
+}
+
 func (m *SnapshotMeta) Encode() ([]byte, error) {
 	return proto.Marshal(m.pbMetadata)
 }
@@ -140,52 +156,69 @@ func newSnapshotSink(wipDir, finalDir string, metadata *SnapshotMeta) *SnapshotS
 }
 
 func (s *SnapshotSink) writeMeta() error {
-	file, err := os.OpenFile(filepath.Join(s.wipDir, "metadata"), os.O_CREATE|os.O_RDWR, 0600)
+	metadataBytes, err := proto.Marshal(s.metadata.pbMetadata)
 	if err != nil {
 		return err
 	}
-	writer := raft.NewBufferedWriteCloser(file)
-	defer writer.Close()
-	metadataBytes, err := proto.Marshal(s.metadata.pbMetadata)
+	file, err := os.OpenFile(filepath.Join(s.wipDir, "metadata"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
-	if _, err := writer.Write(metadataBytes); err != nil {
+	if _, err := file.Write(metadataBytes); err != nil {
+		file.Close()
 		return err
 	}
-	if err := writer.Flush(); err != nil {
+	if err := file.Sync(); err != nil {
+		file.Close()
 		return err
 	}
-	return nil
+	return file.Close()
 }
 
-func (s *SnapshotSink) close() error {
+// open creates the file of the snapshot data, which is created even if no
+// data is written.
+func (s *SnapshotSink) open() error {
 	if s.snapshotFile != nil {
-		if err := s.snapshotWriter.Flush(); err != nil {
-			return err
-		}
-		if err := s.snapshotFile.Close(); err != nil {
-			return err
-		}
+		return nil
+	}
+	file, err := os.OpenFile(filepath.Join(s.wipDir, "snapshot"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
 	}
+	s.snapshotFile = file
+	s.snapshotWriter = bufio.NewWriter(s.snapshotFile)
 	return nil
 }
 
+// close flushes the data to the disk and closes the file of the snapshot.
+func (s *SnapshotSink) close() error {
+	if s.snapshotFile == nil {
+		return nil
+	}
+	file := s.snapshotFile
+	s.snapshotFile = nil
+	if err := s.snapshotWriter.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
 func (s *SnapshotSink) Meta() raft.SnapshotMeta {
 	return s.metadata
 }
 
 func (s *SnapshotSink) Write(p []byte) (n int, err error) {
-	if s.snapshotFile == nil {
-		file, err := os.OpenFile(filepath.Join(s.wipDir, "snapshot"), os.O_CREATE|os.O_RDWR, 0600)
-		if err != nil {
-			return 0, err
-		}
-		s.snapshotFile = file
-		s.snapshotWriter = bufio.NewWriter(s.snapshotFile)
+	if err := s.open(); err != nil {
+		return 0, err
 	}
 
 	n, err = s.snapshotWriter.Write(p)
+	s.metadata.SetCRC64(crc64.Update(s.metadata.CRC64(), crc64Table, p[:n]))
 	if err != nil {
 		return n, err
 	}
@@ -193,27 +226,42 @@ func (s *SnapshotSink) Write(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// Close completes the snapshot, which is listed once its directory is renamed
+// after the data and the metadata are on the disk.
 func (s *SnapshotSink) Close() error {
-	if err := s.close(); err != nil {
-		return err
+	err := s.open()
+	if err == nil {
+		err = s.close()
 	}
-	if err := s.writeMeta(); err != nil {
-		return err
+	if err == nil {
+		err = s.writeMeta()
+	}
+	if err == nil {
+		err = os.Rename(s.wipDir, s.finalDir)
 	}
-	if err := os.Rename(s.wipDir, s.finalDir); err != nil {
+	if err == nil {
+		err = syncDir(filepath.Dir(s.finalDir))
+	}
+	if err != nil {
+		os.RemoveAll(s.wipDir)
 		return err
 	}
 	return nil
 }
 
 func (s *SnapshotSink) Cancel() error {
-	if err := s.close(); err != nil {
-		return err
-	}
-	if err := os.RemoveAll(s.wipDir); err != nil {
+	s.close()
+	return os.RemoveAll(s.wipDir)
+}
+
+// syncDir makes the renames in the directory durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer file.Close()
+	return file.Sync()
 }
 
 type SnapshotStore struct {
@@ -227,18 +275,19 @@ func NewSnapshotStore(storeDir string) *SnapshotStore {
 func (s *SnapshotStore) listDirnames() ([]string, []string, error) {
 	complete := []string{}
 	inprogress := []string{}
-	if err := filepath.WalkDir(s.storeDir, func(path string, d fs.DirEntry, err error) error {
-		if path == s.storeDir || !d.IsDir() {
-			return nil
+	entries, err := os.ReadDir(s.storeDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
 		}
-		if !strings.HasPrefix(d.Name(), "inprogress-") {
-			complete = append(complete, d.Name())
+		if !strings.HasPrefix(entry.Name(), "inprogress-") {
+			complete = append(complete, entry.Name())
 		} else {
-			inprogress = append(inprogress, d.Name())
+			inprogress = append(inprogress, entry.Name())
 		}
-		return filepath.SkipDir
-	}); err != nil {
-		return nil, nil, err
 	}
 	return complete, inprogress, nil
 }
@@ -246,13 +295,7 @@ func (s *SnapshotStore) listDirnames() ([]string, []string, error) {
 func (s *SnapshotStore) sortMeta(dirnames []string) ([]raft.SnapshotMeta, error) {
 	metadataList := []raft.SnapshotMeta{}
 	for _, dirname := range dirnames {
-		file, err := os.Open(filepath.Join(s.storeDir, dirname, "metadata"))
-		if err != nil {
-			return nil, err
-		}
-		metadataBytes, err := io.ReadAll(file)
-		file.Close()
-		metadata, err := s.DecodeMeta(metadataBytes)
+		metadata, err := readMeta(filepath.Join(s.storeDir, dirname))
 		if err != nil {
 			return nil, err
 		}
@@ -302,11 +345,18 @@ func (s *SnapshotStore) Open(id string) (raft.Snapshot, error) {
 
 func (s *SnapshotStore) DecodeMeta(b []byte) (raft.SnapshotMeta, error) {
 	var pbMetadata kvpb.SnapshotMeta
-	proto.Unmarshal(b, &pbMetadata)
+	if err := proto.Unmarshal(b, &pbMetadata); err != nil {
+		return nil, err
+	}
 	return &SnapshotMeta{pbMetadata: &pbMetadata}, nil
 }
 
-// TODO: Refactor this
+func (s *SnapshotStore) Delete(id string) error {
+	return os.RemoveAll(filepath.Join(s.storeDir, id))
+}
+
+// Trim removes the snapshots left in progress and all complete snapshots
+// except the latest one.
 func (s *SnapshotStore) Trim() error {
 	complete, inprogress, err := s.listDirnames()
 	if err != nil {
@@ -323,6 +373,9 @@ func (s *SnapshotStore) Trim() error {
 	if err != nil {
 		return err
 	}
+	if len(metadataList) <= 1 {
+		return nil
+	}
 	for _, metadata := range metadataList[1:] {
 		if err := os.RemoveAll(filepath.Join(s.storeDir, metadata.Id())); err != nil {
 			return err
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+	"github.com/sumimakito/raft/rafttest"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	store := NewSnapshotStore(t.TempDir())
+	m := NewStateMachine()
+	m.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "a", Value: []byte("1"), ExpiresAt: 42}))
+	m.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "b", Value: []byte("2")}))
+
+	c := &pb.Configuration{Current: &pb.Config{Peers: []*pb.Peer{{Id: "1", Endpoint: "e1"}}}}
+	write := func(index uint64) string {
+		snapshot, err := m.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink, err := store.Create(index, 1, c, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, snapshot.Write(sink))
+		assert.NoError(t, sink.Close())
+		return sink.Meta().Id()
+	}
+	write(1)
+	id := write(2)
+	// The snapshot being written is not listed.
+	inprogress, err := store.Create(3, 1, c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metaList, err := store.List()
+	assert.NoError(t, err)
+	if assert.Len(t, metaList, 2) {
+		assert.Equal(t, id, metaList[0].Id())
+		assert.Equal(t, uint64(2), metaList[0].Index())
+		assert.Equal(t, c.Current.Peers[0].Id, metaList[0].Configuration().Current.Peers[0].Id)
+	}
+	_, err = raft.CheckSnapshot(store, id)
+	assert.NoError(t, err)
+
+	snapshot, err := store.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	restored := NewStateMachine()
+	assert.NoError(t, restored.Restore(snapshot))
+	assert.Equal(t, m.KeyValues(), restored.KeyValues())
+	assert.Equal(t, []string{"a", "b"}, restored.Keys())
+	expiresAt, ok := restored.ExpiresAt("a")
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), expiresAt.UnixNano())
+
+	assert.NoError(t, store.Trim())
+	metaList, err = store.List()
+	assert.NoError(t, err)
+	if assert.Len(t, metaList, 1) {
+		assert.Equal(t, id, metaList[0].Id())
+	}
+	assert.NoError(t, inprogress.Cancel())
+	_, err = store.Open("unknown")
+	assert.Error(t, err)
+}
+
+// TestSnapshotRestart restarts the servers of the KV example from the
+// snapshots, taken by themselves or installed from the leader.
+func TestSnapshotRestart(t *testing.T) {
+	snapshotStores := map[string]*SnapshotStore{}
+	c := rafttest.NewCluster(t, rafttest.Options{
+		Servers:      3,
+		StateMachine: func(id string) raft.StateMachine { return NewStateMachine() },
+		StableStore: func(id string) raft.StableStore {
+			store, err := raft.NewBoltStore(filepath.Join(t.TempDir(), "store.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+		SnapshotStore: func(id string) raft.SnapshatStore {
+			snapshotStores[id] = NewSnapshotStore(t.TempDir())
+			return snapshotStores[id]
+		},
+	})
+	set := func(key string) uint64 {
+		return c.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: key, Value: []byte(key)}))
+	}
+	c.WaitForApplied(set("0"))
+	follower := ""
+	for _, server := range c.Servers() {
+		if server.Id() != c.WaitForLeader().Id() {
+			follower = server.Id()
+		}
+	}
+	c.Stop(follower)
+
+	var index uint64
+	for i := 1; i < 10; i++ {
+		index = set(fmt.Sprint(i))
+	}
+	// The logs are compacted on the servers that may become the leader, so
+	// that the snapshot is installed on the follower.
+	for _, server := range c.Servers() {
+		if server.Id() == follower {
+			continue
+		}
+		c.WaitForApplied(index, server.Id())
+		if _, err := server.Snapshot().Result(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := c.StateMachine(c.WaitForLeader().Id()).(*StateMachine).KeyValues()
+
+	c.Restart(follower)
+	c.WaitForApplied(index, follower)
+	assert.Equal(t, expected, c.StateMachine(follower).(*StateMachine).KeyValues())
+	metaList, err := snapshotStores[follower].List()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, metaList)
+
+	// The servers are restored from their own snapshots once restarted.
+	for _, server := range c.Servers() {
+		c.Stop(server.Id())
+	}
+	for _, server := range c.Servers() {
+		c.Restart(server.Id())
+	}
+	c.WaitForApplied(set("after"))
+	expected["after"] = []byte("after")
+	for _, server := range c.Servers() {
+		assert.Equal(t, expected, c.StateMachine(server.Id()).(*StateMachine).KeyValues())
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/sumimakito/raft"
 	"github.com/ugorji/go/codec"
@@ -9,34 +12,176 @@ import (
 
 type StateMachine struct {
 	mu     sync.RWMutex
-	index  uint64
-	term   uint64
 	states map[string][]byte
+	// keys are the keys of states in order, which serve the range queries.
+	keys []string
+	// expiresAt are the times in Unix nanoseconds the keys with a TTL expire
+	// at.
+	expiresAt  map[string]int64
+	expiration expiration
 }
 
 func NewStateMachine() *StateMachine {
-	return &StateMachine{states: map[string][]byte{}}
+	return &StateMachine{
+		states:     map[string][]byte{},
+		expiresAt:  map[string]int64{},
+		expiration: expiration{interval: defaultExpirationInterval},
+	}
 }
 
-func (m *StateMachine) Apply(command raft.Command) {
+// Apply applies the command and returns an *ApplyResult with the previous
+// value of the key, or an error if the command is invalid.
+func (m *StateMachine) Apply(command raft.Command) interface{} {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	cmd := DecodeCommand(command)
 	switch cmd.Type {
+	case CommandTxn:
+		// The transaction is checked as a whole so that it's never partially
+		// applied.
+		if err := validateTxn(cmd); err != nil {
+			return err
+		}
+	case CommandMultiSet, CommandMultiDelete:
+		if err := validateMulti(cmd); err != nil {
+			return err
+		}
+	}
+	return m.apply(cmd)
+}
+
+func (m *StateMachine) apply(cmd *Command) *ApplyResult {
+	previous, found := m.states[cmd.Key]
+	switch cmd.Type {
 	case CommandSet:
-		m.states[cmd.Key] = cmd.Value
+		m.set(cmd, found)
 	case CommandUnset:
-		delete(m.states, cmd.Key)
+		m.delete(cmd.Key, found)
+	case CommandExpire:
+		if !found || cmd.ExpiresAt == 0 || m.expiresAt[cmd.Key] != cmd.ExpiresAt {
+			return &ApplyResult{}
+		}
+		m.delete(cmd.Key, found)
+	case CommandCompareAndSwap:
+		succeeded := m.compare(cmd.Compares)
+		if succeeded {
+			m.set(cmd, found)
+		}
+		return &ApplyResult{Previous: previous, Found: found, Succeeded: succeeded}
+	case CommandTxn:
+		succeeded := m.compare(cmd.Compares)
+		commands := cmd.Failure
+		if succeeded {
+			commands = cmd.Success
+		}
+		result := &ApplyResult{Succeeded: succeeded, Results: make([]*ApplyResult, 0, len(commands))}
+		for _, c := range commands {
+			result.Results = append(result.Results, m.apply(c))
+		}
+		return result
+	case CommandMultiSet, CommandMultiDelete:
+		result := &ApplyResult{Results: make([]*ApplyResult, 0, len(cmd.Keys))}
+		for _, c := range cmd.commands() {
+			result.Results = append(result.Results, m.apply(c))
+		}
+		return result
+	}
+	return &ApplyResult{Previous: previous, Found: found}
+}
+
+// compare reports whether all the Compares hold.
+func (m *StateMachine) compare(compares []*Compare) bool {
+	for _, c := range compares {
+		value, found := m.states[c.Key]
+		if found != c.Exists || found && c.Value != nil && !bytes.Equal(value, c.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *StateMachine) set(cmd *Command, found bool) {
+	if !found {
+		m.insertKey(cmd.Key)
+	}
+	m.states[cmd.Key] = cmd.Value
+	if cmd.ExpiresAt != 0 {
+		m.expiresAt[cmd.Key] = cmd.ExpiresAt
+	} else {
+		delete(m.expiresAt, cmd.Key)
+	}
+}
+
+func (m *StateMachine) delete(key string, found bool) {
+	if found {
+		m.removeKey(key)
 	}
+	delete(m.states, key)
+	delete(m.expiresAt, key)
+}
+
+func (m *StateMachine) insertKey(key string) {
+	i := sort.SearchStrings(m.keys, key)
+	m.keys = append(m.keys, "")
+	copy(m.keys[i+1:], m.keys[i:])
+	m.keys[i] = key
 }
 
-func (m *StateMachine) Keys() (keys []string) {
+func (m *StateMachine) removeKey(key string) {
+	i := sort.SearchStrings(m.keys, key)
+	m.keys = append(m.keys[:i], m.keys[i+1:]...)
+}
+
+// Keys returns the keys in order.
+func (m *StateMachine) Keys() []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	for key := range m.states {
-		keys = append(keys, key)
+	return append(make([]string, 0, len(m.keys)), m.keys...)
+}
+
+// KeyValue is a key and its value.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Range returns the keys in [start, end) and their values in order, or those
+// from start on if end is empty. At most limit keys are returned unless limit
+// is 0, and more reports whether there are more keys in the range.
+func (m *StateMachine) Range(start, end string, limit int) (keyValues []KeyValue, more bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keyValues = []KeyValue{}
+	for i := sort.SearchStrings(m.keys, start); i < len(m.keys); i++ {
+		key := m.keys[i]
+		if end != "" && key >= end {
+			break
+		}
+		if limit > 0 && len(keyValues) == limit {
+			return keyValues, true
+		}
+		keyValues = append(keyValues, KeyValue{Key: key, Value: append(([]byte)(nil), m.states[key]...)})
+	}
+	return keyValues, false
+}
+
+// Prefix returns the keys with the prefix and their values in order, with the
+// limit as in Range.
+func (m *StateMachine) Prefix(prefix string, limit int) (keyValues []KeyValue, more bool) {
+	return m.Range(prefix, prefixEnd(prefix), limit)
+}
+
+// prefixEnd returns the smallest key greater than all keys with the prefix,
+// or an empty string if there is no such key.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
 	}
-	return
+	return ""
 }
 
 func (m *StateMachine) Value(key string) ([]byte, bool) {
@@ -46,6 +191,18 @@ func (m *StateMachine) Value(key string) ([]byte, bool) {
 	return v, ok
 }
 
+// ExpiresAt returns the time the key expires at, or false if the key doesn't
+// exist or never expires.
+func (m *StateMachine) ExpiresAt(key string) (time.Time, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	expiresAt, ok := m.expiresAt[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, expiresAt), true
+}
+
 func (m *StateMachine) KeyValues() map[string][]byte {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -56,50 +213,59 @@ func (m *StateMachine) KeyValues() map[string][]byte {
 	return keyValues
 }
 
+// snapshotState is the state of the StateMachine kept in the snapshots.
+type snapshotState struct {
+	KeyValues map[string][]byte
+	ExpiresAt map[string]int64
+}
+
 func (m *StateMachine) Snapshot() (raft.StateMachineSnapshot, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	keyValues := map[string][]byte{}
+	state := &snapshotState{KeyValues: map[string][]byte{}, ExpiresAt: map[string]int64{}}
 	for key, value := range m.states {
-		keyValues[key] = append(([]byte)(nil), value...)
+		state.KeyValues[key] = append(([]byte)(nil), value...)
+	}
+	for key, expiresAt := range m.expiresAt {
+		state.ExpiresAt[key] = expiresAt
 	}
-	return &KVSMSnapshot{index: m.index, term: m.term, keyValues: keyValues}, nil
+	return &KVSMSnapshot{state: state}, nil
 }
 
 func (m *StateMachine) Restore(snapshot raft.Snapshot) error {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	keyValues := map[string][]byte{}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	snapshotReader, err := snapshot.Reader()
 	if err != nil {
 		return err
 	}
-	if err := codec.NewDecoder(snapshotReader, &codec.MsgpackHandle{}).Decode(&keyValues); err != nil {
+	var state snapshotState
+	if err := codec.NewDecoder(snapshotReader, &codec.MsgpackHandle{}).Decode(&state); err != nil {
 		return err
 	}
-	m.states = keyValues
+	if state.KeyValues == nil {
+		state.KeyValues = map[string][]byte{}
+	}
+	if state.ExpiresAt == nil {
+		state.ExpiresAt = map[string]int64{}
+	}
+	keys := make([]string, 0, len(state.KeyValues))
+	for key := range state.KeyValues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	m.states = state.KeyValues
+	m.keys = keys
+	m.expiresAt = state.ExpiresAt
 	return nil
 }
 
+// KVSMSnapshot is a copy of the state taken by StateMachine.Snapshot, so that
+// it's written to the sink while the commands are applied.
 type KVSMSnapshot struct {
-	index     uint64
-	term      uint64
-	keyValues map[string][]byte
-}
-
-func (s *KVSMSnapshot) Index() uint64 {
-	return s.index
-}
-
-func (s *KVSMSnapshot) Term() uint64 {
-	return s.term
+	state *snapshotState
 }
 
 func (s *KVSMSnapshot) Write(sink raft.SnapshotSink) error {
-	var out []byte
-	if err := codec.NewEncoder(sink, &codec.MsgpackHandle{}).Encode(s.keyValues); err != nil {
-		return err
-	}
-	_, err := sink.Write(out)
-	return err
+	return codec.NewEncoder(sink, &codec.MsgpackHandle{}).Encode(s.state)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateMachineRange(t *testing.T) {
+	m := NewStateMachine()
+	apply := func(command *Command) {
+		m.Apply(encodeCommand(t, command))
+	}
+	for _, key := range []string{"b", "a/2", "a/1", "c", "a/3", "a\xff", "\xff\xff"} {
+		apply(&Command{Type: CommandSet, Key: key, Value: []byte(key)})
+	}
+	apply(&Command{Type: CommandUnset, Key: "a/3"})
+	apply(&Command{Type: CommandUnset, Key: "d"})
+	apply(&Command{Type: CommandSet, Key: "b", Value: []byte("b2")})
+	assert.Equal(t, []string{"a/1", "a/2", "a\xff", "b", "c", "\xff\xff"}, m.Keys())
+
+	keys := func(keyValues []KeyValue, more bool) []interface{} {
+		var keys []string
+		for _, kv := range keyValues {
+			keys = append(keys, kv.Key)
+		}
+		return []interface{}{keys, more}
+	}
+	assert.Equal(t, []interface{}{[]string{"a\xff", "b"}, false}, keys(m.Range("a0", "c", 0)))
+	assert.Equal(t, []interface{}{[]string{"b", "c", "\xff\xff"}, false}, keys(m.Range("b", "", 0)))
+	assert.Equal(t, []interface{}{[]string{"a/1", "a/2"}, true}, keys(m.Range("", "", 2)))
+	assert.Equal(t, []interface{}{[]string{"a/1", "a/2"}, false}, keys(m.Prefix("a/", 0)))
+	assert.Equal(t, []interface{}{[]string{"a/1"}, true}, keys(m.Prefix("a/", 1)))
+	assert.Equal(t, []interface{}{[]string{"a/1", "a/2", "a\xff"}, false}, keys(m.Prefix("a", 0)))
+	assert.Equal(t, []interface{}{[]string{"\xff\xff"}, false}, keys(m.Prefix("\xff", 0)))
+	assert.Equal(t, []interface{}{[]string(nil), false}, keys(m.Prefix("d", 0)))
+
+	keyValues, _ := m.Range("b", "c", 0)
+	assert.Equal(t, []KeyValue{{Key: "b", Value: []byte("b2")}}, keyValues)
+}
+
+func TestStateMachineTxn(t *testing.T) {
+	m := NewStateMachine()
+	m.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "a", Value: []byte("1")}))
+
+	// The key is swapped only if it has the value.
+	result := m.Apply(encodeCommand(t, &Command{Type: CommandCompareAndSwap, Key: "a", Value: []byte("2"),
+		Compares: []*Compare{{Key: "a", Exists: true, Value: []byte("0")}}}))
+	assert.Equal(t, &ApplyResult{Previous: []byte("1"), Found: true}, result)
+	result = m.Apply(encodeCommand(t, &Command{Type: CommandCompareAndSwap, Key: "a", Value: []byte("2"),
+		Compares: []*Compare{{Key: "a", Exists: true, Value: []byte("1")}}}))
+	assert.Equal(t, &ApplyResult{Previous: []byte("1"), Found: true, Succeeded: true}, result)
+	result = m.Apply(encodeCommand(t, &Command{Type: CommandCompareAndSwap, Key: "b", Value: []byte("1"),
+		Compares: []*Compare{{Key: "b"}}}))
+	assert.Equal(t, &ApplyResult{Succeeded: true}, result)
+
+	txn := &Command{
+		Type:     CommandTxn,
+		Compares: []*Compare{{Key: "a", Exists: true}, {Key: "c"}},
+		Success: []*Command{
+			{Type: CommandSet, Key: "c", Value: []byte("3")},
+			{Type: CommandUnset, Key: "b"},
+		},
+		Failure: []*Command{{Type: CommandSet, Key: "failed", Value: []byte("1")}},
+	}
+	result = m.Apply(encodeCommand(t, txn))
+	assert.Equal(t, &ApplyResult{Succeeded: true, Results: []*ApplyResult{
+		{},
+		{Previous: []byte("1"), Found: true},
+	}}, result)
+	// The result is carried back to the followers the transaction is applied
+	// through.
+	data, err := result.(*ApplyResult).MarshalBinary()
+	assert.NoError(t, err)
+	decoded, err := decodeApplyResult(data)
+	assert.NoError(t, err)
+	assert.Equal(t, result, decoded)
+	// The compares no longer hold as c exists.
+	result = m.Apply(encodeCommand(t, txn))
+	assert.Equal(t, &ApplyResult{Results: []*ApplyResult{{}}}, result)
+	assert.Equal(t, []string{"a", "c", "failed"}, m.Keys())
+
+	// The invalid transaction is not applied at all.
+	result = m.Apply(encodeCommand(t, &Command{Type: CommandTxn, Success: []*Command{
+		{Type: CommandSet, Key: "d", Value: []byte("4")},
+		{Type: CommandExpire, Key: "a"},
+	}}))
+	assert.EqualError(t, result.(error), "invalid command in the transaction: expire")
+	assert.Equal(t, []string{"a", "c", "failed"}, m.Keys())
+}
+
+func TestStateMachineMulti(t *testing.T) {
+	m := NewStateMachine()
+	m.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "a", Value: []byte("1")}))
+
+	result := m.Apply(encodeCommand(t, &Command{
+		Type:      CommandMultiSet,
+		Keys:      []string{"a", "b"},
+		Values:    [][]byte{[]byte("2"), []byte("3")},
+		ExpiresAt: 42,
+	}))
+	assert.Equal(t, &ApplyResult{Results: []*ApplyResult{
+		{Previous: []byte("1"), Found: true},
+		{},
+	}}, result)
+	assert.Equal(t, map[string][]byte{"a": []byte("2"), "b": []byte("3")}, m.KeyValues())
+	expiresAt, ok := m.ExpiresAt("b")
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), expiresAt.UnixNano())
+
+	result = m.Apply(encodeCommand(t, &Command{Type: CommandMultiDelete, Keys: []string{"b", "c"}}))
+	assert.Equal(t, &ApplyResult{Results: []*ApplyResult{
+		{Previous: []byte("3"), Found: true},
+		{},
+	}}, result)
+	assert.Equal(t, []string{"a"}, m.Keys())
+
+	// The command without a value for each key is not applied at all.
+	result = m.Apply(encodeCommand(t, &Command{
+		Type:   CommandMultiSet,
+		Keys:   []string{"c", "d"},
+		Values: [][]byte{[]byte("4")},
+	}))
+	assert.EqualError(t, result.(error), "2 keys given with 1 values")
+	assert.Equal(t, []string{"a"}, m.Keys())
+}
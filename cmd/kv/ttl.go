@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sumimakito/raft"
+)
+
+const (
+	defaultExpirationInterval = time.Second
+	// maxExpirationsPerRound is the maximum number of the keys expired in a
+	// round, so that a burst of expirations doesn't hold back the other
+	// commands.
+	maxExpirationsPerRound = 100
+)
+
+// expiration expires the keys with a TTL while the server is the leader. The
+// leader doesn't delete the keys by itself, but applies CommandExpire through
+// the log, so that the keys are deleted at the same point of the log on all
+// servers regardless of their clocks.
+type expiration struct {
+	interval time.Duration
+
+	mu     sync.Mutex // protects server and stopCh
+	server *raft.Server
+	stopCh chan struct{}
+}
+
+// SetServer sets the server the expired keys are deleted through, which must
+// be the server the StateMachine is applied by.
+func (m *StateMachine) SetServer(server *raft.Server) {
+	m.expiration.mu.Lock()
+	defer m.expiration.mu.Unlock()
+	m.expiration.server = server
+}
+
+// OnPromote starts expiring the keys on the leader.
+func (m *StateMachine) OnPromote(term uint64) {
+	m.expiration.mu.Lock()
+	defer m.expiration.mu.Unlock()
+	if m.expiration.stopCh != nil {
+		close(m.expiration.stopCh)
+	}
+	m.expiration.stopCh = make(chan struct{})
+	go m.runExpiration(m.expiration.stopCh)
+}
+
+// OnDemote stops expiring the keys.
+func (m *StateMachine) OnDemote() {
+	m.expiration.mu.Lock()
+	defer m.expiration.mu.Unlock()
+	if m.expiration.stopCh != nil {
+		close(m.expiration.stopCh)
+		m.expiration.stopCh = nil
+	}
+}
+
+func (m *StateMachine) runExpiration(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(m.expiration.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case now := <-ticker.C:
+			m.expire(stopCh, now)
+		}
+	}
+}
+
+// expire applies CommandExpire for the keys expired by now. The keys left
+// expired, e.g., as the commands failed, are expired in the next round.
+func (m *StateMachine) expire(stopCh <-chan struct{}, now time.Time) {
+	m.expiration.mu.Lock()
+	server := m.expiration.server
+	m.expiration.mu.Unlock()
+	if server == nil {
+		return
+	}
+	for _, command := range m.expired(now.UnixNano()) {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		data, err := raft.EncodeCommand(raft.MsgpackCodec, command)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), m.expiration.interval)
+		_, err = server.ApplyCommand(ctx, data).Response()
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// expired returns the commands expiring the keys expired by now, the earliest
+// first.
+func (m *StateMachine) expired(now int64) []*Command {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var commands []*Command
+	for key, expiresAt := range m.expiresAt {
+		if expiresAt <= now {
+			commands = append(commands, &Command{Type: CommandExpire, Key: key, ExpiresAt: expiresAt})
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if commands[i].ExpiresAt != commands[j].ExpiresAt {
+			return commands[i].ExpiresAt < commands[j].ExpiresAt
+		}
+		return commands[i].Key < commands[j].Key
+	})
+	if len(commands) > maxExpirationsPerRound {
+		commands = commands[:maxExpirationsPerRound]
+	}
+	return commands
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/rafttest"
+)
+
+func encodeCommand(t *testing.T, command *Command) raft.Command {
+	t.Helper()
+	data, err := raft.EncodeCommand(raft.MsgpackCodec, command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStateMachineExpire(t *testing.T) {
+	m := NewStateMachine()
+	m.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "a", Value: []byte("1"), ExpiresAt: 10}))
+	m.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "b", Value: []byte("1"), ExpiresAt: 20}))
+	m.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "c", Value: []byte("1")}))
+	assert.Equal(t, []*Command{
+		{Type: CommandExpire, Key: "a", ExpiresAt: 10},
+		{Type: CommandExpire, Key: "b", ExpiresAt: 20},
+	}, m.expired(20))
+
+	// The key set again since it's found expired is kept.
+	m.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "a", Value: []byte("2"), ExpiresAt: 30}))
+	result := m.Apply(encodeCommand(t, &Command{Type: CommandExpire, Key: "a", ExpiresAt: 10}))
+	assert.Equal(t, &ApplyResult{}, result)
+	value, _ := m.Value("a")
+	assert.Equal(t, "2", string(value))
+
+	result = m.Apply(encodeCommand(t, &Command{Type: CommandExpire, Key: "b", ExpiresAt: 20}))
+	assert.Equal(t, &ApplyResult{Previous: []byte("1"), Found: true}, result)
+	// The key set without a TTL never expires.
+	m.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "a", Value: []byte("3")}))
+	assert.Empty(t, m.expired(30))
+	assert.Equal(t, []string{"a", "c"}, m.Keys())
+}
+
+func TestStateMachineExpiration(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{
+		Servers: 3,
+		StateMachine: func(id string) raft.StateMachine {
+			m := NewStateMachine()
+			m.expiration.interval = 20 * time.Millisecond
+			return m
+		},
+	})
+	for _, server := range c.Servers() {
+		c.StateMachine(server.Id()).(*StateMachine).SetServer(server)
+	}
+	c.WaitForApplied(c.Apply(encodeCommand(t, &Command{
+		Type: CommandSet, Key: "expiring", Value: []byte("v"), ExpiresAt: time.Now().Add(time.Second).UnixNano(),
+	})))
+	c.WaitForApplied(c.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "kept", Value: []byte("v")})))
+	for _, server := range c.Servers() {
+		_, ok := c.StateMachine(server.Id()).(*StateMachine).ExpiresAt("expiring")
+		assert.True(t, ok)
+	}
+
+	leader := c.WaitForLeader()
+	assert.Eventually(t, func() bool {
+		_, ok := c.StateMachine(leader.Id()).(*StateMachine).Value("expiring")
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+	// The expiration is replicated through the log.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	meta, err := leader.ApplyCommand(ctx, encodeCommand(t, &Command{Type: CommandSet, Key: "after", Value: []byte("v")})).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WaitForApplied(meta.Index)
+	for _, server := range c.Servers() {
+		assert.Equal(t, []string{"after", "kept"}, c.StateMachine(server.Id()).(*StateMachine).Keys())
+	}
+}
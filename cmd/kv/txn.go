@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sumimakito/raft"
+)
+
+// txnRequest is the body of the requests to /txn, e.g.,
+//
+//	{
+//	  "compares": [{"key": "lock", "exists": false}],
+//	  "success": [{"type": "set", "key": "lock", "value": "b3duZXI=", "ttl": "10s"}],
+//	  "failure": []
+//	}
+//
+// where the values are encoded in base64.
+type txnRequest struct {
+	Compares []*Compare      `json:"compares"`
+	Success  []*txnRequestOp `json:"success"`
+	Failure  []*txnRequestOp `json:"failure"`
+}
+
+type txnRequestOp struct {
+	// Type is either set or unset.
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	TTL   string `json:"ttl"`
+}
+
+func (o *txnRequestOp) command(now time.Time) (*Command, error) {
+	command := &Command{Key: o.Key}
+	switch o.Type {
+	case CommandSet.String():
+		command.Type = CommandSet
+		command.Value = o.Value
+		if o.TTL != "" {
+			ttl, err := time.ParseDuration(o.TTL)
+			if err != nil || ttl <= 0 {
+				return nil, errors.New("invalid ttl: " + o.TTL)
+			}
+			command.ExpiresAt = now.Add(ttl).UnixNano()
+		}
+	case CommandUnset.String():
+		if o.Value != nil || o.TTL != "" {
+			return nil, fmt.Errorf("unexpected value of %s %s", o.Type, o.Key)
+		}
+		command.Type = CommandUnset
+	default:
+		return nil, fmt.Errorf("invalid type of %s: %s", o.Key, o.Type)
+	}
+	return command, nil
+}
+
+// command returns the CommandTxn of the request.
+func (r *txnRequest) command() (*Command, error) {
+	command := &Command{Type: CommandTxn, Compares: r.Compares}
+	now := time.Now()
+	for _, op := range r.Success {
+		c, err := op.command(now)
+		if err != nil {
+			return nil, err
+		}
+		command.Success = append(command.Success, c)
+	}
+	for _, op := range r.Failure {
+		c, err := op.command(now)
+		if err != nil {
+			return nil, err
+		}
+		command.Failure = append(command.Failure, c)
+	}
+	for _, c := range command.Compares {
+		if c == nil {
+			return nil, errors.New("invalid compare: null")
+		}
+		if !c.Exists && c.Value != nil {
+			return nil, fmt.Errorf("unexpected value of the absent key %s", c.Key)
+		}
+	}
+	return command, nil
+}
+
+// serveTxn applies the transaction in the request body. The response is 200
+// OK with the ApplyResult whether or not the compares held.
+func (e *APIExtension) serveTxn(s *raft.Server, rw http.ResponseWriter, r *http.Request) {
+	var request txnRequest
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxValueSize+1))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		e.writeError(rw, err, http.StatusBadRequest)
+		return
+	}
+	command, err := request.command()
+	if err != nil {
+		e.writeError(rw, err, http.StatusBadRequest)
+		return
+	}
+	e.apply(s, rw, r, command)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+)
+
+const watchKeepaliveInterval = 15 * time.Second
+
+// WatchEvent is a change of a key streamed by the watch endpoint. The changes
+// are conditional as the commands are: an event of CommandExpire deletes the
+// key only if it still expires at ExpiresAt, i.e., it hasn't been set since
+// with another TTL, and those of CommandCompareAndSwap and CommandTxn apply
+// depending on the Compares, which the watchers keeping the keys check as the
+// StateMachine does.
+type WatchEvent struct {
+	// Index is the index of the log of the change, from which the watch can
+	// be resumed. It's 0 for the changes in Success and Failure.
+	Index     uint64        `json:"index,omitempty"`
+	Type      string        `json:"type"`
+	Key       string        `json:"key,omitempty"`
+	Value     []byte        `json:"value,omitempty"`
+	ExpiresAt int64         `json:"expires_at,omitempty"`
+	Compares  []*Compare    `json:"compares,omitempty"`
+	Success   []*WatchEvent `json:"success,omitempty"`
+	Failure   []*WatchEvent `json:"failure,omitempty"`
+	// Keys and Values are those of CommandMultiSet and CommandMultiDelete.
+	Keys   []string `json:"keys,omitempty"`
+	Values [][]byte `json:"values,omitempty"`
+}
+
+func newWatchEvent(index uint64, command *Command) *WatchEvent {
+	event := &WatchEvent{
+		Index:     index,
+		Type:      command.Type.String(),
+		Key:       command.Key,
+		Value:     command.Value,
+		ExpiresAt: command.ExpiresAt,
+		Compares:  command.Compares,
+		Keys:      command.Keys,
+		Values:    command.Values,
+	}
+	for _, c := range command.Success {
+		event.Success = append(event.Success, newWatchEvent(0, c))
+	}
+	for _, c := range command.Failure {
+		event.Failure = append(event.Failure, newWatchEvent(0, c))
+	}
+	return event
+}
+
+// watchedBy reports whether the command may change the keys with the prefix.
+func (c *Command) watchedBy(prefix string) bool {
+	switch c.Type {
+	case CommandTxn:
+	case CommandMultiSet, CommandMultiDelete:
+		for _, key := range c.Keys {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	default:
+		return strings.HasPrefix(c.Key, prefix)
+	}
+	for _, commands := range [][]*Command{c.Success, c.Failure} {
+		for _, command := range commands {
+			if command.watchedBy(prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWatch streams the changes of the keys with the prefix parameter as
+// server-sent events named after the types of the changes, as the logs are
+// applied. The changes are streamed from the log at the from parameter, the
+// one after the Last-Event-ID header, or the next log to apply. If the logs
+// to stream have been compacted, an error event is sent and the stream ends,
+// and the client should read the keys again before resuming the watch.
+func (e *APIExtension) serveWatch(s *raft.Server, rw http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	fromIndex := s.States().LastAppliedIndex + 1
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		index, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			e.writeError(rw, errors.New("invalid Last-Event-ID: "+value), http.StatusBadRequest)
+			return
+		}
+		fromIndex = index + 1
+	}
+	if value := r.URL.Query().Get("from"); value != "" {
+		index, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			e.writeError(rw, errors.New("invalid from: "+value), http.StatusBadRequest)
+			return
+		}
+		fromIndex = index
+	}
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		e.writeError(rw, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	events := make(chan *WatchEvent)
+	watchErrCh := make(chan error, 1)
+	go func() {
+		watchErrCh <- s.WatchLogs(ctx, fromIndex, []pb.LogType{pb.LogType_COMMAND}, func(log *pb.Log) error {
+			command, err := raft.DecodeCommand[*Command](raft.MsgpackCodec, log.Body.Data)
+			if err != nil {
+				return err
+			}
+			if !command.watchedBy(prefix) {
+				return nil
+			}
+			select {
+			case events <- newWatchEvent(log.Meta.Index, command):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(watchKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-watchErrCh:
+			if ctx.Err() == nil {
+				data, _ := json.Marshal(errorResponse{Error: err.Error()})
+				fmt.Fprintf(rw, "event: error\ndata: %s\n\n", data)
+				flusher.Flush()
+			}
+			return
+		case <-keepalive.C:
+			// Comments keep idle connections from being closed by proxies.
+			if _, err := io.WriteString(rw, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", event.Index, event.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
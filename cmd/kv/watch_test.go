@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/rafttest"
+	"go.uber.org/zap"
+)
+
+func TestAPIExtensionWatch(t *testing.T) {
+	c := rafttest.NewCluster(t, rafttest.Options{
+		Servers:       3,
+		StateMachine:  func(id string) raft.StateMachine { return NewStateMachine() },
+		ServerOptions: []raft.ServerOption{raft.APIExtensionOption(NewAPIExtension(zap.NewNop(), nil))},
+	})
+	leader := c.WaitForLeader()
+	first := c.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "a/1", Value: []byte("1")}))
+	c.WaitForApplied(first)
+	// The changes are watched on a follower.
+	var follower *raft.Server
+	for _, server := range c.Servers() {
+		if server.Id() != leader.Id() {
+			follower = server
+		}
+	}
+	httpServer := httptest.NewServer(follower.APIHandler())
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := func(query string, header http.Header) (*bufio.Reader, func()) {
+		t.Helper()
+		ctx, cancel := context.WithCancel(ctx)
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, httpServer.URL+"/api/extension/watch?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name := range header {
+			request.Header.Set(name, header.Get(name))
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+		return bufio.NewReader(response.Body), func() {
+			cancel()
+			response.Body.Close()
+		}
+	}
+	readEvent := func(reader *bufio.Reader) (id, name string, event WatchEvent) {
+		t.Helper()
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			case line == "":
+				return id, name, event
+			}
+		}
+	}
+
+	// The watch starts from the next log to apply by default.
+	reader, stop := watch("prefix=a/", nil)
+	defer stop()
+	c.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "b", Value: []byte("ignored")}))
+	second := c.Apply(encodeCommand(t, &Command{Type: CommandSet, Key: "a/2", Value: []byte("2"), ExpiresAt: 42}))
+	third := c.Apply(encodeCommand(t, &Command{Type: CommandUnset, Key: "a/1"}))
+	id, name, event := readEvent(reader)
+	assert.Equal(t, "set", name)
+	assert.Equal(t, WatchEvent{Index: second, Type: "set", Key: "a/2", Value: []byte("2"), ExpiresAt: 42}, event)
+	assert.Equal(t, strconv.FormatUint(second, 10), id)
+	_, name, event = readEvent(reader)
+	assert.Equal(t, "unset", name)
+	assert.Equal(t, WatchEvent{Index: third, Type: "unset", Key: "a/1"}, event)
+
+	// The watch is resumed from the log.
+	reader, stop = watch("prefix=a/&from=1", nil)
+	defer stop()
+	_, _, event = readEvent(reader)
+	assert.Equal(t, WatchEvent{Index: first, Type: "set", Key: "a/1", Value: []byte("1")}, event)
+	reader, stop = watch("", http.Header{"Last-Event-Id": {id}})
+	defer stop()
+	_, _, event = readEvent(reader)
+	assert.Equal(t, third, event.Index)
+
+	// The watch ends once the logs to stream are compacted.
+	if _, err := follower.Snapshot().Result(); err != nil {
+		t.Fatal(err)
+	}
+	reader, stop = watch("from=1", nil)
+	defer stop()
+	_, name, _ = readEvent(reader)
+	assert.Equal(t, "error", name)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sumimakito/raft/raftclient"
+)
+
+// keyValue is a key printed by get in JSON.
+type keyValue struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// applyResult mirrors the ApplyResult of the KV example.
+type applyResult struct {
+	Previous  []byte `json:"previous"`
+	Found     bool   `json:"found"`
+	Succeeded bool   `json:"succeeded,omitempty"`
+}
+
+// watchEvent mirrors the WatchEvent of the KV example.
+type watchEvent struct {
+	Index     uint64          `json:"index,omitempty"`
+	Type      string          `json:"type"`
+	Key       string          `json:"key,omitempty"`
+	Value     []byte          `json:"value,omitempty"`
+	ExpiresAt int64           `json:"expires_at,omitempty"`
+	Compares  json.RawMessage `json:"compares,omitempty"`
+	Success   []*watchEvent   `json:"success,omitempty"`
+	Failure   []*watchEvent   `json:"failure,omitempty"`
+	Keys      []string        `json:"keys,omitempty"`
+	Values    [][]byte        `json:"values,omitempty"`
+}
+
+// errKeyNotFound is returned when the key to get or delete is not found.
+var errKeyNotFound = errors.New("key not found")
+
+// keyPath returns the path of the route of the key.
+func keyPath(key string) string {
+	return "/keys/" + url.PathEscape(key)
+}
+
+// printJSON writes v in JSON.
+func (e *env) printJSON(v interface{}) error {
+	return json.NewEncoder(e.out).Encode(v)
+}
+
+var getCommand = &command{
+	name:  "get",
+	usage: "get [-consistency linearizable|lease|stale] KEY",
+	help:  "Print the value of the key, read at the consistency.",
+	run: func(ctx context.Context, env *env, args []string) error {
+		flags := flag.NewFlagSet("get", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		consistency := flags.String("consistency", "linearizable", "")
+		if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+			return errUsage
+		}
+		key := flags.Arg(0)
+		ctx, cancel := env.withTimeout(ctx)
+		defer cancel()
+		query := url.Values{"encoding": {"raw"}, "consistency": {*consistency}}
+		response, err := env.client.ExtensionRequest(ctx, http.MethodGet, keyPath(key)+"?"+query.Encode(), nil)
+		var apiErr *raftclient.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return errKeyNotFound
+		} else if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		value, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		if env.json {
+			return env.printJSON(keyValue{Key: key, Value: value, ExpiresAt: response.Header.Get("X-Expires-At")})
+		}
+		_, err = fmt.Fprintf(env.out, "%s\n", value)
+		return err
+	},
+}
+
+// apply sends the request changing the key and prints the applyResult.
+func apply(ctx context.Context, env *env, method, path string, body io.Reader) error {
+	ctx, cancel := env.withTimeout(ctx)
+	defer cancel()
+	response, err := env.client.ExtensionRequest(ctx, method, path, body)
+	var apiErr *raftclient.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return errKeyNotFound
+	} else if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	var result applyResult
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return err
+	}
+	if env.json {
+		return env.printJSON(result)
+	}
+	_, err = fmt.Fprintln(env.out, "OK")
+	return err
+}
+
+var setCommand = &command{
+	name:  "set",
+	usage: "set [-ttl DURATION] KEY VALUE",
+	help:  "Set the key to the value, or to the standard input if the value is -.",
+	run: func(ctx context.Context, env *env, args []string) error {
+		flags := flag.NewFlagSet("set", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		ttl := flags.Duration("ttl", 0, "")
+		if err := flags.Parse(args); err != nil || flags.NArg() != 2 || *ttl < 0 {
+			return errUsage
+		}
+		key, value := flags.Arg(0), []byte(flags.Arg(1))
+		if flags.Arg(1) == "-" {
+			var err error
+			if value, err = ioutil.ReadAll(env.in); err != nil {
+				return err
+			}
+		}
+		path := keyPath(key)
+		if *ttl > 0 {
+			path += "?ttl=" + url.QueryEscape(ttl.String())
+		}
+		return apply(ctx, env, http.MethodPut, path, bytes.NewReader(value))
+	},
+}
+
+var delCommand = &command{
+	name:  "del",
+	usage: "del KEY",
+	help:  "Delete the key.",
+	run: func(ctx context.Context, env *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		return apply(ctx, env, http.MethodDelete, keyPath(args[0]), nil)
+	},
+}
+
+// watchRetryInterval is the interval to wait before the watch is resumed.
+const watchRetryInterval = time.Second
+
+var watchCommand = &command{
+	name:  "watch",
+	usage: "watch [-prefix PREFIX] [-from INDEX]",
+	help:  "Print the changes of the keys with the prefix as they are applied.",
+	run: func(ctx context.Context, env *env, args []string) error {
+		flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		prefix := flags.String("prefix", "", "")
+		from := flags.Uint64("from", 0, "")
+		if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+			return errUsage
+		}
+		// The watch is resumed from the log after the last change printed
+		// once the stream ends, e.g., as the leader changes.
+		fromIndex := *from
+		for {
+			err := watch(ctx, env, *prefix, fromIndex, func(event *watchEvent) error {
+				fromIndex = event.Index + 1
+				return printWatchEvent(env, event)
+			})
+			var watchErr *watchError
+			var apiErr *raftclient.APIError
+			if ctx.Err() != nil {
+				return nil
+			} else if errors.As(err, &watchErr) || errors.As(err, &apiErr) && apiErr.StatusCode/100 == 4 {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(watchRetryInterval):
+			}
+		}
+	},
+}
+
+// watchError is the error event that ends the stream of the watch.
+type watchError struct {
+	Message string `json:"error"`
+}
+
+func (e *watchError) Error() string {
+	return e.Message
+}
+
+// watch calls fn with the changes streamed by the watch endpoint from the log
+// at fromIndex, or the next log to apply if it's 0, until the stream ends. The
+// error event is returned as a watchError.
+func watch(ctx context.Context, env *env, prefix string, fromIndex uint64, fn func(event *watchEvent) error) error {
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if fromIndex > 0 {
+		query.Set("from", strconv.FormatUint(fromIndex, 10))
+	}
+	response, err := env.client.ExtensionRequest(ctx, http.MethodGet, "/watch?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var name string
+	var data []byte
+	scanner := bufio.NewScanner(response.Body)
+	// The values of up to 1 MiB are encoded in base64 in the events.
+	scanner.Buffer(nil, 4<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:"))...)
+		case line == "":
+			if data == nil {
+				// Comments and ids.
+				continue
+			}
+			if name == "error" {
+				var watchErr watchError
+				if err := json.Unmarshal(data, &watchErr); err != nil {
+					return err
+				}
+				return &watchErr
+			}
+			var event watchEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			if err := fn(&event); err != nil {
+				return err
+			}
+			name, data = "", nil
+		}
+	}
+	return scanner.Err()
+}
+
+func printWatchEvent(env *env, event *watchEvent) error {
+	if env.json {
+		return env.printJSON(event)
+	}
+	var b strings.Builder
+	var write func(indent string, event *watchEvent)
+	write = func(indent string, event *watchEvent) {
+		fmt.Fprintf(&b, "%s%s %s", indent, event.Type, event.Key)
+		if event.Value != nil {
+			fmt.Fprintf(&b, " %s", event.Value)
+		}
+		for i, key := range event.Keys {
+			fmt.Fprintf(&b, " %s", key)
+			if i < len(event.Values) {
+				fmt.Fprintf(&b, "=%s", event.Values[i])
+			}
+		}
+		if event.Compares != nil {
+			fmt.Fprintf(&b, " if %s", event.Compares)
+		}
+		b.WriteByte('\n')
+		for _, e := range event.Success {
+			write(indent+"  then ", e)
+		}
+		for _, e := range event.Failure {
+			write(indent+"  else ", e)
+		}
+	}
+	fmt.Fprintf(&b, "%d ", event.Index)
+	write("", event)
+	_, err := io.WriteString(env.out, b.String())
+	return err
+}
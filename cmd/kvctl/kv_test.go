@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/raftclient"
+)
+
+func TestKV(t *testing.T) {
+	keys := map[string][]byte{}
+	var consistencies, watchQueries []string
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/status", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(raft.ServerStates{ID: "1", Role: raft.Leader.String()})
+	})
+	router.HandleFunc("/api/extension/keys/{key:.+}", func(rw http.ResponseWriter, r *http.Request) {
+		value, ok := keys[mux.Vars(r)["key"]]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(rw, `{"error":"key not found"}`)
+			return
+		}
+		assert.Equal(t, "raw", r.URL.Query().Get("encoding"))
+		consistencies = append(consistencies, r.URL.Query().Get("consistency"))
+		rw.Write(value)
+	}).Methods("GET")
+	router.HandleFunc("/api/extension/keys/{key:.+}", func(rw http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		previous, found := keys[key]
+		if r.Method == http.MethodPut {
+			keys[key], _ = ioutil.ReadAll(r.Body)
+		} else if found {
+			delete(keys, key)
+		} else {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+		json.NewEncoder(rw).Encode(applyResult{Previous: previous, Found: found})
+	}).Methods("PUT", "DELETE")
+	router.HandleFunc("/api/extension/watch", func(rw http.ResponseWriter, r *http.Request) {
+		watchQueries = append(watchQueries, r.URL.RawQuery)
+		rw.Header().Set("Content-Type", "text/event-stream")
+		if r.URL.Query().Get("from") == "" {
+			fmt.Fprint(rw, ": keepalive\n\n")
+			fmt.Fprint(rw, "id: 3\nevent: set\ndata: {\"index\":3,\"type\":\"set\",\"key\":\"a/1\",\"value\":\"MQ==\"}\n\n")
+			return
+		}
+		fmt.Fprint(rw, "event: error\ndata: {\"error\":\"compacted\"}\n\n")
+	}).Methods("GET")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	client, err := raftclient.New([]string{strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	run := func(c *command, json bool, stdin string, args ...string) (string, error) {
+		var out bytes.Buffer
+		e := &env{client: client, in: strings.NewReader(stdin), out: &out, json: json, timeout: time.Second}
+		err := c.run(context.Background(), e, args)
+		return out.String(), err
+	}
+
+	out, err := run(setCommand, false, "", "a/1", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "OK\n", out)
+	out, err = run(setCommand, true, "2", "a/1", "-")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"previous":"MQ==","found":true}`, out)
+	out, err = run(getCommand, false, "", "a/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "2\n", out)
+	out, err = run(getCommand, true, "", "-consistency", "stale", "a/1")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"key":"a/1","value":"Mg=="}`, out)
+	assert.Equal(t, []string{"linearizable", "stale"}, consistencies)
+
+	_, err = run(delCommand, false, "", "a/1")
+	assert.NoError(t, err)
+	_, err = run(delCommand, false, "", "a/1")
+	assert.ErrorIs(t, err, errKeyNotFound)
+	_, err = run(getCommand, false, "", "a/1")
+	assert.ErrorIs(t, err, errKeyNotFound)
+	_, err = run(setCommand, false, "", "a/1")
+	assert.ErrorIs(t, err, errUsage)
+
+	// The watch is resumed after the last change until the error event.
+	out, err = run(watchCommand, false, "", "-prefix", "a/")
+	var watchErr *watchError
+	assert.True(t, errors.As(err, &watchErr))
+	assert.Equal(t, "3 set a/1 1\n", out)
+	assert.Equal(t, []string{"prefix=a%2F", "from=4&prefix=a%2F"}, watchQueries)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+	"github.com/sumimakito/raft/raftclient"
+)
+
+var statusCommand = &command{
+	name:  "status",
+	usage: "status",
+	help:  "Show the states of the servers at the endpoints.",
+	run:   runStatus,
+}
+
+var membersCommand = &command{
+	name:  "members",
+	usage: "members [add|add-non-voter|update <ID> <ENDPOINT> [KEY=VALUE...] | promote|remove <ID> | abort | history]",
+	help:  "List, add, update, promote, or remove the members, abort the transition, or show the history.",
+	run:   runMembers,
+}
+
+var transferLeadershipCommand = &command{
+	name:  "transfer-leadership",
+	usage: "transfer-leadership [ID]",
+	help:  "Transfer the leadership to the voter, or the most up-to-date one.",
+	run:   runTransferLeadership,
+}
+
+var snapshotCommand = &command{
+	name:  "snapshot",
+	usage: "snapshot",
+	help:  "Take a snapshot on each server at the endpoints.",
+	run:   runSnapshot,
+}
+
+var storageCommand = &command{
+	name:  "storage",
+	usage: "storage [compact]",
+	help:  "Show the disk usage of the stores of the servers at the endpoints, or compact them.",
+	run:   runStorage,
+}
+
+var eventsCommand = &command{
+	name:  "events",
+	usage: "events",
+	help:  "Tail the events of the servers at the endpoints until interrupted.",
+	run:   runEvents,
+}
+
+// endpointStatus is the status of the server at an endpoint, or the error
+// querying it.
+type endpointStatus struct {
+	Endpoint string             `json:"endpoint"`
+	States   *raft.ServerStates `json:"states,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+func runStatus(ctx context.Context, e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+	endpoints := e.client.Endpoints()
+	statuses := make([]endpointStatus, len(endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			statuses[i].Endpoint = endpoint
+			if states, err := e.client.Status(ctx, endpoint); err != nil {
+				statuses[i].Error = err.Error()
+			} else {
+				statuses[i].States = states
+			}
+		}(i, endpoint)
+	}
+	wg.Wait()
+	return e.print(statuses, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ENDPOINT\tID\tROLE\tTERM\tLEADER\tLAST LOG\tCOMMIT\tAPPLIED")
+		for _, status := range statuses {
+			if status.States == nil {
+				fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\t-\t(%s)\n", status.Endpoint, status.Error)
+				continue
+			}
+			states := status.States
+			leader := "-"
+			if states.Leader != nil && states.Leader.Id != "" {
+				leader = states.Leader.Id
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%d\t%d\t%d\n", status.Endpoint, states.ID, states.Role,
+				states.CurrentTerm, leader, states.LastLogIndex, states.CommitIndex, states.LastAppliedIndex)
+		}
+	})
+}
+
+func runMembers(ctx context.Context, e *env, args []string) error {
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+	switch {
+	case len(args) == 0:
+		members, err := e.client.Members(ctx)
+		if err != nil {
+			return err
+		}
+		return e.print(members, func(w *tabwriter.Writer) {
+			printConfiguration(w, "committed", members.Committed)
+			if members.Latest.LogIndex != members.Committed.LogIndex {
+				printConfiguration(w, "latest", members.Latest)
+			}
+		})
+	case len(args) >= 3 && (args[0] == "add" || args[0] == "add-non-voter" || args[0] == "update"):
+		peer := &pb.Peer{Id: args[1], Endpoint: args[2]}
+		if args[0] == "add-non-voter" {
+			peer.Suffrage = pb.Suffrage_SUFFRAGE_NON_VOTER
+		}
+		for _, arg := range args[3:] {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok || key == "" {
+				return errUsage
+			}
+			if peer.Metadata == nil {
+				peer.Metadata = map[string]string{}
+			}
+			peer.Metadata[key] = value
+		}
+		if args[0] == "update" {
+			return e.client.UpdatePeer(ctx, peer)
+		}
+		return e.client.AddPeer(ctx, peer)
+	case len(args) == 2 && args[0] == "promote":
+		return e.client.PromotePeer(ctx, args[1])
+	case len(args) == 2 && args[0] == "remove":
+		return e.client.RemovePeer(ctx, args[1])
+	case len(args) == 1 && args[0] == "abort":
+		return e.client.AbortTransition(ctx)
+	case len(args) == 1 && args[0] == "history":
+		records, err := e.client.ConfigurationHistory(ctx)
+		if err != nil {
+			return err
+		}
+		return e.print(records, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "INDEX\tTERM\tINITIATOR\tCURRENT\tNEXT\tSTAGING")
+			for _, r := range records {
+				term := "-"
+				if r.Term != 0 {
+					term = fmt.Sprint(r.Term)
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", r.LogIndex, term, orDash(r.Initiator),
+					peerIDs(r.Current), peerIDs(r.Next), peerIDs(r.Staging))
+			}
+		})
+	}
+	return errUsage
+}
+
+// formatMetadata formats the metadata as comma-separated KEY=VALUE pairs
+// sorted by the keys, or returns "-" if there are none.
+func formatMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return orDash(strings.Join(pairs, ","))
+}
+
+// peerIDs joins the IDs of the peers with commas, or returns "-" if there are
+// no peers.
+func peerIDs(peers []*pb.Peer) string {
+	ids := make([]string, 0, len(peers))
+	for _, p := range peers {
+		ids = append(ids, p.Id)
+	}
+	return orDash(strings.Join(ids, ","))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// printConfiguration lists the peers of the configuration. The peers in a
+// joint configuration are marked with the configs they are in, and the
+// staging peers are marked as staging.
+func printConfiguration(w *tabwriter.Writer, name string, c raftclient.Configuration) {
+	if c.Joint {
+		fmt.Fprintf(w, "# %s configuration at log %d (joint)\n", name, c.LogIndex)
+	} else {
+		fmt.Fprintf(w, "# %s configuration at log %d\n", name, c.LogIndex)
+	}
+	fmt.Fprintln(w, "ID\tENDPOINT\tCONFIG\tMETADATA")
+	type member struct {
+		peer    *pb.Peer
+		configs string
+	}
+	var members []*member
+	byID := map[string]*member{}
+	add := func(peers []*pb.Peer, config string) {
+		for _, peer := range peers {
+			m, ok := byID[peer.Id]
+			if !ok {
+				m = &member{peer: peer}
+				byID[peer.Id] = m
+				members = append(members, m)
+			}
+			if m.configs != "" {
+				m.configs += ","
+			}
+			m.configs += config
+			if peer.Suffrage == pb.Suffrage_SUFFRAGE_NON_VOTER {
+				m.configs += "(non-voter)"
+			}
+		}
+	}
+	add(c.Current, "current")
+	if c.Joint {
+		add(c.Next, "next")
+	}
+	add(c.Staging, "staging")
+	for _, m := range members {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.peer.Id, m.peer.Endpoint, m.configs, formatMetadata(m.peer.Metadata))
+	}
+	w.Flush()
+}
+
+func runTransferLeadership(ctx context.Context, e *env, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	var id string
+	if len(args) == 1 {
+		id = args[0]
+	}
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+	return e.client.TransferLeadership(ctx, id)
+}
+
+// endpointSnapshot is the snapshot taken on the server at an endpoint, or the
+// error taking it.
+type endpointSnapshot struct {
+	Endpoint string                   `json:"endpoint"`
+	Snapshot *raftclient.SnapshotInfo `json:"snapshot,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+func runSnapshot(ctx context.Context, e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+	var snapshots []endpointSnapshot
+	failed := false
+	for _, endpoint := range e.client.Endpoints() {
+		snapshot := endpointSnapshot{Endpoint: endpoint}
+		if info, err := e.client.Snapshot(ctx, endpoint); err != nil {
+			snapshot.Error = err.Error()
+			failed = true
+		} else {
+			snapshot.Snapshot = info
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	if err := e.print(snapshots, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ENDPOINT\tSNAPSHOT\tINDEX\tTERM")
+		for _, s := range snapshots {
+			if s.Snapshot == nil {
+				fmt.Fprintf(w, "%s\t-\t-\t-\t(%s)\n", s.Endpoint, s.Error)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", s.Endpoint, s.Snapshot.Id, s.Snapshot.Index, s.Snapshot.Term)
+		}
+	}); err != nil {
+		return err
+	}
+	if failed {
+		return errors.New("failed to take snapshots on some servers")
+	}
+	return nil
+}
+
+// endpointStorage is the disk usage of the store of the server at an
+// endpoint, or the error querying or compacting it.
+type endpointStorage struct {
+	Endpoint string             `json:"endpoint"`
+	Stats    *raft.StorageStats `json:"stats,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+func runStorage(ctx context.Context, e *env, args []string) error {
+	fn := e.client.StorageStats
+	switch {
+	case len(args) == 1 && args[0] == "compact":
+		fn = e.client.CompactStorage
+	case len(args) != 0:
+		return errUsage
+	}
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+	var storages []endpointStorage
+	failed := false
+	for _, endpoint := range e.client.Endpoints() {
+		storage := endpointStorage{Endpoint: endpoint}
+		if stats, err := fn(ctx, endpoint); err != nil {
+			storage.Error = err.Error()
+			failed = true
+		} else {
+			storage.Stats = stats
+		}
+		storages = append(storages, storage)
+	}
+	if err := e.print(storages, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ENDPOINT\tSIZE\tLIVE\tFRAGMENTATION")
+		for _, s := range storages {
+			if s.Stats == nil {
+				fmt.Fprintf(w, "%s\t-\t-\t-\t(%s)\n", s.Endpoint, s.Error)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\n", s.Endpoint, s.Stats.SizeBytes, s.Stats.LiveBytes, s.Stats.Fragmentation*100)
+		}
+	}); err != nil {
+		return err
+	}
+	if failed {
+		if len(args) == 1 {
+			return errors.New("failed to compact the stores on some servers")
+		}
+		return errors.New("failed to query the stores on some servers")
+	}
+	return nil
+}
+
+// endpointEvent is an event published by the server at an endpoint.
+type endpointEvent struct {
+	Endpoint string `json:"endpoint"`
+	*raft.Event
+}
+
+func runEvents(ctx context.Context, e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	var mu sync.Mutex // serializes the output
+	endpoints := e.client.Endpoints()
+	errCh := make(chan error, len(endpoints))
+	for _, endpoint := range endpoints {
+		go func(endpoint string) {
+			errCh <- e.client.Events(ctx, endpoint, func(event *raft.Event) error {
+				mu.Lock()
+				defer mu.Unlock()
+				return e.print(endpointEvent{Endpoint: endpoint, Event: event}, func(w *tabwriter.Writer) {
+					fmt.Fprintf(w, "%s  %s  term=%d  %s  %s\n", event.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+						endpoint, event.Term, event.Type, eventData(event.Data))
+				})
+			})
+		}(endpoint)
+	}
+	var err error
+	for range endpoints {
+		if endpointErr := <-errCh; endpointErr != nil && !errors.Is(endpointErr, context.Canceled) && err == nil {
+			err = endpointErr
+		}
+	}
+	return err
+}
+
+// eventData formats the data of the event in a line.
+func eventData(data interface{}) string {
+	if s, ok := data.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprint(data)
+	}
+	return string(b)
+}
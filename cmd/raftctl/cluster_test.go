@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/raftclient"
+)
+
+func TestStorage(t *testing.T) {
+	compacted := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/storage", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(raft.StorageStats{SizeBytes: 400, LiveBytes: 100, Fragmentation: 0.75})
+	})
+	mux.HandleFunc("/api/v1/storage/compact", func(rw http.ResponseWriter, r *http.Request) {
+		compacted = true
+		json.NewEncoder(rw).Encode(raft.StorageStats{SizeBytes: 100, LiveBytes: 100})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+	client, err := raftclient.New([]string{endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runStorage(context.Background(), &env{client: client, out: &out, timeout: time.Second}, args)
+		return out.String(), err
+	}
+
+	out, err := run()
+	assert.NoError(t, err)
+	assert.Regexp(t, endpoint+`\s+400\s+100\s+75\.0%`, out)
+	assert.False(t, compacted)
+
+	out, err = run("compact")
+	assert.NoError(t, err)
+	assert.Regexp(t, endpoint+`\s+100\s+100\s+0\.0%`, out)
+	assert.True(t, compacted)
+
+	_, err = run("defrag")
+	assert.ErrorIs(t, err, errUsage)
+}
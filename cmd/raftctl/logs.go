@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+	"go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+var logsCommand = &command{
+	name:    "logs",
+	usage:   "logs [-from INDEX] [-to INDEX] [-check [-tail N]] <PATH>",
+	help:    "Dump or check the logs in the bbolt file or the WAL directory of a stopped server.",
+	offline: true,
+	run:     runLogs,
+}
+
+// boltOpenTimeout is how long to wait for the lock of a bbolt file, which is
+// held by the server using it.
+const boltOpenTimeout = time.Second
+
+// openLogStore opens the LogStore at path read-only. A directory is opened as
+// a WALLogStore, and a file as the bbolt database of a BoltStore.
+func openLogStore(path string) (raft.LogStore, io.Closer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		store, err := raft.NewWALLogStore(path, raft.WALReadOnlyOption())
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, store, nil
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: boltOpenTimeout})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return nil, nil, fmt.Errorf("%s is locked, possibly by a running server", path)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return raft.NewBoltLogStore(db), db, nil
+}
+
+// logsFlushInterval is the number of lines after which the table of the logs
+// is flushed.
+const logsFlushInterval = 256
+
+// logEntry is a log decoded for display.
+type logEntry struct {
+	Index         uint64             `json:"index"`
+	Term          uint64             `json:"term"`
+	Type          string             `json:"type"`
+	Checksum      string             `json:"checksum"`
+	Size          int                `json:"size"`
+	Configuration *pb.Configuration  `json:"configuration,omitempty"`
+	Session       *pb.SessionRequest `json:"session,omitempty"`
+	Error         string             `json:"error,omitempty"`
+	// Warning reports the discontinuity between the log and the previous one.
+	Warning string `json:"warning,omitempty"`
+}
+
+func newLogEntry(log *pb.Log) *logEntry {
+	e := &logEntry{
+		Index:   log.Meta.Index,
+		Term:    log.Meta.Term,
+		Type:    log.Body.Type.String(),
+		Size:    len(log.Body.Data),
+		Session: log.Body.Session,
+	}
+	switch {
+	case log.Checksum == 0:
+		e.Checksum = "none"
+	case log.Checksum == log.ComputeChecksum():
+		e.Checksum = "ok"
+	default:
+		e.Checksum = "mismatch"
+	}
+	if log.Body.Type == pb.LogType_CONFIGURATION {
+		var c pb.Configuration
+		if err := proto.Unmarshal(log.Body.Data, &c); err != nil {
+			e.Error = fmt.Sprintf("undecodable configuration: %v", err)
+		} else {
+			e.Configuration = &c
+		}
+	}
+	return e
+}
+
+// detail summarizes the content of the log in a line.
+func (e *logEntry) detail() string {
+	var parts []string
+	if e.Warning != "" {
+		parts = append(parts, "("+e.Warning+")")
+	}
+	if e.Error != "" {
+		parts = append(parts, "("+e.Error+")")
+	}
+	if c := e.Configuration; c != nil {
+		parts = append(parts, "current="+formatPeers(c.Current))
+		if c.Next != nil {
+			parts = append(parts, "next="+formatPeers(c.Next))
+		}
+		if len(c.Staging) > 0 {
+			parts = append(parts, "staging="+formatPeers(&pb.Config{Peers: c.Staging}))
+		}
+	} else if e.Size > 0 {
+		parts = append(parts, fmt.Sprintf("%d bytes", e.Size))
+	}
+	if e.Session != nil {
+		parts = append(parts, fmt.Sprintf("session=%d sequence=%d", e.Session.SessionId, e.Session.Sequence))
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatPeers(c *pb.Config) string {
+	if c == nil {
+		return "[]"
+	}
+	peers := make([]string, 0, len(c.Peers))
+	for _, peer := range c.Peers {
+		if peer.Suffrage == pb.Suffrage_SUFFRAGE_NON_VOTER {
+			peers = append(peers, peer.Id+"@"+peer.Endpoint+"(non-voter)")
+			continue
+		}
+		peers = append(peers, peer.Id+"@"+peer.Endpoint)
+	}
+	return "[" + strings.Join(peers, ",") + "]"
+}
+
+func runLogs(ctx context.Context, e *env, args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	from := flags.Uint64("from", 0, "")
+	to := flags.Uint64("to", 0, "")
+	check := flags.Bool("check", false, "")
+	tail := flags.Uint64("tail", raft.LogCheckAllLogs, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	store, closer, err := openLogStore(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	if *check {
+		return checkLogs(e, store, *tail)
+	}
+	return dumpLogs(ctx, e, store, *from, *to)
+}
+
+// checkLogs verifies the continuity, checksums, and terms of the last tail
+// logs, or all logs if tail is zero.
+func checkLogs(e *env, store raft.LogStore, tail uint64) error {
+	firstIndex, err := store.FirstIndex()
+	if err != nil {
+		return err
+	}
+	lastIndex, err := store.LastIndex()
+	if err != nil {
+		return err
+	}
+	if tail != raft.LogCheckAllLogs && lastIndex-firstIndex >= tail {
+		// Only the last tail logs are checked.
+		firstIndex = lastIndex - tail + 1
+	}
+	checkErr, err := raft.CheckLogsTail(store, tail)
+	if err != nil {
+		return err
+	}
+	result := struct {
+		FirstIndex uint64              `json:"first_index"`
+		LastIndex  uint64              `json:"last_index"`
+		Error      *raft.LogCheckError `json:"error,omitempty"`
+	}{firstIndex, lastIndex, checkErr}
+	if err := e.print(result, func(w *tabwriter.Writer) {
+		if checkErr == nil {
+			fmt.Fprintf(w, "logs %d to %d are consistent\n", firstIndex, lastIndex)
+		}
+	}); err != nil {
+		return err
+	}
+	if checkErr != nil {
+		return checkErr
+	}
+	return nil
+}
+
+// dumpLogs prints the logs in the range of from to to, both inclusive. A zero
+// to means the last log. The discontinuities between the logs are reported
+// along with the logs.
+func dumpLogs(ctx context.Context, e *env, store raft.LogStore, from, to uint64) error {
+	firstIndex, err := store.FirstIndex()
+	if err != nil {
+		return err
+	}
+	if from < firstIndex {
+		from = firstIndex
+	}
+	it := raft.NewLogIterator(store)
+	defer it.Close()
+	it.Seek(from)
+
+	w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	if !e.json {
+		fmt.Fprintln(w, "INDEX\tTERM\tTYPE\tCHECKSUM\tDETAIL")
+	}
+	var prev *pb.Log
+	var lines int
+	for ctx.Err() == nil {
+		log, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if log == nil || (to != 0 && log.Meta.Index > to) {
+			break
+		}
+		entry := newLogEntry(log)
+		if prev != nil {
+			if log.Meta.Index != prev.Meta.Index+1 {
+				entry.Warning = fmt.Sprintf("missing logs %d to %d", prev.Meta.Index+1, log.Meta.Index-1)
+			} else if log.Meta.Term < prev.Meta.Term {
+				entry.Warning = fmt.Sprintf("term decreased from %d", prev.Meta.Term)
+			}
+		}
+		prev = log
+		if e.json {
+			if err := e.print(entry, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", entry.Index, entry.Term, entry.Type, entry.Checksum, entry.detail())
+		// Flush periodically instead of buffering all logs for the alignment.
+		if lines++; lines%logsFlushInterval == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func testLogs(t *testing.T) []*pb.Log {
+	configuration, err := proto.Marshal(&pb.Configuration{
+		Current: &pb.Config{Peers: []*pb.Peer{{Id: "1", Endpoint: "e1"}}},
+		Next:    &pb.Config{Peers: []*pb.Peer{{Id: "1", Endpoint: "e1"}, {Id: "2", Endpoint: "e2"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := []*pb.Log{
+		{Meta: &pb.LogMeta{Index: 1, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_CONFIGURATION, Data: configuration}},
+		{Meta: &pb.LogMeta{Index: 2, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_NOOP}},
+		{Meta: &pb.LogMeta{Index: 3, Term: 2}, Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("command")}},
+		// The logs 4 and 5 are missing.
+		{Meta: &pb.LogMeta{Index: 6, Term: 2}, Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("command")}},
+	}
+	for _, log := range logs {
+		log.Checksum = log.ComputeChecksum()
+	}
+	// Corrupt the log 3.
+	logs[2].Body.Data = []byte("corrupted")
+	return logs
+}
+
+func TestLogs(t *testing.T) {
+	boltPath := filepath.Join(t.TempDir(), "store.db")
+	boltStore, err := raft.NewBoltStore(boltPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, boltStore.AppendLogs(testLogs(t)))
+	assert.NoError(t, boltStore.Close())
+
+	walPath := t.TempDir()
+	walStore, err := raft.NewWALLogStore(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, walStore.AppendLogs(testLogs(t)))
+	assert.NoError(t, walStore.Close())
+
+	run := func(json bool, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runLogs(context.Background(), &env{out: &out, json: json}, args)
+		return out.String(), err
+	}
+
+	for name, path := range map[string]string{"Bolt": boltPath, "WAL": walPath} {
+		t.Run(name, func(t *testing.T) {
+			out, err := run(false, path)
+			assert.NoError(t, err)
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			if assert.Len(t, lines, 5) {
+				assert.Regexp(t, `^1\s+1\s+CONFIGURATION\s+ok\s+current=\[1@e1\] next=\[1@e1,2@e2\]$`, lines[1])
+				assert.Regexp(t, `^2\s+1\s+NOOP\s+ok\s*$`, lines[2])
+				assert.Regexp(t, `^3\s+2\s+COMMAND\s+mismatch\s+9 bytes$`, lines[3])
+				assert.Regexp(t, `^6\s+2\s+COMMAND\s+ok\s+\(missing logs 4 to 5\) 7 bytes$`, lines[4])
+			}
+
+			out, err = run(true, "-from", "2", "-to", "3", path)
+			assert.NoError(t, err)
+			decoder := json.NewDecoder(strings.NewReader(out))
+			var indexes []uint64
+			for decoder.More() {
+				var entry logEntry
+				assert.NoError(t, decoder.Decode(&entry))
+				indexes = append(indexes, entry.Index)
+			}
+			assert.Equal(t, []uint64{2, 3}, indexes)
+
+			_, err = run(false, "-check", path)
+			var checkErr *raft.LogCheckError
+			if assert.True(t, errors.As(err, &checkErr)) {
+				assert.Equal(t, uint64(3), checkErr.Index)
+			}
+			// The mismatch is before the last log.
+			out, err = run(false, "-check", "-tail", "1", path)
+			assert.NoError(t, err)
+			assert.Equal(t, "logs 6 to 6 are consistent\n", out)
+		})
+	}
+
+	_, err = run(false)
+	assert.ErrorIs(t, err, errUsage)
+	_, err = run(false, "-bogus", boltPath)
+	assert.ErrorIs(t, err, errUsage)
+}
@@ -0,0 +1,192 @@
+// Command raftctl administers a raft cluster through the API servers of its
+// servers.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sumimakito/raft/raftclient"
+)
+
+// command is a subcommand of raftctl. Commands with subcommands of their own
+// dispatch them in run.
+type command struct {
+	name  string
+	usage string
+	help  string
+	// offline commands work on the files of a server and do not talk to the
+	// API servers.
+	offline bool
+	run     func(ctx context.Context, env *env, args []string) error
+}
+
+// env is what the commands run with.
+type env struct {
+	client  *raftclient.Client
+	out     io.Writer
+	json    bool
+	timeout time.Duration
+}
+
+// print writes v in JSON if -json is set, or calls table otherwise.
+func (e *env) print(v interface{}, table func(w *tabwriter.Writer)) error {
+	if e.json {
+		encoder := json.NewEncoder(e.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+// withTimeout returns ctx with the timeout of the requests.
+func (e *env) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, e.timeout)
+}
+
+var commands = []*command{
+	statusCommand,
+	membersCommand,
+	transferLeadershipCommand,
+	snapshotCommand,
+	storageCommand,
+	eventsCommand,
+	logsCommand,
+	snapshotsCommand,
+}
+
+// errUsage is returned by the commands run with invalid arguments.
+var errUsage = errors.New("invalid arguments")
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [OPTIONS] <COMMAND> [ARGS]\n\nCommands:\n", os.Args[0])
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", c.usage, c.help)
+	}
+	w.Flush()
+	fmt.Fprintln(out, "\nOptions:")
+	flag.PrintDefaults()
+}
+
+// tlsConfig loads the TLS config from the files, or returns nil if none is
+// given.
+func tlsConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func main() {
+	flag.Usage = usage
+	endpoints := flag.String("endpoints", os.Getenv("RAFTCTL_ENDPOINTS"),
+		"Comma-separated addresses of the API servers. Defaults to $RAFTCTL_ENDPOINTS.")
+	token := flag.String("token", os.Getenv("RAFTCTL_TOKEN"),
+		"Bearer token to authenticate with. Defaults to $RAFTCTL_TOKEN.")
+	caFile := flag.String("ca", "", "Path to the CA certificate to verify the API servers with.")
+	certFile := flag.String("cert", "", "Path to the client certificate for mTLS.")
+	keyFile := flag.String("key", "", "Path to the key of the client certificate.")
+	timeout := flag.Duration("timeout", 10*time.Second, "Timeout of the requests.")
+	jsonOutput := flag.Bool("json", false, "Print the results in JSON.")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	c := findCommand(flag.Arg(0))
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	e := &env{out: os.Stdout, json: *jsonOutput, timeout: *timeout}
+	if !c.offline {
+		var opts []raftclient.Option
+		if *token != "" {
+			opts = append(opts, raftclient.BearerTokenOption(*token))
+		}
+		config, err := tlsConfig(*caFile, *certFile, *keyFile)
+		if err != nil {
+			fatal(err)
+		}
+		if config != nil {
+			opts = append(opts, raftclient.TLSConfigOption(config))
+		}
+		var list []string
+		for _, endpoint := range strings.Split(*endpoints, ",") {
+			if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+				list = append(list, endpoint)
+			}
+		}
+		client, err := raftclient.New(list, opts...)
+		if errors.Is(err, raftclient.ErrNoEndpoints) {
+			fatal(errors.New("no endpoints given with -endpoints or $RAFTCTL_ENDPOINTS"))
+		} else if err != nil {
+			fatal(err)
+		}
+		defer client.Close()
+		e.client = client
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := c.run(ctx, e, flag.Args()[1:]); err != nil {
+		stop()
+		if errors.Is(err, errUsage) {
+			fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] %s\n", os.Args[0], c.usage)
+			os.Exit(2)
+		}
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(1)
+}
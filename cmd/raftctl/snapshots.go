@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sumimakito/raft"
+)
+
+var snapshotsCommand = &command{
+	name:    "snapshots",
+	usage:   "snapshots <list|verify|extract> <LOCATION> [ARGS]",
+	help:    "List, verify [ID...], or extract [-raw] <ID> <FILE> the snapshots in a directory or at s3://BUCKET/PREFIX.",
+	offline: true,
+	run:     runSnapshots,
+}
+
+// openSnapshotStore opens the ObjectSnapshotStore at the location, which is
+// either a directory or an S3 URL like
+// s3://BUCKET/PREFIX?endpoint=URL&region=REGION&path_style=true, where the
+// query is optional. The credentials of S3 are taken from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment
+// variables.
+func openSnapshotStore(location string) (*raft.ObjectSnapshotStore, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		if _, err := os.Stat(location); err != nil {
+			return nil, err
+		}
+		return raft.NewObjectSnapshotStore(raft.NewFileObjectStore(location), ""), nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	region := query.Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	var pathStyle bool
+	if v := query.Get("path_style"); v != "" {
+		if pathStyle, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid path_style: %s", v)
+		}
+	}
+	objects, err := raft.NewS3ObjectStore(raft.S3Config{
+		Endpoint:        endpoint,
+		Region:          region,
+		Bucket:          u.Host,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		PathStyle:       pathStyle,
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return raft.NewObjectSnapshotStore(objects, prefix), nil
+}
+
+// snapshotInfo is the metadata of a snapshot for display.
+type snapshotInfo struct {
+	Id                 string     `json:"id"`
+	Index              uint64     `json:"index"`
+	Term               uint64     `json:"term"`
+	ConfigurationIndex uint64     `json:"configuration_index"`
+	Current            string     `json:"current"`
+	Next               string     `json:"next,omitempty"`
+	Size               *uint64    `json:"size,omitempty"`
+	CRC64              string     `json:"crc64,omitempty"`
+	CreatedAt          *time.Time `json:"created_at,omitempty"`
+}
+
+func newSnapshotInfo(meta raft.SnapshotMeta) *snapshotInfo {
+	info := &snapshotInfo{
+		Id:                 meta.Id(),
+		Index:              meta.Index(),
+		Term:               meta.Term(),
+		ConfigurationIndex: meta.ConfigurationIndex(),
+	}
+	if c := meta.Configuration(); c != nil {
+		info.Current = formatPeers(c.Current)
+		if c.Next != nil {
+			info.Next = formatPeers(c.Next)
+		}
+	}
+	if checksumMeta, ok := meta.(raft.SnapshotChecksumMeta); ok {
+		size := checksumMeta.Size()
+		info.Size = &size
+		info.CRC64 = fmt.Sprintf("%016x", checksumMeta.CRC64())
+	}
+	if timeMeta, ok := meta.(raft.SnapshotTimeMeta); ok {
+		createdAt := timeMeta.CreatedAt()
+		info.CreatedAt = &createdAt
+	}
+	return info
+}
+
+func runSnapshots(ctx context.Context, e *env, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "list":
+		return runSnapshotsList(e, args[1:])
+	case "verify":
+		return runSnapshotsVerify(ctx, e, args[1:])
+	case "extract":
+		return runSnapshotsExtract(e, args[1:])
+	}
+	return errUsage
+}
+
+func runSnapshotsList(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	store, err := openSnapshotStore(args[0])
+	if err != nil {
+		return err
+	}
+	metaList, err := store.List()
+	if err != nil {
+		return err
+	}
+	infos := make([]*snapshotInfo, 0, len(metaList))
+	for _, meta := range metaList {
+		infos = append(infos, newSnapshotInfo(meta))
+	}
+	return e.print(infos, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tINDEX\tTERM\tSIZE\tCRC64\tCREATED\tCONFIGURATION")
+		for _, info := range infos {
+			size, createdAt := "-", "-"
+			if info.Size != nil {
+				size = strconv.FormatUint(*info.Size, 10)
+			}
+			if info.CreatedAt != nil {
+				createdAt = info.CreatedAt.Format(time.RFC3339)
+			}
+			configuration := fmt.Sprintf("%d current=%s", info.ConfigurationIndex, info.Current)
+			if info.Next != "" {
+				configuration += " next=" + info.Next
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n",
+				info.Id, info.Index, info.Term, size, info.CRC64, createdAt, configuration)
+		}
+	})
+}
+
+// snapshotVerification is the result of verifying a snapshot.
+type snapshotVerification struct {
+	Id    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+func runSnapshotsVerify(ctx context.Context, e *env, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	store, err := openSnapshotStore(args[0])
+	if err != nil {
+		return err
+	}
+	ids := args[1:]
+	if len(ids) == 0 {
+		metaList, err := store.List()
+		if err != nil {
+			return err
+		}
+		for _, meta := range metaList {
+			ids = append(ids, meta.Id())
+		}
+	}
+	var results []snapshotVerification
+	failed := false
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		result := snapshotVerification{Id: id}
+		if _, err := raft.CheckSnapshot(store, id); err != nil {
+			result.Error = err.Error()
+			failed = true
+		}
+		results = append(results, result)
+	}
+	if err := e.print(results, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tSTATUS")
+		for _, result := range results {
+			if result.Error != "" {
+				fmt.Fprintf(w, "%s\tFAILED (%s)\n", result.Id, result.Error)
+			} else {
+				fmt.Fprintf(w, "%s\tOK\n", result.Id)
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	if failed {
+		return errors.New("some snapshots failed the verification")
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written.
+type countingWriter struct {
+	n uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += uint64(len(p))
+	return len(p), nil
+}
+
+// snapshotExtraction is the result of extracting a snapshot.
+type snapshotExtraction struct {
+	Id       string `json:"id"`
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	Sessions int    `json:"sessions"`
+}
+
+func runSnapshotsExtract(e *env, args []string) error {
+	flags := flag.NewFlagSet("snapshots extract", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	raw := flags.Bool("raw", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 3 {
+		return errUsage
+	}
+	location, id, path := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+	store, err := openSnapshotStore(location)
+	if err != nil {
+		return err
+	}
+	snapshot, err := store.Open(id)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	meta, err := snapshot.Meta()
+	if err != nil {
+		return err
+	}
+	reader, err := snapshot.Reader()
+	if err != nil {
+		return err
+	}
+
+	// The data is verified while being extracted.
+	h := crc64.New(crc64.MakeTable(crc64.ECMA))
+	counter := &countingWriter{}
+	reader = io.TeeReader(reader, io.MultiWriter(h, counter))
+	result := snapshotExtraction{Id: id, File: path}
+	if !*raw {
+		sessions, payload, err := raft.ReadSnapshotSessions(reader)
+		if err != nil {
+			return err
+		}
+		result.Sessions = len(sessions.Sessions)
+		reader = payload
+	}
+
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	if result.Size, err = io.Copy(out, reader); err == nil {
+		err = verifyExtraction(meta, counter.n, h.Sum64())
+	}
+	if err != nil {
+		if path != "-" {
+			os.Remove(path)
+		}
+		return err
+	}
+	if path == "-" {
+		return nil
+	}
+	if err := out.(*os.File).Close(); err != nil {
+		return err
+	}
+	return e.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "extracted %d bytes to %s", result.Size, path)
+		if result.Sessions > 0 {
+			fmt.Fprintf(w, ", skipping %d client sessions", result.Sessions)
+		}
+		fmt.Fprintln(w)
+	})
+}
+
+// verifyExtraction checks the size and the checksum of the data read against
+// the metadata, if the metadata carries them.
+func verifyExtraction(meta raft.SnapshotMeta, size, checksum uint64) error {
+	checksumMeta, ok := meta.(raft.SnapshotChecksumMeta)
+	if !ok {
+		return nil
+	}
+	if size != checksumMeta.Size() {
+		return fmt.Errorf("%w: expected %d bytes but got %d", raft.ErrCorruptedSnapshot, checksumMeta.Size(), size)
+	}
+	if checksum != checksumMeta.CRC64() {
+		return fmt.Errorf("%w: checksum mismatch: expected %016x but got %016x",
+			raft.ErrCorruptedSnapshot, checksumMeta.CRC64(), checksum)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	store := raft.NewObjectSnapshotStore(raft.NewFileObjectStore(dir), "")
+	c := &pb.Configuration{Current: &pb.Config{Peers: []*pb.Peer{{Id: "1", Endpoint: "e1"}}}}
+	create := func(index uint64, data []byte) string {
+		sink, err := store.Create(index, 1, c, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = sink.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, sink.Close())
+		return sink.Meta().Id()
+	}
+	// A snapshot with the client sessions in front of the data.
+	sessions, err := proto.Marshal(&pb.SessionTable{Sessions: []*pb.Session{{Id: 1}, {Id: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	data.WriteString("RAFTSESS")
+	binary.Write(&data, binary.BigEndian, uint64(len(sessions)))
+	data.Write(sessions)
+	data.WriteString("state")
+	id1 := create(1, data.Bytes())
+	id2 := create(2, []byte("corrupted"))
+	// Corrupt the data of the second snapshot.
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, id2, "snapshot"), []byte("corrupteD"), 0600))
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runSnapshots(context.Background(), &env{out: &out}, args)
+		return out.String(), err
+	}
+
+	out, err := run("list", dir)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Regexp(t, "^"+id2+`\s+2\s+1\s+9\s+[0-9a-f]{16}\s+\S+\s+1 current=\[1@e1\]$`, lines[1])
+		assert.Regexp(t, "^"+id1+`\s+1\s+1\s+`, lines[2])
+	}
+
+	out, err = run("verify", dir)
+	assert.EqualError(t, err, "some snapshots failed the verification")
+	assert.Regexp(t, id2+`\s+FAILED \(checksum mismatch`, out)
+	assert.Regexp(t, id1+`\s+OK`, out)
+	_, err = run("verify", dir, id1)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "state")
+	out, err = run("extract", dir, id1, path)
+	assert.NoError(t, err)
+	assert.Equal(t, "extracted 5 bytes to "+path+", skipping 2 client sessions\n", out)
+	extracted, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "state", string(extracted))
+
+	rawPath := filepath.Join(t.TempDir(), "raw")
+	_, err = run("extract", "-raw", dir, id1, rawPath)
+	assert.NoError(t, err)
+	extracted, err = os.ReadFile(rawPath)
+	assert.NoError(t, err)
+	assert.Equal(t, data.Bytes(), extracted)
+
+	// The data failing the verification is not left behind.
+	corruptedPath := filepath.Join(t.TempDir(), "corrupted")
+	_, err = run("extract", dir, id2, corruptedPath)
+	assert.ErrorIs(t, err, raft.ErrCorruptedSnapshot)
+	assert.NoFileExists(t, corruptedPath)
+
+	_, err = run("extract", dir, id1)
+	assert.ErrorIs(t, err, errUsage)
+	_, err = run("remove", dir)
+	assert.ErrorIs(t, err, errUsage)
+}
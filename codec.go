@@ -0,0 +1,122 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes and decodes the commands and their results, so that the
+// clients and the StateMachine agree on the encoding. The server encodes the
+// commands applied with ApplyTyped with the Codec set with CommandCodecOption.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// ProtoCodec encodes the values implementing proto.Message.
+	ProtoCodec Codec = protoCodec{}
+	// MsgpackCodec encodes the values with MessagePack.
+	MsgpackCodec Codec = msgpackCodec{}
+	// JSONCodec encodes the values with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+)
+
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errors.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) (out []byte, err error) {
+	err = codec.NewEncoderBytes(&out, &codec.MsgpackHandle{}).Encode(v)
+	return
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, &codec.MsgpackHandle{}).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// EncodeCommand encodes the command with the Codec.
+func EncodeCommand(c Codec, command interface{}) (Command, error) {
+	return c.Marshal(command)
+}
+
+// DecodeCommand decodes the command encoded with the Codec into T, which is
+// usually called by StateMachine.Apply. T may be a pointer to a proto.Message
+// for ProtoCodec, which is allocated here.
+func DecodeCommand[T any](c Codec, command Command) (T, error) {
+	var v T
+	if err := c.Unmarshal(command, newTarget(&v)); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+// newTarget returns the value to decode into for *v, which is *v itself if it
+// is a proto.Message, since the codecs expect a message rather than a pointer
+// to it.
+func newTarget[T any](v *T) interface{} {
+	if m, ok := interface{}(*v).(proto.Message); ok {
+		m = m.ProtoReflect().Type().New().Interface()
+		*v = m.(T)
+		return m
+	}
+	return v
+}
+
+// ApplyTyped encodes the command with the Codec of the server, applies it with
+// ApplyCommand, and decodes its result into T with the same Codec. The result
+// is returned as is if StateMachine.Apply returns a T, which is the case on
+// the leader, and the zero value is returned if the result is nil.
+func ApplyTyped[T any](ctx context.Context, s *Server, command interface{}) (T, error) {
+	var result T
+	c := s.opts().commandCodec
+	encoded, err := EncodeCommand(c, command)
+	if err != nil {
+		return result, errors.Wrapf(err, "error encoding the command")
+	}
+	response, err := s.ApplyCommand(ctx, encoded).Response()
+	if err != nil {
+		return result, err
+	}
+	switch r := response.(type) {
+	case nil:
+		return result, nil
+	case T:
+		return r, nil
+	}
+	data, err := encodeApplyResponse(response)
+	if err != nil {
+		return result, err
+	}
+	return DecodeCommand[T](c, data)
+}
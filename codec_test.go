@@ -0,0 +1,51 @@
+package raft
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+type testingCodecCommand struct {
+	Key   string
+	Value []byte
+}
+
+func TestCodec(t *testing.T) {
+	command := testingCodecCommand{Key: "key", Value: []byte("value")}
+	for _, c := range []Codec{MsgpackCodec, JSONCodec} {
+		encoded := ƒAssertNoError2(EncodeCommand(c, &command))(t)
+		assert.Equal(t, command, ƒAssertNoError2(DecodeCommand[testingCodecCommand](c, encoded))(t))
+		assert.Equal(t, &command, ƒAssertNoError2(DecodeCommand[*testingCodecCommand](c, encoded))(t))
+	}
+
+	peer := &pb.Peer{Id: "id", Endpoint: "endpoint"}
+	encoded := ƒAssertNoError2(EncodeCommand(ProtoCodec, peer))(t)
+	assert.True(t, proto.Equal(peer, ƒAssertNoError2(DecodeCommand[*pb.Peer](ProtoCodec, encoded))(t)))
+	_, err := EncodeCommand(ProtoCodec, &command)
+	assert.Error(t, err)
+}
+
+func TestApplyTyped(t *testing.T) {
+	server := testingServer(t, CommandCodecOption(JSONCodec))
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.snapshotService = newSnapshotService(server)
+	server.snapshotService.StartScheduler()
+	defer server.snapshotService.StopScheduler()
+	server.stateMachine = newStateMachineProxy(server, &testingEchoStateMachine{})
+	server.logOpsCh = make(chan logStoreOp, 8)
+	server.serverState.stateCurrentTerm = 1
+	server.setRole(Leader)
+	go func() {
+		server.handleLogOp(<-server.logOpsCh)
+		server.commitAndApply(server.lastLogIndex())
+	}()
+
+	// The echoed command is decoded as the result.
+	command := testingCodecCommand{Key: "key", Value: []byte("value")}
+	result := ƒAssertNoError2(ApplyTyped[testingCodecCommand](context.Background(), server, &command))(t)
+	assert.Equal(t, command, result)
+}
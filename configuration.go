@@ -1,6 +1,9 @@
 package raft
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"sync/atomic"
 
 	"github.com/sumimakito/raft/pb"
@@ -8,6 +11,81 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// ConfigurationError describes why a configuration is rejected by a
+// transition.
+type ConfigurationError struct {
+	Reason string
+}
+
+func (e *ConfigurationError) Error() string {
+	return "invalid configuration: " + e.Reason
+}
+
+func (e *ConfigurationError) Unwrap() error {
+	return ErrInvalidConfiguration
+}
+
+// validateConfiguration returns a *ConfigurationError if the configuration
+// has no voters, or the peers in it have duplicate or conflicting IDs and
+// endpoints, metadata with empty keys, or suffrages not matching where they
+// are, i.e., staging peers must be and only be in the staging peers.
+func validateConfiguration(c *pb.Configuration) error {
+	endpoints, ids := map[string]string{}, map[string]string{}
+	validatePeers := func(peers []*pb.Peer, name string) error {
+		seen := map[string]bool{}
+		for _, p := range peers {
+			if p.Id == "" || p.Endpoint == "" {
+				return &ConfigurationError{Reason: fmt.Sprintf("peer %s@%s in the %s peers has no ID or endpoint",
+					p.Id, p.Endpoint, name)}
+			}
+			if seen[p.Id] {
+				return &ConfigurationError{Reason: fmt.Sprintf("duplicate server ID %s in the %s peers", p.Id, name)}
+			}
+			if p.Suffrage == pb.Suffrage_SUFFRAGE_STAGING && name != "staging" {
+				return &ConfigurationError{Reason: fmt.Sprintf("staging server %s in the %s peers", p.Id, name)}
+			}
+			if p.Suffrage != pb.Suffrage_SUFFRAGE_STAGING && name == "staging" {
+				return &ConfigurationError{Reason: fmt.Sprintf("server %s in the staging peers is not staging", p.Id)}
+			}
+			if _, ok := p.Metadata[""]; ok {
+				return &ConfigurationError{Reason: fmt.Sprintf("server %s has metadata with an empty key", p.Id)}
+			}
+			seen[p.Id] = true
+			if endpoint, ok := endpoints[p.Id]; ok && endpoint != p.Endpoint {
+				return &ConfigurationError{Reason: fmt.Sprintf("server %s has endpoints %s and %s",
+					p.Id, endpoint, p.Endpoint)}
+			}
+			if id, ok := ids[p.Endpoint]; ok && id != p.Id {
+				return &ConfigurationError{Reason: fmt.Sprintf("duplicate endpoint %s of servers %s and %s",
+					p.Endpoint, id, p.Id)}
+			}
+			endpoints[p.Id], ids[p.Endpoint] = p.Endpoint, p.Id
+		}
+		return nil
+	}
+	if c.Current == nil || newConfig(c.Current).Voters() == 0 {
+		return &ConfigurationError{Reason: "no voters in the current config"}
+	}
+	if err := validatePeers(c.Current.Peers, "current"); err != nil {
+		return err
+	}
+	if c.Next != nil {
+		if newConfig(c.Next).Voters() == 0 {
+			return &ConfigurationError{Reason: "no voters in the next config"}
+		}
+		if err := validatePeers(c.Next.Peers, "next"); err != nil {
+			return err
+		}
+	}
+	// Only the current and the next peers are validated so far.
+	for _, p := range c.Staging {
+		if _, ok := endpoints[p.Id]; ok {
+			return &ConfigurationError{Reason: fmt.Sprintf("staging server %s is already a member", p.Id)}
+		}
+	}
+	return validatePeers(c.Staging, "staging")
+}
+
 type config struct {
 	peerMap SingleFlight[map[string]*pb.Peer]
 
@@ -22,11 +100,14 @@ func (c *config) Copy() *config {
 	return newConfig(c.Config.Copy())
 }
 
+// Contains reports whether the server is a voter in the config.
 func (c *config) Contains(serverId string) bool {
 	peerMap := c.peerMap.Do(func() map[string]*pb.Peer {
 		m := map[string]*pb.Peer{}
 		for _, p := range c.Peers {
-			m[p.Id] = p
+			if p.Voter() {
+				m[p.Id] = p
+			}
 		}
 		return m
 	})
@@ -34,8 +115,21 @@ func (c *config) Contains(serverId string) bool {
 	return ok
 }
 
+// Voters returns the number of the voters in the config.
+func (c *config) Voters() int {
+	voters := 0
+	for _, p := range c.Peers {
+		if p.Voter() {
+			voters++
+		}
+	}
+	return voters
+}
+
+// Quorum returns the number of the voters that make a majority of the voters
+// in the config.
 func (c *config) Quorum() int {
-	return len(c.Peers)/2 + 1
+	return c.Voters()/2 + 1
 }
 
 type configuration struct {
@@ -131,10 +225,45 @@ func (c *configuration) Peers() []*pb.Peer {
 	return c.peers()
 }
 
+// Voter reports whether the server is a voter in the current config or the
+// next config.
+func (c *configuration) Voter(serverId string) bool {
+	return c.CurrentConfig().Contains(serverId) || (c.Joint() && c.NextConfig().Contains(serverId))
+}
+
+// StagingPeer returns the staging peer with the ID, which receives the logs
+// but is not in the voting configuration.
+func (c *configuration) StagingPeer(serverId string) (*pb.Peer, bool) {
+	for _, p := range c.Staging {
+		if p.Id == serverId {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// maxConfigurationHistory is the number of the committed configurations kept
+// in the history.
+const maxConfigurationHistory = 256
+
+// ConfigurationRecord is a committed configuration in the history of the
+// configurations.
+type ConfigurationRecord struct {
+	// Index is the index of the configuration log.
+	Index uint64
+	// Term is the term of the configuration log, or zero if it's the bootstrap
+	// configuration, or restored from a snapshot, which does not record it.
+	Term uint64
+	*pb.Configuration
+}
+
 type configurationStore struct {
 	server    *Server
 	committed atomic.Value // *Configuration
 	latest    atomic.Value // *Configuration
+
+	historyMu sync.Mutex // protects history
+	history   []ConfigurationRecord
 }
 
 func newConfigurationStore(server *Server) (*configurationStore, error) {
@@ -165,26 +294,254 @@ func newConfigurationStore(server *Server) (*configurationStore, error) {
 // When the leader prepares to change the configuration, this should be the only
 // function to call.
 // ErrInJointConsensus is returned when the server is already in a joint consensus.
-func (s *configurationStore) initiateTransition(next *config) error {
+// A *ConfigurationError is returned when the configuration is invalid, or the
+// quorum of the next configuration cannot be reached.
+func (s *configurationStore) initiateTransition(next *config, initiator string) error {
+	c, err := s.update(func(latest *configuration) (*pb.Configuration, error) {
+		if latest.Joint() {
+			return nil, ErrInJointConsensus
+		}
+		if err := s.verifyQuorum(next.Config); err != nil {
+			return nil, err
+		}
+		c := latest.CopyInitiateTransition(next.Config)
+		c.Initiator = initiator
+		return c, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.server.logger.Infow("a configuration transition has been initiated",
+		logFields(s.server, "configuration", c)...)
+	return nil
+}
+
+// abortTransition reverts the uncommitted joint configuration to its current
+// configuration, which is safe as each quorum of the joint configuration
+// overlaps with those of the current configuration. It's used when the
+// servers of the next configuration never come up, with which the joint
+// configuration cannot be committed.
+// ErrNotInJointConsensus is returned when the server is not in a joint consensus,
+// and ErrTransitionCommitted is returned when the joint configuration has been
+// committed, and the transition is to complete.
+func (s *configurationStore) abortTransition(initiator string) error {
+	c, err := s.update(func(latest *configuration) (*pb.Configuration, error) {
+		if !latest.Joint() {
+			return nil, ErrNotInJointConsensus
+		}
+		if s.Committed().LogIndex() >= latest.LogIndex() {
+			return nil, ErrTransitionCommitted
+		}
+		c := latest.Configuration.Copy()
+		c.Next = nil
+		c.Initiator = initiator
+		return c, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.server.logger.Infow("a configuration transition has been aborted",
+		logFields(s.server, "configuration", c)...)
+	return nil
+}
+
+// stage appends the configuration log with the peer added to the staging
+// peers, to which the logs are replicated before it's promoted.
+func (s *configurationStore) stage(peer *pb.Peer, initiator string) error {
+	c, err := s.update(func(latest *configuration) (*pb.Configuration, error) {
+		if _, ok := latest.StagingPeer(peer.Id); ok {
+			return nil, nil
+		}
+		staging := peer.Copy()
+		staging.Suffrage = pb.Suffrage_SUFFRAGE_STAGING
+		c := latest.CopyStaging(append(append([]*pb.Peer{}, latest.Staging...), staging))
+		c.Initiator = initiator
+		return c, nil
+	})
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		s.server.logger.Infow("a peer has been staged", logFields(s.server, zap.Object("peer", peer))...)
+	}
+	return nil
+}
+
+// unstage appends the configuration log with the peer removed from the
+// staging peers if it's staged.
+func (s *configurationStore) unstage(serverId string, initiator string) error {
+	c, err := s.update(func(latest *configuration) (*pb.Configuration, error) {
+		if _, ok := latest.StagingPeer(serverId); !ok {
+			return nil, nil
+		}
+		c := latest.CopyStaging(withoutPeer(latest.Staging, serverId))
+		c.Initiator = initiator
+		return c, nil
+	})
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		s.server.logger.Infow("a peer has been unstaged", logFields(s.server, "peer_id", serverId)...)
+	}
+	return nil
+}
+
+// promote initiates the configuration transition that moves the staging peer
+// into the voting configuration.
+// ErrInJointConsensus is returned when the server is already in a joint consensus.
+// Should only be called by Server.promoteStaging().
+func (s *configurationStore) promote(peer *pb.Peer) error {
 	latest := s.latest.Load().(*configuration)
 	if latest.Joint() {
 		return ErrInJointConsensus
 	}
-	c := latest.CopyInitiateTransition(next.Config)
-	appendOp := &logStoreAppendOp{
-		FutureTask: newFutureTask[[]*pb.LogMeta]([]*pb.LogBody{
-			{Type: pb.LogType_CONFIGURATION, Data: Must2(proto.Marshal(c))},
-		}),
+	voter := peer.Copy()
+	voter.Suffrage = pb.Suffrage_SUFFRAGE_VOTER
+	next := latest.Current.Copy()
+	next.Peers = append(next.Peers, voter)
+	if err := s.verifyQuorum(next); err != nil {
+		return err
 	}
-	s.server.logOpsCh <- appendOp
-	if _, err := appendOp.Result(); err != nil {
+	c := latest.CopyInitiateTransition(next)
+	c.Staging = withoutPeer(c.Staging, peer.Id)
+	if err := s.appendConfiguration(c); err != nil {
 		return err
 	}
-	s.server.logger.Infow("a configuration transition has been initiated",
+	s.server.logger.Infow("a configuration transition has been initiated to promote a staging peer",
+		logFields(s.server, "configuration", c)...)
+	return nil
+}
+
+// updatePeer appends the configuration log with the endpoint and the metadata
+// of the peer with the same ID replaced in the voting and the staging
+// configurations. No transition is needed as the voters are not changed.
+// ErrUnknownPeer is returned when the peer is not in the configuration.
+func (s *configurationStore) updatePeer(peer *pb.Peer, initiator string) error {
+	c, err := s.update(func(latest *configuration) (*pb.Configuration, error) {
+		current, ok := latest.Peer(peer.Id)
+		if !ok {
+			if current, ok = latest.StagingPeer(peer.Id); !ok {
+				return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, peer.Id)
+			}
+		}
+		// The suffrage is kept, as changing it changes the quorums, which
+		// takes a transition.
+		peer = peer.Copy()
+		peer.Suffrage = current.Suffrage
+		if proto.Equal(current, peer) {
+			return nil, nil
+		}
+		c := latest.Configuration.Copy()
+		replace := func(peers []*pb.Peer) {
+			for i := range peers {
+				if peers[i].Id == peer.Id {
+					suffrage := peers[i].Suffrage
+					peers[i] = peer.Copy()
+					peers[i].Suffrage = suffrage
+				}
+			}
+		}
+		replace(c.Current.Peers)
+		if c.Next != nil {
+			replace(c.Next.Peers)
+		}
+		replace(c.Staging)
+		c.Initiator = initiator
+		return c, nil
+	})
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		s.server.logger.Infow("a peer has been updated", logFields(s.server, zap.Object("peer", peer))...)
+	}
+	return nil
+}
+
+// remove initiates the configuration transition that removes the voter.
+// ErrInJointConsensus is returned when the server is already in a joint consensus.
+// Should only be called in the main loop.
+func (s *configurationStore) remove(serverId string, initiator string) error {
+	latest := s.latest.Load().(*configuration)
+	if latest.Joint() {
+		return ErrInJointConsensus
+	}
+	next := latest.Current.Copy()
+	next.Peers = withoutPeer(next.Peers, serverId)
+	if err := s.verifyQuorum(next); err != nil {
+		return err
+	}
+	c := latest.CopyInitiateTransition(next)
+	c.Initiator = initiator
+	if err := s.appendConfiguration(c); err != nil {
+		return err
+	}
+	s.server.logger.Infow("a configuration transition has been initiated to remove a peer",
 		logFields(s.server, "configuration", c)...)
 	return nil
 }
 
+// verifyQuorum returns a *ConfigurationError if the voters of the config
+// that have acknowledged the leader recently, including the leader, cannot
+// make a quorum, as the transition would not be committed until the others
+// are back. Should only be called on the leader.
+func (s *configurationStore) verifyQuorum(next *pb.Config) error {
+	since := s.server.opts().clock.Now().Add(-s.server.opts().followerTimeout)
+	active := 0
+	for _, p := range next.Peers {
+		if !p.Voter() {
+			continue
+		}
+		if p.Id == s.server.id || !s.server.replScheduler.lastContact(p.Id).Before(since) {
+			active++
+		}
+	}
+	if c := newConfig(next); active < c.Quorum() {
+		return &ConfigurationError{Reason: fmt.Sprintf("only %d of the %d voters are active, fewer than the quorum of %d",
+			active, c.Voters(), c.Quorum())}
+	}
+	return nil
+}
+
+// update appends the configuration log built by fn from the latest
+// configuration through the main loop, and returns the configuration
+// appended, or nil if fn returns nil.
+func (s *configurationStore) update(fn func(latest *configuration) (*pb.Configuration, error)) (*pb.Configuration, error) {
+	op := &logStoreConfigurationOp{
+		FutureTask: newFutureTask[*pb.Configuration](fn),
+	}
+	if err := s.server.enqueueLogOp(context.Background(), op); err != nil {
+		return nil, err
+	}
+	return op.Result()
+}
+
+// appendUpdate appends the configuration log built by fn from the latest
+// configuration. Should only be called in the main loop.
+func (s *configurationStore) appendUpdate(fn func(latest *configuration) (*pb.Configuration, error)) (*pb.Configuration, error) {
+	c, err := fn(s.Latest())
+	if err != nil || c == nil {
+		return nil, err
+	}
+	if err := s.appendConfiguration(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// appendConfiguration validates and appends the configuration log. Should only
+// be called in the main loop.
+func (s *configurationStore) appendConfiguration(c *pb.Configuration) error {
+	if err := validateConfiguration(c); err != nil {
+		return err
+	}
+	_, err := s.server.appendLogs([]*pb.LogBody{
+		{Type: pb.LogType_CONFIGURATION, Data: Must2(proto.Marshal(c))},
+	}, nil, nil)
+	return err
+}
+
 // commitTransition creates a new configuration from the next configuration in the
 // configuration for joint consensus and appends the configuration log.
 // ErrNotInJointConsensus is returned when the server is not in a joint consensus.
@@ -197,12 +554,74 @@ func (s *configurationStore) commitTransition() error {
 	c := latest.CopyCommitTransition()
 	s.server.appendLogs([]*pb.LogBody{
 		{Type: pb.LogType_CONFIGURATION, Data: Must2(proto.Marshal(c))},
-	})
+	}, nil, nil)
 	s.server.logger.Infow("a configuration transition has been committed",
 		logFields(s.server, "configuration", c)...)
 	return nil
 }
 
+// Restore rebuilds the configurations from the configuration recorded in the
+// snapshot, so that the logs compacted by the snapshot need not be replayed.
+// The snapshot's configuration becomes the committed configuration, and the
+// latest configuration log following the snapshot, if any, supersedes it as
+// the latest configuration, which is returned.
+func (s *configurationStore) Restore(snapshotMeta SnapshotMeta) (*configuration, error) {
+	if snapshotMeta.Configuration() == nil {
+		// The snapshot carries no configuration.
+		return s.Latest(), nil
+	}
+	committed := newConfiguration(snapshotMeta.Configuration().Copy(), snapshotMeta.ConfigurationIndex())
+	s.SetCommitted(committed)
+	s.record(ConfigurationRecord{Index: committed.LogIndex(), Configuration: committed.Configuration})
+
+	log, err := s.server.logStore.LastEntry(pb.LogType_CONFIGURATION)
+	if err != nil {
+		return nil, err
+	}
+	if log == nil || log.Meta.Index <= snapshotMeta.Index() {
+		return committed, nil
+	}
+	var conf pb.Configuration
+	if err := proto.Unmarshal(log.Body.Data, &conf); err != nil {
+		return nil, err
+	}
+	return newConfiguration(&conf, log.Meta.Index), nil
+}
+
+// record appends the committed configuration to the history unless it's been
+// recorded, as the logs are applied again after restarts.
+func (s *configurationStore) record(r ConfigurationRecord) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	if n := len(s.history); n > 0 && s.history[n-1].Index >= r.Index {
+		return
+	}
+	s.history = append(s.history, r)
+	if len(s.history) > maxConfigurationHistory {
+		s.history = append([]ConfigurationRecord{}, s.history[len(s.history)-maxConfigurationHistory:]...)
+	}
+}
+
+// History returns the committed configurations in the order they were
+// committed. The configurations compacted by a snapshot before the server
+// starts are not included except the one recorded in the snapshot, and only
+// the last maxConfigurationHistory configurations are kept.
+func (s *configurationStore) History() []ConfigurationRecord {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	return append([]ConfigurationRecord{}, s.history...)
+}
+
+func withoutPeer(peers []*pb.Peer, serverId string) []*pb.Peer {
+	out := make([]*pb.Peer, 0, len(peers))
+	for _, p := range peers {
+		if p.Id != serverId {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
 func (s *configurationStore) Joint() bool {
 	return s.latest.Load().(*configuration).Joint()
 }
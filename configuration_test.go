@@ -2,9 +2,11 @@ package raft
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/sumimakito/raft/pb"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestConfiguration(t *testing.T) {
@@ -28,4 +30,181 @@ func TestConfiguration(t *testing.T) {
 	assert.True(t, ok)
 	_, ok = jointConf.Peer(peer3.Id)
 	assert.True(t, ok)
+
+	copied := jointConf.Copy(2)
+	assert.True(t, copied.Joint())
+	assert.True(t, proto.Equal(jointConf.Configuration, copied.Configuration))
+}
+
+func TestValidateConfiguration(t *testing.T) {
+	peer1 := &pb.Peer{Id: "node1", Endpoint: "endpoint1"}
+	peer2 := &pb.Peer{Id: "node2", Endpoint: "endpoint2"}
+	peer3 := &pb.Peer{Id: "node3", Endpoint: "endpoint3"}
+	configFn := func(peers ...*pb.Peer) *pb.Config { return &pb.Config{Peers: peers} }
+
+	for _, c := range []struct {
+		name  string
+		conf  *pb.Configuration
+		valid bool
+	}{
+		{"valid", &pb.Configuration{Current: configFn(peer1, peer2), Next: configFn(peer2, peer3), Staging: []*pb.Peer{
+			{Id: "node4", Endpoint: "endpoint4", Suffrage: pb.Suffrage_SUFFRAGE_STAGING},
+		}}, true},
+		{"no current peers", &pb.Configuration{Current: configFn()}, false},
+		{"no next peers", &pb.Configuration{Current: configFn(peer1), Next: configFn()}, false},
+		{"non-voter", &pb.Configuration{Current: configFn(peer1, &pb.Peer{Id: "node2", Endpoint: "endpoint2",
+			Suffrage: pb.Suffrage_SUFFRAGE_NON_VOTER})}, true},
+		{"no current voters", &pb.Configuration{Current: configFn(&pb.Peer{Id: "node1", Endpoint: "endpoint1",
+			Suffrage: pb.Suffrage_SUFFRAGE_NON_VOTER})}, false},
+		{"staging suffrage in current", &pb.Configuration{Current: configFn(peer1, &pb.Peer{Id: "node2", Endpoint: "endpoint2",
+			Suffrage: pb.Suffrage_SUFFRAGE_STAGING})}, false},
+		{"voter suffrage in staging", &pb.Configuration{Current: configFn(peer1), Staging: []*pb.Peer{peer2}}, false},
+		{"duplicate ID", &pb.Configuration{Current: configFn(peer1, peer1)}, false},
+		{"duplicate endpoint", &pb.Configuration{Current: configFn(peer1, &pb.Peer{Id: "node2", Endpoint: "endpoint1"})}, false},
+		{"conflicting endpoints", &pb.Configuration{Current: configFn(peer1), Next: configFn(
+			&pb.Peer{Id: "node1", Endpoint: "endpoint2"})}, false},
+		{"no endpoint", &pb.Configuration{Current: configFn(&pb.Peer{Id: "node1"})}, false},
+		{"staging voter", &pb.Configuration{Current: configFn(peer1), Staging: []*pb.Peer{peer1}}, false},
+		{"metadata", &pb.Configuration{Current: configFn(&pb.Peer{Id: "node1", Endpoint: "endpoint1",
+			Metadata: map[string]string{"zone": "a", "version": ""}})}, true},
+		{"empty metadata key", &pb.Configuration{Current: configFn(&pb.Peer{Id: "node1", Endpoint: "endpoint1",
+			Metadata: map[string]string{"": "a"}})}, false},
+	} {
+		err := validateConfiguration(c.conf)
+		if c.valid {
+			assert.NoError(t, err, c.name)
+			continue
+		}
+		var confErr *ConfigurationError
+		assert.ErrorAs(t, err, &confErr, c.name)
+		assert.ErrorIs(t, err, ErrInvalidConfiguration, c.name)
+	}
+}
+
+func TestConfigSuffrage(t *testing.T) {
+	c := newConfig(&pb.Config{Peers: []*pb.Peer{
+		{Id: "node1", Endpoint: "endpoint1"},
+		{Id: "node2", Endpoint: "endpoint2"},
+		{Id: "node3", Endpoint: "endpoint3"},
+		{Id: "node4", Endpoint: "endpoint4", Suffrage: pb.Suffrage_SUFFRAGE_NON_VOTER},
+		{Id: "node5", Endpoint: "endpoint5", Suffrage: pb.Suffrage_SUFFRAGE_NON_VOTER},
+	}})
+	assert.Equal(t, 3, c.Voters())
+	assert.Equal(t, 2, c.Quorum())
+	assert.True(t, c.Contains("node1"))
+	assert.False(t, c.Contains("node4"))
+	assert.False(t, c.Contains("node6"))
+
+	// A voter in the current config is demoted in the next config.
+	conf := newConfiguration(&pb.Configuration{Current: c.Config, Next: &pb.Config{Peers: []*pb.Peer{
+		{Id: "node1", Endpoint: "endpoint1", Suffrage: pb.Suffrage_SUFFRAGE_NON_VOTER},
+		{Id: "node2", Endpoint: "endpoint2"},
+		{Id: "node3", Endpoint: "endpoint3"},
+	}}}, 1)
+	assert.True(t, conf.Voter("node1"))
+	assert.True(t, conf.Voter("node2"))
+	assert.False(t, conf.Voter("node4"))
+	assert.Equal(t, 2, conf.NextConfig().Quorum())
+}
+
+func TestConfigurationStoreVerifyQuorum(t *testing.T) {
+	server := testingServer(t)
+	server.id = "node1"
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	store := ƒAssertNoError2(newConfigurationStore(server))(t)
+
+	next := &pb.Config{Peers: []*pb.Peer{
+		{Id: "node1", Endpoint: "endpoint1"}, {Id: "node2", Endpoint: "endpoint2"}, {Id: "node3", Endpoint: "endpoint3"},
+	}}
+	assert.ErrorIs(t, store.verifyQuorum(next), ErrInvalidConfiguration)
+	// The servers that have not acknowledged the leader recently are inactive.
+	server.replScheduler.setLastContact("node2", time.Now().Add(-time.Hour))
+	assert.ErrorIs(t, store.verifyQuorum(next), ErrInvalidConfiguration)
+	server.replScheduler.setLastContact("node2", time.Now())
+	assert.NoError(t, store.verifyQuorum(next))
+	// The non-voters are not counted.
+	next.Peers = append(next.Peers,
+		&pb.Peer{Id: "node4", Endpoint: "endpoint4", Suffrage: pb.Suffrage_SUFFRAGE_NON_VOTER},
+		&pb.Peer{Id: "node5", Endpoint: "endpoint5", Suffrage: pb.Suffrage_SUFFRAGE_NON_VOTER})
+	assert.NoError(t, store.verifyQuorum(next))
+}
+
+func TestConfigurationStoreRestore(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	store := ƒAssertNoError2(newConfigurationStore(server))(t)
+
+	snapshotConf := &pb.Configuration{Current: &pb.Config{Peers: []*pb.Peer{{Id: "node1", Endpoint: "endpoint1"}}}}
+	snapshotMeta := &objectSnapshotMeta{pbMeta: &pb.ObjectSnapshotMeta{
+		Index:              3,
+		Term:               1,
+		Configuration:      snapshotConf,
+		ConfigurationIndex: 2,
+	}}
+
+	latest := ƒAssertNoError2(store.Restore(snapshotMeta))(t)
+	assert.True(t, proto.Equal(snapshotConf, latest.Configuration))
+	assert.Equal(t, uint64(2), latest.LogIndex())
+	assert.Equal(t, uint64(2), store.Committed().LogIndex())
+
+	// The configuration log following the snapshot supersedes the snapshot's.
+	logConf := snapshotConf.CopyInitiateTransition(&pb.Config{Peers: []*pb.Peer{{Id: "node2", Endpoint: "endpoint2"}}})
+	assert.NoError(t, server.logStore.AppendLogs([]*pb.Log{{
+		Meta: &pb.LogMeta{Index: 4, Term: 1},
+		Body: &pb.LogBody{Type: pb.LogType_CONFIGURATION, Data: ƒAssertNoError2(proto.Marshal(logConf))(t)},
+	}}))
+	latest = ƒAssertNoError2(store.Restore(snapshotMeta))(t)
+	assert.True(t, proto.Equal(logConf, latest.Configuration))
+	assert.Equal(t, uint64(4), latest.LogIndex())
+	assert.Equal(t, uint64(2), store.Committed().LogIndex())
+	// The snapshot's configuration is recorded in the history once.
+	history := store.History()
+	assert.Len(t, history, 1)
+	assert.Equal(t, uint64(2), history[0].Index)
+	assert.Zero(t, history[0].Term)
+}
+
+func TestConfigurationStoreHistory(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	store := ƒAssertNoError2(newConfigurationStore(server))(t)
+
+	conf := &pb.Configuration{Current: &pb.Config{Peers: []*pb.Peer{{Id: "node1", Endpoint: "endpoint1"}}}}
+	for i := uint64(1); i <= maxConfigurationHistory+1; i++ {
+		store.record(ConfigurationRecord{Index: i, Term: 1, Configuration: conf})
+	}
+	// The configurations applied again are not recorded.
+	store.record(ConfigurationRecord{Index: 3, Term: 1, Configuration: conf})
+	history := store.History()
+	assert.Len(t, history, maxConfigurationHistory)
+	assert.Equal(t, uint64(2), history[0].Index)
+	assert.Equal(t, uint64(maxConfigurationHistory+1), history[len(history)-1].Index)
+}
+
+type testingConfigurationStateMachine struct {
+	testingStateMachine
+	indexes        []uint64
+	configurations []*pb.Configuration
+}
+
+func (m *testingConfigurationStateMachine) ApplyConfiguration(index uint64, configuration *pb.Configuration) {
+	m.indexes = append(m.indexes, index)
+	m.configurations = append(m.configurations, configuration)
+}
+
+func TestStateMachineProxyApplyConfiguration(t *testing.T) {
+	server := testingServer(t)
+	stateMachine := &testingConfigurationStateMachine{}
+	proxy := newStateMachineProxy(server, stateMachine)
+
+	configuration := &pb.Configuration{
+		Current: &pb.Config{Peers: []*pb.Peer{{Id: "1", Endpoint: "1"}}},
+		Next:    &pb.Config{Peers: []*pb.Peer{{Id: "1", Endpoint: "1"}, {Id: "2", Endpoint: "2"}}},
+	}
+	ƒAssertNoError2(proxy.Apply(&pb.Log{
+		Meta: &pb.LogMeta{Index: 3, Term: 1},
+		Body: &pb.LogBody{Type: pb.LogType_CONFIGURATION, Data: Must2(proto.Marshal(configuration))},
+	}))(t)
+	assert.Equal(t, []uint64{3}, stateMachine.indexes)
+	assert.True(t, proto.Equal(configuration, stateMachine.configurations[0]))
 }
@@ -14,3 +14,22 @@ func Context(timeout ...time.Duration) (context.Context, context.CancelFunc) {
 	}
 	return context.WithTimeout(context.Background(), t)
 }
+
+// stopContext returns a context that is canceled once stopCh is closed.
+func stopContext(stopCh <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	select {
+	case <-stopCh:
+		cancel()
+		return ctx, cancel
+	default:
+	}
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,78 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DeadServerPolicy decides when the leader removes the voters that have been
+// unreachable from the configuration on its own, so that the failed servers
+// don't keep counting towards the quorum, and the cluster keeps tolerating
+// failures until they are replaced. The voters are removed one at a time with
+// configuration transitions.
+type DeadServerPolicy struct {
+	// Threshold is how long a voter may have not responded to the leader
+	// before it's removed. The voters that have not responded since the
+	// leader is elected are timed from the election. It must not be shorter
+	// than the follower timeout. Zero disables the cleanup.
+	Threshold time.Duration
+	// MinVoters is the number of the voters below which no more voters are
+	// removed, e.g., 3 to keep a cluster of 3 servers from shrinking when a
+	// server fails. Zero means no limit other than the quorum of the servers
+	// left, which must be reachable.
+	MinVoters int
+}
+
+func (p DeadServerPolicy) validate() error {
+	if p.Threshold < 0 {
+		return fmt.Errorf("dead server threshold %v is negative", p.Threshold)
+	}
+	if p.MinVoters < 0 {
+		return fmt.Errorf("dead server min voters %d is negative", p.MinVoters)
+	}
+	return nil
+}
+
+// unreachableSince returns the time since when the peer has not responded to
+// the leader, which is when the replications of the term are started if the
+// peer has not responded in the term.
+func (r *replScheduler) unreachableSince(serverID string) time.Time {
+	if lastContact := r.lastContact(serverID); !lastContact.IsZero() {
+		return lastContact
+	}
+	return r.startedAt
+}
+
+// removeDeadServers initiates the configuration transition removing a voter
+// that has been unreachable beyond the threshold of the DeadServerPolicy. The
+// other dead voters are removed after the transition completes. Should only
+// be called in the leader loop.
+func (s *Server) removeDeadServers() {
+	policy := s.opts().deadServerPolicy
+	latest := s.confStore.Latest()
+	if policy.Threshold <= 0 || latest.Joint() || latest.CurrentConfig().Voters() <= policy.MinVoters {
+		return
+	}
+	now := s.opts().clock.Now()
+	for _, peer := range latest.Current.Peers {
+		if peer.Id == s.id || !peer.Voter() {
+			continue
+		}
+		since := s.replScheduler.unreachableSince(peer.Id)
+		if now.Sub(since) < policy.Threshold {
+			continue
+		}
+		s.logger.Warnw("removing the dead server",
+			logFields(s, zap.Object("peer", peer), "unreachable_since", since)...)
+		if err := s.confStore.remove(peer.Id, s.id); err != nil {
+			s.logger.Warnw("error occurred removing the dead server",
+				logFields(s, zap.Object("peer", peer), zap.Error(err))...)
+			return
+		}
+		s.audit(context.Background(), AuditDeadServerRemoved, peer)
+		return
+	}
+}
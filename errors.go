@@ -1,6 +1,10 @@
 package raft
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	ErrDeadlineExceeded = errors.New("deadline exceeded")
@@ -13,6 +17,10 @@ var (
 	// be processed on non-leader server.
 	ErrNonLeader = errors.New("not a leader")
 
+	// ErrNoLeader indicates that a request cannot be redirected to the leader
+	// since the leader is unknown, e.g., during an election.
+	ErrNoLeader = errors.New("no known leader")
+
 	// ErrNonFollower indicates that the server received an RPC that cannot
 	// be processed on non-follower server.
 	ErrNonFollower = errors.New("not a follower")
@@ -28,7 +36,137 @@ var (
 	// ErrInJointConsensus indicates that the server is not in a joint consensus.
 	ErrNotInJointConsensus = errors.New("not in a joint consensus")
 
+	// ErrTransitionCommitted indicates that a configuration transition cannot
+	// be aborted since its joint configuration has been committed.
+	ErrTransitionCommitted = errors.New("configuration transition already committed")
+
 	ErrUnknownTransporClient = errors.New("unknown transport client")
 
 	ErrUnknownRPC = errors.New("unknown RPC")
+
+	// ErrCompactionUnsupported indicates that the LogStore does not implement
+	// LogStoreCompactor.
+	ErrCompactionUnsupported = errors.New("compaction is not supported by the LogStore")
+
+	// ErrAuditLogDisabled indicates that no AuditLog is set.
+	ErrAuditLogDisabled = errors.New("audit log is disabled")
+
+	// ErrLogsCompacted indicates that the requested logs have been compacted
+	// by a snapshot.
+	ErrLogsCompacted = errors.New("logs have been compacted")
+
+	// ErrCorruptedLog indicates that a persisted log record is damaged.
+	ErrCorruptedLog = errors.New("corrupted log")
+
+	// ErrCorruptedState indicates that the persisted states are damaged.
+	ErrCorruptedState = errors.New("corrupted state")
+
+	// ErrInvalidLog indicates that the logs to be persisted violate the
+	// invariants of the LogStore.
+	ErrInvalidLog = errors.New("invalid log")
+
+	// ErrReadOnlyLogStore indicates that the LogStore is opened read-only and
+	// cannot be modified.
+	ErrReadOnlyLogStore = errors.New("log store is read-only")
+
+	// ErrObjectNotFound indicates that the object does not exist in the
+	// ObjectStore.
+	ErrObjectNotFound = errors.New("object not found")
+
+	// ErrSnapshotChecksumUnsupported indicates that the SnapshotMeta does not
+	// implement SnapshotChecksumMeta.
+	ErrSnapshotChecksumUnsupported = errors.New("snapshot checksums are not supported by the SnapshotMeta")
+
+	// ErrCorruptedSnapshot indicates that the data of a snapshot does not
+	// match its SnapshotMeta.
+	ErrCorruptedSnapshot = errors.New("corrupted snapshot")
+
+	// ErrNothingToSnapshot indicates that a snapshot is not taken since there
+	// are no applied logs.
+	ErrNothingToSnapshot = errors.New("nothing to snapshot")
+
+	// ErrNoQueryHandler indicates that a query cannot be served since no
+	// QueryHandler is set.
+	ErrNoQueryHandler = errors.New("no query handler")
+
+	// ErrPeerExists indicates that the peer to add is already in the
+	// configuration.
+	ErrPeerExists = errors.New("peer already exists")
+
+	// ErrUnauthenticated indicates that a request to the API server carries no
+	// valid credentials.
+	ErrUnauthenticated = errors.New("unauthenticated")
+
+	// ErrInvalidOption indicates that NewServer is called with an option the
+	// server cannot work with. The error returned wraps it with the details.
+	ErrInvalidOption = errors.New("invalid option")
+
+	// ErrLeadershipTransfer indicates that new logs are rejected since the
+	// leadership is being transferred.
+	ErrLeadershipTransfer = errors.New("leadership transfer in progress")
+
+	// ErrProposalDropped indicates that a log is rejected by the leader since
+	// the logs yet to be committed have reached a limit of the
+	// BackpressurePolicy.
+	ErrProposalDropped = errors.New("proposal dropped: too many uncommitted logs")
+
+	// ErrLeadershipLost indicates that the leader lost the leadership before
+	// the log was applied. The log may or may not be committed by the new
+	// leader.
+	ErrLeadershipLost = errors.New("leadership lost before the log was applied")
+
+	// ErrUnknownSession indicates that a command is applied in a client
+	// session that is not registered or has expired.
+	ErrUnknownSession = errors.New("unknown session")
+
+	// ErrStaleSequence indicates that a command is applied in a client
+	// session with a sequence number the client has acknowledged.
+	ErrStaleSequence = errors.New("stale session sequence")
+
+	// ErrNoTransferTarget indicates that there's no other voter to transfer
+	// the leadership to.
+	ErrNoTransferTarget = errors.New("no server to transfer the leadership to")
+
+	// ErrUnknownPeer indicates that an RPC is rejected since the sender is not
+	// in the configuration.
+	ErrUnknownPeer = errors.New("unknown peer")
+
+	// ErrCatchUpTimeout indicates that a server is not added to the cluster
+	// since it did not catch up with the leader in time.
+	ErrCatchUpTimeout = errors.New("server did not catch up with the leader in time")
+
+	// ErrEndpointChanged indicates that the server is started with an endpoint
+	// other than the one of its ID in the configuration, while
+	// AnnounceEndpointOption is disabled.
+	ErrEndpointChanged = errors.New("endpoint differs from the configuration")
+
+	// ErrInvalidConfiguration indicates that a configuration transition is
+	// rejected since the configuration is broken, or its quorum cannot be
+	// reached. The error returned wraps it with the details.
+	ErrInvalidConfiguration = errors.New("invalid configuration")
 )
+
+// messageErrors are the errors recognized by errorFromMessage.
+var messageErrors = []error{
+	ErrDeadlineExceeded, ErrServerShutdown, ErrNonLeader, ErrNoLeader, ErrLeadershipLost,
+	ErrLeadershipTransfer, ErrUnknownSession, ErrStaleSequence, ErrInJointConsensus, ErrPeerExists,
+	ErrUnknownPeer, ErrCatchUpTimeout, ErrInvalidConfiguration, ErrNotInJointConsensus, ErrTransitionCommitted,
+	ErrProposalDropped,
+}
+
+// errorFromMessage converts the message of an error carried in an RPC
+// response back to the known error it originates from if possible.
+func errorFromMessage(message string) error {
+	for _, err := range messageErrors {
+		if message == err.Error() {
+			return err
+		}
+	}
+	for _, err := range messageErrors {
+		if strings.HasPrefix(message, err.Error()) {
+			// Keep the details in the message.
+			return fmt.Errorf("%w%s", err, strings.TrimPrefix(message, err.Error()))
+		}
+	}
+	return errors.New(message)
+}
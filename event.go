@@ -0,0 +1,166 @@
+package raft
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sumimakito/raft/pb"
+)
+
+// EventType is the type of the Event.
+type EventType string
+
+const (
+	// EventLeaderChanged is published when the server discovers a new leader or
+	// loses the leader. Data is the new leader, which is NilPeer if the leader
+	// is lost.
+	EventLeaderChanged EventType = "leader_changed"
+	// EventRoleChanged is published when the role of the server changes. Data
+	// is the name of the new role.
+	EventRoleChanged EventType = "role_changed"
+	// EventConfigurationChanged is published when the latest configuration
+	// changes. Data is the new configuration.
+	EventConfigurationChanged EventType = "configuration_changed"
+	// EventSnapshotTaken is published when a snapshot has been taken. Data is
+	// the metadata of the snapshot.
+	EventSnapshotTaken EventType = "snapshot_taken"
+	// EventSnapshotRestored is published when a snapshot has been restored.
+	// Data is the metadata of the snapshot.
+	EventSnapshotRestored EventType = "snapshot_restored"
+	// EventPeerAdded is published when a peer joins the latest configuration.
+	// Data is the peer.
+	EventPeerAdded EventType = "peer_added"
+	// EventPeerRemoved is published when a peer leaves the latest
+	// configuration. Data is the peer.
+	EventPeerRemoved EventType = "peer_removed"
+	// EventElectionStarted is published when the server starts an election.
+	// Data is the term of the election.
+	EventElectionStarted EventType = "election_started"
+	// EventElectionWon is published when the server wins an election. Data is
+	// the term of the election.
+	EventElectionWon EventType = "election_won"
+	// EventElectionLost is published when an election started by the server
+	// ends without winning, e.g., on a split vote or a higher term. Data is the
+	// term of the election.
+	EventElectionLost EventType = "election_lost"
+	// EventRequestVoteReceived is published when the server has handled a
+	// RequestVote RPC. Data is the RequestVoteObservation.
+	EventRequestVoteReceived EventType = "request_vote_received"
+)
+
+// RequestVoteObservation is the data of EventRequestVoteReceived.
+type RequestVoteObservation struct {
+	CandidateID string `json:"candidate_id"`
+	Term        uint64 `json:"term"`
+	Granted     bool   `json:"granted"`
+}
+
+// Event is a notable change in the cluster observed by the server.
+type Event struct {
+	Type EventType   `json:"type"`
+	Time time.Time   `json:"time"`
+	Term uint64      `json:"term"`
+	Data interface{} `json:"data"`
+}
+
+type eventSnapshotData struct {
+	Id    string `json:"id"`
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+}
+
+// eventBroker fans out the events to the subscribers. Subscribers that fall
+// behind miss the events rather than block the publisher. The zero value is
+// ready for use.
+type eventBroker struct {
+	mu sync.Mutex // protects subscribers
+	// subscribers maps the channels to whether they are closed on
+	// unsubscription, i.e., they are created by the broker.
+	subscribers map[chan<- Event]bool
+}
+
+func (b *eventBroker) subscribe(bufferSize int) chan Event {
+	ch := make(chan Event, bufferSize)
+	b.register(ch, true)
+	return ch
+}
+
+func (b *eventBroker) register(ch chan<- Event, owned bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = map[chan<- Event]bool{}
+	}
+	b.subscribers[ch] = owned
+}
+
+func (b *eventBroker) unsubscribe(ch chan<- Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if owned, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		if owned {
+			close(ch)
+		}
+	}
+}
+
+func (b *eventBroker) publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that receives the events published from now on,
+// and a function that cancels the subscription and closes the channel. Events
+// are dropped if the channel, which is buffered with bufferSize, is full.
+func (s *Server) Subscribe(bufferSize int) (<-chan Event, func()) {
+	ch := s.events.subscribe(bufferSize)
+	return ch, func() { s.events.unsubscribe(ch) }
+}
+
+// RegisterObserver makes ch receive the events published from now on until it
+// is deregistered with DeregisterObserver, so that the applications can react
+// to the changes in the cluster without polling. Events are dropped if ch is
+// not ready to receive them. The channel is never closed by the server.
+func (s *Server) RegisterObserver(ch chan<- Event) {
+	s.events.register(ch, false)
+}
+
+// DeregisterObserver stops ch from receiving the events.
+func (s *Server) DeregisterObserver(ch chan<- Event) {
+	s.events.unsubscribe(ch)
+}
+
+func (s *Server) publishEvent(eventType EventType, data interface{}) {
+	s.events.publish(Event{Type: eventType, Time: time.Now(), Term: s.currentTerm(), Data: data})
+}
+
+func (s *Server) publishSnapshotEvent(eventType EventType, meta SnapshotMeta) {
+	s.publishEvent(eventType, eventSnapshotData{Id: meta.Id(), Index: meta.Index(), Term: meta.Term()})
+}
+
+// publishPeerEvents publishes the peers that join or leave the configuration.
+func (s *Server) publishPeerEvents(previous, c *configuration) {
+	for _, peer := range c.Peers() {
+		if _, ok := previous.Peer(peer.Id); !ok {
+			s.publishEvent(EventPeerAdded, peer)
+		}
+	}
+	for _, peer := range previous.Peers() {
+		if _, ok := c.Peer(peer.Id); !ok {
+			s.publishEvent(EventPeerRemoved, peer)
+		}
+	}
+}
+
+func (s *Server) publishLeaderEvent(previous, leader *pb.Peer) {
+	if previous.Id != leader.Id || previous.Endpoint != leader.Endpoint {
+		s.publishEvent(EventLeaderChanged, leader)
+	}
+}
@@ -0,0 +1,243 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const healthWatchInterval = 500 * time.Millisecond
+
+// healthService implements the gRPC health checking protocol. The status is
+// evaluated on each check so that it always reflects the current state of the
+// cluster. Only the overall health, i.e., the empty service name, and the
+// services registered along with it are known.
+type healthService struct {
+	healthpb.UnimplementedHealthServer
+
+	checkerMu sync.RWMutex
+	checker   func() bool
+
+	services map[string]struct{}
+}
+
+func newHealthService(checker func() bool, services ...string) *healthService {
+	s := &healthService{checker: checker, services: map[string]struct{}{"": {}}}
+	for _, service := range services {
+		s.services[service] = struct{}{}
+	}
+	return s
+}
+
+func (s *healthService) setChecker(checker func() bool) {
+	s.checkerMu.Lock()
+	defer s.checkerMu.Unlock()
+	s.checker = checker
+}
+
+func (s *healthService) status() healthpb.HealthCheckResponse_ServingStatus {
+	s.checkerMu.RLock()
+	checker := s.checker
+	s.checkerMu.RUnlock()
+	if checker == nil || !checker() {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+func (s *healthService) Check(ctx context.Context, request *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if _, ok := s.services[request.Service]; !ok {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	return &healthpb.HealthCheckResponse{Status: s.status()}, nil
+}
+
+// Watch sends the status once and then whenever it changes until the stream
+// is closed. Unknown services are reported as SERVICE_UNKNOWN.
+func (s *healthService) Watch(request *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	statusFn := s.status
+	if _, ok := s.services[request.Service]; !ok {
+		statusFn = func() healthpb.HealthCheckResponse_ServingStatus {
+			return healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+		}
+	}
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+	lastStatus := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		if status := statusFn(); status != lastStatus {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: status}); err != nil {
+				return err
+			}
+			lastStatus = status
+		}
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Names of the checks reported in Health.
+const (
+	HealthCheckQuorum        = "quorum"
+	HealthCheckLeaderContact = "leader_contact"
+	HealthCheckStorage       = "storage"
+	HealthCheckApply         = "apply"
+)
+
+// HealthPolicy decides when the checks of Health fail.
+type HealthPolicy struct {
+	// LeaderContactTimeout is how long a follower may go without hearing
+	// from the leader, and how long a leader may go without hearing from a
+	// quorum. Zero means the follower timeout.
+	LeaderContactTimeout time.Duration
+	// StorageStallTimeout is how long an append to the LogStore may run
+	// before the storage is considered unresponsive. Zero disables the check.
+	StorageStallTimeout time.Duration
+	// MaxApplyBacklog is the number of the committed logs that may be waiting
+	// to be applied. Zero disables the limit.
+	MaxApplyBacklog uint64
+}
+
+func (p HealthPolicy) validate() error {
+	if p.LeaderContactTimeout < 0 {
+		return fmt.Errorf("leader contact timeout %v is negative", p.LeaderContactTimeout)
+	}
+	if p.StorageStallTimeout < 0 {
+		return fmt.Errorf("storage stall timeout %v is negative", p.StorageStallTimeout)
+	}
+	return nil
+}
+
+// HealthCheck is the result of one of the checks of Health.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	// Detail explains the result, mostly why the check failed.
+	Detail string `json:"detail,omitempty"`
+}
+
+// Health is the overall health of the server, which is healthy only if all
+// the checks pass.
+type Health struct {
+	Healthy bool          `json:"healthy"`
+	Checks  []HealthCheck `json:"checks"`
+}
+
+// Health evaluates the health of the server by the HealthPolicy. It is used
+// for the health services and suits a readiness probe, since the server is
+// reported unhealthy when it cannot serve the requests in time.
+func (s *Server) Health() Health {
+	health := Health{
+		Healthy: true,
+		Checks: []HealthCheck{
+			s.checkQuorum(),
+			s.checkLeaderContact(),
+			s.checkStorage(),
+			s.checkApply(),
+		},
+	}
+	for _, check := range health.Checks {
+		if !check.Healthy {
+			health.Healthy = false
+		}
+	}
+	return health
+}
+
+func (s *Server) leaderContactTimeout() time.Duration {
+	if timeout := s.opts().healthPolicy.LeaderContactTimeout; timeout > 0 {
+		return timeout
+	}
+	return s.opts().followerTimeout
+}
+
+// checkQuorum checks whether a quorum has acknowledged the leader recently.
+// Only the leader knows, so the followers rely on checkLeaderContact.
+func (s *Server) checkQuorum() HealthCheck {
+	check := HealthCheck{Name: HealthCheckQuorum, Healthy: true}
+	if s.role() != Leader {
+		check.Detail = "checked by the leader"
+		return check
+	}
+	timeout := s.leaderContactTimeout()
+	if !s.quorumContactedSince(s.opts().clock.Now().Add(-timeout)) {
+		check.Healthy = false
+		check.Detail = fmt.Sprintf("quorum not reached within %v", timeout)
+	}
+	return check
+}
+
+// checkLeaderContact checks whether a leader is known and has been heard from
+// recently.
+func (s *Server) checkLeaderContact() HealthCheck {
+	check := HealthCheck{Name: HealthCheckLeaderContact, Healthy: true}
+	if s.role() == Leader {
+		return check
+	}
+	if s.Leader().Id == "" {
+		check.Healthy = false
+		check.Detail = "no known leader"
+		return check
+	}
+	if age := s.opts().clock.Now().Sub(s.lastLeaderContact()); age > s.leaderContactTimeout() {
+		check.Healthy = false
+		check.Detail = fmt.Sprintf("last contact with the leader %v ago", age)
+	}
+	return check
+}
+
+// checkStorage checks whether the append to the LogStore in progress, if any,
+// has stalled.
+func (s *Server) checkStorage() HealthCheck {
+	check := HealthCheck{Name: HealthCheckStorage, Healthy: true}
+	timeout := s.opts().healthPolicy.StorageStallTimeout
+	if stalled := s.logStore.appendStalled(); timeout > 0 && stalled > timeout {
+		check.Healthy = false
+		check.Detail = fmt.Sprintf("log append stalled for %v", stalled)
+	}
+	return check
+}
+
+// checkApply checks whether the logs are applied without transient errors and
+// the backlog of the committed logs is within the limit.
+func (s *Server) checkApply() HealthCheck {
+	check := HealthCheck{Name: HealthCheckApply, Healthy: true}
+	switch {
+	case atomic.LoadUint32(&s.flagApplyHalted) == 1:
+		check.Healthy = false
+		check.Detail = "applying halted by a transient error"
+	case atomic.LoadUint32(&s.flagApplyUnhealthy) == 1:
+		check.Healthy = false
+		check.Detail = "marked unhealthy by a transient error"
+	default:
+		maxBacklog := s.opts().healthPolicy.MaxApplyBacklog
+		if backlog := s.applyBacklog(); maxBacklog > 0 && backlog > maxBacklog {
+			check.Healthy = false
+			check.Detail = fmt.Sprintf("%d committed logs waiting to be applied", backlog)
+		}
+	}
+	return check
+}
+
+// applyBacklog returns the number of the committed logs yet to be applied.
+func (s *Server) applyBacklog() uint64 {
+	commitIndex, appliedIndex := s.commitIndex(), s.lastApplied().Index
+	if commitIndex <= appliedIndex {
+		return 0
+	}
+	return commitIndex - appliedIndex
+}
+
+// healthy reports whether all the checks of Health pass.
+func (s *Server) healthy() bool {
+	return s.Health().Healthy
+}
@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+)
+
+func TestServerHealth(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	server := testingServer(t, ClockOption(clock), HealthPolicyOption(HealthPolicy{
+		StorageStallTimeout: time.Second,
+		MaxApplyBacklog:     2,
+	}))
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{
+		Peers: []*pb.Peer{{Id: "1", Endpoint: "1"}, {Id: "2", Endpoint: "2"}, {Id: "3", Endpoint: "3"}},
+	}}, 1))
+	server.id = "1"
+
+	failedChecks := func() []string {
+		var failed []string
+		health := server.Health()
+		for _, check := range health.Checks {
+			if !check.Healthy {
+				failed = append(failed, check.Name)
+			}
+		}
+		assert.Equal(t, len(failed) == 0, health.Healthy)
+		return failed
+	}
+
+	// A follower without a leader.
+	assert.Equal(t, []string{HealthCheckLeaderContact}, failedChecks())
+	server.alterLeader(&pb.Peer{Id: "2", Endpoint: "2"})
+	server.setLastLeaderContact(clock.Now())
+	assert.Empty(t, failedChecks())
+	clock.Advance(server.opts().followerTimeout + time.Millisecond)
+	assert.Equal(t, []string{HealthCheckLeaderContact}, failedChecks())
+
+	// A leader without a quorum.
+	server.setRole(Leader)
+	assert.Equal(t, []string{HealthCheckQuorum}, failedChecks())
+	server.replScheduler.setLastContact("2", clock.Now())
+	assert.Empty(t, failedChecks())
+
+	// A stalled append.
+	server.logStore.appendStart = time.Now().Add(-2 * time.Second).UnixNano()
+	assert.Equal(t, []string{HealthCheckStorage}, failedChecks())
+	server.logStore.appendStart = 0
+
+	// A backlog of the committed logs.
+	server.setCommitIndex(3)
+	assert.Equal(t, []string{HealthCheckApply}, failedChecks())
+	server.setLastApplied(1, 1)
+	assert.Empty(t, failedChecks())
+}
@@ -0,0 +1,111 @@
+package raft
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap"
+)
+
+// leadershipTransferPollInterval is the interval between checks on the
+// progress of a leadership transfer.
+const leadershipTransferPollInterval = 5 * time.Millisecond
+
+// TransferLeadership transfers the leadership to the voter with the ID, or to
+// the most up-to-date voter if id is empty. New logs are rejected with
+// ErrLeadershipTransfer during the transfer. The target is brought up to date
+// with the logs of the leader and then asked to start an election at once,
+// which the voters take part in even though the leader is alive. It returns
+// once the leader steps down. ErrNonLeader is returned on non-leader servers,
+// and ErrNoTransferTarget is returned if there's no other voter.
+func (s *Server) TransferLeadership(ctx context.Context, id string) error {
+	if s.role() != Leader {
+		return ErrNonLeader
+	}
+	s.audit(ctx, AuditLeadershipTransferRequested, id)
+	if !atomic.CompareAndSwapUint32(&s.flagLeadershipTransfer, 0, 1) {
+		return ErrLeadershipTransfer
+	}
+	defer atomic.StoreUint32(&s.flagLeadershipTransfer, 0)
+
+	target, err := s.transferTarget(id)
+	if err != nil {
+		return err
+	}
+	term := s.currentTerm()
+	s.logger.Infow("leadership transfer started", logFields(s, zap.Object("target", target))...)
+
+	ticker := time.NewTicker(leadershipTransferPollInterval)
+	defer ticker.Stop()
+	wait := func() error {
+		if s.currentTerm() != term || s.role() != Leader {
+			return ErrNonLeader
+		}
+		select {
+		case <-ctx.Done():
+			return ErrDeadlineExceeded
+		case <-ticker.C:
+			return nil
+		}
+	}
+
+	// The logs enqueued before the transfer may still be appended, so the last
+	// log index is checked on each round.
+	for s.replScheduler.matchIndex(target.Id) < s.lastLogIndex() {
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+
+	// The lease reads fall back to ReadIndex from now on in the term, even if
+	// the transfer fails.
+	atomic.StoreUint64(&s.leaseSuspendedTerm, term)
+	if _, err := s.trans.TimeoutNow(WithRequestID(ctx, NewObjectID().Hex()), target, &pb.TimeoutNowRequest{Term: term, LeaderId: s.id}); err != nil {
+		return err
+	}
+
+	// We step down once we learn the term of the election.
+	for {
+		if err := wait(); errors.Is(err, ErrNonLeader) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	s.logger.Infow("leadership transferred", logFields(s, zap.Object("target", target))...)
+	return nil
+}
+
+// transferTarget returns the voter with the ID, or the voter with the highest
+// match index if id is empty. The voters in the next configuration are
+// considered during a joint consensus.
+func (s *Server) transferTarget(id string) (*pb.Peer, error) {
+	c := s.confStore.Latest()
+	voters := c.CurrentConfig()
+	if c.Joint() {
+		voters = c.NextConfig()
+	}
+	if id != "" {
+		if id == s.id || !voters.Contains(id) {
+			return nil, errors.Wrapf(ErrUnknownPeer, "server %q is not another voter", id)
+		}
+		peer, _ := c.Peer(id)
+		return peer, nil
+	}
+	var target *pb.Peer
+	for _, p := range voters.Peers {
+		if p.Id == s.id || !p.Voter() {
+			continue
+		}
+		if target == nil || s.replScheduler.matchIndex(p.Id) > s.replScheduler.matchIndex(target.Id) {
+			target = p
+		}
+	}
+	if target == nil {
+		return nil, ErrNoTransferTarget
+	}
+	return target, nil
+}
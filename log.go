@@ -1,7 +1,14 @@
 package raft
 
 import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
 	"github.com/sumimakito/raft/pb"
+	"google.golang.org/protobuf/proto"
 )
 
 // LogStore defines the interface for appending, trimming, and retrieving logs
@@ -12,6 +19,10 @@ type LogStore interface {
 	// AppendLogs is used to append logs to the LogStore.
 	// It's recommended to use techniques like transaction processing to
 	// avoid data inconsistency due to an error or interruption.
+	// The logs must not be modified. They may only be retained after
+	// AppendLogs returns if the LogStore does not implement
+	// LogStoreRetention, or reports that it retains the logs, in which case
+	// the server passes copies of the logs it reuses.
 	AppendLogs(logs []*pb.Log) error
 
 	// TrimPrefix is used to trim the logs by evicting UNPACKED logs forwards from
@@ -32,6 +43,200 @@ type LogStore interface {
 	LastEntry(t pb.LogType) (*pb.Log, error)
 }
 
+// LogStoreRangeReader is an optional interface for those LogStore
+// implementations that are able to read a range of logs more efficiently than
+// calling Entry() on each index.
+type LogStoreRangeReader interface {
+	// Entries returns the logs with indexes in the range of firstIndex to
+	// lastIndex, both inclusive, in ascending order of the index. Logs that do
+	// not exist are omitted.
+	Entries(firstIndex, lastIndex uint64) ([]*pb.Log, error)
+}
+
+// logStoreEntries reads the logs in the range of firstIndex to lastIndex with
+// LogStoreRangeReader if the LogStore implements it, or falls back to calling
+// Entry() on each index.
+func logStoreEntries(store LogStore, firstIndex, lastIndex uint64) ([]*pb.Log, error) {
+	if r, ok := store.(LogStoreRangeReader); ok {
+		return r.Entries(firstIndex, lastIndex)
+	}
+	if firstIndex > lastIndex {
+		return nil, nil
+	}
+	logs := make([]*pb.Log, 0, lastIndex-firstIndex+1)
+	for i := firstIndex; i <= lastIndex; i++ {
+		log, err := store.Entry(i)
+		if err != nil {
+			return nil, err
+		}
+		if log != nil {
+			logs = append(logs, log)
+		}
+	}
+	return logs, nil
+}
+
+// LogStoreRetention is an optional interface for those LogStore
+// implementations that report whether they retain the logs passed to
+// AppendLogs(). The server reuses the logs once they are appended to the
+// LogStores that do not retain them, and appends copies of the logs to the
+// other LogStores, including those not implementing LogStoreRetention.
+type LogStoreRetention interface {
+	// RetainsLogs reports whether the logs passed to AppendLogs() may be
+	// referenced after AppendLogs() returns.
+	RetainsLogs() bool
+}
+
+// logStoreRetainsLogs reports whether the LogStore may retain the logs passed
+// to AppendLogs(). LogStores not implementing LogStoreRetention are assumed to
+// retain them.
+func logStoreRetainsLogs(store LogStore) bool {
+	r, ok := store.(LogStoreRetention)
+	return !ok || r.RetainsLogs()
+}
+
+// LogIterator is used to iterate over the logs in ascending order of the
+// index without reading all of them into memory at once.
+type LogIterator interface {
+	// Seek moves the iterator to the first log with an index not less than
+	// index.
+	Seek(index uint64)
+
+	// Next returns the log at the current position and advances the iterator.
+	// A nil log is returned if there are no more logs.
+	Next() (*pb.Log, error)
+
+	// Close releases the resources held by the iterator.
+	Close() error
+}
+
+// LogStoreIterable is an optional interface for those LogStore
+// implementations that are able to provide a LogIterator natively.
+type LogStoreIterable interface {
+	Iterator() LogIterator
+}
+
+// logIteratorBatchSize is the number of logs read at once by the fallback
+// LogIterator.
+const logIteratorBatchSize = 64
+
+// NewLogIterator returns the LogIterator provided by the LogStore if it
+// implements LogStoreIterable, or a LogIterator that reads the logs in batches
+// with logStoreEntries().
+func NewLogIterator(store LogStore) LogIterator {
+	if i, ok := store.(LogStoreIterable); ok {
+		return i.Iterator()
+	}
+	return &batchLogIterator{store: store}
+}
+
+type batchLogIterator struct {
+	store     LogStore
+	next      uint64
+	lastIndex uint64
+	batch     []*pb.Log
+	err       error
+}
+
+func (i *batchLogIterator) Seek(index uint64) {
+	i.next = index
+	i.batch = nil
+	i.lastIndex, i.err = i.store.LastIndex()
+}
+
+func (i *batchLogIterator) Next() (*pb.Log, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	for len(i.batch) == 0 {
+		if i.next == 0 || i.next > i.lastIndex {
+			return nil, nil
+		}
+		lastIndex := i.next + logIteratorBatchSize - 1
+		if lastIndex > i.lastIndex {
+			lastIndex = i.lastIndex
+		}
+		if i.batch, i.err = logStoreEntries(i.store, i.next, lastIndex); i.err != nil {
+			return nil, i.err
+		}
+		i.next = lastIndex + 1
+	}
+	log := i.batch[0]
+	i.batch = i.batch[1:]
+	return log, nil
+}
+
+func (i *batchLogIterator) Close() error {
+	i.batch = nil
+	return nil
+}
+
+// LogStoreSyncObserverSetter is an optional interface for those LogStore
+// implementations that sync the logs to the disk. The server sets the
+// function the durations of the syncs are reported to, which records
+// MetricLogSyncLatency and warns about the slow syncs.
+type LogStoreSyncObserverSetter interface {
+	SetSyncObserver(observer func(d time.Duration))
+}
+
+// LogStoreCompactor is an optional interface for those LogStore
+// implementations that are able to reclaim the disk space occupied by trimmed
+// or overwritten logs.
+type LogStoreCompactor interface {
+	// Compact reclaims the disk space that holds no live data.
+	Compact() error
+
+	// StorageStats reports the disk usage of the LogStore.
+	StorageStats() (StorageStats, error)
+}
+
+// StorageStats describes the disk usage of a LogStore.
+type StorageStats struct {
+	// SizeBytes is the disk space occupied by the LogStore.
+	SizeBytes int64 `json:"size_bytes"`
+	// LiveBytes is the part of SizeBytes that holds live data.
+	LiveBytes int64 `json:"live_bytes"`
+	// Fragmentation is the ratio of the disk space that can be reclaimed by
+	// compaction.
+	Fragmentation float64 `json:"fragmentation"`
+}
+
+func newStorageStats(sizeBytes, liveBytes int64) StorageStats {
+	stats := StorageStats{SizeBytes: sizeBytes, LiveBytes: liveBytes}
+	if sizeBytes > 0 && liveBytes < sizeBytes {
+		stats.Fragmentation = float64(sizeBytes-liveBytes) / float64(sizeBytes)
+	}
+	return stats
+}
+
+// LogCorruptionPolicy decides what to do when a log fails the checksum
+// verification on read.
+type LogCorruptionPolicy uint8
+
+const (
+	// LogCorruptionPanic panics the server.
+	LogCorruptionPanic LogCorruptionPolicy = 1 + iota
+	// LogCorruptionTruncate evicts the corrupted log and all logs after it so
+	// that the logs end with the last good log. The evicted logs are treated as
+	// missing and can be replicated again from the leader.
+	LogCorruptionTruncate
+	// LogCorruptionReport logs the corruption and returns ErrCorruptedLog to the
+	// caller.
+	LogCorruptionReport
+)
+
+func (p LogCorruptionPolicy) String() string {
+	switch p {
+	case LogCorruptionPanic:
+		return "Panic"
+	case LogCorruptionTruncate:
+		return "Truncate"
+	case LogCorruptionReport:
+		return "Report"
+	}
+	return "Unknown"
+}
+
 type logStoreOp interface {
 	__logStoreOp()
 }
@@ -45,6 +250,12 @@ const (
 
 type logStoreAppendOp struct {
 	FutureTask[[]*pb.LogMeta, []*pb.LogBody]
+	// responses, if not nil, are the futures of the results of
+	// StateMachine.Apply on the logs, in the order of the bodies.
+	responses []Future[interface{}]
+	// terms, if not nil, are the terms of the logs replicated from the
+	// leader, in the order of the bodies.
+	terms []uint64
 }
 
 func (*logStoreAppendOp) __logStoreOp() {}
@@ -56,46 +267,319 @@ type logStoreTrimOp struct {
 
 func (*logStoreTrimOp) __logStoreOp() {}
 
+// logStoreConfigurationOp appends the configuration log built by the task
+// from the latest configuration in the main loop, so that the configuration
+// does not change in between. No log is appended if the task returns nil.
+type logStoreConfigurationOp struct {
+	FutureTask[*pb.Configuration, func(latest *configuration) (*pb.Configuration, error)]
+}
+
+func (*logStoreConfigurationOp) __logStoreOp() {}
+
+// LogCompactionPolicy decides how many logs covered by a snapshot are retained
+// when the logs are compacted after taking the snapshot. Retaining logs allows
+// lagging followers to catch up without installing the snapshot. A log is
+// retained if any of the conditions holds. The zero value retains no logs.
+type LogCompactionPolicy struct {
+	// RetainEntries is the number of the last logs covered by the snapshot to
+	// retain.
+	RetainEntries uint64
+	// RetainBytes is the total size of the last logs covered by the snapshot
+	// to retain.
+	RetainBytes int64
+	// RetainDuration is the duration for which the logs are retained after
+	// being appended. Logs appended before the server starts are not retained
+	// by this condition.
+	RetainDuration time.Duration
+}
+
+type logAppendTime struct {
+	index uint64
+	at    time.Time
+}
+
 // logStoreProxy works as a proxy for the underlying LogStore.
 type logStoreProxy struct {
 	LogStore
-	server       *Server
-	snapshotMeta SnapshotMeta
+	server *Server
+
+	snapshotMetaMu sync.RWMutex // protects snapshotMeta
+	snapshotMeta   SnapshotMeta
+
+	appendTimesMu sync.Mutex // protects appendTimes
+	// appendTimes holds the first index and the time of each append in
+	// ascending order of the index for LogCompactionPolicy.RetainDuration.
+	appendTimes []logAppendTime
+
+	// appendStart is the time in Unix nanoseconds when the append in progress
+	// started, or zero if there's none.
+	appendStart int64
+
+	lastMetaMu sync.Mutex // protects lastMeta and lastMetaGen
+	// lastMeta caches the meta of the last log. Nil means the cache is invalid.
+	lastMeta *pb.LogMeta
+	// lastMetaGen is increased on each invalidation to prevent a stale meta
+	// loaded concurrently from being cached.
+	lastMetaGen uint64
+
+	// appendedBytes is the total size of the logs appended since the server
+	// started.
+	appendedBytes int64 // atomic
+
+	// retainsLogs is set if the LogStore may retain the appended logs, which
+	// are then copied before they are appended.
+	retainsLogs bool
 }
 
 func newLogStoreProxy(server *Server, logStore LogStore) *logStoreProxy {
-	return &logStoreProxy{server: server, LogStore: logStore}
+	return &logStoreProxy{server: server, LogStore: logStore, retainsLogs: logStoreRetainsLogs(logStore)}
 }
 
 func (l *logStoreProxy) Restore(snapshotMeta SnapshotMeta) error {
+	conflicting, err := l.conflictsWith(snapshotMeta)
+	if err != nil {
+		return err
+	}
+	if conflicting {
+		// The logs cannot follow the snapshot. Discard all of them.
+		if err := l.LogStore.TrimSuffix(0); err != nil {
+			return err
+		}
+		l.appendTimesMu.Lock()
+		l.appendTimes = nil
+		l.appendTimesMu.Unlock()
+	}
+	l.setSnapshotMeta(snapshotMeta)
 	// Evict all logs with the logs that exist in the snapshot.
 	if err := l.TrimPrefix(snapshotMeta.Index() + 1); err != nil {
 		return err
 	}
+	l.server.setLastLogIndex(Must2(l.LastIndex()))
+	return nil
+}
+
+// conflictsWith reports whether the logs in the underlying LogStore conflict
+// with the snapshot. The logs following the snapshot are retained only if the
+// log at the snapshot's index has the snapshot's term, or if the logs start
+// right after the snapshot's index.
+func (l *logStoreProxy) conflictsWith(snapshotMeta SnapshotMeta) (bool, error) {
+	lastIndex, err := l.LogStore.LastIndex()
+	if err != nil {
+		return false, err
+	}
+	if lastIndex == 0 {
+		return false, nil
+	}
+	log, err := l.LogStore.Entry(snapshotMeta.Index())
+	if err != nil {
+		return false, err
+	}
+	if log != nil {
+		return log.Meta.Term != snapshotMeta.Term(), nil
+	}
+	firstIndex, err := l.LogStore.FirstIndex()
+	if err != nil {
+		return false, err
+	}
+	return firstIndex != snapshotMeta.Index()+1, nil
+}
+
+// snapshot returns the meta of the latest snapshot, or nil if there's none.
+func (l *logStoreProxy) snapshot() SnapshotMeta {
+	l.snapshotMetaMu.RLock()
+	defer l.snapshotMetaMu.RUnlock()
+	return l.snapshotMeta
+}
+
+func (l *logStoreProxy) setSnapshotMeta(snapshotMeta SnapshotMeta) {
+	l.snapshotMetaMu.Lock()
+	defer l.snapshotMetaMu.Unlock()
 	l.snapshotMeta = snapshotMeta
+}
+
+// SetSnapshot is used after taking a snapshot to mark the logs that exist in
+// the snapshot as compactable. The logs are not evicted until TrimPrefix() is
+// called.
+func (l *logStoreProxy) SetSnapshot(snapshotMeta SnapshotMeta) error {
+	l.setSnapshotMeta(snapshotMeta)
+	l.invalidateLastMeta()
 	l.server.setLastLogIndex(Must2(l.LastIndex()))
 	return nil
 }
 
-func (l *logStoreProxy) TrimPrefix(index uint64) error {
-	if l.snapshotMeta != nil {
-		// Ensure the index is not in the snapshot's range.
-		// If so, we cannot do anything.
-		if index <= l.snapshotMeta.Index() {
-			l.server.logger.Panicw("called TrimPrefix() with an index exists in the snapshot", logFields(l.server)...)
+// compactionIndex returns the index of the first log to retain under the
+// LogCompactionPolicy when compacting the logs up to snapshotIndex.
+func (l *logStoreProxy) compactionIndex(snapshotIndex uint64) (uint64, error) {
+	policy := l.server.opts().logCompactionPolicy
+	index := snapshotIndex + 1
+	if n := policy.RetainEntries; n > 0 {
+		if n >= index {
+			return 1, nil
 		}
+		index -= n
 	}
-	return l.LogStore.TrimPrefix(index)
+	if d := policy.RetainDuration; d > 0 {
+		deadline := time.Now().Add(-d)
+		l.appendTimesMu.Lock()
+		for _, t := range l.appendTimes {
+			if t.at.After(deadline) {
+				if t.index < index {
+					index = t.index
+				}
+				break
+			}
+		}
+		l.appendTimesMu.Unlock()
+	}
+	if policy.RetainBytes > 0 {
+		var size int64
+		for i := snapshotIndex; i > 0 && i < index && size < policy.RetainBytes; i-- {
+			log, err := l.LogStore.Entry(i)
+			if err != nil {
+				return 0, err
+			}
+			if log == nil {
+				break
+			}
+			size += int64(proto.Size(log))
+			index = i
+		}
+	}
+	if index < 1 {
+		index = 1
+	}
+	return index, nil
+}
+
+// trimAppendTimes evicts the append times of the logs before index.
+func (l *logStoreProxy) trimAppendTimes(index uint64) {
+	l.appendTimesMu.Lock()
+	defer l.appendTimesMu.Unlock()
+	i := sort.Search(len(l.appendTimes), func(i int) bool { return l.appendTimes[i].index > index })
+	if i > 0 {
+		// The append at i-1 may contain logs after index.
+		l.appendTimes = append([]logAppendTime(nil), l.appendTimes[i-1:]...)
+	}
+}
+
+// appendStalled returns how long the append in progress has been running, or
+// zero if there's none.
+func (l *logStoreProxy) appendStalled() time.Duration {
+	start := atomic.LoadInt64(&l.appendStart)
+	if start == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, start))
+}
+
+// AppendLogs is used to append logs with their checksums.
+func (l *logStoreProxy) AppendLogs(logs []*pb.Log) error {
+	for _, log := range logs {
+		log.Checksum = log.ComputeChecksum()
+	}
+	appended := logs
+	if l.retainsLogs {
+		// The logs are reused by the server once they are appended.
+		appended = make([]*pb.Log, len(logs))
+		for i, log := range logs {
+			appended[i] = log.Copy()
+		}
+	}
+	start := time.Now()
+	atomic.StoreInt64(&l.appendStart, start.UnixNano())
+	err := l.LogStore.AppendLogs(appended)
+	atomic.StoreInt64(&l.appendStart, 0)
+	d := time.Since(start)
+	l.server.recordMetric(MetricLogAppendLatency, d)
+	l.server.warnSlowOp("log append", l.server.opts().slowOpThresholds.LogAppend, d, "logs", len(logs))
+	l.server.recordMetric(MetricLogAppendBatchSize, len(logs))
+	if err != nil {
+		l.invalidateLastMeta()
+		return err
+	}
+	if len(logs) > 0 {
+		l.lastMetaMu.Lock()
+		if last := logs[len(logs)-1].Meta; l.lastMeta != nil && last.Index >= l.lastMeta.Index {
+			l.lastMeta = last.Copy()
+		} else {
+			l.lastMeta = nil
+			l.lastMetaGen++
+		}
+		l.lastMetaMu.Unlock()
+	}
+	var size int
+	for _, log := range logs {
+		size += proto.Size(log)
+	}
+	atomic.AddInt64(&l.appendedBytes, int64(size))
+	if len(logs) > 0 && l.server.opts().logCompactionPolicy.RetainDuration > 0 {
+		l.appendTimesMu.Lock()
+		index := logs[0].Meta.Index
+		// Appended logs may overwrite the logs after index.
+		i := sort.Search(len(l.appendTimes), func(i int) bool { return l.appendTimes[i].index >= index })
+		l.appendTimes = append(l.appendTimes[:i], logAppendTime{index: index, at: time.Now()})
+		l.appendTimesMu.Unlock()
+	}
+	return nil
+}
+
+// AppendedBytes returns the total size of the logs appended since the server
+// started.
+func (l *logStoreProxy) AppendedBytes() int64 {
+	return atomic.LoadInt64(&l.appendedBytes)
+}
+
+// verify is used to verify the checksum of the log, if any. A non-nil log is
+// returned if the log is good. Otherwise, the corruption is handled by the
+// LogCorruptionPolicy.
+func (l *logStoreProxy) verify(log *pb.Log) (*pb.Log, error) {
+	if log == nil || log.Checksum == 0 || log.Checksum == log.ComputeChecksum() {
+		return log, nil
+	}
+	index := log.Meta.Index
+	switch l.server.opts().logCorruptionPolicy {
+	case LogCorruptionTruncate:
+		if l.withinCompacted(index - 1) {
+			l.server.logger.Panicw("corrupted log cannot be truncated", logFields(l.server, "index", index)...)
+		}
+		l.server.logger.Warnw("corrupted log detected, truncating logs", logFields(l.server, "index", index)...)
+		if err := l.LogStore.TrimSuffix(index - 1); err != nil {
+			return nil, err
+		}
+		l.invalidateLastMeta()
+		l.server.setLastLogIndex(Must2(l.LastIndex()))
+		return nil, nil
+	case LogCorruptionReport:
+		l.server.logger.Errorw("corrupted log detected", logFields(l.server, "index", index)...)
+		return nil, errors.Wrapf(ErrCorruptedLog, "checksum mismatch at index %d", index)
+	}
+	l.server.logger.Panicw("corrupted log detected", logFields(l.server, "index", index)...)
+	return nil, nil
+}
+
+func (l *logStoreProxy) TrimPrefix(index uint64) error {
+	// Ensure the logs to evict exist in the snapshot.
+	// If not, we cannot do anything.
+	if snapshotMeta := l.snapshot(); snapshotMeta == nil || index > snapshotMeta.Index()+1 {
+		l.server.logger.Panicw("called TrimPrefix() with an index beyond the snapshot", logFields(l.server)...)
+	}
+	defer l.invalidateLastMeta()
+	if err := l.LogStore.TrimPrefix(index); err != nil {
+		return err
+	}
+	l.trimAppendTimes(index)
+	return nil
 }
 
 func (l *logStoreProxy) TrimSuffix(index uint64) error {
-	if l.snapshotMeta != nil {
+	if snapshotMeta := l.snapshot(); snapshotMeta != nil {
 		// Ensure the index is not in the snapshot's range.
 		// If so, we cannot do anything.
-		if index < l.snapshotMeta.Index() {
+		if index < snapshotMeta.Index() {
 			l.server.logger.Panicw("called TrimSuffix() with an index exists in the snapshot", logFields(l.server)...)
 		}
 	}
+	defer l.invalidateLastMeta()
 	return l.LogStore.TrimSuffix(index)
 }
 
@@ -112,21 +596,130 @@ func (l *logStoreProxy) LastIndex() (uint64, error) {
 	// The last index in the underlying being zero indicates that the underlying
 	// LogStore is empty. Use the last index in the snapshot (if any) or return
 	// zero.
-	if l.snapshotMeta != nil {
-		return l.snapshotMeta.Index(), nil
+	if snapshotMeta := l.snapshot(); snapshotMeta != nil {
+		return snapshotMeta.Index(), nil
 	}
 	return 0, nil
 }
 
 func (l *logStoreProxy) Entry(index uint64) (*pb.Log, error) {
-	if l.snapshotMeta != nil {
-		// Ensure the index is not in the snapshot's range.
-		// If so, we cannot do anything.
-		if index < l.snapshotMeta.Index() {
-			l.server.logger.Panicw("called Entry() with an index compacted by the snapshot", logFields(l.server)...)
+	// Ensure the index is not in the snapshot's range.
+	// If so, we cannot do anything.
+	if l.withinCompacted(index) {
+		l.server.logger.Panicw("called Entry() with an index compacted by the snapshot", logFields(l.server)...)
+	}
+	start := time.Now()
+	log, err := l.LogStore.Entry(index)
+	l.server.recordMetric(MetricLogReadLatency, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	return l.verify(log)
+}
+
+func (l *logStoreProxy) LastEntry(t pb.LogType) (*pb.Log, error) {
+	start := time.Now()
+	log, err := l.LogStore.LastEntry(t)
+	l.server.recordMetric(MetricLogReadLatency, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	return l.verify(log)
+}
+
+// Entries is used to get the logs in the range of firstIndex to lastIndex.
+// See LogStoreRangeReader for details.
+func (l *logStoreProxy) Entries(firstIndex, lastIndex uint64) ([]*pb.Log, error) {
+	// Ensure the index is not in the snapshot's range.
+	// If so, we cannot do anything.
+	if l.withinCompacted(firstIndex) {
+		l.server.logger.Panicw("called Entries() with an index compacted by the snapshot", logFields(l.server)...)
+	}
+	start := time.Now()
+	logs, err := logStoreEntries(l.LogStore, firstIndex, lastIndex)
+	l.server.recordMetric(MetricLogReadLatency, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	for i, log := range logs {
+		if log, err := l.verify(log); err != nil {
+			return nil, err
+		} else if log == nil {
+			// The logs have been truncated at the corrupted log.
+			return logs[:i], nil
 		}
 	}
-	return l.LogStore.Entry(index)
+	return logs, nil
+}
+
+// Iterator returns a LogIterator that verifies the logs it returns.
+func (l *logStoreProxy) Iterator() LogIterator {
+	return &logStoreProxyIterator{LogIterator: NewLogIterator(l.LogStore), proxy: l}
+}
+
+type logStoreProxyIterator struct {
+	LogIterator
+	proxy *logStoreProxy
+}
+
+func (i *logStoreProxyIterator) Seek(index uint64) {
+	if i.proxy.withinCompacted(index) {
+		i.proxy.server.logger.Panicw("called Seek() with an index compacted by the snapshot", logFields(i.proxy.server)...)
+	}
+	i.LogIterator.Seek(index)
+}
+
+func (i *logStoreProxyIterator) Next() (*pb.Log, error) {
+	start := time.Now()
+	log, err := i.LogIterator.Next()
+	i.proxy.server.recordMetric(MetricLogReadLatency, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	// A nil log is returned for a truncated corrupted log, which ends the
+	// iteration as there are no more logs after it.
+	return i.proxy.verify(log)
+}
+
+// LastTermIndex is used to get the term and the index of the last log, or
+// those in the snapshot if there are no logs after the snapshot. The result is
+// cached until the logs are altered.
+func (l *logStoreProxy) LastTermIndex() (term uint64, index uint64, err error) {
+	l.lastMetaMu.Lock()
+	if m := l.lastMeta; m != nil {
+		l.lastMetaMu.Unlock()
+		return m.Term, m.Index, nil
+	}
+	gen := l.lastMetaGen
+	l.lastMetaMu.Unlock()
+
+	log, err := l.LastEntry(0)
+	if err != nil {
+		return 0, 0, err
+	}
+	var m *pb.LogMeta
+	switch snapshotMeta := l.snapshot(); {
+	case log != nil:
+		m = log.Meta.Copy()
+	case snapshotMeta != nil:
+		m = &pb.LogMeta{Index: snapshotMeta.Index(), Term: snapshotMeta.Term()}
+	default:
+		m = &pb.LogMeta{}
+	}
+
+	l.lastMetaMu.Lock()
+	if l.lastMetaGen == gen {
+		l.lastMeta = m
+	}
+	l.lastMetaMu.Unlock()
+	return m.Term, m.Index, nil
+}
+
+func (l *logStoreProxy) invalidateLastMeta() {
+	l.lastMetaMu.Lock()
+	defer l.lastMetaMu.Unlock()
+	l.lastMeta = nil
+	l.lastMetaGen++
 }
 
 // Meta is used to get the log meta at the index. A valid index should be in
@@ -134,33 +727,44 @@ func (l *logStoreProxy) Entry(index uint64) (*pb.Log, error) {
 // unpacked log index to the last unpacked log index, if any, or the last log
 // index in the snapshot.
 func (l *logStoreProxy) Meta(index uint64) (*pb.LogMeta, error) {
-	if l.snapshotMeta != nil {
-		if index == l.snapshotMeta.Index() {
-			return &pb.LogMeta{Index: l.snapshotMeta.Index(), Term: l.snapshotMeta.Term()}, nil
-		} else if index < l.snapshotMeta.Index() {
-			l.server.logger.Panicw("called Meta() with an index compacted by the snapshot", logFields(l.server)...)
+	if snapshotMeta := l.snapshot(); snapshotMeta != nil {
+		if index == snapshotMeta.Index() {
+			return &pb.LogMeta{Index: snapshotMeta.Index(), Term: snapshotMeta.Term()}, nil
 		}
 	}
+	if l.withinCompacted(index) {
+		l.server.logger.Panicw("called Meta() with an index compacted by the snapshot", logFields(l.server)...)
+	}
+	start := time.Now()
 	e, err := l.LogStore.Entry(index)
+	l.server.recordMetric(MetricLogReadLatency, time.Since(start))
 	if err != nil {
 		return nil, err
 	}
+	if e, err = l.verify(e); err != nil {
+		return nil, err
+	}
 	if e == nil {
 		return nil, nil
 	}
 	return e.Meta, nil
 }
 
+// withinCompacted reports whether the log at the index has been evicted after
+// being included in the snapshot.
 func (l *logStoreProxy) withinCompacted(index uint64) bool {
-	if l.snapshotMeta == nil {
+	if snapshotMeta := l.snapshot(); snapshotMeta == nil || index >= snapshotMeta.Index() {
 		return false
 	}
-	return index < l.snapshotMeta.Index()
+	// Logs covered by the snapshot may be retained by the LogCompactionPolicy.
+	firstIndex := l.server.firstLogIndex()
+	return firstIndex == 0 || index < firstIndex
 }
 
 func (l *logStoreProxy) withinSnapshot(index uint64) bool {
-	if l.snapshotMeta == nil {
+	snapshotMeta := l.snapshot()
+	if snapshotMeta == nil {
 		return false
 	}
-	return index <= l.snapshotMeta.Index()
+	return index <= snapshotMeta.Index()
 }
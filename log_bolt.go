@@ -16,11 +16,11 @@ const (
 
 // BoltLogStore is a LogStore that uses bbolt as a backend.
 type BoltLogStore struct {
-	db *bbolt.DB
+	db *boltDB
 }
 
 func NewBoltLogStore(db *bbolt.DB) *BoltLogStore {
-	return &BoltLogStore{db: db}
+	return &BoltLogStore{db: &boltDB{db: db}}
 }
 
 func (s *BoltLogStore) encodeLog(log *pb.Log) ([]byte, error) {
@@ -47,6 +47,9 @@ func (s *BoltLogStore) putLogIndex(tx *bbolt.Tx, t pb.LogType, index uint64) err
 		bucket, err = tx.CreateBucketIfNotExists([]byte(boltLogStoreBucketCmdIndexes))
 	case pb.LogType_CONFIGURATION:
 		bucket, err = tx.CreateBucketIfNotExists([]byte(boltLogStoreBucketConfIndexes))
+	default:
+		// Other types are not indexed.
+		return nil
 	}
 	if err != nil {
 		return err
@@ -61,7 +64,9 @@ func (s *BoltLogStore) deleteLogIndex(tx *bbolt.Tx, t pb.LogType, index uint64)
 	case pb.LogType_COMMAND:
 		bucket, err = tx.CreateBucketIfNotExists([]byte(boltLogStoreBucketCmdIndexes))
 	case pb.LogType_CONFIGURATION:
-		bucket, err = tx.CreateBucketIfNotExists([]byte(boltLogStoreBucketCmdIndexes))
+		bucket, err = tx.CreateBucketIfNotExists([]byte(boltLogStoreBucketConfIndexes))
+	default:
+		return nil
 	}
 	if err != nil {
 		return err
@@ -91,6 +96,12 @@ func (s *BoltLogStore) AppendLogs(logs []*pb.Log) error {
 	})
 }
 
+// RetainsLogs implements LogStoreRetention. The logs are encoded as they are
+// appended.
+func (s *BoltLogStore) RetainsLogs() bool {
+	return false
+}
+
 func (s *BoltLogStore) TrimPrefix(index uint64) error {
 	return s.db.Update(func(t *bbolt.Tx) error {
 		bucket := t.Bucket([]byte(boltLogStoreBucketLogs))
@@ -195,6 +206,25 @@ func (s *BoltLogStore) Entry(index uint64) (*pb.Log, error) {
 	})
 }
 
+func (s *BoltLogStore) Entries(firstIndex, lastIndex uint64) ([]*pb.Log, error) {
+	var logs []*pb.Log
+	return logs, s.db.View(func(t *bbolt.Tx) error {
+		bucket := t.Bucket([]byte(boltLogStoreBucketLogs))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for key, value := c.Seek(EncodeUint64(firstIndex)); key != nil && DecodeUint64(key) <= lastIndex; key, value = c.Next() {
+			log, err := s.decodeLog(value)
+			if err != nil {
+				return err
+			}
+			logs = append(logs, log)
+		}
+		return nil
+	})
+}
+
 func (s *BoltLogStore) LastEntry(t pb.LogType) (*pb.Log, error) {
 	var log *pb.Log
 	return log, s.db.View(func(tx *bbolt.Tx) error {
@@ -0,0 +1,142 @@
+package raft
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/sumimakito/raft/pb"
+)
+
+// CachedLogStore is a LogStore that keeps the most recently used logs of the
+// underlying LogStore in memory to avoid repeated reads from the storage on
+// the hot path, such as applying committed logs and replicating logs.
+type CachedLogStore struct {
+	LogStore
+
+	mu       sync.Mutex // protects entries and lru
+	capacity int
+	entries  map[uint64]*list.Element
+	lru      *list.List
+}
+
+// NewCachedLogStore wraps the LogStore with a cache holding at most capacity
+// logs.
+func NewCachedLogStore(store LogStore, capacity int) *CachedLogStore {
+	return &CachedLogStore{
+		LogStore: store,
+		capacity: capacity,
+		entries:  map[uint64]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+func (s *CachedLogStore) putLocked(log *pb.Log) {
+	if s.capacity <= 0 {
+		return
+	}
+	if e, ok := s.entries[log.Meta.Index]; ok {
+		e.Value = log
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.entries[log.Meta.Index] = s.lru.PushFront(log)
+	for s.lru.Len() > s.capacity {
+		s.removeLocked(s.lru.Back())
+	}
+}
+
+func (s *CachedLogStore) removeLocked(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.entries, e.Value.(*pb.Log).Meta.Index)
+}
+
+// removeIfLocked evicts all cached logs that satisfy fn.
+func (s *CachedLogStore) removeIfLocked(fn func(index uint64) bool) {
+	for index, e := range s.entries {
+		if fn(index) {
+			s.removeLocked(e)
+		}
+	}
+}
+
+func (s *CachedLogStore) AppendLogs(logs []*pb.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.LogStore.AppendLogs(logs); err != nil {
+		// The logs may be partially appended.
+		for _, log := range logs {
+			if e, ok := s.entries[log.Meta.Index]; ok {
+				s.removeLocked(e)
+			}
+		}
+		return err
+	}
+	for _, log := range logs {
+		s.putLocked(log.Copy())
+	}
+	return nil
+}
+
+// RetainsLogs implements LogStoreRetention. The logs are copied into the cache,
+// so it reports whether the underlying LogStore retains them.
+func (s *CachedLogStore) RetainsLogs() bool {
+	return logStoreRetainsLogs(s.LogStore)
+}
+
+func (s *CachedLogStore) TrimPrefix(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeIfLocked(func(i uint64) bool { return i < index })
+	return s.LogStore.TrimPrefix(index)
+}
+
+func (s *CachedLogStore) TrimSuffix(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeIfLocked(func(i uint64) bool { return i > index })
+	return s.LogStore.TrimSuffix(index)
+}
+
+func (s *CachedLogStore) Entry(index uint64) (*pb.Log, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[index]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*pb.Log), nil
+	}
+	log, err := s.LogStore.Entry(index)
+	if err != nil || log == nil {
+		return log, err
+	}
+	s.putLocked(log)
+	return log, nil
+}
+
+func (s *CachedLogStore) Entries(firstIndex, lastIndex uint64) ([]*pb.Log, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if firstIndex <= lastIndex && lastIndex-firstIndex < uint64(s.lru.Len()) {
+		logs := make([]*pb.Log, 0, lastIndex-firstIndex+1)
+		for i := firstIndex; i <= lastIndex; i++ {
+			e, ok := s.entries[i]
+			if !ok {
+				break
+			}
+			logs = append(logs, e.Value.(*pb.Log))
+		}
+		if uint64(len(logs)) == lastIndex-firstIndex+1 {
+			for i := firstIndex; i <= lastIndex; i++ {
+				s.lru.MoveToFront(s.entries[i])
+			}
+			return logs, nil
+		}
+	}
+	logs, err := logStoreEntries(s.LogStore, firstIndex, lastIndex)
+	if err != nil {
+		return nil, err
+	}
+	for _, log := range logs {
+		s.putLocked(log)
+	}
+	return logs, nil
+}
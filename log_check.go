@@ -0,0 +1,150 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+)
+
+// LogCheckPolicy decides what to do when the logs are found inconsistent on
+// startup, e.g., due to torn writes or missing logs.
+type LogCheckPolicy uint8
+
+const (
+	// LogCheckFail makes NewServer fail with a *LogCheckError.
+	LogCheckFail LogCheckPolicy = 1 + iota
+	// LogCheckTruncate evicts the first inconsistent log and all logs after it
+	// so that the logs end with the last consistent log.
+	LogCheckTruncate
+	// LogCheckDisabled skips the check.
+	LogCheckDisabled
+)
+
+func (p LogCheckPolicy) String() string {
+	switch p {
+	case LogCheckFail:
+		return "Fail"
+	case LogCheckTruncate:
+		return "Truncate"
+	case LogCheckDisabled:
+		return "Disabled"
+	}
+	return "Unknown"
+}
+
+// LogCheckError describes the first inconsistency found in the logs.
+type LogCheckError struct {
+	FirstIndex uint64 `json:"first_index"`
+	LastIndex  uint64 `json:"last_index"`
+	// Index is the index of the first inconsistent log.
+	Index  uint64 `json:"index"`
+	Reason string `json:"reason"`
+}
+
+func (e *LogCheckError) Error() string {
+	return fmt.Sprintf("inconsistent log at index %d (logs %d to %d): %s", e.Index, e.FirstIndex, e.LastIndex, e.Reason)
+}
+
+func (e *LogCheckError) Unwrap() error {
+	return ErrCorruptedLog
+}
+
+// LogCheckAllLogs is the window of the log check on startup that makes it scan
+// all logs in the LogStore.
+const LogCheckAllLogs = 0
+
+// Check is used to scan the last logs in the underlying LogStore within the
+// window set by LogCheckWindowOption for missing logs, unreadable logs,
+// checksum mismatches, and decreasing terms. The inconsistency found, if any,
+// is handled by the LogCheckPolicy.
+func (l *logStoreProxy) Check() error {
+	policy := l.server.opts().logCheckPolicy
+	if policy == LogCheckDisabled {
+		return nil
+	}
+	checkErr, err := l.check()
+	if err != nil || checkErr == nil {
+		return err
+	}
+	if policy != LogCheckTruncate {
+		return checkErr
+	}
+	l.server.logger.Warnw("inconsistent logs detected, truncating logs",
+		logFields(l.server, "index", checkErr.Index, "reason", checkErr.Reason)...)
+	if err := l.LogStore.TrimSuffix(checkErr.Index - 1); err != nil {
+		return err
+	}
+	l.invalidateLastMeta()
+	l.server.audit(context.Background(), AuditLogsTruncated, checkErr)
+	return nil
+}
+
+func (l *logStoreProxy) check() (*LogCheckError, error) {
+	return CheckLogsTail(l.LogStore, l.server.opts().logCheckWindow)
+}
+
+// CheckLogs scans all logs in the LogStore for missing logs, unreadable logs,
+// checksum mismatches, and decreasing terms, and returns the first
+// inconsistency found, or nil if the logs are consistent. The returned error
+// is reserved for the errors reading the range of the logs.
+func CheckLogs(store LogStore) (*LogCheckError, error) {
+	return CheckLogsTail(store, LogCheckAllLogs)
+}
+
+// CheckLogsTail is like CheckLogs but only scans the last n logs, which are
+// the ones torn writes leave inconsistent. The term of the log before them, if
+// readable, is compared with the term of the first log scanned. A zero n, i.e.,
+// LogCheckAllLogs, scans all logs.
+func CheckLogsTail(store LogStore, n uint64) (*LogCheckError, error) {
+	firstIndex, err := store.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+	lastIndex, err := store.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	if lastIndex == 0 {
+		return nil, nil
+	}
+	checkErr := func(index uint64, format string, args ...interface{}) (*LogCheckError, error) {
+		return &LogCheckError{
+			FirstIndex: firstIndex,
+			LastIndex:  lastIndex,
+			Index:      index,
+			Reason:     fmt.Sprintf(format, args...),
+		}, nil
+	}
+
+	startIndex := firstIndex
+	var lastTerm uint64
+	if n != LogCheckAllLogs && lastIndex-firstIndex >= n {
+		startIndex = lastIndex - n + 1
+		if log, err := store.Entry(startIndex - 1); err == nil && log != nil {
+			lastTerm = log.Meta.Term
+		}
+	}
+
+	it := NewLogIterator(store)
+	defer it.Close()
+	it.Seek(startIndex)
+	for index := startIndex; index <= lastIndex; index++ {
+		log, err := it.Next()
+		if err != nil {
+			return checkErr(index, "unreadable log: %v", err)
+		}
+		if log == nil || log.Meta.Index > index {
+			return checkErr(index, "missing log")
+		}
+		if log.Meta.Index < index {
+			return checkErr(index, "unordered log with index %d", log.Meta.Index)
+		}
+		if log.Checksum != 0 && log.Checksum != log.ComputeChecksum() {
+			return checkErr(index, "checksum mismatch")
+		}
+		if log.Meta.Term < lastTerm {
+			return checkErr(index, "term %d is less than the term %d of the previous log", log.Meta.Term, lastTerm)
+		}
+		lastTerm = log.Meta.Term
+	}
+	return nil, nil
+}
@@ -0,0 +1,207 @@
+package raft
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/sumimakito/raft/pb"
+)
+
+// LogCipher encrypts and decrypts the data of the logs. The additional data
+// is authenticated but not encrypted, and must be the same for decrypting.
+type LogCipher interface {
+	Encrypt(plaintext, additionalData []byte) ([]byte, error)
+	Decrypt(ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// KeyProvider provides the keys used by the built-in LogCipher. Keys are
+// identified by IDs so that they can be rotated without re-encrypting the
+// existing logs.
+type KeyProvider interface {
+	// CurrentKey returns the key used to encrypt new logs.
+	CurrentKey() (id uint32, key []byte, err error)
+
+	// Key returns the key with the ID.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider that provides a single key with ID 0.
+type StaticKeyProvider []byte
+
+func (p StaticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return 0, p, nil
+}
+
+func (p StaticKeyProvider) Key(id uint32) ([]byte, error) {
+	if id != 0 {
+		return nil, errors.Errorf("unknown key ID %d", id)
+	}
+	return p, nil
+}
+
+// aesGCMLogCipher is a LogCipher using AES-GCM. The ciphertext is laid out as
+// [key ID (4 bytes)][nonce][sealed data].
+type aesGCMLogCipher struct {
+	keys KeyProvider
+}
+
+// NewAESGCMLogCipher returns a LogCipher using AES-GCM with the keys provided
+// by the KeyProvider. The keys must be 16, 24, or 32 bytes long to select
+// AES-128, AES-192, or AES-256.
+func NewAESGCMLogCipher(keys KeyProvider) LogCipher {
+	return &aesGCMLogCipher{keys: keys}
+}
+
+func (c *aesGCMLogCipher) aead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *aesGCMLogCipher) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	id, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(out[:4], id)
+	if _, err := io.ReadFull(rand.Reader, out[4:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[4:], plaintext, additionalData), nil
+}
+
+func (c *aesGCMLogCipher) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < 4 {
+		return nil, errors.New("ciphertext too short")
+	}
+	key, err := c.keys.Key(binary.BigEndian.Uint32(ciphertext[:4]))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext = ciphertext[4:]
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+}
+
+// EncryptedLogStore is a LogStore that encrypts the data of the logs with a
+// LogCipher before they reach the underlying LogStore and decrypts them on
+// read. The meta and the type of the logs are kept in plaintext and are
+// authenticated as the additional data. The extensions are kept in plaintext
+// and are covered by the checksums of the logs instead.
+type EncryptedLogStore struct {
+	LogStore
+	cipher LogCipher
+}
+
+func NewEncryptedLogStore(store LogStore, cipher LogCipher) *EncryptedLogStore {
+	return &EncryptedLogStore{LogStore: store, cipher: cipher}
+}
+
+func (s *EncryptedLogStore) additionalData(log *pb.Log) []byte {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint64(b[0:8], log.Meta.Index)
+	binary.BigEndian.PutUint64(b[8:16], log.Meta.Term)
+	binary.BigEndian.PutUint64(b[16:24], uint64(log.Body.Type))
+	return b
+}
+
+func (s *EncryptedLogStore) encrypt(log *pb.Log) (*pb.Log, error) {
+	data, err := s.cipher.Encrypt(log.Body.Data, s.additionalData(log))
+	if err != nil {
+		return nil, err
+	}
+	// Only the data is replaced, so that the session and the extensions are
+	// kept along with it.
+	body := log.Body.Copy()
+	body.Data = data
+	encrypted := &pb.Log{
+		Meta:     log.Meta.Copy(),
+		Body:     body,
+		Checksum: log.Checksum,
+	}
+	return encrypted, nil
+}
+
+func (s *EncryptedLogStore) decrypt(log *pb.Log) (*pb.Log, error) {
+	if log == nil {
+		return nil, nil
+	}
+	data, err := s.cipher.Decrypt(log.Body.Data, s.additionalData(log))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt the log at index %d", log.Meta.Index)
+	}
+	body := log.Body.Copy()
+	body.Data = data
+	return &pb.Log{
+		Meta:     log.Meta.Copy(),
+		Body:     body,
+		Checksum: log.Checksum,
+	}, nil
+}
+
+func (s *EncryptedLogStore) AppendLogs(logs []*pb.Log) error {
+	encrypted := make([]*pb.Log, 0, len(logs))
+	for _, log := range logs {
+		e, err := s.encrypt(log)
+		if err != nil {
+			return err
+		}
+		encrypted = append(encrypted, e)
+	}
+	return s.LogStore.AppendLogs(encrypted)
+}
+
+// RetainsLogs implements LogStoreRetention. The encrypted copies of the logs
+// are appended to the underlying LogStore.
+func (s *EncryptedLogStore) RetainsLogs() bool {
+	return false
+}
+
+func (s *EncryptedLogStore) Entry(index uint64) (*pb.Log, error) {
+	log, err := s.LogStore.Entry(index)
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(log)
+}
+
+func (s *EncryptedLogStore) Entries(firstIndex, lastIndex uint64) ([]*pb.Log, error) {
+	logs, err := logStoreEntries(s.LogStore, firstIndex, lastIndex)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]*pb.Log, 0, len(logs))
+	for _, log := range logs {
+		d, err := s.decrypt(log)
+		if err != nil {
+			return nil, err
+		}
+		decrypted = append(decrypted, d)
+	}
+	return decrypted, nil
+}
+
+func (s *EncryptedLogStore) LastEntry(t pb.LogType) (*pb.Log, error) {
+	log, err := s.LogStore.LastEntry(t)
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(log)
+}
@@ -0,0 +1,190 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/sumimakito/raft/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// A log export stream is laid out as:
+//
+//	[magic (4 bytes)][version (2 bytes)]
+//	[length (4 bytes)][CRC-32C of the log (4 bytes)][log] ...
+//	[zero length (4 bytes)][CRC-32C of the count (4 bytes)][count (8 bytes)]
+//
+// The trailer carries the number of exported logs so that a truncated stream
+// can be detected.
+var logExportMagic = []byte("RLOG")
+
+const logExportVersion = 1
+
+// logExportImportBatchSize is the number of logs appended at once on import.
+const logExportImportBatchSize = 256
+
+var logExportCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ExportLogs writes the logs with indexes in the range of from to to, both
+// inclusive, to w as a versioned and checksummed stream, and returns the
+// number of exported logs. A zero to means the last log. The stream can be
+// imported with ImportLogs.
+func ExportLogs(store LogStore, w io.Writer, from, to uint64) (int, error) {
+	return exportLogs(NewLogIterator(store), w, from, to, store.LastIndex)
+}
+
+func exportLogs(it LogIterator, w io.Writer, from, to uint64, lastIndexFn func() (uint64, error)) (int, error) {
+	defer it.Close()
+	if from == 0 {
+		from = 1
+	}
+	if to == 0 {
+		lastIndex, err := lastIndexFn()
+		if err != nil {
+			return 0, err
+		}
+		to = lastIndex
+	}
+
+	bw := bufio.NewWriter(w)
+	header := make([]byte, len(logExportMagic)+2)
+	copy(header, logExportMagic)
+	binary.BigEndian.PutUint16(header[len(logExportMagic):], logExportVersion)
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+
+	var count uint64
+	recordHeader := make([]byte, 8)
+	it.Seek(from)
+	for {
+		log, err := it.Next()
+		if err != nil {
+			return 0, err
+		}
+		if log == nil || log.Meta.Index > to {
+			break
+		}
+		b, err := proto.Marshal(log)
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint32(recordHeader[0:4], uint32(len(b)))
+		binary.BigEndian.PutUint32(recordHeader[4:8], crc32.Checksum(b, logExportCRCTable))
+		if _, err := bw.Write(recordHeader); err != nil {
+			return 0, err
+		}
+		if _, err := bw.Write(b); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	trailer := make([]byte, 16)
+	binary.BigEndian.PutUint64(trailer[8:16], count)
+	binary.BigEndian.PutUint32(trailer[4:8], crc32.Checksum(trailer[8:16], logExportCRCTable))
+	if _, err := bw.Write(trailer); err != nil {
+		return 0, err
+	}
+	return int(count), bw.Flush()
+}
+
+// ImportLogs reads the logs exported by ExportLogs from r and appends them to
+// the LogStore, and returns the number of imported logs. The first imported
+// log must immediately follow the last log in the LogStore unless the
+// LogStore is empty, so that incremental exports can be imported in order.
+// The stream is fully verified before any log is appended.
+func ImportLogs(store LogStore, r io.Reader) (int, error) {
+	logs, err := readLogExport(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(logs) == 0 {
+		return 0, nil
+	}
+
+	lastIndex, err := store.LastIndex()
+	if err != nil {
+		return 0, err
+	}
+	if lastIndex > 0 && logs[0].Meta.Index != lastIndex+1 {
+		return 0, errors.Errorf("imported logs start at index %d but the last log is at index %d",
+			logs[0].Meta.Index, lastIndex)
+	}
+	for i := 0; i < len(logs); i += logExportImportBatchSize {
+		j := i + logExportImportBatchSize
+		if j > len(logs) {
+			j = len(logs)
+		}
+		if err := store.AppendLogs(logs[i:j]); err != nil {
+			return i, err
+		}
+	}
+	return len(logs), nil
+}
+
+func readLogExport(r io.Reader) ([]*pb.Log, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(logExportMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errors.Wrap(err, "failed to read the header")
+	}
+	if !bytes.Equal(header[:len(logExportMagic)], logExportMagic) {
+		return nil, errors.New("not a log export")
+	}
+	if version := binary.BigEndian.Uint16(header[len(logExportMagic):]); version != logExportVersion {
+		return nil, errors.Errorf("unsupported log export version %d", version)
+	}
+
+	var logs []*pb.Log
+	recordHeader := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, recordHeader); err != nil {
+			return nil, errors.Wrap(err, "truncated log export")
+		}
+		length := binary.BigEndian.Uint32(recordHeader[0:4])
+		checksum := binary.BigEndian.Uint32(recordHeader[4:8])
+		if length == 0 {
+			// The trailer
+			count := make([]byte, 8)
+			if _, err := io.ReadFull(br, count); err != nil {
+				return nil, errors.Wrap(err, "truncated log export")
+			}
+			if crc32.Checksum(count, logExportCRCTable) != checksum {
+				return nil, errors.Wrap(ErrCorruptedLog, "trailer checksum mismatch")
+			}
+			if n := binary.BigEndian.Uint64(count); n != uint64(len(logs)) {
+				return nil, errors.Wrapf(ErrCorruptedLog, "expected %d logs but got %d", n, len(logs))
+			}
+			return logs, nil
+		}
+		b := make([]byte, length)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, errors.Wrap(err, "truncated log export")
+		}
+		if crc32.Checksum(b, logExportCRCTable) != checksum {
+			return nil, errors.Wrapf(ErrCorruptedLog, "checksum mismatch in log #%d", len(logs)+1)
+		}
+		var log pb.Log
+		if err := proto.Unmarshal(b, &log); err != nil {
+			return nil, err
+		}
+		if len(logs) > 0 && log.Meta.Index != logs[len(logs)-1].Meta.Index+1 {
+			return nil, errors.Wrapf(ErrCorruptedLog, "non-contiguous log at index %d", log.Meta.Index)
+		}
+		logs = append(logs, &log)
+	}
+}
+
+// ExportLogs writes the logs with indexes in the range of from to to, both
+// inclusive, to w. A zero to means the last log. See ExportLogs for details.
+func (s *Server) ExportLogs(w io.Writer, from, to uint64) (int, error) {
+	if s.logStore.withinCompacted(from) {
+		return 0, errors.Errorf("logs before index %d have been compacted", s.firstLogIndex())
+	}
+	return exportLogs(s.logStore.Iterator(), w, from, to, s.logStore.LastIndex)
+}
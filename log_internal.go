@@ -2,11 +2,13 @@ package raft
 
 import (
 	"sort"
+	"sync"
 
 	"github.com/sumimakito/raft/pb"
 )
 
 type internalLogStore struct {
+	mu   sync.RWMutex // protects logs
 	logs []*pb.Log
 }
 
@@ -26,13 +28,23 @@ func (s *internalLogStore) putLog(log *pb.Log) {
 }
 
 func (s *internalLogStore) AppendLogs(logs []*pb.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, log := range logs {
 		s.putLog(log)
 	}
 	return nil
 }
 
+// RetainsLogs implements LogStoreRetention. The logs are copied as they are
+// appended.
+func (s *internalLogStore) RetainsLogs() bool {
+	return false
+}
+
 func (s *internalLogStore) TrimPrefix(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	i := sort.Search(len(s.logs), func(i int) bool { return s.logs[i].Meta.Index >= index })
 	if i == 0 {
 		return nil
@@ -42,6 +54,8 @@ func (s *internalLogStore) TrimPrefix(index uint64) error {
 }
 
 func (s *internalLogStore) TrimSuffix(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	i := sort.Search(len(s.logs), func(i int) bool { return s.logs[i].Meta.Index >= index })
 	if i == len(s.logs) {
 		return nil
@@ -59,6 +73,8 @@ func (s *internalLogStore) TrimSuffix(index uint64) error {
 }
 
 func (s *internalLogStore) FirstIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if len(s.logs) == 0 {
 		return 0, nil
 	}
@@ -66,6 +82,8 @@ func (s *internalLogStore) FirstIndex() (uint64, error) {
 }
 
 func (s *internalLogStore) LastIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if len(s.logs) == 0 {
 		return 0, nil
 	}
@@ -73,6 +91,8 @@ func (s *internalLogStore) LastIndex() (uint64, error) {
 }
 
 func (s *internalLogStore) Entry(index uint64) (*pb.Log, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if len(s.logs) == 0 {
 		return nil, nil
 	}
@@ -83,7 +103,20 @@ func (s *internalLogStore) Entry(index uint64) (*pb.Log, error) {
 	return s.logs[i], nil
 }
 
+func (s *internalLogStore) Entries(firstIndex, lastIndex uint64) ([]*pb.Log, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.logs), func(i int) bool { return s.logs[i].Meta.Index >= firstIndex })
+	j := sort.Search(len(s.logs), func(i int) bool { return s.logs[i].Meta.Index > lastIndex })
+	if i >= j {
+		return nil, nil
+	}
+	return append([]*pb.Log(nil), s.logs[i:j]...), nil
+}
+
 func (s *internalLogStore) LastEntry(t pb.LogType) (*pb.Log, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if len(s.logs) == 0 {
 		return nil, nil
 	}
@@ -1,15 +1,21 @@
 package raft
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/sumimakito/raft/pb"
+	"google.golang.org/protobuf/proto"
 )
 
 func testLogStoreAppendLogs(t *testing.T, p LogStore) {
@@ -160,6 +166,80 @@ func testLogStoreEntry(t *testing.T, p LogStore) {
 	assert.Nil(t, e)
 }
 
+func testLogStoreEntries(t *testing.T, p LogStore) {
+	logs := make([]*pb.Log, 0, 8)
+	for i := 1; i <= 8; i++ {
+		logs = append(logs, &pb.Log{Meta: &pb.LogMeta{Index: uint64(i), Term: 1}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}})
+	}
+	assert.NoError(t, p.AppendLogs(logs))
+	assert.NoError(t, p.TrimPrefix(3))
+
+	entries, err := logStoreEntries(p, 1, 5)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	for i, e := range entries {
+		assert.Equal(t, uint64(i+3), e.Meta.Index)
+	}
+
+	entries, err = logStoreEntries(p, 7, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	entries, err = logStoreEntries(p, 9, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func testLogStoreIterator(t *testing.T, p LogStore) {
+	logs := make([]*pb.Log, 0, 2*logIteratorBatchSize)
+	for i := 1; i <= 2*logIteratorBatchSize; i++ {
+		logs = append(logs, &pb.Log{Meta: &pb.LogMeta{Index: uint64(i), Term: 1}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}})
+	}
+	assert.NoError(t, p.AppendLogs(logs))
+	assert.NoError(t, p.TrimPrefix(3))
+
+	it := NewLogIterator(p)
+	defer it.Close()
+	it.Seek(1)
+	index := uint64(3)
+	for {
+		e := ƒAssertNoError2(it.Next())(t)
+		if e == nil {
+			break
+		}
+		assert.Equal(t, index, e.Meta.Index)
+		index++
+	}
+	assert.Equal(t, uint64(2*logIteratorBatchSize+1), index)
+
+	it.Seek(2 * logIteratorBatchSize)
+	assert.Equal(t, uint64(2*logIteratorBatchSize), ƒAssertNoError2(it.Next())(t).Meta.Index)
+	assert.Nil(t, ƒAssertNoError2(it.Next())(t))
+}
+
+func testLogStoreLastEntry(t *testing.T, p LogStore) {
+	logs := make([]*pb.Log, 0, 6)
+	for i := 1; i <= 6; i++ {
+		logType := pb.LogType_COMMAND
+		if i%2 == 0 {
+			logType = pb.LogType_CONFIGURATION
+		}
+		logs = append(logs, &pb.Log{Meta: &pb.LogMeta{Index: uint64(i), Term: 1}, Body: &pb.LogBody{Type: logType}})
+	}
+	assert.NoError(t, p.AppendLogs(logs))
+	assert.Equal(t, uint64(6), ƒAssertNoError2(p.LastEntry(0))(t).Meta.Index)
+	assert.Equal(t, uint64(5), ƒAssertNoError2(p.LastEntry(pb.LogType_COMMAND))(t).Meta.Index)
+	assert.Equal(t, uint64(6), ƒAssertNoError2(p.LastEntry(pb.LogType_CONFIGURATION))(t).Meta.Index)
+
+	// The trimmed logs are no longer found by their types.
+	assert.NoError(t, p.TrimSuffix(4))
+	assert.Equal(t, uint64(3), ƒAssertNoError2(p.LastEntry(pb.LogType_COMMAND))(t).Meta.Index)
+	assert.Equal(t, uint64(4), ƒAssertNoError2(p.LastEntry(pb.LogType_CONFIGURATION))(t).Meta.Index)
+	assert.NoError(t, p.TrimPrefix(5))
+	assert.Nil(t, ƒAssertNoError2(p.LastEntry(pb.LogType_COMMAND))(t))
+	assert.Nil(t, ƒAssertNoError2(p.LastEntry(pb.LogType_CONFIGURATION))(t))
+}
+
 func testLogStore(t *testing.T, storeFn func() (StableStore, error)) {
 	t.Run("AppendLogs", func(t *testing.T) {
 		store, err := storeFn()
@@ -187,6 +267,33 @@ func testLogStore(t *testing.T, storeFn func() (StableStore, error)) {
 		}
 		testLogStoreEntry(t, store)
 	})
+
+	t.Run("Entries", func(t *testing.T) {
+		store, err := storeFn()
+		assert.NoError(t, err)
+		if closer, ok := store.(io.Closer); ok {
+			defer closer.Close()
+		}
+		testLogStoreEntries(t, store)
+	})
+
+	t.Run("Iterator", func(t *testing.T) {
+		store, err := storeFn()
+		assert.NoError(t, err)
+		if closer, ok := store.(io.Closer); ok {
+			defer closer.Close()
+		}
+		testLogStoreIterator(t, store)
+	})
+
+	t.Run("LastEntry", func(t *testing.T) {
+		store, err := storeFn()
+		assert.NoError(t, err)
+		if closer, ok := store.(io.Closer); ok {
+			defer closer.Close()
+		}
+		testLogStoreLastEntry(t, store)
+	})
 }
 
 func TestLogStores(t *testing.T) {
@@ -216,4 +323,718 @@ func TestLogStores(t *testing.T) {
 		}
 		testLogStore(t, storeFn)
 	})
+
+	t.Run("WAL", func(t *testing.T) {
+		storeFn := func() (StableStore, error) {
+			logStore, err := NewWALLogStore(t.TempDir(), WALSegmentSizeOption(256))
+			if err != nil {
+				return nil, err
+			}
+			return &internalStore{LogStore: logStore, StateStore: newInternalStateStore()}, nil
+		}
+		testLogStore(t, storeFn)
+	})
+
+	t.Run("Cached", func(t *testing.T) {
+		storeFn := func() (StableStore, error) {
+			return &internalStore{
+				LogStore:   NewCachedLogStore(newInternalLogStore(), 2),
+				StateStore: newInternalStateStore(),
+			}, nil
+		}
+		testLogStore(t, storeFn)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		storeFn := func() (StableStore, error) {
+			cipher := NewAESGCMLogCipher(StaticKeyProvider(make([]byte, 32)))
+			return &internalStore{
+				LogStore:   NewEncryptedLogStore(newInternalLogStore(), cipher),
+				StateStore: newInternalStateStore(),
+			}, nil
+		}
+		testLogStore(t, storeFn)
+	})
+}
+
+func TestEncryptedLogStore(t *testing.T) {
+	key := make([]byte, 32)
+	ƒAssertNoError2(rand.Read(key))(t)
+	underlying := newInternalLogStore()
+	store := NewEncryptedLogStore(underlying, NewAESGCMLogCipher(StaticKeyProvider(key)))
+
+	log := &pb.Log{
+		Meta: &pb.LogMeta{Index: 1, Term: 1},
+		Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("command")},
+	}
+	assert.NoError(t, store.AppendLogs([]*pb.Log{log}))
+	assert.Equal(t, []byte("command"), log.Body.Data)
+
+	// The underlying LogStore should only see the ciphertext.
+	encrypted := ƒAssertNoError2(underlying.Entry(1))(t)
+	assert.NotContains(t, string(encrypted.Body.Data), "command")
+	assert.Equal(t, []byte("command"), ƒAssertNoError2(store.Entry(1))(t).Body.Data)
+
+	// The meta is authenticated.
+	encrypted.Meta.Term = 2
+	_, err := store.Entry(1)
+	assert.Error(t, err)
+
+	// The session and the checksum survive the round trip.
+	log = &pb.Log{
+		Meta: &pb.LogMeta{Index: 2, Term: 1},
+		Body: &pb.LogBody{
+			Type:    pb.LogType_COMMAND,
+			Data:    []byte("command"),
+			Session: &pb.SessionRequest{SessionId: 1, Sequence: 2, AckedSequence: 1},
+		},
+	}
+	log.Checksum = log.ComputeChecksum()
+	assert.NoError(t, store.AppendLogs([]*pb.Log{log}))
+	read := ƒAssertNoError2(store.Entry(2))(t)
+	assert.True(t, proto.Equal(log.Body.Session, read.Body.Session))
+	assert.Equal(t, log.Checksum, read.ComputeChecksum())
+}
+
+func TestLogExtensions(t *testing.T) {
+	log := &pb.Log{
+		Meta: &pb.LogMeta{Index: 1, Term: 1},
+		Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("command")},
+	}
+	checksum := log.ComputeChecksum()
+	log.Body.Extensions = map[string][]byte{}
+	assert.Equal(t, checksum, log.ComputeChecksum())
+
+	// The extensions are covered by the checksum.
+	log.Body.Extensions = map[string][]byte{"request_id": []byte("1"), "tenant": []byte("a")}
+	checksum = log.ComputeChecksum()
+	assert.Equal(t, checksum, log.Copy().ComputeChecksum())
+	log.Body.Extensions["tenant"] = []byte("b")
+	assert.NotEqual(t, checksum, log.ComputeChecksum())
+
+	// The copy does not share the extensions.
+	copied := log.Copy()
+	copied.Body.Extensions["tenant"][0] = 'c'
+	assert.Equal(t, []byte("b"), log.Body.Extensions["tenant"])
+
+	// The extensions are preserved by the stores.
+	key := make([]byte, 32)
+	ƒAssertNoError2(rand.Read(key))(t)
+	for _, store := range []LogStore{
+		newInternalLogStore(),
+		NewEncryptedLogStore(newInternalLogStore(), NewAESGCMLogCipher(StaticKeyProvider(key))),
+	} {
+		assert.NoError(t, store.AppendLogs([]*pb.Log{log}))
+		assert.Equal(t, log.Body.Extensions, ƒAssertNoError2(store.Entry(1))(t).Body.Extensions)
+	}
+}
+
+func TestValidatingLogStore(t *testing.T) {
+	store := NewValidatingLogStore(newInternalLogStore())
+	logFn := func(index, term uint64) *pb.Log {
+		return &pb.Log{
+			Meta: &pb.LogMeta{Index: index, Term: term},
+			Body: &pb.LogBody{Type: pb.LogType_COMMAND},
+		}
+	}
+	assertInvalid := func(logs ...*pb.Log) {
+		err := store.AppendLogs(logs)
+		assert.ErrorIs(t, err, ErrInvalidLog)
+		var validationErr *LogValidationError
+		assert.ErrorAs(t, err, &validationErr)
+	}
+
+	assertInvalid(logFn(0, 1))
+	assert.NoError(t, store.AppendLogs([]*pb.Log{logFn(5, 1), logFn(6, 1)}))
+	assertInvalid(logFn(8, 1))
+	assertInvalid(logFn(6, 1))
+	assertInvalid(logFn(7, 0))
+	assertInvalid(logFn(7, 2), logFn(9, 2))
+	assertInvalid(logFn(7, 2), &pb.Log{Meta: &pb.LogMeta{Index: 8, Term: 2}})
+	// Rejected batches should not be partially appended.
+	assert.Equal(t, uint64(6), ƒAssertNoError2(store.LastIndex())(t))
+
+	assert.NoError(t, store.AppendLogs([]*pb.Log{logFn(7, 2), logFn(8, 3)}))
+	assert.NoError(t, store.TrimSuffix(7))
+	assertInvalid(logFn(7, 3))
+	assert.NoError(t, store.AppendLogs([]*pb.Log{logFn(8, 3)}))
+	// Any index is accepted once all logs are evicted.
+	assert.NoError(t, store.TrimPrefix(9))
+	assert.NoError(t, store.AppendLogs([]*pb.Log{logFn(10, 4)}))
+}
+
+func TestCachedLogStore(t *testing.T) {
+	store := NewCachedLogStore(newInternalLogStore(), 4)
+
+	logs := make([]*pb.Log, 0, 8)
+	for i := 1; i <= 8; i++ {
+		logs = append(logs, &pb.Log{
+			Meta: &pb.LogMeta{Index: uint64(i), Term: 1},
+			Body: &pb.LogBody{Type: pb.LogType_COMMAND},
+		})
+	}
+	assert.NoError(t, store.AppendLogs(logs))
+	assert.Equal(t, 4, store.lru.Len())
+	for i := uint64(5); i <= 8; i++ {
+		assert.Contains(t, store.entries, i)
+	}
+
+	// A cache miss should bring the log into the cache.
+	e := ƒAssertNoError2(store.Entry(1))(t)
+	assert.Equal(t, uint64(1), e.Meta.Index)
+	assert.Contains(t, store.entries, uint64(1))
+	assert.NotContains(t, store.entries, uint64(5))
+
+	// Trimmed logs should be evicted.
+	assert.NoError(t, store.TrimSuffix(6))
+	assert.NotContains(t, store.entries, uint64(7))
+	assert.NotContains(t, store.entries, uint64(8))
+	assert.Nil(t, ƒAssertNoError2(store.Entry(8))(t))
+	assert.NoError(t, store.TrimPrefix(3))
+	assert.NotContains(t, store.entries, uint64(1))
+	assert.Nil(t, ƒAssertNoError2(store.Entry(1))(t))
+}
+
+func TestWALLogStore(t *testing.T) {
+	dir := t.TempDir()
+	store := ƒAssertNoError2(NewWALLogStore(dir, WALSegmentSizeOption(256)))(t)
+
+	logs := make([]*pb.Log, 0, 32)
+	for i := 1; i <= 32; i++ {
+		logs = append(logs, &pb.Log{
+			Meta: &pb.LogMeta{Index: uint64(i), Term: 1},
+			Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("command")},
+		})
+	}
+	assert.NoError(t, store.AppendLogs(logs))
+	assert.NoError(t, store.TrimSuffix(30))
+	assert.NoError(t, store.TrimPrefix(20))
+	segments := len(store.segments)
+	assert.NoError(t, store.Close())
+
+	// Reopen the store and check if the records are replayed.
+	store = ƒAssertNoError2(NewWALLogStore(dir, WALSegmentSizeOption(256)))(t)
+	defer store.Close()
+	assert.Equal(t, segments, len(store.segments))
+	assert.Equal(t, uint64(20), ƒAssertNoError2(store.FirstIndex())(t))
+	assert.Equal(t, uint64(30), ƒAssertNoError2(store.LastIndex())(t))
+	e := ƒAssertNoError2(store.Entry(25))(t)
+	assert.NotNil(t, e)
+	assert.Equal(t, []byte("command"), e.Body.Data)
+	assert.Nil(t, ƒAssertNoError2(store.Entry(19))(t))
+	assert.Nil(t, ƒAssertNoError2(store.Entry(31))(t))
+
+	// Segments holding trimmed logs only should have been deleted.
+	assert.Greater(t, store.segments[0].seq, uint64(1))
+}
+
+func TestWALLogStoreCorruptedLength(t *testing.T) {
+	dir := t.TempDir()
+	store := ƒAssertNoError2(NewWALLogStore(dir, WALSegmentSizeOption(256)))(t)
+	logs := make([]*pb.Log, 0, 16)
+	for i := 1; i <= 16; i++ {
+		logs = append(logs, &pb.Log{
+			Meta: &pb.LogMeta{Index: uint64(i), Term: 1},
+			Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("command")},
+		})
+	}
+	assert.NoError(t, store.AppendLogs(logs))
+	assert.Greater(t, len(store.segments), 1)
+	// Damage the length of the first record.
+	ƒAssertNoError2(store.segments[0].file.WriteAt([]byte{0x7f, 0xff, 0xff, 0xff}, 0))(t)
+	assert.NoError(t, store.Close())
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := NewWALLogStore(dir, WALSegmentSizeOption(256))
+	runtime.ReadMemStats(&after)
+	assert.ErrorIs(t, err, ErrCorruptedLog)
+	// The payload is not allocated with the damaged length.
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+func TestWALStore(t *testing.T) {
+	dir := t.TempDir()
+	store := ƒAssertNoError2(NewWALStore(dir, WALSegmentSizeOption(256)))(t)
+	assert.NoError(t, store.AppendLogs([]*pb.Log{
+		{Meta: &pb.LogMeta{Index: 1, Term: 2}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}},
+	}))
+	assert.NoError(t, store.SetCurrentTerm(2))
+	assert.NoError(t, store.SetLastVote(voteSummary{term: 2, candidate: "server1"}))
+	assert.NoError(t, store.Close())
+
+	// Reopen the store and check if the logs and the states are kept.
+	store = ƒAssertNoError2(NewWALStore(dir, WALSegmentSizeOption(256)))(t)
+	assert.Equal(t, uint64(1), ƒAssertNoError2(store.LastIndex())(t))
+	assert.Equal(t, uint64(2), ƒAssertNoError2(store.CurrentTerm())(t))
+	assert.Equal(t, voteSummary{term: 2, candidate: "server1"}, ƒAssertNoError2(store.LastVote())(t))
+	assert.NoError(t, store.Close())
+
+	// The damaged states are reported.
+	path := filepath.Join(dir, walStoreStateFile)
+	content := ƒAssertNoError2(os.ReadFile(path))(t)
+	content[0] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, content, 0600))
+	_, err := NewWALStore(dir, WALSegmentSizeOption(256))
+	assert.ErrorIs(t, err, ErrCorruptedState)
+}
+
+func TestWALLogStoreReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	store := ƒAssertNoError2(NewWALLogStore(dir, WALSegmentSizeOption(256)))(t)
+	logs := make([]*pb.Log, 0, 8)
+	for i := 1; i <= 8; i++ {
+		logs = append(logs, &pb.Log{
+			Meta: &pb.LogMeta{Index: uint64(i), Term: 1},
+			Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("command")},
+		})
+	}
+	assert.NoError(t, store.AppendLogs(logs))
+	segment := store.activeSegment()
+	path := filepath.Join(dir, walSegmentName(segment.seq))
+	// Leave a torn record at the tail.
+	ƒAssertNoError2(segment.file.WriteAt([]byte{0, 0, 0, 8, 1, 2}, segment.size))(t)
+	assert.NoError(t, store.Close())
+	content := ƒAssertNoError2(os.ReadFile(path))(t)
+
+	store = ƒAssertNoError2(NewWALLogStore(dir, WALSegmentSizeOption(256), WALReadOnlyOption()))(t)
+	defer store.Close()
+	assert.Equal(t, uint64(8), ƒAssertNoError2(store.LastIndex())(t))
+	assert.Equal(t, []byte("command"), ƒAssertNoError2(store.Entry(8))(t).Body.Data)
+	assert.ErrorIs(t, store.AppendLogs(logs[:1]), ErrReadOnlyLogStore)
+	assert.ErrorIs(t, store.TrimPrefix(2), ErrReadOnlyLogStore)
+	assert.ErrorIs(t, store.TrimSuffix(2), ErrReadOnlyLogStore)
+	assert.ErrorIs(t, store.Compact(), ErrReadOnlyLogStore)
+	// The torn tail should have been left as is.
+	assert.Equal(t, content, ƒAssertNoError2(os.ReadFile(path))(t))
+
+	_, err := NewWALLogStore(filepath.Join(dir, "missing"), WALReadOnlyOption())
+	assert.Error(t, err)
+}
+
+func TestLogStoreCompactor(t *testing.T) {
+	testCompactor := func(t *testing.T, store interface {
+		LogStore
+		LogStoreCompactor
+	}) {
+		logs := make([]*pb.Log, 0, 64)
+		for i := 1; i <= 64; i++ {
+			logs = append(logs, &pb.Log{
+				Meta: &pb.LogMeta{Index: uint64(i), Term: 1},
+				Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: make([]byte, 128)},
+			})
+		}
+		assert.NoError(t, store.AppendLogs(logs))
+		assert.NoError(t, store.TrimPrefix(48))
+
+		before := ƒAssertNoError2(store.StorageStats())(t)
+		assert.NoError(t, store.Compact())
+		after := ƒAssertNoError2(store.StorageStats())(t)
+		assert.LessOrEqual(t, after.SizeBytes, before.SizeBytes)
+		assert.GreaterOrEqual(t, after.LiveBytes, int64(0))
+
+		assert.Equal(t, uint64(48), ƒAssertNoError2(store.FirstIndex())(t))
+		assert.Equal(t, uint64(64), ƒAssertNoError2(store.LastIndex())(t))
+		for i := uint64(48); i <= 64; i++ {
+			e := ƒAssertNoError2(store.Entry(i))(t)
+			assert.NotNil(t, e)
+			assert.Equal(t, i, e.Meta.Index)
+		}
+	}
+
+	t.Run("Bolt", func(t *testing.T) {
+		store := ƒAssertNoError2(NewBoltStore(filepath.Join(t.TempDir(), "bolt.db")))(t)
+		defer store.Close()
+		testCompactor(t, store)
+	})
+
+	t.Run("WAL", func(t *testing.T) {
+		dir := t.TempDir()
+		store := ƒAssertNoError2(NewWALLogStore(dir, WALSegmentSizeOption(1024)))(t)
+		testCompactor(t, store)
+		assert.Equal(t, 0.0, ƒAssertNoError2(store.StorageStats())(t).Fragmentation)
+		assert.NoError(t, store.Close())
+
+		// Reopen the store and check if the compacted segments are replayed.
+		store = ƒAssertNoError2(NewWALLogStore(dir, WALSegmentSizeOption(1024)))(t)
+		defer store.Close()
+		assert.Equal(t, uint64(48), ƒAssertNoError2(store.FirstIndex())(t))
+		assert.Equal(t, uint64(64), ƒAssertNoError2(store.LastIndex())(t))
+	})
+}
+
+func TestBoltStoreCompactRenameError(t *testing.T) {
+	renameErr := fmt.Errorf("rename failed")
+	boltRename = func(oldpath, newpath string) error { return renameErr }
+	defer func() { boltRename = os.Rename }()
+
+	dir := t.TempDir()
+	store := ƒAssertNoError2(NewBoltStore(filepath.Join(dir, "bolt.db")))(t)
+	defer store.Close()
+	assert.NoError(t, store.AppendLogs([]*pb.Log{{
+		Meta: &pb.LogMeta{Index: 1, Term: 1},
+		Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("command")},
+	}}))
+	assert.ErrorIs(t, store.Compact(), renameErr)
+
+	// The original database file is reopened.
+	e := ƒAssertNoError2(store.Entry(1))(t)
+	if assert.NotNil(t, e) {
+		assert.Equal(t, []byte("command"), e.Body.Data)
+	}
+	assert.NoError(t, store.AppendLogs([]*pb.Log{{Meta: &pb.LogMeta{Index: 2, Term: 1}, Body: &pb.LogBody{}}}))
+	entries := ƒAssertNoError2(os.ReadDir(dir))(t)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "bolt.db", entries[0].Name())
+	}
+}
+
+// retainingLogStore keeps the logs passed to AppendLogs like the LogStores
+// written before LogStoreRetention.
+type retainingLogStore struct {
+	LogStore
+	appended []*pb.Log
+}
+
+func (s *retainingLogStore) AppendLogs(logs []*pb.Log) error {
+	s.appended = append(s.appended, logs...)
+	return s.LogStore.AppendLogs(logs)
+}
+
+func TestLogStoreProxyRetention(t *testing.T) {
+	assert.True(t, logStoreRetainsLogs(&retainingLogStore{LogStore: newInternalLogStore()}))
+	assert.False(t, logStoreRetainsLogs(newInternalLogStore()))
+	assert.False(t, logStoreRetainsLogs(NewCachedLogStore(newInternalLogStore(), 4)))
+	assert.True(t, logStoreRetainsLogs(NewCachedLogStore(&retainingLogStore{LogStore: newInternalLogStore()}, 4)))
+
+	server := testingServer(t)
+	store := &retainingLogStore{LogStore: newInternalLogStore()}
+	server.logStore = newLogStoreProxy(server, store)
+	server.serverState.stateCurrentTerm = 1
+	bodies := []*pb.LogBody{
+		{Type: pb.LogType_COMMAND, Data: []byte("command1")},
+		{Type: pb.LogType_COMMAND, Data: []byte("command2")},
+	}
+	ƒAssertNoError2(server.appendLogs(bodies, nil, nil))(t)
+	bodies[0].Data[0] = 'C'
+
+	// The logs reused by the server are not the ones retained by the LogStore.
+	if assert.Len(t, store.appended, 2) {
+		for i, log := range store.appended {
+			if assert.NotNil(t, log.Meta) && assert.NotNil(t, log.Body) {
+				assert.Equal(t, uint64(i+1), log.Meta.Index)
+				assert.Equal(t, fmt.Sprintf("command%d", i+1), string(log.Body.Data))
+			}
+		}
+	}
+}
+
+func TestLogStoreProxyChecksum(t *testing.T) {
+	proxyFn := func(t *testing.T, policy LogCorruptionPolicy) *logStoreProxy {
+		server := testingServer(t, LogCorruptionPolicyOption(policy))
+		proxy := newLogStoreProxy(server, newInternalLogStore())
+		logs := make([]*pb.Log, 0, 4)
+		for i := 1; i <= 4; i++ {
+			logs = append(logs, &pb.Log{
+				Meta: &pb.LogMeta{Index: uint64(i), Term: 1},
+				Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("command")},
+			})
+		}
+		assert.NoError(t, proxy.AppendLogs(logs))
+		for _, log := range logs {
+			assert.Equal(t, log.ComputeChecksum(), log.Checksum)
+		}
+		// Corrupt the log at index 3.
+		ƒAssertNoError2(proxy.LogStore.Entry(3))(t).Body.Data[0] ^= 0xff
+		server.setLastLogIndex(4)
+		return proxy
+	}
+
+	t.Run("Panic", func(t *testing.T) {
+		proxy := proxyFn(t, LogCorruptionPanic)
+		assert.NotNil(t, ƒAssertNoError2(proxy.Entry(2))(t))
+		assert.Panics(t, func() { proxy.Entry(3) })
+		assert.Panics(t, func() { proxy.Entries(1, 4) })
+	})
+
+	t.Run("Truncate", func(t *testing.T) {
+		proxy := proxyFn(t, LogCorruptionTruncate)
+		logs := ƒAssertNoError2(proxy.Entries(1, 4))(t)
+		assert.Len(t, logs, 2)
+		assert.Equal(t, uint64(2), ƒAssertNoError2(proxy.LastIndex())(t))
+		assert.Equal(t, uint64(2), proxy.server.lastLogIndex())
+		assert.Nil(t, ƒAssertNoError2(proxy.Entry(3))(t))
+	})
+
+	t.Run("Report", func(t *testing.T) {
+		proxy := proxyFn(t, LogCorruptionReport)
+		_, err := proxy.Entry(3)
+		assert.ErrorIs(t, err, ErrCorruptedLog)
+		_, err = proxy.Meta(3)
+		assert.ErrorIs(t, err, ErrCorruptedLog)
+		assert.Equal(t, uint64(4), ƒAssertNoError2(proxy.LastIndex())(t))
+	})
+}
+
+type testingSnapshotMeta struct {
+	index, term uint64
+}
+
+func (m testingSnapshotMeta) Id() string                       { return fmt.Sprint(m.index) }
+func (m testingSnapshotMeta) Index() uint64                    { return m.index }
+func (m testingSnapshotMeta) Term() uint64                     { return m.term }
+func (m testingSnapshotMeta) Configuration() *pb.Configuration { return nil }
+func (m testingSnapshotMeta) ConfigurationIndex() uint64       { return 0 }
+func (m testingSnapshotMeta) Encode() ([]byte, error)          { return nil, nil }
+
+func TestSnapshotServiceCompactLogs(t *testing.T) {
+	compactFn := func(t *testing.T, policy LogCompactionPolicy) *logStoreProxy {
+		server := testingServer(t, LogCompactionPolicyOption(policy))
+		server.logStore = newLogStoreProxy(server, newInternalLogStore())
+		server.logOpsCh = make(chan logStoreOp)
+		defer close(server.logOpsCh)
+		go func() {
+			for op := range server.logOpsCh {
+				server.handleLogOp(op)
+			}
+		}()
+
+		logs := make([]*pb.Log, 0, 10)
+		for i := 1; i <= 10; i++ {
+			logs = append(logs, &pb.Log{
+				Meta: &pb.LogMeta{Index: uint64(i), Term: 1},
+				Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: make([]byte, 10)},
+			})
+		}
+		assert.NoError(t, server.logStore.AppendLogs(logs))
+		server.setFirstLogIndex(1)
+		server.setLastLogIndex(10)
+
+		snapshotMeta := testingSnapshotMeta{index: 8, term: 1}
+		assert.NoError(t, server.logStore.SetSnapshot(snapshotMeta))
+		assert.NoError(t, newSnapshotService(server).compactLogs(snapshotMeta))
+		return server.logStore
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		proxy := compactFn(t, LogCompactionPolicy{})
+		assert.Equal(t, uint64(9), proxy.server.firstLogIndex())
+		assert.Equal(t, uint64(10), proxy.server.lastLogIndex())
+		assert.True(t, proxy.withinCompacted(7))
+	})
+
+	t.Run("RetainEntries", func(t *testing.T) {
+		proxy := compactFn(t, LogCompactionPolicy{RetainEntries: 3})
+		assert.Equal(t, uint64(6), proxy.server.firstLogIndex())
+		assert.False(t, proxy.withinCompacted(6))
+		assert.NotNil(t, ƒAssertNoError2(proxy.Entry(6))(t))
+		assert.True(t, proxy.withinCompacted(5))
+	})
+
+	t.Run("RetainBytes", func(t *testing.T) {
+		proxy := compactFn(t, LogCompactionPolicy{RetainBytes: 1})
+		assert.Equal(t, uint64(8), proxy.server.firstLogIndex())
+	})
+
+	t.Run("RetainDuration", func(t *testing.T) {
+		proxy := compactFn(t, LogCompactionPolicy{RetainDuration: time.Hour})
+		assert.Equal(t, uint64(1), proxy.server.firstLogIndex())
+	})
+}
+
+func TestLogStoreProxyLastTermIndex(t *testing.T) {
+	proxy := newLogStoreProxy(testingServer(t), newInternalLogStore())
+
+	term, index := ƒAssertNoError3(proxy.LastTermIndex())(t)
+	assert.Equal(t, uint64(0), term)
+	assert.Equal(t, uint64(0), index)
+
+	assert.NoError(t, proxy.AppendLogs([]*pb.Log{
+		{Meta: &pb.LogMeta{Index: 1, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}},
+		{Meta: &pb.LogMeta{Index: 2, Term: 2}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}},
+	}))
+	term, index = ƒAssertNoError3(proxy.LastTermIndex())(t)
+	assert.Equal(t, uint64(2), term)
+	assert.Equal(t, uint64(2), index)
+
+	assert.NoError(t, proxy.TrimSuffix(1))
+	term, index = ƒAssertNoError3(proxy.LastTermIndex())(t)
+	assert.Equal(t, uint64(1), term)
+	assert.Equal(t, uint64(1), index)
+
+	// Fall back to the snapshot if there are no logs after it.
+	assert.NoError(t, proxy.Restore(testingSnapshotMeta{index: 5, term: 3}))
+	term, index = ƒAssertNoError3(proxy.LastTermIndex())(t)
+	assert.Equal(t, uint64(3), term)
+	assert.Equal(t, uint64(5), index)
+}
+
+func TestLogStoreProxyRestore(t *testing.T) {
+	newProxy := func() *logStoreProxy {
+		proxy := newLogStoreProxy(testingServer(t), newInternalLogStore())
+		logs := []*pb.Log{}
+		for i := uint64(1); i <= 5; i++ {
+			logs = append(logs, &pb.Log{Meta: &pb.LogMeta{Index: i, Term: 2}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}})
+		}
+		assert.NoError(t, proxy.AppendLogs(logs))
+		return proxy
+	}
+
+	// The logs following a matching snapshot are retained.
+	proxy := newProxy()
+	assert.NoError(t, proxy.Restore(testingSnapshotMeta{index: 3, term: 2}))
+	assert.Equal(t, uint64(4), ƒAssertNoError2(proxy.LogStore.FirstIndex())(t))
+	assert.Equal(t, uint64(5), ƒAssertNoError2(proxy.LastIndex())(t))
+
+	// The logs starting right after the snapshot are retained.
+	assert.NoError(t, proxy.Restore(testingSnapshotMeta{index: 3, term: 2}))
+	assert.Equal(t, uint64(5), ƒAssertNoError2(proxy.LastIndex())(t))
+
+	// All logs are discarded if the log at the snapshot's index has a
+	// different term.
+	proxy = newProxy()
+	assert.NoError(t, proxy.Restore(testingSnapshotMeta{index: 3, term: 3}))
+	assert.Equal(t, uint64(0), ƒAssertNoError2(proxy.LogStore.LastIndex())(t))
+	assert.Equal(t, uint64(3), ƒAssertNoError2(proxy.LastIndex())(t))
+
+	// All logs are discarded if the snapshot is beyond the logs.
+	proxy = newProxy()
+	assert.NoError(t, proxy.Restore(testingSnapshotMeta{index: 7, term: 2}))
+	assert.Equal(t, uint64(0), ƒAssertNoError2(proxy.LogStore.LastIndex())(t))
+	assert.Equal(t, uint64(7), ƒAssertNoError2(proxy.LastIndex())(t))
+}
+
+type testingMetricsExporter struct {
+	mu      sync.Mutex
+	records map[string][]interface{}
+}
+
+func (e *testingMetricsExporter) Record(time time.Time, name string, value interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.records == nil {
+		e.records = map[string][]interface{}{}
+	}
+	e.records[name] = append(e.records[name], value)
+}
+
+func TestLogStoreProxyMetrics(t *testing.T) {
+	exporter := &testingMetricsExporter{}
+	proxy := newLogStoreProxy(testingServer(t, MetricsKeeperOption(exporter)), newInternalLogStore())
+
+	assert.NoError(t, proxy.AppendLogs([]*pb.Log{
+		{Meta: &pb.LogMeta{Index: 1, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}},
+		{Meta: &pb.LogMeta{Index: 2, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}},
+	}))
+	ƒAssertNoError2(proxy.Entry(1))(t)
+	ƒAssertNoError2(proxy.Entries(1, 2))(t)
+
+	assert.Equal(t, []interface{}{2}, exporter.records[MetricLogAppendBatchSize])
+	assert.Len(t, exporter.records[MetricLogAppendLatency], 1)
+	assert.Len(t, exporter.records[MetricLogReadLatency], 2)
+}
+
+func TestLogStoreProxyCheck(t *testing.T) {
+	proxyFn := func(t *testing.T, policy LogCheckPolicy) *logStoreProxy {
+		store := newInternalLogStore()
+		for i := 1; i <= 6; i++ {
+			if i == 4 {
+				// Leave a gap at index 4.
+				continue
+			}
+			log := &pb.Log{Meta: &pb.LogMeta{Index: uint64(i), Term: 1}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}}
+			log.Checksum = log.ComputeChecksum()
+			assert.NoError(t, store.AppendLogs([]*pb.Log{log}))
+		}
+		return newLogStoreProxy(testingServer(t, LogCheckPolicyOption(policy)), store)
+	}
+
+	t.Run("Fail", func(t *testing.T) {
+		err := proxyFn(t, LogCheckFail).Check()
+		var checkErr *LogCheckError
+		assert.ErrorAs(t, err, &checkErr)
+		assert.ErrorIs(t, err, ErrCorruptedLog)
+		assert.Equal(t, uint64(4), checkErr.Index)
+	})
+
+	t.Run("Truncate", func(t *testing.T) {
+		proxy := proxyFn(t, LogCheckTruncate)
+		assert.NoError(t, proxy.Check())
+		assert.Equal(t, uint64(3), ƒAssertNoError2(proxy.LastIndex())(t))
+		assert.NoError(t, proxy.Check())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		proxy := proxyFn(t, LogCheckDisabled)
+		assert.NoError(t, proxy.Check())
+		assert.Equal(t, uint64(6), ƒAssertNoError2(proxy.LastIndex())(t))
+	})
+}
+
+func TestCheckLogsTail(t *testing.T) {
+	store := newInternalLogStore()
+	for i, term := range []uint64{1, 1, 1, 3, 2, 2, 2, 2} {
+		if i == 1 {
+			// Leave a gap at index 2.
+			continue
+		}
+		log := &pb.Log{Meta: &pb.LogMeta{Index: uint64(i + 1), Term: term}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}}
+		log.Checksum = log.ComputeChecksum()
+		assert.NoError(t, store.AppendLogs([]*pb.Log{log}))
+	}
+
+	// The inconsistencies before the window are not found.
+	assert.Nil(t, ƒAssertNoError2(CheckLogsTail(store, 3))(t))
+	// The term of the first log in the window is compared with the log before.
+	checkErr := ƒAssertNoError2(CheckLogsTail(store, 4))(t)
+	if assert.NotNil(t, checkErr) {
+		assert.Equal(t, uint64(5), checkErr.Index)
+		assert.Equal(t, uint64(1), checkErr.FirstIndex)
+		assert.Equal(t, uint64(8), checkErr.LastIndex)
+	}
+	for _, n := range []uint64{LogCheckAllLogs, 8, 100} {
+		checkErr := ƒAssertNoError2(CheckLogsTail(store, n))(t)
+		if assert.NotNil(t, checkErr) {
+			assert.Equal(t, uint64(2), checkErr.Index)
+		}
+	}
+	assert.Equal(t, uint64(2), ƒAssertNoError2(CheckLogs(store))(t).Index)
+
+	proxy := newLogStoreProxy(testingServer(t, LogCheckWindowOption(3)), store)
+	assert.NoError(t, proxy.Check())
+	proxy = newLogStoreProxy(testingServer(t, LogCheckWindowOption(LogCheckAllLogs)), store)
+	assert.ErrorIs(t, proxy.Check(), ErrCorruptedLog)
+}
+
+func TestExportImportLogs(t *testing.T) {
+	src := newInternalLogStore()
+	logs := make([]*pb.Log, 0, 10)
+	for i := 1; i <= 10; i++ {
+		logs = append(logs, &pb.Log{
+			Meta: &pb.LogMeta{Index: uint64(i), Term: 1},
+			Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte(fmt.Sprint(i))},
+		})
+	}
+	assert.NoError(t, src.AppendLogs(logs))
+
+	var full, incremental bytes.Buffer
+	assert.Equal(t, 6, ƒAssertNoError2(ExportLogs(src, &full, 0, 6))(t))
+	assert.Equal(t, 4, ƒAssertNoError2(ExportLogs(src, &incremental, 7, 0))(t))
+
+	dst := newInternalLogStore()
+	assert.Equal(t, 6, ƒAssertNoError2(ImportLogs(dst, bytes.NewReader(full.Bytes())))(t))
+	// The same export does not follow the last log.
+	_, err := ImportLogs(dst, bytes.NewReader(full.Bytes()))
+	assert.Error(t, err)
+	assert.Equal(t, 4, ƒAssertNoError2(ImportLogs(dst, bytes.NewReader(incremental.Bytes())))(t))
+	assert.Equal(t, uint64(10), ƒAssertNoError2(dst.LastIndex())(t))
+	assert.Equal(t, []byte("7"), ƒAssertNoError2(dst.Entry(7))(t).Body.Data)
+
+	// Corrupted and truncated exports are rejected.
+	corrupted := append([]byte(nil), full.Bytes()...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	_, err = ImportLogs(newInternalLogStore(), bytes.NewReader(corrupted))
+	assert.Error(t, err)
+	_, err = ImportLogs(newInternalLogStore(), bytes.NewReader(full.Bytes()[:full.Len()-1]))
+	assert.Error(t, err)
 }
@@ -0,0 +1,130 @@
+package raft
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sumimakito/raft/pb"
+)
+
+// LogValidationError describes the log that violates the invariants enforced
+// by the ValidatingLogStore.
+type LogValidationError struct {
+	Index  uint64
+	Term   uint64
+	Reason string
+}
+
+func (e *LogValidationError) Error() string {
+	return fmt.Sprintf("invalid log at index %d with term %d: %s", e.Index, e.Term, e.Reason)
+}
+
+func (e *LogValidationError) Unwrap() error {
+	return ErrInvalidLog
+}
+
+// ValidatingLogStore is a LogStore that validates the logs before they reach
+// the underlying LogStore. The indexes must be non-zero and contiguous, both
+// within a batch and with the last log, and the terms must not decrease. A
+// batch containing any invalid log is rejected as a whole with a
+// *LogValidationError.
+//
+// It's useful for catching bugs when implementing a custom LogStore.
+type ValidatingLogStore struct {
+	LogStore
+
+	mu       sync.Mutex // protects lastMeta
+	lastMeta *pb.LogMeta
+}
+
+func NewValidatingLogStore(store LogStore) *ValidatingLogStore {
+	return &ValidatingLogStore{LogStore: store}
+}
+
+// lastMetaLocked returns the meta of the last log, or nil if the LogStore is
+// empty.
+func (s *ValidatingLogStore) lastMetaLocked() (*pb.LogMeta, error) {
+	if s.lastMeta != nil {
+		return s.lastMeta, nil
+	}
+	log, err := s.LogStore.LastEntry(0)
+	if err != nil || log == nil {
+		return nil, err
+	}
+	s.lastMeta = log.Meta.Copy()
+	return s.lastMeta, nil
+}
+
+func (s *ValidatingLogStore) validate(logs []*pb.Log) error {
+	last, err := s.lastMetaLocked()
+	if err != nil {
+		return err
+	}
+	for _, log := range logs {
+		if log == nil || log.Meta == nil || log.Body == nil {
+			var index uint64
+			if last != nil {
+				index = last.Index + 1
+			}
+			return &LogValidationError{Index: index, Reason: "incomplete log"}
+		}
+		invalid := func(format string, args ...interface{}) error {
+			return &LogValidationError{Index: log.Meta.Index, Term: log.Meta.Term, Reason: fmt.Sprintf(format, args...)}
+		}
+		if log.Meta.Index == 0 {
+			return invalid("zero index")
+		}
+		if last != nil {
+			if log.Meta.Index != last.Index+1 {
+				return invalid("index does not follow the last index %d", last.Index)
+			}
+			if log.Meta.Term < last.Term {
+				return invalid("term is less than the last term %d", last.Term)
+			}
+		}
+		last = log.Meta
+	}
+	return nil
+}
+
+func (s *ValidatingLogStore) AppendLogs(logs []*pb.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.validate(logs); err != nil {
+		return err
+	}
+	// The logs may be partially appended on errors.
+	s.lastMeta = nil
+	if err := s.LogStore.AppendLogs(logs); err != nil {
+		return err
+	}
+	if len(logs) > 0 {
+		s.lastMeta = logs[len(logs)-1].Meta.Copy()
+	}
+	return nil
+}
+
+// RetainsLogs implements LogStoreRetention by reporting whether the underlying
+// LogStore retains the logs.
+func (s *ValidatingLogStore) RetainsLogs() bool {
+	return logStoreRetainsLogs(s.LogStore)
+}
+
+func (s *ValidatingLogStore) TrimPrefix(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// All logs may be evicted.
+	s.lastMeta = nil
+	return s.LogStore.TrimPrefix(index)
+}
+
+func (s *ValidatingLogStore) TrimSuffix(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastMeta = nil
+	return s.LogStore.TrimSuffix(index)
+}
+
+func (s *ValidatingLogStore) Entries(firstIndex, lastIndex uint64) ([]*pb.Log, error) {
+	return logStoreEntries(s.LogStore, firstIndex, lastIndex)
+}
@@ -0,0 +1,661 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sumimakito/raft/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	walSegmentExt = ".wal"
+
+	// walRecordHeaderSize is the size of a record header which consists of the
+	// payload length (4 bytes), the CRC of the record type and the payload
+	// (4 bytes), and the record type (1 byte).
+	walRecordHeaderSize = 9
+
+	defaultWALSegmentSize = 64 << 20
+)
+
+type walRecordType uint8
+
+const (
+	walRecordEntry walRecordType = 1 + iota
+	walRecordTrimPrefix
+	walRecordTrimSuffix
+)
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+type walLogStoreOptions struct {
+	segmentSize int64
+	readOnly    bool
+}
+
+type WALLogStoreOption func(options *walLogStoreOptions)
+
+func defaultWALLogStoreOptions() *walLogStoreOptions {
+	return &walLogStoreOptions{
+		segmentSize: defaultWALSegmentSize,
+	}
+}
+
+// WALSegmentSizeOption sets the size of the segment files. Segment files are
+// pre-allocated with the size and a new segment is started once the active
+// segment is full.
+func WALSegmentSizeOption(size int64) WALLogStoreOption {
+	return func(options *walLogStoreOptions) {
+		options.segmentSize = size
+	}
+}
+
+// WALReadOnlyOption opens the WALLogStore read-only, e.g., to inspect the
+// logs of a stopped server. The segments are left as is: a torn tail is
+// skipped instead of being discarded, and no segment is created. Operations
+// that modify the logs fail with ErrReadOnlyLogStore.
+func WALReadOnlyOption() WALLogStoreOption {
+	return func(options *walLogStoreOptions) {
+		options.readOnly = true
+	}
+}
+
+type walSegment struct {
+	seq  uint64
+	file *os.File
+	// size is the number of bytes occupied by valid records.
+	size int64
+	// maxIndex is the largest log index ever appended to the segment.
+	maxIndex uint64
+}
+
+// walEntry locates a log entry's record in the segments.
+type walEntry struct {
+	index   uint64
+	logType pb.LogType
+	segment *walSegment
+	offset  int64
+	// length is the length of the record including the header.
+	length int64
+}
+
+// WALLogStore is a LogStore that writes logs to a write-ahead log made of
+// fixed-size segment files. Every record is protected by a CRC. Appends and
+// trims are recorded as records and replayed when the WALLogStore is opened.
+// TrimPrefix releases disk space by deleting the segments that only contain
+// the trimmed logs. It's used with a FileStateStore by the WALStore.
+type WALLogStore struct {
+	dir  string
+	opts *walLogStoreOptions
+
+	mu           sync.RWMutex // protects segments, entries, and syncObserver
+	segments     []*walSegment
+	entries      []walEntry // sorted by index
+	syncObserver func(d time.Duration)
+}
+
+// NewWALLogStore opens or creates a WALLogStore in dir.
+func NewWALLogStore(dir string, opts ...WALLogStoreOption) (*WALLogStore, error) {
+	options := defaultWALLogStoreOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+	if !options.readOnly {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	s := &WALLogStore{dir: dir, opts: options}
+	if err := s.open(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func walSegmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, walSegmentExt)
+}
+
+func (s *WALLogStore) open() error {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var seqs []uint64
+	for _, e := range dirEntries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), walSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	flag := os.O_RDWR
+	if s.opts.readOnly {
+		flag = os.O_RDONLY
+	}
+	for i, seq := range seqs {
+		file, err := os.OpenFile(filepath.Join(s.dir, walSegmentName(seq)), flag, 0600)
+		if err != nil {
+			return err
+		}
+		segment := &walSegment{seq: seq, file: file}
+		s.segments = append(s.segments, segment)
+		if err := s.replay(segment, i == len(seqs)-1); err != nil {
+			return err
+		}
+	}
+
+	if len(s.segments) == 0 && !s.opts.readOnly {
+		if _, err := s.createSegment(1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay reads all records in the segment and applies them to the entries.
+// A torn record at the tail of the last segment is discarded.
+func (s *WALLogStore) replay(segment *walSegment, last bool) error {
+	if _, err := segment.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	info, err := segment.file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(segment.file)
+	header := make([]byte, walRecordHeaderSize)
+	var offset int64
+	for {
+		recordType, payload, err := s.readRecord(reader, header, info.Size()-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !last {
+				return errors.Wrapf(err, "segment %s at offset %d", walSegmentName(segment.seq), offset)
+			}
+			if s.opts.readOnly {
+				break
+			}
+			// The tail of the last segment may be torn by an interrupted write.
+			// Discard it and pre-allocate the space again.
+			if err := segment.file.Truncate(offset); err != nil {
+				return err
+			}
+			if offset < s.opts.segmentSize {
+				if err := segment.file.Truncate(s.opts.segmentSize); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err := s.applyRecord(segment, offset, int64(len(payload)), recordType, payload); err != nil {
+			return err
+		}
+		offset += walRecordHeaderSize + int64(len(payload))
+	}
+	segment.size = offset
+	return nil
+}
+
+// readRecord reads the next record, which must fit in the remaining bytes of
+// the segment. io.EOF is returned when the end of the records is reached.
+func (s *WALLogStore) readRecord(reader io.Reader, header []byte, remaining int64) (walRecordType, []byte, error) {
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			if walZeroed(header[:n]) {
+				// Reached the end of a segment that is not large enough to
+				// hold another record header.
+				return 0, nil, io.EOF
+			}
+			return 0, nil, ErrCorruptedLog
+		}
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	recordType := walRecordType(header[8])
+	if length == 0 && checksum == 0 && recordType == 0 {
+		// Reached the pre-allocated space.
+		return 0, nil, io.EOF
+	}
+	if int64(length) > remaining-walRecordHeaderSize {
+		// The length is damaged, or the record is torn.
+		return 0, nil, ErrCorruptedLog
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil, ErrCorruptedLog
+		}
+		return 0, nil, err
+	}
+	crc := crc32.Update(crc32.Checksum(header[8:9], walCRCTable), walCRCTable, payload)
+	if crc != checksum {
+		return 0, nil, ErrCorruptedLog
+	}
+	return recordType, payload, nil
+}
+
+func walZeroed(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *WALLogStore) applyRecord(
+	segment *walSegment, offset, payloadLength int64, recordType walRecordType, payload []byte,
+) error {
+	switch recordType {
+	case walRecordEntry:
+		var log pb.Log
+		if err := proto.Unmarshal(payload, &log); err != nil {
+			return err
+		}
+		s.putEntry(walEntry{
+			index:   log.Meta.Index,
+			logType: log.Body.Type,
+			segment: segment,
+			offset:  offset,
+			length:  walRecordHeaderSize + payloadLength,
+		})
+		if log.Meta.Index > segment.maxIndex {
+			segment.maxIndex = log.Meta.Index
+		}
+	case walRecordTrimPrefix:
+		s.trimPrefixEntries(binary.BigEndian.Uint64(payload))
+	case walRecordTrimSuffix:
+		s.trimSuffixEntries(binary.BigEndian.Uint64(payload))
+	default:
+		return errors.Wrapf(ErrCorruptedLog, "unknown record type %d", recordType)
+	}
+	return nil
+}
+
+func (s *WALLogStore) putEntry(e walEntry) {
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].index >= e.index })
+	if i < len(s.entries) && s.entries[i].index == e.index {
+		s.entries[i] = e
+		return
+	}
+	s.entries = append(s.entries, walEntry{})
+	copy(s.entries[i+1:], s.entries[i:])
+	s.entries[i] = e
+}
+
+func (s *WALLogStore) trimPrefixEntries(index uint64) {
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].index >= index })
+	s.entries = append([]walEntry(nil), s.entries[i:]...)
+}
+
+func (s *WALLogStore) trimSuffixEntries(index uint64) {
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].index > index })
+	s.entries = append([]walEntry(nil), s.entries[:i]...)
+}
+
+func (s *WALLogStore) createSegment(seq uint64) (*walSegment, error) {
+	file, err := os.OpenFile(filepath.Join(s.dir, walSegmentName(seq)), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// Pre-allocate the segment.
+	if err := file.Truncate(s.opts.segmentSize); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := s.syncDir(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	segment := &walSegment{seq: seq, file: file}
+	s.segments = append(s.segments, segment)
+	return segment, nil
+}
+
+func (s *WALLogStore) syncDir() error {
+	return syncDir(s.dir)
+}
+
+// SetSyncObserver sets the function the durations of the syncs are reported
+// to.
+func (s *WALLogStore) SetSyncObserver(observer func(d time.Duration)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncObserver = observer
+}
+
+// syncFile syncs the file and reports the duration to the syncObserver.
+// s.mu must be held.
+func (s *WALLogStore) syncFile(file *os.File) error {
+	start := time.Now()
+	err := file.Sync()
+	if s.syncObserver != nil {
+		s.syncObserver(time.Since(start))
+	}
+	return err
+}
+
+func (s *WALLogStore) activeSegment() *walSegment {
+	return s.segments[len(s.segments)-1]
+}
+
+func encodeWALRecord(recordType walRecordType, payload []byte) []byte {
+	record := make([]byte, walRecordHeaderSize+len(payload))
+	record[8] = byte(recordType)
+	copy(record[walRecordHeaderSize:], payload)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], walCRCTable))
+	return record
+}
+
+// writeRecordLocked writes the record to the active segment and returns the
+// segment and the offset of the record. A new segment is started if the active
+// segment has no space left for the record.
+func (s *WALLogStore) writeRecordLocked(record []byte) (*walSegment, int64, error) {
+	segment := s.activeSegment()
+	if segment.size > 0 && segment.size+int64(len(record)) > s.opts.segmentSize {
+		if err := s.syncFile(segment.file); err != nil {
+			return nil, 0, err
+		}
+		next, err := s.createSegment(segment.seq + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		segment = next
+	}
+	offset := segment.size
+	if _, err := segment.file.WriteAt(record, offset); err != nil {
+		return nil, 0, err
+	}
+	segment.size += int64(len(record))
+	return segment, offset, nil
+}
+
+func (s *WALLogStore) readEntryLocked(e walEntry) (*pb.Log, error) {
+	header := make([]byte, walRecordHeaderSize)
+	remaining := e.segment.size - e.offset
+	recordType, payload, err := s.readRecord(io.NewSectionReader(e.segment.file, e.offset, remaining), header, remaining)
+	if err != nil {
+		if err == io.EOF {
+			err = ErrCorruptedLog
+		}
+		return nil, errors.Wrapf(err, "segment %s at offset %d", walSegmentName(e.segment.seq), e.offset)
+	}
+	if recordType != walRecordEntry {
+		return nil, errors.Wrapf(ErrCorruptedLog, "unexpected record type %d", recordType)
+	}
+	var log pb.Log
+	if err := proto.Unmarshal(payload, &log); err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
+func (s *WALLogStore) AppendLogs(logs []*pb.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.readOnly {
+		return ErrReadOnlyLogStore
+	}
+
+	appended := make([]walEntry, 0, len(logs))
+	for _, log := range logs {
+		payload, err := proto.Marshal(log)
+		if err != nil {
+			return err
+		}
+		record := encodeWALRecord(walRecordEntry, payload)
+		segment, offset, err := s.writeRecordLocked(record)
+		if err != nil {
+			return err
+		}
+		appended = append(appended, walEntry{
+			index:   log.Meta.Index,
+			logType: log.Body.Type,
+			segment: segment,
+			offset:  offset,
+			length:  int64(len(record)),
+		})
+	}
+	if err := s.syncFile(s.activeSegment().file); err != nil {
+		return err
+	}
+	for _, e := range appended {
+		s.putEntry(e)
+		if e.index > e.segment.maxIndex {
+			e.segment.maxIndex = e.index
+		}
+	}
+	return nil
+}
+
+// RetainsLogs implements LogStoreRetention. The logs are encoded as they are
+// appended.
+func (s *WALLogStore) RetainsLogs() bool {
+	return false
+}
+
+func (s *WALLogStore) TrimPrefix(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.readOnly {
+		return ErrReadOnlyLogStore
+	}
+
+	if len(s.entries) == 0 || s.entries[0].index >= index {
+		return nil
+	}
+	if _, _, err := s.writeRecordLocked(encodeWALRecord(walRecordTrimPrefix, EncodeUint64(index))); err != nil {
+		return err
+	}
+	if err := s.syncFile(s.activeSegment().file); err != nil {
+		return err
+	}
+	s.trimPrefixEntries(index)
+
+	// Delete the segments that only contain trimmed logs.
+	n := 0
+	for _, segment := range s.segments[:len(s.segments)-1] {
+		if segment.maxIndex >= index {
+			break
+		}
+		if err := segment.file.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(s.dir, walSegmentName(segment.seq))); err != nil {
+			return err
+		}
+		n++
+	}
+	if n > 0 {
+		s.segments = append([]*walSegment(nil), s.segments[n:]...)
+		return s.syncDir()
+	}
+	return nil
+}
+
+func (s *WALLogStore) TrimSuffix(index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.readOnly {
+		return ErrReadOnlyLogStore
+	}
+
+	if len(s.entries) == 0 || s.entries[len(s.entries)-1].index <= index {
+		return nil
+	}
+	if _, _, err := s.writeRecordLocked(encodeWALRecord(walRecordTrimSuffix, EncodeUint64(index))); err != nil {
+		return err
+	}
+	if err := s.syncFile(s.activeSegment().file); err != nil {
+		return err
+	}
+	s.trimSuffixEntries(index)
+	return nil
+}
+
+func (s *WALLogStore) FirstIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.entries) == 0 {
+		return 0, nil
+	}
+	return s.entries[0].index, nil
+}
+
+func (s *WALLogStore) LastIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.entries) == 0 {
+		return 0, nil
+	}
+	return s.entries[len(s.entries)-1].index, nil
+}
+
+func (s *WALLogStore) Entry(index uint64) (*pb.Log, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].index >= index })
+	if i == len(s.entries) || s.entries[i].index != index {
+		return nil, nil
+	}
+	return s.readEntryLocked(s.entries[i])
+}
+
+func (s *WALLogStore) Entries(firstIndex, lastIndex uint64) ([]*pb.Log, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].index >= firstIndex })
+	var logs []*pb.Log
+	for ; i < len(s.entries) && s.entries[i].index <= lastIndex; i++ {
+		log, err := s.readEntryLocked(s.entries[i])
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, log)
+	}
+	return logs, nil
+}
+
+func (s *WALLogStore) LastEntry(t pb.LogType) (*pb.Log, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if t == 0 || s.entries[i].logType == t {
+			return s.readEntryLocked(s.entries[i])
+		}
+	}
+	return nil, nil
+}
+
+// Compact rewrites the live records into new segments and deletes the old
+// segments to reclaim the disk space occupied by overwritten and trimmed logs.
+func (s *WALLogStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.readOnly {
+		return ErrReadOnlyLogStore
+	}
+
+	n := len(s.segments)
+	// Start a new segment so that the live records are rewritten after all
+	// existing records. Replaying the old segments before the new ones still
+	// results in the same logs if the compaction is interrupted.
+	if _, err := s.createSegment(s.activeSegment().seq + 1); err != nil {
+		return err
+	}
+	entries := make([]walEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		record := make([]byte, e.length)
+		if _, err := e.segment.file.ReadAt(record, e.offset); err != nil {
+			return err
+		}
+		segment, offset, err := s.writeRecordLocked(record)
+		if err != nil {
+			return err
+		}
+		if e.index > segment.maxIndex {
+			segment.maxIndex = e.index
+		}
+		entries = append(entries, walEntry{
+			index:   e.index,
+			logType: e.logType,
+			segment: segment,
+			offset:  offset,
+			length:  e.length,
+		})
+	}
+	if err := s.syncFile(s.activeSegment().file); err != nil {
+		return err
+	}
+	s.entries = entries
+
+	for _, segment := range s.segments[:n] {
+		if err := segment.file.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(s.dir, walSegmentName(segment.seq))); err != nil {
+			return err
+		}
+	}
+	s.segments = append([]*walSegment(nil), s.segments[n:]...)
+	return s.syncDir()
+}
+
+func (s *WALLogStore) StorageStats() (StorageStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sizeBytes, liveBytes int64
+	for _, segment := range s.segments {
+		info, err := segment.file.Stat()
+		if err != nil {
+			return StorageStats{}, err
+		}
+		sizeBytes += info.Size()
+		// The unused tail of a segment is not reclaimable by compaction and is
+		// therefore not counted as fragmentation.
+		if free := info.Size() - segment.size; free > 0 {
+			liveBytes += free
+		}
+	}
+	for _, e := range s.entries {
+		liveBytes += e.length
+	}
+	return newStorageStats(sizeBytes, liveBytes), nil
+}
+
+func (s *WALLogStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lastErr error
+	for _, segment := range s.segments {
+		if err := segment.file.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	s.segments = nil
+	return lastErr
+}
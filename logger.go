@@ -7,18 +7,30 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+// logFields prepends the states of the server to keysAndValues. The states are
+// only read when an entry is actually written, so that the disabled levels cost
+// little.
 func logFields(server *Server, keysAndValues ...interface{}) []interface{} {
-	lastApplied := server.lastApplied()
-	return append([]interface{}{
-		zap.Any("server", server.Info()),
-		zap.String("role", server.role().String()),
-		zap.Uint64("term", server.currentTerm()),
-		zap.Uint64("commit_index", server.commitIndex()),
-		zap.Uint64("first_log_index", server.firstLogIndex()),
-		zap.Uint64("last_log_index", server.lastLogIndex()),
-		zap.Uint64("last_applied_index", lastApplied.Index),
-		zap.Uint64("last_applied_term", lastApplied.Term),
-	}, keysAndValues...)
+	return append([]interface{}{zap.Inline(serverStates{server})}, keysAndValues...)
+}
+
+type serverStates struct {
+	server *Server
+}
+
+func (s serverStates) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	lastApplied := s.server.lastApplied()
+	if err := enc.AddReflected("server", s.server.Info()); err != nil {
+		return err
+	}
+	enc.AddString("role", s.server.role().String())
+	enc.AddUint64("term", s.server.currentTerm())
+	enc.AddUint64("commit_index", s.server.commitIndex())
+	enc.AddUint64("first_log_index", s.server.firstLogIndex())
+	enc.AddUint64("last_log_index", s.server.lastLogIndex())
+	enc.AddUint64("last_applied_index", lastApplied.Index)
+	enc.AddUint64("last_applied_term", lastApplied.Term)
+	return nil
 }
 
 func serverLogger(logLevel zapcore.Level) *zap.SugaredLogger {
@@ -1,17 +1,178 @@
 package raft
 
 import (
+	"runtime"
 	"time"
 )
 
 const (
 	MetricGoroutines = "goroutines"
+
+	// MetricLogAppendLatency is the time.Duration taken by each append to the
+	// LogStore.
+	MetricLogAppendLatency = "log_append_latency"
+	// MetricLogAppendBatchSize is the number of logs in each append to the
+	// LogStore.
+	MetricLogAppendBatchSize = "log_append_batch_size"
+	// MetricLogReadLatency is the time.Duration taken by each read from the
+	// LogStore.
+	MetricLogReadLatency = "log_read_latency"
+	// MetricLogSyncLatency is the time.Duration taken by each sync of the
+	// LogStore if it implements LogStoreSyncObserverSetter.
+	MetricLogSyncLatency = "log_sync_latency"
+	// MetricLogStorageSize is the disk space in bytes occupied by the
+	// StableStore if it implements LogStoreCompactor.
+	MetricLogStorageSize = "log_storage_size"
+	// MetricLogStorageLiveSize is the disk space in bytes holding live data in
+	// the StableStore if it implements LogStoreCompactor.
+	MetricLogStorageLiveSize = "log_storage_live_size"
+
+	// MetricTerm is the current term.
+	MetricTerm = "term"
+	// MetricRole is the ServerRole of the server as a number.
+	MetricRole = "role"
+	// MetricCommitIndex is the commit index.
+	MetricCommitIndex = "commit_index"
+	// MetricAppliedIndex is the index of the last log applied to the
+	// StateMachine.
+	MetricAppliedIndex = "applied_index"
+	// MetricLastLogIndex is the index of the last log.
+	MetricLastLogIndex = "last_log_index"
+	// MetricQueueLogOps is the number of the log operations waiting for the
+	// main loop.
+	MetricQueueLogOps = "queue_log_ops"
+	// MetricQueueCommit is the number of the commit index updates waiting for
+	// the main loop.
+	MetricQueueCommit = "queue_commit"
+	// MetricQueueTransportRPC is the number of the incoming RPCs waiting for
+	// the main loop.
+	MetricQueueTransportRPC = "queue_transport_rpc"
+	// MetricApplyBacklog is the number of the committed logs yet to be
+	// applied.
+	MetricApplyBacklog = "apply_backlog"
+	// MetricHealthy is 1 if the server is healthy by Server.Health, or 0
+	// otherwise.
+	MetricHealthy = "healthy"
+	// MetricElections is the number of the elections started by the server,
+	// recorded as 1 on each election.
+	MetricElections = "elections"
+	// MetricApplyLatency is the time.Duration taken by each StateMachine.Apply.
+	MetricApplyLatency = "apply_latency"
+	// MetricRPCAppendEntriesLatency is the time.Duration taken to handle each
+	// incoming AppendEntries RPC.
+	MetricRPCAppendEntriesLatency = "rpc_append_entries_latency"
+	// MetricRPCRequestVoteLatency is the time.Duration taken to handle each
+	// incoming RequestVote RPC.
+	MetricRPCRequestVoteLatency = "rpc_request_vote_latency"
+	// MetricRPCInstallSnapshotLatency is the time.Duration taken to handle each
+	// incoming InstallSnapshot RPC.
+	MetricRPCInstallSnapshotLatency = "rpc_install_snapshot_latency"
+	// MetricSnapshotTakeDuration is the time.Duration taken by each snapshot.
+	MetricSnapshotTakeDuration = "snapshot_take_duration"
+	// MetricSnapshotRestoreDuration is the time.Duration taken by each
+	// restoration of a snapshot.
+	MetricSnapshotRestoreDuration = "snapshot_restore_duration"
 )
 
+// metricCounters are the metrics whose values are added up by the exporters.
+var metricCounters = map[string]struct{}{
+	MetricElections: {},
+}
+
+// metricDurationBuckets are the upper bounds in seconds of the histogram
+// buckets of the durations.
+var metricDurationBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// metricHistograms are the metrics other than the durations that are recorded
+// on each event, mapped to the upper bounds of their histogram buckets.
+var metricHistograms = map[string][]float64{
+	MetricLogAppendBatchSize: {1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048, 4096},
+}
+
+// metricsInterval is the interval between recordings of the gauge metrics.
+const metricsInterval = 5 * time.Second
+
+// MetricsExporter receives the metrics recorded by the server. The values are
+// integers, float64, or time.Duration. Record is called concurrently and must
+// not block. The durations, e.g., the latencies, and the sizes, e.g.,
+// MetricLogAppendBatchSize, are recorded on each event, the counters, e.g.,
+// MetricElections, are recorded as increments, and the gauges, e.g.,
+// MetricTerm, are recorded periodically.
 type MetricsExporter interface {
 	Record(time time.Time, name string, value interface{})
 }
 
+// NopMetricsExporter is a MetricsExporter that drops all metrics.
+var NopMetricsExporter MetricsExporter = nopMetricsExporter{}
+
+type nopMetricsExporter struct{}
+
+func (nopMetricsExporter) Record(time.Time, string, interface{}) {}
+
+// metricFloat64 converts the value of a metric to a float64. Durations are
+// converted to seconds.
+func metricFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.Seconds(), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func (s *Server) recordMetric(name string, value interface{}) {
+	if s.opts().metricsExporter == nil {
+		return
+	}
+	s.opts().metricsExporter.Record(time.Now(), name, value)
+}
+
+// recordLatency records the time.Duration since start.
+func (s *Server) recordLatency(name string, start time.Time) {
+	s.recordMetric(name, time.Since(start))
+}
+
+// recordGauges records the gauge metrics.
+func (s *Server) recordGauges() {
+	s.recordMetric(MetricGoroutines, runtime.NumGoroutine())
+	s.recordMetric(MetricTerm, s.currentTerm())
+	s.recordMetric(MetricRole, uint32(s.role()))
+	s.recordMetric(MetricCommitIndex, s.commitIndex())
+	s.recordMetric(MetricAppliedIndex, s.lastApplied().Index)
+	s.recordMetric(MetricLastLogIndex, s.lastLogIndex())
+	s.recordMetric(MetricApplyBacklog, s.applyBacklog())
+	queues := s.QueueDepths()
+	s.recordMetric(MetricQueueLogOps, queues.LogOps.Length)
+	s.recordMetric(MetricQueueCommit, queues.Commit.Length)
+	s.recordMetric(MetricQueueTransportRPC, queues.TransportRPC.Length)
+	if s.healthy() {
+		s.recordMetric(MetricHealthy, 1)
+	} else {
+		s.recordMetric(MetricHealthy, 0)
+	}
+	if stats, err := s.StorageStats(); err == nil {
+		s.recordMetric(MetricLogStorageSize, stats.SizeBytes)
+		s.recordMetric(MetricLogStorageLiveSize, stats.LiveBytes)
+	}
+}
+
 type metricAggregator interface {
 	Metric() string
 	Aggregate() map[string]interface{}
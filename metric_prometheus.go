@@ -0,0 +1,138 @@
+package raft
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PrometheusExporter is a MetricsExporter that serves the metrics in the
+// Prometheus text exposition format. The durations are exposed as histograms in
+// seconds, the sizes recorded on each event, e.g., MetricLogAppendBatchSize, as
+// histograms, the counters as counters with the _total suffix, and the other
+// metrics as gauges. The histograms have fixed buckets. It is served by the API server at /metrics when set with
+// MetricsKeeperOption, and can be mounted elsewhere as an http.Handler.
+type PrometheusExporter struct {
+	namespace string
+
+	mu         sync.Mutex // protects the maps
+	gauges     map[string]float64
+	counters   map[string]float64
+	histograms map[string]*prometheusHistogram
+}
+
+type prometheusHistogram struct {
+	// seconds is set if the values are durations in seconds.
+	seconds bool
+	bounds  []float64
+	// counts are the numbers of the values in the buckets, which are not
+	// cumulative.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newPrometheusHistogram(bounds []float64, seconds bool) *prometheusHistogram {
+	return &prometheusHistogram{seconds: seconds, bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *prometheusHistogram) observe(v float64) {
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// NewPrometheusExporter returns a PrometheusExporter whose metric names are
+// prefixed with the namespace, e.g., "raft".
+func NewPrometheusExporter(namespace string) *PrometheusExporter {
+	return &PrometheusExporter{
+		namespace:  namespace,
+		gauges:     map[string]float64{},
+		counters:   map[string]float64{},
+		histograms: map[string]*prometheusHistogram{},
+	}
+}
+
+func (e *PrometheusExporter) Record(_ time.Time, name string, value interface{}) {
+	v, ok := metricFloat64(value)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if h, ok := e.histograms[name]; ok {
+		h.observe(v)
+		return
+	}
+	if _, ok := value.(time.Duration); ok {
+		h := newPrometheusHistogram(metricDurationBuckets, true)
+		h.observe(v)
+		e.histograms[name] = h
+		return
+	}
+	if bounds, ok := metricHistograms[name]; ok {
+		h := newPrometheusHistogram(bounds, false)
+		h.observe(v)
+		e.histograms[name] = h
+		return
+	}
+	if _, ok := metricCounters[name]; ok {
+		e.counters[name] += v
+		return
+	}
+	e.gauges[name] = v
+}
+
+func (e *PrometheusExporter) metricName(name string) string {
+	if e.namespace == "" {
+		return name
+	}
+	return e.namespace + "_" + name
+}
+
+func (e *PrometheusExporter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, name := range sortedKeys(e.gauges) {
+		metric := e.metricName(name)
+		fmt.Fprintf(rw, "# TYPE %s gauge\n%s %s\n", metric, metric, formatFloat(e.gauges[name]))
+	}
+	for _, name := range sortedKeys(e.counters) {
+		metric := e.metricName(name) + "_total"
+		fmt.Fprintf(rw, "# TYPE %s counter\n%s %s\n", metric, metric, formatFloat(e.counters[name]))
+	}
+	for _, name := range sortedKeys(e.histograms) {
+		h := e.histograms[name]
+		metric := e.metricName(name)
+		if h.seconds {
+			metric += "_seconds"
+		}
+		fmt.Fprintf(rw, "# TYPE %s histogram\n", metric)
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i]
+			fmt.Fprintf(rw, "%s_bucket{le=\"%s\"} %d\n", metric, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(rw, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n",
+			metric, h.count, metric, formatFloat(h.sum), metric, h.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
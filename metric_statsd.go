@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// StatsdExporter is a MetricsExporter that sends the metrics to a StatsD
+// server over UDP. The durations are sent as timers in milliseconds, the sizes
+// recorded on each event, e.g., MetricLogAppendBatchSize, as histograms, the
+// counters as counters, and the other metrics as gauges. The metrics failed to
+// be sent are dropped.
+type StatsdExporter struct {
+	prefix string
+	conn   net.Conn
+}
+
+// NewStatsdExporter returns a StatsdExporter sending to the address, whose
+// metric names are prefixed with the prefix and a dot if it is not empty.
+func NewStatsdExporter(address, prefix string) (*StatsdExporter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdExporter{prefix: prefix, conn: conn}, nil
+}
+
+func (e *StatsdExporter) Record(_ time.Time, name string, value interface{}) {
+	if line, ok := e.line(name, value); ok {
+		_, _ = e.conn.Write([]byte(line))
+	}
+}
+
+// line returns the StatsD line of the metric.
+func (e *StatsdExporter) line(name string, value interface{}) (string, bool) {
+	metricType := "g"
+	if _, ok := metricCounters[name]; ok {
+		metricType = "c"
+	} else if _, ok := metricHistograms[name]; ok {
+		metricType = "h"
+	}
+	if e.prefix != "" {
+		name = e.prefix + "." + name
+	}
+	if d, ok := value.(time.Duration); ok {
+		return fmt.Sprintf("%s:%s|ms", name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)), true
+	}
+	v, ok := metricFloat64(value)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%s:%s|%s", name, formatFloat(v), metricType), true
+}
+
+// Close closes the connection to the StatsD server.
+func (e *StatsdExporter) Close() error {
+	return e.conn.Close()
+}
@@ -0,0 +1,73 @@
+package raft
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusExporter(t *testing.T) {
+	exporter := NewPrometheusExporter("raft")
+	now := time.Now()
+	exporter.Record(now, MetricTerm, uint64(3))
+	exporter.Record(now, MetricTerm, uint64(4))
+	exporter.Record(now, MetricElections, 1)
+	exporter.Record(now, MetricElections, 1)
+	exporter.Record(now, MetricApplyLatency, 500*time.Millisecond)
+	exporter.Record(now, MetricApplyLatency, time.Second)
+	exporter.Record(now, MetricLogAppendBatchSize, 3)
+	exporter.Record(now, MetricLogAppendBatchSize, 64)
+	exporter.Record(now, "unsupported", "value")
+
+	rw := httptest.NewRecorder()
+	exporter.ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	body := rw.Body.String()
+	assert.True(t, strings.HasPrefix(body, "# TYPE raft_term gauge\nraft_term 4\n"+
+		"# TYPE raft_elections_total counter\nraft_elections_total 2\n"))
+	for _, line := range []string{
+		"# TYPE raft_apply_latency_seconds histogram\n",
+		"raft_apply_latency_seconds_bucket{le=\"0.25\"} 0\n",
+		"raft_apply_latency_seconds_bucket{le=\"0.5\"} 1\n",
+		"raft_apply_latency_seconds_bucket{le=\"1\"} 2\n",
+		"raft_apply_latency_seconds_bucket{le=\"+Inf\"} 2\n",
+		"raft_apply_latency_seconds_sum 1.5\n",
+		"raft_apply_latency_seconds_count 2\n",
+		// The batch sizes are not recorded as a gauge.
+		"# TYPE raft_log_append_batch_size histogram\n",
+		"raft_log_append_batch_size_bucket{le=\"2\"} 0\n",
+		"raft_log_append_batch_size_bucket{le=\"4\"} 1\n",
+		"raft_log_append_batch_size_bucket{le=\"64\"} 2\n",
+		"raft_log_append_batch_size_sum 67\n",
+		"raft_log_append_batch_size_count 2\n",
+	} {
+		assert.Contains(t, body, line)
+	}
+}
+
+func TestStatsdExporter(t *testing.T) {
+	conn := ƒAssertNoError2(net.ListenPacket("udp", "127.0.0.1:0"))(t)
+	defer conn.Close()
+	exporter := ƒAssertNoError2(NewStatsdExporter(conn.LocalAddr().String(), "raft"))(t)
+	defer exporter.Close()
+
+	buf := make([]byte, 512)
+	for _, c := range []struct {
+		name  string
+		value interface{}
+		line  string
+	}{
+		{MetricTerm, uint64(4), "raft.term:4|g"},
+		{MetricElections, 1, "raft.elections:1|c"},
+		{MetricApplyLatency, 1500 * time.Microsecond, "raft.apply_latency:1.5|ms"},
+		{MetricLogAppendBatchSize, 8, "raft.log_append_batch_size:8|h"},
+	} {
+		exporter.Record(time.Now(), c.name, c.value)
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _ := ƒAssertNoError3(conn.ReadFrom(buf))(t)
+		assert.Equal(t, c.line, string(buf[:n]))
+	}
+}
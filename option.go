@@ -1,34 +1,107 @@
 package raft
 
 import (
+	"crypto/tls"
+	"math"
+	"net"
+	"reflect"
 	"time"
 
+	"github.com/pkg/errors"
 	"go.uber.org/zap/zapcore"
 )
 
 type serverOptions struct {
-	apiServerListenAddress    string
-	apiExtensions             []APIExtension
-	electionTimeout           time.Duration
-	followerTimeout           time.Duration
-	logLevel                  zapcore.Level
-	maxTimerRandomOffsetRatio float64
-	metricsExporter           MetricsExporter
-	snapshotPolicy            SnapshotPolicy
+	announceEndpoint           bool
+	apiAuthenticator           APIAuthenticator
+	apiServerEnabled           bool
+	apiServerListenAddress     string
+	apiServerTLSConfig         *tls.Config
+	apiExtensions              []APIExtension
+	applyErrorPolicy           ApplyErrorPolicy
+	applyOrderCheck            bool
+	auditLog                   AuditLog
+	backpressurePolicy         BackpressurePolicy
+	catchUpPolicy              CatchUpPolicy
+	clock                      Clock
+	commandCodec               Codec
+	deadServerPolicy           DeadServerPolicy
+	debugToken                 string
+	electionTimeout            time.Duration
+	followerTimeout            time.Duration
+	groupCommitMaxBatch        int
+	groupCommitMaxLatency      time.Duration
+	healthPolicy               HealthPolicy
+	heartbeatInterval          time.Duration
+	logCacheCapacity           int
+	logCheckPolicy             LogCheckPolicy
+	logCheckWindow             uint64
+	logCompactionPolicy        LogCompactionPolicy
+	logCorruptionPolicy        LogCorruptionPolicy
+	logLevel                   zapcore.Level
+	maxTimerRandomOffsetRatio  float64
+	metricsExporter            MetricsExporter
+	queryHandler               QueryHandler
+	randSeed                   *int64
+	recoveryFile               string
+	rejectUnknownPeers         bool
+	replicationBatchSize       int
+	retryPolicy                RetryPolicy
+	sessionCapacity            int
+	slowOpThresholds           SlowOpThresholds
+	snapshotInstallConcurrency int
+	snapshotPolicy             SnapshotPolicy
+	snapshotProgress           func(SnapshotProgress)
+	snapshotRetentionPolicy    SnapshotRetentionPolicy
+	tracer                     Tracer
 }
 
 type ServerOption func(options *serverOptions)
 
 func defaultServerOptions() *serverOptions {
 	return &serverOptions{
-		apiServerListenAddress:    "",
-		apiExtensions:             []APIExtension{},
-		electionTimeout:           1000 * time.Millisecond,
-		followerTimeout:           1000 * time.Millisecond,
-		logLevel:                  zapcore.InfoLevel,
-		maxTimerRandomOffsetRatio: 0.3,
-		metricsExporter:           nil,
-		snapshotPolicy:            SnapshotPolicy{Applies: 10, Interval: 1 * time.Second},
+		announceEndpoint:           false,
+		apiAuthenticator:           nil,
+		apiServerEnabled:           true,
+		apiServerListenAddress:     "",
+		apiServerTLSConfig:         nil,
+		apiExtensions:              []APIExtension{},
+		applyErrorPolicy:           ApplyErrorHalt,
+		applyOrderCheck:            false,
+		auditLog:                   nil,
+		backpressurePolicy:         BackpressurePolicy{},
+		catchUpPolicy:              CatchUpPolicy{MaxTrailingLogs: 256, Timeout: 30 * time.Second},
+		clock:                      SystemClock,
+		commandCodec:               MsgpackCodec,
+		deadServerPolicy:           DeadServerPolicy{},
+		debugToken:                 "",
+		electionTimeout:            1000 * time.Millisecond,
+		followerTimeout:            1000 * time.Millisecond,
+		groupCommitMaxBatch:        64,
+		groupCommitMaxLatency:      0,
+		healthPolicy:               HealthPolicy{StorageStallTimeout: 5 * time.Second, MaxApplyBacklog: 1024},
+		heartbeatInterval:          100 * time.Millisecond,
+		logCacheCapacity:           0,
+		logCheckPolicy:             LogCheckFail,
+		logCheckWindow:             4096,
+		logCompactionPolicy:        LogCompactionPolicy{},
+		logCorruptionPolicy:        LogCorruptionPanic,
+		logLevel:                   zapcore.InfoLevel,
+		maxTimerRandomOffsetRatio:  0.3,
+		metricsExporter:            nil,
+		queryHandler:               nil,
+		randSeed:                   nil,
+		recoveryFile:               "",
+		rejectUnknownPeers:         false,
+		replicationBatchSize:       0,
+		retryPolicy:                defaultRetryPolicy,
+		sessionCapacity:            1024,
+		slowOpThresholds:           defaultSlowOpThresholds,
+		snapshotInstallConcurrency: 2,
+		snapshotPolicy:             SnapshotPolicy{Applies: 10, Interval: 1 * time.Second},
+		snapshotProgress:           nil,
+		snapshotRetentionPolicy:    SnapshotRetentionPolicy{},
+		tracer:                     nil,
 	}
 }
 
@@ -40,44 +113,591 @@ func applyServerOpts(opts ...ServerOption) *serverOptions {
 	return options
 }
 
+// newRand returns the random number generator seeded with randSeed.
+func (o *serverOptions) newRand() *lockedRand {
+	if o.randSeed != nil {
+		return newLockedRand(*o.randSeed)
+	}
+	return newLockedRand(time.Now().UnixNano())
+}
+
+// invalidOption returns an error wrapping ErrInvalidOption.
+func invalidOption(format string, args ...interface{}) error {
+	return errors.Wrapf(ErrInvalidOption, format, args...)
+}
+
+// validate reports the first option that the server cannot work with.
+func (o *serverOptions) validate() error {
+	if o.apiServerListenAddress != "" {
+		if _, _, err := net.SplitHostPort(o.apiServerListenAddress); err != nil {
+			return invalidOption("API server listen address %q: %v", o.apiServerListenAddress, err)
+		}
+	}
+	for i, extension := range o.apiExtensions {
+		if extension == nil {
+			return invalidOption("API extension #%d is nil", i)
+		}
+	}
+	switch o.applyErrorPolicy {
+	case ApplyErrorContinue, ApplyErrorUnhealthy, ApplyErrorHalt:
+	default:
+		return invalidOption("unknown ApplyErrorPolicy %d", o.applyErrorPolicy)
+	}
+	if err := o.catchUpPolicy.validate(); err != nil {
+		return invalidOption("%v", err)
+	}
+	if o.clock == nil {
+		return invalidOption("Clock is nil")
+	}
+	if o.commandCodec == nil {
+		return invalidOption("command Codec is nil")
+	}
+	if err := o.deadServerPolicy.validate(); err != nil {
+		return invalidOption("%v", err)
+	}
+	if t := o.deadServerPolicy.Threshold; t > 0 && t < o.followerTimeout {
+		return invalidOption("dead server threshold %v is shorter than the follower timeout %v", t, o.followerTimeout)
+	}
+	if o.electionTimeout <= 0 {
+		return invalidOption("election timeout %v is not positive", o.electionTimeout)
+	}
+	if o.followerTimeout <= 0 {
+		return invalidOption("follower timeout %v is not positive", o.followerTimeout)
+	}
+	if o.groupCommitMaxLatency < 0 {
+		return invalidOption("group commit max latency %v is negative", o.groupCommitMaxLatency)
+	}
+	// The main loop is blocked while the batch is collected.
+	if l := o.groupCommitMaxLatency; l > groupCommitMaxLatencyLimit || l >= o.heartbeatInterval {
+		return invalidOption("group commit max latency %v is not within %v and shorter than the heartbeat interval %v",
+			l, groupCommitMaxLatencyLimit, o.heartbeatInterval)
+	}
+	if err := o.healthPolicy.validate(); err != nil {
+		return invalidOption("%v", err)
+	}
+	if o.logCacheCapacity < 0 {
+		return invalidOption("log cache capacity %d is negative", o.logCacheCapacity)
+	}
+	switch o.logCheckPolicy {
+	case LogCheckFail, LogCheckTruncate, LogCheckDisabled:
+	default:
+		return invalidOption("unknown LogCheckPolicy %d", o.logCheckPolicy)
+	}
+	if p := o.logCompactionPolicy; p.RetainBytes < 0 || p.RetainDuration < 0 {
+		return invalidOption("negative retention in the LogCompactionPolicy")
+	}
+	switch o.logCorruptionPolicy {
+	case LogCorruptionPanic, LogCorruptionTruncate, LogCorruptionReport:
+	default:
+		return invalidOption("unknown LogCorruptionPolicy %d", o.logCorruptionPolicy)
+	}
+	if o.logLevel < zapcore.DebugLevel || o.logLevel > zapcore.FatalLevel {
+		return invalidOption("unknown log level %d", o.logLevel)
+	}
+	if r := o.maxTimerRandomOffsetRatio; r < 0 || math.IsNaN(r) || math.IsInf(r, 0) {
+		return invalidOption("timer random offset ratio %v is not a non-negative number", r)
+	}
+	if o.heartbeatInterval <= 0 {
+		return invalidOption("heartbeat interval %v is not positive", o.heartbeatInterval)
+	}
+	// The heartbeats are delayed by the random offset at most.
+	maxHeartbeatInterval := time.Duration(float64(o.heartbeatInterval) * (1 + o.maxTimerRandomOffsetRatio))
+	if maxHeartbeatInterval >= o.electionTimeout || maxHeartbeatInterval >= o.followerTimeout {
+		return invalidOption("heartbeat interval %v (up to %v with the random offset) is not shorter than "+
+			"the election timeout %v and the follower timeout %v",
+			o.heartbeatInterval, maxHeartbeatInterval, o.electionTimeout, o.followerTimeout)
+	}
+	if o.replicationBatchSize < 0 {
+		return invalidOption("replication batch size %d is negative", o.replicationBatchSize)
+	}
+	if o.retryPolicy == nil {
+		return invalidOption("RetryPolicy is nil")
+	}
+	if o.sessionCapacity <= 0 {
+		return invalidOption("session capacity %d is not positive", o.sessionCapacity)
+	}
+	if t := o.slowOpThresholds; t.LogAppend < 0 || t.LogSync < 0 || t.Apply < 0 || t.SnapshotWrite < 0 {
+		return invalidOption("negative thresholds in the SlowOpThresholds")
+	}
+	if o.snapshotInstallConcurrency < 0 {
+		return invalidOption("snapshot install concurrency %d is negative", o.snapshotInstallConcurrency)
+	}
+	if err := o.snapshotPolicy.validate(); err != nil {
+		return invalidOption("%v", err)
+	}
+	if p := o.snapshotRetentionPolicy; p.Count < 0 || p.MaxAge < 0 {
+		return invalidOption("negative limits in the SnapshotRetentionPolicy")
+	}
+	return nil
+}
+
+// copyTunables copies the options that can be changed at runtime from src.
+func (o *serverOptions) copyTunables(src *serverOptions) {
+	o.electionTimeout = src.electionTimeout
+	o.followerTimeout = src.followerTimeout
+	o.groupCommitMaxBatch = src.groupCommitMaxBatch
+	o.groupCommitMaxLatency = src.groupCommitMaxLatency
+	o.heartbeatInterval = src.heartbeatInterval
+	o.logCompactionPolicy = src.logCompactionPolicy
+	o.replicationBatchSize = src.replicationBatchSize
+	o.snapshotPolicy = src.snapshotPolicy
+	o.snapshotRetentionPolicy = src.snapshotRetentionPolicy
+}
+
+// sameFunc reports whether the funcs a and b are the same function.
+func sameFunc(a, b interface{}) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+func (s *Server) opts() *serverOptions {
+	return s.options.Load().(*serverOptions)
+}
+
+// UpdateOptions changes the options of the server at runtime. Only the
+// following options can be changed, and the changes take effect on their next
+// use, e.g., the next election or heartbeat:
+//
+//   - ElectionTimeoutOption
+//   - FollowerTimeoutOption
+//   - GroupCommitOption
+//   - HeartbeatIntervalOption
+//   - LogCompactionPolicyOption
+//   - ReplicationBatchSizeOption
+//   - SnapshotPolicyOption
+//   - SnapshotRetentionPolicyOption
+//
+// The options are validated as in NewServer. An error wrapping
+// ErrInvalidOption is returned, and no options are changed, if the options are
+// invalid or change anything else.
+func (s *Server) UpdateOptions(opts ...ServerOption) error {
+	s.optionsMu.Lock()
+	defer s.optionsMu.Unlock()
+
+	current := s.opts()
+	next := *current
+	next.apiExtensions = append([]APIExtension{}, current.apiExtensions...)
+	for _, opt := range opts {
+		opt(&next)
+	}
+	if err := next.validate(); err != nil {
+		return err
+	}
+
+	// Everything but the tunables must stay the same.
+	check, base := next, *current
+	check.copyTunables(current)
+	if !sameFunc(check.apiAuthenticator, base.apiAuthenticator) || !sameFunc(check.queryHandler, base.queryHandler) {
+		return invalidOption("only the tunable options can be changed at runtime")
+	}
+	check.apiAuthenticator, base.apiAuthenticator = nil, nil
+	check.queryHandler, base.queryHandler = nil, nil
+	if !reflect.DeepEqual(check, base) {
+		return invalidOption("only the tunable options can be changed at runtime")
+	}
+
+	s.options.Store(&next)
+	s.logger.Infow("options updated", logFields(s,
+		"election_timeout", next.electionTimeout,
+		"follower_timeout", next.followerTimeout,
+		"heartbeat_interval", next.heartbeatInterval,
+		"replication_batch_size", next.replicationBatchSize)...)
+	return nil
+}
+
+// AnnounceEndpointOption toggles the update of the endpoint of the server in
+// the configuration when it starts with an endpoint other than the one there,
+// e.g., after it's redeployed on another host. The server retries updating
+// the endpoint with UpdatePeer in the background until it succeeds. When
+// disabled, NewServer returns ErrEndpointChanged in that case. Defaults to
+// disabled.
+func AnnounceEndpointOption(enabled bool) ServerOption {
+	return func(options *serverOptions) {
+		options.announceEndpoint = enabled
+	}
+}
+
+// APIServerListenAddressOption sets the host:port the API server listens on.
+// Defaults to a random port in [20000, 45000] on all interfaces.
 func APIServerListenAddressOption(address string) ServerOption {
 	return func(options *serverOptions) {
 		options.apiServerListenAddress = address
 	}
 }
 
+// APIAuthenticatorOption makes the API server authenticate every request,
+// including the gRPC ones, with the APIAuthenticator. Requests are rejected
+// unless the access level granted is sufficient for the endpoint. All
+// requests are accepted by default.
+func APIAuthenticatorOption(authenticate APIAuthenticator) ServerOption {
+	return func(options *serverOptions) {
+		options.apiAuthenticator = authenticate
+	}
+}
+
+// APIServerEnabledOption toggles serving the API server on its own listener.
+// When disabled, the host application can serve the API with its own HTTP
+// stack using Server.APIHandler and Server.RegisterAPIServices. Defaults to
+// enabled.
+func APIServerEnabledOption(enabled bool) ServerOption {
+	return func(options *serverOptions) {
+		options.apiServerEnabled = enabled
+	}
+}
+
+// APIServerTLSOption makes the API server serve with TLS using the config.
+// Certificates can be rotated with config.GetCertificate. Defaults to serving
+// without TLS.
+func APIServerTLSOption(config *tls.Config) ServerOption {
+	return func(options *serverOptions) {
+		options.apiServerTLSConfig = config
+	}
+}
+
+// APIServerTLSCertFilesOption makes the API server serve with TLS using the
+// PEM encoded key pair in the files. The key pair is reloaded once the files
+// are modified.
+func APIServerTLSCertFilesOption(certFile, keyFile string) ServerOption {
+	return func(options *serverOptions) {
+		options.apiServerTLSConfig = &tls.Config{
+			GetCertificate: newCertFileReloader(certFile, keyFile).GetCertificate,
+		}
+	}
+}
+
+// ElectionTimeoutOption sets the time a candidate waits for the votes before
+// starting another election. Must be positive. Defaults to 1s.
 func ElectionTimeoutOption(timeout time.Duration) ServerOption {
 	return func(options *serverOptions) {
 		options.electionTimeout = timeout
 	}
 }
 
+// FollowerTimeoutOption sets the time a follower waits for the leader before
+// becoming a candidate. Must be positive. Defaults to 1s.
 func FollowerTimeoutOption(timeout time.Duration) ServerOption {
 	return func(options *serverOptions) {
 		options.followerTimeout = timeout
 	}
 }
 
+// GroupCommitOption sets how the logs are appended in groups. Up to maxBatch
+// pending append operations, e.g., of the concurrent calls to Apply, are
+// combined into a single write to the LogStore, and replicated together. The
+// first operation in a batch waits at most maxLatency for the following
+// operations. A zero maxLatency only combines the operations that are already
+// pending, i.e., that have arrived while the previous batch is written. The
+// main loop handles nothing else while it waits, so maxLatency must not exceed
+// 10ms and must be shorter than the heartbeat interval. A maxBatch less than 2
+// disables group commit. Defaults to 64 operations and a zero maxLatency.
+func GroupCommitOption(maxBatch int, maxLatency time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.groupCommitMaxBatch = maxBatch
+		options.groupCommitMaxLatency = maxLatency
+	}
+}
+
+// HealthPolicyOption sets the HealthPolicy that decides when the checks of
+// Server.Health fail. Defaults to the follower timeout for the leader contact,
+// 5s for a stalled log append, and 1024 logs for the apply backlog.
+func HealthPolicyOption(policy HealthPolicy) ServerOption {
+	return func(options *serverOptions) {
+		options.healthPolicy = policy
+	}
+}
+
+// HeartbeatIntervalOption sets the interval between the heartbeats sent by the
+// leader, which is also the interval between the checks for new logs to
+// replicate. Each interval is extended by a random offset of up to 30%, after
+// which it must still be shorter than the election timeout and the follower
+// timeout. Defaults to 100ms.
+func HeartbeatIntervalOption(interval time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.heartbeatInterval = interval
+	}
+}
+
+// MetricsKeeperOption sets the MetricsExporter the metrics are recorded to,
+// e.g., a PrometheusExporter or a StatsdExporter. The gauges are recorded
+// periodically. Defaults to none.
 func MetricsKeeperOption(exporter MetricsExporter) ServerOption {
 	return func(options *serverOptions) {
 		options.metricsExporter = exporter
 	}
 }
 
+// APIExtensionOption adds the APIExtension to the API server. Can be used
+// multiple times. Defaults to none.
 func APIExtensionOption(extension APIExtension) ServerOption {
 	return func(options *serverOptions) {
 		options.apiExtensions = append(options.apiExtensions, extension)
 	}
 }
 
+// ApplyErrorPolicyOption sets the ApplyErrorPolicy used when the StateMachine
+// returns a TransientApplyError. ApplyErrorContinue and ApplyErrorUnhealthy
+// take the failed log as applied on the server, whose state machine then
+// differs from the others', so they must be chosen explicitly. Defaults to
+// ApplyErrorHalt.
+func ApplyErrorPolicyOption(policy ApplyErrorPolicy) ServerOption {
+	return func(options *serverOptions) {
+		options.applyErrorPolicy = policy
+	}
+}
+
+// ApplyOrderCheckOption toggles runtime checks on the log entries passed to
+// the StateMachine. When enabled, the server panics if the entries are not
+// delivered with contiguous indexes or do not match the entries in the LogStore.
+// Defaults to disabled.
+func ApplyOrderCheckOption(enabled bool) ServerOption {
+	return func(options *serverOptions) {
+		options.applyOrderCheck = enabled
+	}
+}
+
+// AuditLogOption sets the AuditLog the audit trail of the membership and
+// leadership changes and the forced recoveries is appended to, e.g., a
+// FileAuditLog. The records are served by the API server. Defaults to none.
+func AuditLogOption(auditLog AuditLog) ServerOption {
+	return func(options *serverOptions) {
+		options.auditLog = auditLog
+	}
+}
+
+// BackpressurePolicyOption sets the BackpressurePolicy that bounds the logs
+// the leader has appended but not yet committed. Defaults to no limits.
+func BackpressurePolicyOption(policy BackpressurePolicy) ServerOption {
+	return func(options *serverOptions) {
+		options.backpressurePolicy = policy
+	}
+}
+
+// CatchUpPolicyOption sets the CatchUpPolicy that decides when a server being
+// added has caught up with the leader. Defaults to 256 trailing logs and a
+// timeout of 30s.
+func CatchUpPolicyOption(policy CatchUpPolicy) ServerOption {
+	return func(options *serverOptions) {
+		options.catchUpPolicy = policy
+	}
+}
+
+// ClockOption sets the Clock providing the time and the timers to the server,
+// e.g., a ManualClock in tests. Defaults to SystemClock.
+func ClockOption(clock Clock) ServerOption {
+	return func(options *serverOptions) {
+		options.clock = clock
+	}
+}
+
+// CommandCodecOption sets the Codec used by ApplyTyped to encode the commands
+// and decode their results. Defaults to MsgpackCodec.
+func CommandCodecOption(codec Codec) ServerOption {
+	return func(options *serverOptions) {
+		options.commandCodec = codec
+	}
+}
+
+// DeadServerPolicyOption sets the DeadServerPolicy that decides when the
+// leader removes the unreachable voters from the configuration on its own.
+// Defaults to no removals.
+func DeadServerPolicyOption(policy DeadServerPolicy) ServerOption {
+	return func(options *serverOptions) {
+		options.deadServerPolicy = policy
+	}
+}
+
+// DebugEndpointsOption mounts net/http/pprof under /debug/pprof/, the runtime
+// stats under /debug/runtime, and the QueueDepths under /debug/queues on the
+// API server. Requests must carry the token in an "Authorization: Bearer
+// <token>" header. An empty token leaves the endpoints unmounted.
+func DebugEndpointsOption(token string) ServerOption {
+	return func(options *serverOptions) {
+		options.debugToken = token
+	}
+}
+
+// LogCacheOption enables an in-memory cache holding at most capacity recently
+// used logs in front of the LogStore. A zero capacity disables the cache, which
+// is the default.
+func LogCacheOption(capacity int) ServerOption {
+	return func(options *serverOptions) {
+		options.logCacheCapacity = capacity
+	}
+}
+
+// LogCheckPolicyOption sets the LogCheckPolicy used when the logs are found
+// inconsistent on startup. Defaults to LogCheckFail.
+func LogCheckPolicyOption(policy LogCheckPolicy) ServerOption {
+	return func(options *serverOptions) {
+		options.logCheckPolicy = policy
+	}
+}
+
+// LogCheckWindowOption sets the number of the last logs scanned by the check
+// on startup, which bounds the startup time with long logs. The torn writes
+// the check is meant to catch are at the end of the logs. LogCheckAllLogs
+// scans all logs. Defaults to 4096.
+func LogCheckWindowOption(n uint64) ServerOption {
+	return func(options *serverOptions) {
+		options.logCheckWindow = n
+	}
+}
+
+// LogCompactionPolicyOption sets the LogCompactionPolicy consulted when the
+// logs are compacted after taking a snapshot. Defaults to the zero value,
+// which retains no logs covered by the snapshot.
+func LogCompactionPolicyOption(policy LogCompactionPolicy) ServerOption {
+	return func(options *serverOptions) {
+		options.logCompactionPolicy = policy
+	}
+}
+
+// LogCorruptionPolicyOption sets the LogCorruptionPolicy used when a log fails
+// the checksum verification on read. Defaults to LogCorruptionPanic.
+func LogCorruptionPolicyOption(policy LogCorruptionPolicy) ServerOption {
+	return func(options *serverOptions) {
+		options.logCorruptionPolicy = policy
+	}
+}
+
+// LogLevelOption sets the minimum level of the logs of the server. Defaults
+// to zapcore.InfoLevel.
 func LogLevelOption(level zapcore.Level) ServerOption {
 	return func(options *serverOptions) {
 		options.logLevel = level
 	}
 }
 
+// SessionCapacityOption limits the number of client sessions kept by the
+// servers. The least recently used session expires once a new session is
+// registered beyond the limit. Must be the same on all servers since the
+// sessions expire along with the applied logs. Defaults to 1024.
+func SessionCapacityOption(n int) ServerOption {
+	return func(options *serverOptions) {
+		options.sessionCapacity = n
+	}
+}
+
+// SnapshotPolicyOption sets the SnapshotPolicy deciding when snapshots are
+// taken automatically. Defaults to a snapshot every 10 applied commands or
+// every second, whichever comes first.
 func SnapshotPolicyOption(policy SnapshotPolicy) ServerOption {
 	return func(options *serverOptions) {
 		options.snapshotPolicy = policy
 	}
 }
+
+// SnapshotProgressOption sets the function called with the progress of the
+// snapshots being written or restored, once per chunk of the data. It is
+// called by the snapshot service and the main loop, and must not block.
+// Defaults to nil.
+func SnapshotProgressOption(fn func(SnapshotProgress)) ServerOption {
+	return func(options *serverOptions) {
+		options.snapshotProgress = fn
+	}
+}
+
+// SnapshotInstallConcurrencyOption limits the number of snapshots streamed to
+// lagging followers at the same time. Installations beyond the limit are
+// deferred and retried. A zero n removes the limit. Defaults to 2.
+func SnapshotInstallConcurrencyOption(n int) ServerOption {
+	return func(options *serverOptions) {
+		options.snapshotInstallConcurrency = n
+	}
+}
+
+// SnapshotRetentionPolicyOption sets the SnapshotRetentionPolicy used to prune
+// old snapshots after taking a snapshot. Defaults to the zero value, which
+// keeps all snapshots.
+func SnapshotRetentionPolicyOption(policy SnapshotRetentionPolicy) ServerOption {
+	return func(options *serverOptions) {
+		options.snapshotRetentionPolicy = policy
+	}
+}
+
+// QueryHandlerOption sets the QueryHandler that serves the reads made with
+// Server.Query and the query endpoint of the API server. Defaults to none,
+// with which the queries fail with ErrNoQueryHandler.
+func QueryHandlerOption(handler QueryHandler) ServerOption {
+	return func(options *serverOptions) {
+		options.queryHandler = handler
+	}
+}
+
+// RandSeedOption seeds the random number generator behind the random offsets
+// of the election timers and the heartbeats, which makes the offsets
+// deterministic. Defaults to a seed from the current time.
+func RandSeedOption(seed int64) ServerOption {
+	return func(options *serverOptions) {
+		options.randSeed = &seed
+	}
+}
+
+// RecoveryFileOption sets the path of the recovery file, which replaces the
+// configuration on startup for recovering a cluster whose quorum is lost
+// permanently. The file is a JSON array of the peers to keep, e.g.,
+//
+//	[{"id": "a", "endpoint": "10.0.0.1:8080"}, {"id": "b", "endpoint": "10.0.0.2:8080"}]
+//
+// where "metadata" and "non_voter" can also be set for a peer. To recover the cluster, stop
+// all the surviving servers, place the same file on each of them, and start
+// them again. Each of them applies all of its logs, including those not yet
+// committed, and compacts them into a snapshot carrying the configuration.
+// The file is renamed with the suffix ".applied" once applied.
+// The logs the surviving servers have not received are lost, and the
+// committed logs may be lost if none of them has received the logs. The
+// cluster may diverge if a server left out of the file comes back, so never
+// start such a server with its previous data. Defaults to no recovery file.
+func RecoveryFileOption(path string) ServerOption {
+	return func(options *serverOptions) {
+		options.recoveryFile = path
+	}
+}
+
+// RejectUnknownPeersOption toggles the verification of the senders of
+// AppendEntries, RequestVote, and InstallSnapshot. When enabled, the RPCs from
+// the servers that are not in the latest configuration, including the next
+// configuration in a joint consensus, are rejected with ErrUnknownPeer. A
+// server that is not in its own configuration, e.g., one that is joining the
+// cluster, accepts all senders. Defaults to disabled.
+func RejectUnknownPeersOption(enabled bool) ServerOption {
+	return func(options *serverOptions) {
+		options.rejectUnknownPeers = enabled
+	}
+}
+
+// ReplicationBatchSizeOption limits the number of logs sent to a follower in
+// a single AppendEntries request. The remaining logs are sent in the following
+// requests right away. A zero n removes the limit, which is the default.
+func ReplicationBatchSizeOption(n int) ServerOption {
+	return func(options *serverOptions) {
+		options.replicationBatchSize = n
+	}
+}
+
+// RetryPolicyOption sets the RetryPolicy used by all internal retries. The
+// policy is also handed to the Transport if it implements
+// TransportRetryPolicySetter. Must not be nil. Defaults to an
+// ExponentialRetryPolicy with up to 3 attempts.
+func RetryPolicyOption(policy RetryPolicy) ServerOption {
+	return func(options *serverOptions) {
+		options.retryPolicy = policy
+	}
+}
+
+// TracerOption sets the Tracer that traces the logs applied on the leader and
+// the incoming RPCs. The trace context is propagated to the leader along with
+// the logs redirected by the other servers. Defaults to none.
+func TracerOption(tracer Tracer) ServerOption {
+	return func(options *serverOptions) {
+		options.tracer = tracer
+	}
+}
+
+// SlowOpThresholdsOption sets the SlowOpThresholds beyond which the
+// operations are logged as slow. Defaults to 100ms for the log appends, the
+// log syncs, and StateMachine.Apply, and no threshold for the snapshot writes.
+func SlowOpThresholdsOption(thresholds SlowOpThresholds) ServerOption {
+	return func(options *serverOptions) {
+		options.slowOpThresholds = thresholds
+	}
+}
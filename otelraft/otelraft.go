@@ -0,0 +1,88 @@
+// Package otelraft adapts OpenTelemetry to the raft.Tracer, so that the spans
+// of the logs applied on the leader, of their replication, and of the RPCs
+// handled by the followers are exported as OpenTelemetry traces.
+package otelraft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sumimakito/raft"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer is a raft.Tracer that starts the spans with an OpenTelemetry
+// trace.Tracer and propagates the trace context along with the RPCs with a
+// propagation.TextMapPropagator.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer returns a Tracer using the trace.Tracer and the
+// propagation.TextMapPropagator, e.g., propagation.TraceContext{}.
+func NewTracer(tracer trace.Tracer, propagator propagation.TextMapPropagator) *Tracer {
+	return &Tracer{tracer: tracer, propagator: propagator}
+}
+
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, raft.Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, &Span{span: span}
+}
+
+func (t *Tracer) Inject(ctx context.Context, carrier map[string]string) {
+	t.propagator.Inject(ctx, propagation.MapCarrier(carrier))
+}
+
+func (t *Tracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return t.propagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// Span is a raft.Span wrapping an OpenTelemetry trace.Span.
+type Span struct {
+	span trace.Span
+}
+
+// SetAttribute sets the attribute on the span. The values other than strings,
+// booleans, integers, and floats are set as their default formats.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.span.SetAttributes(keyValue(key, value))
+}
+
+// End ends the span. A non-nil err is recorded as an error status.
+func (s *Span) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+func keyValue(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int32:
+		return attribute.Int64(key, int64(v))
+	case int64:
+		return attribute.Int64(key, v)
+	case uint32:
+		return attribute.Int64(key, int64(v))
+	case uint64:
+		if v <= 1<<63-1 {
+			return attribute.Int64(key, int64(v))
+		}
+	case float32:
+		return attribute.Float64(key, float64(v))
+	case float64:
+		return attribute.Float64(key, v)
+	}
+	return attribute.String(key, fmt.Sprint(value))
+}
@@ -0,0 +1,63 @@
+package otelraft
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := NewTracer(provider.Tracer("raft"), propagation.TraceContext{})
+
+	ctx, span := tracer.Start(context.Background(), "raft.replicate.AppendEntries")
+	span.SetAttribute("raft.peer", "peer1")
+	span.SetAttribute("raft.first_index", uint64(1))
+	span.SetAttribute("raft.last_index", uint64(1<<64-1))
+	span.SetAttribute("raft.heartbeat", false)
+
+	carrier := map[string]string{}
+	tracer.Inject(ctx, carrier)
+	assert.Contains(t, carrier, "traceparent")
+
+	remoteCtx := tracer.Extract(context.Background(), carrier)
+	_, remoteSpan := tracer.Start(remoteCtx, "raft.AppendEntries")
+	remoteSpan.End(errors.New("rejected"))
+	span.End(nil)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	follower, leader := spans[0], spans[1]
+	assert.Equal(t, leader.SpanContext().TraceID(), follower.SpanContext().TraceID())
+	assert.Equal(t, leader.SpanContext().SpanID(), follower.Parent().SpanID())
+	assert.True(t, follower.Parent().IsRemote())
+
+	assert.Equal(t, []attribute.KeyValue{
+		attribute.String("raft.peer", "peer1"),
+		attribute.Int64("raft.first_index", 1),
+		attribute.String("raft.last_index", "18446744073709551615"),
+		attribute.Bool("raft.heartbeat", false),
+	}, leader.Attributes())
+	assert.Equal(t, codes.Unset, leader.Status().Code)
+	assert.Equal(t, codes.Error, follower.Status().Code)
+	assert.Equal(t, "rejected", follower.Status().Description)
+	assert.Len(t, follower.Events(), 1)
+}
+
+func TestTracerNoSpan(t *testing.T) {
+	tracer := NewTracer(trace.NewNoopTracerProvider().Tracer("raft"), propagation.TraceContext{})
+	carrier := map[string]string{}
+	tracer.Inject(context.Background(), carrier)
+	assert.Empty(t, carrier)
+	ctx := tracer.Extract(context.Background(), carrier)
+	assert.False(t, trace.SpanContextFromContext(ctx).IsValid())
+}
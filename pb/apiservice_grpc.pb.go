@@ -20,6 +20,10 @@ const _ = grpc.SupportPackageIsVersion7
 type APIServiceClient interface {
 	Apply(ctx context.Context, in *LogBody, opts ...grpc.CallOption) (*ApplyLogResponse, error)
 	ApplyCommand(ctx context.Context, in *Command, opts ...grpc.CallOption) (*ApplyLogResponse, error)
+	ApplyBatch(ctx context.Context, opts ...grpc.CallOption) (APIService_ApplyBatchClient, error)
+	ChangeMembership(ctx context.Context, in *MembershipChangeRequest, opts ...grpc.CallOption) (*MembershipChangeResponse, error)
+	ReadIndex(ctx context.Context, in *ReadIndexRequest, opts ...grpc.CallOption) (*ReadIndexResponse, error)
+	WatchLogs(ctx context.Context, in *WatchLogsRequest, opts ...grpc.CallOption) (APIService_WatchLogsClient, error)
 }
 
 type aPIServiceClient struct {
@@ -48,12 +52,97 @@ func (c *aPIServiceClient) ApplyCommand(ctx context.Context, in *Command, opts .
 	return out, nil
 }
 
+func (c *aPIServiceClient) ApplyBatch(ctx context.Context, opts ...grpc.CallOption) (APIService_ApplyBatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &APIService_ServiceDesc.Streams[0], "/pb.APIService/ApplyBatch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &aPIServiceApplyBatchClient{stream}
+	return x, nil
+}
+
+type APIService_ApplyBatchClient interface {
+	Send(*LogBody) error
+	Recv() (*ApplyLogResponse, error)
+	grpc.ClientStream
+}
+
+type aPIServiceApplyBatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *aPIServiceApplyBatchClient) Send(m *LogBody) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *aPIServiceApplyBatchClient) Recv() (*ApplyLogResponse, error) {
+	m := new(ApplyLogResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *aPIServiceClient) ChangeMembership(ctx context.Context, in *MembershipChangeRequest, opts ...grpc.CallOption) (*MembershipChangeResponse, error) {
+	out := new(MembershipChangeResponse)
+	err := c.cc.Invoke(ctx, "/pb.APIService/ChangeMembership", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIServiceClient) ReadIndex(ctx context.Context, in *ReadIndexRequest, opts ...grpc.CallOption) (*ReadIndexResponse, error) {
+	out := new(ReadIndexResponse)
+	err := c.cc.Invoke(ctx, "/pb.APIService/ReadIndex", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIServiceClient) WatchLogs(ctx context.Context, in *WatchLogsRequest, opts ...grpc.CallOption) (APIService_WatchLogsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &APIService_ServiceDesc.Streams[1], "/pb.APIService/WatchLogs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &aPIServiceWatchLogsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type APIService_WatchLogsClient interface {
+	Recv() (*Log, error)
+	grpc.ClientStream
+}
+
+type aPIServiceWatchLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *aPIServiceWatchLogsClient) Recv() (*Log, error) {
+	m := new(Log)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // APIServiceServer is the server API for APIService service.
 // All implementations must embed UnimplementedAPIServiceServer
 // for forward compatibility
 type APIServiceServer interface {
 	Apply(context.Context, *LogBody) (*ApplyLogResponse, error)
 	ApplyCommand(context.Context, *Command) (*ApplyLogResponse, error)
+	ApplyBatch(APIService_ApplyBatchServer) error
+	ChangeMembership(context.Context, *MembershipChangeRequest) (*MembershipChangeResponse, error)
+	ReadIndex(context.Context, *ReadIndexRequest) (*ReadIndexResponse, error)
+	WatchLogs(*WatchLogsRequest, APIService_WatchLogsServer) error
 	mustEmbedUnimplementedAPIServiceServer()
 }
 
@@ -67,6 +156,18 @@ func (UnimplementedAPIServiceServer) Apply(context.Context, *LogBody) (*ApplyLog
 func (UnimplementedAPIServiceServer) ApplyCommand(context.Context, *Command) (*ApplyLogResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ApplyCommand not implemented")
 }
+func (UnimplementedAPIServiceServer) ApplyBatch(APIService_ApplyBatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method ApplyBatch not implemented")
+}
+func (UnimplementedAPIServiceServer) ChangeMembership(context.Context, *MembershipChangeRequest) (*MembershipChangeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ChangeMembership not implemented")
+}
+func (UnimplementedAPIServiceServer) ReadIndex(context.Context, *ReadIndexRequest) (*ReadIndexResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReadIndex not implemented")
+}
+func (UnimplementedAPIServiceServer) WatchLogs(*WatchLogsRequest, APIService_WatchLogsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchLogs not implemented")
+}
 func (UnimplementedAPIServiceServer) mustEmbedUnimplementedAPIServiceServer() {}
 
 // UnsafeAPIServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -116,6 +217,89 @@ func _APIService_ApplyCommand_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _APIService_ApplyBatch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(APIServiceServer).ApplyBatch(&aPIServiceApplyBatchServer{stream})
+}
+
+type APIService_ApplyBatchServer interface {
+	Send(*ApplyLogResponse) error
+	Recv() (*LogBody, error)
+	grpc.ServerStream
+}
+
+type aPIServiceApplyBatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *aPIServiceApplyBatchServer) Send(m *ApplyLogResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *aPIServiceApplyBatchServer) Recv() (*LogBody, error) {
+	m := new(LogBody)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _APIService_ChangeMembership_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MembershipChangeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServiceServer).ChangeMembership(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.APIService/ChangeMembership",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServiceServer).ChangeMembership(ctx, req.(*MembershipChangeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _APIService_ReadIndex_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadIndexRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServiceServer).ReadIndex(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.APIService/ReadIndex",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServiceServer).ReadIndex(ctx, req.(*ReadIndexRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _APIService_WatchLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchLogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(APIServiceServer).WatchLogs(m, &aPIServiceWatchLogsServer{stream})
+}
+
+type APIService_WatchLogsServer interface {
+	Send(*Log) error
+	grpc.ServerStream
+}
+
+type aPIServiceWatchLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *aPIServiceWatchLogsServer) Send(m *Log) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // APIService_ServiceDesc is the grpc.ServiceDesc for APIService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -131,7 +315,27 @@ var APIService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ApplyCommand",
 			Handler:    _APIService_ApplyCommand_Handler,
 		},
+		{
+			MethodName: "ChangeMembership",
+			Handler:    _APIService_ChangeMembership_Handler,
+		},
+		{
+			MethodName: "ReadIndex",
+			Handler:    _APIService_ReadIndex_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ApplyBatch",
+			Handler:       _APIService_ApplyBatch_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "WatchLogs",
+			Handler:       _APIService_WatchLogs_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "apiservice.proto",
 }
@@ -21,19 +21,35 @@ func (c *Config) MarshalLogObject(e zapcore.ObjectEncoder) error {
 }
 
 func (c *Configuration) Copy() *Configuration {
-	out := &Configuration{Current: c.Current.Copy()}
-	if out.Next != nil {
+	out := &Configuration{Current: c.Current.Copy(), Staging: copyPeers(c.Staging), Initiator: c.Initiator}
+	if c.Next != nil {
 		out.Next = c.Next.Copy()
 	}
 	return out
 }
 
 func (c *Configuration) CopyInitiateTransition(next *Config) *Configuration {
-	return &Configuration{Current: c.Current.Copy(), Next: next.Copy()}
+	return &Configuration{Current: c.Current.Copy(), Next: next.Copy(), Staging: copyPeers(c.Staging), Initiator: c.Initiator}
 }
 
 func (c *Configuration) CopyCommitTransition() *Configuration {
-	return &Configuration{Current: c.Next.Copy()}
+	return &Configuration{Current: c.Next.Copy(), Staging: copyPeers(c.Staging), Initiator: c.Initiator}
+}
+
+// CopyStaging returns a copy of the configuration with the staging peers
+// replaced.
+func (c *Configuration) CopyStaging(staging []*Peer) *Configuration {
+	out := c.Copy()
+	out.Staging = copyPeers(staging)
+	return out
+}
+
+func copyPeers(peers []*Peer) []*Peer {
+	var out []*Peer
+	for _, peer := range peers {
+		out = append(out, peer.Copy())
+	}
+	return out
 }
 
 func (c *Configuration) MarshalLogObject(e zapcore.ObjectEncoder) error {
@@ -49,5 +65,13 @@ func (c *Configuration) MarshalLogObject(e zapcore.ObjectEncoder) error {
 			return err
 		}
 	}
+	if len(c.Staging) > 0 {
+		if err := e.AddArray("staging", PeerArray(c.Staging)); err != nil {
+			return err
+		}
+	}
+	if c.Initiator != "" {
+		e.AddString("initiator", c.Initiator)
+	}
 	return nil
 }
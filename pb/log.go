@@ -1,13 +1,18 @@
 package pb
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"sort"
 
 	"go.uber.org/zap/zapcore"
 )
 
 var NilLog = &Log{Meta: &LogMeta{Index: 0, Term: 0}}
 
+var logCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
 func (m *LogMeta) Copy() *LogMeta {
 	return &LogMeta{
 		Index: m.Index,
@@ -22,9 +27,26 @@ func (m *LogMeta) MarshalLogObject(e zapcore.ObjectEncoder) error {
 }
 
 func (b *LogBody) Copy() *LogBody {
+	var extensions map[string][]byte
+	if b.Extensions != nil {
+		extensions = make(map[string][]byte, len(b.Extensions))
+		for k, v := range b.Extensions {
+			extensions[k] = append(([]byte)(nil), v...)
+		}
+	}
+	var session *SessionRequest
+	if b.Session != nil {
+		session = &SessionRequest{
+			SessionId:     b.Session.SessionId,
+			Sequence:      b.Session.Sequence,
+			AckedSequence: b.Session.AckedSequence,
+		}
+	}
 	return &LogBody{
-		Type: b.Type,
-		Data: append(([]byte)(nil), b.Data...),
+		Type:       b.Type,
+		Data:       append(([]byte)(nil), b.Data...),
+		Extensions: extensions,
+		Session:    session,
 	}
 }
 
@@ -36,14 +58,56 @@ func (b *LogBody) MarshalLogObject(e zapcore.ObjectEncoder) error {
 	} else {
 		e.AddString("data", fmt.Sprintf("<%d bytes>", dataLen))
 	}
+	if len(b.Extensions) > 0 {
+		e.AddInt("extensions", len(b.Extensions))
+	}
+	if b.Session != nil {
+		e.AddUint64("session_id", b.Session.SessionId)
+		e.AddUint64("session_sequence", b.Session.Sequence)
+	}
 	return nil
 }
 
 func (l *Log) Copy() *Log {
 	return &Log{
-		Meta: l.Meta.Copy(),
-		Body: l.Body.Copy(),
+		Meta:     l.Meta.Copy(),
+		Body:     l.Body.Copy(),
+		Checksum: l.Checksum,
+	}
+}
+
+// ComputeChecksum computes the CRC-32C checksum of the meta and the body.
+// The extensions are covered in the order of their keys, followed by the
+// session request if any.
+func (l *Log) ComputeChecksum() uint32 {
+	header := make([]byte, 24)
+	binary.BigEndian.PutUint64(header[0:8], l.Meta.Index)
+	binary.BigEndian.PutUint64(header[8:16], l.Meta.Term)
+	binary.BigEndian.PutUint64(header[16:24], uint64(l.Body.Type))
+	checksum := crc32.Update(crc32.Checksum(header, logCRCTable), logCRCTable, l.Body.Data)
+	if len(l.Body.Extensions) > 0 {
+		keys := make([]string, 0, len(l.Body.Extensions))
+		for k := range l.Body.Extensions {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		length := make([]byte, 8)
+		for _, k := range keys {
+			v := l.Body.Extensions[k]
+			binary.BigEndian.PutUint32(length[0:4], uint32(len(k)))
+			binary.BigEndian.PutUint32(length[4:8], uint32(len(v)))
+			checksum = crc32.Update(checksum, logCRCTable, length)
+			checksum = crc32.Update(checksum, logCRCTable, []byte(k))
+			checksum = crc32.Update(checksum, logCRCTable, v)
+		}
+	}
+	if session := l.Body.Session; session != nil {
+		binary.BigEndian.PutUint64(header[0:8], session.SessionId)
+		binary.BigEndian.PutUint64(header[8:16], session.Sequence)
+		binary.BigEndian.PutUint64(header[16:24], session.AckedSequence)
+		checksum = crc32.Update(checksum, logCRCTable, header)
 	}
+	return checksum
 }
 
 func (l *Log) MarshalLogObject(e zapcore.ObjectEncoder) error {
@@ -26,6 +26,12 @@ const (
 	LogType_UNKNOWN       LogType = 0
 	LogType_COMMAND       LogType = 1
 	LogType_CONFIGURATION LogType = 2
+	// NOOP logs carry no data and are not passed to the state machine. They
+	// are used by the leader to commit a log of its own term.
+	LogType_NOOP LogType = 3
+	// REGISTER_SESSION logs register a client session whose ID is the index of
+	// the log. They carry no data and are not passed to the state machine.
+	LogType_REGISTER_SESSION LogType = 4
 )
 
 // Enum value maps for LogType.
@@ -34,11 +40,15 @@ var (
 		0: "UNKNOWN",
 		1: "COMMAND",
 		2: "CONFIGURATION",
+		3: "NOOP",
+		4: "REGISTER_SESSION",
 	}
 	LogType_value = map[string]int32{
-		"UNKNOWN":       0,
-		"COMMAND":       1,
-		"CONFIGURATION": 2,
+		"UNKNOWN":          0,
+		"COMMAND":          1,
+		"CONFIGURATION":    2,
+		"NOOP":             3,
+		"REGISTER_SESSION": 4,
 	}
 )
 
@@ -131,6 +141,12 @@ type LogBody struct {
 
 	Type LogType `protobuf:"varint,1,opt,name=type,proto3,enum=pb.LogType" json:"type,omitempty"`
 	Data []byte  `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	// Opaque metadata attached by the client, e.g., request IDs, timestamps, or
+	// tenant tags. Replicated along with the data and passed to the state
+	// machine.
+	Extensions map[string][]byte `protobuf:"bytes,3,rep,name=extensions,proto3" json:"extensions,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// The client session the command is applied in, if any.
+	Session *SessionRequest `protobuf:"bytes,4,opt,name=session,proto3" json:"session,omitempty"`
 }
 
 func (x *LogBody) Reset() {
@@ -179,6 +195,20 @@ func (x *LogBody) GetData() []byte {
 	return nil
 }
 
+func (x *LogBody) GetExtensions() map[string][]byte {
+	if x != nil {
+		return x.Extensions
+	}
+	return nil
+}
+
+func (x *LogBody) GetSession() *SessionRequest {
+	if x != nil {
+		return x.Session
+	}
+	return nil
+}
+
 type Log struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -186,6 +216,8 @@ type Log struct {
 
 	Meta *LogMeta `protobuf:"bytes,1,opt,name=meta,proto3" json:"meta,omitempty"`
 	Body *LogBody `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+	// CRC-32C checksum of the meta and the body. Zero means no checksum.
+	Checksum uint32 `protobuf:"varint,3,opt,name=checksum,proto3" json:"checksum,omitempty"`
 }
 
 func (x *Log) Reset() {
@@ -234,28 +266,51 @@ func (x *Log) GetBody() *LogBody {
 	return nil
 }
 
+func (x *Log) GetChecksum() uint32 {
+	if x != nil {
+		return x.Checksum
+	}
+	return 0
+}
+
 var File_log_proto protoreflect.FileDescriptor
 
 var file_log_proto_rawDesc = []byte{
-	0x0a, 0x09, 0x6c, 0x6f, 0x67, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x02, 0x70, 0x62, 0x22,
-	0x33, 0x0a, 0x07, 0x4c, 0x6f, 0x67, 0x4d, 0x65, 0x74, 0x61, 0x12, 0x14, 0x0a, 0x05, 0x69, 0x6e,
-	0x64, 0x65, 0x78, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x69, 0x6e, 0x64, 0x65, 0x78,
-	0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04,
-	0x74, 0x65, 0x72, 0x6d, 0x22, 0x3e, 0x0a, 0x07, 0x4c, 0x6f, 0x67, 0x42, 0x6f, 0x64, 0x79, 0x12,
+	0x0a, 0x09, 0x6c, 0x6f, 0x67, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x02, 0x70, 0x62, 0x1a,
+	0x0d, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x33,
+	0x0a, 0x07, 0x4c, 0x6f, 0x67, 0x4d, 0x65, 0x74, 0x61, 0x12, 0x14, 0x0a, 0x05, 0x69, 0x6e, 0x64,
+	0x65, 0x78, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x12,
+	0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x74,
+	0x65, 0x72, 0x6d, 0x22, 0xe8, 0x01, 0x0a, 0x07, 0x4c, 0x6f, 0x67, 0x42, 0x6f, 0x64, 0x79, 0x12,
 	0x1f, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0b, 0x2e,
 	0x70, 0x62, 0x2e, 0x4c, 0x6f, 0x67, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65,
 	0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04,
-	0x64, 0x61, 0x74, 0x61, 0x22, 0x47, 0x0a, 0x03, 0x4c, 0x6f, 0x67, 0x12, 0x1f, 0x0a, 0x04, 0x6d,
-	0x65, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0b, 0x2e, 0x70, 0x62, 0x2e, 0x4c,
-	0x6f, 0x67, 0x4d, 0x65, 0x74, 0x61, 0x52, 0x04, 0x6d, 0x65, 0x74, 0x61, 0x12, 0x1f, 0x0a, 0x04,
-	0x62, 0x6f, 0x64, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0b, 0x2e, 0x70, 0x62, 0x2e,
-	0x4c, 0x6f, 0x67, 0x42, 0x6f, 0x64, 0x79, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x2a, 0x36, 0x0a,
-	0x07, 0x4c, 0x6f, 0x67, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x4e, 0x4b, 0x4e,
-	0x4f, 0x57, 0x4e, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x43, 0x4f, 0x4d, 0x4d, 0x41, 0x4e, 0x44,
-	0x10, 0x01, 0x12, 0x11, 0x0a, 0x0d, 0x43, 0x4f, 0x4e, 0x46, 0x49, 0x47, 0x55, 0x52, 0x41, 0x54,
-	0x49, 0x4f, 0x4e, 0x10, 0x02, 0x42, 0x1f, 0x5a, 0x1d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e,
-	0x63, 0x6f, 0x6d, 0x2f, 0x73, 0x75, 0x6d, 0x69, 0x6d, 0x61, 0x6b, 0x69, 0x74, 0x6f, 0x2f, 0x72,
-	0x61, 0x66, 0x74, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x64, 0x61, 0x74, 0x61, 0x12, 0x3b, 0x0a, 0x0a, 0x65, 0x78, 0x74, 0x65, 0x6e, 0x73, 0x69, 0x6f,
+	0x6e, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x70, 0x62, 0x2e, 0x4c, 0x6f,
+	0x67, 0x42, 0x6f, 0x64, 0x79, 0x2e, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x73, 0x69, 0x6f, 0x6e, 0x73,
+	0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x0a, 0x65, 0x78, 0x74, 0x65, 0x6e, 0x73, 0x69, 0x6f, 0x6e,
+	0x73, 0x12, 0x2c, 0x0a, 0x07, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x12, 0x2e, 0x70, 0x62, 0x2e, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x07, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x1a,
+	0x3d, 0x0a, 0x0f, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x45, 0x6e, 0x74,
+	0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x63,
+	0x0a, 0x03, 0x4c, 0x6f, 0x67, 0x12, 0x1f, 0x0a, 0x04, 0x6d, 0x65, 0x74, 0x61, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x0b, 0x2e, 0x70, 0x62, 0x2e, 0x4c, 0x6f, 0x67, 0x4d, 0x65, 0x74, 0x61,
+	0x52, 0x04, 0x6d, 0x65, 0x74, 0x61, 0x12, 0x1f, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x0b, 0x2e, 0x70, 0x62, 0x2e, 0x4c, 0x6f, 0x67, 0x42, 0x6f, 0x64,
+	0x79, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x1a, 0x0a, 0x08, 0x63, 0x68, 0x65, 0x63, 0x6b,
+	0x73, 0x75, 0x6d, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x63, 0x68, 0x65, 0x63, 0x6b,
+	0x73, 0x75, 0x6d, 0x2a, 0x56, 0x0a, 0x07, 0x4c, 0x6f, 0x67, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0b,
+	0x0a, 0x07, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x43,
+	0x4f, 0x4d, 0x4d, 0x41, 0x4e, 0x44, 0x10, 0x01, 0x12, 0x11, 0x0a, 0x0d, 0x43, 0x4f, 0x4e, 0x46,
+	0x49, 0x47, 0x55, 0x52, 0x41, 0x54, 0x49, 0x4f, 0x4e, 0x10, 0x02, 0x12, 0x08, 0x0a, 0x04, 0x4e,
+	0x4f, 0x4f, 0x50, 0x10, 0x03, 0x12, 0x14, 0x0a, 0x10, 0x52, 0x45, 0x47, 0x49, 0x53, 0x54, 0x45,
+	0x52, 0x5f, 0x53, 0x45, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x10, 0x04, 0x42, 0x1f, 0x5a, 0x1d, 0x67,
+	0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x73, 0x75, 0x6d, 0x69, 0x6d, 0x61,
+	0x6b, 0x69, 0x74, 0x6f, 0x2f, 0x72, 0x61, 0x66, 0x74, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -271,22 +326,26 @@ func file_log_proto_rawDescGZIP() []byte {
 }
 
 var file_log_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_log_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_log_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
 var file_log_proto_goTypes = []interface{}{
-	(LogType)(0),    // 0: pb.LogType
-	(*LogMeta)(nil), // 1: pb.LogMeta
-	(*LogBody)(nil), // 2: pb.LogBody
-	(*Log)(nil),     // 3: pb.Log
+	(LogType)(0),           // 0: pb.LogType
+	(*LogMeta)(nil),        // 1: pb.LogMeta
+	(*LogBody)(nil),        // 2: pb.LogBody
+	(*Log)(nil),            // 3: pb.Log
+	nil,                    // 4: pb.LogBody.ExtensionsEntry
+	(*SessionRequest)(nil), // 5: pb.SessionRequest
 }
 var file_log_proto_depIdxs = []int32{
 	0, // 0: pb.LogBody.type:type_name -> pb.LogType
-	1, // 1: pb.Log.meta:type_name -> pb.LogMeta
-	2, // 2: pb.Log.body:type_name -> pb.LogBody
-	3, // [3:3] is the sub-list for method output_type
-	3, // [3:3] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	4, // 1: pb.LogBody.extensions:type_name -> pb.LogBody.ExtensionsEntry
+	5, // 2: pb.LogBody.session:type_name -> pb.SessionRequest
+	1, // 3: pb.Log.meta:type_name -> pb.LogMeta
+	2, // 4: pb.Log.body:type_name -> pb.LogBody
+	5, // [5:5] is the sub-list for method output_type
+	5, // [5:5] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
 }
 
 func init() { file_log_proto_init() }
@@ -294,6 +353,7 @@ func file_log_proto_init() {
 	if File_log_proto != nil {
 		return
 	}
+	file_session_proto_init()
 	if !protoimpl.UnsafeEnabled {
 		file_log_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*LogMeta); i {
@@ -338,7 +398,7 @@ func file_log_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_log_proto_rawDesc,
 			NumEnums:      1,
-			NumMessages:   3,
+			NumMessages:   4,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
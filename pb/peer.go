@@ -5,12 +5,40 @@ import "go.uber.org/zap/zapcore"
 var NilPeer = &Peer{Id: "", Endpoint: ""}
 
 func (p *Peer) Copy() *Peer {
-	return &Peer{Id: p.Id, Endpoint: p.Endpoint}
+	out := &Peer{Id: p.Id, Endpoint: p.Endpoint, Suffrage: p.Suffrage}
+	if len(p.Metadata) > 0 {
+		out.Metadata = make(map[string]string, len(p.Metadata))
+		for k, v := range p.Metadata {
+			out.Metadata[k] = v
+		}
+	}
+	return out
 }
 
 func (p *Peer) MarshalLogObject(e zapcore.ObjectEncoder) error {
 	e.AddString("id", p.Id)
 	e.AddString("endpoint", p.Endpoint)
+	if p.Suffrage != Suffrage_SUFFRAGE_VOTER {
+		e.AddString("suffrage", p.Suffrage.String())
+	}
+	if len(p.Metadata) > 0 {
+		return e.AddObject("metadata", metadataObject(p.Metadata))
+	}
+	return nil
+}
+
+// Voter reports whether the peer votes in the elections and counts in the
+// quorums.
+func (p *Peer) Voter() bool {
+	return p.Suffrage == Suffrage_SUFFRAGE_VOTER
+}
+
+type metadataObject map[string]string
+
+func (m metadataObject) MarshalLogObject(e zapcore.ObjectEncoder) error {
+	for k, v := range m {
+		e.AddString(k, v)
+	}
 	return nil
 }
 
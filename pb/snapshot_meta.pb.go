@@ -0,0 +1,210 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.26.0
+// 	protoc        v3.17.3
+// source: snapshot_meta.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// ObjectSnapshotMeta is the metadata of the snapshots stored by the
+// ObjectSnapshotStore.
+type ObjectSnapshotMeta struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id                 string         `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Index              uint64         `protobuf:"varint,2,opt,name=index,proto3" json:"index,omitempty"`
+	Term               uint64         `protobuf:"varint,3,opt,name=term,proto3" json:"term,omitempty"`
+	Configuration      *Configuration `protobuf:"bytes,4,opt,name=configuration,proto3" json:"configuration,omitempty"`
+	ConfigurationIndex uint64         `protobuf:"varint,5,opt,name=configuration_index,json=configurationIndex,proto3" json:"configuration_index,omitempty"`
+	Size               uint64         `protobuf:"varint,6,opt,name=size,proto3" json:"size,omitempty"`
+	// CRC-64 (ECMA) checksum of the snapshot data.
+	Crc64 uint64 `protobuf:"varint,7,opt,name=crc64,proto3" json:"crc64,omitempty"`
+}
+
+func (x *ObjectSnapshotMeta) Reset() {
+	*x = ObjectSnapshotMeta{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_snapshot_meta_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ObjectSnapshotMeta) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ObjectSnapshotMeta) ProtoMessage() {}
+
+func (x *ObjectSnapshotMeta) ProtoReflect() protoreflect.Message {
+	mi := &file_snapshot_meta_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ObjectSnapshotMeta.ProtoReflect.Descriptor instead.
+func (*ObjectSnapshotMeta) Descriptor() ([]byte, []int) {
+	return file_snapshot_meta_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ObjectSnapshotMeta) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *ObjectSnapshotMeta) GetIndex() uint64 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *ObjectSnapshotMeta) GetTerm() uint64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *ObjectSnapshotMeta) GetConfiguration() *Configuration {
+	if x != nil {
+		return x.Configuration
+	}
+	return nil
+}
+
+func (x *ObjectSnapshotMeta) GetConfigurationIndex() uint64 {
+	if x != nil {
+		return x.ConfigurationIndex
+	}
+	return 0
+}
+
+func (x *ObjectSnapshotMeta) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *ObjectSnapshotMeta) GetCrc64() uint64 {
+	if x != nil {
+		return x.Crc64
+	}
+	return 0
+}
+
+var File_snapshot_meta_proto protoreflect.FileDescriptor
+
+var file_snapshot_meta_proto_rawDesc = []byte{
+	0x0a, 0x13, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f, 0x6d, 0x65, 0x74, 0x61, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x02, 0x70, 0x62, 0x1a, 0x13, 0x63, 0x6f, 0x6e, 0x66, 0x69,
+	0x67, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xe2,
+	0x01, 0x0a, 0x12, 0x4f, 0x62, 0x6a, 0x65, 0x63, 0x74, 0x53, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f,
+	0x74, 0x4d, 0x65, 0x74, 0x61, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x14, 0x0a, 0x05, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x12, 0x0a, 0x04, 0x74,
+	0x65, 0x72, 0x6d, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x12,
+	0x37, 0x0a, 0x0d, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x70, 0x62, 0x2e, 0x43, 0x6f, 0x6e, 0x66,
+	0x69, 0x67, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x0d, 0x63, 0x6f, 0x6e, 0x66, 0x69,
+	0x67, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x2f, 0x0a, 0x13, 0x63, 0x6f, 0x6e, 0x66,
+	0x69, 0x67, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18,
+	0x05, 0x20, 0x01, 0x28, 0x04, 0x52, 0x12, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x12, 0x0a, 0x04, 0x73, 0x69, 0x7a,
+	0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x12, 0x14, 0x0a,
+	0x05, 0x63, 0x72, 0x63, 0x36, 0x34, 0x18, 0x07, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x63, 0x72,
+	0x63, 0x36, 0x34, 0x42, 0x1f, 0x5a, 0x1d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
+	0x6d, 0x2f, 0x73, 0x75, 0x6d, 0x69, 0x6d, 0x61, 0x6b, 0x69, 0x74, 0x6f, 0x2f, 0x72, 0x61, 0x66,
+	0x74, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_snapshot_meta_proto_rawDescOnce sync.Once
+	file_snapshot_meta_proto_rawDescData = file_snapshot_meta_proto_rawDesc
+)
+
+func file_snapshot_meta_proto_rawDescGZIP() []byte {
+	file_snapshot_meta_proto_rawDescOnce.Do(func() {
+		file_snapshot_meta_proto_rawDescData = protoimpl.X.CompressGZIP(file_snapshot_meta_proto_rawDescData)
+	})
+	return file_snapshot_meta_proto_rawDescData
+}
+
+var file_snapshot_meta_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_snapshot_meta_proto_goTypes = []interface{}{
+	(*ObjectSnapshotMeta)(nil), // 0: pb.ObjectSnapshotMeta
+	(*Configuration)(nil),      // 1: pb.Configuration
+}
+var file_snapshot_meta_proto_depIdxs = []int32{
+	1, // 0: pb.ObjectSnapshotMeta.configuration:type_name -> pb.Configuration
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_snapshot_meta_proto_init() }
+func file_snapshot_meta_proto_init() {
+	if File_snapshot_meta_proto != nil {
+		return
+	}
+	file_configuration_proto_init()
+	if !protoimpl.UnsafeEnabled {
+		file_snapshot_meta_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ObjectSnapshotMeta); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_snapshot_meta_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_snapshot_meta_proto_goTypes,
+		DependencyIndexes: file_snapshot_meta_proto_depIdxs,
+		MessageInfos:      file_snapshot_meta_proto_msgTypes,
+	}.Build()
+	File_snapshot_meta_proto = out.File
+	file_snapshot_meta_proto_rawDesc = nil
+	file_snapshot_meta_proto_goTypes = nil
+	file_snapshot_meta_proto_depIdxs = nil
+}
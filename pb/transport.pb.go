@@ -24,7 +24,7 @@ var File_transport_proto protoreflect.FileDescriptor
 var file_transport_proto_rawDesc = []byte{
 	0x0a, 0x0f, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x70, 0x6f, 0x72, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74,
 	0x6f, 0x12, 0x02, 0x70, 0x62, 0x1a, 0x09, 0x72, 0x70, 0x63, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
-	0x32, 0x9a, 0x02, 0x0a, 0x09, 0x54, 0x72, 0x61, 0x6e, 0x73, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x44,
+	0x32, 0xa6, 0x03, 0x0a, 0x09, 0x54, 0x72, 0x61, 0x6e, 0x73, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x44,
 	0x0a, 0x0d, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x69, 0x65, 0x73, 0x12,
 	0x18, 0x2e, 0x70, 0x62, 0x2e, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x69,
 	0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x19, 0x2e, 0x70, 0x62, 0x2e, 0x41,
@@ -41,10 +41,19 @@ var file_transport_proto_rawDesc = []byte{
 	0x6f, 0x6e, 0x73, 0x65, 0x28, 0x01, 0x12, 0x35, 0x0a, 0x08, 0x41, 0x70, 0x70, 0x6c, 0x79, 0x4c,
 	0x6f, 0x67, 0x12, 0x13, 0x2e, 0x70, 0x62, 0x2e, 0x41, 0x70, 0x70, 0x6c, 0x79, 0x4c, 0x6f, 0x67,
 	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x14, 0x2e, 0x70, 0x62, 0x2e, 0x41, 0x70, 0x70,
-	0x6c, 0x79, 0x4c, 0x6f, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x1f, 0x5a,
-	0x1d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x73, 0x75, 0x6d, 0x69,
-	0x6d, 0x61, 0x6b, 0x69, 0x74, 0x6f, 0x2f, 0x72, 0x61, 0x66, 0x74, 0x2f, 0x70, 0x62, 0x62, 0x06,
-	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x6c, 0x79, 0x4c, 0x6f, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x4d, 0x0a,
+	0x10, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x4d, 0x65, 0x6d, 0x62, 0x65, 0x72, 0x73, 0x68, 0x69,
+	0x70, 0x12, 0x1b, 0x2e, 0x70, 0x62, 0x2e, 0x4d, 0x65, 0x6d, 0x62, 0x65, 0x72, 0x73, 0x68, 0x69,
+	0x70, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1c,
+	0x2e, 0x70, 0x62, 0x2e, 0x4d, 0x65, 0x6d, 0x62, 0x65, 0x72, 0x73, 0x68, 0x69, 0x70, 0x43, 0x68,
+	0x61, 0x6e, 0x67, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3b, 0x0a, 0x0a,
+	0x54, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x4e, 0x6f, 0x77, 0x12, 0x15, 0x2e, 0x70, 0x62, 0x2e,
+	0x54, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x4e, 0x6f, 0x77, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x16, 0x2e, 0x70, 0x62, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x4e, 0x6f,
+	0x77, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x1f, 0x5a, 0x1d, 0x67, 0x69, 0x74,
+	0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x73, 0x75, 0x6d, 0x69, 0x6d, 0x61, 0x6b, 0x69,
+	0x74, 0x6f, 0x2f, 0x72, 0x61, 0x66, 0x74, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x33,
 }
 
 var file_transport_proto_goTypes = []interface{}{
@@ -52,25 +61,33 @@ var file_transport_proto_goTypes = []interface{}{
 	(*RequestVoteRequest)(nil),         // 1: pb.RequestVoteRequest
 	(*InstallSnapshotRequestData)(nil), // 2: pb.InstallSnapshotRequestData
 	(*ApplyLogRequest)(nil),            // 3: pb.ApplyLogRequest
-	(*AppendEntriesResponse)(nil),      // 4: pb.AppendEntriesResponse
-	(*RequestVoteResponse)(nil),        // 5: pb.RequestVoteResponse
-	(*InstallSnapshotResponse)(nil),    // 6: pb.InstallSnapshotResponse
-	(*ApplyLogResponse)(nil),           // 7: pb.ApplyLogResponse
+	(*MembershipChangeRequest)(nil),    // 4: pb.MembershipChangeRequest
+	(*TimeoutNowRequest)(nil),          // 5: pb.TimeoutNowRequest
+	(*AppendEntriesResponse)(nil),      // 6: pb.AppendEntriesResponse
+	(*RequestVoteResponse)(nil),        // 7: pb.RequestVoteResponse
+	(*InstallSnapshotResponse)(nil),    // 8: pb.InstallSnapshotResponse
+	(*ApplyLogResponse)(nil),           // 9: pb.ApplyLogResponse
+	(*MembershipChangeResponse)(nil),   // 10: pb.MembershipChangeResponse
+	(*TimeoutNowResponse)(nil),         // 11: pb.TimeoutNowResponse
 }
 var file_transport_proto_depIdxs = []int32{
-	0, // 0: pb.Transport.AppendEntries:input_type -> pb.AppendEntriesRequest
-	1, // 1: pb.Transport.RequestVote:input_type -> pb.RequestVoteRequest
-	2, // 2: pb.Transport.InstallSnapshot:input_type -> pb.InstallSnapshotRequestData
-	3, // 3: pb.Transport.ApplyLog:input_type -> pb.ApplyLogRequest
-	4, // 4: pb.Transport.AppendEntries:output_type -> pb.AppendEntriesResponse
-	5, // 5: pb.Transport.RequestVote:output_type -> pb.RequestVoteResponse
-	6, // 6: pb.Transport.InstallSnapshot:output_type -> pb.InstallSnapshotResponse
-	7, // 7: pb.Transport.ApplyLog:output_type -> pb.ApplyLogResponse
-	4, // [4:8] is the sub-list for method output_type
-	0, // [0:4] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	0,  // 0: pb.Transport.AppendEntries:input_type -> pb.AppendEntriesRequest
+	1,  // 1: pb.Transport.RequestVote:input_type -> pb.RequestVoteRequest
+	2,  // 2: pb.Transport.InstallSnapshot:input_type -> pb.InstallSnapshotRequestData
+	3,  // 3: pb.Transport.ApplyLog:input_type -> pb.ApplyLogRequest
+	4,  // 4: pb.Transport.ChangeMembership:input_type -> pb.MembershipChangeRequest
+	5,  // 5: pb.Transport.TimeoutNow:input_type -> pb.TimeoutNowRequest
+	6,  // 6: pb.Transport.AppendEntries:output_type -> pb.AppendEntriesResponse
+	7,  // 7: pb.Transport.RequestVote:output_type -> pb.RequestVoteResponse
+	8,  // 8: pb.Transport.InstallSnapshot:output_type -> pb.InstallSnapshotResponse
+	9,  // 9: pb.Transport.ApplyLog:output_type -> pb.ApplyLogResponse
+	10, // 10: pb.Transport.ChangeMembership:output_type -> pb.MembershipChangeResponse
+	11, // 11: pb.Transport.TimeoutNow:output_type -> pb.TimeoutNowResponse
+	6,  // [6:12] is the sub-list for method output_type
+	0,  // [0:6] is the sub-list for method input_type
+	0,  // [0:0] is the sub-list for extension type_name
+	0,  // [0:0] is the sub-list for extension extendee
+	0,  // [0:0] is the sub-list for field type_name
 }
 
 func init() { file_transport_proto_init() }
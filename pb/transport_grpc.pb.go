@@ -22,6 +22,8 @@ type TransportClient interface {
 	RequestVote(ctx context.Context, in *RequestVoteRequest, opts ...grpc.CallOption) (*RequestVoteResponse, error)
 	InstallSnapshot(ctx context.Context, opts ...grpc.CallOption) (Transport_InstallSnapshotClient, error)
 	ApplyLog(ctx context.Context, in *ApplyLogRequest, opts ...grpc.CallOption) (*ApplyLogResponse, error)
+	ChangeMembership(ctx context.Context, in *MembershipChangeRequest, opts ...grpc.CallOption) (*MembershipChangeResponse, error)
+	TimeoutNow(ctx context.Context, in *TimeoutNowRequest, opts ...grpc.CallOption) (*TimeoutNowResponse, error)
 }
 
 type transportClient struct {
@@ -93,6 +95,24 @@ func (c *transportClient) ApplyLog(ctx context.Context, in *ApplyLogRequest, opt
 	return out, nil
 }
 
+func (c *transportClient) ChangeMembership(ctx context.Context, in *MembershipChangeRequest, opts ...grpc.CallOption) (*MembershipChangeResponse, error) {
+	out := new(MembershipChangeResponse)
+	err := c.cc.Invoke(ctx, "/pb.Transport/ChangeMembership", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transportClient) TimeoutNow(ctx context.Context, in *TimeoutNowRequest, opts ...grpc.CallOption) (*TimeoutNowResponse, error) {
+	out := new(TimeoutNowResponse)
+	err := c.cc.Invoke(ctx, "/pb.Transport/TimeoutNow", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TransportServer is the server API for Transport service.
 // All implementations must embed UnimplementedTransportServer
 // for forward compatibility
@@ -101,6 +121,8 @@ type TransportServer interface {
 	RequestVote(context.Context, *RequestVoteRequest) (*RequestVoteResponse, error)
 	InstallSnapshot(Transport_InstallSnapshotServer) error
 	ApplyLog(context.Context, *ApplyLogRequest) (*ApplyLogResponse, error)
+	ChangeMembership(context.Context, *MembershipChangeRequest) (*MembershipChangeResponse, error)
+	TimeoutNow(context.Context, *TimeoutNowRequest) (*TimeoutNowResponse, error)
 	mustEmbedUnimplementedTransportServer()
 }
 
@@ -120,6 +142,12 @@ func (UnimplementedTransportServer) InstallSnapshot(Transport_InstallSnapshotSer
 func (UnimplementedTransportServer) ApplyLog(context.Context, *ApplyLogRequest) (*ApplyLogResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ApplyLog not implemented")
 }
+func (UnimplementedTransportServer) ChangeMembership(context.Context, *MembershipChangeRequest) (*MembershipChangeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ChangeMembership not implemented")
+}
+func (UnimplementedTransportServer) TimeoutNow(context.Context, *TimeoutNowRequest) (*TimeoutNowResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TimeoutNow not implemented")
+}
 func (UnimplementedTransportServer) mustEmbedUnimplementedTransportServer() {}
 
 // UnsafeTransportServer may be embedded to opt out of forward compatibility for this service.
@@ -213,6 +241,42 @@ func _Transport_ApplyLog_Handler(srv interface{}, ctx context.Context, dec func(
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Transport_ChangeMembership_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MembershipChangeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransportServer).ChangeMembership(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Transport/ChangeMembership",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransportServer).ChangeMembership(ctx, req.(*MembershipChangeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Transport_TimeoutNow_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TimeoutNowRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransportServer).TimeoutNow(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Transport/TimeoutNow",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransportServer).TimeoutNow(ctx, req.(*TimeoutNowRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Transport_ServiceDesc is the grpc.ServiceDesc for Transport service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -232,6 +296,14 @@ var Transport_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ApplyLog",
 			Handler:    _Transport_ApplyLog_Handler,
 		},
+		{
+			MethodName: "ChangeMembership",
+			Handler:    _Transport_ChangeMembership_Handler,
+		},
+		{
+			MethodName: "TimeoutNow",
+			Handler:    _Transport_TimeoutNow_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -0,0 +1,49 @@
+package raft
+
+import (
+	"sync"
+
+	"github.com/sumimakito/raft/pb"
+)
+
+// logPool reuses the logs built by appendLogs. The logStoreProxy appends copies
+// of the logs to the LogStores that may retain them.
+var logPool = sync.Pool{New: func() interface{} { return new(pb.Log) }}
+
+func acquireLog(meta *pb.LogMeta, body *pb.LogBody) *pb.Log {
+	log := logPool.Get().(*pb.Log)
+	log.Meta, log.Body = meta, body
+	return log
+}
+
+// releaseLogs returns the logs to the pool. The metas and bodies of the logs
+// are left untouched, as they may still be referenced.
+func releaseLogs(logs []*pb.Log) {
+	for i, log := range logs {
+		log.Reset()
+		logPool.Put(log)
+		logs[i] = nil
+	}
+}
+
+// appendEntriesRequestPool reuses the AppendEntriesRequests of the
+// replications, along with their slices of entries.
+var appendEntriesRequestPool = sync.Pool{New: func() interface{} { return new(pb.AppendEntriesRequest) }}
+
+func acquireAppendEntriesRequest() *pb.AppendEntriesRequest {
+	return appendEntriesRequestPool.Get().(*pb.AppendEntriesRequest)
+}
+
+// releaseAppendEntriesRequest returns the request to the pool. It must only
+// be called once the Transport no longer references the request, i.e., after
+// the response is received, as the in-process Transports may still hand the
+// request of a failed call to the server.
+func releaseAppendEntriesRequest(request *pb.AppendEntriesRequest) {
+	entries := request.Entries
+	for i := range entries {
+		entries[i] = nil
+	}
+	request.Reset()
+	request.Entries = entries[:0]
+	appendEntriesRequestPool.Put(request)
+}
@@ -0,0 +1,29 @@
+package raft
+
+// QueueDepth is the fill level of a queue.
+type QueueDepth struct {
+	Length   int `json:"length"`
+	Capacity int `json:"capacity"`
+}
+
+// QueueDepths are the fill levels of the queues consumed by the main loop. A
+// queue staying full means the main loop is saturated, e.g., by a slow
+// LogStore or StateMachine, and the producers are blocked.
+type QueueDepths struct {
+	// LogOps queues the logs to append, e.g., from Apply.
+	LogOps QueueDepth `json:"log_ops"`
+	// Commit queues the updates on the commit index.
+	Commit QueueDepth `json:"commit"`
+	// TransportRPC queues the incoming RPCs received by the Transport.
+	TransportRPC QueueDepth `json:"transport_rpc"`
+}
+
+// QueueDepths returns the fill levels of the queues consumed by the main loop.
+func (s *Server) QueueDepths() QueueDepths {
+	rpcCh := s.trans.RPC()
+	return QueueDepths{
+		LogOps:       QueueDepth{Length: len(s.logOpsCh), Capacity: cap(s.logOpsCh)},
+		Commit:       QueueDepth{Length: len(s.commitCh), Capacity: cap(s.commitCh)},
+		TransportRPC: QueueDepth{Length: len(rpcCh), Capacity: cap(rpcCh)},
+	}
+}
@@ -0,0 +1,352 @@
+package raftclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+)
+
+// APIError is returned when the API server responds with an unexpected status
+// code. Err is the error carried in the response, if any.
+type APIError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("%v (status code %d)", e.Err, e.StatusCode)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Configuration is a configuration of the cluster. Next is only set in a joint
+// configuration. Staging are the peers receiving the logs as non-voters until
+// they catch up with the leader. Initiator is the client or the server that
+// initiated the change to the configuration.
+type Configuration struct {
+	LogIndex  uint64     `json:"log_index"`
+	Joint     bool       `json:"joint"`
+	Current   []*pb.Peer `json:"current"`
+	Next      []*pb.Peer `json:"next,omitempty"`
+	Staging   []*pb.Peer `json:"staging,omitempty"`
+	Initiator string     `json:"initiator,omitempty"`
+}
+
+// ConfigurationRecord is a committed configuration in the history. Term is
+// zero if it's the bootstrap configuration or restored from a snapshot.
+type ConfigurationRecord struct {
+	Configuration
+	Term uint64 `json:"term,omitempty"`
+}
+
+// Members are the committed and the latest configurations of the cluster.
+type Members struct {
+	Committed Configuration `json:"committed"`
+	Latest    Configuration `json:"latest"`
+}
+
+// SnapshotInfo identifies a snapshot taken on a server.
+type SnapshotInfo struct {
+	Id    string `json:"id"`
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+}
+
+// httpDo sends the request to the API server at the endpoint, and decodes the
+// response into v if v is not nil.
+func (c *Client) httpDo(ctx context.Context, method, endpoint, path string, body, v interface{}) error {
+	request, err := c.httpRequest(ctx, method, endpoint, path, body)
+	if err != nil {
+		return err
+	}
+	response, err := httpSend(c.opts.httpClient, request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if v == nil || response.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// httpRequest creates the request to the API server at the endpoint with the
+// body encoded in JSON, if any.
+func (c *Client) httpRequest(ctx context.Context, method, endpoint, path string, body interface{}) (*http.Request, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		bodyReader = bytes.NewReader(data)
+	}
+	request, err := c.newHTTPRequest(ctx, method, endpoint, path, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	return request, nil
+}
+
+func (c *Client) newHTTPRequest(ctx context.Context, method, endpoint, path string, body io.Reader) (*http.Request, error) {
+	scheme := "http"
+	if c.opts.tlsConfig != nil {
+		scheme = "https"
+	}
+	request, err := http.NewRequestWithContext(ctx, method, scheme+"://"+endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.bearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+c.opts.bearerToken)
+	}
+	return request, nil
+}
+
+// httpSend sends the request and returns the response with a 2xx status code,
+// or the APIError.
+func httpSend(httpClient *http.Client, request *http.Request) (*http.Response, error) {
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 == 2 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	apiErr := &APIError{StatusCode: response.StatusCode}
+	var errorResponse struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&errorResponse); err == nil && errorResponse.Error != "" {
+		apiErr.Err = responseError(errorResponse.Error)
+	}
+	return nil, apiErr
+}
+
+// doLeader calls fn with the endpoint of the leader, and forgets the leader if
+// fn fails so that it's discovered again on the next call.
+func (c *Client) doLeader(ctx context.Context, fn func(leader string) error) error {
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fn(leader); err != nil {
+		c.resetLeader(leader)
+		return err
+	}
+	return nil
+}
+
+// Endpoints returns the endpoints the client is created with.
+func (c *Client) Endpoints() []string {
+	return append([]string{}, c.endpoints...)
+}
+
+// Status returns the states of the server at the endpoint.
+func (c *Client) Status(ctx context.Context, endpoint string) (*raft.ServerStates, error) {
+	return c.status(ctx, endpoint)
+}
+
+// Members returns the configurations known to the leader.
+func (c *Client) Members(ctx context.Context) (*Members, error) {
+	var members Members
+	if err := c.doLeader(ctx, func(leader string) error {
+		return c.httpDo(ctx, http.MethodGet, leader, "/api/v1/members", nil, &members)
+	}); err != nil {
+		return nil, err
+	}
+	return &members, nil
+}
+
+// ConfigurationHistory returns the configurations committed on the leader in
+// the order they were committed.
+func (c *Client) ConfigurationHistory(ctx context.Context) ([]ConfigurationRecord, error) {
+	var records []ConfigurationRecord
+	if err := c.doLeader(ctx, func(leader string) error {
+		return c.httpDo(ctx, http.MethodGet, leader, "/api/v1/members/history", nil, &records)
+	}); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// AddPeer adds the peer to the cluster with a configuration transition. The
+// metadata of the peer, if any, are carried in the configurations. The peer
+// is added as a non-voter if its suffrage is SUFFRAGE_NON_VOTER.
+func (c *Client) AddPeer(ctx context.Context, peer *pb.Peer) error {
+	return c.doLeader(ctx, func(leader string) error {
+		body := map[string]interface{}{"id": peer.Id, "endpoint": peer.Endpoint}
+		if len(peer.Metadata) > 0 {
+			body["metadata"] = peer.Metadata
+		}
+		if peer.Suffrage == pb.Suffrage_SUFFRAGE_NON_VOTER {
+			body["non_voter"] = true
+		}
+		return c.httpDo(ctx, http.MethodPost, leader, "/api/v1/members", body, nil)
+	})
+}
+
+// UpdatePeer replaces the endpoint and the metadata of the peer with the same
+// ID in the configuration.
+func (c *Client) UpdatePeer(ctx context.Context, peer *pb.Peer) error {
+	return c.doLeader(ctx, func(leader string) error {
+		body := map[string]interface{}{"endpoint": peer.Endpoint}
+		if len(peer.Metadata) > 0 {
+			body["metadata"] = peer.Metadata
+		}
+		return c.httpDo(ctx, http.MethodPut, leader, "/api/v1/members/"+peer.Id, body, nil)
+	})
+}
+
+// PromotePeer promotes the non-voter with the ID to a voter with a
+// configuration transition.
+func (c *Client) PromotePeer(ctx context.Context, id string) error {
+	return c.doLeader(ctx, func(leader string) error {
+		return c.httpDo(ctx, http.MethodPost, leader, "/api/v1/members/"+id+"/promote", nil, nil)
+	})
+}
+
+// RemovePeer removes the server with the ID from the cluster with a
+// configuration transition.
+func (c *Client) RemovePeer(ctx context.Context, id string) error {
+	return c.doLeader(ctx, func(leader string) error {
+		return c.httpDo(ctx, http.MethodDelete, leader, "/api/v1/members/"+id, nil, nil)
+	})
+}
+
+// AbortTransition aborts the configuration transition in progress if its
+// joint configuration is yet to be committed, and reverts to the configuration
+// before it.
+func (c *Client) AbortTransition(ctx context.Context) error {
+	return c.doLeader(ctx, func(leader string) error {
+		return c.httpDo(ctx, http.MethodPost, leader, "/api/v1/members/abort", nil, nil)
+	})
+}
+
+// TransferLeadership transfers the leadership to the voter with the ID, or to
+// the most up-to-date voter if id is empty. It returns once the leader steps
+// down.
+func (c *Client) TransferLeadership(ctx context.Context, id string) error {
+	return c.doLeader(ctx, func(leader string) error {
+		return c.httpDo(ctx, http.MethodPost, leader, "/api/v1/leadership/transfer", map[string]string{"id": id}, nil)
+	})
+}
+
+// Snapshot takes a snapshot on the server at the endpoint.
+func (c *Client) Snapshot(ctx context.Context, endpoint string) (*SnapshotInfo, error) {
+	var info SnapshotInfo
+	if err := c.httpDo(ctx, http.MethodPost, endpoint, "/api/v1/snapshots", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// StorageStats returns the disk usage of the StableStore of the server at the
+// endpoint. raft.ErrCompactionUnsupported is returned if the StableStore
+// cannot be compacted.
+func (c *Client) StorageStats(ctx context.Context, endpoint string) (*raft.StorageStats, error) {
+	var stats raft.StorageStats
+	if err := c.httpDo(ctx, http.MethodGet, endpoint, "/api/v1/storage", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// CompactStorage compacts the StableStore of the server at the endpoint and
+// returns the disk usage after the compaction.
+// raft.ErrCompactionUnsupported is returned if the StableStore cannot be
+// compacted.
+func (c *Client) CompactStorage(ctx context.Context, endpoint string) (*raft.StorageStats, error) {
+	var stats raft.StorageStats
+	if err := c.httpDo(ctx, http.MethodPost, endpoint, "/api/v1/storage/compact", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// ExtensionRequest sends the request to the route of the APIExtension at the
+// path on the leader, e.g., /keys for /api/extension/keys, and returns the
+// response with a 2xx status code, or the APIError. The body of the response
+// must be closed. The request is only bounded by ctx, so that the response
+// can be streamed. The leader is discovered again unless the request is
+// rejected with a 4xx status code.
+func (c *Client) ExtensionRequest(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	request, err := c.newHTTPRequest(ctx, method, leader, "/api/extension"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := *c.opts.httpClient
+	httpClient.Timeout = 0
+	response, err := httpSend(&httpClient, request)
+	if err != nil {
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode/100 != 4 {
+			c.resetLeader(leader)
+		}
+		return nil, err
+	}
+	return response, nil
+}
+
+// Events calls fn with the events of the server at the endpoint as they are
+// published, until fn returns an error, the stream ends, or ctx is done. The
+// Data of the events is decoded from JSON as is.
+func (c *Client) Events(ctx context.Context, endpoint string, fn func(event *raft.Event) error) error {
+	request, err := c.httpRequest(ctx, http.MethodGet, endpoint, "/api/v1/events", nil)
+	if err != nil {
+		return err
+	}
+	// The events are streamed without the timeout of the http.Client.
+	httpClient := *c.opts.httpClient
+	httpClient.Timeout = 0
+	response, err := httpSend(&httpClient, request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	scanner := bufio.NewScanner(response.Body)
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: ")...)
+		case line == "" && len(data) > 0:
+			var event raft.Event
+			if err := json.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			data = nil
+			if err := fn(&event); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
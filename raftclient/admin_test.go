@@ -0,0 +1,163 @@
+package raftclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+)
+
+func TestClientAdmin(t *testing.T) {
+	var added map[string]interface{}
+	var removed, promoted, transferTo string
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/status", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(raft.ServerStates{ID: "1", Role: raft.Leader.String()})
+	})
+	router.HandleFunc("/api/v1/members", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(Members{
+			Committed: Configuration{LogIndex: 1, Current: []*pb.Peer{{Id: "1", Endpoint: "e1"}}},
+			Latest:    Configuration{LogIndex: 1, Current: []*pb.Peer{{Id: "1", Endpoint: "e1"}}},
+		})
+	}).Methods("GET")
+	router.HandleFunc("/api/v1/members", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&added)
+		rw.WriteHeader(http.StatusNoContent)
+	}).Methods("POST")
+	router.HandleFunc("/api/v1/members/history", func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, `[{"log_index":1,"joint":false,"current":[{"id":"1","endpoint":"e1"}],"initiator":"1","term":2}]`)
+	}).Methods("GET")
+	router.HandleFunc("/api/v1/members/{id}", func(rw http.ResponseWriter, r *http.Request) {
+		removed = mux.Vars(r)["id"]
+		rw.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(rw, `{"error":"unknown peer: %s"}`, removed)
+	}).Methods("DELETE")
+	router.HandleFunc("/api/v1/members/{id}/promote", func(rw http.ResponseWriter, r *http.Request) {
+		promoted = mux.Vars(r)["id"]
+		rw.WriteHeader(http.StatusNoContent)
+	}).Methods("POST")
+	router.HandleFunc("/api/v1/leadership/transfer", func(rw http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		transferTo = request["id"]
+		rw.WriteHeader(http.StatusMisdirectedRequest)
+		fmt.Fprintf(rw, `{"error":%q}`, raft.ErrNonLeader.Error())
+	}).Methods("POST")
+	router.HandleFunc("/api/v1/snapshots", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(SnapshotInfo{Id: "s", Index: 3, Term: 2})
+	}).Methods("POST")
+	router.HandleFunc("/api/v1/storage", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(raft.StorageStats{SizeBytes: 400, LiveBytes: 100, Fragmentation: 0.75})
+	}).Methods("GET")
+	router.HandleFunc("/api/v1/storage/compact", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(rw, `{"error":%q}`, raft.ErrCompactionUnsupported.Error())
+	}).Methods("POST")
+	router.HandleFunc("/api/v1/events", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(rw, ": keepalive\n\n")
+		fmt.Fprint(rw, "event: role_changed\ndata: {\"type\":\"role_changed\",\"term\":2,\"data\":\"leader\"}\n\n")
+		fmt.Fprint(rw, "event: election_won\ndata: {\"type\":\"election_won\",\"term\":2,\"data\":2}\n\n")
+	})
+	router.HandleFunc("/api/extension/keys/{key}", func(rw http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["key"] != "k" {
+			rw.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(rw, `{"error":"key not found"}`)
+			return
+		}
+		io.Copy(rw, r.Body)
+	}).Methods("PUT")
+	server := httptest.NewServer(router)
+	defer server.Close()
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+
+	client, err := New([]string{endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	states, err := client.Status(ctx, endpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", states.ID)
+
+	members, err := client.Members(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "e1", members.Latest.Current[0].Endpoint)
+
+	history, err := client.ConfigurationHistory(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, uint64(1), history[0].LogIndex)
+		assert.Equal(t, uint64(2), history[0].Term)
+		assert.Equal(t, "1", history[0].Initiator)
+	}
+
+	assert.NoError(t, client.AddPeer(ctx, &pb.Peer{Id: "2", Endpoint: "e2", Metadata: map[string]string{"zone": "a"}}))
+	assert.Equal(t, map[string]interface{}{
+		"id": "2", "endpoint": "e2", "metadata": map[string]interface{}{"zone": "a"},
+	}, added)
+	added = nil
+	assert.NoError(t, client.AddPeer(ctx, &pb.Peer{Id: "4", Endpoint: "e4", Suffrage: pb.Suffrage_SUFFRAGE_NON_VOTER}))
+	assert.Equal(t, map[string]interface{}{"id": "4", "endpoint": "e4", "non_voter": true}, added)
+
+	assert.NoError(t, client.PromotePeer(ctx, "4"))
+	assert.Equal(t, "4", promoted)
+
+	err = client.RemovePeer(ctx, "3")
+	assert.Equal(t, "3", removed)
+	var apiErr *APIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+		assert.Contains(t, apiErr.Error(), "unknown peer: 3")
+	}
+
+	err = client.TransferLeadership(ctx, "2")
+	assert.Equal(t, "2", transferTo)
+	assert.ErrorIs(t, err, raft.ErrNonLeader)
+
+	info, err := client.Snapshot(ctx, endpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, SnapshotInfo{Id: "s", Index: 3, Term: 2}, *info)
+
+	stats, err := client.StorageStats(ctx, endpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, raft.StorageStats{SizeBytes: 400, LiveBytes: 100, Fragmentation: 0.75}, *stats)
+	_, err = client.CompactStorage(ctx, endpoint)
+	assert.ErrorIs(t, err, raft.ErrCompactionUnsupported)
+
+	response, err := client.ExtensionRequest(ctx, http.MethodPut, "/keys/k", strings.NewReader("v"))
+	if assert.NoError(t, err) {
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, "v", string(body))
+	}
+	_, err = client.ExtensionRequest(ctx, http.MethodPut, "/keys/unknown", nil)
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+		assert.EqualError(t, apiErr.Err, "key not found")
+	}
+
+	var events []*raft.Event
+	assert.NoError(t, client.Events(ctx, endpoint, func(event *raft.Event) error {
+		events = append(events, event)
+		return nil
+	}))
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, raft.EventRoleChanged, events[0].Type)
+		assert.Equal(t, "leader", events[0].Data)
+		assert.Equal(t, raft.EventElectionWon, events[1].Type)
+		assert.Equal(t, float64(2), events[1].Data)
+	}
+}
@@ -0,0 +1,374 @@
+// Package raftclient implements a client of the API servers of a raft
+// cluster. The client discovers the leader with the status API, sends the
+// requests to the leader with gRPC, and retries the requests on another
+// server when the leader changes.
+package raftclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+var defaultRetryPolicy = raft.ExponentialRetryPolicy{
+	Initial:     100 * time.Millisecond,
+	Max:         2 * time.Second,
+	Multiplier:  2,
+	Jitter:      0.3,
+	MaxAttempts: 10,
+}
+
+// ErrNoEndpoints indicates that the client is created without any endpoint.
+var ErrNoEndpoints = errors.New("no endpoints")
+
+type options struct {
+	bearerToken string
+	dialOptions []grpc.DialOption
+	httpClient  *http.Client
+	retryPolicy raft.RetryPolicy
+	tlsConfig   *tls.Config
+}
+
+type Option func(options *options)
+
+// BearerTokenOption makes the client authenticate with the token in the
+// "Authorization: Bearer <token>" header, which is checked by
+// raft.TokenAuthenticator.
+func BearerTokenOption(token string) Option {
+	return func(options *options) {
+		options.bearerToken = token
+	}
+}
+
+// DialOptionsOption sets the options used to dial the gRPC connections.
+// Defaults to insecure connections.
+func DialOptionsOption(dialOptions ...grpc.DialOption) Option {
+	return func(options *options) {
+		options.dialOptions = dialOptions
+	}
+}
+
+// HTTPClientOption sets the http.Client used to query the status API.
+func HTTPClientOption(client *http.Client) Option {
+	return func(options *options) {
+		options.httpClient = client
+	}
+}
+
+// TLSConfigOption makes the client connect to the API servers with TLS using
+// the config. It overrides the transport credentials in the dial options and
+// the TLS config of the http.Client without a Transport.
+func TLSConfigOption(config *tls.Config) Option {
+	return func(options *options) {
+		options.tlsConfig = config
+	}
+}
+
+// RetryPolicyOption sets the RetryPolicy for the requests that fail due to
+// leader changes or unreachable servers.
+func RetryPolicyOption(policy raft.RetryPolicy) Option {
+	return func(options *options) {
+		options.retryPolicy = policy
+	}
+}
+
+// bearerTokenCredentials implements credentials.PerRPCCredentials.
+type bearerTokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (c bearerTokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c bearerTokenCredentials) RequireTransportSecurity() bool {
+	return c.secure
+}
+
+// Client sends requests to the leader of a raft cluster. It is safe for
+// concurrent use.
+type Client struct {
+	endpoints []string
+	opts      *options
+
+	mu     sync.Mutex // protects leader and conns
+	leader string
+	conns  map[string]*grpc.ClientConn
+}
+
+// New returns a Client of the cluster whose API servers listen on the
+// endpoints in the form of host:port. Connections are established lazily.
+func New(endpoints []string, opts ...Option) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	options := &options{
+		dialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		httpClient:  &http.Client{Timeout: 5 * time.Second},
+		retryPolicy: defaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.bearerToken != "" {
+		options.dialOptions = append(options.dialOptions,
+			grpc.WithPerRPCCredentials(bearerTokenCredentials{token: options.bearerToken, secure: options.tlsConfig != nil}))
+	}
+	if options.tlsConfig != nil {
+		options.dialOptions = append(options.dialOptions,
+			grpc.WithTransportCredentials(credentials.NewTLS(options.tlsConfig)))
+		if options.httpClient.Transport == nil {
+			httpClient := *options.httpClient
+			httpClient.Transport = &http.Transport{TLSClientConfig: options.tlsConfig}
+			options.httpClient = &httpClient
+		}
+	}
+	return &Client{
+		endpoints: append([]string{}, endpoints...),
+		opts:      options,
+		conns:     map[string]*grpc.ClientConn{},
+	}, nil
+}
+
+// status queries the status API of the server at the endpoint.
+func (c *Client) status(ctx context.Context, endpoint string) (*raft.ServerStates, error) {
+	var states raft.ServerStates
+	if err := c.httpDo(ctx, http.MethodGet, endpoint, "/api/v1/status", nil, &states); err != nil {
+		return nil, err
+	}
+	return &states, nil
+}
+
+// Leader returns the endpoint of the API server on the leader. The endpoints
+// are queried in turn if the leader is not known to the client.
+func (c *Client) Leader(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	leader := c.leader
+	c.mu.Unlock()
+	if leader != "" {
+		return leader, nil
+	}
+	for _, endpoint := range c.endpoints {
+		states, err := c.status(ctx, endpoint)
+		if err != nil {
+			continue
+		}
+		if states.Role == raft.Leader.String() {
+			c.mu.Lock()
+			c.leader = endpoint
+			c.mu.Unlock()
+			return endpoint, nil
+		}
+	}
+	return "", raft.ErrNoLeader
+}
+
+// resetLeader forgets the leader so that it will be discovered again.
+func (c *Client) resetLeader(leader string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader == leader {
+		c.leader = ""
+	}
+}
+
+func (c *Client) conn(endpoint string) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conns[endpoint]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(endpoint, c.opts.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[endpoint] = conn
+	return conn, nil
+}
+
+// do calls fn with the client of the leader until it succeeds, fails with an
+// error unrelated to the leader, the RetryPolicy gives up, or ctx is done.
+func (c *Client) do(ctx context.Context, fn func(client pb.APIServiceClient) error) error {
+	return c.doRetryable(ctx, retryable, fn)
+}
+
+// doRetryable is do with the errors to retry decided by isRetryable.
+func (c *Client) doRetryable(
+	ctx context.Context, isRetryable func(err error) bool, fn func(client pb.APIServiceClient) error,
+) error {
+	for attempt := 1; ; attempt++ {
+		err := c.try(ctx, fn)
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+		delay, ok := c.opts.retryPolicy.Backoff(attempt)
+		if !ok {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) try(ctx context.Context, fn func(client pb.APIServiceClient) error) error {
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		return err
+	}
+	conn, err := c.conn(leader)
+	if err != nil {
+		c.resetLeader(leader)
+		return err
+	}
+	if err := fn(pb.NewAPIServiceClient(conn)); err != nil {
+		if retryable(err) {
+			c.resetLeader(leader)
+		}
+		return err
+	}
+	return nil
+}
+
+// retryable reports whether the error is caused by leader changes or
+// unreachable servers.
+func retryable(err error) bool {
+	if errors.Is(err, raft.ErrNonLeader) || errors.Is(err, raft.ErrNoLeader) {
+		return true
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Code() == codes.Unavailable
+	}
+	return false
+}
+
+// responseError converts the error carried in a response back to the known
+// error it originates from if possible.
+func responseError(message string) error {
+	for _, err := range []error{
+		raft.ErrNonLeader, raft.ErrNoLeader, raft.ErrDeadlineExceeded, raft.ErrLeadershipLost,
+		raft.ErrLeadershipTransfer, raft.ErrUnknownSession, raft.ErrStaleSequence, raft.ErrProposalDropped,
+		raft.ErrCompactionUnsupported,
+	} {
+		if message == err.Error() {
+			return err
+		}
+	}
+	if strings.HasPrefix(message, raft.ErrNoLeader.Error()) {
+		// Keep the hints of the raft.NoLeaderError in the message.
+		return fmt.Errorf("%w%s", raft.ErrNoLeader, strings.TrimPrefix(message, raft.ErrNoLeader.Error()))
+	}
+	return errors.New(message)
+}
+
+// Apply applies the log on the leader and returns the metadata of the log.
+func (c *Client) Apply(ctx context.Context, body *pb.LogBody) (*pb.LogMeta, error) {
+	var meta *pb.LogMeta
+	err := c.do(ctx, func(client pb.APIServiceClient) error {
+		response, err := client.Apply(ctx, body)
+		if err != nil {
+			return err
+		}
+		return applyLogResult(response, &meta)
+	})
+	return meta, err
+}
+
+// ApplyCommand applies the command on the leader and returns the metadata of
+// the log.
+func (c *Client) ApplyCommand(ctx context.Context, command []byte) (*pb.LogMeta, error) {
+	var meta *pb.LogMeta
+	err := c.do(ctx, func(client pb.APIServiceClient) error {
+		response, err := client.ApplyCommand(ctx, &pb.Command{Data: command})
+		if err != nil {
+			return err
+		}
+		return applyLogResult(response, &meta)
+	})
+	return meta, err
+}
+
+func applyLogResult(response *pb.ApplyLogResponse, meta **pb.LogMeta) error {
+	switch r := response.Response.(type) {
+	case *pb.ApplyLogResponse_Meta:
+		*meta = r.Meta
+		return nil
+	case *pb.ApplyLogResponse_Error:
+		return responseError(r.Error)
+	}
+	return errors.New("empty response")
+}
+
+// ReadIndex returns the read index from the leader, which is applied to the
+// state machine of the leader on return. See raft.Server.ReadIndex.
+func (c *Client) ReadIndex(ctx context.Context) (uint64, error) {
+	var index uint64
+	err := c.do(ctx, func(client pb.APIServiceClient) error {
+		response, err := client.ReadIndex(ctx, &pb.ReadIndexRequest{})
+		if err != nil {
+			return err
+		}
+		if response.Error != "" {
+			return responseError(response.Error)
+		}
+		index = response.Index
+		return nil
+	})
+	return index, err
+}
+
+// WatchLogs calls fn with the committed and applied logs starting from the
+// log at fromIndex until fn returns an error or ctx is done. Only the logs of
+// the types are watched unless types is empty. The watch is resumed from the
+// next log if the stream breaks. See raft.Server.WatchLogs.
+func (c *Client) WatchLogs(ctx context.Context, fromIndex uint64, types []pb.LogType, fn func(log *pb.Log) error) error {
+	return c.do(ctx, func(client pb.APIServiceClient) error {
+		stream, err := client.WatchLogs(ctx, &pb.WatchLogsRequest{FromIndex: fromIndex, Types: types})
+		if err != nil {
+			return err
+		}
+		for {
+			log, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			if err := fn(log); err != nil {
+				return err
+			}
+			fromIndex = log.Meta.Index + 1
+		}
+	})
+}
+
+// Close closes all connections.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var firstErr error
+	for endpoint, conn := range c.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.conns, endpoint)
+	}
+	c.leader = ""
+	return firstErr
+}
@@ -0,0 +1,123 @@
+package raftclient
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+)
+
+// testingAPIServer serves the status API and the APIService on the same
+// listener like the API server does.
+type testingAPIServer struct {
+	pb.UnimplementedAPIServiceServer
+	role     uint32 // raft.ServerRole
+	endpoint string
+	requests int32
+}
+
+func (s *testingAPIServer) Role() raft.ServerRole {
+	return raft.ServerRole(atomic.LoadUint32(&s.role))
+}
+
+func (s *testingAPIServer) SetRole(role raft.ServerRole) {
+	atomic.StoreUint32(&s.role, uint32(role))
+}
+
+func (s *testingAPIServer) ApplyCommand(ctx context.Context, cmd *pb.Command) (*pb.ApplyLogResponse, error) {
+	atomic.AddInt32(&s.requests, 1)
+	return &pb.ApplyLogResponse{Response: &pb.ApplyLogResponse_Meta{Meta: &pb.LogMeta{Index: 1, Term: 1}}}, nil
+}
+
+func (s *testingAPIServer) ReadIndex(ctx context.Context, _ *pb.ReadIndexRequest) (*pb.ReadIndexResponse, error) {
+	atomic.AddInt32(&s.requests, 1)
+	if s.Role() != raft.Leader {
+		return &pb.ReadIndexResponse{Error: raft.ErrNonLeader.Error()}, nil
+	}
+	return &pb.ReadIndexResponse{Index: 3}, nil
+}
+
+func serveTestingAPIServer(t *testing.T, role raft.ServerRole) *testingAPIServer {
+	return serveTestingAPIServerWith(t, role, nil)
+}
+
+// serveTestingAPIServerWith serves the APIService with service if not nil.
+func serveTestingAPIServerWith(t *testing.T, role raft.ServerRole, service pb.APIServiceServer) *testingAPIServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testingAPIServer{role: uint32(role), endpoint: listener.Addr().String()}
+	if service == nil {
+		service = s
+	}
+	grpcServer := grpc.NewServer()
+	pb.RegisterAPIServiceServer(grpcServer, service)
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/status", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(raft.ServerStates{Role: s.Role().String()})
+	})
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(rw, r)
+			return
+		}
+		router.ServeHTTP(rw, r)
+	})
+	httpServer := &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+	go httpServer.Serve(listener)
+	t.Cleanup(func() { httpServer.Close() })
+	return s
+}
+
+func TestClient(t *testing.T) {
+	_, err := New(nil)
+	assert.ErrorIs(t, err, ErrNoEndpoints)
+
+	server1 := serveTestingAPIServer(t, raft.Follower)
+	server2 := serveTestingAPIServer(t, raft.Leader)
+	client, err := New([]string{server1.endpoint, server2.endpoint},
+		RetryPolicyOption(raft.ConstantRetryPolicy{MaxAttempts: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	leader, err := client.Leader(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, server2.endpoint, leader)
+
+	index, err := client.ReadIndex(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), index)
+
+	// The leader changes and the request is retried on the new leader.
+	server1.SetRole(raft.Leader)
+	server2.SetRole(raft.Follower)
+	index, err = client.ReadIndex(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), index)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&server2.requests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&server1.requests))
+
+	meta, err := client.ApplyCommand(context.Background(), []byte("command"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), meta.Index)
+
+	// No leader is found.
+	server1.SetRole(raft.Follower)
+	client.resetLeader(server1.endpoint)
+	_, err = client.ReadIndex(context.Background())
+	assert.ErrorIs(t, err, raft.ErrNoLeader)
+}
@@ -0,0 +1,103 @@
+package raftclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+)
+
+// Session is a client session in which the commands are applied exactly once
+// even if they are retried after the leader changes. See raft.Session. It is
+// safe for concurrent use.
+type Session struct {
+	client *Client
+	id     uint64
+
+	mu          sync.Mutex // protects sequence and outstanding
+	sequence    uint64
+	outstanding map[uint64]struct{}
+}
+
+// RegisterSession registers a new client session in the cluster.
+func (c *Client) RegisterSession(ctx context.Context) (*Session, error) {
+	var id uint64
+	err := c.do(ctx, func(client pb.APIServiceClient) error {
+		response, err := client.Apply(ctx, &pb.LogBody{Type: pb.LogType_REGISTER_SESSION})
+		if err != nil {
+			return err
+		}
+		var meta *pb.LogMeta
+		if err := applyLogResult(response, &meta); err != nil {
+			return err
+		}
+		if len(response.Result) != 8 {
+			return errors.New("malformed session ID")
+		}
+		id = raft.DecodeUint64(response.Result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Session{client: c, id: id, outstanding: map[uint64]struct{}{}}, nil
+}
+
+// ID returns the ID of the session.
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// ApplyCommand applies the command in the session and returns the metadata of
+// the log and the result of the command carried as bytes. The command is
+// retried while the leader changes, including when the leader is lost before
+// the command is applied.
+func (s *Session) ApplyCommand(ctx context.Context, command []byte) (*pb.LogMeta, []byte, error) {
+	s.mu.Lock()
+	s.sequence++
+	sequence := s.sequence
+	s.outstanding[sequence] = struct{}{}
+	acked := s.sequence
+	for outstanding := range s.outstanding {
+		if outstanding <= acked {
+			acked = outstanding - 1
+		}
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.outstanding, sequence)
+		s.mu.Unlock()
+	}()
+
+	body := &pb.LogBody{
+		Type:    pb.LogType_COMMAND,
+		Data:    command,
+		Session: &pb.SessionRequest{SessionId: s.id, Sequence: sequence, AckedSequence: acked},
+	}
+	var meta *pb.LogMeta
+	var result []byte
+	err := s.client.doRetryable(ctx, retryableInSession, func(client pb.APIServiceClient) error {
+		response, err := client.Apply(ctx, body)
+		if err != nil {
+			return err
+		}
+		if err := applyLogResult(response, &meta); err != nil {
+			return err
+		}
+		result = response.Result
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, result, nil
+}
+
+// retryableInSession reports whether the command may be retried in a session,
+// which also holds when the leader is lost before the command is applied.
+func retryableInSession(err error) bool {
+	return retryable(err) || errors.Is(err, raft.ErrLeadershipLost) || errors.Is(err, raft.ErrLeadershipTransfer)
+}
@@ -0,0 +1,66 @@
+package raftclient
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+)
+
+// testingSessionAPIServer fails the first try of each command with
+// raft.ErrLeadershipLost.
+type testingSessionAPIServer struct {
+	*testingAPIServer
+	mu       sync.Mutex
+	requests []*pb.SessionRequest
+}
+
+func (s *testingSessionAPIServer) Apply(ctx context.Context, body *pb.LogBody) (*pb.ApplyLogResponse, error) {
+	if body.Type == pb.LogType_REGISTER_SESSION {
+		return &pb.ApplyLogResponse{
+			Response: &pb.ApplyLogResponse_Meta{Meta: &pb.LogMeta{Index: 7, Term: 1}},
+			Result:   raft.EncodeUint64(7),
+		}, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, body.Session)
+	if len(s.requests)%2 == 1 {
+		return &pb.ApplyLogResponse{Response: &pb.ApplyLogResponse_Error{Error: raft.ErrLeadershipLost.Error()}}, nil
+	}
+	return &pb.ApplyLogResponse{
+		Response: &pb.ApplyLogResponse_Meta{Meta: &pb.LogMeta{Index: 8, Term: 1}},
+		Result:   body.Data,
+	}, nil
+}
+
+func TestSession(t *testing.T) {
+	server := &testingSessionAPIServer{}
+	server.testingAPIServer = serveTestingAPIServerWith(t, raft.Leader, server)
+	client, err := New([]string{server.endpoint}, RetryPolicyOption(raft.ConstantRetryPolicy{MaxAttempts: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session, err := client.RegisterSession(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), session.ID())
+
+	for _, command := range []string{"command1", "command2"} {
+		meta, result, err := session.ApplyCommand(context.Background(), []byte(command))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(8), meta.Index)
+		assert.Equal(t, command, string(result))
+	}
+	// The commands are retried with the same sequence numbers.
+	assert.Equal(t, []*pb.SessionRequest{
+		{SessionId: 7, Sequence: 1, AckedSequence: 0},
+		{SessionId: 7, Sequence: 1, AckedSequence: 0},
+		{SessionId: 7, Sequence: 2, AckedSequence: 1},
+		{SessionId: 7, Sequence: 2, AckedSequence: 1},
+	}, server.requests)
+}
@@ -0,0 +1,553 @@
+// Package rafttest runs the raft clusters in a process for the tests.
+package rafttest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap/zapcore"
+)
+
+// ErrPartitioned is returned for the RPCs between the servers partitioned by
+// the Cluster.
+var ErrPartitioned = errors.New("servers are partitioned")
+
+// Options configure a Cluster.
+type Options struct {
+	// Servers is the number of the servers. Defaults to 3.
+	Servers int
+	// StateMachine creates the StateMachine of the server with the ID.
+	// Defaults to creating a StateMachine.
+	StateMachine func(id string) raft.StateMachine
+	// ServerOptions are applied to all servers after the defaults of the
+	// Cluster, which have the API servers disabled, the logging quieted, and
+	// the timeouts shortened.
+	ServerOptions []raft.ServerOption
+	// WaitTimeout is how long the Wait methods wait before failing the test.
+	// Defaults to 10 seconds.
+	WaitTimeout time.Duration
+	// StableStore creates the StableStore of the server with the ID. The store
+	// is kept when the server is restarted, and is not closed by the Cluster.
+	// Defaults to creating an in-memory store.
+	StableStore func(id string) raft.StableStore
+	// SnapshotStore creates the SnapshatStore of the server with the ID. The
+	// store is kept when the server is restarted. Defaults to creating an
+	// ObjectSnapshotStore in memory.
+	SnapshotStore func(id string) raft.SnapshatStore
+	// Transport creates the Transport of the server with the ID. It's called
+	// again when the server is restarted, and the Transport created must have
+	// the same endpoint. Defaults to creating an InmemTransport.
+	Transport func(id string) raft.Transport
+}
+
+// Cluster is a cluster of servers run in the process, with the in-memory
+// providers and transport unless the Options say otherwise. The servers are
+// shut down when the test finishes.
+type Cluster struct {
+	t              testing.TB
+	opts           Options
+	network        *raft.InmemNetwork
+	peers          []*pb.Peer
+	stableStores   map[string]raft.StableStore
+	snapshotStores map[string]raft.SnapshatStore
+
+	serversMu     sync.RWMutex // protects the fields below
+	servers       []*raft.Server
+	stateMachines map[string]raft.StateMachine
+	// stopped marks the servers stopped by Stop.
+	stopped map[string]bool
+	// redeploys counts the servers redeployed by Redeploy, which names the
+	// new endpoints.
+	redeploys int
+
+	mu sync.RWMutex // protects the fields below
+	// groups maps the servers to their partitions. The servers talk only to
+	// those in the same partition.
+	groups    map[string]int
+	intercept func(from, to string, request interface{}) error
+}
+
+// NewCluster starts a cluster. The servers are named "1" to "N" after the
+// order they are created in.
+func NewCluster(t testing.TB, opts Options) *Cluster {
+	t.Helper()
+	if opts.Servers == 0 {
+		opts.Servers = 3
+	}
+	if opts.StateMachine == nil {
+		opts.StateMachine = func(id string) raft.StateMachine { return NewStateMachine() }
+	}
+	if opts.WaitTimeout == 0 {
+		opts.WaitTimeout = 10 * time.Second
+	}
+	if opts.StableStore == nil {
+		opts.StableStore = func(id string) raft.StableStore { return raft.NewInmemStore() }
+	}
+	if opts.SnapshotStore == nil {
+		opts.SnapshotStore = func(id string) raft.SnapshatStore {
+			return raft.NewObjectSnapshotStore(raft.NewInmemObjectStore(), "")
+		}
+	}
+	c := &Cluster{
+		t:              t,
+		opts:           opts,
+		network:        raft.NewInmemNetwork(),
+		stableStores:   map[string]raft.StableStore{},
+		snapshotStores: map[string]raft.SnapshatStore{},
+		stateMachines:  map[string]raft.StateMachine{},
+		stopped:        map[string]bool{},
+		groups:         map[string]int{},
+	}
+	if opts.Transport == nil {
+		c.opts.Transport = func(id string) raft.Transport { return raft.NewInmemTransport(c.network, "inmem-"+id) }
+	}
+	transports := make([]raft.Transport, opts.Servers)
+	for i := range transports {
+		id := fmt.Sprint(i + 1)
+		transports[i] = c.opts.Transport(id)
+		c.peers = append(c.peers, &pb.Peer{Id: id, Endpoint: transports[i].Endpoint()})
+		c.stableStores[id] = opts.StableStore(id)
+		c.snapshotStores[id] = opts.SnapshotStore(id)
+	}
+	for i, peer := range c.peers {
+		c.servers = append(c.servers, c.startServer(peer.Id, transports[i]))
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// startServer creates and serves the server with the ID on its stores and a
+// new StateMachine.
+func (c *Cluster) startServer(id string, trans raft.Transport) *raft.Server {
+	c.t.Helper()
+	stateMachine := c.opts.StateMachine(id)
+	serverOpts := append([]raft.ServerOption{
+		raft.APIServerEnabledOption(false),
+		raft.LogLevelOption(zapcore.FatalLevel),
+		raft.ElectionTimeoutOption(200 * time.Millisecond),
+		raft.FollowerTimeoutOption(200 * time.Millisecond),
+		raft.HeartbeatIntervalOption(20 * time.Millisecond),
+	}, c.opts.ServerOptions...)
+	server, err := raft.NewServer(raft.ServerCoreOptions{
+		Id:             id,
+		InitialCluster: c.peers,
+		StableStore:    c.stableStores[id],
+		StateMachine:   stateMachine,
+		SnapshotStore:  c.snapshotStores[id],
+		Transport:      &transport{Transport: trans, cluster: c, id: id},
+	}, serverOpts...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	go server.Serve()
+	c.serversMu.Lock()
+	c.stateMachines[id] = stateMachine
+	c.serversMu.Unlock()
+	return server
+}
+
+// Close shuts down the servers. It's called when the test finishes.
+func (c *Cluster) Close() {
+	c.Heal()
+	var wg sync.WaitGroup
+	for _, server := range c.running() {
+		wg.Add(1)
+		go func(server *raft.Server) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			server.Close(ctx)
+		}(server)
+	}
+	wg.Wait()
+}
+
+// AddServer starts a new server named after the servers created before it,
+// e.g., "4" in a cluster of 3 servers. The server starts with the initial
+// configuration of the Cluster, which does not include it, and takes part in
+// the cluster once it's added, e.g., with AddPeer on the leader.
+func (c *Cluster) AddServer() *raft.Server {
+	c.t.Helper()
+	id := fmt.Sprint(len(c.peers) + 1)
+	trans := c.opts.Transport(id)
+	c.stableStores[id] = c.opts.StableStore(id)
+	c.snapshotStores[id] = c.opts.SnapshotStore(id)
+	server := c.startServer(id, trans)
+	c.peers = append(c.peers, &pb.Peer{Id: id, Endpoint: trans.Endpoint()})
+	c.serversMu.Lock()
+	c.servers = append(c.servers, server)
+	c.serversMu.Unlock()
+	return server
+}
+
+// Servers returns the servers in the order they are created in, including
+// those stopped.
+func (c *Cluster) Servers() []*raft.Server {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
+	return append([]*raft.Server(nil), c.servers...)
+}
+
+// running returns the servers not stopped.
+func (c *Cluster) running() []*raft.Server {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
+	var servers []*raft.Server
+	for _, server := range c.servers {
+		if !c.stopped[server.Id()] {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// Server returns the server with the ID, or nil if there is none.
+func (c *Cluster) Server(id string) *raft.Server {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
+	for _, server := range c.servers {
+		if server.Id() == id {
+			return server
+		}
+	}
+	return nil
+}
+
+// StateMachine returns the StateMachine of the server with the ID. A new
+// StateMachine is created each time the server is restarted.
+func (c *Cluster) StateMachine(id string) raft.StateMachine {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
+	return c.stateMachines[id]
+}
+
+// Stop shuts down the server with the ID without waiting for the pending logs
+// or transferring the leadership, as if the server has crashed. Its stores are
+// kept for Restart.
+func (c *Cluster) Stop(id string) {
+	c.t.Helper()
+	server := c.Server(id)
+	if server == nil {
+		c.t.Fatalf("unknown server %s", id)
+	}
+	c.serversMu.Lock()
+	if c.stopped[id] {
+		c.serversMu.Unlock()
+		return
+	}
+	c.stopped[id] = true
+	c.serversMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	server.Close(ctx)
+}
+
+// Restart starts the server with the ID stopped by Stop again on its stores,
+// with a new StateMachine and Transport.
+func (c *Cluster) Restart(id string) *raft.Server {
+	c.t.Helper()
+	c.serversMu.RLock()
+	stopped := c.stopped[id]
+	c.serversMu.RUnlock()
+	if !stopped {
+		c.t.Fatalf("server %s is not stopped", id)
+	}
+	trans := c.opts.Transport(id)
+	for _, peer := range c.peers {
+		if peer.Id == id && peer.Endpoint != trans.Endpoint() {
+			c.t.Fatalf("server %s is restarted with endpoint %s instead of %s", id, trans.Endpoint(), peer.Endpoint)
+		}
+	}
+	server := c.startServer(id, trans)
+	c.serversMu.Lock()
+	defer c.serversMu.Unlock()
+	for i := range c.servers {
+		if c.servers[i].Id() == id {
+			c.servers[i] = server
+		}
+	}
+	delete(c.stopped, id)
+	return server
+}
+
+// Redeploy starts the server with the ID stopped by Stop again on its stores,
+// with a new StateMachine and an InmemTransport at a new endpoint, as if it's
+// redeployed on another host. The server must have AnnounceEndpointOption
+// enabled to start with the endpoint changed.
+func (c *Cluster) Redeploy(id string) *raft.Server {
+	c.t.Helper()
+	c.serversMu.Lock()
+	stopped := c.stopped[id]
+	c.redeploys++
+	endpoint := fmt.Sprintf("inmem-%s-%d", id, c.redeploys)
+	c.serversMu.Unlock()
+	if !stopped {
+		c.t.Fatalf("server %s is not stopped", id)
+	}
+	for i, peer := range c.peers {
+		if peer.Id == id {
+			c.peers[i] = &pb.Peer{Id: id, Endpoint: endpoint}
+		}
+	}
+	server := c.startServer(id, raft.NewInmemTransport(c.network, endpoint))
+	c.serversMu.Lock()
+	defer c.serversMu.Unlock()
+	for i := range c.servers {
+		if c.servers[i].Id() == id {
+			c.servers[i] = server
+		}
+	}
+	delete(c.stopped, id)
+	return server
+}
+
+// Partition splits the network so that the servers only reach those in the
+// same group. The servers not in any group are isolated.
+func (c *Cluster) Partition(groups ...[]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups = map[string]int{}
+	for i, group := range groups {
+		for _, id := range group {
+			c.groups[id] = i + 1
+		}
+	}
+}
+
+// Isolate partitions the servers with the IDs from the others, and from each
+// other.
+func (c *Cluster) Isolate(ids ...string) {
+	isolated := map[string]bool{}
+	for _, id := range ids {
+		isolated[id] = true
+	}
+	var others []string
+	for _, peer := range c.peers {
+		if !isolated[peer.Id] {
+			others = append(others, peer.Id)
+		}
+	}
+	c.Partition(others)
+}
+
+// Heal removes the partitions.
+func (c *Cluster) Heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups = map[string]int{}
+}
+
+// Intercept sets fn to be called before each RPC between the servers that are
+// connected, with the IDs of both ends and the request, which is a
+// *pb.InstallSnapshotRequestMeta for the InstallSnapshot RPCs. The RPC is
+// dropped if fn returns an error. A nil fn removes the interception.
+func (c *Cluster) Intercept(fn func(from, to string, request interface{}) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.intercept = fn
+}
+
+func (c *Cluster) connected(from, to string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.groups) == 0 || c.groups[from] != 0 && c.groups[from] == c.groups[to]
+}
+
+// wait polls cond until it returns true, or fails the test with the message
+// after WaitTimeout.
+func (c *Cluster) wait(cond func() bool, format string, args ...interface{}) {
+	c.t.Helper()
+	deadline := time.Now().Add(c.opts.WaitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for "+format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Leader returns the running leader followed by a quorum of the servers it's
+// connected to, or nil if there is none.
+func (c *Cluster) Leader() *raft.Server {
+	servers := c.running()
+	for _, server := range servers {
+		states := server.States()
+		if states.Role != raft.Leader.String() {
+			continue
+		}
+		followers := 0
+		for _, other := range servers {
+			otherStates := other.States()
+			if c.connected(states.ID, otherStates.ID) && otherStates.CurrentTerm == states.CurrentTerm &&
+				otherStates.Leader != nil && otherStates.Leader.Id == states.ID {
+				followers++
+			}
+		}
+		if followers > len(c.peers)/2 {
+			return server
+		}
+	}
+	return nil
+}
+
+// WaitForLeader waits until a leader is followed by a quorum of the servers it's
+// connected to, and returns it.
+func (c *Cluster) WaitForLeader() *raft.Server {
+	c.t.Helper()
+	var leader *raft.Server
+	c.wait(func() bool {
+		leader = c.Leader()
+		return leader != nil
+	}, "a leader")
+	return leader
+}
+
+// WaitForApplied waits until the logs up to the index are applied on the
+// servers with the IDs, or all running servers if none.
+func (c *Cluster) WaitForApplied(index uint64, ids ...string) {
+	c.t.Helper()
+	servers := c.running()
+	if len(ids) > 0 {
+		servers = nil
+		for _, id := range ids {
+			server := c.Server(id)
+			if server == nil {
+				c.t.Fatalf("unknown server %s", id)
+			}
+			servers = append(servers, server)
+		}
+	}
+	for _, server := range servers {
+		c.wait(func() bool {
+			return server.States().LastAppliedIndex >= index
+		}, "log %d to be applied on %s", index, server.Id())
+	}
+}
+
+// Apply applies the command on the leader and returns the index of its log
+// once it's applied on the leader.
+func (c *Cluster) Apply(command raft.Command) uint64 {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.WaitTimeout)
+	defer cancel()
+	future := c.WaitForLeader().ApplyCommand(ctx, command)
+	if _, err := future.Response(); err != nil {
+		c.t.Fatalf("error applying the command: %v", err)
+	}
+	meta, err := future.Result()
+	if err != nil {
+		c.t.Fatalf("error applying the command: %v", err)
+	}
+	return meta.Index
+}
+
+// transport sends the RPCs of a server unless it's partitioned from the peer or
+// the RPC is dropped by the interception of the Cluster.
+type transport struct {
+	raft.Transport
+	cluster *Cluster
+	id      string
+}
+
+func (t *transport) check(peer *pb.Peer, request interface{}) error {
+	if !t.cluster.connected(t.id, peer.Id) {
+		return errors.Wrapf(ErrPartitioned, "%s and %s", t.id, peer.Id)
+	}
+	t.cluster.mu.RLock()
+	intercept := t.cluster.intercept
+	t.cluster.mu.RUnlock()
+	if intercept != nil {
+		return intercept(t.id, peer.Id, request)
+	}
+	return nil
+}
+
+// Serve, Close, SetRetryPolicy, and SetHealthChecker are forwarded to the
+// Transport if it implements them.
+
+func (t *transport) Serve() error {
+	if s, ok := t.Transport.(raft.TransportServer); ok {
+		return s.Serve()
+	}
+	return nil
+}
+
+func (t *transport) Close() error {
+	if c, ok := t.Transport.(raft.TransportCloser); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (t *transport) SetRetryPolicy(policy raft.RetryPolicy) {
+	if s, ok := t.Transport.(raft.TransportRetryPolicySetter); ok {
+		s.SetRetryPolicy(policy)
+	}
+}
+
+func (t *transport) SetHealthChecker(checker func() bool) {
+	if s, ok := t.Transport.(raft.TransportHealthCheckerSetter); ok {
+		s.SetHealthChecker(checker)
+	}
+}
+
+func (t *transport) AppendEntries(
+	ctx context.Context, peer *pb.Peer, request *pb.AppendEntriesRequest,
+) (*pb.AppendEntriesResponse, error) {
+	if err := t.check(peer, request); err != nil {
+		return nil, err
+	}
+	return t.Transport.AppendEntries(ctx, peer, request)
+}
+
+func (t *transport) RequestVote(
+	ctx context.Context, peer *pb.Peer, request *pb.RequestVoteRequest,
+) (*pb.RequestVoteResponse, error) {
+	if err := t.check(peer, request); err != nil {
+		return nil, err
+	}
+	return t.Transport.RequestVote(ctx, peer, request)
+}
+
+func (t *transport) InstallSnapshot(
+	ctx context.Context, peer *pb.Peer, requestMeta *pb.InstallSnapshotRequestMeta, reader io.Reader,
+) (*pb.InstallSnapshotResponse, error) {
+	if err := t.check(peer, requestMeta); err != nil {
+		return nil, err
+	}
+	return t.Transport.InstallSnapshot(ctx, peer, requestMeta, reader)
+}
+
+func (t *transport) ApplyLog(
+	ctx context.Context, peer *pb.Peer, request *pb.ApplyLogRequest,
+) (*pb.ApplyLogResponse, error) {
+	if err := t.check(peer, request); err != nil {
+		return nil, err
+	}
+	return t.Transport.ApplyLog(ctx, peer, request)
+}
+
+func (t *transport) ChangeMembership(
+	ctx context.Context, peer *pb.Peer, request *pb.MembershipChangeRequest,
+) (*pb.MembershipChangeResponse, error) {
+	if err := t.check(peer, request); err != nil {
+		return nil, err
+	}
+	return t.Transport.ChangeMembership(ctx, peer, request)
+}
+
+func (t *transport) TimeoutNow(
+	ctx context.Context, peer *pb.Peer, request *pb.TimeoutNowRequest,
+) (*pb.TimeoutNowResponse, error) {
+	if err := t.check(peer, request); err != nil {
+		return nil, err
+	}
+	return t.Transport.TimeoutNow(ctx, peer, request)
+}
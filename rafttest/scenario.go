@@ -0,0 +1,289 @@
+package rafttest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sumimakito/raft"
+	"github.com/sumimakito/raft/pb"
+)
+
+// Scenario is a failure injected into a Cluster, after which the servers are
+// checked to have applied the same commands.
+type Scenario struct {
+	Name string
+	// Servers is the number of the servers the scenario runs with.
+	Servers int
+	Run     func(t testing.TB, c *Cluster)
+}
+
+// Scenarios are the failure scenarios run by RunScenarios.
+var Scenarios = []Scenario{
+	{Name: "LeaderCrashMidCommit", Servers: 5, Run: runLeaderCrashMidCommit},
+	{Name: "FollowerCrashDuringSnapshotInstall", Servers: 3, Run: runFollowerCrashDuringSnapshotInstall},
+	{Name: "NetworkFlapDuringJointConsensus", Servers: 5, Run: runNetworkFlapDuringJointConsensus},
+}
+
+// RunScenarios runs each of the Scenarios as a subtest of t on a new Cluster
+// with the Options, so that the custom StableStore, SnapshatStore, or
+// Transport implementations can be checked against the failures. Servers and
+// StateMachine of the Options are set by the scenarios.
+func RunScenarios(t *testing.T, opts Options) {
+	for _, scenario := range Scenarios {
+		scenario := scenario
+		t.Run(scenario.Name, func(t *testing.T) {
+			opts := opts
+			opts.Servers = scenario.Servers
+			opts.StateMachine = func(id string) raft.StateMachine { return NewStateMachine() }
+			scenario.Run(t, NewCluster(t, opts))
+		})
+	}
+}
+
+// others returns the IDs of the servers other than those with the IDs.
+func (c *Cluster) others(ids ...string) []string {
+	excluded := map[string]bool{}
+	for _, id := range ids {
+		excluded[id] = true
+	}
+	var others []string
+	for _, peer := range c.peers {
+		if !excluded[peer.Id] {
+			others = append(others, peer.Id)
+		}
+	}
+	return others
+}
+
+// checkCommands fails the test unless the servers with the IDs have applied
+// the commands, in the order given.
+func checkCommands(t testing.TB, c *Cluster, ids []string, commands ...string) {
+	t.Helper()
+	applied := checkConsistent(t, c, ids)
+	matched := len(applied) == len(commands)
+	for i := 0; matched && i < len(commands); i++ {
+		matched = string(applied[i]) == commands[i]
+	}
+	if !matched {
+		t.Errorf("the servers applied %q, expected %q", applied, commands)
+	}
+}
+
+// applyRetrying applies the command on the leader, retrying if it's not
+// applied, e.g., as the leadership is lost, and returns the index of its log.
+// The command may hence be applied more than once.
+func (c *Cluster) applyRetrying(command raft.Command) uint64 {
+	c.t.Helper()
+	var index uint64
+	c.wait(func() bool {
+		leader := c.Leader()
+		if leader == nil {
+			return false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.opts.WaitTimeout)
+		defer cancel()
+		future := leader.ApplyCommand(ctx, command)
+		if _, err := future.Response(); err != nil {
+			return false
+		}
+		meta, err := future.Result()
+		if err != nil {
+			return false
+		}
+		index = meta.Index
+		return true
+	}, "the command to be applied")
+	return index
+}
+
+// checkConsistent fails the test unless the servers with the IDs have applied
+// the same commands, which are returned.
+func checkConsistent(t testing.TB, c *Cluster, ids []string) []raft.Command {
+	t.Helper()
+	commands := c.StateMachine(ids[0]).(*StateMachine).Commands()
+	for _, id := range ids[1:] {
+		applied := c.StateMachine(id).(*StateMachine).Commands()
+		matched := len(applied) == len(commands)
+		for i := 0; matched && i < len(commands); i++ {
+			matched = bytes.Equal(applied[i], commands[i])
+		}
+		if !matched {
+			t.Errorf("server %s applied %q, but server %s applied %q", id, applied, ids[0], commands)
+		}
+	}
+	return commands
+}
+
+func hasPeer(c *pb.Config, id string) bool {
+	if c == nil {
+		return false
+	}
+	for _, peer := range c.Peers {
+		if peer.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// runLeaderCrashMidCommit crashes the leader after it has replicated a log to a
+// minority. The log must not be committed, and must be replaced on the leader
+// once it's restarted.
+func runLeaderCrashMidCommit(t testing.TB, c *Cluster) {
+	c.WaitForApplied(c.Apply(raft.Command("before")))
+	leader := c.WaitForLeader()
+	others := c.others(leader.Id())
+	follower := c.Server(others[0])
+	c.Partition([]string{leader.Id(), follower.Id()}, others[1:])
+
+	lastIndex := leader.States().LastLogIndex
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.WaitTimeout)
+	defer cancel()
+	future := leader.ApplyCommand(ctx, raft.Command("uncommitted"))
+	c.wait(func() bool {
+		index := leader.States().LastLogIndex
+		return index > lastIndex && follower.States().LastLogIndex >= index
+	}, "the log to be replicated to %s", follower.Id())
+	c.Stop(leader.Id())
+	if _, err := future.Response(); err == nil {
+		t.Errorf("the log replicated to a minority is reported applied")
+	}
+
+	index := c.Apply(raft.Command("after"))
+	c.Heal()
+	c.Restart(leader.Id())
+	c.WaitForApplied(index)
+	checkCommands(t, c, c.others(), "before", "after")
+}
+
+// runFollowerCrashDuringSnapshotInstall crashes a follower while the snapshot
+// is being installed on it, as it has fallen behind the compacted logs. The
+// follower must catch up with the snapshot once it's restarted.
+func runFollowerCrashDuringSnapshotInstall(t testing.TB, c *Cluster) {
+	c.WaitForApplied(c.Apply(raft.Command("0")))
+	follower := c.others(c.WaitForLeader().Id())[0]
+	// The follower is stopped instead of isolated, so that it doesn't disrupt
+	// the leader with a higher term when it's back.
+	c.Stop(follower)
+
+	commands := []string{"0"}
+	var index uint64
+	for i := 1; i < 10; i++ {
+		commands = append(commands, fmt.Sprint(i))
+		index = c.Apply(raft.Command(commands[i]))
+	}
+	// The logs are compacted on all servers that may become the leader.
+	for _, id := range c.others(follower) {
+		c.WaitForApplied(index, id)
+		if _, err := c.Server(id).Snapshot().Result(); err != nil {
+			t.Fatalf("error taking the snapshot on %s: %v", id, err)
+		}
+	}
+
+	crashed := make(chan struct{})
+	var once sync.Once
+	c.Intercept(func(from, to string, request interface{}) error {
+		if _, ok := request.(*pb.InstallSnapshotRequestMeta); ok && to == follower {
+			// The follower crashes while the snapshot is being sent.
+			once.Do(func() {
+				go func() {
+					c.Stop(follower)
+					close(crashed)
+				}()
+			})
+		}
+		return nil
+	})
+	c.Restart(follower)
+	select {
+	case <-crashed:
+	case <-time.After(c.opts.WaitTimeout):
+		t.Fatalf("timed out waiting for the snapshot to be installed on %s", follower)
+	}
+	c.Intercept(nil)
+
+	commands = append(commands, "after")
+	index = c.Apply(raft.Command("after"))
+	c.Restart(follower)
+	c.WaitForApplied(index)
+	checkCommands(t, c, c.others(), commands...)
+	if metaList, err := c.snapshotStores[follower].List(); err != nil || len(metaList) == 0 {
+		t.Errorf("no snapshot is installed on %s: %v", follower, err)
+	}
+}
+
+// runNetworkFlapDuringJointConsensus removes a server from the cluster while
+// the network is repeatedly partitioned and healed. The configuration
+// transition must complete on all servers once the network is healed.
+func runNetworkFlapDuringJointConsensus(t testing.TB, c *Cluster) {
+	c.WaitForApplied(c.Apply(raft.Command("before")))
+	removed := c.others(c.WaitForLeader().Id())[0]
+	remaining := c.others(removed)
+
+	seed := time.Now().UnixNano()
+	t.Logf("flapping the network with seed %d", seed)
+	r := rand.New(rand.NewSource(seed))
+	stopCh := make(chan struct{})
+	flapped := make(chan struct{})
+	go func() {
+		defer close(flapped)
+		for {
+			switch r.Intn(3) {
+			case 0:
+				c.Heal()
+			case 1:
+				c.Isolate(c.peers[r.Intn(len(c.peers))].Id)
+			case 2:
+				ids := c.others()
+				r.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+				n := 1 + r.Intn(len(ids)-1)
+				c.Partition(ids[:n], ids[n:])
+			}
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(time.Duration(20+r.Intn(80)) * time.Millisecond):
+			}
+		}
+	}()
+
+	// The removal is retried on the servers until the joint configuration is
+	// committed, as the requests may be lost or rejected, and the joint
+	// configuration may be replaced, while the network flaps.
+	attempts := 0
+	c.wait(func() bool {
+		server := c.Server(remaining[attempts%len(remaining)])
+		attempts++
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		server.RemovePeer(ctx, removed)
+		configuration := server.Configuration()
+		return configuration.Next == nil && !hasPeer(configuration.Current, removed)
+	}, "the removal of %s to be committed", removed)
+	time.Sleep(500 * time.Millisecond)
+	close(stopCh)
+	<-flapped
+	c.Heal()
+
+	for _, id := range remaining {
+		server := c.Server(id)
+		c.wait(func() bool {
+			configuration := server.Configuration()
+			return configuration.Next == nil && !hasPeer(configuration.Current, removed)
+		}, "the removal of %s to complete on %s", removed, id)
+	}
+	c.Stop(removed)
+	// The servers partitioned by the flaps may disrupt the leader with their
+	// higher terms once the network is healed.
+	index := c.applyRetrying(raft.Command("after"))
+	c.WaitForApplied(index, remaining...)
+	commands := checkConsistent(t, c, remaining)
+	if len(commands) == 0 || string(commands[0]) != "before" || string(commands[len(commands)-1]) != "after" {
+		t.Errorf("the commands applied are %q", commands)
+	}
+}
@@ -0,0 +1,7 @@
+package rafttest
+
+import "testing"
+
+func TestScenarios(t *testing.T) {
+	RunScenarios(t, Options{})
+}
@@ -0,0 +1,60 @@
+package rafttest
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/sumimakito/raft"
+)
+
+// StateMachine is a raft.StateMachine that records the commands applied, in
+// the order they are applied.
+type StateMachine struct {
+	mu       sync.Mutex // protects commands
+	commands []raft.Command
+}
+
+func NewStateMachine() *StateMachine {
+	return &StateMachine{}
+}
+
+func (m *StateMachine) Apply(command raft.Command) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = append(m.commands, append(raft.Command(nil), command...))
+	return nil
+}
+
+// Commands returns the commands applied so far.
+func (m *StateMachine) Commands() []raft.Command {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]raft.Command(nil), m.commands...)
+}
+
+func (m *StateMachine) Snapshot() (raft.StateMachineSnapshot, error) {
+	return &stateMachineSnapshot{commands: m.Commands()}, nil
+}
+
+func (m *StateMachine) Restore(snapshot raft.Snapshot) error {
+	reader, err := snapshot.Reader()
+	if err != nil {
+		return err
+	}
+	var commands []raft.Command
+	if err := json.NewDecoder(reader).Decode(&commands); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = commands
+	return nil
+}
+
+type stateMachineSnapshot struct {
+	commands []raft.Command
+}
+
+func (s *stateMachineSnapshot) Write(sink raft.SnapshotSink) error {
+	return json.NewEncoder(sink).Encode(s.commands)
+}
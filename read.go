@@ -0,0 +1,266 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap"
+)
+
+// ReadConsistency is the consistency of the reads served by Query.
+type ReadConsistency uint8
+
+const (
+	// ReadLinearizable reads follow the read index protocol, which costs a
+	// round of heartbeats to a quorum on each read. Only served by the leader.
+	ReadLinearizable ReadConsistency = 1 + iota
+	// ReadLeaderLease reads skip the heartbeats while a quorum has
+	// acknowledged the leader within the follower timeout, which relies on
+	// bounded clock drift across the servers. Only served by the leader.
+	ReadLeaderLease
+	// ReadStale reads are served by any server from its state machine
+	// as is, which may lag behind the leader.
+	ReadStale
+)
+
+func (c ReadConsistency) String() string {
+	switch c {
+	case ReadLinearizable:
+		return "linearizable"
+	case ReadLeaderLease:
+		return "lease"
+	case ReadStale:
+		return "stale"
+	}
+	return "unknown"
+}
+
+// ParseReadConsistency returns the ReadConsistency with the name returned by
+// ReadConsistency.String().
+func ParseReadConsistency(name string) (ReadConsistency, error) {
+	for _, c := range []ReadConsistency{ReadLinearizable, ReadLeaderLease, ReadStale} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown read consistency %q", name)
+}
+
+// QueryHandler answers the queries with the state of the StateMachine.
+type QueryHandler func(ctx context.Context, query []byte) ([]byte, error)
+
+// readIndexPollInterval is the interval between checks on the applied index
+// while waiting for the state machine to catch up with a read index.
+const readIndexPollInterval = 5 * time.Millisecond
+
+// ReadIndex returns an index such that reads served from the StateMachine are
+// linearizable once the index is applied, which is guaranteed on return. It
+// follows the read index protocol: the leader makes sure a log of its term
+// has been committed, takes the commit index, and confirms that it is still
+// the leader with a round of heartbeats to a quorum. Should only be called on
+// the leader, and ErrNonLeader is returned otherwise.
+func (s *Server) ReadIndex(ctx context.Context) (uint64, error) {
+	if s.role() != Leader {
+		return 0, ErrNonLeader
+	}
+	term := s.currentTerm()
+	if err := s.waitTermCommitted(ctx, term); err != nil {
+		return 0, err
+	}
+	readIndex := s.commitIndex()
+	if err := s.confirmLeadership(ctx, term); err != nil {
+		return 0, err
+	}
+	if err := s.waitApplied(ctx, readIndex); err != nil {
+		return 0, err
+	}
+	return readIndex, nil
+}
+
+// Query calls the QueryHandler with the query once the state machine is
+// allowed to serve reads at the consistency and has applied the log at
+// minIndex. ErrNoQueryHandler is returned if no QueryHandler is set.
+func (s *Server) Query(ctx context.Context, consistency ReadConsistency, minIndex uint64, query []byte) ([]byte, error) {
+	handler := s.opts().queryHandler
+	if handler == nil {
+		return nil, ErrNoQueryHandler
+	}
+	if err := s.WaitReadable(ctx, consistency, minIndex); err != nil {
+		return nil, err
+	}
+	return handler(ctx, query)
+}
+
+// WaitReadable waits until the StateMachine is allowed to serve reads at the
+// consistency and has applied the log at minIndex, for the reads served from
+// the StateMachine without a QueryHandler. ErrNonLeader is returned on the
+// followers unless the consistency is ReadStale.
+func (s *Server) WaitReadable(ctx context.Context, consistency ReadConsistency, minIndex uint64) error {
+	var readIndex uint64
+	var err error
+	switch consistency {
+	case ReadLinearizable:
+		readIndex, err = s.ReadIndex(ctx)
+	case ReadLeaderLease:
+		readIndex, err = s.leaseReadIndex(ctx)
+	case ReadStale:
+	default:
+		err = fmt.Errorf("unknown read consistency %d", consistency)
+	}
+	if err != nil {
+		return err
+	}
+	if minIndex > readIndex {
+		readIndex = minIndex
+	}
+	return s.waitApplied(ctx, readIndex)
+}
+
+// leaseReadIndex returns the commit index without the heartbeats if the lease
+// of the leader holds, or falls back to ReadIndex otherwise.
+func (s *Server) leaseReadIndex(ctx context.Context) (uint64, error) {
+	if s.role() != Leader {
+		return 0, ErrNonLeader
+	}
+	term := s.currentTerm()
+	if err := s.waitTermCommitted(ctx, term); err != nil {
+		return 0, err
+	}
+	readIndex := s.commitIndex()
+	if !s.leaseHolds() {
+		return s.ReadIndex(ctx)
+	}
+	return readIndex, nil
+}
+
+// leaseHolds reports whether a quorum, including ourself, has acknowledged
+// the leadership within the follower timeout. Followers do not start an
+// election within the follower timeout after hearing from the leader, except
+// for the target of a leadership transfer, so the lease does not hold during
+// a transfer, nor in the term in which the target is asked to start one.
+func (s *Server) leaseHolds() bool {
+	if atomic.LoadUint32(&s.flagLeadershipTransfer) != 0 {
+		return false
+	}
+	if term := atomic.LoadUint64(&s.leaseSuspendedTerm); term != 0 && term == s.currentTerm() {
+		return false
+	}
+	return s.quorumContactedSince(s.opts().clock.Now().Add(-s.opts().followerTimeout))
+}
+
+// quorumContactedSince reports whether a quorum, including ourself, has
+// acknowledged the requests of the leader after the time.
+func (s *Server) quorumContactedSince(since time.Time) bool {
+	c := s.confStore.Latest()
+	currentAcks, nextAcks := 0, 0
+	for _, p := range c.Peers() {
+		if p.Id != s.id && !s.replScheduler.lastContact(p.Id).After(since) {
+			continue
+		}
+		if c.CurrentConfig().Contains(p.Id) {
+			currentAcks++
+		}
+		if c.Joint() && c.NextConfig().Contains(p.Id) {
+			nextAcks++
+		}
+	}
+	return currentAcks >= c.CurrentConfig().Quorum() && (!c.Joint() || nextAcks >= c.NextConfig().Quorum())
+}
+
+// waitTermCommitted waits until a log of the term has been applied. A NOOP log
+// is appended if there's none, since the commit index of a new leader may lag
+// behind before it commits a log of its own term.
+func (s *Server) waitTermCommitted(ctx context.Context, term uint64) error {
+	ticker := time.NewTicker(readIndexPollInterval)
+	defer ticker.Stop()
+	noopProposed := false
+	for {
+		if s.currentTerm() != term || s.role() != Leader {
+			return ErrNonLeader
+		}
+		if s.lastApplied().Term == term {
+			return nil
+		}
+		if !noopProposed {
+			if _, err := s.Apply(ctx, &pb.LogBody{Type: pb.LogType_NOOP}).Result(); err != nil {
+				return err
+			}
+			noopProposed = true
+		}
+		select {
+		case <-ctx.Done():
+			return ErrDeadlineExceeded
+		case <-ticker.C:
+		}
+	}
+}
+
+// confirmLeadership sends heartbeats to the peers in the latest configuration
+// and returns once a quorum, including ourself, acknowledges the term.
+func (s *Server) confirmLeadership(ctx context.Context, term uint64) error {
+	c := s.confStore.Latest()
+	peers := c.Peers()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ackCh := make(chan string, len(peers))
+	staleCh := make(chan struct{}, len(peers))
+	for _, p := range peers {
+		if p.Id == s.id {
+			ackCh <- p.Id
+			continue
+		}
+		go func(p *pb.Peer) {
+			requestID, request := s.replScheduler.prepareHeartbeat(term)
+			response, err := s.trans.AppendEntries(WithRequestID(ctx, requestID), p, request)
+			if err != nil {
+				s.logger.Debugw("error confirming leadership",
+					logFields(s, zap.Error(err), zap.Object("peer", p), zap.String("request_id", requestID))...)
+				return
+			}
+			if response.Term > term {
+				staleCh <- struct{}{}
+				return
+			}
+			ackCh <- p.Id
+		}(p)
+	}
+
+	currentAcks, nextAcks := 0, 0
+	for {
+		select {
+		case id := <-ackCh:
+			if c.CurrentConfig().Contains(id) {
+				currentAcks++
+			}
+			if c.Joint() && c.NextConfig().Contains(id) {
+				nextAcks++
+			}
+			if currentAcks >= c.CurrentConfig().Quorum() &&
+				(!c.Joint() || nextAcks >= c.NextConfig().Quorum()) {
+				return nil
+			}
+		case <-staleCh:
+			return ErrNonLeader
+		case <-ctx.Done():
+			return ErrDeadlineExceeded
+		}
+	}
+}
+
+// waitApplied waits until the log at the index has been applied.
+func (s *Server) waitApplied(ctx context.Context, index uint64) error {
+	ticker := time.NewTicker(readIndexPollInterval)
+	defer ticker.Stop()
+	for s.lastApplied().Index < index {
+		select {
+		case <-ctx.Done():
+			return ErrDeadlineExceeded
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap"
+)
+
+// recoveryPeer is a peer in the recovery file, e.g.,
+//
+//	[
+//	  {"id": "a", "endpoint": "10.0.0.1:8080"},
+//	  {"id": "b", "endpoint": "10.0.0.2:8080", "metadata": {"zone": "b"}},
+//	  {"id": "c", "endpoint": "10.0.0.3:8080", "non_voter": true}
+//	]
+type recoveryPeer struct {
+	ID       string            `json:"id"`
+	Endpoint string            `json:"endpoint"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	NonVoter bool              `json:"non_voter,omitempty"`
+}
+
+// readRecoveryFile reads the configuration in the recovery file at path. It
+// returns a nil configuration if the file does not exist.
+func readRecoveryFile(path string) (*pb.Configuration, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var peers []recoveryPeer
+	if err := json.Unmarshal(b, &peers); err != nil {
+		return nil, fmt.Errorf("invalid recovery file %s: %w", path, err)
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("invalid recovery file %s: no peers", path)
+	}
+	// The configuration has no initiator, as it's identical on the servers
+	// recovered with the same file, like the bootstrap configuration.
+	c := &pb.Configuration{Current: &pb.Config{}}
+	for _, peer := range peers {
+		p := &pb.Peer{Id: peer.ID, Endpoint: peer.Endpoint, Metadata: peer.Metadata}
+		if peer.NonVoter {
+			p.Suffrage = pb.Suffrage_SUFFRAGE_NON_VOTER
+		}
+		c.Current.Peers = append(c.Current.Peers, p)
+	}
+	if err := validateConfiguration(c); err != nil {
+		return nil, fmt.Errorf("invalid recovery file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// recoverConfiguration replaces the configuration with the one in the
+// recovery file at path, if any. The file is renamed with the suffix
+// ".applied" afterwards, so that the recovery is not repeated when the server
+// restarts. Should only be called in NewServer.
+//
+// The logs are applied and compacted into a snapshot carrying the recovered
+// configuration at the last log, rather than followed by a new configuration
+// log. The surviving servers may have logs of different lengths, and a log
+// appended after the last log of one server could take an index and term
+// another server already holds with a different entry, which breaks the Log
+// Matching Property. The snapshot creates no such entry.
+func (s *Server) recoverConfiguration(path string) error {
+	c, err := readRecoveryFile(path)
+	if err != nil || c == nil {
+		return err
+	}
+	lastLogIndex := s.lastLogIndex()
+	if lastLogIndex == 0 {
+		return fmt.Errorf("recovery file %s is present but the server has no logs or snapshots to recover", path)
+	}
+	s.logger.Warnw("overriding the configuration with the recovery file; "+
+		"the logs that are not on the recovered servers are lost, and the cluster "+
+		"may diverge unless every surviving server is recovered with the same file",
+		logFields(s, "path", path, zap.Object("previous", s.confStore.Latest()),
+			zap.Object("recovered", c))...)
+
+	// The snapshots at the last log are superseded by the one taken below,
+	// and must be deleted as the order of the snapshots at the same index is
+	// undefined.
+	metaList, err := s.snapshotStore.List()
+	if err != nil {
+		return err
+	}
+	var superseded []SnapshotMeta
+	for _, meta := range metaList {
+		if meta.Index() >= lastLogIndex {
+			superseded = append(superseded, meta)
+		}
+	}
+	deleter, ok := s.snapshotStore.(SnapshotStoreDeleter)
+	if len(superseded) > 0 && !ok {
+		return errors.New("the snapshot at the last log cannot be superseded " +
+			"as the SnapshatStore does not implement SnapshotStoreDeleter")
+	}
+
+	// Every log is applied before the snapshot is taken.
+	s.commit(lastLogIndex)
+	s.applyCommitted()
+	if lastApplied := s.lastApplied(); lastApplied.Index != lastLogIndex {
+		return fmt.Errorf("the logs are applied up to %d instead of %d", lastApplied.Index, lastLogIndex)
+	}
+	stmsSnapshot, err := s.stateMachine.Snapshot()
+	if err != nil {
+		return err
+	}
+	sink, err := s.snapshotStore.Create(stmsSnapshot.Index, stmsSnapshot.Term, c, stmsSnapshot.Index)
+	if err != nil {
+		return err
+	}
+	if err := stmsSnapshot.write(context.Background(), sink, s.opts().snapshotProgress); err != nil {
+		if cancelError := sink.Cancel(); cancelError != nil {
+			return fmt.Errorf("%v: %w", cancelError, err)
+		}
+		return err
+	}
+	if err := sink.Close(); err != nil {
+		return err
+	}
+	snapshotMeta := sink.Meta()
+	for _, meta := range superseded {
+		if err := deleter.Delete(meta.Id()); err != nil {
+			return err
+		}
+	}
+
+	// The logs are compacted as they all exist in the snapshot.
+	if err := s.logStore.Restore(snapshotMeta); err != nil {
+		return err
+	}
+	s.setFirstLogIndex(Must2(s.logStore.FirstIndex()))
+	s.setLastLogIndex(Must2(s.logStore.LastIndex()))
+	recovered, err := s.confStore.Restore(snapshotMeta)
+	if err != nil {
+		return err
+	}
+	s.alterConfiguration(recovered)
+	s.stateMachine.configuration = recovered
+
+	if err := os.Rename(path, path+".applied"); err != nil {
+		return err
+	}
+	s.logger.Infow("configuration has been recovered",
+		logFields(s, zap.String("snapshot_id", snapshotMeta.Id()),
+			zap.Uint64("snapshot_index", snapshotMeta.Index()),
+			zap.Uint64("snapshot_term", snapshotMeta.Term()))...)
+	s.audit(context.Background(), AuditConfigurationRecovered, newAPIConfiguration(s.confStore.Latest()))
+	return nil
+}
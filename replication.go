@@ -1,8 +1,10 @@
 package raft
 
 import (
+	"context"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/sumimakito/raft/pb"
 	"go.uber.org/zap"
@@ -17,16 +19,35 @@ type replState struct {
 	r             *replScheduler
 	peer          *pb.Peer
 	configuration *configuration
+	// term is the term of the leadership the replication is started in, which
+	// the requests are sent in even if the server has seen a newer term before
+	// the replication is stopped.
+	term uint64
 
 	nextIndex uint64
 
+	// triggerCh signals the replication that new logs are appended, so that
+	// they are sent without waiting for the next heartbeat.
+	triggerCh chan struct{}
+
 	ctlMu   sync.Mutex // protects ctl and stopped
 	ctl     *replCtl
 	stopped bool
 }
 
+// stepdown reports the stale term to the leader loop unless the replication is
+// cancelled, since the loop may have been left and stopping the replication.
+func stepdown(ctl *replCtl, stepdownCh serverStepdownChan, term uint64) {
+	select {
+	case stepdownCh <- term:
+	case <-ctl.Cancelled():
+	}
+}
+
 func (s *replState) replicate(ctl *replCtl, stepdownCh serverStepdownChan) {
 	defer ctl.Release()
+	// failures counts consecutive failed attempts for the RetryPolicy.
+	var failures int
 	goto ENTRY
 
 NEXT_MOVE_FORWARD:
@@ -41,8 +62,24 @@ RESET_LOOP:
 	select {
 	case <-ctl.Cancelled():
 		return
-	case <-s.r.server.randomTimer(s.r.server.opts.followerTimeout / 10).C:
+	case <-s.triggerCh:
 		goto CHECK_INDEX
+	case <-s.r.server.randomTimer(s.r.server.opts().heartbeatInterval).C():
+		goto CHECK_INDEX
+	}
+
+BACKOFF:
+	failures++
+	{
+		delay, _ := s.r.server.opts().retryPolicy.Backoff(failures)
+		timer := s.r.server.opts().clock.NewTimer(delay)
+		select {
+		case <-ctl.Cancelled():
+			timer.Stop()
+			return
+		case <-timer.C():
+			goto CHECK_INDEX
+		}
 	}
 
 ENTRY:
@@ -77,7 +114,9 @@ ENTRY:
 			select {
 			case <-ctl.Cancelled():
 				return
-			case <-s.r.server.randomTimer(s.r.server.opts.followerTimeout / 10).C:
+			case <-s.triggerCh:
+				goto SELF_CHECK_INDEX
+			case <-s.r.server.randomTimer(s.r.server.opts().heartbeatInterval).C():
 				goto SELF_CHECK_INDEX
 			}
 		}
@@ -99,7 +138,9 @@ ENTRY:
 		select {
 		case <-ctl.Cancelled():
 			return
-		case <-s.r.server.randomTimer(s.r.server.opts.followerTimeout / 10).C:
+		case <-s.triggerCh:
+			goto SELF_CHECK_INDEX
+		case <-s.r.server.randomTimer(s.r.server.opts().heartbeatInterval).C():
 			goto SELF_CHECK_INDEX
 		}
 	}
@@ -125,9 +166,11 @@ CHECK_INDEX:
 		default:
 		}
 
-		heartbeatRequestId, heartbeaRequest := s.r.prepareHeartbeat()
+		heartbeatRequestId, heartbeaRequest := s.r.prepareHeartbeat(s.term)
 
-		heartbeatResponse, err := s.r.server.trans.AppendEntries(ctl.Context(), s.peer, heartbeaRequest)
+		sentAt := s.r.server.opts().clock.Now()
+		heartbeatResponse, err := s.r.server.trans.AppendEntries(
+			WithRequestID(ctl.Context(), heartbeatRequestId), s.peer, heartbeaRequest)
 		if err != nil {
 			s.r.server.logger.Debugw("error sending heartbeat request",
 				logFields(s.r.server,
@@ -136,14 +179,18 @@ CHECK_INDEX:
 					zap.Object("peer", s.peer),
 					zap.String("request_id", heartbeatRequestId),
 					zap.Reflect("request", heartbeaRequest))...)
-			goto RESET_LOOP
+			goto BACKOFF
 		}
 
 		if heartbeatResponse.Term > heartbeaRequest.Term {
 			// Local term is stale
-			stepdownCh <- heartbeatResponse.Term
+			stepdown(ctl, stepdownCh, heartbeatResponse.Term)
 			return
 		}
+		s.r.setLastContact(s.peer.Id, sentAt)
+		// The heartbeats are only sent once all logs are replicated.
+		s.r.setMatchedAt(s.peer.Id, sentAt)
+		failures = 0
 	}
 	goto RESET_LOOP
 
@@ -155,7 +202,16 @@ REPLICATE:
 		default:
 		}
 
-		replicationRequestId, replicationRequest, err := s.r.prepareRequest(s.nextIndex, lastLogIndex)
+		if s.r.server.logStore.withinCompacted(s.nextIndex - 1) {
+			// The previous log is compacted, e.g., after a snapshot is restored.
+			goto INSTALL_SNAPSHOT
+		}
+
+		lastIndex := lastLogIndex
+		if n := s.r.server.opts().replicationBatchSize; n > 0 && lastIndex-s.nextIndex+1 > uint64(n) {
+			lastIndex = s.nextIndex + uint64(n) - 1
+		}
+		replicationRequestId, replicationRequest, err := s.r.prepareRequest(s.term, s.nextIndex, lastIndex)
 		if err != nil {
 			s.r.server.logger.Debugw("error preparing replication request",
 				logFields(s.r.server,
@@ -164,10 +220,15 @@ REPLICATE:
 					zap.Object("peer", s.peer),
 					zap.String("request_id", replicationRequestId),
 					zap.Reflect("request", replicationRequest))...)
-			goto RESET_LOOP
+			goto BACKOFF
 		}
 
-		replicationResponse, err := s.r.server.trans.AppendEntries(ctl.Context(), s.peer, replicationRequest)
+		replicationCtx, span := s.r.server.traceAppendEntries(
+			WithRequestID(ctl.Context(), replicationRequestId), s.peer, s.nextIndex, lastIndex)
+		sentAt := s.r.server.opts().clock.Now()
+		replicationResponse, err := s.r.server.trans.AppendEntries(replicationCtx, s.peer, replicationRequest)
+		span.SetAttribute("raft.request_id", replicationRequestId)
+		span.End(err)
 		if err != nil {
 			s.r.server.logger.Debugw("error sending replication request",
 				logFields(s.r.server,
@@ -176,30 +237,50 @@ REPLICATE:
 					zap.Object("peer", s.peer),
 					zap.String("request_id", replicationRequestId),
 					zap.Reflect("request", replicationRequest))...)
-			goto RESET_LOOP
+			goto BACKOFF
 		}
+		// The request is reused once the response is received, after which
+		// the Transport no longer references it.
+		requestTerm, prevLogIndex := replicationRequest.Term, replicationRequest.PrevLogIndex
+		releaseAppendEntriesRequest(replicationRequest)
 
-		if replicationResponse.Term > replicationRequest.Term {
+		if replicationResponse.Term > requestTerm {
 			// Local term is stale
-			stepdownCh <- replicationResponse.Term
+			stepdown(ctl, stepdownCh, replicationResponse.Term)
 			return
 		}
+		s.r.setLastContact(s.peer.Id, sentAt)
 
 		switch replicationResponse.Status {
 		case pb.ReplStatus_REPL_OK:
-			s.nextIndex = lastLogIndex + 1
-			s.r.setMatchIndex(s.peer.Id, lastLogIndex)
+			failures = 0
+			s.nextIndex = lastIndex + 1
+			s.r.setMatchIndex(s.peer.Id, lastIndex)
+			if lastIndex < lastLogIndex {
+				// Send the rest of the logs in the next batch.
+				goto CHECK_INDEX
+			}
+			s.r.setMatchedAt(s.peer.Id, sentAt)
 			goto RESET_LOOP
 		case pb.ReplStatus_REPL_ERR_NO_LOG:
-			// If snapshot is disabled:
-			// s.nextIndex = s.nextIndex - 1
-			// Or, we should consider installing snapshots
 			s.r.server.logger.Debugw("unsuccessful replication repsonse: no log",
 				logFields(s.r.server,
 					zap.String("replication_id", ctl.replId),
 					zap.Object("peer", s.peer),
 					zap.String("request_id", replicationRequestId),
 					zap.Reflect("response", replicationResponse))...)
+			if replicationResponse.ConflictIndex > 0 {
+				// Jump back over the conflicting logs with the hints. Snapshots
+				// are installed if the logs to send are compacted.
+				nextIndex, err := s.r.conflictNextIndex(prevLogIndex, replicationResponse)
+				if err != nil {
+					goto BACKOFF
+				}
+				failures = 0
+				s.nextIndex = nextIndex
+				goto CHECK_INDEX
+			}
+			// Or, we should consider installing snapshots
 		default:
 			// We have nothing to do here
 			s.r.server.logger.Debugw("unsuccessful replication repsonse",
@@ -213,6 +294,7 @@ REPLICATE:
 	}
 
 	// TRY & INSTALL SNAPSHOT
+INSTALL_SNAPSHOT:
 	{
 		// Check if we have snapshots available
 		metadataList, err := s.r.server.snapshotStore.List()
@@ -317,15 +399,34 @@ REPLICATE:
 				zap.Object("peer", s.peer),
 				zap.Reflect("snapshot_meta", snapshotMeta))...)
 
+		// Limit the number of snapshots streamed at the same time. The snapshot
+		// will be retried in the next loop, where the replication request also
+		// works as a heartbeat.
+		if !s.r.acquireSnapshotInstall() {
+			s.r.server.logger.Debugw("snapshot installation deferred: too many concurrent installations",
+				logFields(s.r.server,
+					zap.String("replication_id", ctl.replId),
+					zap.Object("peer", s.peer))...)
+			snapshot.Close()
+			goto RESET_LOOP
+		}
+		installSnapshotCtx, installSnapshotRequestId := ensureRequestID(ctl.Context())
+		installSnapshotCtx, span := s.r.server.traceReplication(
+			installSnapshotCtx, context.Background(), "raft.replicate.InstallSnapshot", s.peer)
+		span.SetAttribute("raft.snapshot_index", snapshotMeta.Index())
 		installSnapshotResponse, err := s.r.server.trans.InstallSnapshot(
-			ctl.Context(), s.peer, installSnapshotRequestMeta, snapshotReader,
+			installSnapshotCtx, s.peer, installSnapshotRequestMeta, snapshotReader,
 		)
+		span.SetAttribute("raft.request_id", installSnapshotRequestId)
+		span.End(err)
+		s.r.releaseSnapshotInstall()
 		if err != nil {
 			s.r.server.logger.Infow("error installing snapshot",
 				logFields(s.r.server,
 					zap.Error(err),
 					zap.String("replication_id", ctl.replId),
 					zap.Object("peer", s.peer),
+					zap.String("request_id", installSnapshotRequestId),
 					zap.Reflect("snapshot_meta", snapshotMeta))...)
 			snapshot.Close()
 			goto NEXT_MOVE_FORWARD
@@ -333,7 +434,7 @@ REPLICATE:
 		snapshot.Close()
 
 		if installSnapshotResponse.Term > installSnapshotRequestMeta.Term {
-			stepdownCh <- installSnapshotResponse.Term
+			stepdown(ctl, stepdownCh, installSnapshotResponse.Term)
 			return
 		}
 
@@ -389,18 +490,59 @@ type replScheduler struct {
 	states   map[string]*replState
 
 	matchIndexes sync.Map // map[ServerID]uint64
+
+	// lastContacts holds the time when the last request acknowledged by each
+	// peer in the current term was sent.
+	lastContacts sync.Map // map[ServerID]time.Time
+
+	// matchedAts holds the time when the last request after which each peer
+	// matched the last log of the leader was sent.
+	matchedAts sync.Map // map[ServerID]time.Time
+
+	// term is the term in which the replications are last started.
+	term uint64
+	// startedAt is when the replications are first started in the term.
+	startedAt time.Time
+
+	// snapshotInstallSem limits the number of concurrent snapshot
+	// installations. Nil means no limit.
+	snapshotInstallSem chan struct{}
 }
 
 func newReplScheduler(server *Server) *replScheduler {
-	return &replScheduler{
+	r := &replScheduler{
 		server: server,
 		states: map[string]*replState{},
 	}
+	if n := server.opts().snapshotInstallConcurrency; n > 0 {
+		r.snapshotInstallSem = make(chan struct{}, n)
+	}
+	return r
+}
+
+// acquireSnapshotInstall reserves a slot for installing a snapshot without
+// blocking. It reports whether the slot is reserved.
+func (r *replScheduler) acquireSnapshotInstall() bool {
+	if r.snapshotInstallSem == nil {
+		return true
+	}
+	select {
+	case r.snapshotInstallSem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *replScheduler) releaseSnapshotInstall() {
+	if r.snapshotInstallSem != nil {
+		<-r.snapshotInstallSem
+	}
 }
 
-func (r *replScheduler) prepareHeartbeat() (string, *pb.AppendEntriesRequest) {
+func (r *replScheduler) prepareHeartbeat(term uint64) (string, *pb.AppendEntriesRequest) {
 	return NewObjectID().Hex(), &pb.AppendEntriesRequest{
-		Term:         r.server.currentTerm(),
+		Term:         term,
 		LeaderId:     r.server.id,
 		LeaderCommit: r.server.commitIndex(),
 		PrevLogIndex: 0,
@@ -409,17 +551,13 @@ func (r *replScheduler) prepareHeartbeat() (string, *pb.AppendEntriesRequest) {
 	}
 }
 
-func (r *replScheduler) prepareRequest(firstIndex, lastIndex uint64) (string, *pb.AppendEntriesRequest, error) {
+func (r *replScheduler) prepareRequest(term, firstIndex, lastIndex uint64) (string, *pb.AppendEntriesRequest, error) {
 	requestId := NewObjectID().Hex()
 
-	request := &pb.AppendEntriesRequest{
-		Term:         r.server.currentTerm(),
-		LeaderId:     r.server.id,
-		LeaderCommit: r.server.commitIndex(),
-		PrevLogIndex: 0,
-		PrevLogTerm:  0,
-		Entries:      []*pb.Log{},
-	}
+	request := acquireAppendEntriesRequest()
+	request.Term = term
+	request.LeaderId = r.server.id
+	request.LeaderCommit = r.server.commitIndex()
 
 	if prevLogIndex := firstIndex - 1; prevLogIndex > 0 {
 		logMeta, err := r.server.logStore.Meta(prevLogIndex)
@@ -431,22 +569,69 @@ func (r *replScheduler) prepareRequest(firstIndex, lastIndex uint64) (string, *p
 	}
 
 	lastLogIndex := r.server.lastLogIndex()
+	if lastIndex < lastLogIndex {
+		lastLogIndex = lastIndex
+	}
 	if firstIndex > lastLogIndex || (firstIndex == lastLogIndex && firstIndex == 0) {
 		return requestId, request, nil
 	}
 
-	request.Entries = make([]*pb.Log, 0, lastLogIndex-firstIndex+1)
-	for i := firstIndex; i <= lastLogIndex; i++ {
-		e, err := r.server.logStore.Entry(i)
+	it := r.server.logStore.Iterator()
+	defer it.Close()
+	it.Seek(firstIndex)
+	if n := int(lastLogIndex - firstIndex + 1); cap(request.Entries) < n {
+		request.Entries = make([]*pb.Log, 0, n)
+	}
+	for {
+		e, err := it.Next()
 		if err != nil {
 			return "", nil, err
 		}
-		request.Entries = append(request.Entries, e.Copy())
+		if e == nil || e.Meta.Index > lastLogIndex {
+			break
+		}
+		if r.server.logStore.retainsLogs {
+			// The logs may be held by the LogStore, while the in-process
+			// Transports hand the request to the receiving server as is.
+			e = e.Copy()
+		}
+		request.Entries = append(request.Entries, e)
 	}
 
 	return requestId, request, nil
 }
 
+// conflictNextIndex returns the next index to replicate after the follower
+// rejected the previous log with the conflict hints in the response. If the
+// leader has logs of the conflicting term, the next index follows the last of
+// them. Otherwise, all logs of the term are skipped on the follower.
+func (r *replScheduler) conflictNextIndex(prevLogIndex uint64, response *pb.AppendEntriesResponse) (uint64, error) {
+	nextIndex := response.ConflictIndex
+	if response.ConflictTerm > 0 {
+		for index := prevLogIndex; index > 0 && !r.server.logStore.withinCompacted(index); index-- {
+			meta, err := r.server.logStore.Meta(index)
+			if err != nil {
+				return 0, err
+			}
+			if meta == nil || meta.Term < response.ConflictTerm {
+				break
+			}
+			if meta.Term == response.ConflictTerm {
+				nextIndex = index + 1
+				break
+			}
+		}
+	}
+	if nextIndex > prevLogIndex {
+		// The next index must move backward.
+		nextIndex = prevLogIndex
+	}
+	if nextIndex < 1 {
+		nextIndex = 1
+	}
+	return nextIndex, nil
+}
+
 func (r *replScheduler) matchIndex(serverId string) uint64 {
 	if v, _ := r.matchIndexes.Load(serverId); v != nil {
 		return v.(uint64)
@@ -458,6 +643,30 @@ func (r *replScheduler) setMatchIndex(serverID string, matchIndex uint64) {
 	c := r.server.confStore.Latest()
 	r.matchIndexes.Store(serverID, matchIndex)
 	r.server.alterCommitIndex(r.computeCommitIndex(c))
+	r.notifyStaging(serverID)
+}
+
+func (r *replScheduler) lastContact(serverID string) time.Time {
+	if v, _ := r.lastContacts.Load(serverID); v != nil {
+		return v.(time.Time)
+	}
+	return time.Time{}
+}
+
+func (r *replScheduler) setLastContact(serverID string, t time.Time) {
+	r.lastContacts.Store(serverID, t)
+}
+
+func (r *replScheduler) matchedAt(serverID string) time.Time {
+	if v, _ := r.matchedAts.Load(serverID); v != nil {
+		return v.(time.Time)
+	}
+	return time.Time{}
+}
+
+func (r *replScheduler) setMatchedAt(serverID string, t time.Time) {
+	r.matchedAts.Store(serverID, t)
+	r.notifyStaging(serverID)
 }
 
 func (r *replScheduler) computeCommitIndex(c *configuration) uint64 {
@@ -470,6 +679,9 @@ func (r *replScheduler) computeCommitIndex(c *configuration) uint64 {
 	if !c.Joint() {
 		currentIndexes := make([]uint64, 0, len(c.Current.Peers))
 		for _, p := range c.Current.Peers {
+			if !p.Voter() {
+				continue
+			}
 			if index, ok := matchIndexes[p.Id]; ok {
 				currentIndexes = append(currentIndexes, index)
 			} else {
@@ -487,12 +699,6 @@ func (r *replScheduler) computeCommitIndex(c *configuration) uint64 {
 		nextIndexes := make([]uint64, 0, len(c.Next.Peers))
 		for _, p := range c.Peers() {
 			inCurrent, inNext := c.CurrentConfig().Contains(p.Id), c.NextConfig().Contains(p.Id)
-			if !inCurrent && !inNext {
-				r.server.logger.Panicw(
-					"confusing condition: found a server ID that does not belong to both any configuration",
-					logFields(r.server, zap.String("orphan_server_id", p.Id))...,
-				)
-			}
 			if inCurrent {
 				if index, ok := matchIndexes[p.Id]; ok {
 					currentIndexes = append(currentIndexes, index)
@@ -533,22 +739,43 @@ func (r *replScheduler) Start(stepdownCh serverStepdownChan) {
 	r.server.logger.Infow("replication/heartbeat scheduled",
 		logFields(r.server, "replication_id", replId)...)
 
+	// The contacts are kept if the replications are restarted within the
+	// term, e.g., as the configuration changes.
+	if term := r.server.currentTerm(); term != r.term {
+		r.lastContacts.Range(func(key, _ any) bool {
+			r.lastContacts.Delete(key)
+			return true
+		})
+		r.matchedAts.Range(func(key, _ any) bool {
+			r.matchedAts.Delete(key)
+			return true
+		})
+		r.term = term
+		r.startedAt = r.server.opts().clock.Now()
+	}
+
 	r.statesMu.Lock()
 	r.states = map[string]*replState{}
-	for _, p := range c.Peers() {
+	// The logs are also replicated to the staging peers, which are not counted
+	// in the commits.
+	for _, p := range append(append([]*pb.Peer{}, c.Peers()...), c.Staging...) {
 		if p.Id == r.server.id {
 			r.states[p.Id] = &replState{
 				r:             r,
 				peer:          p,
 				configuration: c,
+				term:          r.term,
 				nextIndex:     r.server.lastLogIndex() + 1,
+				triggerCh:     make(chan struct{}, 1),
 			}
 		} else {
 			r.states[p.Id] = &replState{
 				r:             r,
 				peer:          p,
 				configuration: c,
+				term:          r.term,
 				nextIndex:     r.server.lastLogIndex(), // To start replication to non-self peers immediately
+				triggerCh:     make(chan struct{}, 1),
 			}
 		}
 		r.matchIndexes.Store(p.Id, uint64(0))
@@ -559,6 +786,20 @@ func (r *replScheduler) Start(stepdownCh serverStepdownChan) {
 	r.statesMu.Unlock()
 }
 
+// Trigger signals the replications to send the logs appended since, which
+// are sent in the following requests together with the ones still pending.
+func (r *replScheduler) Trigger() {
+	r.statesMu.Lock()
+	defer r.statesMu.Unlock()
+	for _, s := range r.states {
+		select {
+		case s.triggerCh <- struct{}{}:
+		default:
+			// The replication is triggered already.
+		}
+	}
+}
+
 func (r *replScheduler) Stop() {
 	r.server.logger.Infow("ready to stop all replications", logFields(r.server)...)
 	r.statesMu.Lock()
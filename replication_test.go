@@ -0,0 +1,159 @@
+package raft
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+)
+
+func TestReplSchedulerSnapshotInstallLimit(t *testing.T) {
+	r := newReplScheduler(testingServer(t, SnapshotInstallConcurrencyOption(2)))
+	assert.True(t, r.acquireSnapshotInstall())
+	assert.True(t, r.acquireSnapshotInstall())
+	assert.False(t, r.acquireSnapshotInstall())
+	r.releaseSnapshotInstall()
+	assert.True(t, r.acquireSnapshotInstall())
+
+	r = newReplScheduler(testingServer(t, SnapshotInstallConcurrencyOption(0)))
+	for i := 0; i < 10; i++ {
+		assert.True(t, r.acquireSnapshotInstall())
+	}
+}
+
+func TestReplSchedulerTrigger(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	state := &replState{r: server.replScheduler, triggerCh: make(chan struct{}, 1)}
+	server.replScheduler.states = map[string]*replState{"1": state}
+
+	// The replications of a leader stepping down are not triggered by the
+	// logs replicated from the new leader.
+	ƒAssertNoError2(server.appendLogs([]*pb.LogBody{{Type: pb.LogType_COMMAND}}, nil, nil))(t)
+	assert.Len(t, state.triggerCh, 0)
+
+	// The replications are triggered once per batch of logs, and the signals
+	// are not queued while the replications are busy.
+	server.setRole(Leader)
+	ƒAssertNoError2(server.appendLogs([]*pb.LogBody{{Type: pb.LogType_COMMAND}, {Type: pb.LogType_COMMAND}}, nil, nil))(t)
+	ƒAssertNoError2(server.appendLogs([]*pb.LogBody{{Type: pb.LogType_COMMAND}}, nil, nil))(t)
+	assert.Len(t, state.triggerCh, 1)
+	<-state.triggerCh
+	assert.Len(t, state.triggerCh, 0)
+}
+
+func TestAppendEntriesConflictHints(t *testing.T) {
+	serverFn := func(terms ...uint64) *Server {
+		server := testingServer(t)
+		server.logStore = newLogStoreProxy(server, newInternalLogStore())
+		server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+		server.serverState.stateCurrentTerm = 3
+		for i, term := range terms {
+			assert.NoError(t, server.logStore.AppendLogs([]*pb.Log{
+				{Meta: &pb.LogMeta{Index: uint64(i + 1), Term: term}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}},
+			}))
+		}
+		server.setFirstLogIndex(1)
+		server.setLastLogIndex(uint64(len(terms)))
+		return server
+	}
+	follower := serverFn(1, 1, 2, 2, 2)
+	handler := newRPCHandler(follower)
+	appendEntriesFn := func(prevLogIndex, prevLogTerm uint64) *pb.AppendEntriesResponse {
+		return ƒAssertNoError2(handler.AppendEntries(context.Background(), "", &pb.AppendEntriesRequest{
+			Term:         3,
+			PrevLogIndex: prevLogIndex,
+			PrevLogTerm:  prevLogTerm,
+		}))(t)
+	}
+
+	// The follower reports the first index of the conflicting term.
+	response := appendEntriesFn(5, 3)
+	assert.Equal(t, pb.ReplStatus_REPL_ERR_NO_LOG, response.Status)
+	assert.Equal(t, uint64(2), response.ConflictTerm)
+	assert.Equal(t, uint64(3), response.ConflictIndex)
+	// The follower reports the index following its last log if it has no log
+	// at the previous log index.
+	missingResponse := appendEntriesFn(7, 3)
+	assert.Equal(t, uint64(0), missingResponse.ConflictTerm)
+	assert.Equal(t, uint64(6), missingResponse.ConflictIndex)
+
+	// The leader skips all logs of the term it does not have.
+	leader := newReplScheduler(serverFn(1, 1, 1, 3, 3))
+	assert.Equal(t, uint64(3), ƒAssertNoError2(leader.conflictNextIndex(5, response))(t))
+	// The leader retains its logs of the term.
+	leader = newReplScheduler(serverFn(1, 1, 2, 3, 3))
+	assert.Equal(t, uint64(4), ƒAssertNoError2(leader.conflictNextIndex(5, response))(t))
+	assert.Equal(t, uint64(6), ƒAssertNoError2(leader.conflictNextIndex(7, missingResponse))(t))
+}
+
+func TestReplSchedulerPrepareRequest(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	for i := uint64(1); i <= 5; i++ {
+		assert.NoError(t, server.logStore.AppendLogs([]*pb.Log{
+			{Meta: &pb.LogMeta{Index: i, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}},
+		}))
+	}
+	server.setFirstLogIndex(1)
+	server.setLastLogIndex(5)
+	r := newReplScheduler(server)
+
+	// The logs after the last index are left to the next request.
+	_, request, err := r.prepareRequest(1, 2, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), request.PrevLogIndex)
+	assert.Len(t, request.Entries, 2)
+	assert.Equal(t, uint64(3), request.Entries[1].Meta.Index)
+	// The entries are read from the LogStore without being copied.
+	assert.Same(t, ƒAssertNoError2(server.logStore.Entry(3))(t), request.Entries[1])
+
+	_, request, err = r.prepareRequest(1, 4, 10)
+	assert.NoError(t, err)
+	assert.Len(t, request.Entries, 2)
+
+	// The released requests are reset before they are reused.
+	releaseAppendEntriesRequest(request)
+	assert.Zero(t, request.PrevLogIndex)
+	assert.Empty(t, request.Entries)
+	_, request, err = r.prepareRequest(1, 1, 1)
+	assert.NoError(t, err)
+	assert.Zero(t, request.PrevLogIndex)
+	assert.Len(t, request.Entries, 1)
+
+	// The entries are copied if the LogStore may retain the logs.
+	server.logStore = newLogStoreProxy(server, &retainingLogStore{LogStore: server.logStore.LogStore})
+	_, request, err = r.prepareRequest(1, 2, 3)
+	assert.NoError(t, err)
+	request.Entries[1].Body.Data = []byte("modified")
+	assert.Empty(t, ƒAssertNoError2(server.logStore.Entry(3))(t).Body.Data)
+}
+
+func BenchmarkReplSchedulerPrepareRequest(b *testing.B) {
+	server := testingServer(b)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	logs := make([]*pb.Log, 64)
+	for i := range logs {
+		logs[i] = &pb.Log{
+			Meta: &pb.LogMeta{Index: uint64(i) + 1, Term: 1},
+			Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: make([]byte, 128)},
+		}
+	}
+	if err := server.logStore.AppendLogs(logs); err != nil {
+		b.Fatal(err)
+	}
+	server.setFirstLogIndex(1)
+	server.setLastLogIndex(uint64(len(logs)))
+	r := newReplScheduler(server)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, request, err := r.prepareRequest(1, 1, uint64(len(logs)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		releaseAppendEntriesRequest(request)
+	}
+}
@@ -0,0 +1,97 @@
+package raft
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides how failed internal operations (transport calls,
+// replication attempts, proxied requests, etc.) are retried.
+type RetryPolicy interface {
+	// Backoff returns the delay to wait before the next attempt after attempt
+	// consecutive failures, and whether the operation should be retried at all.
+	// Long-running loops such as replication never give up and only honor the
+	// returned delay.
+	Backoff(attempt int) (delay time.Duration, retry bool)
+}
+
+var defaultRetryPolicy = ExponentialRetryPolicy{
+	Initial:     100 * time.Millisecond,
+	Max:         1 * time.Second,
+	Multiplier:  2,
+	Jitter:      0.3,
+	MaxAttempts: 3,
+}
+
+// ConstantRetryPolicy retries up to MaxAttempts times with a fixed delay.
+// A zero MaxAttempts means unlimited retries.
+type ConstantRetryPolicy struct {
+	Delay       time.Duration
+	MaxAttempts int
+}
+
+func (p ConstantRetryPolicy) Backoff(attempt int) (time.Duration, bool) {
+	return p.Delay, p.MaxAttempts <= 0 || attempt <= p.MaxAttempts
+}
+
+// ExponentialRetryPolicy retries up to MaxAttempts times with a delay growing
+// from Initial by Multiplier on each failure, capped at Max. A random offset of
+// up to Jitter times the delay is added. A zero MaxAttempts means unlimited
+// retries.
+type ExponentialRetryPolicy struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      float64
+	MaxAttempts int
+}
+
+func (p ExponentialRetryPolicy) Backoff(attempt int) (time.Duration, bool) {
+	if attempt < 1 {
+		attempt = 1
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.Initial) * math.Pow(multiplier, float64(attempt-1))
+	if p.Max > 0 && delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+	if p.Jitter > 0 {
+		delay += rand.Float64() * p.Jitter * delay
+	}
+	return time.Duration(delay), p.MaxAttempts <= 0 || attempt <= p.MaxAttempts
+}
+
+// retry calls fn until it succeeds, fn reports the error as not retryable, the
+// RetryPolicy gives up, or ctx is done. The last error is returned.
+func retry(ctx context.Context, policy RetryPolicy, fn func() (retryable bool, err error)) error {
+	for attempt := 1; ; attempt++ {
+		retryable, err := fn()
+		if err == nil || !retryable {
+			return err
+		}
+		delay, ok := policy.Backoff(attempt)
+		if !ok {
+			return err
+		}
+		if delay <= 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			default:
+			}
+			continue
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
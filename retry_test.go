@@ -0,0 +1,70 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialRetryPolicy(t *testing.T) {
+	p := ExponentialRetryPolicy{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2, MaxAttempts: 4}
+
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for i, d := range expected {
+		delay, ok := p.Backoff(i + 1)
+		assert.Equal(t, d*time.Millisecond, delay)
+		assert.Equal(t, i+1 <= p.MaxAttempts, ok)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	e := errors.New("error")
+
+	t.Run("Succeeded", func(t *testing.T) {
+		calls := 0
+		err := retry(context.Background(), ConstantRetryPolicy{}, func() (bool, error) {
+			calls++
+			if calls < 3 {
+				return true, e
+			}
+			return false, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("NotRetryable", func(t *testing.T) {
+		calls := 0
+		err := retry(context.Background(), ConstantRetryPolicy{}, func() (bool, error) {
+			calls++
+			return false, e
+		})
+		assert.ErrorIs(t, err, e)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("GaveUp", func(t *testing.T) {
+		calls := 0
+		err := retry(context.Background(), ConstantRetryPolicy{MaxAttempts: 2}, func() (bool, error) {
+			calls++
+			return true, e
+		})
+		assert.ErrorIs(t, err, e)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := 0
+		err := retry(ctx, ConstantRetryPolicy{Delay: time.Hour}, func() (bool, error) {
+			calls++
+			cancel()
+			return true, e
+		})
+		assert.ErrorIs(t, err, e)
+		assert.Equal(t, 1, calls)
+	})
+}
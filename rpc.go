@@ -3,9 +3,12 @@ package raft
 import (
 	"context"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap"
 )
 
 type RPC struct {
@@ -14,10 +17,17 @@ type RPC struct {
 	futureTask FutureTask[any, any]
 }
 
+// NewRPC creates an RPC with the request. The request ID is the one in ctx
+// set with WithRequestID, if any, so that the RPC can be correlated with the
+// sender.
 func NewRPC(ctx context.Context, request interface{}) *RPC {
+	requestID := RequestID(ctx)
+	if requestID == "" {
+		requestID = NewObjectID().Hex()
+	}
 	return &RPC{
 		ctx:        ctx,
-		requestID:  NewObjectID().Hex(),
+		requestID:  requestID,
 		futureTask: newFutureTask[any](request),
 	}
 }
@@ -26,6 +36,34 @@ func (r *RPC) Context() context.Context {
 	return r.ctx
 }
 
+func (r *RPC) RequestID() string {
+	return r.requestID
+}
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// WithRequestID returns ctx with the request ID, which is sent along with the
+// RPCs made with ctx and logged by both sides.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the request ID in ctx, or an empty string if there's none.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// ensureRequestID returns ctx with a new request ID if it has none.
+func ensureRequestID(ctx context.Context) (context.Context, string) {
+	if requestID := RequestID(ctx); requestID != "" {
+		return ctx, requestID
+	}
+	requestID := NewObjectID().Hex()
+	return WithRequestID(ctx, requestID), requestID
+}
+
 func (r *RPC) Request() interface{} {
 	return r.futureTask.Task()
 }
@@ -45,17 +83,49 @@ type InstallSnapshotRequest struct {
 
 type rpcHandler struct {
 	server *Server
+	// appendMu serializes the AppendEntries RPCs, which are handled
+	// concurrently, so that the logs to append are decided against the logs
+	// appended by the previous ones.
+	appendMu sync.Mutex
+	// matchIndex is the index of the last log known to match those of the
+	// leader of matchTerm. The commit index from the leader is only applied up
+	// to it, since the logs following it may be replaced.
+	matchTerm  uint64
+	matchIndex uint64
 }
 
 func newRPCHandler(server *Server) *rpcHandler {
 	return &rpcHandler{server: server}
 }
 
+// verifyPeer returns ErrUnknownPeer if the unknown peers are rejected and the
+// server with the ID is not in the latest configuration.
+func (h *rpcHandler) verifyPeer(serverID string) error {
+	if !h.server.opts().rejectUnknownPeers {
+		return nil
+	}
+	c := h.server.confStore.Latest()
+	if _, ok := c.Peer(h.server.id); !ok {
+		// We're not in the configuration yet and should learn it from others.
+		return nil
+	}
+	if _, ok := c.Peer(serverID); !ok {
+		return errors.Wrapf(ErrUnknownPeer, "server %q is not in the configuration", serverID)
+	}
+	return nil
+}
+
 func (h *rpcHandler) AppendEntries(
 	ctx context.Context, requestID string, request *pb.AppendEntriesRequest,
 ) (*pb.AppendEntriesResponse, error) {
 	h.server.logger.Debugw("incoming RPC: AppendEntries",
 		logFields(h.server, "request_id", requestID, "request", request)...)
+	defer h.server.recordLatency(MetricRPCAppendEntriesLatency, time.Now())
+
+	if err := h.verifyPeer(request.LeaderId); err != nil {
+		h.server.logger.Warnw("incoming RPC rejected", logFields(h.server, "request_id", requestID, zap.Error(err))...)
+		return nil, err
+	}
 
 	response := &pb.AppendEntriesResponse{
 		ServerId: h.server.id,
@@ -69,10 +139,22 @@ func (h *rpcHandler) AppendEntries(
 		return response, nil
 	}
 
+	h.appendMu.Lock()
+	defer h.appendMu.Unlock()
+
+	// The term may have changed while waiting for the lock, e.g., as we've won
+	// an election, in which case the leader must not be replaced.
+	if request.Term < h.server.currentTerm() {
+		response.Term = h.server.currentTerm()
+		response.Status = pb.ReplStatus_REPL_ERR_STALE_TERM
+		return response, nil
+	}
+
 	if h.server.Leader().Id != request.LeaderId {
 		leaderPeer, _ := h.server.confStore.Latest().Peer(request.LeaderId)
 		h.server.alterLeader(leaderPeer)
 	}
+	h.server.setLastLeaderContact(h.server.opts().clock.Now())
 
 	if request.Term > h.server.currentTerm() {
 		h.server.logger.Debugw("local term is stale", logFields(h.server, "request_id", requestID)...)
@@ -82,13 +164,15 @@ func (h *rpcHandler) AppendEntries(
 		}
 		h.server.alterTerm(request.Term)
 		response.Term = h.server.currentTerm()
+	} else if h.server.role() == Candidate {
+		// Another server has won the election in our term.
+		leaderPeer, _ := h.server.confStore.Latest().Peer(request.LeaderId)
+		h.server.stepdownFollower(leaderPeer)
 	}
 
-	if request.PrevLogIndex > 0 {
-		if h.server.logStore.withinCompacted(request.PrevLogIndex) {
-			h.server.logger.Panicw("previous log index is compacted by the snapshot",
-				logFields(h.server, "request_id", requestID, "request", request)...)
-		}
+	// The logs covered by the snapshot are committed, and hence match those of
+	// the leader.
+	if request.PrevLogIndex > 0 && !h.server.logStore.withinSnapshot(request.PrevLogIndex) {
 		prevLogMeta, err := h.server.logStore.Meta(request.PrevLogIndex)
 		if err != nil {
 			return nil, err
@@ -97,6 +181,9 @@ func (h *rpcHandler) AppendEntries(
 			h.server.logger.Infow("incoming previous log does not exist or has a different term",
 				logFields(h.server, "request_id", requestID, "request", request)...)
 			response.Status = pb.ReplStatus_REPL_ERR_NO_LOG
+			if err := h.setConflict(response, prevLogMeta); err != nil {
+				return nil, err
+			}
 			return response, nil
 		}
 	}
@@ -110,6 +197,10 @@ func (h *rpcHandler) AppendEntries(
 				if e.Meta.Index > lastLogIndex {
 					break
 				}
+				if h.server.logStore.withinSnapshot(e.Meta.Index) {
+					firstAppendArrayIndex = i + 1
+					continue
+				}
 				log, err := h.server.logStore.Entry(e.Meta.Index)
 				if err != nil {
 					return nil, err
@@ -119,33 +210,58 @@ func (h *rpcHandler) AppendEntries(
 					logTerm = log.Meta.Term
 				}
 				if logTerm != e.Meta.Term {
-					firstCleanUpIndex = log.Meta.Index
+					firstCleanUpIndex = e.Meta.Index
 					break
 				}
 				firstAppendArrayIndex = i + 1
 			}
 			if firstCleanUpIndex > 0 {
-				if err := h.server.logStore.TrimSuffix(firstCleanUpIndex - 1); err != nil {
+				// Trim the logs in the main loop so that the last log index is
+				// updated before the logs are appended.
+				trimOp := &logStoreTrimOp{
+					Type:       logStoreTrimSuffix,
+					FutureTask: newFutureTask[any](firstCleanUpIndex - 1),
+				}
+				if err := h.server.enqueueLogOp(ctx, trimOp); err != nil {
+					return nil, err
+				}
+				if _, err := trimOp.Result(); err != nil {
 					// Return errors here should produce no side effects
 					return nil, err
 				}
 			}
 		}
 		bodies := make([]*pb.LogBody, 0, len(request.Entries)-firstAppendArrayIndex)
+		terms := make([]uint64, 0, len(request.Entries)-firstAppendArrayIndex)
 		for i := firstAppendArrayIndex; i < len(request.Entries); i++ {
-			bodies = append(bodies, request.Entries[i].Body.Copy())
+			// The bodies are copied by the logStoreProxy if the LogStore
+			// retains the logs.
+			bodies = append(bodies, request.Entries[i].Body)
+			terms = append(terms, request.Entries[i].Meta.Term)
+		}
+		appendOp := &logStoreAppendOp{FutureTask: newFutureTask[[]*pb.LogMeta](bodies), terms: terms}
+		if err := h.server.enqueueLogOp(ctx, appendOp); err != nil {
+			return nil, err
 		}
-		appendOp := &logStoreAppendOp{FutureTask: newFutureTask[[]*pb.LogMeta](bodies)}
-		h.server.logOpsCh <- appendOp
 		if _, err := appendOp.Result(); err != nil {
 			return nil, err
 		}
 	}
 
-	if request.LeaderCommit > h.server.commitIndex() {
+	if h.matchTerm != request.Term {
+		h.matchTerm, h.matchIndex = request.Term, 0
+	}
+	if lastNewIndex := request.PrevLogIndex + uint64(len(request.Entries)); lastNewIndex > h.matchIndex {
+		h.matchIndex = lastNewIndex
+	}
+	commitIndex := request.LeaderCommit
+	if commitIndex > h.matchIndex {
+		commitIndex = h.matchIndex
+	}
+	if commitIndex > h.server.commitIndex() {
 		h.server.logger.Infow("local commit index is stale",
-			logFields(h.server, "request_id", requestID, "new_commit_index", request.LeaderCommit)...)
-		h.server.alterCommitIndex(request.LeaderCommit)
+			logFields(h.server, "request_id", requestID, "new_commit_index", commitIndex)...)
+		h.server.alterCommitIndex(commitIndex)
 	}
 
 	response.Status = pb.ReplStatus_REPL_OK
@@ -157,6 +273,12 @@ func (h *rpcHandler) RequestVote(
 ) (*pb.RequestVoteResponse, error) {
 	h.server.logger.Infow("incoming RPC: RequestVote",
 		logFields(h.server, "request_id", requestID, "request", request)...)
+	defer h.server.recordLatency(MetricRPCRequestVoteLatency, time.Now())
+
+	if err := h.verifyPeer(request.CandidateId); err != nil {
+		h.server.logger.Warnw("incoming RPC rejected", logFields(h.server, "request_id", requestID, zap.Error(err))...)
+		return nil, err
+	}
 
 	response := &pb.RequestVoteResponse{
 		ServerId: h.server.id,
@@ -164,20 +286,20 @@ func (h *rpcHandler) RequestVote(
 		Granted:  false,
 	}
 
+	h.server.serverState.voteMu.Lock()
+	defer h.server.serverState.voteMu.Unlock()
+
 	if request.Term < h.server.currentTerm() {
 		h.server.logger.Debugw("incoming term is stale", logFields(h.server, "request_id", requestID)...)
 		return response, nil
 	}
 
-	// Check if our server has voted in current term.
-	lastVoteSummary := h.server.lastVoteSummary()
-	if h.server.currentTerm() <= lastVoteSummary.term {
-		h.server.logger.Debugw("server has voted in this term",
-			logFields(h.server, "request_id", requestID, "candidate", lastVoteSummary.candidate)...)
-		// Check if the granted vote is for current candidate.
-		if lastVoteSummary.candidate == request.CandidateId {
-			response.Granted = true
-		}
+	// (6) Withhold the vote while the current leader is alive so that a server
+	// rejoining the cluster cannot disrupt it with a higher term, unless the
+	// election is requested by the leader for a leadership transfer.
+	if !request.LeadershipTransfer && h.server.leaderAlive() {
+		h.server.logger.Debugw("vote withheld since the leader is alive",
+			logFields(h.server, "request_id", requestID, "leader", h.server.Leader().Id)...)
 		return response, nil
 	}
 
@@ -190,17 +312,21 @@ func (h *rpcHandler) RequestVote(
 		response.Term = h.server.currentTerm()
 	}
 
-	lastLog, err := h.server.logStore.LastEntry(0)
-	if err != nil {
-		return nil, err
+	// Check if our server has voted in current term.
+	lastVoteSummary := h.server.lastVoteSummary()
+	if h.server.currentTerm() <= lastVoteSummary.term {
+		h.server.logger.Debugw("server has voted in this term",
+			logFields(h.server, "request_id", requestID, "candidate", lastVoteSummary.candidate)...)
+		// Check if the granted vote is for current candidate.
+		if lastVoteSummary.candidate == request.CandidateId {
+			response.Granted = true
+		}
+		return response, nil
 	}
 
-	var lastIndex uint64
-	var lastTerm uint64
-
-	if lastLog != nil {
-		lastIndex = lastLog.Meta.Index
-		lastTerm = lastLog.Meta.Term
+	lastTerm, lastIndex, err := h.server.logStore.LastTermIndex()
+	if err != nil {
+		return nil, err
 	}
 
 	// Check if candidate's term of the last log is stale.
@@ -220,6 +346,30 @@ func (h *rpcHandler) RequestVote(
 	return response, nil
 }
 
+// setConflict fills the conflict hints in the response so that the leader can
+// skip all conflicting logs of a term at once. prevLogMeta is the meta of the
+// local log at the previous log index, or nil if the log does not exist.
+func (h *rpcHandler) setConflict(response *pb.AppendEntriesResponse, prevLogMeta *pb.LogMeta) error {
+	if prevLogMeta == nil {
+		response.ConflictIndex = h.server.lastLogIndex() + 1
+		return nil
+	}
+	response.ConflictTerm = prevLogMeta.Term
+	index := prevLogMeta.Index
+	for index > 1 && !h.server.logStore.withinCompacted(index-1) {
+		meta, err := h.server.logStore.Meta(index - 1)
+		if err != nil {
+			return err
+		}
+		if meta == nil || meta.Term != prevLogMeta.Term {
+			break
+		}
+		index--
+	}
+	response.ConflictIndex = index
+	return nil
+}
+
 // TODO: Should respond to shutdown signal since it may take longer than expected
 // to complete the installation.
 func (h *rpcHandler) InstallSnapshot(
@@ -227,6 +377,14 @@ func (h *rpcHandler) InstallSnapshot(
 ) (*pb.InstallSnapshotResponse, error) {
 	h.server.logger.Infow("incoming RPC: InstallSnapshot",
 		logFields(h.server, "request_id", requestID, "request", request)...)
+	defer h.server.recordLatency(MetricRPCInstallSnapshotLatency, time.Now())
+
+	if err := h.verifyPeer(request.Metadata.LeaderId); err != nil {
+		h.server.logger.Warnw("incoming RPC rejected", logFields(h.server, "request_id", requestID, zap.Error(err))...)
+		// Stop receiving the snapshot.
+		request.Reader.Close()
+		return nil, err
+	}
 
 	response := &pb.InstallSnapshotResponse{Term: h.server.currentTerm()}
 
@@ -235,6 +393,22 @@ func (h *rpcHandler) InstallSnapshot(
 		return response, nil
 	}
 
+	if h.server.Leader().Id != request.Metadata.LeaderId {
+		leaderPeer, _ := h.server.confStore.Latest().Peer(request.Metadata.LeaderId)
+		h.server.alterLeader(leaderPeer)
+	}
+	h.server.setLastLeaderContact(h.server.opts().clock.Now())
+
+	if request.Metadata.Term > h.server.currentTerm() {
+		h.server.logger.Debugw("local term is stale", logFields(h.server, "request_id", requestID)...)
+		if h.server.role() != Follower {
+			leaderPeer, _ := h.server.confStore.Latest().Peer(request.Metadata.LeaderId)
+			h.server.stepdownFollower(leaderPeer)
+		}
+		h.server.alterTerm(request.Metadata.Term)
+		response.Term = h.server.currentTerm()
+	}
+
 	snapshotMeta, err := h.server.snapshotStore.DecodeMeta(request.Metadata.SnapshotMetadata)
 	if err != nil {
 		return nil, err
@@ -264,7 +438,11 @@ func (h *rpcHandler) InstallSnapshot(
 		return nil, err
 	}
 
-	if _, err := h.server.snapshotService.Restore(sink.Meta().Id()); err != nil {
+	// The restoration is done in the main loop so that it never races with the
+	// logs being applied.
+	restoreTask := newFutureTask[bool](sink.Meta().Id())
+	h.server.snapshotRestoreCh <- restoreTask
+	if _, err := restoreTask.Result(); err != nil {
 		return nil, err
 	}
 
@@ -283,17 +461,46 @@ func (h *rpcHandler) ApplyLog(ctx context.Context, requestID string, request *pb
 		}, nil
 	}
 
-	result, err := h.server.Apply(ctx, request.Body).Result()
-	if err != nil {
-		return &pb.ApplyLogResponse{
-			Response: &pb.ApplyLogResponse_Error{
-				Error: err.Error(),
-			},
-		}, nil
+	return h.server.applyLogResponse(h.server.Apply(ctx, request.Body)), nil
+}
+
+func (h *rpcHandler) ChangeMembership(
+	ctx context.Context, requestID string, request *pb.MembershipChangeRequest,
+) (*pb.MembershipChangeResponse, error) {
+	h.server.logger.Infow("incoming RPC: ChangeMembership",
+		logFields(h.server, "request_id", requestID, "request", request)...)
+
+	if h.server.role() != Leader {
+		return &pb.MembershipChangeResponse{Error: ErrNonLeader.Error()}, nil
+	}
+	if err := h.server.applyMembershipChange(ctx, request); err != nil {
+		return &pb.MembershipChangeResponse{Error: err.Error()}, nil
 	}
-	return &pb.ApplyLogResponse{
-		Response: &pb.ApplyLogResponse_Meta{
-			Meta: result.Copy(),
-		},
-	}, nil
+	return &pb.MembershipChangeResponse{}, nil
+}
+
+// TimeoutNow makes the server start an election immediately on the request of
+// the leader, which is transferring the leadership to the server.
+func (h *rpcHandler) TimeoutNow(
+	ctx context.Context, requestID string, request *pb.TimeoutNowRequest,
+) (*pb.TimeoutNowResponse, error) {
+	h.server.logger.Infow("incoming RPC: TimeoutNow",
+		logFields(h.server, "request_id", requestID, "request", request)...)
+
+	if err := h.verifyPeer(request.LeaderId); err != nil {
+		h.server.logger.Warnw("incoming RPC rejected", logFields(h.server, "request_id", requestID, zap.Error(err))...)
+		return nil, err
+	}
+
+	response := &pb.TimeoutNowResponse{Term: h.server.currentTerm()}
+	if request.Term < h.server.currentTerm() {
+		h.server.logger.Debugw("incoming term is stale", logFields(h.server, "request_id", requestID)...)
+		return response, nil
+	}
+	select {
+	case h.server.timeoutNowCh <- struct{}{}:
+	default:
+		// An election has been requested.
+	}
+	return response, nil
 }
@@ -2,9 +2,14 @@ package raft
 
 import (
 	"context"
+	"fmt"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
 )
 
 func TestRPC(t *testing.T) {
@@ -15,3 +20,376 @@ func TestRPC(t *testing.T) {
 	resp := ƒAssertNoError2(rpc.Response())(t)
 	assert.IsType(t, &testResponse{}, resp)
 }
+
+func TestRPCHandlerRejectUnknownPeers(t *testing.T) {
+	serverFn := func(enabled bool, peerIDs ...string) *rpcHandler {
+		server := testingServer(t, RejectUnknownPeersOption(enabled))
+		server.logStore = newLogStoreProxy(server, newInternalLogStore())
+		server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+		peers := []*pb.Peer{}
+		for _, id := range peerIDs {
+			if id == "self" {
+				id = server.id
+			}
+			peers = append(peers, &pb.Peer{Id: id, Endpoint: id})
+		}
+		server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{Peers: peers}}, 1))
+		return newRPCHandler(server)
+	}
+	requestVoteFn := func(h *rpcHandler, candidateID string) error {
+		_, err := h.RequestVote(context.Background(), "", &pb.RequestVoteRequest{CandidateId: candidateID})
+		return err
+	}
+
+	h := serverFn(true, "self", "2")
+	assert.NoError(t, requestVoteFn(h, "2"))
+	assert.ErrorIs(t, requestVoteFn(h, "3"), ErrUnknownPeer)
+	_, err := h.AppendEntries(context.Background(), "", &pb.AppendEntriesRequest{LeaderId: "3"})
+	assert.ErrorIs(t, err, ErrUnknownPeer)
+
+	// Servers not in their own configuration accept all peers.
+	assert.NoError(t, requestVoteFn(serverFn(true, "2"), "3"))
+	assert.NoError(t, requestVoteFn(serverFn(false, "self", "2"), "3"))
+}
+
+func TestRPCHandlerLeaderStickiness(t *testing.T) {
+	server := testingServer(t, FollowerTimeoutOption(time.Hour))
+	server.stableStore = ƒAssertNoError2(newInternalStore())(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	server.serverState.stateCurrentTerm = 1
+	h := newRPCHandler(server)
+	requestVoteFn := func() *pb.RequestVoteResponse {
+		return ƒAssertNoError2(h.RequestVote(context.Background(), "", &pb.RequestVoteRequest{Term: 2, CandidateId: "2"}))(t)
+	}
+
+	server.setLeader(&pb.Peer{Id: "1", Endpoint: "1"})
+	server.setLastLeaderContact(time.Now())
+	response := requestVoteFn()
+	assert.False(t, response.Granted)
+	// The term is not updated while the vote is withheld.
+	assert.Equal(t, uint64(1), server.currentTerm())
+
+	server.setLastLeaderContact(time.Now().Add(-2 * time.Hour))
+	assert.True(t, requestVoteFn().Granted)
+	assert.Equal(t, uint64(2), server.currentTerm())
+}
+
+func TestRPCHandlerCandidateStepdown(t *testing.T) {
+	server := fuzzingServer(t)
+	h := newRPCHandler(server)
+	server.serverState.stateCurrentTerm = 2
+	server.setRole(Candidate)
+
+	// Another server has won the election in our term.
+	response := ƒAssertNoError2(h.AppendEntries(context.Background(), "", &pb.AppendEntriesRequest{Term: 2, LeaderId: "1"}))(t)
+	assert.Equal(t, pb.ReplStatus_REPL_OK, response.Status)
+	assert.Equal(t, Follower, server.role())
+	assert.Equal(t, "1", server.Leader().Id)
+	assert.Equal(t, uint64(2), server.currentTerm())
+}
+
+// slowLogStore yields to the other goroutines while the logs are appended.
+type slowLogStore struct {
+	LogStore
+}
+
+func (s *slowLogStore) AppendLogs(logs []*pb.Log) error {
+	time.Sleep(time.Millisecond)
+	return s.LogStore.AppendLogs(logs)
+}
+
+func TestRPCHandlerConcurrentAppendEntries(t *testing.T) {
+	for round := 0; round < 5; round++ {
+		server := fuzzingServer(t)
+		server.logStore = newLogStoreProxy(server, &slowLogStore{LogStore: server.stableStore})
+		h := newRPCHandler(server)
+		request := &pb.AppendEntriesRequest{Term: 1, LeaderId: "1"}
+		for i := uint64(1); i <= 3; i++ {
+			request.Entries = append(request.Entries, &pb.Log{
+				Meta: &pb.LogMeta{Index: i, Term: 1},
+				Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte{byte(i)}},
+			})
+		}
+
+		// The retries of the same request, e.g., after a timeout, are handled
+		// concurrently, and each of them should see the logs appended by the
+		// others instead of appending the logs again.
+		var wg sync.WaitGroup
+		startCh := make(chan struct{})
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-startCh
+				response, err := h.AppendEntries(context.Background(), "", request)
+				assert.NoError(t, err)
+				assert.Equal(t, pb.ReplStatus_REPL_OK, response.Status)
+			}()
+		}
+		close(startCh)
+		wg.Wait()
+		assertLogConsistent(t, server)
+		assert.Equal(t, uint64(3), server.lastLogIndex())
+	}
+}
+
+func TestRPCHandlerAppendEntriesConflict(t *testing.T) {
+	server := fuzzingServer(t)
+	h := newRPCHandler(server)
+	entryFn := func(index, term uint64) *pb.Log {
+		return &pb.Log{
+			Meta: &pb.LogMeta{Index: index, Term: term},
+			Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte{byte(index), byte(term)}},
+		}
+	}
+	response := ƒAssertNoError2(h.AppendEntries(context.Background(), "", &pb.AppendEntriesRequest{
+		Term: 1, LeaderId: "1", Entries: []*pb.Log{entryFn(1, 1), entryFn(2, 1), entryFn(3, 1)},
+	}))(t)
+	assert.Equal(t, pb.ReplStatus_REPL_OK, response.Status)
+
+	// The logs from the conflicting one are replaced by those of the new
+	// leader, which follow the remaining logs without a gap.
+	response = ƒAssertNoError2(h.AppendEntries(context.Background(), "", &pb.AppendEntriesRequest{
+		Term: 2, LeaderId: "2", PrevLogIndex: 1, PrevLogTerm: 1, Entries: []*pb.Log{entryFn(2, 2)},
+	}))(t)
+	assert.Equal(t, pb.ReplStatus_REPL_OK, response.Status)
+	assertLogConsistent(t, server)
+	assert.Equal(t, uint64(2), server.lastLogIndex())
+	assert.Equal(t, []byte{2, 2}, ƒAssertNoError2(server.logStore.Entry(2))(t).Body.Data)
+}
+
+// slowStableStore yields to the other goroutines while the votes are saved.
+type slowStableStore struct {
+	StableStore
+}
+
+func (s *slowStableStore) SetLastVote(summary voteSummary) error {
+	time.Sleep(time.Millisecond)
+	return s.StableStore.SetLastVote(summary)
+}
+
+func TestRPCHandlerConcurrentVotes(t *testing.T) {
+	for round := 0; round < 5; round++ {
+		server := fuzzingServer(t)
+		server.stableStore = &slowStableStore{StableStore: server.stableStore}
+		h := newRPCHandler(server)
+
+		// The vote for another candidate and the vote for ourself as an
+		// election starts are not cast in the same term.
+		electionCh := make(chan struct{})
+		go func() {
+			defer close(electionCh)
+			_, cancel, err := server.startElection()
+			assert.NoError(t, err)
+			cancel()
+		}()
+		// Let the election start, which yields while the vote is saved.
+		runtime.Gosched()
+		response := ƒAssertNoError2(h.RequestVote(context.Background(), "", &pb.RequestVoteRequest{Term: 2, CandidateId: "2"}))(t)
+		<-electionCh
+		if response.Granted {
+			assert.Equal(t, uint64(3), server.currentTerm())
+		} else {
+			assert.Equal(t, uint64(2), server.currentTerm())
+		}
+	}
+}
+
+// fuzzInput decodes the values of the fuzz targets from the bytes, which are
+// zeros once exhausted.
+type fuzzInput []byte
+
+func (in *fuzzInput) next(n int) uint64 {
+	if len(*in) == 0 {
+		return 0
+	}
+	b := (*in)[0]
+	*in = (*in)[1:]
+	return uint64(b) % uint64(n)
+}
+
+// fuzzingServer returns a follower whose log ops are handled by a goroutine as
+// the main loop does. The commit indexes are left in commitCh.
+func fuzzingServer(t *testing.T) *Server {
+	server := testingServer(t, FollowerTimeoutOption(time.Hour))
+	server.stableStore = ƒAssertNoError2(newInternalStore())(t)
+	server.logStore = newLogStoreProxy(server, server.stableStore)
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{Peers: []*pb.Peer{
+		{Id: server.id, Endpoint: server.id}, {Id: "1", Endpoint: "1"}, {Id: "2", Endpoint: "2"},
+	}}}, 0))
+	server.logOpsCh = make(chan logStoreOp, 64)
+	server.commitCh = make(chan uint64, 16)
+	server.serverState.stateCurrentTerm = 1
+	go func() {
+		for {
+			select {
+			case op := <-server.logOpsCh:
+				server.handleLogOp(op)
+			case <-server.stopCh:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(server.stopCh) })
+	return server
+}
+
+// assertLogConsistent asserts that the logs are contiguous with non-decreasing
+// terms, and that the index states match the LogStore.
+func assertLogConsistent(t *testing.T, server *Server) {
+	lastIndex := ƒAssertNoError2(server.logStore.LastIndex())(t)
+	if !assert.Equal(t, lastIndex, server.lastLogIndex(), "last log index") {
+		t.FailNow()
+	}
+	var lastTerm uint64
+	for i := uint64(1); i <= lastIndex; i++ {
+		log := ƒAssertNoError2(server.logStore.Entry(i))(t)
+		if !assert.NotNil(t, log, "log %d", i) || !assert.Equal(t, i, log.Meta.Index) ||
+			!assert.GreaterOrEqual(t, log.Meta.Term, lastTerm, "term of log %d", i) {
+			t.FailNow()
+		}
+		lastTerm = log.Meta.Term
+	}
+}
+
+func FuzzRPCHandlerAppendEntries(f *testing.F) {
+	f.Add([]byte{1, 0, 0, 3, 1, 1, 1, 3})
+	f.Add([]byte{1, 0, 0, 4, 1, 1, 1, 1, 0, 2, 2, 1, 2, 2, 0, 2, 2, 1, 0})
+	f.Add([]byte{2, 0, 0, 3, 1, 1, 2, 0, 3, 1, 1, 2, 2, 0, 3, 3, 2, 0, 1, 1, 3, 3, 3, 2, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server := fuzzingServer(t)
+		h := newRPCHandler(server)
+		in := fuzzInput(data)
+		// leaderLogs are the terms of the logs of the leaders of the terms 1 to
+		// 4. The leader of a term has a prefix of the logs of an earlier leader,
+		// followed by the logs of its term.
+		leaderLogs := map[uint64][]uint64{}
+		var leaderLog func(term uint64) []uint64
+		leaderLog = func(term uint64) []uint64 {
+			if log, ok := leaderLogs[term]; ok {
+				return log
+			}
+			var log []uint64
+			if term > 1 {
+				previous := leaderLog(1 + in.next(int(term-1)))
+				log = append(log, previous[:in.next(len(previous)+1)]...)
+			}
+			for n := 1 + in.next(5); n > 0; n-- {
+				log = append(log, term)
+			}
+			leaderLogs[term] = log
+			return log
+		}
+		// matchIndexes are the indexes of the last logs known to match those of
+		// the leaders.
+		matchIndexes := map[uint64]uint64{}
+		for len(in) > 0 {
+			// The requests from the leaders, which may be stale, conflicting,
+			// duplicated, or leave gaps in the logs.
+			request := &pb.AppendEntriesRequest{Term: 1 + in.next(4), LeaderId: "1"}
+			log := leaderLog(request.Term)
+			request.PrevLogIndex = in.next(len(log) + 3)
+			if request.PrevLogIndex > 0 && request.PrevLogIndex <= uint64(len(log)) {
+				request.PrevLogTerm = log[request.PrevLogIndex-1]
+			} else if request.PrevLogIndex > 0 {
+				request.PrevLogTerm = request.Term
+			}
+			n := in.next(5)
+			for i := request.PrevLogIndex; i < uint64(len(log)) && i < request.PrevLogIndex+n; i++ {
+				request.Entries = append(request.Entries, &pb.Log{
+					Meta: &pb.LogMeta{Index: i + 1, Term: log[i]},
+					Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte{byte(i + 1), byte(log[i])}},
+				})
+			}
+			request.LeaderCommit = in.next(12)
+			previousTerm := server.currentTerm()
+
+			response, err := h.AppendEntries(context.Background(), "", request)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			assertLogConsistent(t, server)
+			assert.GreaterOrEqual(t, server.currentTerm(), previousTerm, "current term")
+			if response.Status != pb.ReplStatus_REPL_OK {
+				continue
+			}
+			assert.Equal(t, request.Term, server.currentTerm())
+			for _, e := range request.Entries {
+				log := ƒAssertNoError2(server.logStore.Entry(e.Meta.Index))(t)
+				if !assert.NotNil(t, log, "log %d", e.Meta.Index) {
+					t.FailNow()
+				}
+				assert.Equal(t, e.Meta.Term, log.Meta.Term, "term of log %d", e.Meta.Index)
+				assert.Equal(t, e.Body.Data, log.Body.Data, "data of log %d", e.Meta.Index)
+			}
+			// Only the logs known to match the leader's are committed.
+			if lastNewIndex := request.PrevLogIndex + uint64(len(request.Entries)); lastNewIndex > matchIndexes[request.Term] {
+				matchIndexes[request.Term] = lastNewIndex
+			}
+			select {
+			case commitIndex := <-server.commitCh:
+				assert.LessOrEqual(t, commitIndex, matchIndexes[request.Term])
+				server.setCommitIndex(commitIndex)
+			default:
+			}
+		}
+	})
+}
+
+func FuzzRPCHandlerRequestVote(f *testing.F) {
+	f.Add([]byte{1, 0, 0, 0, 0, 1, 1, 0, 0, 0})
+	f.Add([]byte{2, 0, 3, 2, 0, 2, 1, 5, 3, 0, 3, 1, 1, 1, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server := fuzzingServer(t)
+		in := fuzzInput(data)
+		// The logs of the server.
+		var term uint64 = 1
+		for n, i := in.next(6), uint64(1); i <= n; i++ {
+			term += in.next(2)
+			assert.NoError(t, server.logStore.AppendLogs([]*pb.Log{
+				{Meta: &pb.LogMeta{Index: i, Term: term}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}},
+			}))
+			server.setLastLogIndex(i)
+		}
+		server.serverState.stateCurrentTerm = term
+		lastTerm, lastIndex := ƒAssertNoError3(server.logStore.LastTermIndex())(t)
+
+		h := newRPCHandler(server)
+		votes := map[uint64]string{}
+		// The requests of a candidate in a term are retried with the same logs.
+		candidateLogs := map[string][2]uint64{}
+		for len(in) > 0 {
+			request := &pb.RequestVoteRequest{
+				Term:               term - 1 + in.next(4),
+				CandidateId:        fmt.Sprint(1 + in.next(2)),
+				LeadershipTransfer: in.next(2) == 1,
+			}
+			key := fmt.Sprint(request.Term, request.CandidateId)
+			if _, ok := candidateLogs[key]; !ok {
+				candidateLogs[key] = [2]uint64{in.next(8), in.next(int(term) + 2)}
+			}
+			request.LastLogIndex, request.LastLogTerm = candidateLogs[key][0], candidateLogs[key][1]
+			previousTerm := server.currentTerm()
+
+			response, err := h.RequestVote(context.Background(), "", request)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			assert.GreaterOrEqual(t, server.currentTerm(), previousTerm, "current term")
+			if !response.Granted {
+				continue
+			}
+			assert.Equal(t, request.Term, server.currentTerm())
+			// At most one candidate is voted for in a term.
+			if candidate, ok := votes[request.Term]; ok {
+				assert.Equal(t, candidate, request.CandidateId, "votes in term %d", request.Term)
+			}
+			votes[request.Term] = request.CandidateId
+			// The candidate's logs are at least as up-to-date as ours.
+			assert.True(t, request.LastLogTerm > lastTerm ||
+				request.LastLogTerm == lastTerm && request.LastLogIndex >= lastIndex, "up-to-date logs")
+		}
+	})
+}
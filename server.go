@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/sumimakito/raft/pb"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -31,10 +33,17 @@ type ServerStates struct {
 	LastVoteTerm      uint64   `json:"last_vote_term"`
 	LastVoteCandidate string   `json:"last_vote_candidate"`
 	CommitIndex       uint64   `json:"commit_index"`
+	LastAppliedIndex  uint64   `json:"last_applied_index"`
+	// Metadata are the metadata of the server in the latest configuration.
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
+// ServerCoreOptions are the options required by NewServer. All fields except
+// InitialCluster must be set.
 type ServerCoreOptions struct {
-	Id             string
+	Id string
+	// InitialCluster is the configuration the server starts with if none is
+	// found in the StableStore. Leave it empty to join an existing cluster.
 	InitialCluster []*pb.Peer
 	StableStore    StableStore
 	StateMachine   StateMachine
@@ -42,6 +51,35 @@ type ServerCoreOptions struct {
 	Transport      Transport
 }
 
+func (o ServerCoreOptions) validate() error {
+	if o.Id == "" {
+		return invalidOption("empty server ID")
+	}
+	if o.StableStore == nil {
+		return invalidOption("StableStore is nil")
+	}
+	if o.StateMachine == nil {
+		return invalidOption("StateMachine is nil")
+	}
+	if o.SnapshotStore == nil {
+		return invalidOption("SnapshotStore is nil")
+	}
+	if o.Transport == nil {
+		return invalidOption("Transport is nil")
+	}
+	ids := map[string]struct{}{}
+	for _, p := range o.InitialCluster {
+		if p == nil || p.Id == "" || p.Endpoint == "" {
+			return invalidOption("peer %v in the initial cluster has no ID or endpoint", p)
+		}
+		if _, ok := ids[p.Id]; ok {
+			return invalidOption("duplicate server ID %q in the initial cluster", p.Id)
+		}
+		ids[p.Id] = struct{}{}
+	}
+	return nil
+}
+
 type serverStepdownChan chan uint64
 
 type serverChannels struct {
@@ -60,6 +98,21 @@ type serverChannels struct {
 
 	snapshotRestoreCh chan FutureTask[bool, string]
 
+	// stagingCh is signaled when a staging peer has caught up with the leader
+	// and may be promoted.
+	stagingCh chan struct{}
+
+	// timeoutNowCh receives the requests of the leader to start an election
+	// immediately for a leadership transfer.
+	timeoutNowCh chan struct{}
+
+	// userRestoreCh is used to restore the snapshots provided by users.
+	userRestoreCh chan FutureTask[SnapshotMeta, io.Reader]
+
+	// applyCh is signaled when the commit index is updated, so that the apply
+	// loop applies the committed logs.
+	applyCh chan struct{}
+
 	// stateMachineSnapshotCh is used to trigger a snapshot on the state machine.
 	stateMachineSnapshotCh chan FutureTask[*stateMachineSnapshot, any]
 }
@@ -67,11 +120,17 @@ type serverChannels struct {
 type Server struct {
 	id             string
 	initialCluster []*pb.Peer
-	opts           *serverOptions
+	options        atomic.Value // *serverOptions
+	optionsMu      sync.Mutex   // serializes the updates of options
 	serveFlag      uint32
 	logger         *zap.SugaredLogger
+	rand           *lockedRand
 
 	clusterLeader atomic.Value // *Peer
+	// lastKnownLeader is the last leader that is not NilPeer.
+	lastKnownLeader atomic.Value // *Peer
+
+	events eventBroker
 
 	serverState
 	commitState
@@ -94,10 +153,67 @@ type Server struct {
 	// flagReselectLoop is a flag used by current loop to exit and re-select a loop to enter.
 	flagReselectLoop uint32
 
+	// flagTransferElection is set if the next election is started on the
+	// request of the leader for a leadership transfer.
+	flagTransferElection uint32
+	// flagLeadershipTransfer is set while the leadership is being transferred.
+	flagLeadershipTransfer uint32
+	// leaseSuspendedTerm is the term in which a leadership transfer has asked
+	// the target to start an election. The lease does not hold in the term, as
+	// the target may be elected before the lease expires.
+	leaseSuspendedTerm uint64 // atomic
+	// flagApplyUnhealthy is set once a transient apply error is handled with
+	// ApplyErrorUnhealthy.
+	flagApplyUnhealthy uint32
+	// fsmMu serializes the accesses to the state machine between the apply
+	// loop and the restorations of the snapshots.
+	fsmMu sync.Mutex
+	// flagApplyHalted is set once a transient apply error is handled with
+	// ApplyErrorHalt, which stops applying the logs.
+	flagApplyHalted uint32
+
+	// applyMu protects closing and the increments of applyWg.
+	applyMu sync.RWMutex
+	// closing is set once Close is called, after which Apply is rejected.
+	closing bool
+	// applyWg tracks the Apply calls whose results are yet to be set.
+	applyWg sync.WaitGroup
+	// applyResponses holds the futures of the results of StateMachine.Apply
+	// on the logs applied with Apply on the leader.
+	applyResponses applyResponses
+	// uncommitted tracks the sizes of the logs appended by the leader that
+	// are yet to be committed for the BackpressurePolicy.
+	uncommitted uncommittedLogs
+	// leadershipTerm is the term in which the server is promoted to the
+	// leader, or zero if it is not the leader. Only accessed by the main loop.
+	leadershipTerm uint64
+
+	// logOpsMu protects logOpsClosed.
+	logOpsMu sync.RWMutex
+	// logOpsClosed is set on shutdown, after which no logStoreOps are
+	// enqueued.
+	logOpsClosed bool
+
+	// routines tracks the goroutines started by Serve and the main loop.
+	routines sync.WaitGroup
+	// stopCh is closed once the server starts to shut down.
+	stopCh chan struct{}
+	// closedCh is closed once the server is shut down and all goroutines
+	// tracked by routines have exited.
+	closedCh chan struct{}
+
 	shutdownOnce sync.Once
 }
 
 func NewServer(coreOpts ServerCoreOptions, opts ...ServerOption) (*Server, error) {
+	if err := coreOpts.validate(); err != nil {
+		return nil, err
+	}
+	serverOpts := applyServerOpts(opts...)
+	if err := serverOpts.validate(); err != nil {
+		return nil, err
+	}
+
 	var initialCluster []*pb.Peer
 	if coreOpts.InitialCluster != nil {
 		initialCluster = make([]*pb.Peer, 0, len(coreOpts.InitialCluster))
@@ -113,30 +229,54 @@ func NewServer(coreOpts ServerCoreOptions, opts ...ServerOption) (*Server, error
 		commitState:    commitState{},
 		serverChannels: serverChannels{
 			commitCh:               make(chan uint64, 16),
+			applyCh:                make(chan struct{}, 1),
 			logOpsCh:               make(chan logStoreOp, 64),
 			logRestoreCh:           make(chan FutureTask[any, SnapshotMeta], 64),
 			rpcCh:                  make(chan *RPC, 16),
 			serveErrCh:             make(chan error, 8),
 			shutdownCh:             make(chan error, 8),
 			snapshotRestoreCh:      make(chan FutureTask[bool, string], 8),
+			stagingCh:              make(chan struct{}, 1),
 			stateMachineSnapshotCh: make(chan FutureTask[*stateMachineSnapshot, any], 16),
+			timeoutNowCh:           make(chan struct{}, 1),
+			userRestoreCh:          make(chan FutureTask[SnapshotMeta, io.Reader], 8),
 		},
+		stopCh:        make(chan struct{}),
+		closedCh:      make(chan struct{}),
 		stableStore:   coreOpts.StableStore,
 		trans:         coreOpts.Transport,
 		snapshotStore: coreOpts.SnapshotStore,
-		opts:          applyServerOpts(opts...),
 	}
+	server.options.Store(serverOpts)
+	server.rand = serverOpts.newRand()
 
 	// Set up the logger
-	server.logger = serverLogger(server.opts.logLevel)
+	server.logger = serverLogger(server.opts().logLevel)
+
+	if t, ok := server.trans.(TransportRetryPolicySetter); ok {
+		t.SetRetryPolicy(server.opts().retryPolicy)
+	}
+	if t, ok := server.trans.(TransportHealthCheckerSetter); ok {
+		t.SetHealthChecker(server.healthy)
+	}
 
 	// Set up the LogStore
-	server.logStore = newLogStoreProxy(server, server.stableStore)
+	var logStore LogStore = server.stableStore
+	if server.opts().logCacheCapacity > 0 {
+		logStore = NewCachedLogStore(logStore, server.opts().logCacheCapacity)
+	}
+	server.logStore = newLogStoreProxy(server, logStore)
+	if l, ok := server.stableStore.(LogStoreSyncObserverSetter); ok {
+		l.SetSyncObserver(server.observeLogSync)
+	}
+	if err := server.logStore.Check(); err != nil {
+		return nil, err
+	}
 	if err := server.restoreStates(); err != nil {
 		return nil, err
 	}
 
-	server.apiServer = newAPIServer(server, server.opts.apiExtensions...)
+	server.apiServer = newAPIServer(server, server.opts().apiExtensions...)
 	// Recover the configurationStore using the LogStore.
 	if confStore, err := newConfigurationStore(server); err != nil {
 		return nil, err
@@ -168,19 +308,26 @@ func NewServer(coreOpts ServerCoreOptions, opts ...ServerOption) (*Server, error
 		}
 	}
 
+	if path := server.opts().recoveryFile; path != "" {
+		if err := server.recoverConfiguration(path); err != nil {
+			return nil, err
+		}
+	}
+
 	conf := server.confStore.Latest()
 
 	if len(conf.Peers()) > 0 {
 		// Restore cluster from saved configuration.
 		selfRegistered := false
-		for _, peer := range conf.Peers() {
-			if server.id == peer.Id {
-				// Check for an edge condition
-				if server.Endpoint() != peer.Endpoint {
-					server.logger.Panicw("confusing condition: two servers have the same ID but different endpoints",
-						logFields(server)...)
+		if peer, ok := server.selfPeer(); ok {
+			selfRegistered = true
+			if server.Endpoint() != peer.Endpoint {
+				if !server.opts().announceEndpoint {
+					return nil, fmt.Errorf("%w: %s in the configuration, %s in use",
+						ErrEndpointChanged, peer.Endpoint, server.Endpoint())
 				}
-				break
+				server.logger.Infow("the endpoint differs from the configuration and will be announced",
+					logFields(server, "configured_endpoint", peer.Endpoint)...)
 			}
 		}
 		if !selfRegistered {
@@ -197,7 +344,7 @@ func NewServer(coreOpts ServerCoreOptions, opts ...ServerOption) (*Server, error
 			return nil, err
 		}
 		pbLogBody := &pb.LogBody{Type: pb.LogType_CONFIGURATION, Data: configurationBytes}
-		if _, err := server.appendLogs([]*pb.LogBody{pbLogBody}); err != nil {
+		if _, err := server.appendLogs([]*pb.LogBody{pbLogBody}, nil, nil); err != nil {
 			server.logger.Panicw("error occurred bootstrapping configuration for ourself",
 				logFields(server, zap.Error(err))...)
 		}
@@ -213,14 +360,21 @@ func (s *Server) alterCommitIndex(commitIndex uint64) {
 // alterConfiguration changes the latest configuration the server uses.
 // Loop re-selection will be marked as needed after calling alterConfiguration().
 func (s *Server) alterConfiguration(c *configuration) {
+	previous := s.confStore.Latest()
 	s.confStore.SetLatest(c)
 	s.reselectLoop()
 	s.logger.Infow("configuration has been updated", logFields(s, zap.Reflect("configuration", c))...)
+	s.publishEvent(EventConfigurationChanged, newAPIConfiguration(c))
+	s.publishPeerEvents(previous, s.confStore.Latest())
+	s.audit(context.Background(), AuditConfigurationChanged, newAPIConfiguration(c))
 }
 
 func (s *Server) alterLeader(leader *pb.Peer) {
 	s.logger.Infow("alter leader", logFields(s, zap.Reflect("new_leader", leader))...)
 	s.setLeader(leader)
+	if leader != nil && leader.Id != "" {
+		s.audit(context.Background(), AuditLeaderChanged, leader)
+	}
 }
 
 func (s *Server) alterRole(role ServerRole) {
@@ -235,7 +389,7 @@ func (s *Server) alterTerm(term uint64) {
 
 // stepdownFollower converts the server into a follower
 func (s *Server) stepdownFollower(leader *pb.Peer) {
-	if s.role() < Follower {
+	if s.role() == Follower {
 		s.logger.Panicw("stepdownFollower() requires the server to have a role which is higher than follower",
 			logFields(s)...)
 	}
@@ -244,23 +398,31 @@ func (s *Server) stepdownFollower(leader *pb.Peer) {
 }
 
 // appendLogs submits the logs to the LogStore and updates the index states.
+// The logs are in the current term unless the terms of the logs replicated
+// from the leader are given in terms, where a zero term means the current term.
+// The responses, if not nil, are registered to receive the results of
+// StateMachine.Apply on the logs. The bodies are only copied if the LogStore
+// retains the logs, so they must not be modified by the callers afterwards.
 // NOT safe for concurrent use.
 // Should be used by non-leader servers.
-func (s *Server) appendLogs(bodies []*pb.LogBody) ([]*pb.LogMeta, error) {
+func (s *Server) appendLogs(
+	bodies []*pb.LogBody, terms []uint64, responses []Future[interface{}],
+) ([]*pb.LogMeta, error) {
 	lastLogIndex := s.lastLogIndex()
-	term := s.currentTerm()
+	currentTerm := s.currentTerm()
 	logs := make([]*pb.Log, len(bodies))
 	logMeta := make([]*pb.LogMeta, len(bodies))
 	lastConfArrayIndex := len(logs)
 
 	for i, body := range bodies {
-		log := &pb.Log{
-			Meta: &pb.LogMeta{
-				Index: lastLogIndex + 1 + uint64(i),
-				Term:  term,
-			},
-			Body: body.Copy(),
+		term := currentTerm
+		if terms != nil && terms[i] > 0 {
+			term = terms[i]
 		}
+		log := acquireLog(&pb.LogMeta{
+			Index: lastLogIndex + 1 + uint64(i),
+			Term:  term,
+		}, body)
 		logs[i] = log
 		logMeta[i] = log.Meta
 		if logs[i].Body.Type == pb.LogType_CONFIGURATION {
@@ -279,78 +441,336 @@ func (s *Server) appendLogs(bodies []*pb.LogBody) ([]*pb.LogMeta, error) {
 		conf = newConfiguration(&pbConfiguration, log.Meta.Index)
 	}
 
-	if err := s.logStore.AppendLogs(logs); err != nil {
+	for _, response := range responses {
+		traceStage(response, "raft.Apply.append")
+	}
+	err := s.logStore.AppendLogs(logs)
+	releaseLogs(logs)
+	if err != nil {
 		return nil, err
 	}
+	// The responses are registered before the logs can be committed.
+	for i, response := range responses {
+		if response != nil {
+			traceStage(response, "raft.Apply.commit")
+			s.applyResponses.add(logMeta[i], response)
+		}
+	}
 
 	// Logs have been appended now.
 	// Failure to update the index will cause a panic.
 	s.setFirstLogIndex(Must2(s.logStore.FirstIndex()))
 	s.setLastLogIndex(Must2(s.logStore.LastIndex()))
 
+	if s.role() == Leader && s.opts().backpressurePolicy.MaxUncommittedBytes > 0 {
+		for i, body := range bodies {
+			s.uncommitted.add(logMeta[i].Index, uint64(len(body.Data)))
+		}
+	}
+
 	// Special process is necessary if configuration logs are discovered.
 	if conf != nil {
 		// Stop the replication ...
 		s.replScheduler.Stop()
 		// And alter the configuration
 		s.alterConfiguration(conf)
+		return logMeta, nil
+	}
+	// The logs appended on the leader are handed to the replications as a
+	// unit. The replications of a leader stepping down, which are yet to be
+	// stopped, must not send the logs replicated from the new leader.
+	if s.role() == Leader {
+		s.replScheduler.Trigger()
 	}
 	return logMeta, nil
 }
 
-func (s *Server) commitAndApply(commitIndex uint64) {
-	s.logger.Infow("ready to update commit index", logFields(s, "new_commit_index", commitIndex)...)
-	if commitIndex < s.commitIndex() {
-		return
+func (s *Server) handleLogOp(t logStoreOp) {
+	switch op := t.(type) {
+	case *logStoreAppendOp:
+		if s.opts().groupCommitMaxBatch > 1 {
+			s.groupAppendLogs(op)
+			return
+		}
+		op.setResult(s.appendLogs(op.Task(), op.terms, op.responses))
+	case *logStoreTrimOp:
+		switch op.Type {
+		case logStoreTrimPrefix:
+			op.setResult(nil, s.logStore.TrimPrefix(op.Task()))
+		case logStoreTrimSuffix:
+			op.setResult(nil, s.logStore.TrimSuffix(op.Task()))
+		default:
+			s.logger.Warnw("unknown type in logStoreTrimOp", logFields(s)...)
+			return
+		}
+		s.setFirstLogIndex(Must2(s.logStore.FirstIndex()))
+		s.setLastLogIndex(Must2(s.logStore.LastIndex()))
+	case *logStoreConfigurationOp:
+		op.setResult(s.confStore.appendUpdate(op.Task()))
+	default:
+		s.logger.Warnw("unknown logStoreOp", logFields(s)...)
 	}
+}
+
+// groupCommitMaxLatencyLimit bounds the max latency of group commit, for
+// which the main loop is blocked while the batch is collected.
+const groupCommitMaxLatencyLimit = 10 * time.Millisecond
+
+// groupAppendLogs collects the pending logStoreAppendOps following op and
+// appends their logs with a single write to the LogStore. It stops collecting
+// when the batch is full, the max latency is reached, or a logStoreOp other
+// than logStoreAppendOp is received, which is handled after the batch. The
+// main loop is blocked while the batch is collected, for at most the max
+// latency, which is bounded by groupCommitMaxLatencyLimit.
+func (s *Server) groupAppendLogs(op *logStoreAppendOp) {
+	ops := []*logStoreAppendOp{op}
+	var next logStoreOp
+
+	var timeoutCh <-chan time.Time
+	if s.opts().groupCommitMaxLatency > 0 {
+		timer := time.NewTimer(s.opts().groupCommitMaxLatency)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+COLLECT:
+	for len(ops) < s.opts().groupCommitMaxBatch {
+		var t logStoreOp
+		if timeoutCh == nil {
+			select {
+			case t = <-s.logOpsCh:
+			default:
+				break COLLECT
+			}
+		} else {
+			select {
+			case t = <-s.logOpsCh:
+			case <-timeoutCh:
+				break COLLECT
+			}
+		}
+		appendOp, ok := t.(*logStoreAppendOp)
+		if !ok {
+			next = t
+			break
+		}
+		ops = append(ops, appendOp)
+	}
+
+	var bodies []*pb.LogBody
+	var terms []uint64
+	var responses []Future[interface{}]
+	for _, op := range ops {
+		bodies = append(bodies, op.Task()...)
+		if op.terms != nil {
+			terms = append(terms, op.terms...)
+		} else {
+			terms = append(terms, make([]uint64, len(op.Task()))...)
+		}
+		if op.responses != nil {
+			responses = append(responses, op.responses...)
+		} else {
+			responses = append(responses, make([]Future[interface{}], len(op.Task()))...)
+		}
+	}
+	logMeta, err := s.appendLogs(bodies, terms, responses)
+	for _, op := range ops {
+		if err != nil {
+			op.setResult(nil, err)
+			continue
+		}
+		n := len(op.Task())
+		op.setResult(logMeta[:n], nil)
+		logMeta = logMeta[n:]
+	}
+
+	if next != nil {
+		s.handleLogOp(next)
+	}
+}
+
+// coalesceCommitIndex drains the pending updates on the commit index, and
+// returns the greatest of them and commitIndex, so that the updates received
+// in a burst are committed in one pass.
+func (s *Server) coalesceCommitIndex(commitIndex uint64) uint64 {
+	for {
+		select {
+		case i := <-s.commitCh:
+			if i > commitIndex {
+				commitIndex = i
+			}
+		default:
+			return commitIndex
+		}
+	}
+}
+
+// commit updates the commit index, commits the configuration logs up to it,
+// and notifies the apply loop to apply the logs. The logs are applied outside
+// the main loop, so that a slow StateMachine doesn't block the heartbeats and
+// RPCs. Should only be called in the main loop.
+func (s *Server) commit(commitIndex uint64) {
+	s.logger.Infow("ready to update commit index", logFields(s, "new_commit_index", commitIndex)...)
 	if commitIndex > s.lastLogIndex() {
 		// Commit index should never overflow the log index.
 		commitIndex = s.lastLogIndex()
 	}
-	lastApplied := s.lastApplied()
-	if lastApplied.Index == commitIndex {
-		s.logger.Debugw("lastAppliedIndex == commitIndex, there's nothing to apply", logFields(s)...)
+	prevCommitIndex := s.commitIndex()
+	if commitIndex <= prevCommitIndex {
 		return
 	}
-	if lastApplied.Index > commitIndex {
-		s.logger.Panicw("confusing condition: lastAppliedIndex > commitIndex", logFields(s)...)
+	if atomic.LoadUint32(&s.flagApplyHalted) == 1 {
+		return
 	}
 	s.setCommitIndex(commitIndex)
-	firstIndex := lastApplied.Index + 1
-	s.logger.Infow("ready to apply logs", logFields(s, "first_index", firstIndex, "last_index", commitIndex)...)
-	var commitTerm uint64
-	var lastConfigurationLog *pb.Log
-	for i := firstIndex; i <= commitIndex; i++ {
-		if s.logStore.withinSnapshot(i) {
-			// Skip the log entry if its index is compacted by the snapshot.
-			commitTerm = s.logStore.snapshotMeta.Term()
-			continue
-		}
-		log := Must2(s.logStore.Entry(i))
-		if log == nil {
+	s.uncommitted.commit(commitIndex)
+	s.commitConfigurations(prevCommitIndex, commitIndex)
+	select {
+	case s.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// commitConfigurations records the configuration logs committed after the
+// commit index moves from prevCommitIndex to commitIndex, and commits the last
+// of them. Should only be called in the main loop.
+func (s *Server) commitConfigurations(prevCommitIndex, commitIndex uint64) {
+	latest, committed := s.confStore.Latest(), s.confStore.Committed()
+	if latest.LogIndex() <= committed.LogIndex() || latest.LogIndex() <= prevCommitIndex {
+		// No configuration logs are yet to be committed.
+		return
+	}
+	first, last := prevCommitIndex+1, commitIndex
+	if first <= committed.LogIndex() {
+		first = committed.LogIndex() + 1
+	}
+	if s.logStore.withinSnapshot(first) {
+		first = s.logStore.snapshot().Index() + 1
+	}
+	if last > latest.LogIndex() {
+		last = latest.LogIndex()
+	}
+	var lastConfiguration *configuration
+	it := s.logStore.Iterator()
+	defer it.Close()
+	it.Seek(first)
+	for i := first; i <= last; i++ {
+		log := Must2(it.Next())
+		if log == nil || log.Meta.Index != i {
 			// We've found one or more gaps in the logs
 			s.logger.Panicw("one or more log gaps are detected", logFields(s, "missing_index", i)...)
 		}
-		if i == commitIndex {
-			commitTerm = log.Meta.Term
-		}
-		switch log.Body.Type {
-		case pb.LogType_COMMAND:
-			s.stateMachine.Apply(log.Body.Data)
-		case pb.LogType_CONFIGURATION:
-			lastConfigurationLog = log
+		if log.Body.Type != pb.LogType_CONFIGURATION {
+			continue
 		}
-	}
-	if log := lastConfigurationLog; log != nil {
 		var pbConfiguration pb.Configuration
 		proto.Unmarshal(log.Body.Data, &pbConfiguration)
-		s.confStore.SetCommitted(newConfiguration(&pbConfiguration, log.Meta.Index))
-		s.commitConfiguration(log.Meta.Index)
+		lastConfiguration = newConfiguration(&pbConfiguration, log.Meta.Index)
+		s.confStore.record(ConfigurationRecord{
+			Index: log.Meta.Index, Term: log.Meta.Term, Configuration: &pbConfiguration,
+		})
+	}
+	if c := lastConfiguration; c != nil {
+		s.confStore.SetCommitted(c)
+		s.commitConfiguration(c.LogIndex())
+	}
+}
+
+// runApplyLoop applies the committed logs to the state machine and takes the
+// snapshots of the state machine until the server shuts down.
+func (s *Server) runApplyLoop() {
+	for {
+		select {
+		case <-s.applyCh:
+			s.applyCommitted()
+		case t := <-s.stateMachineSnapshotCh:
+			s.fsmMu.Lock()
+			t.setResult(s.stateMachine.Snapshot())
+			s.fsmMu.Unlock()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// applyCommitted applies the logs after the last applied log up to the commit
+// index to the state machine.
+func (s *Server) applyCommitted() {
+	s.fsmMu.Lock()
+	defer s.fsmMu.Unlock()
+	if atomic.LoadUint32(&s.flagApplyHalted) == 1 {
+		return
+	}
+	commitIndex := s.commitIndex()
+	lastApplied := s.lastApplied()
+	if lastApplied.Index >= commitIndex {
+		s.logger.Debugw("lastAppliedIndex >= commitIndex, there's nothing to apply", logFields(s)...)
+		return
+	}
+	firstIndex := lastApplied.Index + 1
+	s.logger.Infow("ready to apply logs", logFields(s, "first_index", firstIndex, "last_index", commitIndex)...)
+	commitTerm := lastApplied.Term
+	applyIndex := firstIndex
+	if s.logStore.withinSnapshot(applyIndex) {
+		// Skip the log entries whose indexes are compacted by the snapshot.
+		snapshotMeta := s.logStore.snapshot()
+		commitTerm = snapshotMeta.Term()
+		applyIndex = snapshotMeta.Index() + 1
+		s.applyResponses.failUpTo(snapshotMeta.Index(), ErrLogsCompacted)
+	}
+	if applyIndex <= commitIndex {
+		it := s.logStore.Iterator()
+		defer it.Close()
+		it.Seek(applyIndex)
+		for i := applyIndex; i <= commitIndex; i++ {
+			log := Must2(it.Next())
+			if log == nil || log.Meta.Index != i {
+				// We've found one or more gaps in the logs
+				s.logger.Panicw("one or more log gaps are detected", logFields(s, "missing_index", i)...)
+			}
+			s.applyResponses.traceStage(log.Meta, "raft.Apply.fsm")
+			start := time.Now()
+			response, err := s.stateMachine.Apply(log)
+			d := time.Since(start)
+			s.recordMetric(MetricApplyLatency, d)
+			s.warnSlowOp("apply", s.opts().slowOpThresholds.Apply, d, zap.Object("log", log.Meta))
+			if err != nil && !s.handleApplyError(log, err) {
+				commitIndex = i - 1
+				break
+			}
+			commitTerm = log.Meta.Term
+			s.applyResponses.resolve(log.Meta, response, err)
+		}
 	}
 	s.setLastApplied(commitIndex, commitTerm)
 	s.logger.Infow("logs has been applied", logFields(s, "first_index", firstIndex, "last_index", commitIndex)...)
 }
 
+// handleApplyError handles the error returned by StateMachine.Apply with the
+// ApplyErrorPolicy if it's transient, and reports whether the logs after it
+// can be applied.
+func (s *Server) handleApplyError(log *pb.Log, err error) bool {
+	if !IsTransientApplyError(err) {
+		return true
+	}
+	fields := logFields(s, zap.Object("log", log.Meta), zap.Error(err))
+	switch s.opts().applyErrorPolicy {
+	case ApplyErrorUnhealthy:
+		s.logger.Errorw("transient error applying the log, the server is marked unhealthy", fields...)
+		atomic.StoreUint32(&s.flagApplyUnhealthy, 1)
+	case ApplyErrorHalt:
+		s.logger.Errorw("transient error applying the log, halting the server", fields...)
+		atomic.StoreUint32(&s.flagApplyHalted, 1)
+		select {
+		case s.shutdownCh <- err:
+		default:
+		}
+		return false
+	default:
+		s.logger.Warnw("transient error applying the log", fields...)
+	}
+	return true
+}
+
 // commitConfiguration is used when a configuration log has been committed.
 // Unsafe for concurrent use.
 func (s *Server) commitConfiguration(index uint64) {
@@ -374,27 +794,121 @@ func (s *Server) commitConfiguration(index uint64) {
 }
 
 func (s *Server) handleRPC(rpc *RPC) {
+	var span Span
+	ctx := rpc.Context()
+	respond := func(response interface{}, err error) {
+		span.SetAttribute("raft.request_id", rpc.requestID)
+		span.End(err)
+		rpc.Respond(response, err)
+	}
 	switch request := rpc.Request().(type) {
 	case *pb.AppendEntriesRequest:
-		rpc.Respond(s.rpcHandler.AppendEntries(rpc.Context(), rpc.requestID, request))
+		ctx, span = s.traceIncoming(ctx, "raft.AppendEntries")
+		respond(s.rpcHandler.AppendEntries(ctx, rpc.requestID, request))
 	case *pb.RequestVoteRequest:
-		rpc.Respond(s.rpcHandler.RequestVote(rpc.Context(), rpc.requestID, request))
-	case *InstallSnapshotRequest:
-		rpc.Respond(s.rpcHandler.InstallSnapshot(rpc.Context(), rpc.requestID, request))
-		if _, err := rpc.Response(); err != nil {
-			panic(err)
+		ctx, span = s.traceIncoming(ctx, "raft.RequestVote")
+		response, err := s.rpcHandler.RequestVote(ctx, rpc.requestID, request)
+		if err == nil {
+			s.publishEvent(EventRequestVoteReceived, RequestVoteObservation{
+				CandidateID: request.CandidateId, Term: request.Term, Granted: response.Granted,
+			})
 		}
+		respond(response, err)
+	case *InstallSnapshotRequest:
+		ctx, span = s.traceIncoming(ctx, "raft.InstallSnapshot")
+		respond(s.rpcHandler.InstallSnapshot(ctx, rpc.requestID, request))
 	case *pb.ApplyLogRequest:
-		rpc.Respond(s.rpcHandler.ApplyLog(rpc.Context(), rpc.requestID, request))
+		ctx, span = s.traceIncoming(ctx, "raft.ApplyLog")
+		respond(s.rpcHandler.ApplyLog(ctx, rpc.requestID, request))
+	case *pb.MembershipChangeRequest:
+		ctx, span = s.traceIncoming(ctx, "raft.ChangeMembership")
+		respond(s.rpcHandler.ChangeMembership(ctx, rpc.requestID, request))
+	case *pb.TimeoutNowRequest:
+		ctx, span = s.traceIncoming(ctx, "raft.TimeoutNow")
+		respond(s.rpcHandler.TimeoutNow(ctx, rpc.requestID, request))
 	default:
 		s.logger.Warnw("incoming RPC is unrecognized", logFields(s, "request", rpc.Request)...)
 	}
 }
 
 func (s *Server) handleTerminal() {
-	sig := <-terminalSignalCh()
-	s.shutdownCh <- nil
-	s.logger.Infow("terminal signal captured", logFields(s, "signal", sig)...)
+	select {
+	case sig := <-terminalSignalCh():
+		s.shutdownCh <- nil
+		s.logger.Infow("terminal signal captured", logFields(s, "signal", sig)...)
+	case <-s.stopCh:
+	}
+}
+
+// goFunc runs fn in a goroutine tracked by routines.
+func (s *Server) goFunc(fn func()) {
+	s.routines.Add(1)
+	go func() {
+		defer s.routines.Done()
+		fn()
+	}()
+}
+
+// enqueueLogOp sends the logStoreOp to the main loop. ErrServerShutdown is
+// returned once the server is shutting down, so that every logStoreOp is
+// either handled by the main loop or failed by failPendingRequests.
+func (s *Server) enqueueLogOp(ctx context.Context, op logStoreOp) error {
+	s.logOpsMu.RLock()
+	defer s.logOpsMu.RUnlock()
+	if s.logOpsClosed {
+		return ErrServerShutdown
+	}
+	select {
+	case s.logOpsCh <- op:
+		return nil
+	case <-ctx.Done():
+		return ErrDeadlineExceeded
+	}
+}
+
+func failLogOp(t logStoreOp, err error) {
+	switch op := t.(type) {
+	case *logStoreAppendOp:
+		op.setResult(nil, err)
+	case *logStoreTrimOp:
+		op.setResult(nil, err)
+	case *logStoreConfigurationOp:
+		op.setResult(nil, err)
+	}
+}
+
+// failPendingRequests fails the requests sent to the main loop, which is no
+// longer running, with ErrServerShutdown until stopCh is closed.
+func (s *Server) failPendingRequests(stopCh <-chan struct{}) {
+	for {
+		select {
+		case rpc := <-s.trans.RPC():
+			rpc.Respond(nil, ErrServerShutdown)
+		case t := <-s.logOpsCh:
+			failLogOp(t, ErrServerShutdown)
+		case t := <-s.logRestoreCh:
+			t.setResult(nil, ErrServerShutdown)
+		case t := <-s.snapshotRestoreCh:
+			t.setResult(false, ErrServerShutdown)
+		case t := <-s.userRestoreCh:
+			t.setResult(nil, ErrServerShutdown)
+		case t := <-s.stateMachineSnapshotCh:
+			t.setResult(nil, ErrServerShutdown)
+		case <-s.commitCh:
+		case <-s.stagingCh:
+		case <-s.timeoutNowCh:
+		case <-stopCh:
+			// No more logStoreOps are enqueued after logOpsClosed is set.
+			for {
+				select {
+				case t := <-s.logOpsCh:
+					failLogOp(t, ErrServerShutdown)
+				default:
+					return
+				}
+			}
+		}
+	}
 }
 
 func (s *Server) internalShutdown(err error) {
@@ -402,6 +916,22 @@ func (s *Server) internalShutdown(err error) {
 		return
 	}
 	s.logger.Infow("ready to shutdown", logFields(s, zap.Error(err))...)
+	close(s.stopCh)
+	s.applyResponses.fail(ErrServerShutdown)
+	// Wake the applies blocked by the backpressure.
+	s.uncommitted.reset()
+
+	drainStopCh, drainDoneCh := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(drainDoneCh)
+		s.failPendingRequests(drainStopCh)
+	}()
+	// The requests blocked on the full channels are released by
+	// failPendingRequests before logOpsMu is acquired.
+	s.logOpsMu.Lock()
+	s.logOpsClosed = true
+	s.logOpsMu.Unlock()
+
 	if err := s.apiServer.Stop(); err != nil {
 		s.logger.Warnw("error occurred stopping the API server", logFields(s, zap.Error(err))...)
 	}
@@ -413,13 +943,21 @@ func (s *Server) internalShutdown(err error) {
 		}
 	}
 	_ = s.logger.Sync()
+	go func() {
+		s.routines.Wait()
+		close(drainStopCh)
+		<-drainDoneCh
+		close(s.closedCh)
+	}()
 	// Send err (if any) to the serve error channel
 	s.serveErrCh <- err
 }
 
-func (s *Server) randomTimer(timeout time.Duration) *time.Timer {
-	randomOffset := rand.Int63n(int64(s.opts.maxTimerRandomOffsetRatio*float64(timeout)) + 1)
-	return time.NewTimer(timeout + time.Duration(randomOffset))
+// randomTimer returns a Timer of the timeout plus a random offset of up to
+// maxTimerRandomOffsetRatio of the timeout.
+func (s *Server) randomTimer(timeout time.Duration) Timer {
+	randomOffset := s.rand.Int63n(int64(s.opts().maxTimerRandomOffsetRatio*float64(timeout)) + 1)
+	return s.opts().clock.NewTimer(timeout + time.Duration(randomOffset))
 }
 
 func (s *Server) reselectLoop() {
@@ -460,43 +998,61 @@ func (s *Server) runLoopLeader() {
 	s.replScheduler.Start(stepdownCh)
 	defer s.replScheduler.Stop()
 
+	// The leader loop is also re-entered within the term, e.g., when the
+	// configuration changes.
+	if s.promote() {
+		s.resumeTransition()
+	}
+	defer s.leaveLeaderLoop()
+
+	// The dead servers are checked for at the follower timeout, within which
+	// the servers are considered active.
+	var deadServerCh <-chan time.Time
+	if s.opts().deadServerPolicy.Threshold > 0 {
+		ticker := s.opts().clock.NewTicker(s.opts().followerTimeout)
+		defer ticker.Stop()
+		deadServerCh = ticker.C()
+	}
+
 	for s.role() == Leader {
 		select {
 		case commitIndex := <-s.commitCh:
-			s.commitAndApply(commitIndex)
+			s.commit(s.coalesceCommitIndex(commitIndex))
 		case t := <-s.logOpsCh:
-			switch op := t.(type) {
-			case *logStoreAppendOp:
-				op.setResult(s.appendLogs(op.Task()))
-			case *logStoreTrimOp:
-				switch op.Type {
-				case logStoreTrimPrefix:
-					op.setResult(nil, s.logStore.TrimPrefix(op.Task()))
-				case logStoreTrimSuffix:
-					op.setResult(nil, s.logStore.TrimSuffix(op.Task()))
-				default:
-					s.logger.Warnw("unknown type in logStoreTrimOp", logFields(s)...)
-				}
-			default:
-				s.logger.Warnw("unknown logStoreOp", logFields(s)...)
-			}
+			s.handleLogOp(t)
 		case t := <-s.logRestoreCh:
-			t.setResult(nil, s.logStore.Restore(t.Task()))
+			t.setResult(nil, s.logStore.SetSnapshot(t.Task()))
 		case rpc := <-s.trans.RPC():
-			go s.handleRPC(rpc)
+			s.goFunc(func() { s.handleRPC(rpc) })
 		case err := <-s.shutdownCh:
 			s.internalShutdown(err)
 			return
-		case t := <-s.stateMachineSnapshotCh:
-			t.setResult(s.stateMachine.Snapshot())
+		case <-s.stagingCh:
+			s.promoteStaging()
+		case <-deadServerCh:
+			s.removeDeadServers()
 		case term := <-stepdownCh:
-			// We'll update the leader in other loops
-			s.stepdownFollower(pb.NilPeer)
-			s.alterTerm(term)
+			// We'll update the leader in other loops. The RPC handlers may
+			// have stepped down already, e.g., upon a vote request from the
+			// target of a leadership transfer.
+			if s.role() != Follower {
+				s.stepdownFollower(pb.NilPeer)
+			}
+			if term > s.currentTerm() {
+				s.alterTerm(term)
+			}
 			return
 		case t := <-s.snapshotRestoreCh:
 			s.replScheduler.Stop()
-			t.setResult(s.snapshotService.Restore(t.Task()))
+			ok, err := s.snapshotService.Restore(t.Task())
+			if !ok {
+				// The replications are restarted unless the restoration
+				// altered the configuration, which reselects the loop.
+				s.reselectLoop()
+			}
+			t.setResult(ok, err)
+		case t := <-s.userRestoreCh:
+			t.setResult(s.snapshotService.RestoreUserSnapshot(t.Task()))
 		}
 		if s.shouldReselectLoop() {
 			return
@@ -504,28 +1060,90 @@ func (s *Server) runLoopLeader() {
 	}
 }
 
+// promote is called when the leader loop is entered. The state machine is
+// notified once per term. It reports whether the leadership is newly acquired.
+func (s *Server) promote() bool {
+	term := s.currentTerm()
+	if s.leadershipTerm == term {
+		return false
+	}
+	s.leadershipTerm = term
+	// Only the logs appended in the term are tracked.
+	s.uncommitted.reset()
+	s.audit(context.Background(), AuditLeadershipAcquired, nil)
+	if m, ok := s.stateMachine.StateMachine.(LeadershipStateMachine); ok {
+		m.OnPromote(term)
+	}
+	return true
+}
+
+// resumeTransition completes the configuration transition left by the previous
+// leader. A committed joint configuration is committed to its next
+// configuration right away. An uncommitted one is committed by a NOOP log of
+// the term, as the logs of the previous terms are not committed on their own,
+// and the transition is then committed in commitConfiguration.
+func (s *Server) resumeTransition() {
+	latest := s.confStore.Latest()
+	if !latest.Joint() {
+		return
+	}
+	if s.confStore.Committed().LogIndex() == latest.LogIndex() {
+		Must1(s.confStore.commitTransition())
+		return
+	}
+	if _, err := s.appendLogs([]*pb.LogBody{{Type: pb.LogType_NOOP}}, nil, nil); err != nil {
+		s.logger.Warnw("error occurred appending the log to resume the transition", logFields(s, zap.Error(err))...)
+	}
+}
+
+// leaveLeaderLoop demotes the server when the leader loop is left if it is no
+// longer the leader of the term it was promoted in, or is shutting down.
+func (s *Server) leaveLeaderLoop() {
+	if s.role() == Leader && s.currentTerm() == s.leadershipTerm && !s.shutdownState() {
+		return
+	}
+	s.leadershipTerm = 0
+	// Wake the applies blocked by the backpressure.
+	s.uncommitted.reset()
+	s.audit(context.Background(), AuditLeadershipLost, nil)
+	// The logs yet to be applied may be replaced by the next leader.
+	s.applyResponses.fail(ErrLeadershipLost)
+	if m, ok := s.stateMachine.StateMachine.(LeadershipStateMachine); ok {
+		m.OnDemote()
+	}
+}
+
 func (s *Server) runLoopCandidate() {
 	s.logger.Infow("run candidate loop", logFields(s)...)
 
 	c := s.confStore.Latest()
 
-	if _, ok := c.Peer(s.id); !ok {
-		// We're not in the latest configuration.
+	if !c.Voter(s.id) {
+		// We're not a voter in the latest configuration.
 		// 1) A newly joined server is catching up with the leader.
 		// 2) The server is removed from the cluster.
-		s.logger.Infow("stay as a follower since current configuration does not include ourself",
+		// 3) The server is a non-voter.
+		s.logger.Infow("stay as a follower since current configuration does not include ourself as a voter",
 			logFields(s)...)
 		s.alterRole(Follower)
 		s.reselectLoop()
 		return
 	}
 
-	electionTimer := s.randomTimer(s.opts.electionTimeout)
+	electionTimer := s.randomTimer(s.opts().electionTimeout)
 	voteResCh, voteCancel, err := s.startElection()
 	defer voteCancel()
 	if err != nil {
 		s.logger.Panicw("error occurred starting the election", logFields(s, zap.Error(err))...)
 	}
+	electionTerm := s.currentTerm()
+	defer func() {
+		if s.role() == Leader {
+			s.publishEvent(EventElectionWon, electionTerm)
+		} else {
+			s.publishEvent(EventElectionLost, electionTerm)
+		}
+	}()
 
 	currentVotes := 0
 	nextVotes := 0
@@ -539,6 +1157,9 @@ func (s *Server) runLoopCandidate() {
 				s.alterTerm(response.Term)
 				return
 			}
+			if !response.Granted {
+				continue
+			}
 			if c.CurrentConfig().Contains(response.ServerId) {
 				currentVotes++
 			}
@@ -564,22 +1185,24 @@ func (s *Server) runLoopCandidate() {
 					return
 				}
 			}
-		case <-electionTimer.C:
+		case <-electionTimer.C():
 			s.logger.Infow("timed out in Candidate loop", logFields(s)...)
 			voteCancel()
 			return
 		case commitIndex := <-s.commitCh:
-			s.commitAndApply(commitIndex)
+			s.commit(s.coalesceCommitIndex(commitIndex))
 		case t := <-s.logRestoreCh:
-			t.setResult(nil, s.logStore.Restore(t.Task()))
+			t.setResult(nil, s.logStore.SetSnapshot(t.Task()))
 		case rpc := <-s.trans.RPC():
-			go s.handleRPC(rpc)
+			s.goFunc(func() { s.handleRPC(rpc) })
 		case err := <-s.shutdownCh:
 			voteCancel()
 			s.internalShutdown(err)
 			return
 		case t := <-s.snapshotRestoreCh:
 			t.setResult(s.snapshotService.Restore(t.Task()))
+		case t := <-s.userRestoreCh:
+			t.setResult(nil, ErrNonLeader)
 		}
 		if s.shouldReselectLoop() {
 			return
@@ -589,47 +1212,38 @@ func (s *Server) runLoopCandidate() {
 
 func (s *Server) runLoopFollower() {
 	s.logger.Infow("run follower loop", logFields(s)...)
-	followerTimer := s.randomTimer(s.opts.followerTimeout)
+	followerTimer := s.randomTimer(s.opts().followerTimeout)
 
 	s.snapshotService.StartScheduler()
 	defer s.snapshotService.StopScheduler()
 
 	for s.role() == Follower {
 		select {
-		case <-followerTimer.C:
+		case <-followerTimer.C():
 			s.logger.Infow("follower timed out", logFields(s)...)
 			s.alterRole(Candidate)
 			s.reselectLoop()
+		case <-s.timeoutNowCh:
+			s.logger.Infow("election requested by the leader", logFields(s)...)
+			atomic.StoreUint32(&s.flagTransferElection, 1)
+			s.alterRole(Candidate)
+			s.reselectLoop()
 		case commitIndex := <-s.commitCh:
-			s.commitAndApply(commitIndex)
+			s.commit(s.coalesceCommitIndex(commitIndex))
 		case t := <-s.logOpsCh:
-			switch op := t.(type) {
-			case *logStoreAppendOp:
-				op.setResult(s.appendLogs(op.Task()))
-			case *logStoreTrimOp:
-				switch op.Type {
-				case logStoreTrimPrefix:
-					op.setResult(nil, s.logStore.TrimPrefix(op.Task()))
-				case logStoreTrimSuffix:
-					op.setResult(nil, s.logStore.TrimSuffix(op.Task()))
-				default:
-					s.logger.Warnw("unknown type in logStoreTrimOp", logFields(s)...)
-				}
-			default:
-				s.logger.Warnw("unknown logStoreOp", logFields(s)...)
-			}
+			s.handleLogOp(t)
 		case t := <-s.logRestoreCh:
-			t.setResult(nil, s.logStore.Restore(t.Task()))
+			t.setResult(nil, s.logStore.SetSnapshot(t.Task()))
 		case rpc := <-s.trans.RPC():
-			followerTimer.Reset(s.opts.followerTimeout)
-			go s.handleRPC(rpc)
+			followerTimer.Reset(s.opts().followerTimeout)
+			s.goFunc(func() { s.handleRPC(rpc) })
 		case err := <-s.shutdownCh:
 			s.internalShutdown(err)
 			return
-		case t := <-s.stateMachineSnapshotCh:
-			t.setResult(s.stateMachine.Snapshot())
 		case t := <-s.snapshotRestoreCh:
 			t.setResult(s.snapshotService.Restore(t.Task()))
+		case t := <-s.userRestoreCh:
+			t.setResult(nil, ErrNonLeader)
 		}
 		if s.shouldReselectLoop() {
 			return
@@ -639,61 +1253,78 @@ func (s *Server) runLoopFollower() {
 
 func (s *Server) serveAPIServer() {
 	rand.Seed(time.Now().UnixNano())
-	bindAddress := s.opts.apiServerListenAddress
+	bindAddress := s.opts().apiServerListenAddress
 	if bindAddress == "" {
 		bindAddress = fmt.Sprintf("0.0.0.0:%d", 20000+rand.Intn(25001))
 	}
 	listener, err := net.Listen("tcp", bindAddress)
 	if err != nil {
 		s.logger.Warn(err)
+		return
 	}
 	if err := s.apiServer.Serve(listener); err != nil && err != http.ErrServerClosed {
 		s.logger.Warn(err)
 	}
 }
 
+// APIHandler returns the http.Handler of the API server, which serves the HTTP
+// API and the gRPC services, for the host application to mount on its own
+// HTTP stack, e.g., when the API server is disabled with
+// APIServerEnabledOption. The routes are absolute, e.g., /api/v1/status, and
+// gRPC requests are only served over HTTP/2.
+func (s *Server) APIHandler() http.Handler {
+	return s.apiServer.httpServer.Handler
+}
+
+// RegisterAPIServices registers the gRPC services of the API server, i.e.,
+// the APIService, the health service, and those of the APIGRPCExtensions, on
+// the gRPC server of the host application. The requests are not checked by
+// the APIAuthenticator, which only guards the handlers of the API server.
+func (s *Server) RegisterAPIServices(registrar grpc.ServiceRegistrar) error {
+	return s.apiServer.registerServices(registrar)
+}
+
 func (s *Server) startElection() (<-chan *pb.RequestVoteResponse, context.CancelFunc, error) {
 	s.logger.Infow("ready to start the election", logFields(s)...)
+	s.serverState.voteMu.Lock()
 	s.alterTerm(s.currentTerm() + 1)
 	s.setLastVoteSummary(s.currentTerm(), s.id)
+	s.serverState.voteMu.Unlock()
 	s.logger.Infow("election started", logFields(s)...)
+	s.publishEvent(EventElectionStarted, s.currentTerm())
+	s.recordMetric(MetricElections, 1)
 
 	voteCtx, voteCancel := context.WithCancel(context.Background())
 
 	c := s.confStore.Latest()
 	resCh := make(chan *pb.RequestVoteResponse, len(c.Peers()))
 
-	var lastIndex uint64
-	var lastTerm uint64
-
-	log, err := s.logStore.LastEntry(0)
+	lastTerm, lastIndex, err := s.logStore.LastTermIndex()
 	if err != nil {
 		voteCancel()
 		return nil, nil, err
 	}
-	if log != nil {
-		lastIndex = log.Meta.Index
-		lastTerm = log.Meta.Term
-	}
 
 	request := &pb.RequestVoteRequest{
-		Term:         s.currentTerm(),
-		CandidateId:  s.id,
-		LastLogIndex: lastIndex,
-		LastLogTerm:  lastTerm,
+		Term:               s.currentTerm(),
+		CandidateId:        s.id,
+		LastLogIndex:       lastIndex,
+		LastLogTerm:        lastTerm,
+		LeadershipTransfer: atomic.SwapUint32(&s.flagTransferElection, 0) != 0,
 	}
 
+	requestVoteCtx, requestID := ensureRequestID(voteCtx)
 	requestVote := func(peer *pb.Peer) {
-		if response, err := s.trans.RequestVote(voteCtx, peer, request); err != nil {
-			s.logger.Debugw("error requesting vote", logFields(s, "error", err)...)
+		if response, err := s.trans.RequestVote(requestVoteCtx, peer, request); err != nil {
+			s.logger.Debugw("error requesting vote", logFields(s, "error", err, "request_id", requestID)...)
 		} else {
 			resCh <- response
 		}
 	}
 
 	for _, peer := range c.Peers() {
-		// Do not ask ourself to vote
-		if peer.Id == s.id {
+		// Do not ask ourself or the non-voters to vote
+		if peer.Id == s.id || !c.Voter(peer.Id) {
 			continue
 		}
 		go requestVote(peer)
@@ -705,52 +1336,188 @@ func (s *Server) startElection() (<-chan *pb.RequestVoteResponse, context.Cancel
 }
 
 func (s *Server) startMetrics(exporter MetricsExporter) {
+	ticker := time.NewTicker(metricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.recordGauges()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// NoLeaderError is returned when a request cannot be redirected to the leader
+// since the leader is unknown.
+type NoLeaderError struct {
+	// LastLeader is the last known leader, or NilPeer if no leader has been
+	// known. It may still be the leader after the election.
+	LastLeader *pb.Peer
+	// RetryAfter is the suggested delay before retrying the request.
+	RetryAfter time.Duration
+}
+
+func (e *NoLeaderError) Error() string {
+	if e.LastLeader.Id == "" {
+		return fmt.Sprintf("no known leader, retry after %v", e.RetryAfter)
+	}
+	return fmt.Sprintf("no known leader (last known leader %s), retry after %v", e.LastLeader.Id, e.RetryAfter)
+}
 
+func (e *NoLeaderError) Unwrap() error {
+	return ErrNoLeader
 }
 
-// Apply.
-// Future(LogMeta, error)
-func (s *Server) Apply(ctx context.Context, body *pb.LogBody) FutureTask[*pb.LogMeta, *pb.LogBody] {
-	t := newFutureTask[*pb.LogMeta](body.Copy())
+// ApplyFuture is the future of a log applied with Server.Apply. Result returns
+// the metadata of the log once it is appended by the leader, and Response
+// returns the result of StateMachine.Apply once the log is applied. Response
+// fails if Result does.
+type ApplyFuture interface {
+	FutureTask[*pb.LogMeta, *pb.LogBody]
+	Response() (interface{}, error)
+}
+
+type applyFuture struct {
+	FutureTask[*pb.LogMeta, *pb.LogBody]
+	response Future[interface{}]
+}
+
+func newApplyFuture(body *pb.LogBody) *applyFuture {
+	return &applyFuture{FutureTask: newFutureTask[*pb.LogMeta](body), response: newFuture[interface{}]()}
+}
+
+func (f *applyFuture) Response() (interface{}, error) {
+	return f.response.Result()
+}
+
+func (f *applyFuture) fail(err error) {
+	f.setResult(nil, err)
+	f.response.setResult(nil, err)
+}
+
+// Apply appends the log on the leader, or redirects it to the leader on the
+// other servers. On the servers the log is redirected through, Response
+// returns the result of StateMachine.Apply as []byte if it can be carried.
+func (s *Server) Apply(ctx context.Context, body *pb.LogBody) ApplyFuture {
+	// The body is copied once, and shared by the future and the log.
+	body = body.Copy()
+	t := newApplyFuture(body)
+	s.applyMu.RLock()
+	if s.closing || s.shutdownState() {
+		s.applyMu.RUnlock()
+		t.fail(ErrServerShutdown)
+		return t
+	}
+	s.applyWg.Add(1)
+	s.applyMu.RUnlock()
+
 	if s.role() == Leader {
 		// Leader path
-		internalTask := newFutureTask[[]*pb.LogMeta]([]*pb.LogBody{body.Copy()})
-		appendOp := &logStoreAppendOp{FutureTask: internalTask}
-		select {
-		case s.logOpsCh <- appendOp:
-		case <-ctx.Done():
-			internalTask.setResult(nil, ErrDeadlineExceeded)
+		if atomic.LoadUint32(&s.flagLeadershipTransfer) != 0 {
+			s.applyWg.Done()
+			t.fail(ErrLeadershipTransfer)
+			return t
 		}
-		if logMeta, err := internalTask.Result(); err != nil {
-			t.setResult(nil, err)
-		} else {
-			t.setResult(logMeta[0], nil)
+		if err := s.waitBackpressure(ctx); err != nil {
+			s.applyWg.Done()
+			t.fail(err)
+			return t
 		}
+		if s.opts().tracer != nil {
+			t.response = &tracedFuture{Future: t.response, trace: s.newApplyTrace(ctx)}
+		}
+		internalTask := newFutureTask[[]*pb.LogMeta]([]*pb.LogBody{body})
+		appendOp := &logStoreAppendOp{FutureTask: internalTask, responses: []Future[interface{}]{t.response}}
+		if err := s.enqueueLogOp(ctx, appendOp); err != nil {
+			s.applyWg.Done()
+			t.fail(err)
+			return t
+		}
+		// Apply returns once the log is enqueued so that the logs applied by
+		// successive calls are appended in the order of the calls.
+		go func() {
+			defer s.applyWg.Done()
+			if logMeta, err := internalTask.Result(); err != nil {
+				t.fail(err)
+			} else {
+				t.setResult(logMeta[0], nil)
+			}
+		}()
 		return t
 	}
 
 	// Proxy path
+	ctx, requestID := ensureRequestID(ctx)
 	go func() {
+		defer s.applyWg.Done()
 		// Redirect requests to the leader on non-leader servers.
-		response, err := s.trans.ApplyLog(ctx, s.Leader(), &pb.ApplyLogRequest{Body: body.Copy()})
-		if err != nil {
-			t.setResult(nil, err)
+		var response *pb.ApplyLogResponse
+		if err := retry(ctx, s.opts().retryPolicy, func() (bool, error) {
+			if s.shutdownState() {
+				return false, ErrServerShutdown
+			}
+			leader := s.Leader()
+			if leader.Id == "" {
+				// The leader is unknown for now and may be elected later.
+				return true, s.noLeaderError()
+			}
+			r, err := s.trans.ApplyLog(s.traceOutgoing(ctx), leader, &pb.ApplyLogRequest{Body: body})
+			if err != nil {
+				s.logger.Debugw("error redirecting the log to the leader",
+					logFields(s, zap.Error(err), zap.Object("leader", leader), zap.String("request_id", requestID))...)
+				// The leader may have appended the log unless the request is
+				// known to be undelivered, and a retry would append it again.
+				return IsNotDeliveredError(err), err
+			}
+			response = r
+			return false, nil
+		}); err != nil {
+			t.fail(err)
+			return
 		}
-		// TODO: Crashes happen here sometimes.
 		switch r := response.Response.(type) {
 		case *pb.ApplyLogResponse_Meta:
 			t.setResult(r.Meta, nil)
+			if len(response.Result) > 0 {
+				t.response.setResult(response.Result, nil)
+			} else {
+				t.response.setResult(nil, nil)
+			}
 		case *pb.ApplyLogResponse_Error:
-			t.setResult(nil, errors.New(r.Error))
+			t.fail(errorFromMessage(r.Error))
+		default:
+			t.fail(errors.New("empty ApplyLogResponse"))
 		}
 	}()
 
 	return t
 }
 
-// ApplyCommand.
-// Future(LogMeta, error)
-func (s *Server) ApplyCommand(ctx context.Context, command Command) FutureTask[*pb.LogMeta, *pb.LogBody] {
+// applyLogResponse waits for the log to be applied and returns the
+// ApplyLogResponse carrying the metadata and the result of the log.
+func (s *Server) applyLogResponse(future ApplyFuture) *pb.ApplyLogResponse {
+	meta, err := future.Result()
+	if err != nil {
+		return &pb.ApplyLogResponse{Response: &pb.ApplyLogResponse_Error{Error: err.Error()}}
+	}
+	response, err := future.Response()
+	if err != nil {
+		return &pb.ApplyLogResponse{Response: &pb.ApplyLogResponse_Error{Error: err.Error()}}
+	}
+	result, err := encodeApplyResponse(response)
+	if err != nil {
+		s.logger.Warnw("error encoding the result of the log",
+			logFields(s, zap.Object("log", meta), zap.Error(err))...)
+	}
+	return &pb.ApplyLogResponse{
+		Response: &pb.ApplyLogResponse_Meta{Meta: &pb.LogMeta{Index: meta.Index, Term: meta.Term}},
+		Result:   result,
+	}
+}
+
+// ApplyCommand applies the command with Apply.
+func (s *Server) ApplyCommand(ctx context.Context, command Command) ApplyFuture {
 	return s.Apply(ctx, &pb.LogBody{
 		Type: pb.LogType_COMMAND,
 		Data: command,
@@ -783,20 +1550,317 @@ func (s *Server) Leader() *pb.Peer {
 	return pb.NilPeer
 }
 
+// Configuration returns a copy of the latest configuration, which may not be
+// committed yet. The configuration is in a transition if Next is set.
+func (s *Server) Configuration() *pb.Configuration {
+	return s.confStore.Latest().Configuration.Copy()
+}
+
+// ConfigurationHistory returns the configurations committed on the server in
+// the order they were committed, with which the changes to the membership of
+// the cluster can be reconstructed. The configurations compacted by a snapshot
+// before the server starts are not included except the one recorded in the
+// snapshot.
+func (s *Server) ConfigurationHistory() []ConfigurationRecord {
+	history := s.confStore.History()
+	for i := range history {
+		history[i].Configuration = history[i].Configuration.Copy()
+	}
+	return history
+}
+
 func (s *Server) setLeader(leader *pb.Peer) {
 	if leader == nil {
 		leader = pb.NilPeer
 	}
-	s.clusterLeader.Store(leader)
+	previous, _ := s.clusterLeader.Swap(leader).(*pb.Peer)
+	if previous == nil {
+		previous = pb.NilPeer
+	}
+	s.publishLeaderEvent(previous, leader)
+	if leader.Id != "" {
+		s.lastKnownLeader.Store(leader)
+	}
+}
+
+// noLeaderError returns a *NoLeaderError with the last known leader and the
+// time for an election to complete as the hint.
+func (s *Server) noLeaderError() *NoLeaderError {
+	lastLeader := pb.NilPeer
+	if v := s.lastKnownLeader.Load(); v != nil {
+		lastLeader = v.(*pb.Peer)
+	}
+	return &NoLeaderError{LastLeader: lastLeader, RetryAfter: s.opts().electionTimeout}
 }
 
-// Register is used to register a server to current cluster.
+// Register is used to register a server to current cluster. The server is
+// staged to receive the logs as a non-voter, and is promoted to the voting
+// configuration by the leader once it has caught up by the CatchUpPolicy.
+// It returns without waiting for the promotion, and the server stays staged
+// until it's promoted or removed.
 // ErrInJointConsensus is returned when the server is already in a joint consensus.
+// Should only be called on the leader. Use AddPeer to redirect the request to
+// the leader.
 func (s *Server) Register(peer *pb.Peer) error {
+	if _, err := s.nextConfig(&pb.MembershipChangeRequest{
+		Type: pb.MembershipChangeType_MEMBERSHIP_ADD_PEER,
+		Peer: peer,
+	}); err != nil {
+		return err
+	}
+	return s.confStore.stage(peer.Copy(), s.id)
+}
+
+// AddPeer adds the peer to the cluster. The peer is staged to receive the
+// logs as a non-voter first, and the configuration transition adding it is
+// initiated once it has caught up with the leader by the CatchUpPolicy. The
+// request is redirected to the leader on non-leader servers. ErrPeerExists is
+// returned if the peer is already in the configuration, ErrInJointConsensus is
+// returned if another transition is in progress, and ErrCatchUpTimeout is
+// returned if the peer does not catch up in time, in which case it's unstaged.
+// A peer with the suffrage SUFFRAGE_NON_VOTER is added as a non-voter without
+// catching up, as the commits do not wait for it.
+func (s *Server) AddPeer(ctx context.Context, peer *pb.Peer) error {
+	return s.changeMembership(ctx, &pb.MembershipChangeRequest{
+		Type: pb.MembershipChangeType_MEMBERSHIP_ADD_PEER,
+		Peer: peer.Copy(),
+	})
+}
+
+// RemovePeer removes the server with the ID from the cluster with a
+// configuration transition. The request is redirected to the leader on
+// non-leader servers. ErrUnknownPeer is returned if the server is not in the
+// configuration, and ErrInJointConsensus is returned if another transition is
+// in progress.
+func (s *Server) RemovePeer(ctx context.Context, id string) error {
+	return s.changeMembership(ctx, &pb.MembershipChangeRequest{
+		Type: pb.MembershipChangeType_MEMBERSHIP_REMOVE_PEER,
+		Peer: &pb.Peer{Id: id},
+	})
+}
+
+// PromotePeer promotes the non-voter with the ID to a voter with a
+// configuration transition. The request is redirected to the leader on
+// non-leader servers. ErrUnknownPeer is returned if the server is not in the
+// configuration, ErrPeerExists is returned if it's already a voter, and
+// ErrInJointConsensus is returned if another transition is in progress.
+func (s *Server) PromotePeer(ctx context.Context, id string) error {
+	return s.changeMembership(ctx, &pb.MembershipChangeRequest{
+		Type: pb.MembershipChangeType_MEMBERSHIP_PROMOTE_PEER,
+		Peer: &pb.Peer{Id: id},
+	})
+}
+
+// AbortTransition aborts the configuration transition in progress, and reverts
+// to the configuration before it, e.g., when the servers added never come up,
+// with which the transition cannot complete. Only the transitions whose joint
+// configurations are yet to be committed can be aborted. The request is
+// redirected to the leader on non-leader servers. ErrNotInJointConsensus is
+// returned if no transition is in progress, and ErrTransitionCommitted is
+// returned if the transition is to complete.
+func (s *Server) AbortTransition(ctx context.Context) error {
+	return s.changeMembership(ctx, &pb.MembershipChangeRequest{
+		Type: pb.MembershipChangeType_MEMBERSHIP_ABORT_TRANSITION,
+	})
+}
+
+// UpdatePeer replaces the endpoint and the metadata of the peer with the same
+// ID in the configuration, e.g., after the server is redeployed on another
+// host. No configuration transition is needed as the voters are not changed.
+// The request is redirected to the leader on non-leader servers.
+// ErrUnknownPeer is returned if the server is not in the configuration.
+func (s *Server) UpdatePeer(ctx context.Context, peer *pb.Peer) error {
+	return s.changeMembership(ctx, &pb.MembershipChangeRequest{
+		Type: pb.MembershipChangeType_MEMBERSHIP_UPDATE_PEER,
+		Peer: peer.Copy(),
+	})
+}
+
+// announceEndpoint updates the endpoint of the server in the configuration if
+// it differs from the one in use, and retries by the RetryPolicy until it
+// succeeds or the server shuts down.
+func (s *Server) announceEndpoint() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		peer, ok := s.selfPeer()
+		if !ok || peer.Endpoint == s.Endpoint() {
+			return
+		}
+		peer = peer.Copy()
+		peer.Endpoint = s.Endpoint()
+		err := s.requestPeerUpdate(ctx, peer)
+		if err == nil {
+			s.logger.Infow("the endpoint has been announced", logFields(s)...)
+			return
+		}
+		s.logger.Debugw("error announcing the endpoint", logFields(s, zap.Error(err), "attempt", attempt)...)
+		delay, _ := s.opts().retryPolicy.Backoff(attempt)
+		timer := s.opts().clock.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// requestPeerUpdate requests the leader to update the peer. As the server may
+// not learn the leader until its endpoint is updated, since the leader
+// replicates the logs to the endpoint in the configuration, the request is
+// sent to each voter in turn if the leader is unknown, and only the leader
+// accepts it.
+func (s *Server) requestPeerUpdate(ctx context.Context, peer *pb.Peer) error {
+	request := &pb.MembershipChangeRequest{
+		Type:      pb.MembershipChangeType_MEMBERSHIP_UPDATE_PEER,
+		Peer:      peer,
+		Initiator: s.id,
+	}
+	if s.role() == Leader {
+		return s.applyMembershipChange(ctx, request)
+	}
+	targets := s.confStore.Latest().Peers()
+	if leader := s.Leader(); leader.Id != "" {
+		targets = []*pb.Peer{leader}
+	}
+	var err error = s.noLeaderError()
+	for _, target := range targets {
+		if target.Id == s.id {
+			continue
+		}
+		var r *pb.MembershipChangeResponse
+		if r, err = s.trans.ChangeMembership(ctx, target, request); err != nil {
+			continue
+		}
+		if r.Error == "" {
+			return nil
+		}
+		if err = errorFromMessage(r.Error); !errors.Is(err, ErrNonLeader) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *Server) changeMembership(ctx context.Context, request *pb.MembershipChangeRequest) error {
+	s.audit(ctx, AuditMembershipChangeRequested, auditMembershipChange{
+		Type: request.Type.String(),
+		Peer: request.Peer,
+	})
+	request.Initiator = s.initiator(ctx)
+	if s.role() == Leader {
+		return s.applyMembershipChange(ctx, request)
+	}
+
+	// Redirect requests to the leader on non-leader servers.
+	ctx, requestID := ensureRequestID(ctx)
+	var response *pb.MembershipChangeResponse
+	if err := retry(ctx, s.opts().retryPolicy, func() (bool, error) {
+		leader := s.Leader()
+		if leader.Id == "" {
+			// The leader is unknown for now and may be elected later.
+			return true, s.noLeaderError()
+		}
+		r, err := s.trans.ChangeMembership(s.traceOutgoing(ctx), leader, request)
+		if err != nil {
+			s.logger.Debugw("error redirecting the membership change to the leader",
+				logFields(s, zap.Error(err), zap.Object("leader", leader), zap.String("request_id", requestID))...)
+			// The leader may have started the transition unless the request
+			// is known to be undelivered.
+			return IsNotDeliveredError(err), err
+		}
+		response = r
+		return false, nil
+	}); err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return errorFromMessage(response.Error)
+	}
+	return nil
+}
+
+// applyMembershipChange initiates the configuration transition requested. The
+// peer to add is staged until it's promoted by the leader, and the staging
+// peer to remove is unstaged without a transition.
+// Should only be called on the leader.
+func (s *Server) applyMembershipChange(ctx context.Context, request *pb.MembershipChangeRequest) error {
+	initiator := request.Initiator
+	if initiator == "" {
+		initiator = s.initiator(ctx)
+	}
+	if request.Type == pb.MembershipChangeType_MEMBERSHIP_ABORT_TRANSITION {
+		return s.confStore.abortTransition(initiator)
+	}
+	if request.Peer == nil {
+		return fmt.Errorf("no peer in the %v request", request.Type)
+	}
+	if request.Type == pb.MembershipChangeType_MEMBERSHIP_UPDATE_PEER {
+		return s.confStore.updatePeer(request.Peer, initiator)
+	}
+	if request.Type == pb.MembershipChangeType_MEMBERSHIP_REMOVE_PEER {
+		if _, ok := s.confStore.Latest().StagingPeer(request.Peer.Id); ok {
+			return s.confStore.unstage(request.Peer.Id, initiator)
+		}
+	}
+	next, err := s.nextConfig(request)
+	if err != nil {
+		return err
+	}
+	// The non-voters are added without catching up, as the commits don't
+	// wait for them.
+	if request.Type == pb.MembershipChangeType_MEMBERSHIP_ADD_PEER && request.Peer.Voter() {
+		return s.catchUp(ctx, request.Peer, initiator)
+	}
+	s.logger.Infow("membership change requested",
+		logFields(s, "type", request.Type.String(), zap.Object("peer", request.Peer))...)
+	return s.confStore.initiateTransition(newConfig(next), initiator)
+}
+
+// nextConfig returns the next configuration of the membership change
+// requested from the latest configuration.
+func (s *Server) nextConfig(request *pb.MembershipChangeRequest) (*pb.Config, error) {
 	latest := s.confStore.Latest()
+	if latest.Joint() {
+		return nil, ErrInJointConsensus
+	}
 	next := latest.Current.Copy()
-	next.Peers = append(next.Peers, peer)
-	return s.confStore.initiateTransition(newConfig(next))
+	_, exists := latest.Peer(request.Peer.Id)
+	switch request.Type {
+	case pb.MembershipChangeType_MEMBERSHIP_ADD_PEER:
+		if exists {
+			return nil, fmt.Errorf("%w: %s", ErrPeerExists, request.Peer.Id)
+		}
+		next.Peers = append(next.Peers, request.Peer)
+	case pb.MembershipChangeType_MEMBERSHIP_REMOVE_PEER:
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, request.Peer.Id)
+		}
+		next.Peers = withoutPeer(next.Peers, request.Peer.Id)
+	case pb.MembershipChangeType_MEMBERSHIP_PROMOTE_PEER:
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, request.Peer.Id)
+		}
+		if latest.Voter(request.Peer.Id) {
+			return nil, fmt.Errorf("%w: %s is already a voter", ErrPeerExists, request.Peer.Id)
+		}
+		for i, p := range next.Peers {
+			if p.Id == request.Peer.Id {
+				next.Peers[i].Suffrage = pb.Suffrage_SUFFRAGE_VOTER
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown membership change type %v", request.Type)
+	}
+	return next, nil
 }
 
 func (s *Server) Serve() error {
@@ -804,24 +1868,32 @@ func (s *Server) Serve() error {
 		return errors.New("Serve() can only be called once")
 	}
 
-	go s.handleTerminal()
+	s.goFunc(s.handleTerminal)
 
-	if s.opts.metricsExporter != nil {
-		go s.startMetrics(s.opts.metricsExporter)
+	if s.opts().metricsExporter != nil {
+		s.goFunc(func() { s.startMetrics(s.opts().metricsExporter) })
 	}
 
 	if t, ok := s.trans.(TransportServer); ok {
-		go func() {
+		s.goFunc(func() {
 			if err := t.Serve(); err != nil {
-				s.internalShutdown(err)
+				// Shut down in the main loop.
+				s.Shutdown(err)
 			}
-		}()
+		})
 	}
 
-	go s.serveAPIServer()
+	if s.opts().apiServerEnabled {
+		s.goFunc(s.serveAPIServer)
+	}
 
 	s.snapshotService.Start()
-	go s.runMainLoop()
+	s.goFunc(s.runApplyLoop)
+	s.goFunc(s.runMainLoop)
+
+	if s.opts().announceEndpoint {
+		s.goFunc(s.announceEndpoint)
+	}
 
 	return <-s.serveErrCh
 }
@@ -830,6 +1902,53 @@ func (s *Server) Shutdown(err error) {
 	s.shutdownCh <- err
 }
 
+// Close shuts down the server gracefully. It rejects new Apply calls with
+// ErrServerShutdown, waits for the pending ones to resolve, transfers the
+// leadership if the server is the leader, drains the API server, and returns
+// once the server is shut down and all its goroutines have exited. The steps
+// are cut short when ctx is done: the pending futures are failed with
+// ErrServerShutdown, the remaining connections are closed, and
+// ErrDeadlineExceeded is returned after the shutdown.
+func (s *Server) Close(ctx context.Context) error {
+	s.applyMu.Lock()
+	s.closing = true
+	s.applyMu.Unlock()
+
+	var closeErr error
+	if !s.shutdownState() {
+		if err := waitGroupContext(ctx, &s.applyWg); err != nil {
+			s.logger.Warnw("pending logs will be failed since the deadline is exceeded", logFields(s)...)
+			closeErr = err
+		}
+		if s.role() == Leader && closeErr == nil {
+			if err := s.TransferLeadership(ctx, ""); err != nil && !errors.Is(err, ErrNoTransferTarget) {
+				s.logger.Warnw("error occurred transferring the leadership", logFields(s, zap.Error(err))...)
+				if errors.Is(err, ErrDeadlineExceeded) {
+					closeErr = err
+				}
+			}
+		}
+		if err := s.apiServer.Shutdown(ctx); err != nil {
+			s.logger.Warnw("error occurred draining the API server", logFields(s, zap.Error(err))...)
+			if closeErr == nil {
+				closeErr = ErrDeadlineExceeded
+			}
+		}
+	}
+
+	if atomic.LoadUint32(&s.serveFlag) == 0 {
+		// There's no main loop to shut down the server.
+		s.internalShutdown(nil)
+	} else {
+		select {
+		case s.shutdownCh <- nil:
+		case <-s.stopCh:
+		}
+	}
+	<-s.closedCh
+	return closeErr
+}
+
 func (s *Server) States() ServerStates {
 	lastVoteSummary := s.lastVoteSummary()
 	return ServerStates{
@@ -842,5 +1961,104 @@ func (s *Server) States() ServerStates {
 		LastVoteTerm:      lastVoteSummary.term,
 		LastVoteCandidate: lastVoteSummary.candidate,
 		CommitIndex:       s.commitIndex(),
+		LastAppliedIndex:  s.lastApplied().Index,
+		Metadata:          s.metadata(),
+	}
+}
+
+// metadata returns a copy of the metadata of the server in the latest
+// configuration.
+func (s *Server) metadata() map[string]string {
+	if peer, ok := s.selfPeer(); ok {
+		return peer.Copy().Metadata
+	}
+	return nil
+}
+
+// selfPeer returns the peer of the server in the latest configuration,
+// including the staging peers.
+func (s *Server) selfPeer() (*pb.Peer, bool) {
+	latest := s.confStore.Latest()
+	if peer, ok := latest.Peer(s.id); ok {
+		return peer, true
+	}
+	return latest.StagingPeer(s.id)
+}
+
+// StorageStats reports the disk usage of the StableStore if it implements
+// LogStoreCompactor.
+func (s *Server) StorageStats() (StorageStats, error) {
+	compactor, ok := s.stableStore.(LogStoreCompactor)
+	if !ok {
+		return StorageStats{}, ErrCompactionUnsupported
+	}
+	return compactor.StorageStats()
+}
+
+// Snapshot triggers a snapshot of the StateMachine and returns a FutureTask
+// that resolves to the SnapshotMeta once the snapshot is persisted. The latest
+// snapshot is resolved if the StateMachine has not changed since it was taken.
+// ErrNothingToSnapshot is resolved if no logs have been applied.
+func (s *Server) Snapshot() FutureTask[SnapshotMeta, any] {
+	return s.snapshotService.Snapshot()
+}
+
+// Restore installs the snapshot read from the reader, e.g., a backup or the
+// seed data, on the leader. The snapshot is placed after the last log, so that
+// all logs are superseded and the snapshot is then replicated to the followers.
+// The content must be restorable by the StateMachine. ErrNonLeader is returned
+// on non-leader servers.
+func (s *Server) Restore(ctx context.Context, reader io.Reader) (SnapshotMeta, error) {
+	if s.role() != Leader {
+		return nil, ErrNonLeader
+	}
+	t := newFutureTask[SnapshotMeta](reader)
+	select {
+	case s.userRestoreCh <- t:
+	case <-ctx.Done():
+		return nil, ErrDeadlineExceeded
+	}
+	meta, err := t.Result()
+	if err != nil {
+		s.logger.Warnw("snapshot restoration failed", logFields(s, zap.Error(err))...)
+		return nil, err
+	}
+	s.logger.Infow("snapshot restored", logFields(s, zap.String("snapshot_id", meta.Id()))...)
+	s.audit(ctx, AuditSnapshotRestored, eventSnapshotData{Id: meta.Id(), Index: meta.Index(), Term: meta.Term()})
+	return meta, nil
+}
+
+// VerifySnapshot re-reads the snapshot with the ID and validates its integrity
+// with the size and the checksum in its SnapshotMeta. ErrCorruptedSnapshot is
+// returned on mismatches, and ErrSnapshotChecksumUnsupported is returned if
+// the SnapshotMeta does not implement SnapshotChecksumMeta.
+func (s *Server) VerifySnapshot(id string) (SnapshotMeta, error) {
+	meta, err := s.snapshotService.Verify(id)
+	if err != nil {
+		s.logger.Warnw("snapshot verification failed",
+			logFields(s, zap.String("snapshot_id", id), zap.Error(err))...)
+		return nil, err
+	}
+	s.logger.Infow("snapshot verified", logFields(s, zap.String("snapshot_id", id))...)
+	return meta, nil
+}
+
+// CompactStorage triggers a compaction of the StableStore if it implements
+// LogStoreCompactor and returns the disk usage after the compaction.
+func (s *Server) CompactStorage() (StorageStats, error) {
+	compactor, ok := s.stableStore.(LogStoreCompactor)
+	if !ok {
+		return StorageStats{}, ErrCompactionUnsupported
+	}
+	s.logger.Infow("storage compaction started", logFields(s)...)
+	if err := compactor.Compact(); err != nil {
+		return StorageStats{}, err
+	}
+	stats, err := compactor.StorageStats()
+	if err != nil {
+		return StorageStats{}, err
 	}
+	s.logger.Infow("storage compaction finished",
+		logFields(s, "size_bytes", stats.SizeBytes, "live_bytes", stats.LiveBytes)...)
+	return stats, nil
 }
@@ -0,0 +1,1040 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/proto"
+)
+
+type countingLogStore struct {
+	LogStore
+	appends int
+}
+
+func (s *countingLogStore) AppendLogs(logs []*pb.Log) error {
+	s.appends++
+	return s.LogStore.AppendLogs(logs)
+}
+
+func TestServerGroupCommit(t *testing.T) {
+	server := testingServer(t, GroupCommitOption(4, time.Second))
+	server.logOpsCh = make(chan logStoreOp, 8)
+	store := &countingLogStore{LogStore: newInternalLogStore()}
+	server.logStore = newLogStoreProxy(server, store)
+
+	appendOpFn := func(n int) *logStoreAppendOp {
+		bodies := make([]*pb.LogBody, n)
+		for i := range bodies {
+			bodies[i] = &pb.LogBody{Type: pb.LogType_COMMAND}
+		}
+		return &logStoreAppendOp{FutureTask: newFutureTask[[]*pb.LogMeta](bodies)}
+	}
+
+	ops := []*logStoreAppendOp{appendOpFn(1), appendOpFn(2), appendOpFn(3)}
+	trimOp := &logStoreTrimOp{Type: logStoreTrimSuffix, FutureTask: newFutureTask[any](uint64(5))}
+	server.logOpsCh <- ops[1]
+	server.logOpsCh <- ops[2]
+	server.logOpsCh <- trimOp
+
+	// The batch should end at the logStoreTrimOp without waiting for the max
+	// latency.
+	start := time.Now()
+	server.handleLogOp(ops[0])
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 1, store.appends)
+
+	var index uint64
+	for _, op := range ops {
+		logMeta := ƒAssertNoError2(op.Result())(t)
+		assert.Len(t, logMeta, len(op.Task()))
+		for _, m := range logMeta {
+			index++
+			assert.Equal(t, index, m.Index)
+		}
+	}
+	ƒAssertNoError2(trimOp.Result())(t)
+	assert.Equal(t, uint64(1), ƒAssertNoError2(store.FirstIndex())(t))
+	assert.Equal(t, uint64(5), ƒAssertNoError2(store.LastIndex())(t))
+}
+
+func TestServerAppendLogsTerms(t *testing.T) {
+	server := testingServer(t, GroupCommitOption(2, 0))
+	server.logOpsCh = make(chan logStoreOp, 8)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.serverState.stateCurrentTerm = 3
+
+	// The logs replicated from the leader keep their terms, while the others
+	// are in the current term, also when they are appended in a group.
+	replicated := &logStoreAppendOp{
+		FutureTask: newFutureTask[[]*pb.LogMeta]([]*pb.LogBody{{Type: pb.LogType_COMMAND}, {Type: pb.LogType_COMMAND}}),
+		terms:      []uint64{1, 2},
+	}
+	local := &logStoreAppendOp{FutureTask: newFutureTask[[]*pb.LogMeta]([]*pb.LogBody{{Type: pb.LogType_COMMAND}})}
+	server.logOpsCh <- local
+	server.handleLogOp(replicated)
+	ƒAssertNoError2(replicated.Result())(t)
+	ƒAssertNoError2(local.Result())(t)
+	for i, term := range []uint64{1, 2, 3} {
+		assert.Equal(t, term, ƒAssertNoError2(server.logStore.Meta(uint64(i+1)))(t).Term, "term of log %d", i+1)
+	}
+}
+
+func BenchmarkServerAppendLogs(b *testing.B) {
+	server := testingServer(b)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.serverState.stateCurrentTerm = 1
+	bodies := make([]*pb.LogBody, 64)
+	for i := range bodies {
+		bodies[i] = &pb.LogBody{Type: pb.LogType_COMMAND, Data: make([]byte, 128)}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := server.appendLogs(bodies, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestServerApplyNoLeader(t *testing.T) {
+	server := testingServer(t,
+		ElectionTimeoutOption(2*time.Second),
+		RetryPolicyOption(ConstantRetryPolicy{MaxAttempts: 1}))
+
+	_, err := server.Apply(context.Background(), &pb.LogBody{Type: pb.LogType_COMMAND}).Result()
+	var noLeaderErr *NoLeaderError
+	assert.ErrorAs(t, err, &noLeaderErr)
+	assert.ErrorIs(t, err, ErrNoLeader)
+	assert.Equal(t, pb.NilPeer, noLeaderErr.LastLeader)
+	assert.Equal(t, 2*time.Second, noLeaderErr.RetryAfter)
+
+	// The last known leader is kept as the hint.
+	leader := &pb.Peer{Id: "1", Endpoint: "1"}
+	server.setLeader(leader)
+	server.setLeader(pb.NilPeer)
+	_, err = server.Apply(context.Background(), &pb.LogBody{Type: pb.LogType_COMMAND}).Result()
+	assert.ErrorAs(t, err, &noLeaderErr)
+	assert.Equal(t, leader, noLeaderErr.LastLeader)
+}
+
+// failingTransport fails the requests redirected to the leader with err.
+type failingTransport struct {
+	Transport
+	err   error
+	calls int32
+}
+
+func (t *failingTransport) ApplyLog(ctx context.Context, peer *pb.Peer, request *pb.ApplyLogRequest) (*pb.ApplyLogResponse, error) {
+	atomic.AddInt32(&t.calls, 1)
+	return nil, t.err
+}
+
+func (t *failingTransport) ChangeMembership(
+	ctx context.Context, peer *pb.Peer, request *pb.MembershipChangeRequest,
+) (*pb.MembershipChangeResponse, error) {
+	atomic.AddInt32(&t.calls, 1)
+	return nil, t.err
+}
+
+func TestServerRedirectRetry(t *testing.T) {
+	for _, c := range []struct {
+		err   error
+		calls int32
+	}{
+		// The requests that never reached the leader are retried.
+		{NotDeliveredError(ErrUnknownTransporClient), 3},
+		// The others may have been handled by the leader.
+		{errors.New("connection reset"), 1},
+	} {
+		server := testingServer(t, RetryPolicyOption(ConstantRetryPolicy{MaxAttempts: 2}))
+		trans := &failingTransport{Transport: server.trans, err: c.err}
+		server.trans = trans
+		server.setLeader(&pb.Peer{Id: "1", Endpoint: "1"})
+
+		_, err := server.Apply(context.Background(), &pb.LogBody{Type: pb.LogType_COMMAND}).Result()
+		assert.ErrorIs(t, err, c.err)
+		assert.Equal(t, c.calls, atomic.SwapInt32(&trans.calls, 0))
+		assert.ErrorIs(t, server.AbortTransition(context.Background()), c.err)
+		assert.Equal(t, c.calls, atomic.SwapInt32(&trans.calls, 0))
+	}
+}
+
+func TestServerMembershipChange(t *testing.T) {
+	lookup := newInternalTransClientLookup()
+	serverFn := func(id string) *Server {
+		server := testingServer(t,
+			RetryPolicyOption(ConstantRetryPolicy{MaxAttempts: 1}),
+			HeartbeatIntervalOption(10*time.Millisecond),
+			CatchUpPolicyOption(CatchUpPolicy{Timeout: 100 * time.Millisecond}))
+		server.id = id
+		server.trans = ƒAssertNoError2(newInternalTransport(lookup, id))(t)
+		testingTransportServe(t, server.trans)
+		server.logStore = newLogStoreProxy(server, newInternalLogStore())
+		server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+		server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{
+			Peers: []*pb.Peer{{Id: "1", Endpoint: "1"}, {Id: "2", Endpoint: "2"}},
+		}}, 1))
+		server.rpcHandler = newRPCHandler(server)
+		server.logOpsCh = make(chan logStoreOp)
+		go func() {
+			for op := range server.logOpsCh {
+				server.handleLogOp(op)
+			}
+		}()
+		go func() {
+			for rpc := range server.trans.RPC() {
+				server.handleRPC(rpc)
+			}
+		}()
+		return server
+	}
+	leader, follower := serverFn("1"), serverFn("2")
+	defer close(leader.logOpsCh)
+	defer close(follower.logOpsCh)
+	leader.setRole(Leader)
+	follower.setLeader(&pb.Peer{Id: "1", Endpoint: "1"})
+
+	assert.ErrorIs(t, leader.AddPeer(context.Background(), &pb.Peer{Id: "2", Endpoint: "2"}), ErrPeerExists)
+	assert.ErrorIs(t, leader.RemovePeer(context.Background(), "3"), ErrUnknownPeer)
+
+	// The broken configurations are rejected.
+	assert.ErrorIs(t, follower.AddPeer(context.Background(), &pb.Peer{Id: "3", Endpoint: "2"}), ErrInvalidConfiguration)
+	assert.ErrorIs(t, leader.AddPeer(context.Background(), &pb.Peer{Id: "3"}), ErrInvalidConfiguration)
+	assert.Empty(t, leader.confStore.Latest().Staging)
+
+	// The request is redirected to the leader, and the peer is unstaged as it
+	// never catches up.
+	peer := &pb.Peer{Id: "3", Endpoint: "3"}
+	assert.ErrorIs(t, follower.AddPeer(context.Background(), peer), ErrCatchUpTimeout)
+	assert.False(t, leader.confStore.Latest().Joint())
+	assert.Empty(t, leader.confStore.Latest().Staging)
+
+	// The staging peer is removed without a transition.
+	assert.NoError(t, leader.Register(peer))
+	assert.Len(t, leader.confStore.Latest().Staging, 1)
+	assert.NoError(t, follower.RemovePeer(context.Background(), "3"))
+	assert.False(t, leader.confStore.Latest().Joint())
+	assert.Empty(t, leader.confStore.Latest().Staging)
+
+	// The staging peer is promoted once it has caught up.
+	assert.NoError(t, leader.Register(peer))
+	leader.promoteStaging()
+	assert.False(t, leader.confStore.Latest().Joint())
+	leader.replScheduler.setLastContact("3", time.Now())
+	leader.replScheduler.matchIndexes.Store("3", leader.lastLogIndex())
+	leader.promoteStaging()
+	latest := leader.confStore.Latest()
+	assert.True(t, latest.Joint())
+	assert.Len(t, latest.Next.Peers, 3)
+	assert.Empty(t, latest.Staging)
+	assert.Len(t, follower.confStore.Latest().Peers(), 2)
+
+	assert.ErrorIs(t, leader.RemovePeer(context.Background(), "2"), ErrInJointConsensus)
+
+	// The transition is aborted unless the joint configuration is committed.
+	leader.confStore.SetCommitted(latest)
+	assert.ErrorIs(t, follower.AbortTransition(context.Background()), ErrTransitionCommitted)
+	leader.confStore.SetCommitted(nil)
+	assert.NoError(t, follower.AbortTransition(context.Background()))
+	latest = leader.confStore.Latest()
+	assert.False(t, latest.Joint())
+	assert.Len(t, latest.Peers(), 2)
+	assert.ErrorIs(t, follower.AbortTransition(context.Background()), ErrNotInJointConsensus)
+
+	// The peers are updated without a transition.
+	updated := &pb.Peer{Id: "2", Endpoint: "2", Metadata: map[string]string{"zone": "a"}}
+	assert.NoError(t, follower.UpdatePeer(context.Background(), updated))
+	latest = leader.confStore.Latest()
+	assert.False(t, latest.Joint())
+	if p, ok := latest.Peer("2"); assert.True(t, ok) {
+		assert.Equal(t, updated.Metadata, p.Metadata)
+	}
+	assert.ErrorIs(t, follower.UpdatePeer(context.Background(), &pb.Peer{Id: "4", Endpoint: "4"}), ErrUnknownPeer)
+	assert.ErrorIs(t, follower.UpdatePeer(context.Background(), &pb.Peer{Id: "2", Endpoint: "1"}), ErrInvalidConfiguration)
+}
+
+func TestServerReadIndex(t *testing.T) {
+	lookup := newInternalTransClientLookup()
+	serverFn := func(id string) *Server {
+		server := testingServer(t)
+		server.id = id
+		server.trans = ƒAssertNoError2(newInternalTransport(lookup, id))(t)
+		testingTransportServe(t, server.trans)
+		server.logStore = newLogStoreProxy(server, newInternalLogStore())
+		server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+		server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{
+			Peers: []*pb.Peer{{Id: "1", Endpoint: "1"}, {Id: "2", Endpoint: "2"}, {Id: "3", Endpoint: "3"}},
+		}}, 1))
+		server.rpcHandler = newRPCHandler(server)
+		server.commitCh = make(chan uint64, 16)
+		server.serverState.stateCurrentTerm = 2
+		return server
+	}
+	leader, follower := serverFn("1"), serverFn("2")
+	go func() {
+		for rpc := range follower.trans.RPC() {
+			follower.handleRPC(rpc)
+		}
+	}()
+
+	_, err := follower.ReadIndex(context.Background())
+	assert.ErrorIs(t, err, ErrNonLeader)
+
+	leader.setRole(Leader)
+	leader.setCommitIndex(3)
+	leader.setLastApplied(3, 2)
+	// The leader and one of the two followers make a quorum.
+	assert.Equal(t, uint64(3), ƒAssertNoError2(leader.ReadIndex(context.Background()))(t))
+
+	// The leader is unable to confirm its leadership after a newer term is seen.
+	follower.serverState.stateCurrentTerm = 3
+	_, err = leader.ReadIndex(context.Background())
+	assert.ErrorIs(t, err, ErrNonLeader)
+}
+
+func TestServerWatchLogs(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	logs := []*pb.Log{
+		{Meta: &pb.LogMeta{Index: 1, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("1")}},
+		{Meta: &pb.LogMeta{Index: 2, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_NOOP}},
+		{Meta: &pb.LogMeta{Index: 3, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte("3")}},
+	}
+	assert.NoError(t, server.logStore.AppendLogs(logs))
+	server.setFirstLogIndex(1)
+	server.setLastLogIndex(3)
+	server.setLastApplied(2, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchedCh := make(chan *pb.Log, 3)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.WatchLogs(ctx, 0, []pb.LogType{pb.LogType_COMMAND}, func(log *pb.Log) error {
+			watchedCh <- log
+			return nil
+		})
+	}()
+	assert.Equal(t, uint64(1), (<-watchedCh).Meta.Index)
+	// The log is watched once it is applied.
+	server.setLastApplied(3, 1)
+	assert.Equal(t, uint64(3), (<-watchedCh).Meta.Index)
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+
+	server.setFirstLogIndex(2)
+	assert.ErrorIs(t, server.WatchLogs(context.Background(), 1, nil, func(log *pb.Log) error { return nil }),
+		ErrLogsCompacted)
+}
+
+func TestServerTransferLeadership(t *testing.T) {
+	lookup := newInternalTransClientLookup()
+	serverFn := func(id string) *Server {
+		server := testingServer(t, FollowerTimeoutOption(time.Hour))
+		server.id = id
+		server.trans = ƒAssertNoError2(newInternalTransport(lookup, id))(t)
+		testingTransportServe(t, server.trans)
+		server.stableStore = ƒAssertNoError2(newInternalStore())(t)
+		server.logStore = newLogStoreProxy(server, newInternalLogStore())
+		server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+		server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{
+			Peers: []*pb.Peer{{Id: "1", Endpoint: "1"}, {Id: "2", Endpoint: "2"}},
+		}}, 1))
+		server.serverState.stateCurrentTerm = 1
+		server.rpcHandler = newRPCHandler(server)
+		server.timeoutNowCh = make(chan struct{}, 1)
+		go func() {
+			for rpc := range server.trans.RPC() {
+				server.handleRPC(rpc)
+			}
+		}()
+		return server
+	}
+	leader, follower := serverFn("1"), serverFn("2")
+	leader.setRole(Leader)
+	follower.setLeader(&pb.Peer{Id: "1", Endpoint: "1"})
+	follower.setLastLeaderContact(time.Now())
+
+	assert.ErrorIs(t, follower.TransferLeadership(context.Background(), ""), ErrNonLeader)
+	assert.ErrorIs(t, leader.TransferLeadership(context.Background(), "3"), ErrUnknownPeer)
+
+	// The follower is yet to catch up with the leader.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	leader.setLastLogIndex(1)
+	assert.ErrorIs(t, leader.TransferLeadership(ctx, ""), ErrDeadlineExceeded)
+
+	voteCh := make(chan *pb.RequestVoteResponse, 1)
+	go func() {
+		// Run the election as the follower loop does.
+		<-follower.timeoutNowCh
+		atomic.StoreUint32(&follower.flagTransferElection, 1)
+		responseCh, cancel, err := follower.startElection()
+		assert.NoError(t, err)
+		defer cancel()
+		<-responseCh // Our own vote
+		voteCh <- <-responseCh
+	}()
+	leader.replScheduler.matchIndexes.Store("2", uint64(1))
+	assert.NoError(t, leader.TransferLeadership(context.Background(), "2"))
+	assert.Equal(t, Follower, leader.role())
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&leader.leaseSuspendedTerm))
+	// The vote is granted even though the leader is alive.
+	assert.True(t, (<-voteCh).Granted)
+}
+
+func TestServerCandidateDeniedVotes(t *testing.T) {
+	lookup := newInternalTransClientLookup()
+	clock := NewManualClock(time.Now())
+	server := testingServer(t, ClockOption(clock))
+	server.id = "1"
+	server.trans = ƒAssertNoError2(newInternalTransport(lookup, "1"))(t)
+	server.stableStore = ƒAssertNoError2(newInternalStore())(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{
+		Peers: []*pb.Peer{{Id: "1", Endpoint: "1"}, {Id: "2", Endpoint: "2"}, {Id: "3", Endpoint: "3"}},
+	}}, 1))
+	server.setRole(Candidate)
+
+	// The other voters deny the votes.
+	deniedCh := make(chan struct{}, 2)
+	for _, id := range []string{"2", "3"} {
+		id := id
+		trans := ƒAssertNoError2(newInternalTransport(lookup, id))(t)
+		testingTransportServe(t, trans)
+		go func() {
+			for rpc := range trans.RPC() {
+				request := rpc.Request().(*pb.RequestVoteRequest)
+				rpc.Respond(&pb.RequestVoteResponse{ServerId: id, Term: request.Term}, nil)
+				deniedCh <- struct{}{}
+			}
+		}()
+	}
+
+	loopCh := make(chan struct{})
+	go func() {
+		defer close(loopCh)
+		server.runLoopCandidate()
+	}()
+	<-deniedCh
+	<-deniedCh
+	// The denied votes are not counted toward the quorum.
+	assert.Never(t, func() bool { return server.role() == Leader }, 50*time.Millisecond, 5*time.Millisecond)
+	for {
+		select {
+		case <-loopCh:
+			assert.Equal(t, Candidate, server.role())
+			return
+		case <-time.After(5 * time.Millisecond):
+			clock.Advance(server.opts().electionTimeout)
+		}
+	}
+}
+
+func TestServerLeaseHoldsDuringTransfer(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{
+		Peers: []*pb.Peer{{Id: server.id, Endpoint: server.Endpoint()}, {Id: "2", Endpoint: "2"}},
+	}}, 1))
+	server.serverState.stateCurrentTerm = 1
+	server.setRole(Leader)
+	server.replScheduler.setLastContact("2", time.Now())
+	assert.True(t, server.leaseHolds())
+
+	// The lease does not hold while the leadership is being transferred.
+	atomic.StoreUint32(&server.flagLeadershipTransfer, 1)
+	assert.False(t, server.leaseHolds())
+
+	// Nor after the transfer fails once the target is asked to start an
+	// election, until the term changes.
+	atomic.StoreUint32(&server.flagLeadershipTransfer, 0)
+	atomic.StoreUint64(&server.leaseSuspendedTerm, 1)
+	assert.False(t, server.leaseHolds())
+	server.serverState.stateCurrentTerm = 2
+	assert.True(t, server.leaseHolds())
+}
+
+func TestServerClose(t *testing.T) {
+	// The logs are appended one by one.
+	server := testingServer(t, GroupCommitOption(0, 0))
+	server.stableStore = ƒAssertNoError2(newInternalStore())(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{
+		Peers: []*pb.Peer{{Id: server.id, Endpoint: server.Endpoint()}},
+	}}, 1))
+	server.snapshotService = newSnapshotService(server)
+	server.apiServer = newAPIServer(server)
+	server.serveErrCh = make(chan error, 1)
+	server.logOpsCh = make(chan logStoreOp, 8)
+	server.setRole(Leader)
+
+	// The main loop handles the logs slowly.
+	handleCh := make(chan struct{})
+	server.goFunc(func() {
+		for {
+			select {
+			case <-handleCh:
+			case <-server.stopCh:
+				return
+			}
+			select {
+			case op := <-server.logOpsCh:
+				server.handleLogOp(op)
+			case <-server.stopCh:
+				return
+			}
+		}
+	})
+	futures := make([]ApplyFuture, 3)
+	for i := range futures {
+		futures[i] = server.ApplyCommand(context.Background(), Command("command"))
+	}
+	handleCh <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.Close(ctx), ErrDeadlineExceeded)
+	select {
+	case <-server.closedCh:
+	default:
+		t.Fatal("Close returned before the goroutines exited")
+	}
+
+	// Pending logs are either appended or failed.
+	_, err := futures[0].Result()
+	assert.NoError(t, err)
+	_, err = futures[0].Response()
+	assert.ErrorIs(t, err, ErrServerShutdown)
+	for _, f := range futures[1:] {
+		_, err := f.Result()
+		assert.ErrorIs(t, err, ErrServerShutdown)
+	}
+	assert.NoError(t, <-server.serveErrCh)
+
+	_, err = server.ApplyCommand(context.Background(), Command("command")).Result()
+	assert.ErrorIs(t, err, ErrServerShutdown)
+	assert.ErrorIs(t, server.enqueueLogOp(context.Background(), &logStoreTrimOp{}), ErrServerShutdown)
+}
+
+func TestNewServerValidation(t *testing.T) {
+	trans := ƒAssertNoError2(newInternalTransport(newInternalTransClientLookup(), "1"))(t)
+	coreOpts := ServerCoreOptions{
+		Id:            "1",
+		StableStore:   ƒAssertNoError2(newInternalStore())(t),
+		StateMachine:  &testingStateMachine{},
+		SnapshotStore: NewObjectSnapshotStore(nil, ""),
+		Transport:     trans,
+	}
+
+	invalidCoreOpts := []func(o *ServerCoreOptions){
+		func(o *ServerCoreOptions) { o.Id = "" },
+		func(o *ServerCoreOptions) { o.StableStore = nil },
+		func(o *ServerCoreOptions) { o.StateMachine = nil },
+		func(o *ServerCoreOptions) { o.SnapshotStore = nil },
+		func(o *ServerCoreOptions) { o.Transport = nil },
+		func(o *ServerCoreOptions) { o.InitialCluster = []*pb.Peer{{Id: "1"}} },
+		func(o *ServerCoreOptions) {
+			o.InitialCluster = []*pb.Peer{{Id: "1", Endpoint: "1"}, {Id: "1", Endpoint: "2"}}
+		},
+	}
+	for i, fn := range invalidCoreOpts {
+		o := coreOpts
+		fn(&o)
+		_, err := NewServer(o)
+		assert.ErrorIs(t, err, ErrInvalidOption, "core options #%d", i)
+	}
+
+	invalidOpts := []ServerOption{
+		APIServerListenAddressOption("localhost"),
+		APIExtensionOption(nil),
+		DeadServerPolicyOption(DeadServerPolicy{MinVoters: -1}),
+		// Shorter than the follower timeout.
+		DeadServerPolicyOption(DeadServerPolicy{Threshold: time.Millisecond}),
+		ElectionTimeoutOption(0),
+		FollowerTimeoutOption(-time.Second),
+		GroupCommitOption(8, -time.Millisecond),
+		// Blocking the main loop for too long.
+		GroupCommitOption(8, time.Second),
+		HeartbeatIntervalOption(0),
+		// Not shorter than the timeouts with the random offset.
+		HeartbeatIntervalOption(800 * time.Millisecond),
+		LogCacheOption(-1),
+		LogCheckPolicyOption(0),
+		LogCompactionPolicyOption(LogCompactionPolicy{RetainBytes: -1}),
+		LogCorruptionPolicyOption(0),
+		RetryPolicyOption(nil),
+		SnapshotInstallConcurrencyOption(-1),
+		SnapshotPolicyOption(SnapshotPolicy{}),
+		SnapshotRetentionPolicyOption(SnapshotRetentionPolicy{Count: -1}),
+	}
+	for i, opt := range invalidOpts {
+		_, err := NewServer(coreOpts, opt)
+		assert.ErrorIs(t, err, ErrInvalidOption, "option #%d", i)
+	}
+}
+
+func TestNewServerEndpointChanged(t *testing.T) {
+	lookup := newInternalTransClientLookup()
+	trans := ƒAssertNoError2(newInternalTransport(lookup, "1"))(t)
+	coreOpts := ServerCoreOptions{
+		Id:             "1",
+		InitialCluster: []*pb.Peer{{Id: "1", Endpoint: trans.Endpoint()}},
+		StableStore:    ƒAssertNoError2(newInternalStore())(t),
+		StateMachine:   &testingStateMachine{},
+		SnapshotStore:  NewObjectSnapshotStore(NewInmemObjectStore(), ""),
+		Transport:      trans,
+	}
+	ƒAssertNoError2(NewServer(coreOpts))(t)
+
+	// The server is restarted with another endpoint.
+	coreOpts.InitialCluster = nil
+	coreOpts.Transport = ƒAssertNoError2(newInternalTransport(lookup, "2"))(t)
+	_, err := NewServer(coreOpts)
+	assert.ErrorIs(t, err, ErrEndpointChanged)
+	_, err = NewServer(coreOpts, AnnounceEndpointOption(true))
+	assert.NoError(t, err)
+}
+
+func TestNewServerRecoveryFile(t *testing.T) {
+	lookup := newInternalTransClientLookup()
+	trans := ƒAssertNoError2(newInternalTransport(lookup, "1"))(t)
+	coreOpts := ServerCoreOptions{
+		Id: "1",
+		InitialCluster: []*pb.Peer{
+			{Id: "1", Endpoint: trans.Endpoint()},
+			{Id: "2", Endpoint: "2"},
+			{Id: "3", Endpoint: "3"},
+		},
+		StableStore:   ƒAssertNoError2(newInternalStore())(t),
+		StateMachine:  &testingStreamingStateMachine{},
+		SnapshotStore: NewObjectSnapshotStore(NewInmemObjectStore(), ""),
+		Transport:     trans,
+	}
+	path := filepath.Join(t.TempDir(), "peers.json")
+	server := ƒAssertNoError2(NewServer(coreOpts, RecoveryFileOption(path)))(t)
+	assert.Len(t, server.confStore.Latest().Peers(), 3)
+
+	// The servers 2 and 3 are lost.
+	coreOpts.InitialCluster = nil
+	recovery := fmt.Sprintf(`[{"id": "1", "endpoint": %q, "metadata": {"zone": "a"}}]`, trans.Endpoint())
+	assert.NoError(t, os.WriteFile(path, []byte(recovery), 0o644))
+	server = ƒAssertNoError2(NewServer(coreOpts, RecoveryFileOption(path)))(t)
+	// The configuration is recovered through a snapshot at the last log.
+	assert.Equal(t, uint64(1), server.lastLogIndex())
+	metaList := ƒAssertNoError2(server.snapshotStore.List())(t)
+	assert.Len(t, metaList, 1)
+	assert.Equal(t, uint64(1), metaList[0].Index())
+	latest := server.confStore.Latest()
+	assert.Equal(t, uint64(1), latest.LogIndex())
+	assert.False(t, latest.Joint())
+	assert.Equal(t, []*pb.Peer{{Id: "1", Endpoint: trans.Endpoint(), Metadata: map[string]string{"zone": "a"}}},
+		latest.Peers())
+	assert.NoFileExists(t, path)
+	assert.FileExists(t, path+".applied")
+
+	// The recovery is not repeated.
+	server = ƒAssertNoError2(NewServer(coreOpts, RecoveryFileOption(path)))(t)
+	assert.Equal(t, uint64(1), server.confStore.Latest().LogIndex())
+	assert.Len(t, server.confStore.Latest().Peers(), 1)
+	assert.Len(t, ƒAssertNoError2(server.snapshotStore.List())(t), 1)
+
+	for _, invalid := range []string{`{}`, `[]`, `[{"id": "1"}]`, `[{"id": "1", "endpoint": "1"}, {"id": "1", "endpoint": "2"}]`} {
+		assert.NoError(t, os.WriteFile(path, []byte(invalid), 0o644))
+		_, err := NewServer(coreOpts, RecoveryFileOption(path))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNewServerRecoveryFileDivergedLogs(t *testing.T) {
+	peers := []*pb.Peer{{Id: "1", Endpoint: "1"}, {Id: "2", Endpoint: "2"}, {Id: "3", Endpoint: "3"}}
+	confData := ƒAssertNoError2(proto.Marshal(&pb.Configuration{Current: &pb.Config{Peers: peers}}))(t)
+	recovery := `[{"id": "1", "endpoint": "1"}, {"id": "2", "endpoint": "2"}]`
+
+	// The servers 1 and 2 survive with the logs of different lengths, as the
+	// logs of the term 2 only reached the server 2.
+	for _, c := range []struct {
+		id       string
+		lastTerm uint64
+		logs     int
+	}{{"1", 1, 3}, {"2", 2, 5}} {
+		stableStore := ƒAssertNoError2(newInternalStore())(t)
+		logs := []*pb.Log{{Meta: &pb.LogMeta{Index: 1, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_CONFIGURATION, Data: confData}}}
+		for i := 2; i <= c.logs; i++ {
+			term := uint64(1)
+			if i > 3 {
+				term = 2
+			}
+			logs = append(logs, &pb.Log{Meta: &pb.LogMeta{Index: uint64(i), Term: term}, Body: &pb.LogBody{Type: pb.LogType_COMMAND}})
+		}
+		assert.NoError(t, stableStore.AppendLogs(logs))
+		path := filepath.Join(t.TempDir(), "peers.json")
+		assert.NoError(t, os.WriteFile(path, []byte(recovery), 0o644))
+		lookup := newInternalTransClientLookup()
+		coreOpts := ServerCoreOptions{
+			Id:            c.id,
+			StableStore:   stableStore,
+			StateMachine:  &testingStreamingStateMachine{},
+			SnapshotStore: NewObjectSnapshotStore(NewInmemObjectStore(), ""),
+			Transport:     ƒAssertNoError2(newInternalTransport(lookup, c.id))(t),
+		}
+		server := ƒAssertNoError2(NewServer(coreOpts, RecoveryFileOption(path)))(t)
+
+		// No log is appended after the last log, whose index and term may be
+		// held by another server with a different entry.
+		lastIndex := uint64(c.logs)
+		assert.Equal(t, lastIndex, server.lastLogIndex(), c.id)
+		assert.Equal(t, lastIndex, server.commitIndex(), c.id)
+		assert.Equal(t, uint64(0), ƒAssertNoError2(stableStore.LastIndex())(t), c.id)
+		metaList := ƒAssertNoError2(server.snapshotStore.List())(t)
+		assert.Len(t, metaList, 1, c.id)
+		assert.Equal(t, lastIndex, metaList[0].Index(), c.id)
+		assert.Equal(t, c.lastTerm, metaList[0].Term(), c.id)
+		assert.Equal(t, lastIndex, metaList[0].ConfigurationIndex(), c.id)
+		latest := server.confStore.Latest()
+		assert.Equal(t, lastIndex, latest.LogIndex(), c.id)
+		assert.Len(t, latest.Peers(), 2, c.id)
+		assert.Equal(t, latest, server.confStore.Committed(), c.id)
+	}
+}
+
+func TestServerUpdateOptions(t *testing.T) {
+	server := testingServer(t, QueryHandlerOption(func(ctx context.Context, query []byte) ([]byte, error) {
+		return query, nil
+	}))
+
+	assert.NoError(t, server.UpdateOptions(
+		ElectionTimeoutOption(2*time.Second),
+		HeartbeatIntervalOption(50*time.Millisecond),
+		ReplicationBatchSizeOption(64),
+		SnapshotPolicyOption(SnapshotPolicy{Entries: 100}),
+	))
+	assert.Equal(t, 2*time.Second, server.opts().electionTimeout)
+	assert.Equal(t, 50*time.Millisecond, server.opts().heartbeatInterval)
+	assert.Equal(t, 64, server.opts().replicationBatchSize)
+	assert.Equal(t, SnapshotPolicy{Entries: 100}, server.opts().snapshotPolicy)
+
+	// Invalid and non-tunable options are rejected as a whole.
+	assert.ErrorIs(t, server.UpdateOptions(ElectionTimeoutOption(3*time.Second), HeartbeatIntervalOption(0)), ErrInvalidOption)
+	assert.ErrorIs(t, server.UpdateOptions(ElectionTimeoutOption(3*time.Second), LogLevelOption(zapcore.DebugLevel)), ErrInvalidOption)
+	assert.ErrorIs(t, server.UpdateOptions(QueryHandlerOption(nil)), ErrInvalidOption)
+	assert.Equal(t, 2*time.Second, server.opts().electionTimeout)
+}
+
+type testingEchoStateMachine struct {
+	testingStateMachine
+}
+
+func (m *testingEchoStateMachine) Apply(command Command) interface{} {
+	return []byte(command)
+}
+
+func TestServerApplyResponse(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.snapshotService = newSnapshotService(server)
+	server.snapshotService.StartScheduler()
+	defer server.snapshotService.StopScheduler()
+	server.stateMachine = newStateMachineProxy(server, &testingEchoStateMachine{})
+	server.logOpsCh = make(chan logStoreOp, 8)
+	server.serverState.stateCurrentTerm = 1
+	server.setRole(Leader)
+
+	future := server.ApplyCommand(context.Background(), Command("command"))
+	server.handleLogOp(<-server.logOpsCh)
+	meta := ƒAssertNoError2(future.Result())(t)
+	server.commitAndApply(meta.Index)
+	assert.Equal(t, []byte("command"), ƒAssertNoError2(future.Response())(t))
+
+	// The log is replaced by a log of another term before it is applied.
+	future = server.ApplyCommand(context.Background(), Command("command"))
+	server.handleLogOp(<-server.logOpsCh)
+	meta = ƒAssertNoError2(future.Result())(t)
+	server.applyResponses.resolve(&pb.LogMeta{Index: meta.Index, Term: meta.Term + 1}, nil, nil)
+	_, err := future.Response()
+	assert.ErrorIs(t, err, ErrLeadershipLost)
+}
+
+func TestServerBackpressure(t *testing.T) {
+	server := testingServer(t, BackpressurePolicyOption(BackpressurePolicy{MaxUncommittedEntries: 3, MaxUncommittedBytes: 8}))
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.logOpsCh = make(chan logStoreOp, 8)
+	server.serverState.stateCurrentTerm = 1
+	server.setRole(Leader)
+	apply := func(ctx context.Context, data string) error {
+		future := server.Apply(ctx, &pb.LogBody{Type: pb.LogType_COMMAND, Data: []byte(data)})
+		select {
+		case op := <-server.logOpsCh:
+			server.handleLogOp(op)
+		default:
+		}
+		_, err := future.Result()
+		return err
+	}
+
+	// The limit of the bytes is reached first.
+	assert.NoError(t, apply(context.Background(), "12345"))
+	assert.NoError(t, apply(context.Background(), "12345"))
+	assert.ErrorIs(t, apply(context.Background(), "1"), ErrProposalDropped)
+	server.commit(1)
+	assert.Equal(t, uint64(5), server.uncommitted.Bytes())
+	assert.NoError(t, apply(context.Background(), ""))
+	assert.NoError(t, apply(context.Background(), ""))
+	// Then the limit of the entries.
+	assert.ErrorIs(t, apply(context.Background(), ""), ErrProposalDropped)
+
+	// Apply waits for the commits with Block.
+	opts := *server.opts()
+	opts.backpressurePolicy.Block = true
+	server.options.Store(&opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, apply(ctx, ""), ErrDeadlineExceeded)
+	// The blocked applies are woken by the commits.
+	errCh := make(chan error, 1)
+	go func() { errCh <- apply(context.Background(), "") }()
+	waitShrunk := func() {
+		assert.Eventually(t, func() bool {
+			server.uncommitted.mu.Lock()
+			defer server.uncommitted.mu.Unlock()
+			return server.uncommitted.shrinkCh != nil
+		}, time.Second, time.Millisecond)
+	}
+	waitShrunk()
+	server.commit(server.lastLogIndex())
+	assert.NoError(t, <-errCh)
+
+	// And by the loss of the leadership.
+	assert.NoError(t, apply(context.Background(), ""))
+	assert.NoError(t, apply(context.Background(), ""))
+	go func() { errCh <- apply(context.Background(), "") }()
+	waitShrunk()
+	server.stateMachine = newStateMachineProxy(server, &testingStateMachine{})
+	server.setRole(Follower)
+	server.leaveLeaderLoop()
+	assert.ErrorIs(t, <-errCh, ErrNonLeader)
+}
+
+func TestServerCoalesceCommitIndex(t *testing.T) {
+	server := testingServer(t)
+	server.commitCh = make(chan uint64, 16)
+	for _, i := range []uint64{3, 5, 4} {
+		server.commitCh <- i
+	}
+	assert.Equal(t, uint64(5), server.coalesceCommitIndex(2))
+	assert.Len(t, server.commitCh, 0)
+	assert.Equal(t, uint64(6), server.coalesceCommitIndex(6))
+}
+
+type testingBlockingStateMachine struct {
+	testingStateMachine
+	unblockCh chan struct{}
+}
+
+func (m *testingBlockingStateMachine) Apply(command Command) interface{} {
+	<-m.unblockCh
+	return []byte(command)
+}
+
+func TestServerApplyLoop(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.snapshotService = newSnapshotService(server)
+	server.snapshotService.StartScheduler()
+	defer server.snapshotService.StopScheduler()
+	stateMachine := &testingBlockingStateMachine{unblockCh: make(chan struct{})}
+	server.stateMachine = newStateMachineProxy(server, stateMachine)
+	server.logOpsCh = make(chan logStoreOp, 8)
+	server.applyCh = make(chan struct{}, 1)
+	server.stateMachineSnapshotCh = make(chan FutureTask[*stateMachineSnapshot, any], 1)
+	server.serverState.stateCurrentTerm = 1
+	server.setRole(Leader)
+	server.goFunc(server.runApplyLoop)
+	defer server.routines.Wait()
+	defer close(server.stopCh)
+
+	futures := make([]ApplyFuture, 2)
+	for i := range futures {
+		futures[i] = server.ApplyCommand(context.Background(), Command(fmt.Sprintf("command %d", i)))
+		server.handleLogOp(<-server.logOpsCh)
+		meta := ƒAssertNoError2(futures[i].Result())(t)
+		// The logs are committed while the state machine is blocked.
+		server.commit(meta.Index)
+		assert.Equal(t, meta.Index, server.commitIndex())
+	}
+	assert.Zero(t, server.lastApplied().Index)
+
+	close(stateMachine.unblockCh)
+	for i, f := range futures {
+		assert.Equal(t, []byte(fmt.Sprintf("command %d", i)), ƒAssertNoError2(f.Response())(t))
+	}
+	assert.Eventually(t, func() bool { return server.lastApplied().Index == server.commitIndex() },
+		time.Second, 10*time.Millisecond)
+
+	// The snapshots are taken in the apply loop.
+	snapshotFuture := newFutureTask[*stateMachineSnapshot, any](nil)
+	server.stateMachineSnapshotCh <- snapshotFuture
+	snapshot := ƒAssertNoError2(snapshotFuture.Result())(t)
+	assert.Equal(t, server.commitIndex(), snapshot.Index)
+}
+
+type testingLeadershipStateMachine struct {
+	testingStateMachine
+	events []string
+}
+
+func (m *testingLeadershipStateMachine) OnPromote(term uint64) {
+	m.events = append(m.events, fmt.Sprintf("promote %d", term))
+}
+
+func (m *testingLeadershipStateMachine) OnDemote() {
+	m.events = append(m.events, "demote")
+}
+
+func TestServerLeadershipHooks(t *testing.T) {
+	server := testingServer(t)
+	stateMachine := &testingLeadershipStateMachine{}
+	server.stateMachine = newStateMachineProxy(server, stateMachine)
+	server.serverState.stateCurrentTerm = 2
+	server.setRole(Leader)
+
+	server.promote()
+	future := newFuture[interface{}]()
+	server.applyResponses.add(&pb.LogMeta{Index: 1, Term: 2}, future)
+	// The leader loop is re-entered within the term.
+	server.leaveLeaderLoop()
+	server.promote()
+	assert.Equal(t, []string{"promote 2"}, stateMachine.events)
+
+	server.setRole(Follower)
+	server.leaveLeaderLoop()
+	assert.Equal(t, []string{"promote 2", "demote"}, stateMachine.events)
+	_, err := future.Result()
+	assert.ErrorIs(t, err, ErrLeadershipLost)
+
+	server.serverState.stateCurrentTerm = 3
+	server.setRole(Leader)
+	server.promote()
+	assert.Equal(t, []string{"promote 2", "demote", "promote 3"}, stateMachine.events)
+}
+
+type testingFailingStateMachine struct {
+	testingStateMachine
+}
+
+func (m *testingFailingStateMachine) Apply(command Command) interface{} {
+	switch string(command) {
+	case "invalid":
+		return errors.New("invalid command")
+	case "transient":
+		return TransientApplyError(errors.New("disk failure"))
+	}
+	return nil
+}
+
+func TestServerApplyError(t *testing.T) {
+	setup := func(policy ApplyErrorPolicy) *Server {
+		server := testingServer(t, ApplyErrorPolicyOption(policy))
+		server.logStore = newLogStoreProxy(server, newInternalLogStore())
+		server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+		server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{
+			Peers: []*pb.Peer{{Id: server.id, Endpoint: server.id}},
+		}}, 1))
+		server.snapshotService = newSnapshotService(server)
+		server.stateMachine = newStateMachineProxy(server, &testingFailingStateMachine{})
+		server.logOpsCh = make(chan logStoreOp, 8)
+		server.shutdownCh = make(chan error, 1)
+		server.serverState.stateCurrentTerm = 1
+		server.setRole(Leader)
+		return server
+	}
+	applyFn := func(server *Server, command string) ApplyFuture {
+		future := server.ApplyCommand(context.Background(), Command(command))
+		server.handleLogOp(<-server.logOpsCh)
+		ƒAssertNoError2(future.Result())(t)
+		return future
+	}
+
+	// The servers halt unless another policy is chosen.
+	assert.Equal(t, ApplyErrorHalt, testingServer(t).opts().applyErrorPolicy)
+
+	server := setup(ApplyErrorUnhealthy)
+	server.snapshotService.StartScheduler()
+	defer server.snapshotService.StopScheduler()
+	invalid := applyFn(server, "invalid")
+	server.commitAndApply(server.lastLogIndex())
+	_, err := invalid.Response()
+	assert.EqualError(t, err, "invalid command")
+	assert.True(t, server.healthy())
+	transient := applyFn(server, "transient")
+	next := applyFn(server, "command")
+	server.commitAndApply(server.lastLogIndex())
+	_, err = transient.Response()
+	assert.True(t, IsTransientApplyError(err))
+	assert.False(t, server.healthy())
+	// The logs after the error are applied.
+	assert.Equal(t, uint64(3), server.lastApplied().Index)
+	assert.Nil(t, ƒAssertNoError2(next.Response())(t))
+
+	server = setup(ApplyErrorHalt)
+	server.snapshotService.StartScheduler()
+	defer server.snapshotService.StopScheduler()
+	applyFn(server, "command")
+	applyFn(server, "transient")
+	applyFn(server, "command")
+	server.commitAndApply(server.lastLogIndex())
+	assert.Equal(t, uint64(1), server.lastApplied().Index)
+	assert.True(t, IsTransientApplyError(<-server.shutdownCh))
+	// No more logs are applied until the server restarts.
+	server.commitAndApply(server.lastLogIndex())
+	assert.Equal(t, uint64(1), server.lastApplied().Index)
+}
+
+func TestServerObserver(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	ch := make(chan Event, 8)
+	server.RegisterObserver(ch)
+
+	peer1 := &pb.Peer{Id: "1", Endpoint: "1"}
+	peer2 := &pb.Peer{Id: "2", Endpoint: "2"}
+	server.alterConfiguration(newConfiguration(&pb.Configuration{
+		Current: &pb.Config{Peers: []*pb.Peer{peer1, peer2}},
+	}, 1))
+	server.alterConfiguration(newConfiguration(&pb.Configuration{
+		Current: &pb.Config{Peers: []*pb.Peer{peer1}},
+	}, 2))
+
+	var events []string
+	for len(ch) > 0 {
+		event := <-ch
+		if peer, ok := event.Data.(*pb.Peer); ok {
+			events = append(events, string(event.Type)+" "+peer.Id)
+		}
+	}
+	assert.Equal(t, []string{"peer_added 1", "peer_added 2", "peer_removed 2"}, events)
+
+	// The channel of the observer is left open.
+	server.DeregisterObserver(ch)
+	server.publishEvent(EventElectionStarted, uint64(1))
+	select {
+	case _, ok := <-ch:
+		t.Fatalf("unexpected receive: open=%v", ok)
+	default:
+	}
+}
@@ -0,0 +1,39 @@
+package raft
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// testingServer returns a Server that is not started and only has the fields
+// required by the components under test.
+func testingServer(t testing.TB, opts ...ServerOption) *Server {
+	trans, err := newInternalTransport(newInternalTransClientLookup(), NewObjectID().Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		id:          NewObjectID().Hex(),
+		serverState: serverState{stateRole: Follower},
+		trans:       trans,
+		logger:      zap.NewNop().Sugar(),
+		stopCh:      make(chan struct{}),
+		closedCh:    make(chan struct{}),
+	}
+	server.options.Store(applyServerOpts(opts...))
+	server.rand = server.opts().newRand()
+	server.replScheduler = newReplScheduler(server)
+	// The configurations are empty until the tests set up the store.
+	server.confStore = &configurationStore{server: server}
+	server.confStore.SetCommitted(nil)
+	server.confStore.SetLatest(nil)
+	return server
+}
+
+// commitAndApply commits the logs up to commitIndex and applies them right
+// away, as the main loop and the apply loop do.
+func (s *Server) commitAndApply(commitIndex uint64) {
+	s.commit(commitIndex)
+	s.applyCommitted()
+}
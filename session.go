@@ -0,0 +1,278 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// Session is a client session registered with Server.RegisterSession. The
+// commands applied in the session are applied exactly once even if they are
+// retried, e.g., after the leader changes, as described in §6.3 of the Raft
+// dissertation. The servers cache the results of the commands until the
+// client receives them, and the sessions expire in the order of their last
+// use once there are more than the capacity set with SessionCapacityOption.
+// It is safe for concurrent use.
+type Session struct {
+	server *Server
+	id     uint64
+
+	mu          sync.Mutex // protects sequence and outstanding
+	sequence    uint64
+	outstanding map[uint64]struct{}
+}
+
+// RegisterSession registers a new client session in the cluster.
+func (s *Server) RegisterSession(ctx context.Context) (*Session, error) {
+	response, err := s.Apply(ctx, &pb.LogBody{Type: pb.LogType_REGISTER_SESSION}).Response()
+	if err != nil {
+		return nil, err
+	}
+	b, ok := response.([]byte)
+	if !ok || len(b) != 8 {
+		return nil, errors.New("malformed session ID")
+	}
+	return &Session{server: s, id: DecodeUint64(b), outstanding: map[uint64]struct{}{}}, nil
+}
+
+// ID returns the ID of the session, which is the index of the log that
+// registered the session.
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// ApplyCommand applies the command in the session with Server.Apply. The
+// command is retried with the RetryPolicy of the server while the leader is
+// changing. Response returns the result of StateMachine.Apply, or the cached
+// result as []byte if the command turns out to be applied by a previous try.
+// ErrUnknownSession is returned if the session has expired.
+func (s *Session) ApplyCommand(ctx context.Context, command Command) ApplyFuture {
+	s.mu.Lock()
+	s.sequence++
+	sequence := s.sequence
+	s.outstanding[sequence] = struct{}{}
+	acked := s.ackedSequence()
+	s.mu.Unlock()
+
+	body := &pb.LogBody{
+		Type:    pb.LogType_COMMAND,
+		Data:    command,
+		Session: &pb.SessionRequest{SessionId: s.id, Sequence: sequence, AckedSequence: acked},
+	}
+	t := newApplyFuture(body)
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.outstanding, sequence)
+			s.mu.Unlock()
+		}()
+		if err := retry(ctx, s.server.opts().retryPolicy, func() (bool, error) {
+			f := s.server.Apply(ctx, body)
+			meta, err := f.Result()
+			if err != nil {
+				return retryableSessionError(err), err
+			}
+			response, err := f.Response()
+			if err != nil {
+				return retryableSessionError(err), err
+			}
+			t.setResult(meta, nil)
+			t.response.setResult(response, nil)
+			return false, nil
+		}); err != nil {
+			t.fail(err)
+		}
+	}()
+	return t
+}
+
+// ackedSequence returns the sequence number up to which all commands have
+// been completed.
+// s.mu must be held.
+func (s *Session) ackedSequence() uint64 {
+	acked := s.sequence
+	for sequence := range s.outstanding {
+		if sequence <= acked {
+			acked = sequence - 1
+		}
+	}
+	return acked
+}
+
+// retryableSessionError reports whether the command may be retried in the
+// session after the error, i.e., the command may or may not be applied.
+func retryableSessionError(err error) bool {
+	return errors.Is(err, ErrNonLeader) || errors.Is(err, ErrNoLeader) ||
+		errors.Is(err, ErrLeadershipLost) || errors.Is(err, ErrLeadershipTransfer)
+}
+
+// sessionTable holds the client sessions along with the state machine. It
+// changes only with the applied logs, so that it's identical on all servers.
+// Unsafe for concurrent use.
+type sessionTable struct {
+	sessions map[uint64]*pb.Session
+}
+
+// register adds the session registered by the log at the index, and expires
+// the least recently used session if there are more than capacity sessions.
+func (t *sessionTable) register(index uint64, capacity int) {
+	if t.sessions == nil {
+		t.sessions = map[uint64]*pb.Session{}
+	}
+	t.sessions[index] = &pb.Session{Id: index, LastIndex: index, Responses: map[uint64][]byte{}}
+	for len(t.sessions) > capacity {
+		var expired *pb.Session
+		for _, session := range t.sessions {
+			if expired == nil || session.LastIndex < expired.LastIndex {
+				expired = session
+			}
+		}
+		delete(t.sessions, expired.Id)
+	}
+}
+
+// use returns the session of the request made by the log at the index after
+// discarding the responses acknowledged by the client.
+func (t *sessionTable) use(request *pb.SessionRequest, index uint64) (*pb.Session, error) {
+	session, ok := t.sessions[request.SessionId]
+	if !ok {
+		return nil, ErrUnknownSession
+	}
+	session.LastIndex = index
+	if request.AckedSequence > session.AckedSequence {
+		for sequence := range session.Responses {
+			if sequence <= request.AckedSequence {
+				delete(session.Responses, sequence)
+			}
+		}
+		session.AckedSequence = request.AckedSequence
+	}
+	if request.Sequence <= session.AckedSequence {
+		return nil, ErrStaleSequence
+	}
+	return session, nil
+}
+
+// copy returns a deep copy of the sessions.
+func (t *sessionTable) copy() *pb.SessionTable {
+	table := &pb.SessionTable{}
+	for _, session := range t.sessions {
+		table.Sessions = append(table.Sessions, proto.Clone(session).(*pb.Session))
+	}
+	return table
+}
+
+// restore replaces the sessions with those in the table.
+func (t *sessionTable) restore(table *pb.SessionTable) {
+	t.sessions = map[uint64]*pb.Session{}
+	for _, session := range table.GetSessions() {
+		if session.Responses == nil {
+			session.Responses = map[uint64][]byte{}
+		}
+		t.sessions[session.Id] = session
+	}
+}
+
+// sessionSnapshotMagic marks the snapshots that carry the client sessions in
+// front of the data of the state machine.
+var sessionSnapshotMagic = []byte("RAFTSESS")
+
+// writeSessions writes the client sessions in front of the data of the state
+// machine. Nothing is written if there are no sessions, which leaves the
+// snapshots of the servers without sessions unchanged.
+func writeSessions(w io.Writer, table *pb.SessionTable) error {
+	if len(table.GetSessions()) == 0 {
+		return nil
+	}
+	b, err := proto.Marshal(table)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, len(sessionSnapshotMagic)+8)
+	copy(header, sessionSnapshotMagic)
+	binary.BigEndian.PutUint64(header[len(sessionSnapshotMagic):], uint64(len(b)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadSnapshotSessions reads the client sessions carried in front of the data
+// of a snapshot, if any, and returns the reader of the remaining data of the
+// state machine, i.e., what StateMachine.Restore() reads from the snapshot.
+func ReadSnapshotSessions(r io.Reader) (*pb.SessionTable, io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(sessionSnapshotMagic))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if !bytes.Equal(magic, sessionSnapshotMagic) {
+		return &pb.SessionTable{}, br, nil
+	}
+	header := make([]byte, len(sessionSnapshotMagic)+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint64(header[len(sessionSnapshotMagic):]))
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, nil, err
+	}
+	table := &pb.SessionTable{}
+	if err := proto.Unmarshal(b, table); err != nil {
+		return nil, nil, err
+	}
+	return table, br, nil
+}
+
+// sessionSnapshot is a Snapshot whose reader skips the client sessions.
+type sessionSnapshot struct {
+	Snapshot
+	reader io.Reader
+	ctx    context.Context
+}
+
+func (s *sessionSnapshot) Reader() (io.Reader, error) {
+	return s.reader, nil
+}
+
+func (s *sessionSnapshot) Context() context.Context {
+	return s.ctx
+}
+
+// applySession applies the log in the session of the request, or returns the
+// cached result if the log is a retry of an applied command.
+// Unsafe for concurrent use.
+func (a *stateMachineProxy) applySession(log *pb.Log) (interface{}, error) {
+	request := log.Body.Session
+	session, err := a.sessions.use(request, log.Meta.Index)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := session.Responses[request.Sequence]; ok {
+		if len(cached) == 0 {
+			return nil, nil
+		}
+		return cached, nil
+	}
+	response, err := a.applyCommand(log)
+	if err != nil {
+		// The command is left unapplied, so the retries are applied again.
+		return nil, err
+	}
+	cached, err := encodeApplyResponse(response)
+	if err != nil {
+		a.server.logger.Warnw("error encoding the result of the log for the session",
+			logFields(a.server, zap.Object("log", log.Meta), zap.Error(err))...)
+	}
+	session.Responses[request.Sequence] = cached
+	return response, nil
+}
@@ -0,0 +1,116 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+)
+
+type testingCountingStateMachine struct {
+	testingStateMachine
+	applied int
+}
+
+func (m *testingCountingStateMachine) Apply(command Command) interface{} {
+	m.applied++
+	return []byte{byte(m.applied)}
+}
+
+func TestStateMachineProxySessions(t *testing.T) {
+	server := testingServer(t, SessionCapacityOption(1))
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.snapshotService = newSnapshotService(server)
+	server.snapshotService.StartScheduler()
+	defer server.snapshotService.StopScheduler()
+	stateMachine := &testingCountingStateMachine{}
+	proxy := newStateMachineProxy(server, stateMachine)
+
+	index := uint64(0)
+	applyFn := func(body *pb.LogBody) (interface{}, error) {
+		index++
+		return proxy.Apply(&pb.Log{Meta: &pb.LogMeta{Index: index, Term: 1}, Body: body})
+	}
+	commandFn := func(sessionID, sequence, acked uint64) (interface{}, error) {
+		return applyFn(&pb.LogBody{
+			Type:    pb.LogType_COMMAND,
+			Session: &pb.SessionRequest{SessionId: sessionID, Sequence: sequence, AckedSequence: acked},
+		})
+	}
+
+	assert.Equal(t, EncodeUint64(1), ƒAssertNoError2(applyFn(&pb.LogBody{Type: pb.LogType_REGISTER_SESSION}))(t))
+	assert.Equal(t, []byte{1}, ƒAssertNoError2(commandFn(1, 1, 0))(t))
+	// The retry returns the cached result without applying the command.
+	assert.Equal(t, []byte{1}, ƒAssertNoError2(commandFn(1, 1, 0))(t))
+	assert.Equal(t, 1, stateMachine.applied)
+	assert.Equal(t, []byte{2}, ƒAssertNoError2(commandFn(1, 2, 1))(t))
+	_, err := commandFn(1, 1, 1)
+	assert.ErrorIs(t, err, ErrStaleSequence)
+	_, err = commandFn(2, 1, 0)
+	assert.ErrorIs(t, err, ErrUnknownSession)
+
+	// The sessions are carried by the snapshots.
+	snapshot := ƒAssertNoError2(proxy.Snapshot())(t)
+	assert.Len(t, snapshot.Sessions.Sessions, 1)
+	var buf bytes.Buffer
+	assert.NoError(t, writeSessions(&buf, snapshot.Sessions))
+	buf.WriteString("data")
+	sessions, reader := ƒAssertNoError3(ReadSnapshotSessions(&buf))(t)
+	assert.Equal(t, "data", string(ƒAssertNoError2(io.ReadAll(reader))(t)))
+	restored := &sessionTable{}
+	restored.restore(sessions)
+	assert.Equal(t, []byte{2}, restored.sessions[1].Responses[2])
+
+	// The least recently used session expires.
+	assert.Equal(t, EncodeUint64(index+1), ƒAssertNoError2(applyFn(&pb.LogBody{Type: pb.LogType_REGISTER_SESSION}))(t))
+	_, err = commandFn(1, 3, 2)
+	assert.ErrorIs(t, err, ErrUnknownSession)
+	assert.Equal(t, 2, stateMachine.applied)
+
+	// The snapshots without sessions are read as is.
+	sessions, reader = ƒAssertNoError3(ReadSnapshotSessions(bytes.NewReader([]byte("data"))))(t)
+	assert.Empty(t, sessions.Sessions)
+	assert.Equal(t, "data", string(ƒAssertNoError2(io.ReadAll(reader))(t)))
+}
+
+func TestServerSession(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.snapshotService = newSnapshotService(server)
+	server.snapshotService.StartScheduler()
+	defer server.snapshotService.StopScheduler()
+	stateMachine := &testingCountingStateMachine{}
+	server.stateMachine = newStateMachineProxy(server, stateMachine)
+	server.serverState.stateCurrentTerm = 1
+	server.setRole(Leader)
+
+	// The logs are committed once they are appended, except that the leader
+	// loses the leadership before the first command is committed, which is
+	// committed along with the retry.
+	server.logOpsCh = make(chan logStoreOp)
+	defer close(server.logOpsCh)
+	go func() {
+		commands := 0
+		for op := range server.logOpsCh {
+			server.handleLogOp(op)
+			if appendOp, ok := op.(*logStoreAppendOp); ok && appendOp.Task()[0].Type == pb.LogType_COMMAND {
+				if commands++; commands == 1 {
+					server.applyResponses.fail(ErrLeadershipLost)
+					continue
+				}
+			}
+			server.commitAndApply(server.lastLogIndex())
+		}
+	}()
+
+	session := ƒAssertNoError2(server.RegisterSession(context.Background()))(t)
+	assert.Equal(t, uint64(1), session.ID())
+	future := session.ApplyCommand(context.Background(), Command("command"))
+	assert.Equal(t, []byte{1}, ƒAssertNoError2(future.Response())(t))
+	assert.Equal(t, 1, stateMachine.applied)
+	future = session.ApplyCommand(context.Background(), Command("command"))
+	assert.Equal(t, []byte{2}, ƒAssertNoError2(future.Response())(t))
+}
@@ -0,0 +1,47 @@
+package raft
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+// A failing seed replays the same events when rerun alone with -sim.seed.
+var (
+	simSeeds = flag.Int("sim.seeds", 100, "the number of the seeds simulated by TestSimulation")
+	simSteps = flag.Int("sim.steps", 100, "the number of the steps simulated for each seed")
+	simSeed  = flag.Int64("sim.seed", 0, "the only seed simulated by TestSimulation, if not zero")
+)
+
+func TestSimulation(t *testing.T) {
+	seeds, steps := *simSeeds, *simSteps
+	if testing.Short() {
+		seeds = 1
+	}
+	first := int64(1)
+	if *simSeed != 0 {
+		first, seeds = *simSeed, 1
+	}
+	start := time.Now()
+	for seed := first; seed < first+int64(seeds); seed++ {
+		// The clusters of 3 and 5 servers are simulated in turn.
+		c := newSimCluster(t, seed, 3+2*int(seed%2))
+		c.Run(steps)
+		c.Close()
+		t.Logf("seed %d: %d terms, %d logs committed, digest %x", seed, len(c.leaders), len(c.committed), c.Digest())
+	}
+	t.Logf("%.1f clusters/s", float64(seeds)/time.Since(start).Seconds())
+}
+
+func TestSimulationReplay(t *testing.T) {
+	var digests [2]uint64
+	for i := range digests {
+		c := newSimCluster(t, 7, 5)
+		c.Run(100)
+		c.Close()
+		digests[i] = c.Digest()
+	}
+	if digests[0] != digests[1] {
+		t.Fatalf("the seed replayed different events: digests %x and %x", digests[0], digests[1])
+	}
+}
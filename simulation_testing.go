@@ -0,0 +1,743 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/proto"
+)
+
+// errSimDropped is returned by the simTransports for the RPCs dropped by the
+// simNetwork.
+var errSimDropped = errors.New("dropped by the simulated network")
+
+// simMessage is an RPC sent through the simNetwork. It's delivered to the peer
+// as a request, and then back to the sender as a response, each as an event of
+// the simCluster.
+type simMessage struct {
+	ctx      context.Context // the context of the sender
+	from, to string
+	kind     string
+	request  interface{}
+	// call delivers the request through the internal transport.
+	call func() (interface{}, error)
+
+	// The fields below are set by the simCluster, or by the goroutine
+	// calling call before the message is sent back.
+	seq       uint64 // the order of the request among the events
+	at        time.Time
+	responded bool
+	response  interface{}
+	err       error
+	doneCh    chan struct{}
+}
+
+// fail fails the message, which unblocks its sender.
+func (m *simMessage) fail(err error) {
+	m.response, m.err = nil, err
+	close(m.doneCh)
+}
+
+// simNetwork holds the messages sent between the simulated servers until the
+// simCluster dispatches them, so that their order, their latencies, and the
+// drops are decided by the seed rather than by the scheduling of goroutines.
+type simNetwork struct {
+	lookup *internalTransClientLookup
+
+	mu sync.Mutex // protects sent and closed
+	// sent holds the requests and the responses sent since the messages were
+	// last collected by the simCluster.
+	sent   []*simMessage
+	closed bool
+
+	// The fields below are only accessed by the simCluster.
+	// groups maps the servers to their partitions. The servers talk only to
+	// those in the same partition.
+	groups map[string]int
+	// dropRate is the probability of each request or response being dropped.
+	dropRate float64
+}
+
+func newSimNetwork() *simNetwork {
+	return &simNetwork{lookup: newInternalTransClientLookup(), groups: map[string]int{}}
+}
+
+// Partition splits the network so that the servers only reach those in the
+// same group. The servers not in any group are isolated.
+func (n *simNetwork) Partition(groups ...[]string) {
+	n.groups = map[string]int{}
+	for i, group := range groups {
+		for _, id := range group {
+			n.groups[id] = i + 1
+		}
+	}
+}
+
+// Heal removes the partitions.
+func (n *simNetwork) Heal() {
+	n.groups = map[string]int{}
+}
+
+// SetDropRate sets the probability of each request or response being dropped.
+func (n *simNetwork) SetDropRate(rate float64) {
+	n.dropRate = rate
+}
+
+// send holds the request or the response until it's collected.
+func (n *simNetwork) send(m *simMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		m.fail(errSimDropped)
+		return
+	}
+	n.sent = append(n.sent, m)
+}
+
+// collect returns the messages sent since the last call.
+func (n *simNetwork) collect() []*simMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sent := n.sent
+	n.sent = nil
+	return sent
+}
+
+// close fails the messages held and those sent afterwards.
+func (n *simNetwork) close() []*simMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	sent := n.sent
+	n.sent = nil
+	return sent
+}
+
+// simCall sends the RPC from a server to the peer, and waits until its
+// response is delivered or it's dropped.
+func simCall[T any](
+	ctx context.Context, n *simNetwork, from string, peer *pb.Peer, kind string, request interface{}, call func() (T, error),
+) (T, error) {
+	var zero T
+	m := &simMessage{
+		ctx:     ctx,
+		from:    from,
+		to:      peer.Id,
+		kind:    kind,
+		request: request,
+		call:    func() (interface{}, error) { return call() },
+		doneCh:  make(chan struct{}),
+	}
+	n.send(m)
+	select {
+	case <-m.doneCh:
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+	if m.err != nil {
+		return zero, m.err
+	}
+	return m.response.(T), nil
+}
+
+// simTransport is the Transport of a simulated server, which sends the RPCs
+// through the simNetwork.
+type simTransport struct {
+	*internalTransport
+	network *simNetwork
+	id      string
+}
+
+func (t *simTransport) AppendEntries(
+	ctx context.Context, peer *pb.Peer, request *pb.AppendEntriesRequest,
+) (*pb.AppendEntriesResponse, error) {
+	return simCall(ctx, t.network, t.id, peer, "AppendEntries", request, func() (*pb.AppendEntriesResponse, error) {
+		return t.internalTransport.AppendEntries(ctx, peer, request)
+	})
+}
+
+func (t *simTransport) RequestVote(
+	ctx context.Context, peer *pb.Peer, request *pb.RequestVoteRequest,
+) (*pb.RequestVoteResponse, error) {
+	return simCall(ctx, t.network, t.id, peer, "RequestVote", request, func() (*pb.RequestVoteResponse, error) {
+		return t.internalTransport.RequestVote(ctx, peer, request)
+	})
+}
+
+func (t *simTransport) InstallSnapshot(
+	ctx context.Context, peer *pb.Peer, requestMeta *pb.InstallSnapshotRequestMeta, reader io.Reader,
+) (*pb.InstallSnapshotResponse, error) {
+	return simCall(ctx, t.network, t.id, peer, "InstallSnapshot", requestMeta, func() (*pb.InstallSnapshotResponse, error) {
+		return t.internalTransport.InstallSnapshot(ctx, peer, requestMeta, reader)
+	})
+}
+
+func (t *simTransport) ApplyLog(
+	ctx context.Context, peer *pb.Peer, request *pb.ApplyLogRequest,
+) (*pb.ApplyLogResponse, error) {
+	return simCall(ctx, t.network, t.id, peer, "ApplyLog", request, func() (*pb.ApplyLogResponse, error) {
+		return t.internalTransport.ApplyLog(ctx, peer, request)
+	})
+}
+
+func (t *simTransport) ChangeMembership(
+	ctx context.Context, peer *pb.Peer, request *pb.MembershipChangeRequest,
+) (*pb.MembershipChangeResponse, error) {
+	return simCall(ctx, t.network, t.id, peer, "ChangeMembership", request, func() (*pb.MembershipChangeResponse, error) {
+		return t.internalTransport.ChangeMembership(ctx, peer, request)
+	})
+}
+
+func (t *simTransport) TimeoutNow(
+	ctx context.Context, peer *pb.Peer, request *pb.TimeoutNowRequest,
+) (*pb.TimeoutNowResponse, error) {
+	return simCall(ctx, t.network, t.id, peer, "TimeoutNow", request, func() (*pb.TimeoutNowResponse, error) {
+		return t.internalTransport.TimeoutNow(ctx, peer, request)
+	})
+}
+
+// simEntry is a log applied to a simStateMachine.
+type simEntry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
+}
+
+// simStateMachine records the logs applied.
+type simStateMachine struct {
+	mu      sync.Mutex // protects applied
+	applied []simEntry
+}
+
+func (m *simStateMachine) Apply(command Command) interface{} {
+	panic("ApplyLog is called instead")
+}
+
+func (m *simStateMachine) ApplyLog(log *pb.Log) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applied = append(m.applied, simEntry{Index: log.Meta.Index, Term: log.Meta.Term, Data: log.Body.Data})
+	return nil
+}
+
+func (m *simStateMachine) Snapshot() (StateMachineSnapshot, error) {
+	return nil, errors.New("snapshots are not simulated")
+}
+
+func (m *simStateMachine) Restore(snapshot Snapshot) error {
+	return errors.New("snapshots are not simulated")
+}
+
+// appliedSince returns the logs applied after the first n ones.
+func (m *simStateMachine) appliedSince(n int) []simEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]simEntry(nil), m.applied[n:]...)
+}
+
+type simServer struct {
+	id       string
+	server   *Server
+	fsm      *simStateMachine
+	eventCh  chan Event
+	observed int // the number of the applied logs observed
+}
+
+// simCommitted is a log observed applied by any server.
+type simCommitted struct {
+	simEntry
+	// step is the step in which the log is first observed applied.
+	step int
+}
+
+// simCluster runs the servers of a simulated cluster, and checks the safety
+// invariants of Raft after each step:
+//   - Election safety: at most one leader is elected in a term.
+//   - Log matching: the logs of two servers with the same index and term are
+//     identical, and so are all the logs before them.
+//   - Leader completeness: the leaders elected after a log is committed have
+//     the log.
+//   - State machine safety: the servers apply the same log at an index.
+//
+// The simulations are deterministic. A simCluster is a discrete event
+// scheduler over a ManualClock: the requests and the responses held by the
+// simNetwork, and the timers of the servers, are dispatched one at a time in
+// the order of their virtual times, and each event is processed by the
+// servers until no goroutine is runnable before the next one is dispatched.
+// The messages sent while processing an event are sorted before they are
+// given their latencies and their drops by the random source seeded with the
+// seed, as are the faults and the commands, so that a seed always replays the
+// same events. GOMAXPROCS is set to 1 while a simCluster runs, which keeps the
+// goroutines woken by an event from running in parallel, and the garbage
+// collector is disabled, since a goroutine waiting to assist it is not
+// counted as runnable.
+type simCluster struct {
+	t       testing.TB
+	seed    int64
+	rand    *rand.Rand
+	clock   *ManualClock
+	network *simNetwork
+	servers []*simServer
+	step    int
+	procs   int
+	gcPct   int
+
+	// events holds the requests and the responses to be dispatched.
+	events []*simMessage
+	seq    uint64
+	// trace digests the events dispatched and the states after each step,
+	// which are identical in the runs of a seed.
+	trace hash.Hash64
+
+	// leaders maps the terms to the servers elected in them.
+	leaders map[uint64]string
+	// committed maps the indexes to the logs observed applied.
+	committed map[uint64]simCommitted
+}
+
+const (
+	// simStepDuration is the virtual time advanced in each step.
+	simStepDuration = 10 * time.Millisecond
+	// simMinLatency and simMaxLatency bound the latency of each request or
+	// response.
+	simMinLatency = 1 * time.Millisecond
+	simMaxLatency = 5 * time.Millisecond
+	// simElectionTimeout and simHeartbeatInterval are shortened to have more
+	// elections in fewer steps.
+	simElectionTimeout   = 150 * time.Millisecond
+	simHeartbeatInterval = 50 * time.Millisecond
+)
+
+func newSimCluster(t testing.TB, seed int64, n int) *simCluster {
+	c := &simCluster{
+		t:         t,
+		seed:      seed,
+		rand:      rand.New(rand.NewSource(seed)),
+		clock:     NewManualClock(time.Unix(0, 0)),
+		network:   newSimNetwork(),
+		procs:     runtime.GOMAXPROCS(1),
+		gcPct:     debug.SetGCPercent(-1),
+		trace:     fnv.New64a(),
+		leaders:   map[uint64]string{},
+		committed: map[uint64]simCommitted{},
+	}
+	peers := make([]*pb.Peer, n)
+	for i := range peers {
+		id := fmt.Sprint(i + 1)
+		peers[i] = &pb.Peer{Id: id, Endpoint: id}
+	}
+	for i, peer := range peers {
+		trans, err := newInternalTransport(c.network.lookup, peer.Endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stableStore, err := newInternalStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsm := &simStateMachine{}
+		server, err := NewServer(ServerCoreOptions{
+			Id:             peer.Id,
+			InitialCluster: peers,
+			StableStore:    stableStore,
+			StateMachine:   fsm,
+			SnapshotStore:  NewObjectSnapshotStore(NewInmemObjectStore(), ""),
+			Transport:      &simTransport{internalTransport: trans, network: c.network, id: peer.Id},
+		},
+			APIServerEnabledOption(false),
+			ClockOption(c.clock),
+			ElectionTimeoutOption(simElectionTimeout),
+			FollowerTimeoutOption(simElectionTimeout),
+			HeartbeatIntervalOption(simHeartbeatInterval),
+			LogLevelOption(zapcore.FatalLevel),
+			RandSeedOption(seed+int64(i)),
+			// The jitter of the default RetryPolicy is not seeded.
+			RetryPolicyOption(ExponentialRetryPolicy{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}),
+			SnapshotPolicyOption(SnapshotPolicy{Entries: math.MaxUint64}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &simServer{id: peer.Id, server: server, fsm: fsm, eventCh: make(chan Event, 1024)}
+		server.RegisterObserver(s.eventCh)
+		go server.Serve()
+		c.servers = append(c.servers, s)
+		c.wait()
+	}
+	return c
+}
+
+// Close shuts down the servers, and fails the messages not yet dispatched.
+func (c *simCluster) Close() {
+	for _, m := range append(c.network.close(), c.events...) {
+		m.fail(errSimDropped)
+	}
+	c.events = nil
+	for _, s := range c.servers {
+		s.server.Shutdown(nil)
+	}
+	for _, s := range c.servers {
+		<-s.server.closedCh
+	}
+	runtime.GOMAXPROCS(c.procs)
+	debug.SetGCPercent(c.gcPct)
+}
+
+// Leader returns the leader of the highest term, if any.
+func (c *simCluster) Leader() *simServer {
+	var leader *simServer
+	for _, s := range c.servers {
+		if s.server.role() == Leader && (leader == nil || s.server.currentTerm() > leader.server.currentTerm()) {
+			leader = s
+		}
+	}
+	return leader
+}
+
+// IDs returns the IDs of the servers.
+func (c *simCluster) IDs() []string {
+	ids := make([]string, len(c.servers))
+	for i, s := range c.servers {
+		ids[i] = s.id
+	}
+	return ids
+}
+
+// Step dispatches the events due in the next simStepDuration of virtual time,
+// and checks the invariants.
+func (c *simCluster) Step() {
+	c.step++
+	c.runUntil(c.clock.Now().Add(simStepDuration))
+	for _, s := range c.servers {
+		fmt.Fprintf(c.trace, "%d/%d/%d/%d/%d;", s.server.role(), s.server.currentTerm(),
+			s.server.lastLogIndex(), s.server.commitIndex(), s.server.lastApplied().Index)
+	}
+	c.check()
+}
+
+// Digest returns the digest of the events dispatched and the states of the
+// servers after each step so far.
+func (c *simCluster) Digest() uint64 {
+	return c.trace.Sum64()
+}
+
+// runUntil dispatches the events due by the deadline in the order of their
+// times. A timer is fired before a message due at the same time.
+func (c *simCluster) runUntil(deadline time.Time) {
+	for {
+		c.wait()
+		c.collect()
+		next := c.nextEvent()
+		timerAt, ok := c.clock.nextDeadline()
+		switch {
+		case ok && !timerAt.After(deadline) && (next < 0 || !timerAt.After(c.events[next].at)):
+			c.clock.fireNext(deadline)
+			fmt.Fprintf(c.trace, "%d timer;", timerAt.UnixNano())
+		case next >= 0 && !c.events[next].at.After(deadline):
+			m := c.events[next]
+			c.events = append(c.events[:next], c.events[next+1:]...)
+			c.clock.Advance(m.at.Sub(c.clock.Now()))
+			c.dispatch(m)
+		default:
+			c.clock.Advance(deadline.Sub(c.clock.Now()))
+			return
+		}
+	}
+}
+
+// nextEvent returns the index of the message due first in events, or -1 if
+// there's none.
+func (c *simCluster) nextEvent() int {
+	first := -1
+	for i, m := range c.events {
+		if first < 0 || m.at.Before(c.events[first].at) ||
+			m.at.Equal(c.events[first].at) && (m.seq < c.events[first].seq || m.seq == c.events[first].seq && !m.responded) {
+			first = i
+		}
+	}
+	return first
+}
+
+// collect schedules the messages sent since the last event. The requests are
+// sorted by their senders, their receivers, their kinds, and their contents,
+// and the responses by their requests, before the latencies are drawn.
+func (c *simCluster) collect() {
+	sent := c.network.collect()
+	if len(sent) == 0 {
+		return
+	}
+	sort.Slice(sent, func(i, j int) bool {
+		a, b := sent[i], sent[j]
+		if a.responded != b.responded {
+			return !a.responded
+		}
+		if a.responded {
+			return a.seq < b.seq
+		}
+		if a.from != b.from {
+			return a.from < b.from
+		}
+		if a.to != b.to {
+			return a.to < b.to
+		}
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		return bytes.Compare(simMarshal(a.request), simMarshal(b.request)) < 0
+	})
+	for _, m := range sent {
+		if !m.responded {
+			c.seq++
+			m.seq = c.seq
+		}
+		m.at = c.clock.Now().Add(simMinLatency + time.Duration(c.rand.Int63n(int64(simMaxLatency-simMinLatency))))
+		c.events = append(c.events, m)
+	}
+}
+
+func simMarshal(request interface{}) []byte {
+	message, ok := request.(proto.Message)
+	if !ok {
+		return nil
+	}
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	return b
+}
+
+// deliverable decides whether a message from a server reaches another.
+func (c *simCluster) deliverable(from, to string) bool {
+	groups := c.network.groups
+	if len(groups) > 0 && (groups[from] == 0 || groups[from] != groups[to]) {
+		return false
+	}
+	return c.network.dropRate <= 0 || c.rand.Float64() >= c.network.dropRate
+}
+
+// dispatch delivers the request to its receiver, or the response to its
+// sender, unless it's dropped.
+func (c *simCluster) dispatch(m *simMessage) {
+	from, to := m.from, m.to
+	if m.responded {
+		from, to = to, from
+	}
+	delivered := c.deliverable(from, to)
+	// The request abandoned by its sender is not delivered, for the internal
+	// transport would choose between delivering it and failing it at random.
+	abandoned := !m.responded && m.ctx.Err() != nil
+	fmt.Fprintf(c.trace, "%d %s %s>%s %t %t;", m.at.UnixNano(), m.kind, from, to, delivered, abandoned)
+	switch {
+	case !delivered:
+		m.fail(errSimDropped)
+	case abandoned:
+		m.fail(NotDeliveredError(m.ctx.Err()))
+	case m.responded:
+		close(m.doneCh)
+	default:
+		go func() {
+			response, err := m.call()
+			m.response, m.err, m.responded = response, err, true
+			c.network.send(m)
+		}()
+	}
+}
+
+// simRunnableMetric is the runtime metric of the runnable goroutines, which
+// is supported since Go 1.26.
+const simRunnableMetric = "/sched/goroutines/runnable:goroutines"
+
+// wait returns once no other goroutine is runnable, i.e., the servers have
+// processed the last event and are blocked on the next ones. With GOMAXPROCS
+// set to 1, the goroutines only run while the calling goroutine yields.
+func (c *simCluster) wait() {
+	sample := []metrics.Sample{{Name: simRunnableMetric}}
+	for {
+		metrics.Read(sample)
+		var runnable uint64
+		if sample[0].Value.Kind() == metrics.KindUint64 {
+			runnable = sample[0].Value.Uint64()
+		} else {
+			runnable = simRunnableFromStacks()
+		}
+		if runnable == 0 {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// simRunnableFromStacks counts the runnable goroutines in the stack traces,
+// for the runtimes without simRunnableMetric.
+func simRunnableFromStacks() uint64 {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return uint64(bytes.Count(buf[:n], []byte(" [runnable")))
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func (c *simCluster) fatalf(format string, args ...interface{}) {
+	c.t.Helper()
+	c.t.Fatalf("seed %d, step %d: %s", c.seed, c.step, fmt.Sprintf(format, args...))
+}
+
+func (c *simCluster) check() {
+	c.t.Helper()
+	c.checkElectionSafety()
+	c.checkStateMachineSafety()
+	c.checkLogMatching()
+}
+
+// checkElectionSafety checks the elections won, and the leader completeness of
+// the winners.
+func (c *simCluster) checkElectionSafety() {
+	c.t.Helper()
+	for _, s := range c.servers {
+		for drained := false; !drained; {
+			select {
+			case e := <-s.eventCh:
+				if e.Type != EventElectionWon {
+					continue
+				}
+				term := e.Data.(uint64)
+				if leader, ok := c.leaders[term]; ok && leader != s.id {
+					c.fatalf("election safety violated: %s and %s elected in term %d", leader, s.id, term)
+				}
+				c.leaders[term] = s.id
+				c.checkLeaderCompleteness(s, term)
+			default:
+				drained = true
+			}
+		}
+	}
+}
+
+// checkLeaderCompleteness checks that the server elected in the term has the
+// logs committed before the step.
+func (c *simCluster) checkLeaderCompleteness(s *simServer, term uint64) {
+	c.t.Helper()
+	for _, committed := range c.committed {
+		if committed.step >= c.step {
+			continue
+		}
+		log, err := s.server.logStore.Entry(committed.Index)
+		if err != nil {
+			c.fatalf("error reading log %d of %s: %v", committed.Index, s.id, err)
+		}
+		if log == nil || log.Meta.Term != committed.Term || !bytes.Equal(log.Body.Data, committed.Data) {
+			c.fatalf("leader completeness violated: %s elected in term %d lacks committed log %d",
+				s.id, term, committed.Index)
+		}
+	}
+}
+
+// checkStateMachineSafety collects the logs applied in the step, and checks
+// that they match those applied by the other servers.
+func (c *simCluster) checkStateMachineSafety() {
+	c.t.Helper()
+	for _, s := range c.servers {
+		for _, e := range s.fsm.appliedSince(s.observed) {
+			s.observed++
+			if committed, ok := c.committed[e.Index]; !ok {
+				c.committed[e.Index] = simCommitted{simEntry: e, step: c.step}
+			} else if committed.Term != e.Term || !bytes.Equal(committed.Data, e.Data) {
+				c.fatalf("state machine safety violated: %s applied %d/%d %q, others applied %d/%d %q",
+					s.id, e.Index, e.Term, e.Data, committed.Index, committed.Term, committed.Data)
+			}
+		}
+	}
+}
+
+// checkLogMatching compares the logs of each pair of the servers from the last
+// index they both have, and checks that all logs are identical once the terms
+// match. The logs applied by both servers are left to the state machine safety
+// check.
+func (c *simCluster) checkLogMatching() {
+	c.t.Helper()
+	for i, a := range c.servers {
+		for _, b := range c.servers[i+1:] {
+			last := a.server.lastLogIndex()
+			if l := b.server.lastLogIndex(); l < last {
+				last = l
+			}
+			applied := a.server.lastApplied().Index
+			if l := b.server.lastApplied().Index; l < applied {
+				applied = l
+			}
+			matched := false
+			for index := last; index > applied; index-- {
+				logA, errA := a.server.logStore.Entry(index)
+				logB, errB := b.server.logStore.Entry(index)
+				if errA != nil || errB != nil || logA == nil || logB == nil {
+					// The logs may have been compacted into a snapshot.
+					break
+				}
+				if logA.Meta.Term != logB.Meta.Term {
+					if matched {
+						c.fatalf("log matching violated: %s and %s differ at %d", a.id, b.id, index)
+					}
+					continue
+				}
+				matched = true
+				if logA.Body.Type != logB.Body.Type || !bytes.Equal(logA.Body.Data, logB.Body.Data) {
+					c.fatalf("log matching violated: %s and %s differ at %d/%d", a.id, b.id, index, logA.Meta.Term)
+				}
+			}
+		}
+	}
+}
+
+// Run runs the steps with the faults and the commands chosen by the seed:
+// random partitions, an isolated leader, lossy links, and the heals, and a
+// command applied on the leader at about every other step.
+func (c *simCluster) Run(steps int) {
+	c.t.Helper()
+	for i := 0; i < steps; i++ {
+		switch r := c.rand.Float64(); {
+		case r < 0.02:
+			ids := c.IDs()
+			c.rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+			split := 1 + c.rand.Intn(len(ids)-1)
+			c.network.Partition(ids[:split], ids[split:])
+		case r < 0.03:
+			if leader := c.Leader(); leader != nil {
+				var others []string
+				for _, id := range c.IDs() {
+					if id != leader.id {
+						others = append(others, id)
+					}
+				}
+				c.network.Partition([]string{leader.id}, others)
+			}
+		case r < 0.04:
+			c.network.SetDropRate(c.rand.Float64() * 0.3)
+		case r < 0.08:
+			c.network.Heal()
+			c.network.SetDropRate(0)
+		}
+		if c.rand.Intn(2) == 0 {
+			if leader := c.Leader(); leader != nil {
+				leader.server.ApplyCommand(context.Background(), Command(fmt.Sprintf("%d-%d", c.seed, c.step)))
+			}
+		}
+		c.Step()
+	}
+}
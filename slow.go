@@ -0,0 +1,43 @@
+package raft
+
+import (
+	"time"
+)
+
+// SlowOpThresholds are the durations beyond which the operations are logged
+// as slow with warnings. Slow disks and state machines are the usual causes
+// of unexpected elections since they hold up the main loop. A zero threshold
+// is disabled.
+type SlowOpThresholds struct {
+	// LogAppend is the threshold of the appends to the LogStore.
+	LogAppend time.Duration
+	// LogSync is the threshold of the syncs reported by the LogStores that
+	// implement LogStoreSyncObserverSetter.
+	LogSync time.Duration
+	// Apply is the threshold of StateMachine.Apply.
+	Apply time.Duration
+	// SnapshotWrite is the threshold of writing a snapshot of the state
+	// machine to the SnapshotSink.
+	SnapshotWrite time.Duration
+}
+
+var defaultSlowOpThresholds = SlowOpThresholds{
+	LogAppend: 100 * time.Millisecond,
+	LogSync:   100 * time.Millisecond,
+	Apply:     100 * time.Millisecond,
+}
+
+// warnSlowOp logs a warning if the operation took longer than the threshold.
+func (s *Server) warnSlowOp(op string, threshold, d time.Duration, keysAndValues ...interface{}) {
+	if threshold <= 0 || d <= threshold {
+		return
+	}
+	keysAndValues = append(keysAndValues, "op", op, "duration", d, "threshold", threshold)
+	s.logger.Warnw("slow operation detected", logFields(s, keysAndValues...)...)
+}
+
+// observeLogSync is the sync observer set on the LogStore.
+func (s *Server) observeLogSync(d time.Duration) {
+	s.recordMetric(MetricLogSyncLatency, d)
+	s.warnSlowOp("log sync", s.opts().slowOpThresholds.LogSync, d)
+}
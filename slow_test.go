@@ -0,0 +1,48 @@
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWarnSlowOp(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	core, logs := observer.New(zapcore.WarnLevel)
+	server.logger = zap.New(core).Sugar()
+
+	server.warnSlowOp("apply", 0, time.Second)
+	server.warnSlowOp("apply", time.Second, time.Second)
+	assert.Equal(t, 0, logs.Len())
+
+	server.warnSlowOp("apply", time.Millisecond, time.Second, "index", 1)
+	entries := logs.TakeAll()
+	assert.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "apply", fields["op"])
+	assert.Equal(t, time.Second, fields["duration"])
+	assert.Equal(t, time.Millisecond, fields["threshold"])
+	assert.EqualValues(t, 1, fields["index"])
+}
+
+func TestWALLogStoreSyncObserver(t *testing.T) {
+	store := ƒAssertNoError2(NewWALLogStore(t.TempDir()))(t)
+	defer store.Close()
+
+	syncs := 0
+	store.SetSyncObserver(func(d time.Duration) {
+		assert.GreaterOrEqual(t, d, time.Duration(0))
+		syncs++
+	})
+	assert.NoError(t, store.AppendLogs([]*pb.Log{{
+		Meta: &pb.LogMeta{Index: 1, Term: 1},
+		Body: &pb.LogBody{Type: pb.LogType_COMMAND},
+	}}))
+	assert.Greater(t, syncs, 0)
+}
@@ -1,8 +1,11 @@
 package raft
 
 import (
+	"context"
+	"hash/crc64"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -11,6 +14,8 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+var snapshotCRCTable = crc64.MakeTable(crc64.ECMA)
+
 // Snapshot is a descriptor that holds the snapshot file.
 type Snapshot interface {
 	Meta() (SnapshotMeta, error)
@@ -20,11 +25,71 @@ type Snapshot interface {
 	Close() error
 }
 
+// SnapshotPolicy decides when the snapshotScheduler triggers a snapshot. A
+// snapshot is triggered once any of the thresholds is reached since the last
+// trigger. A zero threshold is disabled, and at least one threshold must be
+// set.
 type SnapshotPolicy struct {
-	Applies  int
+	// Applies is the number of commands applied to the StateMachine.
+	Applies int
+	// Entries is the number of logs applied, including the non-command logs.
+	Entries uint64
+	// Bytes is the total size of the logs appended to the LogStore.
+	Bytes int64
+	// Interval is the time elapsed.
 	Interval time.Duration
 }
 
+func (p SnapshotPolicy) validate() error {
+	if p.Applies < 0 || p.Bytes < 0 || p.Interval < 0 {
+		return errors.New("negative thresholds in the SnapshotPolicy")
+	}
+	if p.Applies == 0 && p.Entries == 0 && p.Bytes == 0 && p.Interval == 0 {
+		return errors.New("no thresholds set in the SnapshotPolicy")
+	}
+	return nil
+}
+
+// SnapshotRetentionPolicy decides which snapshots to keep after a snapshot is
+// taken. The latest snapshot is always kept. Older snapshots are kept while
+// all the limits hold, and are pruned from the first one exceeding any limit.
+// A zero limit is not enforced, and the zero value keeps all snapshots.
+// Pruning requires the SnapshatStore to implement SnapshotStoreDeleter.
+type SnapshotRetentionPolicy struct {
+	// Count is the maximum number of snapshots to keep.
+	Count int
+	// MaxAge is the maximum age of the snapshots to keep. Only enforced on the
+	// snapshots with SnapshotMeta implementing SnapshotTimeMeta.
+	MaxAge time.Duration
+	// MaxBytes is the maximum total size of the snapshots to keep. Only the
+	// snapshots with SnapshotMeta implementing SnapshotChecksumMeta are counted.
+	MaxBytes uint64
+}
+
+// prune returns the snapshots to be pruned from the list in descending order
+// of the index.
+func (p SnapshotRetentionPolicy) prune(metaList []SnapshotMeta, now time.Time) []SnapshotMeta {
+	var totalBytes uint64
+	for i, meta := range metaList {
+		if checksumMeta, ok := meta.(SnapshotChecksumMeta); ok {
+			totalBytes += checksumMeta.Size()
+		}
+		if i == 0 {
+			continue
+		}
+		if p.Count > 0 && i >= p.Count {
+			return metaList[i:]
+		}
+		if timeMeta, ok := meta.(SnapshotTimeMeta); ok && p.MaxAge > 0 && now.Sub(timeMeta.CreatedAt()) > p.MaxAge {
+			return metaList[i:]
+		}
+		if p.MaxBytes > 0 && totalBytes > p.MaxBytes {
+			return metaList[i:]
+		}
+	}
+	return nil
+}
+
 type SnapshotMeta interface {
 	Id() string
 	Index() uint64
@@ -34,6 +99,24 @@ type SnapshotMeta interface {
 	Encode() ([]byte, error)
 }
 
+// SnapshotChecksumMeta is an optional interface for those SnapshotMeta
+// implementations that carry the size and the checksum of the snapshot data,
+// which allows the snapshots to be verified with Server.VerifySnapshot().
+type SnapshotChecksumMeta interface {
+	// Size returns the size of the snapshot data in bytes.
+	Size() uint64
+
+	// CRC64 returns the CRC-64 checksum of the snapshot data using the ECMA
+	// polynomial.
+	CRC64() uint64
+}
+
+// SnapshotTimeMeta is an optional interface for those SnapshotMeta
+// implementations that know when the snapshot was created.
+type SnapshotTimeMeta interface {
+	CreatedAt() time.Time
+}
+
 type SnapshotSink interface {
 	io.WriteCloser
 	Meta() SnapshotMeta
@@ -48,14 +131,35 @@ type SnapshatStore interface {
 	Trim() error
 }
 
+// SnapshotStoreDeleter is an optional interface for those SnapshatStore
+// implementations that are able to delete a specific snapshot.
+type SnapshotStoreDeleter interface {
+	Delete(id string) error
+}
+
+// snapshotCheckInterval is the interval at which the snapshotScheduler checks
+// the thresholds in the SnapshotPolicy.
+const snapshotCheckInterval = 50 * time.Millisecond
+
+// snapshotProgress holds the counters compared with the thresholds in the
+// SnapshotPolicy.
+type snapshotProgress struct {
+	applies uint64
+	index   uint64
+	bytes   int64
+	at      time.Time
+}
+
 type snapshotScheduler struct {
 	server  *Server
 	service *snapshotService
 
 	stopCh chan struct{}
 
-	counterTimerMu sync.Mutex
-	counterTimer   *CounterTimer
+	// applies is the number of commands applied since the scheduler started.
+	applies uint64 // atomic
+	// lastTrigger is the progress when the last snapshot was triggered.
+	lastTrigger snapshotProgress
 }
 
 func newSnapshotScheduler(server *Server, service *snapshotService) *snapshotScheduler {
@@ -63,24 +167,27 @@ func newSnapshotScheduler(server *Server, service *snapshotService) *snapshotSch
 		server:  server,
 		service: service,
 		stopCh:  make(chan struct{}, 1),
-		counterTimer: NewCounterTimer(
-			server.opts.snapshotPolicy.Applies,
-			server.opts.snapshotPolicy.Interval,
-		),
 	}
+	s.lastTrigger = s.progress()
 
 	go func() {
 		s.server.logger.Infow("snapshotScheduler started")
 		defer s.server.logger.Infow("snapshotScheduler stopped")
+		ticker := s.server.opts().clock.NewTicker(snapshotCheckInterval)
+		defer ticker.Stop()
 		for {
 			select {
-			case <-s.counterTimer.C():
+			case <-ticker.C():
+				progress := s.progress()
+				if !s.due(progress) {
+					continue
+				}
+				s.lastTrigger = progress
 				select {
-				case s.service.snapshotCh <- struct{}{}:
+				case s.service.snapshotCh <- newFutureTask[SnapshotMeta, any](nil):
 				default:
 				}
 			case <-s.stopCh:
-				s.counterTimer.Stop()
 				return
 			}
 		}
@@ -89,9 +196,29 @@ func newSnapshotScheduler(server *Server, service *snapshotService) *snapshotSch
 	return s
 }
 
+func (s *snapshotScheduler) progress() snapshotProgress {
+	return snapshotProgress{
+		applies: atomic.LoadUint64(&s.applies),
+		index:   s.server.lastApplied().Index,
+		bytes:   s.server.logStore.AppendedBytes(),
+		at:      s.server.opts().clock.Now(),
+	}
+}
+
+// due reports whether any of the thresholds in the SnapshotPolicy is reached
+// since the last trigger.
+func (s *snapshotScheduler) due(progress snapshotProgress) bool {
+	policy := s.server.opts().snapshotPolicy
+	last := s.lastTrigger
+	return policy.Applies > 0 && progress.applies-last.applies >= uint64(policy.Applies) ||
+		policy.Entries > 0 && progress.index > last.index && progress.index-last.index >= policy.Entries ||
+		policy.Bytes > 0 && progress.bytes-last.bytes >= policy.Bytes ||
+		policy.Interval > 0 && progress.at.Sub(last.at) >= policy.Interval
+}
+
 // CountApply is called when a command has been applied to the StateMachine.
 func (s *snapshotScheduler) CountApply() {
-	s.counterTimer.Count()
+	atomic.AddUint64(&s.applies, 1)
 }
 
 func (s *snapshotScheduler) Stop() {
@@ -109,8 +236,13 @@ type snapshotService struct {
 	schedulerMu sync.RWMutex
 	scheduler   *snapshotScheduler
 
-	snapshotCh chan struct{}
+	// snapshotCh receives the snapshot requests from the snapshotScheduler and
+	// Server.Snapshot().
+	snapshotCh chan FutureTask[SnapshotMeta, any]
 	stopCh     chan struct{}
+	// stopMu prevents requests from being sent after the service is stopped.
+	stopMu  sync.RWMutex
+	stopped bool
 
 	lastSnapshotConf *pb.Configuration
 	lastSnapshotMeta SnapshotMeta
@@ -119,7 +251,7 @@ type snapshotService struct {
 func newSnapshotService(server *Server) *snapshotService {
 	s := &snapshotService{
 		server:     server,
-		snapshotCh: make(chan struct{}, 16),
+		snapshotCh: make(chan FutureTask[SnapshotMeta, any], 16),
 		stopCh:     make(chan struct{}, 1),
 	}
 
@@ -128,28 +260,54 @@ func newSnapshotService(server *Server) *snapshotService {
 
 func (s *snapshotService) Start() {
 	s.startOnce.Do(func() {
-		go func() {
+		s.server.goFunc(func() {
 			for {
 				select {
-				case <-s.snapshotCh:
-					s.TakeSnapshot()
+				case t := <-s.snapshotCh:
+					t.setResult(s.TakeSnapshot())
 				case <-s.stopCh:
-					s.server.logger.Infow("snapshotService stopped")
-					return
+					// Fail the pending requests.
+					for {
+						select {
+						case t := <-s.snapshotCh:
+							t.setResult(nil, ErrServerShutdown)
+						default:
+							s.server.logger.Infow("snapshotService stopped")
+							return
+						}
+					}
 				}
 			}
-		}()
+		})
 	})
 }
 
 func (s *snapshotService) Stop() {
-	s.stopOnce.Do(func() { close(s.stopCh) })
+	s.stopOnce.Do(func() {
+		s.stopMu.Lock()
+		defer s.stopMu.Unlock()
+		s.stopped = true
+		close(s.stopCh)
+	})
 }
 
 func (s *snapshotService) Scheduler() *snapshotScheduler {
+	s.schedulerMu.RLock()
+	defer s.schedulerMu.RUnlock()
 	return s.scheduler
 }
 
+// CountApply counts an applied log towards the scheduler, if it's running.
+// The logs are applied outside the main loop, which starts and stops the
+// scheduler.
+func (s *snapshotService) CountApply() {
+	s.schedulerMu.RLock()
+	defer s.schedulerMu.RUnlock()
+	if s.scheduler != nil {
+		s.scheduler.CountApply()
+	}
+}
+
 func (s *snapshotService) StartScheduler() {
 	s.schedulerMu.Lock()
 	defer s.schedulerMu.Unlock()
@@ -172,15 +330,31 @@ func (s *snapshotService) StopScheduler() {
 	s.scheduler = nil
 }
 
-// TakeSnapshot is used to take a snapshot and trim log entries.
+// Snapshot requests a snapshot to be taken by the snapshotService.
+func (s *snapshotService) Snapshot() FutureTask[SnapshotMeta, any] {
+	t := newFutureTask[SnapshotMeta, any](nil)
+	s.stopMu.RLock()
+	defer s.stopMu.RUnlock()
+	if s.stopped {
+		t.setResult(nil, ErrServerShutdown)
+		return t
+	}
+	s.snapshotCh <- t
+	return t
+}
+
+// TakeSnapshot is used to take a snapshot and trim log entries. The latest
+// snapshot is returned if it's not stale, and ErrNothingToSnapshot is returned
+// if there are no applied logs.
 func (s *snapshotService) TakeSnapshot() (SnapshotMeta, error) {
+	start := time.Now()
 	c := s.server.confStore.Committed()
 
 	lastApplied := s.server.lastApplied()
 	if lastApplied.Index == 0 {
 		// It's unnecessary to take a snapshot since there're no applied logs.
 		s.server.logger.Debugw("snapshot skipped: no applied logs", logFields(s.server)...)
-		return nil, nil
+		return nil, ErrNothingToSnapshot
 	}
 
 	// Check if our latest snapshot is stale
@@ -188,7 +362,7 @@ func (s *snapshotService) TakeSnapshot() (SnapshotMeta, error) {
 		// Skip if the snapshot index and configuration are identical to current values.
 		if m.Index() >= lastApplied.Index && proto.Equal(m.Configuration(), c.Configuration) {
 			s.server.logger.Debugw("snapshot skipped: snapshot is not stale", logFields(s.server)...)
-			return nil, nil
+			return m, nil
 		}
 	}
 
@@ -201,13 +375,24 @@ func (s *snapshotService) TakeSnapshot() (SnapshotMeta, error) {
 		return nil, err
 	}
 
+	if stmsSnapshot.Configuration != nil {
+		// The configuration committed after the last applied log is not
+		// included in the snapshot.
+		c = stmsSnapshot.Configuration
+	}
 	sink, err := s.server.snapshotStore.Create(stmsSnapshot.Index, stmsSnapshot.Term, c.Configuration, c.LogIndex())
 	if err != nil {
 		return nil, err
 	}
 	snapshotMeta := sink.Meta()
 
-	if err := stmsSnapshot.Write(sink); err != nil {
+	ctx, cancel := stopContext(s.server.stopCh)
+	defer cancel()
+	writeStart := time.Now()
+	err = stmsSnapshot.write(ctx, sink, s.server.opts().snapshotProgress)
+	s.server.warnSlowOp("snapshot write", s.server.opts().slowOpThresholds.SnapshotWrite, time.Since(writeStart),
+		zap.String("snapshot_id", snapshotMeta.Id()))
+	if err != nil {
 		if cancelError := sink.Cancel(); cancelError != nil {
 			return nil, errors.Wrap(cancelError, err.Error())
 		}
@@ -224,6 +409,8 @@ func (s *snapshotService) TakeSnapshot() (SnapshotMeta, error) {
 	}
 
 	s.lastSnapshotMeta = snapshotMeta
+	s.server.publishSnapshotEvent(EventSnapshotTaken, snapshotMeta)
+	s.server.recordLatency(MetricSnapshotTakeDuration, start)
 
 	s.server.logger.Infow("snapshot has been taken",
 		logFields(s.server,
@@ -231,6 +418,147 @@ func (s *snapshotService) TakeSnapshot() (SnapshotMeta, error) {
 			zap.Uint64("snapshot_index", sink.Meta().Index()),
 			zap.Uint64("snapshot_term", sink.Meta().Term()))...)
 
+	if err := s.pruneSnapshots(); err != nil {
+		s.server.logger.Warnw("error occurred pruning snapshots",
+			logFields(s.server, zap.Error(err), zap.String("snapshot_id", snapshotMeta.Id()))...)
+	}
+
+	// Evict the logs that exist in the snapshot under the LogCompactionPolicy.
+	// Failures here are not fatal since the logs can be evicted after the next
+	// snapshot.
+	if err := s.compactLogs(snapshotMeta); err != nil {
+		s.server.logger.Warnw("error occurred compacting logs",
+			logFields(s.server, zap.Error(err), zap.String("snapshot_id", snapshotMeta.Id()))...)
+	}
+
+	return snapshotMeta, nil
+}
+
+// pruneSnapshots deletes the snapshots that are not kept by the
+// SnapshotRetentionPolicy.
+func (s *snapshotService) pruneSnapshots() error {
+	policy := s.server.opts().snapshotRetentionPolicy
+	if policy == (SnapshotRetentionPolicy{}) {
+		return nil
+	}
+	deleter, ok := s.server.snapshotStore.(SnapshotStoreDeleter)
+	if !ok {
+		return errors.New("the SnapshatStore does not implement SnapshotStoreDeleter")
+	}
+	metaList, err := s.server.snapshotStore.List()
+	if err != nil {
+		return err
+	}
+	for _, meta := range policy.prune(metaList, s.server.opts().clock.Now()) {
+		if err := deleter.Delete(meta.Id()); err != nil {
+			return err
+		}
+		s.server.logger.Infow("snapshot has been pruned",
+			logFields(s.server,
+				zap.String("snapshot_id", meta.Id()),
+				zap.Uint64("snapshot_index", meta.Index()))...)
+	}
+	return nil
+}
+
+// compactLogs schedules a TrimPrefix() to evict the logs that exist in the
+// snapshot except those retained by the LogCompactionPolicy.
+func (s *snapshotService) compactLogs(snapshotMeta SnapshotMeta) error {
+	index, err := s.server.logStore.compactionIndex(snapshotMeta.Index())
+	if err != nil {
+		return err
+	}
+	if index <= s.server.firstLogIndex() {
+		return nil
+	}
+	trimOp := &logStoreTrimOp{Type: logStoreTrimPrefix, FutureTask: newFutureTask[any](index)}
+	if err := s.server.enqueueLogOp(context.Background(), trimOp); err != nil {
+		return err
+	}
+	if _, err := trimOp.Result(); err != nil {
+		return err
+	}
+	s.server.logger.Infow("logs have been compacted",
+		logFields(s.server, zap.Uint64("trim_index", index), zap.String("snapshot_id", snapshotMeta.Id()))...)
+	return nil
+}
+
+// Verify re-reads the snapshot with the ID from the SnapshatStore and checks
+// its data against the size and the checksum in its SnapshotMeta.
+func (s *snapshotService) Verify(snapshotId string) (SnapshotMeta, error) {
+	return CheckSnapshot(s.server.snapshotStore, snapshotId)
+}
+
+// CheckSnapshot reads the data of the snapshot in the SnapshatStore and
+// verifies its size and checksum against the SnapshotMeta, which must
+// implement SnapshotChecksumMeta. ErrCorruptedSnapshot is returned if they
+// don't match.
+func CheckSnapshot(store SnapshatStore, snapshotId string) (SnapshotMeta, error) {
+	snapshot, err := store.Open(snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+	snapshotMeta, err := snapshot.Meta()
+	if err != nil {
+		return nil, err
+	}
+	checksumMeta, ok := snapshotMeta.(SnapshotChecksumMeta)
+	if !ok {
+		return nil, ErrSnapshotChecksumUnsupported
+	}
+	reader, err := snapshot.Reader()
+	if err != nil {
+		return nil, err
+	}
+	h := crc64.New(snapshotCRCTable)
+	size, err := io.Copy(h, reader)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(size) != checksumMeta.Size() {
+		return nil, errors.Wrapf(ErrCorruptedSnapshot, "expected %d bytes but got %d", checksumMeta.Size(), size)
+	}
+	if h.Sum64() != checksumMeta.CRC64() {
+		return nil, errors.Wrapf(ErrCorruptedSnapshot, "checksum mismatch: expected %016x but got %016x",
+			checksumMeta.CRC64(), h.Sum64())
+	}
+	return snapshotMeta, nil
+}
+
+// RestoreUserSnapshot persists the snapshot read from the reader and restores
+// it. The snapshot is placed after the last log with the current term, which
+// makes the logs on every server conflict with it and be discarded. The
+// replications are stopped only once the snapshot is persisted, and restarted
+// with the leader loop if the restoration fails.
+// Must be called in a channel select branch of the leader loop.
+func (s *snapshotService) RestoreUserSnapshot(reader io.Reader) (SnapshotMeta, error) {
+	if s.server.confStore.Joint() {
+		return nil, ErrInJointConsensus
+	}
+	c := s.server.confStore.Committed()
+
+	sink, err := s.server.snapshotStore.Create(
+		s.server.lastLogIndex()+1, s.server.currentTerm(), c.Configuration, c.LogIndex())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(sink, reader); err != nil {
+		if cancelError := sink.Cancel(); cancelError != nil {
+			return nil, errors.Wrap(cancelError, err.Error())
+		}
+		return nil, err
+	}
+	if err := sink.Close(); err != nil {
+		return nil, err
+	}
+
+	s.server.replScheduler.Stop()
+	snapshotMeta := sink.Meta()
+	if _, err := s.Restore(snapshotMeta.Id()); err != nil {
+		s.server.reselectLoop()
+		return nil, err
+	}
 	return snapshotMeta, nil
 }
 
@@ -243,21 +571,30 @@ func (s *snapshotService) Restore(snapshotId string) (bool, error) {
 		// It's recoverable if errors happen here.
 		return false, err
 	}
+	defer snapshot.Close()
 
 	snapshotMeta, err := snapshot.Meta()
 	if err != nil {
 		return false, err
 	}
 
+	// The logs are not applied while the snapshot is being restored.
+	s.server.fsmMu.Lock()
+	defer s.server.fsmMu.Unlock()
+
 	// Check if the restoration is necessary.
-	if snapshotMeta.Index() < s.server.firstLogIndex()-1 {
+	firstLogIndex := s.server.firstLogIndex()
+	if (firstLogIndex > 0 && snapshotMeta.Index() < firstLogIndex-1) ||
+		snapshotMeta.Index() <= s.server.lastApplied().Index {
 		// Restoration is not necessary.
 		return false, nil
 	}
 
+	start := time.Now()
 	if err := s.server.stateMachine.Restore(snapshot); err != nil {
 		return false, err
 	}
+	s.server.recordLatency(MetricSnapshotRestoreDuration, start)
 
 	if err := s.server.logStore.Restore(snapshotMeta); err != nil {
 		s.server.logger.Panicw("error occurred while triming logs during restoration",
@@ -267,8 +604,23 @@ func (s *snapshotService) Restore(snapshotId string) (bool, error) {
 	s.server.setFirstLogIndex(Must2(s.server.logStore.FirstIndex()))
 	s.server.setLastLogIndex(Must2(s.server.logStore.LastIndex()))
 
-	s.server.commitAndApply(snapshotMeta.Index())
+	if s.server.commitIndex() < snapshotMeta.Index() {
+		s.server.setCommitIndex(snapshotMeta.Index())
+	}
+	s.server.applyResponses.failUpTo(snapshotMeta.Index(), ErrLogsCompacted)
+	s.server.setLastApplied(snapshotMeta.Index(), snapshotMeta.Term())
+	// The logs committed after the snapshot, if any, are applied next.
+	select {
+	case s.server.applyCh <- struct{}{}:
+	default:
+	}
 
-	s.server.alterConfiguration(newConfiguration(snapshotMeta.Configuration(), snapshotMeta.ConfigurationIndex()))
+	c, err := s.server.confStore.Restore(snapshotMeta)
+	if err != nil {
+		s.server.logger.Panicw("error occurred while restoring configurations during restoration",
+			logFields(s.server, zap.Error(err))...)
+	}
+	s.server.alterConfiguration(c)
+	s.server.publishSnapshotEvent(EventSnapshotRestored, snapshotMeta)
 	return true, nil
 }
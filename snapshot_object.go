@@ -0,0 +1,292 @@
+package raft
+
+import (
+	"hash/crc64"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/proto"
+)
+
+// ObjectStore is a minimal interface of object storage services like S3.
+type ObjectStore interface {
+	// Put returns an ObjectWriter that uploads the object with the key. The
+	// object must not be visible until the ObjectWriter is closed.
+	Put(key string) (ObjectWriter, error)
+
+	// Get returns the content of the object with the key. ErrObjectNotFound
+	// should be returned if the object does not exist.
+	Get(key string) (io.ReadCloser, error)
+
+	// List returns the keys of all objects with the prefix.
+	List(prefix string) ([]string, error)
+
+	// Delete removes the object with the key. Removing an object that does not
+	// exist is not an error.
+	Delete(key string) error
+}
+
+// ObjectWriter uploads an object to the ObjectStore.
+type ObjectWriter interface {
+	io.WriteCloser
+
+	// Abort discards the data written so far.
+	Abort() error
+}
+
+const (
+	objectSnapshotDataName = "snapshot"
+	objectSnapshotMetaName = "metadata"
+)
+
+type objectSnapshotMeta struct {
+	pbMeta *pb.ObjectSnapshotMeta
+}
+
+func (m *objectSnapshotMeta) Id() string {
+	return m.pbMeta.Id
+}
+
+func (m *objectSnapshotMeta) Index() uint64 {
+	return m.pbMeta.Index
+}
+
+func (m *objectSnapshotMeta) Term() uint64 {
+	return m.pbMeta.Term
+}
+
+func (m *objectSnapshotMeta) Configuration() *pb.Configuration {
+	return m.pbMeta.Configuration
+}
+
+func (m *objectSnapshotMeta) ConfigurationIndex() uint64 {
+	return m.pbMeta.ConfigurationIndex
+}
+
+// Size returns the size of the snapshot data in bytes.
+func (m *objectSnapshotMeta) Size() uint64 {
+	return m.pbMeta.Size
+}
+
+func (m *objectSnapshotMeta) CRC64() uint64 {
+	return m.pbMeta.Crc64
+}
+
+// CreatedAt returns the time when the snapshot was created, which is derived
+// from the ID.
+func (m *objectSnapshotMeta) CreatedAt() time.Time {
+	id, err := ObjectIDFromHex(m.pbMeta.Id)
+	if err != nil {
+		return time.Time{}
+	}
+	return id.Timestamp()
+}
+
+func (m *objectSnapshotMeta) Encode() ([]byte, error) {
+	return proto.Marshal(m.pbMeta)
+}
+
+func (m *objectSnapshotMeta) MarshalLogObject(e zapcore.ObjectEncoder) error {
+	e.AddString("id", m.pbMeta.Id)
+	e.AddUint64("index", m.pbMeta.Index)
+	e.AddUint64("term", m.pbMeta.Term)
+	e.AddUint64("configuration_index", m.pbMeta.ConfigurationIndex)
+	e.AddUint64("size", m.pbMeta.Size)
+	e.AddUint64("crc64", m.pbMeta.Crc64)
+	return nil
+}
+
+type objectSnapshot struct {
+	meta   *objectSnapshotMeta
+	reader io.ReadCloser
+}
+
+func (s *objectSnapshot) Meta() (SnapshotMeta, error) {
+	return s.meta, nil
+}
+
+func (s *objectSnapshot) Reader() (io.Reader, error) {
+	return s.reader, nil
+}
+
+func (s *objectSnapshot) Close() error {
+	return s.reader.Close()
+}
+
+type objectSnapshotSink struct {
+	store  *ObjectSnapshotStore
+	meta   *objectSnapshotMeta
+	writer ObjectWriter
+}
+
+func (s *objectSnapshotSink) Meta() SnapshotMeta {
+	return s.meta
+}
+
+func (s *objectSnapshotSink) Write(p []byte) (n int, err error) {
+	n, err = s.writer.Write(p)
+	s.meta.pbMeta.Size += uint64(n)
+	s.meta.pbMeta.Crc64 = crc64.Update(s.meta.pbMeta.Crc64, snapshotCRCTable, p[:n])
+	return n, err
+}
+
+// Close completes the upload of the snapshot data and then uploads the
+// metadata, which makes the snapshot visible to List().
+func (s *objectSnapshotSink) Close() error {
+	if err := s.writer.Close(); err != nil {
+		return err
+	}
+	metaBytes, err := s.meta.Encode()
+	if err != nil {
+		return err
+	}
+	writer, err := s.store.objects.Put(s.store.key(s.meta.Id(), objectSnapshotMetaName))
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(metaBytes); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Close()
+}
+
+func (s *objectSnapshotSink) Cancel() error {
+	return s.writer.Abort()
+}
+
+// ObjectSnapshotStore is a SnapshatStore that keeps the snapshots in an
+// ObjectStore, so that servers without local persistent volumes are able to
+// recover from the snapshots in the ObjectStore. Each snapshot consists of two
+// objects under the prefix: <id>/snapshot holding the data streamed from the
+// SnapshotSink, and <id>/metadata holding the metadata, which is uploaded
+// after the data is complete.
+type ObjectSnapshotStore struct {
+	objects ObjectStore
+	prefix  string
+}
+
+// NewObjectSnapshotStore returns an ObjectSnapshotStore that keeps the
+// snapshots in the ObjectStore under the key prefix.
+func NewObjectSnapshotStore(objects ObjectStore, prefix string) *ObjectSnapshotStore {
+	return &ObjectSnapshotStore{objects: objects, prefix: prefix}
+}
+
+func (s *ObjectSnapshotStore) key(id, name string) string {
+	return s.prefix + id + "/" + name
+}
+
+func (s *ObjectSnapshotStore) readMeta(id string) (*objectSnapshotMeta, error) {
+	reader, err := s.objects.Get(s.key(id, objectSnapshotMetaName))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	metaBytes, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s.DecodeMeta(metaBytes)
+	if err != nil {
+		return nil, err
+	}
+	return meta.(*objectSnapshotMeta), nil
+}
+
+func (s *ObjectSnapshotStore) Create(index, term uint64, c *pb.Configuration, cIndex uint64) (SnapshotSink, error) {
+	id := NewObjectID().Hex()
+	writer, err := s.objects.Put(s.key(id, objectSnapshotDataName))
+	if err != nil {
+		return nil, err
+	}
+	return &objectSnapshotSink{
+		store: s,
+		meta: &objectSnapshotMeta{pbMeta: &pb.ObjectSnapshotMeta{
+			Id:                 id,
+			Index:              index,
+			Term:               term,
+			Configuration:      c.Copy(),
+			ConfigurationIndex: cIndex,
+		}},
+		writer: writer,
+	}, nil
+}
+
+// List returns the metadata of the complete snapshots in descending order of
+// the index.
+func (s *ObjectSnapshotStore) List() ([]SnapshotMeta, error) {
+	keys, err := s.objects.List(s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	metaList := []SnapshotMeta{}
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, s.prefix)
+		if !strings.HasSuffix(id, "/"+objectSnapshotMetaName) {
+			continue
+		}
+		id = strings.TrimSuffix(id, "/"+objectSnapshotMetaName)
+		if strings.Contains(id, "/") {
+			continue
+		}
+		meta, err := s.readMeta(id)
+		if err != nil {
+			return nil, err
+		}
+		metaList = append(metaList, meta)
+	}
+	sort.SliceStable(metaList, func(i, j int) bool {
+		return metaList[i].Index() > metaList[j].Index()
+	})
+	return metaList, nil
+}
+
+func (s *ObjectSnapshotStore) Open(id string) (Snapshot, error) {
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := s.objects.Get(s.key(id, objectSnapshotDataName))
+	if err != nil {
+		return nil, err
+	}
+	return &objectSnapshot{meta: meta, reader: reader}, nil
+}
+
+func (s *ObjectSnapshotStore) DecodeMeta(b []byte) (SnapshotMeta, error) {
+	var pbMeta pb.ObjectSnapshotMeta
+	if err := proto.Unmarshal(b, &pbMeta); err != nil {
+		return nil, err
+	}
+	return &objectSnapshotMeta{pbMeta: &pbMeta}, nil
+}
+
+// Delete removes the snapshot with the ID. The metadata is removed before the
+// data so that a snapshot being removed is never listed.
+func (s *ObjectSnapshotStore) Delete(id string) error {
+	if err := s.objects.Delete(s.key(id, objectSnapshotMetaName)); err != nil {
+		return err
+	}
+	return s.objects.Delete(s.key(id, objectSnapshotDataName))
+}
+
+// Trim removes all complete snapshots except the latest one.
+func (s *ObjectSnapshotStore) Trim() error {
+	metaList, err := s.List()
+	if err != nil {
+		return err
+	}
+	if len(metaList) <= 1 {
+		return nil
+	}
+	for _, meta := range metaList[1:] {
+		if err := s.Delete(meta.Id()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package raft
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// fileObjectTempPrefix marks the files of the objects being written, which
+// are invisible until renamed.
+const fileObjectTempPrefix = ".tmp-"
+
+// FileObjectStore is an ObjectStore that keeps the objects as files in a
+// directory, e.g., on a local volume or a network file system. The slashes in
+// the keys separate the directories.
+type FileObjectStore struct {
+	dir string
+}
+
+func NewFileObjectStore(dir string) *FileObjectStore {
+	return &FileObjectStore{dir: filepath.Clean(dir)}
+}
+
+func (s *FileObjectStore) path(key string) (string, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, s.dir+string(filepath.Separator)) {
+		return "", errors.Errorf("invalid object key: %s", key)
+	}
+	return path, nil
+}
+
+// Put returns an ObjectWriter that writes the object to a temporary file,
+// which is renamed to the file of the object when closed.
+func (s *FileObjectStore) Put(key string) (ObjectWriter, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), fileObjectTempPrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &fileObjectWriter{File: file, store: s, path: path}, nil
+}
+
+func (s *FileObjectStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return file, err
+}
+
+func (s *FileObjectStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == s.dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), fileObjectTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the file of the object, and then the parent directories left
+// empty.
+func (s *FileObjectStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.removeEmptyDirs(filepath.Dir(path))
+	return nil
+}
+
+// removeEmptyDirs removes the directory and its parents until a non-empty one
+// or the directory of the FileObjectStore is reached.
+func (s *FileObjectStore) removeEmptyDirs(dir string) {
+	for ; dir != s.dir; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+type fileObjectWriter struct {
+	*os.File
+	store *FileObjectStore
+	path  string
+}
+
+func (w *fileObjectWriter) Close() error {
+	if err := w.File.Sync(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return os.Rename(w.File.Name(), w.path)
+}
+
+func (w *fileObjectWriter) Abort() error {
+	w.File.Close()
+	if err := os.Remove(w.File.Name()); err != nil {
+		return err
+	}
+	w.store.removeEmptyDirs(filepath.Dir(w.path))
+	return nil
+}
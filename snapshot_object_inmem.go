@@ -0,0 +1,72 @@
+package raft
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// InmemObjectStore is an ObjectStore that keeps the objects in memory, e.g., for
+// the tests.
+type InmemObjectStore struct {
+	mu      sync.Mutex // protects objects
+	objects map[string][]byte
+}
+
+func NewInmemObjectStore() *InmemObjectStore {
+	return &InmemObjectStore{objects: map[string][]byte{}}
+}
+
+func (s *InmemObjectStore) Put(key string) (ObjectWriter, error) {
+	return &inmemObjectWriter{store: s, key: key}, nil
+}
+
+func (s *InmemObjectStore) Get(key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *InmemObjectStore) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *InmemObjectStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+type inmemObjectWriter struct {
+	bytes.Buffer
+	store *InmemObjectStore
+	key   string
+}
+
+func (w *inmemObjectWriter) Close() error {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.store.objects[w.key] = w.Bytes()
+	return nil
+}
+
+func (w *inmemObjectWriter) Abort() error {
+	w.Reset()
+	return nil
+}
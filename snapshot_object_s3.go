@@ -0,0 +1,406 @@
+package raft
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const s3DefaultPartSize = 8 << 20
+
+// S3Config configures an S3ObjectStore.
+type S3Config struct {
+	// Endpoint is the URL of the service, e.g., https://s3.us-east-1.amazonaws.com
+	// for AWS S3 or https://storage.googleapis.com for GCS.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is only required by temporary credentials.
+	SessionToken string
+
+	// PathStyle makes the bucket a part of the path instead of the host name.
+	// It's usually required by self-hosted services.
+	PathStyle bool
+
+	// PartSize is the size of the parts in multipart uploads. AWS S3 requires
+	// the parts except the last one to be at least 5 MiB. Defaults to 8 MiB.
+	PartSize int
+
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// S3ObjectStore is an ObjectStore backed by the S3 API, which is also
+// provided by GCS and most self-hosted object storage services. Objects larger
+// than a part are streamed with multipart uploads.
+type S3ObjectStore struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3ObjectStore(config S3Config) (*S3ObjectStore, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.Errorf("invalid S3 endpoint: %s", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("missing S3 bucket")
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = s3DefaultPartSize
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3ObjectStore{config: config, endpoint: endpoint, client: client}, nil
+}
+
+// s3Error is the error response of the S3 API.
+type s3Error struct {
+	XMLName    xml.Name `xml:"Error"`
+	StatusCode int      `xml:"-"`
+	Code       string   `xml:"Code"`
+	Message    string   `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+func (s *S3ObjectStore) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	if s.config.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.config.Bucket + "/" + key
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = s3EncodePath(u.Path)
+	u.RawQuery = s3EncodeQuery(query)
+	return &u
+}
+
+func (s *S3ObjectStore) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := s.url(key, query)
+	request, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(request, u, body, time.Now().UTC())
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		defer response.Body.Close()
+		return nil, s.readError(response)
+	}
+	return response, nil
+}
+
+func (s *S3ObjectStore) readError(response *http.Response) error {
+	e := &s3Error{StatusCode: response.StatusCode}
+	b, _ := io.ReadAll(response.Body)
+	if err := xml.Unmarshal(b, e); err != nil {
+		e.Code = http.StatusText(response.StatusCode)
+	}
+	if response.StatusCode == http.StatusNotFound && (e.Code == "" || e.Code == "NoSuchKey" || e.Code == http.StatusText(http.StatusNotFound)) {
+		return errors.Wrap(ErrObjectNotFound, e.Error())
+	}
+	return e
+}
+
+// doXML sends the request and decodes the XML response into v. Some APIs like
+// CompleteMultipartUpload may report errors with status 200, which are also
+// detected here.
+func (s *S3ObjectStore) doXML(method, key string, query url.Values, body []byte, v interface{}) error {
+	response, err := s.do(method, key, query, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	b, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	e := &s3Error{StatusCode: response.StatusCode}
+	if xml.Unmarshal(b, e) == nil {
+		return e
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(b, v)
+}
+
+func (s *S3ObjectStore) Put(key string) (ObjectWriter, error) {
+	return &s3ObjectWriter{store: s, key: key, buf: make([]byte, 0, s.config.PartSize)}, nil
+}
+
+func (s *S3ObjectStore) Get(key string) (io.ReadCloser, error) {
+	response, err := s.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (s *S3ObjectStore) List(prefix string) ([]string, error) {
+	var result struct {
+		Contents []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}
+	keys := []string{}
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		result.Contents = nil
+		if err := s.doXML(http.MethodGet, "", query, nil, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3ObjectStore) Delete(key string) error {
+	response, err := s.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		return err
+	}
+	return response.Body.Close()
+}
+
+// sign signs the request with AWS Signature Version 4.
+func (s *S3ObjectStore) sign(request *http.Request, u *url.URL, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.config.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	headers := map[string]string{"host": u.Host}
+	for k, v := range request.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	headerNames := make([]string, 0, len(headers))
+	for k := range headers {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, k := range headerNames {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		u.EscapedPath(),
+		u.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := []byte("AWS4" + s.config.SecretAccessKey)
+	for _, v := range []string{date, s.config.Region, "s3", "aws4_request"} {
+		key = s3HMAC(key, v)
+	}
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes the string as required by AWS Signature Version 4, where
+// only the unreserved characters are kept.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || keepSlash && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EncodePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return s3Escape(path, true)
+}
+
+func s3EncodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3ObjectWriter buffers the data of a part in memory. Objects no larger than
+// a part are uploaded with a single PutObject, and larger ones with a
+// multipart upload which is started when the first part is full.
+type s3ObjectWriter struct {
+	store    *S3ObjectStore
+	key      string
+	buf      []byte
+	uploadID string
+	parts    []s3CompletedPart
+	closed   bool
+}
+
+func (w *s3ObjectWriter) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, errors.New("write to a closed object writer")
+	}
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.uploadPart(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *s3ObjectWriter) uploadPart() error {
+	if w.uploadID == "" {
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := w.store.doXML(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, &result); err != nil {
+			return err
+		}
+		w.uploadID = result.UploadID
+	}
+	partNumber := len(w.parts) + 1
+	response, err := w.store.do(http.MethodPut, w.key, url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {w.uploadID},
+	}, w.buf)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	w.parts = append(w.parts, s3CompletedPart{PartNumber: partNumber, ETag: response.Header.Get("ETag")})
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *s3ObjectWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.uploadID == "" {
+		response, err := w.store.do(http.MethodPut, w.key, nil, w.buf)
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	}
+	if len(w.buf) > 0 {
+		if err := w.uploadPart(); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	if err := w.store.doXML(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, body, nil); err != nil {
+		w.abort()
+		return err
+	}
+	return nil
+}
+
+func (w *s3ObjectWriter) abort() error {
+	if w.uploadID == "" {
+		return nil
+	}
+	response, err := w.store.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (w *s3ObjectWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.buf = nil
+	return w.abort()
+}
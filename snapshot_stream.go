@@ -0,0 +1,164 @@
+package raft
+
+import (
+	"context"
+	"io"
+)
+
+// snapshotChunkSize is the size of the chunks written to the SnapshotSink by
+// a SnapshotWriter.
+const snapshotChunkSize = 1 << 20
+
+// SnapshotProgress is the progress of writing or restoring a snapshot,
+// reported to the function set with SnapshotProgressOption.
+type SnapshotProgress struct {
+	SnapshotID string
+	// Restoring is set if the snapshot is being restored, or written otherwise.
+	Restoring bool
+	// Bytes is the number of bytes of the snapshot data written or read so far.
+	Bytes int64
+	// Total is the size of the snapshot being restored, or zero if the
+	// SnapshotMeta does not implement SnapshotChecksumMeta.
+	Total int64
+}
+
+// StreamingStateMachineSnapshot is an optional interface that can be
+// implemented by a StateMachineSnapshot to stream a state machine too large to
+// be serialized in memory. WriteStream is called in place of Write, and should
+// write the state in pieces, e.g., key by key, to the SnapshotWriter, which
+// writes them to the SnapshotSink in chunks. The context is done once the
+// server shuts down, which cancels the snapshot.
+type StreamingStateMachineSnapshot interface {
+	WriteStream(ctx context.Context, w *SnapshotWriter) error
+}
+
+// StreamingStateMachine is an optional interface that can be implemented by a
+// StateMachine to restore the snapshots written by a
+// StreamingStateMachineSnapshot. RestoreStream is called in place of Restore
+// with the reader of the snapshot data, whose reads fail with the error of the
+// context once it is done, e.g., when the server shuts down.
+type StreamingStateMachine interface {
+	RestoreStream(ctx context.Context, meta SnapshotMeta, r io.Reader) error
+}
+
+// SnapshotWriter buffers the data of a snapshot into chunks written to the
+// SnapshotSink, and reports the progress on each chunk. Writes fail with the
+// error of the context once it is done.
+type SnapshotWriter struct {
+	ctx      context.Context
+	sink     SnapshotSink
+	buf      []byte
+	written  int64
+	progress func(SnapshotProgress)
+}
+
+func newSnapshotWriter(ctx context.Context, sink SnapshotSink, progress func(SnapshotProgress)) *SnapshotWriter {
+	return &SnapshotWriter{ctx: ctx, sink: sink, buf: make([]byte, 0, snapshotChunkSize), progress: progress}
+}
+
+func (w *SnapshotWriter) Write(p []byte) (n int, err error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+		if len(w.buf) == cap(w.buf) {
+			if err := w.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes the buffered data to the SnapshotSink and reports the
+// progress. The remaining data is flushed after WriteStream returns.
+func (w *SnapshotWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if _, err := w.sink.Write(w.buf); err != nil {
+		return err
+	}
+	w.written += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	if w.progress != nil {
+		w.progress(SnapshotProgress{SnapshotID: w.sink.Meta().Id(), Bytes: w.written})
+	}
+	return nil
+}
+
+// Written returns the number of bytes written, including the buffered ones.
+func (w *SnapshotWriter) Written() int64 {
+	return w.written + int64(len(w.buf))
+}
+
+// snapshotWriterSink is the SnapshotSink passed to StateMachineSnapshot.Write
+// that writes through a SnapshotWriter.
+type snapshotWriterSink struct {
+	SnapshotSink
+	writer *SnapshotWriter
+}
+
+func (s *snapshotWriterSink) Write(p []byte) (int, error) {
+	return s.writer.Write(p)
+}
+
+// RestoreContext returns the context of the restoration of the snapshot passed
+// to StateMachine.Restore, which is done once the server shuts down. The reads
+// of the snapshot fail with its error once it is done, so that the state
+// machine can abort the restoration cleanly.
+func RestoreContext(snapshot Snapshot) context.Context {
+	if s, ok := snapshot.(interface{ Context() context.Context }); ok {
+		return s.Context()
+	}
+	return context.Background()
+}
+
+// progressReader reports the progress of restoring a snapshot once per chunk
+// read and at the end of the data.
+type progressReader struct {
+	reader   io.Reader
+	progress func(SnapshotProgress)
+	report   SnapshotProgress
+	reported int64
+}
+
+func newProgressReader(reader io.Reader, meta SnapshotMeta, progress func(SnapshotProgress)) io.Reader {
+	if progress == nil {
+		return reader
+	}
+	r := &progressReader{reader: reader, progress: progress}
+	r.report = SnapshotProgress{SnapshotID: meta.Id(), Restoring: true}
+	if m, ok := meta.(SnapshotChecksumMeta); ok {
+		r.report.Total = int64(m.Size())
+	}
+	return r
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.report.Bytes += int64(n)
+	if r.report.Bytes-r.reported >= snapshotChunkSize || (err == io.EOF && r.report.Bytes > r.reported) {
+		r.reported = r.report.Bytes
+		r.progress(r.report)
+	}
+	return n, err
+}
+
+// contextReader is a reader whose reads fail with the error of the context
+// once it is done.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
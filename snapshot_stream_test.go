@@ -0,0 +1,135 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+)
+
+type testingBufferSink struct {
+	bytes.Buffer
+	meta SnapshotMeta
+}
+
+func (s *testingBufferSink) Meta() SnapshotMeta { return s.meta }
+
+func (s *testingBufferSink) Close() error { return nil }
+
+func (s *testingBufferSink) Cancel() error { return nil }
+
+type testingBufferSnapshot struct {
+	meta SnapshotMeta
+	data []byte
+}
+
+func (s *testingBufferSnapshot) Meta() (SnapshotMeta, error) { return s.meta, nil }
+
+func (s *testingBufferSnapshot) Reader() (io.Reader, error) { return bytes.NewReader(s.data), nil }
+
+func (s *testingBufferSnapshot) Close() error { return nil }
+
+type testingStreamingStateMachine struct {
+	testingStateMachine
+	data []byte
+}
+
+func (m *testingStreamingStateMachine) Snapshot() (StateMachineSnapshot, error) {
+	return m, nil
+}
+
+func (m *testingStreamingStateMachine) Write(sink SnapshotSink) error {
+	panic("Write is called on a StreamingStateMachineSnapshot")
+}
+
+func (m *testingStreamingStateMachine) WriteStream(ctx context.Context, w *SnapshotWriter) error {
+	for data := m.data; len(data) > 0; {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (m *testingStreamingStateMachine) RestoreStream(ctx context.Context, meta SnapshotMeta, r io.Reader) (err error) {
+	m.data, err = io.ReadAll(r)
+	return
+}
+
+func TestStreamingSnapshot(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	stateMachine := &testingStreamingStateMachine{data: bytes.Repeat([]byte("0123456789"), snapshotChunkSize/5+1)}
+	server.stateMachine = newStateMachineProxy(server, stateMachine)
+	meta := &objectSnapshotMeta{pbMeta: &pb.ObjectSnapshotMeta{Id: NewObjectID().Hex(), Index: 1, Term: 1}}
+
+	var progress []int64
+	progressFn := func(p SnapshotProgress) {
+		assert.Equal(t, meta.Id(), p.SnapshotID)
+		progress = append(progress, p.Bytes)
+	}
+	snapshot := ƒAssertNoError2(server.stateMachine.Snapshot())(t)
+	sink := &testingBufferSink{meta: meta}
+	assert.NoError(t, snapshot.write(context.Background(), sink, progressFn))
+	assert.Equal(t, stateMachine.data, sink.Bytes())
+	// The data is written in chunks.
+	assert.Equal(t, []int64{snapshotChunkSize, 2 * snapshotChunkSize, int64(len(stateMachine.data))}, progress)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, snapshot.write(ctx, &testingBufferSink{meta: meta}, nil), context.Canceled)
+
+	data := stateMachine.data
+	stateMachine.data = nil
+	assert.NoError(t, server.stateMachine.Restore(&testingBufferSnapshot{meta: meta, data: data}))
+	assert.Equal(t, data, stateMachine.data)
+
+	// The restoration is canceled once the server shuts down.
+	close(server.stopCh)
+	assert.ErrorIs(t, server.stateMachine.Restore(&testingBufferSnapshot{meta: meta, data: data}), context.Canceled)
+}
+
+type testingContextStateMachine struct {
+	testingStateMachine
+	ctxErr error
+}
+
+func (m *testingContextStateMachine) Restore(snapshot Snapshot) error {
+	m.ctxErr = RestoreContext(snapshot).Err()
+	return m.testingStateMachine.Restore(snapshot)
+}
+
+func TestRestoreProgress(t *testing.T) {
+	var progress []SnapshotProgress
+	server := testingServer(t, SnapshotProgressOption(func(p SnapshotProgress) {
+		progress = append(progress, p)
+	}))
+	stateMachine := &testingContextStateMachine{}
+	server.stateMachine = newStateMachineProxy(server, stateMachine)
+	data := bytes.Repeat([]byte("0123456789"), snapshotChunkSize/5+1)
+	meta := &objectSnapshotMeta{pbMeta: &pb.ObjectSnapshotMeta{
+		Id: NewObjectID().Hex(), Index: 1, Term: 1, Size: uint64(len(data)),
+	}}
+
+	assert.NoError(t, server.stateMachine.Restore(&testingBufferSnapshot{meta: meta, data: data}))
+	assert.Equal(t, data, stateMachine.restored)
+	assert.NotEmpty(t, progress)
+	last := progress[len(progress)-1]
+	assert.Equal(t, SnapshotProgress{SnapshotID: meta.Id(), Restoring: true, Bytes: int64(len(data)), Total: int64(len(data))}, last)
+	for i := 1; i < len(progress)-1; i++ {
+		assert.GreaterOrEqual(t, progress[i].Bytes-progress[i-1].Bytes, int64(snapshotChunkSize))
+	}
+
+	// The restoration is canceled once the server shuts down.
+	assert.NoError(t, stateMachine.ctxErr)
+	close(server.stopCh)
+	assert.ErrorIs(t, server.stateMachine.Restore(&testingBufferSnapshot{meta: meta, data: data}), context.Canceled)
+}
@@ -0,0 +1,85 @@
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+)
+
+func TestSnapshotRetentionPolicy(t *testing.T) {
+	now := time.Now()
+	metaList := make([]SnapshotMeta, 0, 5)
+	// Snapshots of 10 bytes taken every minute in descending order of the index
+	for i := 0; i < 5; i++ {
+		metaList = append(metaList, &objectSnapshotMeta{pbMeta: &pb.ObjectSnapshotMeta{
+			Id:    NewObjectIDFromTimestamp(now.Add(-time.Duration(i) * time.Minute)).Hex(),
+			Index: uint64(5 - i),
+			Size:  10,
+		}})
+	}
+	prunedFn := func(policy SnapshotRetentionPolicy) int {
+		return len(policy.prune(metaList, now))
+	}
+
+	assert.Equal(t, 0, prunedFn(SnapshotRetentionPolicy{}))
+	assert.Equal(t, 3, prunedFn(SnapshotRetentionPolicy{Count: 2}))
+	assert.Equal(t, 2, prunedFn(SnapshotRetentionPolicy{MaxAge: 150 * time.Second}))
+	assert.Equal(t, 1, prunedFn(SnapshotRetentionPolicy{MaxBytes: 40}))
+	// The latest snapshot is always kept.
+	assert.Equal(t, 4, prunedFn(SnapshotRetentionPolicy{MaxBytes: 1}))
+	assert.Equal(t, 4, prunedFn(SnapshotRetentionPolicy{Count: 3, MaxAge: time.Second}))
+	assert.Equal(t, metaList[3:], SnapshotRetentionPolicy{Count: 3}.prune(metaList, now))
+}
+
+func TestSnapshotServiceSnapshot(t *testing.T) {
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	server.snapshotService = newSnapshotService(server)
+	server.snapshotService.Start()
+
+	_, err := server.Snapshot().Result()
+	assert.ErrorIs(t, err, ErrNothingToSnapshot)
+
+	// The latest snapshot is resolved if it's not stale.
+	lastSnapshotMeta := &objectSnapshotMeta{pbMeta: &pb.ObjectSnapshotMeta{
+		Id:            NewObjectID().Hex(),
+		Index:         5,
+		Configuration: server.confStore.Committed().Configuration,
+	}}
+	server.snapshotService.lastSnapshotMeta = lastSnapshotMeta
+	server.setLastApplied(5, 1)
+	assert.Equal(t, lastSnapshotMeta, ƒAssertNoError2(server.Snapshot().Result())(t))
+
+	server.snapshotService.Stop()
+	_, err = server.Snapshot().Result()
+	assert.ErrorIs(t, err, ErrServerShutdown)
+}
+
+func TestSnapshotSchedulerDue(t *testing.T) {
+	dueFn := func(policy SnapshotPolicy, progress snapshotProgress) bool {
+		s := &snapshotScheduler{
+			server:      testingServer(t, SnapshotPolicyOption(policy)),
+			lastTrigger: snapshotProgress{applies: 10, index: 100, bytes: 1000, at: time.Unix(100, 0)},
+		}
+		return s.due(progress)
+	}
+	progress := snapshotProgress{applies: 15, index: 110, bytes: 1500, at: time.Unix(110, 0)}
+
+	assert.True(t, dueFn(SnapshotPolicy{Applies: 5}, progress))
+	assert.False(t, dueFn(SnapshotPolicy{Applies: 6}, progress))
+	assert.True(t, dueFn(SnapshotPolicy{Entries: 10}, progress))
+	assert.False(t, dueFn(SnapshotPolicy{Entries: 11}, progress))
+	assert.True(t, dueFn(SnapshotPolicy{Bytes: 500}, progress))
+	assert.False(t, dueFn(SnapshotPolicy{Bytes: 501}, progress))
+	assert.True(t, dueFn(SnapshotPolicy{Interval: 10 * time.Second}, progress))
+	assert.False(t, dueFn(SnapshotPolicy{Interval: 11 * time.Second}, progress))
+	// Any of the thresholds triggers a snapshot.
+	assert.True(t, dueFn(SnapshotPolicy{Applies: 100, Bytes: 500}, progress))
+
+	assert.Error(t, SnapshotPolicy{}.validate())
+	assert.Error(t, SnapshotPolicy{Interval: -time.Second}.validate())
+	assert.NoError(t, SnapshotPolicy{Bytes: 1 << 20}.validate())
+}
@@ -1,7 +1,9 @@
 package raft
 
 import (
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type ServerRole uint32
@@ -41,6 +43,15 @@ type serverState struct {
 	stateLastLogIndex    uint64       // volatile
 	stateLastVoteSummary atomic.Value // voteSummary persistent
 	stateShutdownState   uint32       // volatile
+
+	// stateLastLeaderContact is the time in Unix nanoseconds when we heard
+	// from the current leader for the last time.
+	stateLastLeaderContact int64 // volatile
+
+	// voteMu serializes the votes granted, which are handled concurrently,
+	// and the votes for ourself when an election starts, so that at most one
+	// vote is cast in a term.
+	voteMu sync.Mutex
 }
 
 func (s *Server) restoreStates() error {
@@ -56,7 +67,10 @@ func (s *Server) role() ServerRole {
 }
 
 func (s *Server) setRole(role ServerRole) {
-	atomic.StoreUint32((*uint32)(&s.serverState.stateRole), uint32(role))
+	previous := atomic.SwapUint32((*uint32)(&s.serverState.stateRole), uint32(role))
+	if ServerRole(previous) != role {
+		s.publishEvent(EventRoleChanged, role.String())
+	}
 }
 
 func (s *Server) currentTerm() uint64 {
@@ -97,6 +111,26 @@ func (s *Server) setLastVoteSummary(term uint64, candidate string) {
 	s.serverState.stateLastVoteSummary.Store(summary)
 }
 
+func (s *Server) lastLeaderContact() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.serverState.stateLastLeaderContact))
+}
+
+func (s *Server) setLastLeaderContact(t time.Time) {
+	atomic.StoreInt64(&s.serverState.stateLastLeaderContact, t.UnixNano())
+}
+
+// leaderAlive reports whether we're the leader or have heard from the current
+// leader within the minimum election timeout.
+func (s *Server) leaderAlive() bool {
+	if s.role() == Leader {
+		return true
+	}
+	if s.Leader().Id == "" {
+		return false
+	}
+	return s.opts().clock.Now().Sub(s.lastLeaderContact()) < s.opts().followerTimeout
+}
+
 func (server *Server) shutdownState() bool {
 	return atomic.LoadUint32(&server.serverState.stateShutdownState) != 0
 }
@@ -14,11 +14,11 @@ const (
 )
 
 type BoltStateStore struct {
-	db *bbolt.DB
+	db *boltDB
 }
 
 func NewBoltStateStore(db *bbolt.DB) *BoltStateStore {
-	return &BoltStateStore{db: db}
+	return &BoltStateStore{db: &boltDB{db: db}}
 }
 
 func (s *BoltStateStore) CurrentTerm() (uint64, error) {
@@ -0,0 +1,108 @@
+package raft
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStateSize is the size of a state file without the candidate, which
+// consists of the current term (8 bytes), the term of the last vote (8 bytes),
+// and the CRC of the states (4 bytes).
+const fileStateSize = 20
+
+// FileStateStore is a StateStore that keeps the states in a single file. The
+// file is replaced atomically every time a state is set.
+type FileStateStore struct {
+	path string
+
+	mu          sync.Mutex // protects currentTerm, lastVote, and the file
+	currentTerm uint64
+	lastVote    voteSummary
+}
+
+// NewFileStateStore opens or creates a FileStateStore at path.
+func NewFileStateStore(path string) (*FileStateStore, error) {
+	s := &FileStateStore{path: path, lastVote: nilVoteSummary}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(b) < fileStateSize {
+		return nil, ErrCorruptedState
+	}
+	states := b[:len(b)-4]
+	if crc32.Checksum(states, walCRCTable) != binary.BigEndian.Uint32(b[len(b)-4:]) {
+		return nil, ErrCorruptedState
+	}
+	s.currentTerm = binary.BigEndian.Uint64(states[0:8])
+	s.lastVote = voteSummary{
+		term:      binary.BigEndian.Uint64(states[8:16]),
+		candidate: string(states[16:]),
+	}
+	return s, nil
+}
+
+// writeLocked writes the states to a temporary file and renames it to the
+// path. s.mu must be held.
+func (s *FileStateStore) writeLocked(currentTerm uint64, lastVote voteSummary) error {
+	b := make([]byte, fileStateSize+len(lastVote.candidate))
+	binary.BigEndian.PutUint64(b[0:8], currentTerm)
+	binary.BigEndian.PutUint64(b[8:16], lastVote.term)
+	copy(b[16:], lastVote.candidate)
+	binary.BigEndian.PutUint32(b[len(b)-4:], crc32.Checksum(b[:len(b)-4], walCRCTable))
+
+	tmpPath := s.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	s.currentTerm = currentTerm
+	s.lastVote = lastVote
+	return nil
+}
+
+func (s *FileStateStore) CurrentTerm() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.currentTerm, nil
+}
+
+func (s *FileStateStore) SetCurrentTerm(currentTerm uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(currentTerm, s.lastVote)
+}
+
+func (s *FileStateStore) LastVote() (voteSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastVote, nil
+}
+
+func (s *FileStateStore) SetLastVote(summary voteSummary) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(s.currentTerm, summary)
+}
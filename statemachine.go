@@ -1,19 +1,163 @@
 package raft
 
+import (
+	"context"
+	"encoding"
+	"errors"
+	"math"
+	"sync"
+
+	"github.com/sumimakito/raft/pb"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// StateMachine is the application state replicated by the cluster.
+//
+// Apply is called sequentially, never concurrently, with the commands of the
+// committed log entries in log order. Entries are delivered exactly once with
+// strictly increasing indexes and no gaps except for the non-command entries
+// and the entries compacted into a snapshot passed to Restore. The ordering can
+// be verified at runtime with ApplyOrderCheckOption.
+//
+// Apply returns the result of the command, e.g., the previous value or whether
+// a compare-and-swap succeeded, which is returned by ApplyFuture.Response on
+// the leader. Only the results of []byte and encoding.BinaryMarshaler are
+// carried as bytes to the servers and the API clients the logs are applied
+// through; other results are dropped there.
+//
+// An error returned as the result fails ApplyFuture.Response with the error.
+// It must be deterministic, i.e., returned by all servers with the command
+// left unapplied, e.g., an invalid command. The errors that depend on the
+// server, e.g., a failing disk, are wrapped with TransientApplyError and
+// handled with the ApplyErrorPolicy.
+//
+// Restore replaces the state with the snapshot. It is canceled once the
+// server shuts down, which is observable with RestoreContext.
 type StateMachine interface {
-	Apply(command Command)
+	Apply(command Command) interface{}
 	Snapshot() (StateMachineSnapshot, error)
 	Restore(snapshot Snapshot) error
 }
 
+// LogApplier is an optional interface that can be implemented by a
+// StateMachine to receive the committed log entries instead of the bare
+// commands, e.g., to deduplicate requests or to audit by the extensions
+// attached to the entries. ApplyLog is called in place of Apply with the same
+// guarantees, and returns the result in the same way. The log entry must not be
+// modified.
+type LogApplier interface {
+	ApplyLog(log *pb.Log) interface{}
+}
+
+// LeadershipStateMachine is an optional interface that can be implemented by a
+// StateMachine to start and stop the work only done on the leader, e.g.,
+// timers or external locks. OnPromote is called once the server becomes the
+// leader of the term, when the logs committed by the previous leaders may be
+// yet to be applied. OnDemote is called once the server is no longer the
+// leader, including when it shuts down. They are called by the main loop,
+// never concurrently with Apply, and must not block.
+type LeadershipStateMachine interface {
+	OnPromote(term uint64)
+	OnDemote()
+}
+
+// ConfigurationStateMachine is an optional interface that can be implemented by
+// a StateMachine to be informed of the membership changes. ApplyConfiguration
+// is called with each committed configuration log entry in the order of the
+// logs, including the joint configurations whose Next is the new peer set. It
+// is not called for the entries compacted by a snapshot being restored, so the
+// state machine that depends on the membership should keep it in the snapshots.
+// The configuration must not be modified.
+type ConfigurationStateMachine interface {
+	ApplyConfiguration(index uint64, configuration *pb.Configuration)
+}
+
+// ApplyErrorPolicy decides what to do when StateMachine.Apply returns an error
+// wrapped with TransientApplyError.
+type ApplyErrorPolicy uint8
+
+const (
+	// ApplyErrorContinue logs the error and goes on applying the logs, taking
+	// the log as applied, which leaves the state machine of the server without
+	// the effects of the log.
+	ApplyErrorContinue ApplyErrorPolicy = 1 + iota
+	// ApplyErrorUnhealthy goes on like ApplyErrorContinue, but reports the
+	// server as unhealthy until it restarts.
+	ApplyErrorUnhealthy
+	// ApplyErrorHalt stops applying the logs and shuts down the server with
+	// the error. The log is applied again once the server restarts.
+	ApplyErrorHalt
+)
+
+func (p ApplyErrorPolicy) String() string {
+	switch p {
+	case ApplyErrorContinue:
+		return "Continue"
+	case ApplyErrorUnhealthy:
+		return "Unhealthy"
+	case ApplyErrorHalt:
+		return "Halt"
+	}
+	return "Unknown"
+}
+
+type transientApplyError struct {
+	err error
+}
+
+func (e *transientApplyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientApplyError) Unwrap() error {
+	return e.err
+}
+
+// TransientApplyError marks the error returned by StateMachine.Apply as
+// specific to the server, so that it is handled with the ApplyErrorPolicy.
+func TransientApplyError(err error) error {
+	return &transientApplyError{err: err}
+}
+
+// IsTransientApplyError reports whether the error is wrapped with
+// TransientApplyError.
+func IsTransientApplyError(err error) bool {
+	var e *transientApplyError
+	return errors.As(err, &e)
+}
+
 type StateMachineSnapshot interface {
 	Write(sink SnapshotSink) error
 }
 
 type stateMachineSnapshot struct {
 	StateMachineSnapshot
-	Index uint64
-	Term  uint64
+	Index    uint64
+	Term     uint64
+	Sessions *pb.SessionTable
+	// Configuration is the last configuration applied, or nil if none is
+	// applied since the server started.
+	Configuration *configuration
+}
+
+// write writes the client sessions, if any, followed by the snapshot of the
+// state machine through a SnapshotWriter.
+func (s *stateMachineSnapshot) write(ctx context.Context, sink SnapshotSink, progress func(SnapshotProgress)) error {
+	w := newSnapshotWriter(ctx, sink, progress)
+	if err := writeSessions(w, s.Sessions); err != nil {
+		return err
+	}
+	var err error
+	if snapshot, ok := s.StateMachineSnapshot.(StreamingStateMachineSnapshot); ok {
+		err = snapshot.WriteStream(ctx, w)
+	} else {
+		err = s.StateMachineSnapshot.Write(&snapshotWriterSink{SnapshotSink: sink, writer: w})
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
 }
 
 // stateMachineProxy acts as a proxy between the underlying StateMachine and
@@ -21,18 +165,97 @@ type stateMachineSnapshot struct {
 type stateMachineProxy struct {
 	server *Server
 	StateMachine
+
+	// lastMeta is the meta of the last log entry passed to Apply().
+	// Only tracked when the apply order check is enabled.
+	lastMeta *pb.LogMeta
+	// configuration is the configuration in the last configuration log
+	// passed to Apply() or in the last snapshot restored. The committed
+	// configuration may be ahead of it, as the logs are applied after they
+	// are committed.
+	configuration *configuration
+
+	sessions sessionTable
 }
 
 func newStateMachineProxy(server *Server, stateMachine StateMachine) *stateMachineProxy {
 	return &stateMachineProxy{server: server, StateMachine: stateMachine}
 }
 
-// Apply receives a command and its containing log's index and term, apply the
-// command to the underlying StateMachine and records the index and term.
+// checkOrder ensures the log entry immediately follows the last one passed to
+// Apply() and matches the entry in the LogStore. The server panics with
+// diagnostics on violations.
+func (a *stateMachineProxy) checkOrder(log *pb.Log) {
+	if last := a.lastMeta; last != nil {
+		if log.Meta.Index != last.Index+1 {
+			a.server.logger.Panicw("apply order violated: log index is not contiguous",
+				logFields(a.server,
+					zap.Object("last_applied_log", last),
+					zap.Object("log", log.Meta),
+					zap.Uint64("expected_index", last.Index+1))...)
+		}
+		if log.Meta.Term < last.Term {
+			a.server.logger.Panicw("apply order violated: log term decreased",
+				logFields(a.server,
+					zap.Object("last_applied_log", last),
+					zap.Object("log", log.Meta))...)
+		}
+	}
+	stored, err := a.server.logStore.Meta(log.Meta.Index)
+	if err != nil {
+		a.server.logger.Panicw("apply order check failed: error reading the log",
+			logFields(a.server, zap.Object("log", log.Meta), zap.Error(err))...)
+	}
+	if stored == nil || stored.Term != log.Meta.Term {
+		a.server.logger.Panicw("apply order violated: log does not match the LogStore",
+			logFields(a.server, zap.Object("log", log.Meta), zap.Reflect("stored_log", stored))...)
+	}
+	a.lastMeta = log.Meta.Copy()
+}
+
+// Apply receives a committed log entry and applies its command, if any, to the
+// underlying StateMachine, and returns the result of the command. The client
+// sessions are registered and checked here.
 // Unsafe for concurrent use.
-func (a *stateMachineProxy) Apply(command Command) {
-	a.StateMachine.Apply(command)
-	a.server.snapshotService.Scheduler().CountApply()
+func (a *stateMachineProxy) Apply(log *pb.Log) (interface{}, error) {
+	if a.server.opts().applyOrderCheck {
+		a.checkOrder(log)
+	}
+	switch log.Body.Type {
+	case pb.LogType_COMMAND:
+		if log.Body.Session != nil {
+			return a.applySession(log)
+		}
+		return a.applyCommand(log)
+	case pb.LogType_REGISTER_SESSION:
+		a.sessions.register(log.Meta.Index, a.server.opts().sessionCapacity)
+		return EncodeUint64(log.Meta.Index), nil
+	case pb.LogType_CONFIGURATION:
+		var configuration pb.Configuration
+		if err := proto.Unmarshal(log.Body.Data, &configuration); err != nil {
+			return nil, err
+		}
+		a.configuration = newConfiguration(&configuration, log.Meta.Index)
+		if m, ok := a.StateMachine.(ConfigurationStateMachine); ok {
+			m.ApplyConfiguration(log.Meta.Index, &configuration)
+		}
+	}
+	return nil, nil
+}
+
+// applyCommand applies the command of the log to the underlying StateMachine.
+// The error returned as the result is returned as the error.
+func (a *stateMachineProxy) applyCommand(log *pb.Log) (response interface{}, err error) {
+	if applier, ok := a.StateMachine.(LogApplier); ok {
+		response = applier.ApplyLog(log)
+	} else {
+		response = a.StateMachine.Apply(log.Body.Data)
+	}
+	a.server.snapshotService.CountApply()
+	if err, ok := response.(error); ok {
+		return nil, err
+	}
+	return response, nil
 }
 
 func (a *stateMachineProxy) Snapshot() (*stateMachineSnapshot, error) {
@@ -41,5 +264,153 @@ func (a *stateMachineProxy) Snapshot() (*stateMachineSnapshot, error) {
 		return nil, err
 	}
 	lastApplied := a.server.lastApplied()
-	return &stateMachineSnapshot{StateMachineSnapshot: s, Index: lastApplied.Index, Term: lastApplied.Term}, nil
+	return &stateMachineSnapshot{
+		StateMachineSnapshot: s,
+		Index:                lastApplied.Index,
+		Term:                 lastApplied.Term,
+		Sessions:             a.sessions.copy(),
+		Configuration:        a.configuration,
+	}, nil
+}
+
+// Restore restores the client sessions and the state machine from the
+// snapshot. The restoration is canceled once the server shuts down, and its
+// progress is reported to the function set with SnapshotProgressOption.
+func (a *stateMachineProxy) Restore(snapshot Snapshot) error {
+	meta, err := snapshot.Meta()
+	if err != nil {
+		return err
+	}
+	reader, err := snapshot.Reader()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := stopContext(a.server.stopCh)
+	defer cancel()
+	reader = &contextReader{ctx: ctx, reader: newProgressReader(reader, meta, a.server.opts().snapshotProgress)}
+	sessions, reader, err := ReadSnapshotSessions(reader)
+	if err != nil {
+		return err
+	}
+	if m, ok := a.StateMachine.(StreamingStateMachine); ok {
+		if err := m.RestoreStream(ctx, meta, reader); err != nil {
+			return err
+		}
+	} else if err := a.StateMachine.Restore(&sessionSnapshot{Snapshot: snapshot, reader: reader, ctx: ctx}); err != nil {
+		return err
+	}
+	a.sessions.restore(sessions)
+	if c := meta.Configuration(); c != nil {
+		a.configuration = newConfiguration(c.Copy(), meta.ConfigurationIndex())
+	}
+	if a.server.opts().applyOrderCheck {
+		// Entries after the snapshot are expected next.
+		a.lastMeta = &pb.LogMeta{Index: meta.Index(), Term: meta.Term()}
+	}
+	return nil
+}
+
+// applyResponse is a future waiting for the result of StateMachine.Apply on the
+// log appended by the leader in the term.
+type applyResponse struct {
+	term   uint64
+	future Future[interface{}]
+}
+
+// applyResponses holds the applyResponses keyed by the log indexes. The zero
+// value is ready for use.
+type applyResponses struct {
+	mu        sync.Mutex // protects responses
+	responses map[uint64]applyResponse
+}
+
+// add registers the future of the log, which must happen before the log can
+// be committed.
+func (r *applyResponses) add(meta *pb.LogMeta, future Future[interface{}]) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.responses == nil {
+		r.responses = map[uint64]applyResponse{}
+	}
+	r.responses[meta.Index] = applyResponse{term: meta.Term, future: future}
+}
+
+// resolve sets the result of the applied log. The future fails with
+// ErrLeadershipLost if the log has been replaced by a log of another term.
+func (r *applyResponses) resolve(meta *pb.LogMeta, response interface{}, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending, ok := r.responses[meta.Index]
+	if !ok {
+		return
+	}
+	delete(r.responses, meta.Index)
+	if pending.term != meta.Term {
+		pending.future.setResult(nil, ErrLeadershipLost)
+		return
+	}
+	pending.future.setResult(response, err)
+}
+
+// traceStage moves the trace of the pending log, if any, to the next stage.
+func (r *applyResponses) traceStage(meta *pb.LogMeta, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if pending, ok := r.responses[meta.Index]; ok && pending.term == meta.Term {
+		traceStage(pending.future, name)
+	}
+}
+
+// traceContext returns the context of the current stage of the trace of the
+// first log from firstIndex to lastIndex applied with a trace, or
+// context.Background() if there's none.
+func (r *applyResponses) traceContext(firstIndex, lastIndex uint64) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ctx context.Context
+	var first uint64
+	for index, pending := range r.responses {
+		if index < firstIndex || index > lastIndex || ctx != nil && index > first {
+			continue
+		}
+		if f, ok := pending.future.(*tracedFuture); ok {
+			if traceCtx, ok := f.trace.stageContext(); ok {
+				ctx, first = traceCtx, index
+			}
+		}
+	}
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// failUpTo fails the futures of the logs up to the index with err, e.g., the
+// logs compacted into a restored snapshot that are never applied.
+func (r *applyResponses) failUpTo(index uint64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, pending := range r.responses {
+		if i <= index {
+			delete(r.responses, i)
+			pending.future.setResult(nil, err)
+		}
+	}
+}
+
+// fail fails all futures with err.
+func (r *applyResponses) fail(err error) {
+	r.failUpTo(math.MaxUint64, err)
+}
+
+// encodeApplyResponse returns the bytes of the result of StateMachine.Apply
+// carried in the ApplyLogResponse, or nil if the result cannot be carried.
+func encodeApplyResponse(response interface{}) ([]byte, error) {
+	switch r := response.(type) {
+	case []byte:
+		return r, nil
+	case encoding.BinaryMarshaler:
+		return r.MarshalBinary()
+	}
+	return nil, nil
 }
@@ -0,0 +1,55 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+)
+
+func TestStateMachineProxyApplyOrderCheck(t *testing.T) {
+	server := testingServer(t, ApplyOrderCheckOption(true))
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	for i := uint64(1); i <= 6; i++ {
+		assert.NoError(t, server.logStore.AppendLogs([]*pb.Log{
+			{Meta: &pb.LogMeta{Index: i, Term: 1}, Body: &pb.LogBody{Type: pb.LogType_NOOP}},
+		}))
+	}
+	proxy := newStateMachineProxy(server, &testingStateMachine{})
+	applyFn := func(index, term uint64) func() {
+		return func() {
+			proxy.Apply(&pb.Log{Meta: &pb.LogMeta{Index: index, Term: term}, Body: &pb.LogBody{Type: pb.LogType_NOOP}})
+		}
+	}
+
+	assert.NotPanics(t, applyFn(1, 1))
+	assert.NotPanics(t, applyFn(2, 1))
+	// Out of order.
+	assert.Panics(t, applyFn(4, 1))
+	// Duplicate.
+	assert.Panics(t, applyFn(2, 1))
+	// Not matching the log in the LogStore.
+	assert.Panics(t, applyFn(3, 2))
+	// The violations are not recorded as the last applied log.
+	assert.NotPanics(t, applyFn(3, 1))
+	assert.Equal(t, uint64(3), proxy.lastMeta.Index)
+
+	// The logs following the restored snapshot are expected next.
+	store := NewObjectSnapshotStore(NewInmemObjectStore(), "")
+	c := &pb.Configuration{Current: &pb.Config{Peers: []*pb.Peer{{Id: "1", Endpoint: "1"}}}}
+	sink := ƒAssertNoError2(store.Create(5, 1, c, 1))(t)
+	assert.NoError(t, sink.Close())
+	snapshot := ƒAssertNoError2(store.Open(sink.Meta().Id()))(t)
+	defer snapshot.Close()
+	assert.NoError(t, proxy.Restore(snapshot))
+	assert.Equal(t, uint64(5), proxy.lastMeta.Index)
+	assert.Panics(t, applyFn(4, 1))
+	assert.NotPanics(t, applyFn(6, 1))
+
+	// The order is not checked if disabled.
+	server.options.Store(applyServerOpts())
+	proxy = newStateMachineProxy(server, &testingStateMachine{})
+	assert.NotPanics(t, applyFn(4, 1))
+	assert.NotPanics(t, applyFn(2, 1))
+	assert.Nil(t, proxy.lastMeta)
+}
@@ -1,10 +1,154 @@
 package raft
 
-import "go.etcd.io/bbolt"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sumimakito/raft/pb"
+	"go.etcd.io/bbolt"
+)
+
+// boltCompactTxMaxSize is the maximum size of a transaction used to copy the
+// data during compaction.
+const boltCompactTxMaxSize = 64 << 20
+
+// boltDB holds a bbolt database shared by the bbolt-backed stores. The database
+// may be swapped by compaction.
+type boltDB struct {
+	mu sync.RWMutex // protects db
+	db *bbolt.DB
+}
+
+func (b *boltDB) View(fn func(*bbolt.Tx) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.db.View(fn)
+}
+
+func (b *boltDB) Update(fn func(*bbolt.Tx) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.db.Update(fn)
+}
+
+func (b *boltDB) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.db.Close()
+}
+
+// boltRename renames the compacted database file over the current one. It's
+// replaced in the tests to simulate the failures.
+var boltRename = os.Rename
+
+// Compact copies the live data into a new database file and replaces the
+// current database file with it. The current database file is reopened if it
+// cannot be replaced.
+func (b *boltDB) Compact() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	path := b.db.Path()
+	compactPath := path + ".compact"
+	origPath := path + ".orig"
+	for _, p := range []string{compactPath, origPath} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	dst, err := bbolt.Open(compactPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	if err := bbolt.Compact(dst, b.db, boltCompactTxMaxSize); err != nil {
+		dst.Close()
+		os.Remove(compactPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(compactPath)
+		return err
+	}
+	// Keep a link to the current database file so that it can be reopened if
+	// the compacted one cannot be.
+	if err := os.Link(path, origPath); err != nil {
+		os.Remove(compactPath)
+		return err
+	}
+	defer os.Remove(origPath)
+	if err := b.db.Close(); err != nil {
+		os.Remove(compactPath)
+		return b.reopen(path, err)
+	}
+	if err := boltRename(compactPath, path); err != nil {
+		os.Remove(compactPath)
+		return b.reopen(path, err)
+	}
+	syncErr := syncDir(filepath.Dir(path))
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		if renameErr := os.Rename(origPath, path); renameErr != nil {
+			return fmt.Errorf("%w; failed to restore the database file: %v", err, renameErr)
+		}
+		return b.reopen(path, err)
+	}
+	b.db = db
+	return syncErr
+}
+
+// reopen opens the database file at the path after a failed compaction and
+// returns the error of the compaction. The error of the reopening is also
+// returned if the database file cannot be reopened, leaving the database
+// closed.
+func (b *boltDB) reopen(path string, err error) error {
+	db, openErr := bbolt.Open(path, 0600, nil)
+	if openErr != nil {
+		return fmt.Errorf("%w; failed to reopen the database file: %v", err, openErr)
+	}
+	b.db = db
+	return err
+}
+
+// syncDir syncs the directory so that the renames in it are durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (b *boltDB) StorageStats() (StorageStats, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	info, err := os.Stat(b.db.Path())
+	if err != nil {
+		return StorageStats{}, err
+	}
+	pageSize := int64(b.db.Info().PageSize)
+	// The meta pages are always in use.
+	livePages := int64(2)
+	if err := b.db.View(func(t *bbolt.Tx) error {
+		return t.ForEach(func(name []byte, bucket *bbolt.Bucket) error {
+			stats := bucket.Stats()
+			livePages += int64(stats.BranchPageN + stats.BranchOverflowN + stats.LeafPageN + stats.LeafOverflowN)
+			return nil
+		})
+	}); err != nil {
+		return StorageStats{}, err
+	}
+	return newStorageStats(info.Size(), livePages*pageSize), nil
+}
 
 type BoltStore struct {
 	LogStore
 	StateStore
+
+	db *boltDB
 }
 
 func NewBoltStore(path string) (*BoltStore, error) {
@@ -12,7 +156,30 @@ func NewBoltStore(path string) (*BoltStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	logStore := NewBoltLogStore(db)
-	stateStore := NewBoltStateStore(db)
-	return &BoltStore{LogStore: logStore, StateStore: stateStore}, nil
+	b := &boltDB{db: db}
+	logStore := &BoltLogStore{db: b}
+	stateStore := &BoltStateStore{db: b}
+	return &BoltStore{LogStore: logStore, StateStore: stateStore, db: b}, nil
+}
+
+// Compact reclaims the disk space freed by trimmed logs. Operations on the
+// BoltStore are blocked during the compaction.
+func (s *BoltStore) Compact() error {
+	return s.db.Compact()
+}
+
+func (s *BoltStore) RetainsLogs() bool {
+	return false
+}
+
+func (s *BoltStore) StorageStats() (StorageStats, error) {
+	return s.db.StorageStats()
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Entries(firstIndex, lastIndex uint64) ([]*pb.Log, error) {
+	return logStoreEntries(s.LogStore, firstIndex, lastIndex)
 }
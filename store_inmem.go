@@ -0,0 +1,7 @@
+package raft
+
+// NewInmemStore returns a StableStore that keeps the logs and the states in
+// memory, e.g., for the tests.
+func NewInmemStore() StableStore {
+	return Must2(newInternalStore())
+}
@@ -1,5 +1,7 @@
 package raft
 
+import "github.com/sumimakito/raft/pb"
+
 type internalStore struct {
 	LogStore
 	StateStore
@@ -10,3 +12,7 @@ func newInternalStore() (*internalStore, error) {
 	stateStore := newInternalStateStore()
 	return &internalStore{LogStore: logStore, StateStore: stateStore}, nil
 }
+
+func (s *internalStore) Entries(firstIndex, lastIndex uint64) ([]*pb.Log, error) {
+	return logStoreEntries(s.LogStore, firstIndex, lastIndex)
+}
@@ -0,0 +1,31 @@
+package raft
+
+import (
+	"path/filepath"
+)
+
+// walStoreStateFile is the name of the file the WALStore keeps the states in.
+const walStoreStateFile = "state"
+
+// WALStore is a StableStore that keeps the logs in a WALLogStore and the
+// states in a FileStateStore in the same directory. It only depends on the
+// standard library, and is the default choice for a persistent StableStore.
+type WALStore struct {
+	*WALLogStore
+	*FileStateStore
+}
+
+// NewWALStore opens or creates a WALStore in dir. The options are applied to
+// the WALLogStore.
+func NewWALStore(dir string, opts ...WALLogStoreOption) (*WALStore, error) {
+	logStore, err := NewWALLogStore(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	stateStore, err := NewFileStateStore(filepath.Join(dir, walStoreStateFile))
+	if err != nil {
+		logStore.Close()
+		return nil, err
+	}
+	return &WALStore{WALLogStore: logStore, FileStateStore: stateStore}, nil
+}
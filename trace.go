@@ -0,0 +1,315 @@
+package raft
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sumimakito/raft/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Tracer starts the spans of the logs applied through the pipeline on the
+// leader and of the incoming RPCs, so that the latency can be attributed to
+// the storage, the network, or the quorum. The otelraft module adapts an
+// OpenTelemetry trace.Tracer and propagation.TextMapPropagator to it.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, if any, and returns
+	// the context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject writes the trace context in ctx to the carrier sent along with
+	// the outgoing RPCs.
+	Inject(ctx context.Context, carrier map[string]string)
+	// Extract returns ctx with the trace context read from the carrier of an
+	// incoming RPC.
+	Extract(ctx context.Context, carrier map[string]string) context.Context
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End(err error)
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+
+func (nopSpan) End(error) {}
+
+// startSpan starts a span with the Tracer, if any.
+func (s *Server) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if tracer := s.opts().tracer; tracer != nil {
+		return tracer.Start(ctx, name)
+	}
+	return ctx, nopSpan{}
+}
+
+// traceOutgoing returns ctx with the carrier of its trace context, which is
+// sent along with the outgoing RPCs made with ctx.
+func (s *Server) traceOutgoing(ctx context.Context) context.Context {
+	tracer := s.opts().tracer
+	if tracer == nil {
+		return ctx
+	}
+	carrier := map[string]string{}
+	tracer.Inject(ctx, carrier)
+	return context.WithValue(ctx, traceCarrierKey{}, carrier)
+}
+
+// traceReplication starts the span of a replication RPC sent to the peer as
+// a child of the span in parent, if any. ctx is returned with the carrier of
+// the span, which is sent along with the RPC, while it keeps the deadline and
+// the cancellation of ctx.
+func (s *Server) traceReplication(ctx, parent context.Context, name string, peer *pb.Peer) (context.Context, Span) {
+	tracer := s.opts().tracer
+	if tracer == nil {
+		return ctx, nopSpan{}
+	}
+	spanCtx, span := tracer.Start(parent, name)
+	span.SetAttribute("raft.peer", peer.Id)
+	carrier := map[string]string{}
+	tracer.Inject(spanCtx, carrier)
+	return context.WithValue(ctx, traceCarrierKey{}, carrier), span
+}
+
+// traceAppendEntries starts the span of an AppendEntries RPC replicating the
+// logs from firstIndex to lastIndex to the peer, as a child of the commit stage
+// of the first of them applied with a trace, if any.
+func (s *Server) traceAppendEntries(ctx context.Context, peer *pb.Peer, firstIndex, lastIndex uint64) (context.Context, Span) {
+	if s.opts().tracer == nil {
+		return ctx, nopSpan{}
+	}
+	ctx, span := s.traceReplication(ctx, s.applyResponses.traceContext(firstIndex, lastIndex), "raft.replicate.AppendEntries", peer)
+	span.SetAttribute("raft.first_index", firstIndex)
+	span.SetAttribute("raft.last_index", lastIndex)
+	return ctx, span
+}
+
+// traceIncoming starts the span of an incoming RPC as a child of the trace
+// context sent along with the RPC, if any.
+func (s *Server) traceIncoming(ctx context.Context, name string) (context.Context, Span) {
+	tracer := s.opts().tracer
+	if tracer == nil {
+		return ctx, nopSpan{}
+	}
+	if carrier, ok := ctx.Value(traceCarrierKey{}).(map[string]string); ok {
+		ctx = tracer.Extract(ctx, carrier)
+	}
+	return tracer.Start(ctx, name)
+}
+
+// traceCarrierKey is the context key of the trace carrier of an RPC.
+type traceCarrierKey struct{}
+
+const (
+	// traceMetadataPrefix prefixes the keys of the trace carrier in the gRPC
+	// metadata, except for those of the W3C trace context.
+	traceMetadataPrefix = "raft-trace-"
+	// requestIDMetadataKey is the key of the request ID in the gRPC metadata.
+	requestIDMetadataKey = "raft-request-id"
+	// RequestIDHeader is the HTTP header of the request ID accepted by the API
+	// server.
+	RequestIDHeader = "X-Request-Id"
+)
+
+// w3cTraceContextKeys are the keys of the W3C trace context, which are sent
+// as they are so that the trace context is understood by other services.
+var w3cTraceContextKeys = map[string]struct{}{
+	"traceparent": {},
+	"tracestate":  {},
+}
+
+// outgoingTraceContext returns ctx with the request ID and the trace carrier
+// in the outgoing gRPC metadata. Without a Tracer, the trace carrier received
+// from the incoming request is forwarded as it is.
+func outgoingTraceContext(ctx context.Context) context.Context {
+	var kv []string
+	if requestID := RequestID(ctx); requestID != "" {
+		kv = append(kv, requestIDMetadataKey, requestID)
+	}
+	carrier, _ := ctx.Value(traceCarrierKey{}).(map[string]string)
+	for key, value := range carrier {
+		key = strings.ToLower(key)
+		if _, ok := w3cTraceContextKeys[key]; !ok {
+			key = traceMetadataPrefix + key
+		}
+		kv = append(kv, key, value)
+	}
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// incomingTraceContext returns ctx with the request ID and the trace carrier
+// received in the incoming gRPC metadata.
+func incomingTraceContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	carrier := map[string]string{}
+	for key, values := range md {
+		if len(values) == 0 {
+			continue
+		}
+		switch _, w3c := w3cTraceContextKeys[key]; {
+		case key == requestIDMetadataKey:
+			ctx = WithRequestID(ctx, values[0])
+		case w3c:
+			carrier[key] = values[0]
+		case strings.HasPrefix(key, traceMetadataPrefix):
+			carrier[strings.TrimPrefix(key, traceMetadataPrefix)] = values[0]
+		}
+	}
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, traceCarrierKey{}, carrier)
+}
+
+// incomingHTTPTraceContext returns the context of the HTTP request with the
+// request ID and the W3C trace context received in the headers.
+func incomingHTTPTraceContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if requestID := r.Header.Get(RequestIDHeader); requestID != "" {
+		ctx = WithRequestID(ctx, requestID)
+	}
+	carrier := map[string]string{}
+	for key := range w3cTraceContextKeys {
+		if value := r.Header.Get(key); value != "" {
+			carrier[key] = value
+		}
+	}
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, traceCarrierKey{}, carrier)
+}
+
+// traceUnaryClientInterceptor sends the request ID and the trace carrier in
+// the context along with the RPCs in the gRPC metadata.
+func traceUnaryClientInterceptor(
+	ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption,
+) error {
+	return invoker(outgoingTraceContext(ctx), method, req, reply, cc, opts...)
+}
+
+func traceStreamClientInterceptor(
+	ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	return streamer(outgoingTraceContext(ctx), desc, cc, method, opts...)
+}
+
+// traceUnaryServerInterceptor puts the request ID and the trace carrier
+// received in the gRPC metadata into the context of the RPC.
+func traceUnaryServerInterceptor(
+	ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+) (interface{}, error) {
+	return handler(incomingTraceContext(ctx), req)
+}
+
+func traceStreamServerInterceptor(
+	srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+) error {
+	return handler(srv, &tracedServerStream{ServerStream: ss, ctx: incomingTraceContext(ss.Context())})
+}
+
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// applyTrace traces a log applied on the leader through the stages of the
+// pipeline, i.e., queueing for the main loop, appending to the LogStore,
+// waiting for the quorum to commit, and applying to the StateMachine. Each
+// stage is a child span of the span of Apply.
+type applyTrace struct {
+	ctx context.Context
+	s   *Server
+
+	mu       sync.Mutex // protects span, stage, and stageCtx
+	span     Span
+	stage    Span
+	stageCtx context.Context
+}
+
+func (s *Server) newApplyTrace(ctx context.Context) *applyTrace {
+	ctx, span := s.startSpan(ctx, "raft.Apply")
+	t := &applyTrace{ctx: ctx, s: s, span: span}
+	t.next("raft.Apply.queue")
+	return t
+}
+
+// next ends the current stage and starts the next one.
+func (t *applyTrace) next(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.span == nil {
+		return
+	}
+	if t.stage != nil {
+		t.stage.End(nil)
+	}
+	t.stageCtx, t.stage = t.s.startSpan(t.ctx, name)
+}
+
+// stageContext returns the context carrying the span of the current stage, if
+// the trace has not ended.
+func (t *applyTrace) stageContext() (context.Context, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stageCtx, t.stageCtx != nil
+}
+
+// setAttribute sets the attribute on the span of Apply.
+func (t *applyTrace) setAttribute(key string, value interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.span != nil {
+		t.span.SetAttribute(key, value)
+	}
+}
+
+// end ends the current stage and the span of Apply. Only the first call takes
+// effect.
+func (t *applyTrace) end(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.span == nil {
+		return
+	}
+	if t.stage != nil {
+		t.stage.End(err)
+	}
+	t.span.End(err)
+	t.span, t.stage, t.stageCtx = nil, nil, nil
+}
+
+// tracedFuture is the future of the result of StateMachine.Apply on a log
+// traced by the applyTrace, which ends along with the future.
+type tracedFuture struct {
+	Future[interface{}]
+	trace *applyTrace
+}
+
+func (f *tracedFuture) setResult(value interface{}, err error) {
+	f.trace.end(err)
+	f.Future.setResult(value, err)
+}
+
+// traceStage moves the trace of the future, if any, to the next stage.
+func traceStage(future Future[interface{}], name string) {
+	if f, ok := future.(*tracedFuture); ok {
+		f.trace.next(name)
+	}
+}
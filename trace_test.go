@@ -0,0 +1,127 @@
+package raft
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumimakito/raft/pb"
+	"google.golang.org/grpc/metadata"
+)
+
+type testingSpanKey struct{}
+
+type testingSpan struct {
+	tracer *testingTracer
+	name   string
+	parent string
+}
+
+func (s *testingSpan) SetAttribute(key string, value interface{}) {}
+
+func (s *testingSpan) End(err error) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.ended = append(s.tracer.ended, s.parent+">"+s.name)
+}
+
+type testingTracer struct {
+	mu    sync.Mutex
+	ended []string
+}
+
+func (t *testingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(testingSpanKey{}).(string)
+	return context.WithValue(ctx, testingSpanKey{}, name), &testingSpan{tracer: t, name: name, parent: parent}
+}
+
+func (t *testingTracer) Inject(ctx context.Context, carrier map[string]string) {
+	if span, ok := ctx.Value(testingSpanKey{}).(string); ok {
+		carrier["Span"] = span
+	}
+}
+
+func (t *testingTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return context.WithValue(ctx, testingSpanKey{}, carrier["span"])
+}
+
+func TestServerApplyTrace(t *testing.T) {
+	tracer := &testingTracer{}
+	server := testingServer(t, TracerOption(tracer))
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.snapshotService = newSnapshotService(server)
+	server.snapshotService.StartScheduler()
+	defer server.snapshotService.StopScheduler()
+	server.stateMachine = newStateMachineProxy(server, &testingEchoStateMachine{})
+	server.logOpsCh = make(chan logStoreOp, 8)
+	server.serverState.stateCurrentTerm = 1
+	server.setRole(Leader)
+
+	ctx := context.WithValue(context.Background(), testingSpanKey{}, "client")
+	future := server.ApplyCommand(ctx, Command("command"))
+	server.handleLogOp(<-server.logOpsCh)
+	meta := ƒAssertNoError2(future.Result())(t)
+
+	// The AppendEntries RPCs replicating the log are traced as children of
+	// its commit stage, and the follower continues the trace.
+	replicateCtx, replicateSpan := server.traceAppendEntries(context.Background(), &pb.Peer{Id: "2"}, meta.Index, meta.Index)
+	md, _ := metadata.FromOutgoingContext(outgoingTraceContext(replicateCtx))
+	_, span := server.traceIncoming(incomingTraceContext(metadata.NewIncomingContext(context.Background(), md)), "raft.AppendEntries")
+	span.End(nil)
+	replicateSpan.End(nil)
+	// Heartbeats have no traced logs to be parented to.
+	_, heartbeatSpan := server.traceAppendEntries(context.Background(), &pb.Peer{Id: "2"}, meta.Index+1, meta.Index)
+	heartbeatSpan.End(nil)
+
+	server.commitAndApply(meta.Index)
+	ƒAssertNoError2(future.Response())(t)
+	assert.Equal(t, []string{
+		"raft.Apply>raft.Apply.queue",
+		"raft.Apply>raft.Apply.append",
+		"raft.replicate.AppendEntries>raft.AppendEntries",
+		"raft.Apply.commit>raft.replicate.AppendEntries",
+		">raft.replicate.AppendEntries",
+		"raft.Apply>raft.Apply.commit",
+		"raft.Apply>raft.Apply.fsm",
+		"client>raft.Apply",
+	}, tracer.ended)
+
+	// The trace context is sent along with the outgoing RPCs.
+	ctx = server.traceOutgoing(ctx)
+	md, _ = metadata.FromOutgoingContext(outgoingTraceContext(ctx))
+	ctx = incomingTraceContext(metadata.NewIncomingContext(context.Background(), md))
+	_, span = server.traceIncoming(ctx, "raft.ApplyLog")
+	span.End(nil)
+	assert.Equal(t, "client>raft.ApplyLog", tracer.ended[len(tracer.ended)-1])
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	trans := ƒAssertNoError2(NewGRPCTransport("127.0.0.1:0"))(t)
+	go trans.Serve()
+	defer trans.Close()
+	go func() {
+		rpc := <-trans.RPC()
+		carrier, _ := rpc.Context().Value(traceCarrierKey{}).(map[string]string)
+		rpc.Respond(&pb.ApplyLogResponse{Result: []byte(rpc.RequestID() + " " + carrier["traceparent"])}, nil)
+	}()
+
+	const traceParent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	ctx := WithRequestID(context.Background(), "request")
+	ctx = context.WithValue(ctx, traceCarrierKey{}, map[string]string{"traceparent": traceParent})
+	response := ƒAssertNoError2(trans.ApplyLog(ctx, &pb.Peer{Id: "1", Endpoint: trans.Endpoint()}, &pb.ApplyLogRequest{}))(t)
+	assert.Equal(t, "request "+traceParent, string(response.Result))
+
+	// The request ID and the W3C trace context are accepted by the API server
+	// in the HTTP headers.
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/logs", nil)
+	r.Header.Set(RequestIDHeader, "request")
+	r.Header.Set("traceparent", traceParent)
+	ctx = incomingHTTPTraceContext(r)
+	assert.Equal(t, "request", RequestID(ctx))
+	md, _ := metadata.FromOutgoingContext(outgoingTraceContext(ctx))
+	assert.Equal(t, []string{"request"}, md.Get(requestIDMetadataKey))
+	assert.Equal(t, []string{traceParent}, md.Get("traceparent"))
+}
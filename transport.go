@@ -2,6 +2,7 @@ package raft
 
 import (
 	"context"
+	"errors"
 	"io"
 
 	"github.com/sumimakito/raft/pb"
@@ -15,6 +16,8 @@ type Transport interface {
 	RequestVote(ctx context.Context, peer *pb.Peer, request *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error)
 	InstallSnapshot(ctx context.Context, peer *pb.Peer, requestMeta *pb.InstallSnapshotRequestMeta, reader io.Reader) (*pb.InstallSnapshotResponse, error)
 	ApplyLog(ctx context.Context, peer *pb.Peer, request *pb.ApplyLogRequest) (*pb.ApplyLogResponse, error)
+	ChangeMembership(ctx context.Context, peer *pb.Peer, request *pb.MembershipChangeRequest) (*pb.MembershipChangeResponse, error)
+	TimeoutNow(ctx context.Context, peer *pb.Peer, request *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error)
 
 	RPC() <-chan *RPC
 }
@@ -36,3 +39,43 @@ type TransportServer interface {
 type TransportCloser interface {
 	Close() error
 }
+
+// TransportRetryPolicySetter is an optional interface for those implementations
+// that retry failed calls and allow the server to supply its RetryPolicy.
+type TransportRetryPolicySetter interface {
+	SetRetryPolicy(policy RetryPolicy)
+}
+
+// TransportHealthCheckerSetter is an optional interface for those
+// implementations that serve a health check and allow the server to supply
+// the function that decides whether it is healthy.
+type TransportHealthCheckerSetter interface {
+	SetHealthChecker(checker func() bool)
+}
+
+type notDeliveredError struct {
+	err error
+}
+
+func (e *notDeliveredError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notDeliveredError) Unwrap() error {
+	return e.err
+}
+
+// NotDeliveredError marks the error of a Transport call as failed before the
+// request could reach the peer, e.g., as the peer is unknown or cannot be
+// connected. Only such calls are retried by the servers redirecting the
+// requests to the leader, as the others may have been handled already.
+func NotDeliveredError(err error) error {
+	return &notDeliveredError{err: err}
+}
+
+// IsNotDeliveredError reports whether the error is wrapped with
+// NotDeliveredError.
+func IsNotDeliveredError(err error) bool {
+	var e *notDeliveredError
+	return errors.As(err, &e)
+}
@@ -1,24 +1,75 @@
 package raft
 
 import (
+	"bufio"
 	"context"
 	"encoding/base64"
 	"errors"
 	"io"
 	"log"
 	"net"
-	"net/rpc"
 	"sync"
 	"sync/atomic"
 
 	"github.com/sumimakito/raft/pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
+const (
+	defaultGRPCSnapshotChunkSize  = 1 << 20
+	defaultGRPCSnapshotBufferSize = 1 << 20
+)
+
+type grpcTransportOptions struct {
+	snapshotBufferSize int
+	snapshotChunkSize  int
+}
+
+type GRPCTransportOption func(options *grpcTransportOptions)
+
+// GRPCSnapshotChunkSizeOption sets the maximum size in bytes of the chunks
+// streamed in InstallSnapshot. The size should stay below the maximum message
+// size of gRPC, which is 4MB by default. Defaults to 1MB.
+func GRPCSnapshotChunkSizeOption(size int) GRPCTransportOption {
+	return func(options *grpcTransportOptions) {
+		options.snapshotChunkSize = size
+	}
+}
+
+// GRPCSnapshotBufferSizeOption sets the size in bytes of the buffers on both
+// ends of the pipe that passes the received snapshot to the server, and of
+// the buffer used to read the snapshot to send. Defaults to 1MB.
+func GRPCSnapshotBufferSizeOption(size int) GRPCTransportOption {
+	return func(options *grpcTransportOptions) {
+		options.snapshotBufferSize = size
+	}
+}
+
+func applyGRPCTransportOpts(opts ...GRPCTransportOption) *grpcTransportOptions {
+	options := &grpcTransportOptions{
+		snapshotBufferSize: defaultGRPCSnapshotBufferSize,
+		snapshotChunkSize:  defaultGRPCSnapshotChunkSize,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.snapshotBufferSize <= 0 {
+		options.snapshotBufferSize = defaultGRPCSnapshotBufferSize
+	}
+	if options.snapshotChunkSize <= 0 {
+		options.snapshotChunkSize = defaultGRPCSnapshotChunkSize
+	}
+	return options
+}
+
 type grpcTransService struct {
+	opts  *grpcTransportOptions
 	rpcCh chan *RPC
 	pb.UnimplementedTransportServer
 }
@@ -64,11 +115,11 @@ func (s *grpcTransService) InstallSnapshot(stream pb.Transport_InstallSnapshotSe
 	}
 
 	pr, pw := io.Pipe()
-	writer := NewBufferedWriteCloser(pw)
+	writer := NewBufferedWriteCloserSize(pw, s.opts.snapshotBufferSize)
 
 	request := &InstallSnapshotRequest{
 		Metadata: &requestMeta,
-		Reader:   NewBufferedReadCloser(pr),
+		Reader:   NewBufferedReadCloserSize(pr, s.opts.snapshotBufferSize),
 	}
 
 	r := NewRPC(stream.Context(), request)
@@ -110,13 +161,37 @@ func (s *grpcTransService) ApplyLog(ctx context.Context, request *pb.ApplyLogReq
 	return response.(*pb.ApplyLogResponse), nil
 }
 
+func (s *grpcTransService) ChangeMembership(
+	ctx context.Context, request *pb.MembershipChangeRequest,
+) (*pb.MembershipChangeResponse, error) {
+	r := NewRPC(ctx, request)
+	s.rpcCh <- r
+	response, err := r.Response()
+	if err != nil {
+		return nil, err
+	}
+	return response.(*pb.MembershipChangeResponse), nil
+}
+
+func (s *grpcTransService) TimeoutNow(ctx context.Context, request *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error) {
+	r := NewRPC(ctx, request)
+	s.rpcCh <- r
+	response, err := r.Response()
+	if err != nil {
+		return nil, err
+	}
+	return response.(*pb.TimeoutNowResponse), nil
+}
+
 type grpcTransClient struct {
 	conn   *grpc.ClientConn
 	client pb.TransportClient
 }
 
 type GRPCTransport struct {
+	opts    *grpcTransportOptions
 	service *grpcTransService
+	health  *healthService
 	server  *grpc.Server
 
 	listener net.Listener
@@ -125,17 +200,25 @@ type GRPCTransport struct {
 
 	clients   map[string]*grpcTransClient
 	clientsMu sync.RWMutex // protects clients
+
+	retryPolicy   RetryPolicy
+	retryPolicyMu sync.RWMutex // protects retryPolicy
 }
 
-func NewGRPCTransport(listenAddr string) (*GRPCTransport, error) {
+func NewGRPCTransport(listenAddr string, opts ...GRPCTransportOption) (*GRPCTransport, error) {
 	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return nil, err
 	}
+	options := applyGRPCTransportOpts(opts...)
 	return &GRPCTransport{
-		service:  &grpcTransService{rpcCh: make(chan *RPC, 16)},
+		opts:     options,
+		service:  &grpcTransService{opts: options, rpcCh: make(chan *RPC, 16)},
+		health:   newHealthService(nil, pb.Transport_ServiceDesc.ServiceName),
 		listener: listener,
 		clients:  map[string]*grpcTransClient{},
+		// Retry once immediately by default.
+		retryPolicy: ConstantRetryPolicy{MaxAttempts: 1},
 	}, nil
 }
 
@@ -143,7 +226,10 @@ func (t *GRPCTransport) connectLocked(peer *pb.Peer) error {
 	if _, ok := t.clients[peer.Id]; ok {
 		return nil
 	}
-	conn, err := grpc.Dial(peer.Endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial(peer.Endpoint,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(traceUnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(traceStreamClientInterceptor))
 	if err != nil {
 		return err
 	}
@@ -159,57 +245,56 @@ func (t *GRPCTransport) disconnectLocked(peer *pb.Peer) {
 	}
 }
 
-func (t *GRPCTransport) tryClient(peer *pb.Peer, fn func(c *grpcTransClient) error) error {
-	retryState := -1
-	var lastErr error
-	var client *grpcTransClient
-	var ok bool
-retryClient:
-	if retryState > 0 {
-		return lastErr
-	}
-	retryState++
+// client returns the client for the peer and connects to it if necessary.
+func (t *GRPCTransport) client(peer *pb.Peer) (*grpcTransClient, error) {
 	t.clientsMu.RLock()
-	client, ok = t.clients[peer.Id]
+	client, ok := t.clients[peer.Id]
 	t.clientsMu.RUnlock()
-	// Check if the client is unset
-	if !ok {
-		t.clientsMu.Lock()
-		// Check again to ensure the client is unset
-		client, ok = t.clients[peer.Id]
-		if ok {
-			// Client is set
-			t.clientsMu.Unlock()
-			goto tryCall
-		}
-		// Client is unset
-		// Try to connect it
-		if err := t.connectLocked(peer); err != nil {
-			t.clientsMu.Unlock()
-			return err
+	if ok {
+		return client, nil
+	}
+	t.clientsMu.Lock()
+	defer t.clientsMu.Unlock()
+	if err := t.connectLocked(peer); err != nil {
+		return nil, err
+	}
+	return t.clients[peer.Id], nil
+}
+
+// grpcRetryable reports whether the call failed because the peer is
+// unreachable, e.g., the connection is broken or the peer is shutting down,
+// rather than with an error returned by the peer.
+func grpcRetryable(err error) bool {
+	if s, ok := status.FromError(err); ok {
+		return s.Code() == codes.Unavailable
+	}
+	return false
+}
+
+func (t *GRPCTransport) tryClient(ctx context.Context, peer *pb.Peer, fn func(c *grpcTransClient) error) error {
+	t.retryPolicyMu.RLock()
+	policy := t.retryPolicy
+	t.retryPolicyMu.RUnlock()
+	return retry(ctx, policy, func() (bool, error) {
+		client, err := t.client(peer)
+		if err != nil {
+			return true, NotDeliveredError(err)
 		}
-		t.clientsMu.Unlock()
-		lastErr = errors.New("client not connected")
-		goto retryClient
-	}
-tryCall:
-	if err := fn(client); err != nil {
-		if err == rpc.ErrShutdown {
-			// Disconnect current client
-			t.clientsMu.Lock()
-			t.disconnectLocked(peer)
-			// And try to connect it again
-			if err := t.connectLocked(peer); err != nil {
+		if err := fn(client); err != nil {
+			if grpcRetryable(err) {
+				// Disconnect current client so that it will be connected again
+				// on the next attempt, unless another call has done so.
+				t.clientsMu.Lock()
+				if t.clients[peer.Id] == client {
+					t.disconnectLocked(peer)
+				}
 				t.clientsMu.Unlock()
-				return err
+				return true, err
 			}
-			t.clientsMu.Unlock()
-			lastErr = err
-			goto retryClient
+			return false, err
 		}
-		return err
-	}
-	return nil
+		return false, nil
+	})
 }
 
 func (t *GRPCTransport) Endpoint() string {
@@ -220,7 +305,7 @@ func (t *GRPCTransport) AppendEntries(
 	ctx context.Context, peer *pb.Peer, request *pb.AppendEntriesRequest,
 ) (*pb.AppendEntriesResponse, error) {
 	var response *pb.AppendEntriesResponse
-	if err := t.tryClient(peer, func(c *grpcTransClient) error {
+	if err := t.tryClient(ctx, peer, func(c *grpcTransClient) error {
 		r, err := c.client.AppendEntries(ctx, request)
 		if err != nil {
 			return err
@@ -237,7 +322,7 @@ func (t *GRPCTransport) RequestVote(
 	ctx context.Context, peer *pb.Peer, request *pb.RequestVoteRequest,
 ) (*pb.RequestVoteResponse, error) {
 	var response *pb.RequestVoteResponse
-	if err := t.tryClient(peer, func(c *grpcTransClient) error {
+	if err := t.tryClient(ctx, peer, func(c *grpcTransClient) error {
 		r, err := c.client.RequestVote(ctx, request)
 		if err != nil {
 			return err
@@ -254,7 +339,7 @@ func (t *GRPCTransport) InstallSnapshot(
 	ctx context.Context, peer *pb.Peer, requestMeta *pb.InstallSnapshotRequestMeta, reader io.Reader,
 ) (*pb.InstallSnapshotResponse, error) {
 	var response *pb.InstallSnapshotResponse
-	if err := t.tryClient(peer, func(c *grpcTransClient) error {
+	if err := t.tryClient(ctx, peer, func(c *grpcTransClient) error {
 		reqestMetaByets, err := proto.Marshal(requestMeta)
 		if err != nil {
 			return err
@@ -264,18 +349,22 @@ func (t *GRPCTransport) InstallSnapshot(
 		if err != nil {
 			return err
 		}
-		chunk := make([]byte, 4096)
+		bufferedReader := bufio.NewReaderSize(reader, t.opts.snapshotBufferSize)
+		chunk := make([]byte, t.opts.snapshotChunkSize)
 		for {
-			n, err := reader.Read(chunk)
-			if err == io.EOF {
+			// Fill the chunks as much as possible to reduce the messages.
+			n, err := io.ReadFull(bufferedReader, chunk)
+			if n > 0 {
+				if err := client.Send(&pb.InstallSnapshotRequestData{Data: chunk[:n]}); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				break
 			}
 			if err != nil {
 				return err
 			}
-			if err := client.Send(&pb.InstallSnapshotRequestData{Data: chunk[:n]}); err != nil {
-				return err
-			}
 		}
 		r, err := client.CloseAndRecv()
 		if err != nil {
@@ -293,7 +382,7 @@ func (t *GRPCTransport) ApplyLog(
 	ctx context.Context, peer *pb.Peer, request *pb.ApplyLogRequest,
 ) (*pb.ApplyLogResponse, error) {
 	var response *pb.ApplyLogResponse
-	if err := t.tryClient(peer, func(c *grpcTransClient) error {
+	if err := t.tryClient(ctx, peer, func(c *grpcTransClient) error {
 		r, err := c.client.ApplyLog(ctx, request)
 		if err != nil {
 			return err
@@ -306,6 +395,40 @@ func (t *GRPCTransport) ApplyLog(
 	return response, nil
 }
 
+func (t *GRPCTransport) ChangeMembership(
+	ctx context.Context, peer *pb.Peer, request *pb.MembershipChangeRequest,
+) (*pb.MembershipChangeResponse, error) {
+	var response *pb.MembershipChangeResponse
+	if err := t.tryClient(ctx, peer, func(c *grpcTransClient) error {
+		r, err := c.client.ChangeMembership(ctx, request)
+		if err != nil {
+			return err
+		}
+		response = r
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *GRPCTransport) TimeoutNow(
+	ctx context.Context, peer *pb.Peer, request *pb.TimeoutNowRequest,
+) (*pb.TimeoutNowResponse, error) {
+	var response *pb.TimeoutNowResponse
+	if err := t.tryClient(ctx, peer, func(c *grpcTransClient) error {
+		r, err := c.client.TimeoutNow(ctx, request)
+		if err != nil {
+			return err
+		}
+		response = r
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
 func (t *GRPCTransport) RPC() <-chan *RPC {
 	return t.service.rpcCh
 }
@@ -315,11 +438,26 @@ func (t *GRPCTransport) Serve() error {
 		panic("Serve() should be only called once")
 	}
 	log.Println("transport started", "addr", t.listener.Addr())
-	t.server = grpc.NewServer()
+	t.server = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(traceUnaryServerInterceptor),
+		grpc.ChainStreamInterceptor(traceStreamServerInterceptor))
 	pb.RegisterTransportServer(t.server, t.service)
+	healthpb.RegisterHealthServer(t.server, t.health)
 	return t.server.Serve(t.listener)
 }
 
+func (t *GRPCTransport) SetRetryPolicy(policy RetryPolicy) {
+	t.retryPolicyMu.Lock()
+	defer t.retryPolicyMu.Unlock()
+	t.retryPolicy = policy
+}
+
+// SetHealthChecker sets the function that decides whether the health service
+// reports SERVING. NOT_SERVING is reported until a checker is set.
+func (t *GRPCTransport) SetHealthChecker(checker func() bool) {
+	t.health.setChecker(checker)
+}
+
 func (t *GRPCTransport) Connect(peer *pb.Peer) error {
 	t.clientsMu.RLock()
 	if _, ok := t.clients[peer.Id]; ok {
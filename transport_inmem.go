@@ -0,0 +1,22 @@
+package raft
+
+// InmemNetwork connects the InmemTransports created on it in the process.
+type InmemNetwork struct {
+	lookup *internalTransClientLookup
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{lookup: newInternalTransClientLookup()}
+}
+
+// InmemTransport is a Transport that delivers the RPCs to the other
+// InmemTransports on the same InmemNetwork by their endpoints, e.g., for the
+// clusters run in the tests. An InmemTransport is reachable once served and
+// unreachable once closed.
+type InmemTransport struct {
+	*internalTransport
+}
+
+func NewInmemTransport(network *InmemNetwork, endpoint string) *InmemTransport {
+	return &InmemTransport{internalTransport: Must2(newInternalTransport(network.lookup, endpoint))}
+}
@@ -31,10 +31,14 @@ func (l *internalTransClientLookup) Register(client *internalTransClient) {
 	l.clients[client.endpoint] = client
 }
 
+// Unregister removes the client unless the endpoint has been registered again
+// by another client, e.g., of a restarted server.
 func (l *internalTransClientLookup) Unregister(client *internalTransClient) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	delete(l.clients, client.endpoint)
+	if l.clients[client.endpoint] == client {
+		delete(l.clients, client.endpoint)
+	}
 }
 
 type internalTransClient struct {
@@ -46,10 +50,30 @@ func newInternalTransClient(endpoint string) *internalTransClient {
 	return &internalTransClient{endpoint: endpoint, rpcCh: make(chan *RPC, 16)}
 }
 
-func (s *internalTransClient) AppendEntries(ctx context.Context, request *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+// call sends the request and waits for the response. The RPC fails with the
+// error of ctx once it's done, as the server may never receive or respond to
+// the RPC after it shuts down.
+func (s *internalTransClient) call(ctx context.Context, request interface{}) (interface{}, error) {
 	r := NewRPC(ctx, request)
-	s.rpcCh <- r
-	response, err := r.Response()
+	select {
+	case s.rpcCh <- r:
+	case <-ctx.Done():
+		return nil, NotDeliveredError(ctx.Err())
+	}
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Respond(nil, ctx.Err())
+		case <-doneCh:
+		}
+	}()
+	return r.Response()
+}
+
+func (s *internalTransClient) AppendEntries(ctx context.Context, request *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	response, err := s.call(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -57,9 +81,7 @@ func (s *internalTransClient) AppendEntries(ctx context.Context, request *pb.App
 }
 
 func (s *internalTransClient) RequestVote(ctx context.Context, request *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
-	r := NewRPC(ctx, request)
-	s.rpcCh <- r
-	response, err := r.Response()
+	response, err := s.call(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -76,10 +98,7 @@ func (s *internalTransClient) InstallSnapshot(
 		Reader:   io.NopCloser(reader),
 	}
 
-	r := NewRPC(ctx, request)
-	s.rpcCh <- r
-
-	response, err := r.Response()
+	response, err := s.call(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -87,15 +106,31 @@ func (s *internalTransClient) InstallSnapshot(
 }
 
 func (s *internalTransClient) ApplyLog(ctx context.Context, request *pb.ApplyLogRequest) (*pb.ApplyLogResponse, error) {
-	r := NewRPC(ctx, request)
-	s.rpcCh <- r
-	response, err := r.Response()
+	response, err := s.call(ctx, request)
 	if err != nil {
 		return nil, err
 	}
 	return response.(*pb.ApplyLogResponse), nil
 }
 
+func (s *internalTransClient) ChangeMembership(
+	ctx context.Context, request *pb.MembershipChangeRequest,
+) (*pb.MembershipChangeResponse, error) {
+	response, err := s.call(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return response.(*pb.MembershipChangeResponse), nil
+}
+
+func (s *internalTransClient) TimeoutNow(ctx context.Context, request *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error) {
+	response, err := s.call(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return response.(*pb.TimeoutNowResponse), nil
+}
+
 type internalTransport struct {
 	lookup   *internalTransClientLookup
 	endpoint string
@@ -115,7 +150,7 @@ func (t *internalTransport) AppendEntries(
 ) (*pb.AppendEntriesResponse, error) {
 	client, ok := t.lookup.Get(peer.Endpoint)
 	if !ok {
-		return nil, errors.Wrapf(ErrUnknownTransporClient, "client %s not registered", peer.Endpoint)
+		return nil, NotDeliveredError(errors.Wrapf(ErrUnknownTransporClient, "client %s not registered", peer.Endpoint))
 	}
 	response, err := client.AppendEntries(ctx, request)
 	if err != nil {
@@ -129,7 +164,7 @@ func (t *internalTransport) RequestVote(
 ) (*pb.RequestVoteResponse, error) {
 	client, ok := t.lookup.Get(peer.Endpoint)
 	if !ok {
-		return nil, errors.Wrapf(ErrUnknownTransporClient, "client %s not registered", peer.Endpoint)
+		return nil, NotDeliveredError(errors.Wrapf(ErrUnknownTransporClient, "client %s not registered", peer.Endpoint))
 	}
 	response, err := client.RequestVote(ctx, request)
 	if err != nil {
@@ -143,7 +178,7 @@ func (t *internalTransport) InstallSnapshot(
 ) (*pb.InstallSnapshotResponse, error) {
 	client, ok := t.lookup.Get(peer.Endpoint)
 	if !ok {
-		return nil, errors.Wrapf(ErrUnknownTransporClient, "client %s not registered", peer.Endpoint)
+		return nil, NotDeliveredError(errors.Wrapf(ErrUnknownTransporClient, "client %s not registered", peer.Endpoint))
 	}
 	response, err := client.InstallSnapshot(ctx, requestMeta, reader)
 	if err != nil {
@@ -157,7 +192,7 @@ func (t *internalTransport) ApplyLog(
 ) (*pb.ApplyLogResponse, error) {
 	client, ok := t.lookup.Get(peer.Endpoint)
 	if !ok {
-		return nil, errors.Wrapf(ErrUnknownTransporClient, "client %s not registered", peer.Endpoint)
+		return nil, NotDeliveredError(errors.Wrapf(ErrUnknownTransporClient, "client %s not registered", peer.Endpoint))
 	}
 	response, err := client.ApplyLog(ctx, request)
 	if err != nil {
@@ -166,6 +201,34 @@ func (t *internalTransport) ApplyLog(
 	return response, nil
 }
 
+func (t *internalTransport) ChangeMembership(
+	ctx context.Context, peer *pb.Peer, request *pb.MembershipChangeRequest,
+) (*pb.MembershipChangeResponse, error) {
+	client, ok := t.lookup.Get(peer.Endpoint)
+	if !ok {
+		return nil, NotDeliveredError(errors.Wrapf(ErrUnknownTransporClient, "client %s not registered", peer.Endpoint))
+	}
+	response, err := client.ChangeMembership(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *internalTransport) TimeoutNow(
+	ctx context.Context, peer *pb.Peer, request *pb.TimeoutNowRequest,
+) (*pb.TimeoutNowResponse, error) {
+	client, ok := t.lookup.Get(peer.Endpoint)
+	if !ok {
+		return nil, NotDeliveredError(errors.Wrapf(ErrUnknownTransporClient, "client %s not registered", peer.Endpoint))
+	}
+	response, err := client.TimeoutNow(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
 func (t *internalTransport) RPC() <-chan *RPC {
 	return t.client.rpcCh
 }
@@ -3,10 +3,19 @@ package raft
 import (
 	"context"
 	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/sumimakito/raft/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 func testTransport(t *testing.T, transFn func(peer *pb.Peer) (Transport, error), peerFn func() (*pb.Peer, error)) {
@@ -27,6 +36,7 @@ func testTransport(t *testing.T, transFn func(peer *pb.Peer) (Transport, error),
 	}
 	_, err := trans1.AppendEntries(context.Background(), peer2, appendEntriesRequest)
 	assert.True(t, errors.Is(err, ErrUnknownTransporClient))
+	assert.True(t, IsNotDeliveredError(err))
 
 	testingTransportServe(t, trans2)
 
@@ -50,3 +60,124 @@ func TestTransports(t *testing.T) {
 	})
 
 }
+
+func TestGRPCTransportInstallSnapshot(t *testing.T) {
+	trans1 := ƒAssertNoError2(NewGRPCTransport("127.0.0.1:0", GRPCSnapshotChunkSizeOption(3)))(t)
+	trans2 := ƒAssertNoError2(NewGRPCTransport("127.0.0.1:0", GRPCSnapshotBufferSizeOption(16)))(t)
+	for _, trans := range []*GRPCTransport{trans1, trans2} {
+		go trans.Serve()
+	}
+	defer trans1.Close()
+	defer trans2.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		rpc := <-trans2.RPC()
+		request := rpc.Request().(*InstallSnapshotRequest)
+		data, err := io.ReadAll(request.Reader)
+		rpc.Respond(&pb.InstallSnapshotResponse{Term: request.Metadata.Term}, err)
+		received <- data
+	}()
+
+	peer2 := &pb.Peer{Id: "2", Endpoint: trans2.Endpoint()}
+	response := ƒAssertNoError2(trans1.InstallSnapshot(context.Background(), peer2,
+		&pb.InstallSnapshotRequestMeta{Term: 1}, strings.NewReader("snapshot data")))(t)
+	assert.Equal(t, uint64(1), response.Term)
+	assert.Equal(t, []byte("snapshot data"), <-received)
+}
+
+// testingFailingTransportServer fails the RequestVote calls with the code
+// until failures calls have failed.
+type testingFailingTransportServer struct {
+	pb.UnimplementedTransportServer
+	code     codes.Code
+	failures int32
+	calls    int32
+}
+
+func (s *testingFailingTransportServer) RequestVote(
+	ctx context.Context, request *pb.RequestVoteRequest,
+) (*pb.RequestVoteResponse, error) {
+	if atomic.AddInt32(&s.calls, 1) <= s.failures {
+		return nil, status.Error(s.code, "failed")
+	}
+	return &pb.RequestVoteResponse{Term: request.Term, Granted: true}, nil
+}
+
+func TestGRPCTransportRetry(t *testing.T) {
+	serverFn := func(code codes.Code, failures int32) (*testingFailingTransportServer, *pb.Peer) {
+		listener := ƒAssertNoError2(net.Listen("tcp", "127.0.0.1:0"))(t)
+		service := &testingFailingTransportServer{code: code, failures: failures}
+		server := grpc.NewServer()
+		pb.RegisterTransportServer(server, service)
+		go server.Serve(listener)
+		t.Cleanup(server.Stop)
+		return service, &pb.Peer{Id: "2", Endpoint: listener.Addr().String()}
+	}
+	trans := ƒAssertNoError2(NewGRPCTransport("127.0.0.1:0"))(t)
+	defer trans.DisconnectAll()
+	trans.SetRetryPolicy(ConstantRetryPolicy{MaxAttempts: 2})
+
+	// The unavailable peer is called again with a new connection.
+	service, peer := serverFn(codes.Unavailable, 2)
+	assert.NoError(t, trans.Connect(peer))
+	client := ƒAssertNoError2(trans.client(peer))(t)
+	response := ƒAssertNoError2(trans.RequestVote(context.Background(), peer, &pb.RequestVoteRequest{Term: 1}))(t)
+	assert.True(t, response.Granted)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&service.calls))
+	assert.NotSame(t, client, ƒAssertNoError2(trans.client(peer))(t))
+
+	// The attempts are bounded by the RetryPolicy.
+	service, peer = serverFn(codes.Unavailable, 3)
+	peer.Id = "3"
+	_, err := trans.RequestVote(context.Background(), peer, &pb.RequestVoteRequest{Term: 1})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&service.calls))
+
+	// The errors returned by the peer are not retried.
+	service, peer = serverFn(codes.Internal, 1)
+	peer.Id = "4"
+	_, err = trans.RequestVote(context.Background(), peer, &pb.RequestVoteRequest{Term: 1})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&service.calls))
+}
+
+func TestGRPCTransportHealth(t *testing.T) {
+	trans := ƒAssertNoError2(NewGRPCTransport("127.0.0.1:0"))(t)
+	go trans.Serve()
+	defer trans.Close()
+
+	conn := ƒAssertNoError2(grpc.Dial(trans.Endpoint(), grpc.WithTransportCredentials(insecure.NewCredentials())))(t)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	check := func(service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+		response, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			return 0, err
+		}
+		return response.Status, nil
+	}
+
+	// NOT_SERVING is reported until a checker is set.
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, ƒAssertNoError2(check(""))(t))
+
+	server := testingServer(t)
+	server.logStore = newLogStoreProxy(server, newInternalLogStore())
+	server.confStore = ƒAssertNoError2(newConfigurationStore(server))(t)
+	server.confStore.SetLatest(newConfiguration(&pb.Configuration{Current: &pb.Config{
+		Peers: []*pb.Peer{{Id: server.id, Endpoint: server.id}},
+	}}, 1))
+	trans.SetHealthChecker(server.healthy)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, ƒAssertNoError2(check(""))(t))
+	server.setLeader(&pb.Peer{Id: "2", Endpoint: "2"})
+	server.setLastLeaderContact(server.opts().clock.Now())
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, ƒAssertNoError2(check(""))(t))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING,
+		ƒAssertNoError2(check(pb.Transport_ServiceDesc.ServiceName))(t))
+	server.setLeader(nil)
+	server.setRole(Leader)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, ƒAssertNoError2(check(""))(t))
+
+	_, err := check("unknown")
+	assert.Error(t, err)
+}
@@ -28,6 +28,8 @@ func testingTransportRPCResponder(rpcCh <-chan *RPC) (stopCh chan struct{}) {
 					rpc.Respond(&pb.InstallSnapshotResponse{}, nil)
 				case *pb.ApplyLogRequest:
 					rpc.Respond(&pb.ApplyLogResponse{}, nil)
+				case *pb.MembershipChangeRequest:
+					rpc.Respond(&pb.MembershipChangeResponse{}, nil)
 				default:
 					rpc.Respond(nil, ErrUnknownRPC)
 				}
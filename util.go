@@ -2,9 +2,11 @@ package raft
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"io"
 	"log"
+	"math/rand"
 	"path"
 	"path/filepath"
 	"reflect"
@@ -68,6 +70,15 @@ func NewBufferedReadCloser(r io.ReadCloser) *BufferedReadCloser {
 	}
 }
 
+// NewBufferedReadCloserSize returns a BufferedReadCloser whose buffer has at
+// least the specified size.
+func NewBufferedReadCloserSize(r io.ReadCloser, size int) *BufferedReadCloser {
+	return &BufferedReadCloser{
+		reader: bufio.NewReaderSize(r, size),
+		closer: r,
+	}
+}
+
 func (r *BufferedReadCloser) Close() error {
 	return r.closer.Close()
 }
@@ -88,6 +99,15 @@ func NewBufferedWriteCloser(w io.WriteCloser) *BufferedWriteCloser {
 	}
 }
 
+// NewBufferedWriteCloserSize returns a BufferedWriteCloser whose buffer has at
+// least the specified size.
+func NewBufferedWriteCloserSize(w io.WriteCloser, size int) *BufferedWriteCloser {
+	return &BufferedWriteCloser{
+		writer: bufio.NewWriterSize(w, size),
+		closer: w,
+	}
+}
+
 func (w *BufferedWriteCloser) Close() error {
 	return w.closer.Close()
 }
@@ -336,3 +356,35 @@ func PathJoin(prefix, suffix string) string {
 	}
 	return filepath.Join(prefix, suffix)
 }
+
+// waitGroupContext waits for the WaitGroup until ctx is done, in which case
+// ErrDeadlineExceeded is returned.
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	doneCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		return ErrDeadlineExceeded
+	}
+}
+
+// lockedRand is a rand.Rand that is safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) Int63n(n int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Int63n(n)
+}
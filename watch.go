@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"context"
+	"time"
+
+	"github.com/sumimakito/raft/pb"
+)
+
+// watchLogsPollInterval is the interval between checks on the applied index
+// while watching for new logs.
+const watchLogsPollInterval = 10 * time.Millisecond
+
+// WatchLogs calls fn with the logs that have been committed and applied, in
+// the order of their indexes, starting from the log at fromIndex. Only the
+// logs of the types are passed to fn unless types is empty. WatchLogs blocks
+// until fn returns an error, which is returned, or ctx is done.
+// ErrLogsCompacted is returned if the logs to watch have been compacted by a
+// snapshot.
+func (s *Server) WatchLogs(ctx context.Context, fromIndex uint64, types []pb.LogType, fn func(log *pb.Log) error) error {
+	typeFilter := map[pb.LogType]struct{}{}
+	for _, t := range types {
+		typeFilter[t] = struct{}{}
+	}
+	next := fromIndex
+	if next == 0 {
+		next = 1
+	}
+
+	ticker := time.NewTicker(watchLogsPollInterval)
+	defer ticker.Stop()
+	for {
+		if lastApplied := s.lastApplied().Index; next <= lastApplied {
+			var err error
+			if next, err = s.watchLogs(next, lastApplied, typeFilter, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchLogs calls fn with the logs from the index first to last and returns
+// the index of the next log to watch.
+func (s *Server) watchLogs(first, last uint64, typeFilter map[pb.LogType]struct{}, fn func(log *pb.Log) error) (uint64, error) {
+	if firstLogIndex := s.firstLogIndex(); firstLogIndex == 0 || first < firstLogIndex {
+		return 0, ErrLogsCompacted
+	}
+	it := s.logStore.Iterator()
+	defer it.Close()
+	it.Seek(first)
+	for index := first; index <= last; index++ {
+		log, err := it.Next()
+		if err != nil {
+			return 0, err
+		}
+		if log == nil || log.Meta.Index != index {
+			// The logs are compacted after the check.
+			return 0, ErrLogsCompacted
+		}
+		if _, ok := typeFilter[log.Body.Type]; !ok && len(typeFilter) > 0 {
+			continue
+		}
+		if err := fn(log); err != nil {
+			return 0, err
+		}
+	}
+	return last + 1, nil
+}